@@ -0,0 +1,200 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errFileAccessTraceUnsupported = errors.New("tracing file accesses is not supported on this platform")
+
+// fileAccess is a file opened by a traced command.
+type fileAccess struct {
+	// path is the absolute path of the file.
+	path  string
+	write bool
+}
+
+// FileAccessTracer runs commands tracing files they read and write,
+// and compares them with the dependency graph. A file in the working
+// directory which a command reads is a missing dependency if it isn't
+// a prerequisite or an output of the target, nor written by commands
+// of the target before. Files outside the working directory, e.g.
+// system headers, aren't checked.
+type FileAccessTracer struct {
+	wd string
+
+	mu sync.Mutex
+	// missing are files read by targets without declaring them.
+	missing map[string]map[string]bool
+	// writers are targets which write files.
+	writers map[string]map[string]bool
+}
+
+// NewFileAccessTracer creates a FileAccessTracer for the current
+// directory. It fails if tracing isn't supported on the platform.
+func NewFileAccessTracer() (*FileAccessTracer, error) {
+	if !fileAccessTraceSupported {
+		return nil, errFileAccessTraceUnsupported
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return &FileAccessTracer{
+		wd:      wd,
+		missing: make(map[string]map[string]bool),
+		writers: make(map[string]map[string]bool),
+	}, nil
+}
+
+// RunCommand runs c in a subprocess, tracing files it accesses.
+func (t *FileAccessTracer) RunCommand(ctx context.Context, c *Command) error {
+	cmd, cleanup, err := localCommand(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	accesses, err := traceCommand(cmd)
+	t.record(c, accesses)
+	return err
+}
+
+// relToDir returns the path relative to dir, if path is in dir.
+func relToDir(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// record records files accessed by c.
+func (t *FileAccessTracer) record(c *Command, accesses []fileAccess) {
+	wd := c.Dir
+	if wd == "" {
+		wd = t.wd
+	}
+	declared := make(map[string]bool)
+	for _, paths := range [][]string{c.Inputs, c.Outputs} {
+		for _, p := range paths {
+			if filepath.IsAbs(p) {
+				p, _ = relToDir(wd, p)
+			}
+			declared[filepath.Clean(p)] = true
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, a := range accesses {
+		rel, ok := relToDir(wd, a.path)
+		if !ok {
+			continue
+		}
+		if a.write {
+			addToSet(t.writers, rel, c.Target)
+			continue
+		}
+		if declared[rel] || t.writers[rel][c.Target] {
+			continue
+		}
+		// reading directories, e.g. by wildcards in commands,
+		// doesn't depend on them.
+		if fi, err := os.Stat(a.path); err != nil || fi.IsDir() {
+			continue
+		}
+		addToSet(t.missing, c.Target, rel)
+	}
+}
+
+func addToSet(m map[string]map[string]bool, k, v string) {
+	s, ok := m[k]
+	if !ok {
+		s = make(map[string]bool)
+		m[k] = s
+	}
+	s[v] = true
+}
+
+func sortedSet(s map[string]bool) []string {
+	var r []string
+	for v := range s {
+		r = append(r, v)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// MissingDeps returns files which targets read without declaring them
+// as prerequisites, by targets.
+func (t *FileAccessTracer) MissingDeps() map[string][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := make(map[string][]string)
+	for target, files := range t.missing {
+		r[target] = sortedSet(files)
+	}
+	return r
+}
+
+// MultipleWriters returns files written by commands of more than one
+// target, with the targets.
+func (t *FileAccessTracer) MultipleWriters() map[string][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := make(map[string][]string)
+	for file, targets := range t.writers {
+		if len(targets) > 1 {
+			r[file] = sortedSet(targets)
+		}
+	}
+	return r
+}
+
+// WriteReport writes missing dependencies and files written by
+// multiple targets, e.g.
+//
+//	foo.o: missing prerequisites: foo.h
+//	gen.h: written by multiple targets: a b
+func (t *FileAccessTracer) WriteReport(w io.Writer) error {
+	for _, m := range []struct {
+		files map[string][]string
+		msg   string
+	}{
+		{t.MissingDeps(), "missing prerequisites"},
+		{t.MultipleWriters(), "written by multiple targets"},
+	} {
+		var keys []string
+		for k := range m.files {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, err := fmt.Fprintf(w, "%s: %s: %s\n", k, m.msg, strings.Join(m.files[k], " "))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package kati
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// Commands are traced by ptrace. Syscalls which open, execute, rename
+// or link files are decoded at their entries, and recorded at their
+// exits if they succeed.
+
+const fileAccessTraceSupported = true
+
+const atFDCWD = -100
+
+// fileSyscall is how to decode arguments of a syscall accessing a
+// file. Fields are indexes of arguments, or -1 if the syscall doesn't
+// have them.
+type fileSyscall struct {
+	dirfd int
+	path  int
+	// flags are open flags, which tell whether the file is written.
+	flags int
+	// how is struct open_how of openat2, whose first field is flags.
+	how   int
+	write bool
+}
+
+// tracee is the state of a traced thread.
+type tracee struct {
+	inSyscall bool
+	// access is the file accessed by the syscall being called, or nil.
+	access *fileAccess
+}
+
+// traceCommand runs cmd tracing files it accesses. It doesn't wait for
+// background processes of cmd.
+func traceCommand(cmd *exec.Cmd) ([]fileAccess, error) {
+	// cmd.Wait can't be used, as the process is reaped by the
+	// tracer, so output not to a file is copied here.
+	var wg sync.WaitGroup
+	var pipes []*os.File
+	redirect := func(w io.Writer) (io.Writer, error) {
+		if _, ok := w.(*os.File); ok || w == nil {
+			return w, nil
+		}
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		pipes = append(pipes, pw)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(w, pr)
+			pr.Close()
+		}()
+		return pw, nil
+	}
+	stdout, stderr := cmd.Stdout, cmd.Stderr
+	var err error
+	cmd.Stdout, err = redirect(stdout)
+	if err == nil {
+		if sameWriter(stdout, stderr) {
+			cmd.Stderr = cmd.Stdout
+		} else {
+			cmd.Stderr, err = redirect(stderr)
+		}
+	}
+	if err != nil {
+		for _, pw := range pipes {
+			pw.Close()
+		}
+		wg.Wait()
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Ptrace = true
+
+	type result struct {
+		accesses []fileAccess
+		err      error
+	}
+	ch := make(chan result)
+	go func() {
+		// ptrace requests must be made by the thread which started
+		// cmd. The thread is terminated when this goroutine exits
+		// locked, which detaches background processes still traced.
+		runtime.LockOSThread()
+		err := cmd.Start()
+		for _, pw := range pipes {
+			pw.Close()
+		}
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		accesses, err := ptraceLoop(cmd.Process.Pid)
+		ch <- result{accesses: accesses, err: err}
+	}()
+	r := <-ch
+	wg.Wait()
+	if cmd.Process != nil {
+		cmd.Process.Release()
+	}
+	return r.accesses, r.err
+}
+
+// sameWriter reports whether a and b are the same writer, as
+// exec.Cmd does for Stdout and Stderr.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// ptraceLoop traces the process pid stopped at its exec until it
+// exits, and returns files accessed by it and its descendants. The
+// error is *ExitError if the process fails.
+func ptraceLoop(pid int) ([]fileAccess, error) {
+	var ws syscall.WaitStatus
+	_, err := syscall.Wait4(pid, &ws, syscall.WALL, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.PtraceSetOptions(pid, syscall.PTRACE_O_TRACESYSGOOD|syscall.PTRACE_O_TRACECLONE|syscall.PTRACE_O_TRACEFORK|syscall.PTRACE_O_TRACEVFORK|syscall.PTRACE_O_TRACEEXEC)
+	if err != nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		syscall.Wait4(pid, &ws, syscall.WALL, nil)
+		return nil, err
+	}
+	var accesses []fileAccess
+	tracees := map[int]*tracee{pid: {}}
+	err = syscall.PtraceSyscall(pid, 0)
+	for err == nil {
+		var wpid int
+		// other goroutines may run their children, which must
+		// not be reaped here.
+		wpid, err = syscall.Wait4(-1, &ws, syscall.WALL|syscall.WNOTHREAD, nil)
+		if err == syscall.EINTR {
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if ws.Exited() || ws.Signaled() {
+			delete(tracees, wpid)
+			if wpid != pid {
+				continue
+			}
+			if ws.ExitStatus() != 0 || ws.Signaled() {
+				return accesses, &ExitError{Status: ws.ExitStatus()}
+			}
+			return accesses, nil
+		}
+		if !ws.Stopped() {
+			continue
+		}
+		t, ok := tracees[wpid]
+		if !ok {
+			// a new child starts with SIGSTOP.
+			t = &tracee{}
+			tracees[wpid] = t
+		}
+		sig := ws.StopSignal()
+		switch {
+		case sig == syscall.SIGTRAP|0x80:
+			sig = 0
+			t.inSyscall = !t.inSyscall
+			if t.inSyscall {
+				t.access = syscallAccess(wpid)
+			} else if t.access != nil {
+				if syscallSucceeded(wpid) {
+					accesses = append(accesses, *t.access)
+				}
+				t.access = nil
+			}
+		case sig == syscall.SIGTRAP:
+			// events of fork, clone and exec.
+			sig = 0
+		case sig == syscall.SIGSTOP && !ok:
+			sig = 0
+		}
+		err = syscall.PtraceSyscall(wpid, int(sig))
+		if err == syscall.ESRCH {
+			// killed while stopped.
+			err = nil
+		}
+	}
+	return accesses, err
+}
+
+// syscallAccess returns the file accessed by the syscall which the
+// thread pid is entering, or nil.
+func syscallAccess(pid int) *fileAccess {
+	var regs syscall.PtraceRegs
+	if err := syscall.PtraceGetRegs(pid, &regs); err != nil {
+		return nil
+	}
+	nr, args := syscallEntry(&regs)
+	fs, ok := fileSyscalls[nr]
+	if !ok {
+		return nil
+	}
+	path, err := peekString(pid, uintptr(args[fs.path]))
+	if err != nil || path == "" {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		dir := "/proc/" + strconv.Itoa(pid) + "/cwd"
+		if fs.dirfd >= 0 && int32(args[fs.dirfd]) != atFDCWD {
+			dir = fmt.Sprintf("/proc/%d/fd/%d", pid, int32(args[fs.dirfd]))
+		}
+		dir, err = os.Readlink(dir)
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(dir, path)
+	}
+	a := &fileAccess{
+		path:  filepath.Clean(path),
+		write: fs.write,
+	}
+	var flags uint64
+	switch {
+	case fs.flags >= 0:
+		flags = args[fs.flags]
+	case fs.how >= 0:
+		b := make([]byte, 8)
+		if n, _ := syscall.PtracePeekData(pid, uintptr(args[fs.how]), b); n < len(b) {
+			return a
+		}
+		flags = binary.LittleEndian.Uint64(b)
+	default:
+		return a
+	}
+	a.write = flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&(syscall.O_CREAT|syscall.O_TRUNC) != 0
+	return a
+}
+
+// syscallSucceeded reports whether the syscall which the thread pid is
+// exiting succeeded.
+func syscallSucceeded(pid int) bool {
+	var regs syscall.PtraceRegs
+	if err := syscall.PtraceGetRegs(pid, &regs); err != nil {
+		// the thread exited by execve of another thread.
+		glog.V(1).Infof("ptrace %d: %v", pid, err)
+		return false
+	}
+	return syscallReturn(&regs) >= 0
+}
+
+// peekString reads the NUL terminated string at addr in the memory of
+// the thread pid.
+func peekString(pid int, addr uintptr) (string, error) {
+	var s []byte
+	buf := make([]byte, 256)
+	for len(s) < 4096 {
+		n, err := syscall.PtracePeekData(pid, addr, buf)
+		if i := bytes.IndexByte(buf[:n], 0); i >= 0 {
+			return string(append(s, buf[:i]...)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		s = append(s, buf[:n]...)
+		addr += uintptr(n)
+	}
+	return "", errors.New("too long path")
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "syscall"
+
+// arm64 has only *at syscalls.
+var fileSyscalls = map[uint64]fileSyscall{
+	56:  {dirfd: 0, path: 1, flags: 2, how: -1},                // openat
+	437: {dirfd: 0, path: 1, flags: -1, how: 2},                // openat2
+	221: {dirfd: -1, path: 0, flags: -1, how: -1},              // execve
+	281: {dirfd: 0, path: 1, flags: -1, how: -1},               // execveat
+	45:  {dirfd: -1, path: 0, flags: -1, how: -1, write: true}, // truncate
+	38:  {dirfd: 2, path: 3, flags: -1, how: -1, write: true},  // renameat
+	276: {dirfd: 2, path: 3, flags: -1, how: -1, write: true},  // renameat2
+	37:  {dirfd: 2, path: 3, flags: -1, how: -1, write: true},  // linkat
+	36:  {dirfd: 1, path: 2, flags: -1, how: -1, write: true},  // symlinkat
+}
+
+// syscallEntry returns the number and the arguments of the syscall at
+// its entry.
+func syscallEntry(regs *syscall.PtraceRegs) (uint64, [4]uint64) {
+	return regs.Regs[8], [4]uint64{regs.Regs[0], regs.Regs[1], regs.Regs[2], regs.Regs[3]}
+}
+
+// syscallReturn returns the return value of the syscall at its exit.
+func syscallReturn(regs *syscall.PtraceRegs) int64 {
+	return int64(regs.Regs[0])
+}
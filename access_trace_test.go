@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFileAccessTracer(t *testing.T) {
+	if !fileAccessTraceSupported {
+		t.Skip(errFileAccessTraceUnsupported)
+	}
+	chdirTestMakefile(t, `all: b c
+	cat b > all
+b: a
+	cat a h > b; cat b > /dev/null; ls
+c:
+	echo c > b
+fail:
+	exit 3
+`)
+	for _, f := range []string{"a", "h"} {
+		err := ioutil.WriteFile(f, []byte(f+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"all", "fail"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer, err := NewFileAccessTracer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExecutor(&ExecutorOpt{CommandRunner: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "c\n"; got != want {
+		t.Errorf("all=%q; want %q", got, want)
+	}
+	var buf bytes.Buffer
+	err = tracer.WriteReport(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `b: missing prerequisites: h
+b: written by multiple targets: b c
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteReport=%q; want %q", got, want)
+	}
+
+	ex, err = NewExecutor(&ExecutorOpt{CommandRunner: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, []string{"fail"})
+	if err == nil || err.Error() != "*** [fail] Error 3" {
+		t.Errorf("Exec(fail)=%v; want *** [fail] Error 3", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Archive member targets, e.g. "lib.a(foo.o)".
+// http://www.gnu.org/software/make/manual/make.html#Archives
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitArchiveMember splits an archive member reference "archive(member)"
+// into the archive and the member. ok is false if name isn't an archive
+// member reference.
+func splitArchiveMember(name string) (archive, member string, ok bool) {
+	i := strings.IndexByte(name, '(')
+	if i <= 0 || len(name) < i+3 || name[len(name)-1] != ')' {
+		return "", "", false
+	}
+	return name[:i], name[i+1 : len(name)-1], true
+}
+
+// archiveMemberName returns the member name of name if it is an archive
+// member reference, or name itself. It is the name used in $^, $+, $?
+// and $|.
+func archiveMemberName(name string) string {
+	if _, member, ok := splitArchiveMember(name); ok {
+		return member
+	}
+	return name
+}
+
+// expandArchiveMembers expands archive member references of multiple
+// members in words, e.g. "lib.a(a.o" "b.o)" into "lib.a(a.o)"
+// "lib.a(b.o)". Other words are kept as is, and words itself is
+// returned if it has no such references.
+func expandArchiveMembers(words []string) []string {
+	var r []string
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		p := strings.IndexByte(w, '(')
+		if p <= 0 || strings.IndexByte(w[p:], ')') >= 0 {
+			if r != nil {
+				r = append(r, w)
+			}
+			continue
+		}
+		if r == nil {
+			r = append([]string{}, words[:i]...)
+		}
+		// find the word which closes the reference.
+		j := i + 1
+		for j < len(words) && strings.IndexByte(words[j], ')') < 0 {
+			j++
+		}
+		if j == len(words) || !strings.HasSuffix(words[j], ")") {
+			r = append(r, w)
+			continue
+		}
+		archive := w[:p]
+		members := append([]string{w[p+1:]}, words[i+1:j+1]...)
+		members[len(members)-1] = strings.TrimSuffix(members[len(members)-1], ")")
+		for _, m := range members {
+			if m == "" {
+				continue
+			}
+			r = append(r, intern(archive+"("+m+")"))
+		}
+		i = j
+	}
+	if r == nil {
+		return words
+	}
+	return r
+}
+
+const (
+	arMagic     = "!<arch>\n"
+	arHeaderLen = 60
+)
+
+// archiveMemberTimestamp returns the modification time of member in
+// archive in seconds, recorded in the member header, or -2 if the
+// archive or the member doesn't exist. Note that archives made in
+// deterministic mode of ar(1) record 0 as the time.
+func archiveMemberTimestamp(archive, member string) int64 {
+	f, err := os.Open(archive)
+	if err != nil {
+		return -2
+	}
+	defer f.Close()
+	off, err := findArchiveMember(f, member)
+	if err != nil {
+		return -2
+	}
+	var date [12]byte
+	if _, err := f.ReadAt(date[:], off+16); err != nil {
+		return -2
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(date[:])), 10, 64)
+	if err != nil {
+		return -2
+	}
+	return ts
+}
+
+// touchArchiveMember sets the modification time of member in archive
+// to t, as "make -t" does.
+func touchArchiveMember(archive, member string, t time.Time) error {
+	f, err := os.OpenFile(archive, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	off, err := findArchiveMember(f, member)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.WriteAt([]byte(fmt.Sprintf("%-12d", t.Unix())), off+16)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// findArchiveMember returns the offset of the header of member in the
+// archive f. A member is looked up by its base name, as ar(1) stores
+// it. Both the GNU and the BSD formats of long names are supported.
+func findArchiveMember(f *os.File, member string) (int64, error) {
+	if i := strings.LastIndexByte(member, '/'); i >= 0 {
+		member = member[i+1:]
+	}
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != arMagic {
+		return 0, fmt.Errorf("%s: not an archive", f.Name())
+	}
+	// names is the table of long names of GNU ar.
+	var names []byte
+	var hdr [arHeaderLen]byte
+	bad := fmt.Errorf("%s: malformed archive", f.Name())
+	off := int64(len(arMagic))
+	for {
+		if _, err := f.ReadAt(hdr[:], off); err == io.EOF {
+			return 0, fmt.Errorf("%s: no member %q", f.Name(), member)
+		} else if err != nil {
+			return 0, err
+		}
+		if string(hdr[58:60]) != "`\n" {
+			return 0, bad
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return 0, bad
+		}
+		data := off + arHeaderLen
+		name := strings.TrimRight(string(hdr[0:16]), " ")
+		switch {
+		case name == "//":
+			names = make([]byte, size)
+			if _, err := f.ReadAt(names, data); err != nil {
+				return 0, bad
+			}
+			name = ""
+		case name == "/" || name == "/SYM64/" || strings.HasPrefix(name, "__.SYMDEF"):
+			name = ""
+		case strings.HasPrefix(name, "#1/"):
+			// BSD: the name follows the header.
+			n, err := strconv.Atoi(name[3:])
+			if err != nil || n < 0 || int64(n) > size {
+				return 0, bad
+			}
+			buf := make([]byte, n)
+			if _, err := f.ReadAt(buf, data); err != nil {
+				return 0, bad
+			}
+			name = string(bytes.TrimRight(buf, "\x00"))
+		case strings.HasPrefix(name, "/"):
+			// GNU: an offset in the table of long names.
+			i, err := strconv.Atoi(name[1:])
+			if err != nil || i < 0 || i > len(names) {
+				return 0, bad
+			}
+			name = string(names[i:])
+			if j := strings.Index(name, "/\n"); j >= 0 {
+				name = name[:j]
+			}
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+		if name != "" && name == member {
+			return off, nil
+		}
+		off = data + size + size%2
+	}
+}
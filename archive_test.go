@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpandArchiveMembers(t *testing.T) {
+	for _, tc := range []struct {
+		in   []string
+		want []string
+	}{
+		{
+			in:   []string{"a", "lib.a(a.o)", "b"},
+			want: []string{"a", "lib.a(a.o)", "b"},
+		},
+		{
+			in:   []string{"lib.a(a.o", "b.o)", "c"},
+			want: []string{"lib.a(a.o)", "lib.a(b.o)", "c"},
+		},
+		{
+			in:   []string{"a", "lib.a(", "a.o", "b.o", ")"},
+			want: []string{"a", "lib.a(a.o)", "lib.a(b.o)"},
+		},
+		{
+			in:   []string{"lib.a(a.o", "b"},
+			want: []string{"lib.a(a.o", "b"},
+		},
+		{
+			in:   []string{"(a.o", "b.o)"},
+			want: []string{"(a.o", "b.o)"},
+		},
+	} {
+		got := expandArchiveMembers(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expandArchiveMembers(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// arHeader returns the header of an archive member.
+func arHeader(name string, date int64, size int) string {
+	return fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, date, 0, 0, 0644, size)
+}
+
+func TestArchiveMemberTimestamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	long := "a_very_long_member_name.o"
+	gnu := arMagic +
+		arHeader("/", 0, 4) + "\x00\x00\x00\x00" +
+		arHeader("//", 0, len(long)+2) + long + "/\n\n" +
+		arHeader("a.o/", 100, 3) + "abc\n" +
+		arHeader("/0", 200, 2) + "ab"
+	bsd := arMagic +
+		arHeader("__.SYMDEF", 0, 4) + "\x00\x00\x00\x00" +
+		arHeader("a.o", 100, 1) + "a\n" +
+		arHeader(fmt.Sprintf("#1/%d", len(long)+3), 200, len(long)+5) + long + "\x00\x00\x00ab"
+	for name, content := range map[string]string{"gnu.a": gnu, "bsd.a": bsd} {
+		archive := filepath.Join(dir, name)
+		err := ioutil.WriteFile(archive, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			member string
+			want   int64
+		}{
+			{member: "a.o", want: 100},
+			{member: "dir/a.o", want: 100},
+			{member: long, want: 200},
+			{member: "b.o", want: -2},
+		} {
+			got := archiveMemberTimestamp(archive, tc.member)
+			if got != tc.want {
+				t.Errorf("archiveMemberTimestamp(%q, %q)=%d; want %d", name, tc.member, got, tc.want)
+			}
+		}
+
+		err = touchArchiveMember(archive, long, time.Unix(300, 0))
+		if err != nil {
+			t.Fatalf("touchArchiveMember(%q, %q)=%v", name, long, err)
+		}
+		if got := archiveMemberTimestamp(archive, long); got != 300 {
+			t.Errorf("archiveMemberTimestamp(%q, %q)=%d after touch; want 300", name, long, got)
+		}
+		if got := archiveMemberTimestamp(archive, "a.o"); got != 100 {
+			t.Errorf("archiveMemberTimestamp(%q, a.o)=%d after touch; want 100", name, got)
+		}
+	}
+	if got := archiveMemberTimestamp(filepath.Join(dir, "missing.a"), "a.o"); got != -2 {
+		t.Errorf("archiveMemberTimestamp(missing.a, a.o)=%d; want -2", got)
+	}
+}
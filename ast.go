@@ -23,12 +23,16 @@ import (
 type ast interface {
 	eval(*Evaluator) error
 	show()
+	pos() srcpos
 }
 
 type assignAST struct {
 	srcpos
 	lhs Value
 	rhs Value
+	// src is rhs as written if it has '$', which rhs.String() may
+	// not reproduce, e.g. "$$".
+	src string
 	op  string
 	opt string // "override", "export"
 }
@@ -39,7 +43,7 @@ func (ast *assignAST) eval(ev *Evaluator) error {
 
 func (ast *assignAST) evalRHS(ev *Evaluator, lhs string) (Var, error) {
 	origin := "file"
-	if ast.filename == bootstrapMakefileName {
+	if ast.filename == bootstrapMakefileName && !fileOriginVars[lhs] {
 		origin = "default"
 	}
 	if ast.opt == "override" {
@@ -48,6 +52,9 @@ func (ast *assignAST) evalRHS(ev *Evaluator, lhs string) (Var, error) {
 	// TODO(ukai): handle ast.opt == "export"
 	switch ast.op {
 	case ":=":
+		if f, ok := ast.rhs.(*funcShell); ok && ev.canBatchShell() {
+			return ev.batchShell(f, lhs, origin)
+		}
 		switch v := ast.rhs.(type) {
 		case literal:
 			return &simpleVar{value: []string{v.String()}, origin: origin}, nil
@@ -63,11 +70,32 @@ func (ast *assignAST) evalRHS(ev *Evaluator, lhs string) (Var, error) {
 			return &simpleVar{value: []string{buf.String()}, origin: origin}, nil
 		}
 	case "=":
-		return &recursiveVar{expr: ast.rhs, origin: origin}, nil
+		return &recursiveVar{expr: ast.rhsValue(), src: ast.src, origin: origin}, nil
 	case "+=":
 		prev := ev.lookupVarInCurrentScope(lhs)
 		if !prev.IsDefined() {
-			return &recursiveVar{expr: ast.rhs, origin: origin}, nil
+			return &recursiveVar{expr: ast.rhsValue(), src: ast.src, origin: origin}, nil
+		}
+		if originPrecedence[prev.Origin()] > originPrecedence[origin] {
+			// e.g. appending to a command line variable without
+			// override, which is ignored.
+			return prev, nil
+		}
+		if err := ev.checkAppend(lhs, prev); err != nil {
+			return nil, err
+		}
+		if originPrecedence[prev.Origin()] < originPrecedence[origin] {
+			// e.g. an environment variable becomes a file one, or a
+			// command line variable becomes an override one.
+			prev = withOrigin(prev, origin)
+		}
+		if ev.inRecipe {
+			// prev may be a target specific variable, which
+			// a global assignment in commands never modifies.
+			prev = copyVar(prev)
+		}
+		if ast.src != "" && prev.Flavor() == "recursive" {
+			return prev.Append(ev, ast.src)
 		}
 		return prev.AppendVar(ev, ast.rhs)
 	case "?=":
@@ -75,11 +103,22 @@ func (ast *assignAST) evalRHS(ev *Evaluator, lhs string) (Var, error) {
 		if prev.IsDefined() {
 			return prev, nil
 		}
-		return &recursiveVar{expr: ast.rhs, origin: origin}, nil
+		return &recursiveVar{expr: ast.rhsValue(), src: ast.src, origin: origin}, nil
 	}
 	return nil, ast.errorf("unknown assign op: %q", ast.op)
 }
 
+// rhsValue returns rhs to be used as value of a recursive variable.
+// Parsed makefiles are cached and may be shared by several evaluations,
+// so cap the expr to make sure recursiveVar.Append never writes into
+// its backing array.
+func (ast *assignAST) rhsValue() Value {
+	if e, ok := ast.rhs.(expr); ok {
+		return e[:len(e):len(e)]
+	}
+	return ast.rhs
+}
+
 func (ast *assignAST) show() {
 	glog.Infof("%s %s %s %q", ast.opt, ast.lhs, ast.op, ast.rhs)
 }
@@ -176,3 +215,17 @@ func (ast *vpathAST) eval(ev *Evaluator) error {
 func (ast *vpathAST) show() {
 	glog.Infof("vpath %s", ast.expr.String())
 }
+
+type loadAST struct {
+	srcpos
+	expr Value
+	op   string
+}
+
+func (ast *loadAST) eval(ev *Evaluator) error {
+	return ev.evalLoad(ast)
+}
+
+func (ast *loadAST) show() {
+	glog.Infof("%s %s", ast.op, ast.expr.String())
+}
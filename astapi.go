@@ -0,0 +1,227 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"sort"
+	"strings"
+
+	mkparser "github.com/google/kati/parser"
+)
+
+// ParseAST parses the makefile src read from filename into the syntax
+// tree of package parser.
+func ParseAST(src []byte, filename string) (*mkparser.File, error) {
+	p := newParser(append([]byte(nil), src...), filename)
+	p.spans = make(map[ast]srcspan)
+	mk, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	c := &astConverter{
+		filename: filename,
+		src:      src,
+		spans:    p.spans,
+		lines:    []int{0},
+	}
+	for i, b := range src {
+		if b == '\n' {
+			c.lines = append(c.lines, i+1)
+		}
+	}
+	return &mkparser.File{
+		Name:  filename,
+		Stmts: c.stmts(mk.stmts),
+	}, nil
+}
+
+// astConverter converts ast to package parser.
+type astConverter struct {
+	filename string
+	src      []byte
+	spans    map[ast]srcspan
+	// lines are offsets of lines in src.
+	lines []int
+}
+
+func (c *astConverter) pos(off int) mkparser.Pos {
+	i := sort.Search(len(c.lines), func(i int) bool { return c.lines[i] > off }) - 1
+	return mkparser.Pos{
+		Filename: c.filename,
+		Offset:   off,
+		Line:     i + 1,
+		Column:   off - c.lines[i] + 1,
+	}
+}
+
+// span returns the span of stmt. It starts at the first non-space
+// byte, except for recipe lines.
+func (c *astConverter) span(stmt ast) mkparser.Span {
+	s := c.spans[stmt]
+	start := s.start
+	if _, ok := stmt.(*commandAST); !ok {
+		for start < s.end && (c.src[start] == ' ' || c.src[start] == '\t') {
+			start++
+		}
+	}
+	return mkparser.Span{From: c.pos(start), To: c.pos(s.end)}
+}
+
+func (c *astConverter) stmts(stmts []ast) []mkparser.Stmt {
+	var r []mkparser.Stmt
+	for _, s := range stmts {
+		r = append(r, c.stmt(s))
+	}
+	return r
+}
+
+func (c *astConverter) stmt(stmt ast) mkparser.Stmt {
+	span := c.span(stmt)
+	switch s := stmt.(type) {
+	case *assignAST:
+		return c.assign(s, span)
+	case *maybeRuleAST:
+		r := &mkparser.RuleStmt{
+			Span:      span,
+			Expr:      c.expr(s.expr),
+			IsRule:    s.isRule,
+			Recipe:    string(s.semi),
+			HasRecipe: s.semi != nil,
+		}
+		if s.assign != nil {
+			r.Assign = c.assign(s.assign, span)
+		}
+		return r
+	case *commandAST:
+		return &mkparser.CommandStmt{Span: span, Command: s.cmd}
+	case *includeAST:
+		return &mkparser.IncludeStmt{Span: span, Op: s.op, Files: c.parseExpr([]byte(s.expr))}
+	case *ifAST:
+		return &mkparser.IfStmt{
+			Span: span,
+			Op:   s.op,
+			LHS:  c.expr(s.lhs),
+			RHS:  c.expr(s.rhs),
+			Then: c.stmts(s.trueStmts),
+			Else: c.stmts(s.falseStmts),
+		}
+	case *exportAST:
+		return &mkparser.ExportStmt{
+			Span:     span,
+			Export:   s.export,
+			Names:    c.parseExpr(s.expr),
+			HasEqual: s.hasEqual,
+		}
+	case *vpathAST:
+		return &mkparser.VpathStmt{Span: span, Expr: c.expr(s.expr)}
+	case *loadAST:
+		return &mkparser.LoadStmt{Span: span, Op: s.op, Expr: c.expr(s.expr)}
+	}
+	panic(stmt.pos().errorf("unknown statement %T", stmt))
+}
+
+func (c *astConverter) assign(s *assignAST, span mkparser.Span) *mkparser.AssignStmt {
+	a := &mkparser.AssignStmt{
+		Span:      span,
+		Name:      c.expr(s.lhs),
+		Op:        s.op,
+		Value:     c.expr(s.rhs),
+		Directive: s.opt,
+	}
+	line := c.src[span.From.Offset:span.To.Offset]
+	for {
+		w, rest := firstWord(line)
+		switch string(w) {
+		case "override", "export":
+			line = rest
+			continue
+		case "define":
+			a.Define = true
+		}
+		break
+	}
+	return a
+}
+
+// parseExpr parses s which is parsed in evaluation.
+func (c *astConverter) parseExpr(s []byte) mkparser.Expr {
+	v, _, err := parseExpr(s, nil, parseOp{alloc: true})
+	if err != nil {
+		return &mkparser.Literal{Text: string(s)}
+	}
+	return c.expr(v)
+}
+
+func (c *astConverter) expr(v Value) mkparser.Expr {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case literal:
+		return &mkparser.Literal{Text: string(v)}
+	case tmpval:
+		return &mkparser.Literal{Text: string(v)}
+	case expr:
+		switch len(v) {
+		case 0:
+			return &mkparser.Literal{}
+		case 1:
+			return c.expr(v[0])
+		}
+		e := &mkparser.Concat{}
+		for _, p := range v {
+			e.Parts = append(e.Parts, c.expr(p))
+		}
+		return e
+	case *varref:
+		return &mkparser.VarRef{Name: c.expr(v.varname), Paren: v.paren}
+	case paramref:
+		return &mkparser.ParamRef{N: int(v)}
+	case varsubst:
+		return &mkparser.SubstRef{
+			Name:        c.expr(v.varname),
+			Pattern:     c.expr(v.pat),
+			Replacement: c.expr(v.subst),
+			Paren:       v.paren,
+		}
+	case funcstats:
+		return c.expr(v.Value)
+	case *funcEvalAssign:
+		// compacted $(eval A = b).
+		return &mkparser.Call{
+			Func: "eval",
+			Args: []mkparser.Expr{&mkparser.Concat{Parts: []mkparser.Expr{
+				&mkparser.Literal{Text: v.lhs + " " + v.op + " "},
+				c.expr(v.rhs),
+			}}},
+			Paren: '(',
+		}
+	case *funcNop:
+		// compacted $(eval) with comments only.
+		e := &mkparser.Call{Func: "eval", Paren: v.expr[1]}
+		if i := strings.IndexAny(v.expr, " \t"); i >= 0 {
+			e.Args = []mkparser.Expr{&mkparser.Literal{Text: v.expr[i+1 : len(v.expr)-1]}}
+		}
+		return e
+	case interface{ closure() *fclosure }:
+		f := v.closure()
+		arg0 := f.args[0].String()
+		e := &mkparser.Call{Func: arg0[1:], Paren: arg0[0]}
+		for _, a := range f.args[1:] {
+			e.Args = append(e.Args, c.expr(a))
+		}
+		return e
+	}
+	return &mkparser.Literal{Text: v.String()}
+}
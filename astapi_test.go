@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	mkparser "github.com/google/kati/parser"
+)
+
+// showStmts shows statements with their spans, one per line.
+func showStmts(stmts []mkparser.Stmt, indent string) []string {
+	var r []string
+	for _, s := range stmts {
+		span := fmt.Sprintf("%s%d:%d-%d:%d ", indent, s.Pos().Line, s.Pos().Column, s.End().Line, s.End().Column)
+		switch s := s.(type) {
+		case *mkparser.AssignStmt:
+			r = append(r, fmt.Sprintf("%sassign %q %s %q %s define=%t", span, s.Name, s.Op, s.Value, s.Directive, s.Define))
+		case *mkparser.RuleStmt:
+			line := fmt.Sprintf("%srule %q isRule=%t", span, s.Expr, s.IsRule)
+			if s.Assign != nil {
+				line += fmt.Sprintf(" assign %q %s %q", s.Assign.Name, s.Assign.Op, s.Assign.Value)
+			}
+			if s.HasRecipe {
+				line += fmt.Sprintf(" recipe %q", s.Recipe)
+			}
+			r = append(r, line)
+		case *mkparser.CommandStmt:
+			r = append(r, fmt.Sprintf("%scommand %q", span, s.Command))
+		case *mkparser.IncludeStmt:
+			r = append(r, fmt.Sprintf("%s%s %q", span, s.Op, s.Files))
+		case *mkparser.IfStmt:
+			r = append(r, fmt.Sprintf("%s%s %q %v", span, s.Op, s.LHS, s.RHS))
+			r = append(r, showStmts(s.Then, indent+" ")...)
+			r = append(r, indent+"else")
+			r = append(r, showStmts(s.Else, indent+" ")...)
+		case *mkparser.ExportStmt:
+			r = append(r, fmt.Sprintf("%sexport=%t %q hasEqual=%t", span, s.Export, s.Names, s.HasEqual))
+		default:
+			r = append(r, fmt.Sprintf("%s%T", span, s))
+		}
+	}
+	return r
+}
+
+func TestParseAST(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{
+			in: "A := a\n  override B += $(A) \\\n  b\n",
+			want: []string{
+				`1:1-1:7 assign "A" := "a"  define=false`,
+				`2:3-3:4 assign "B" += "$(A) b" override define=false`,
+			},
+		},
+		{
+			in: "foo: bar ; echo\n\techo $@\nfoo: A := a\n",
+			want: []string{
+				`1:1-1:16 rule "foo: bar " isRule=true recipe " echo"`,
+				`2:1-2:9 command "echo $@"`,
+				`3:1-3:12 rule "foo:" isRule=true assign "A" := "a"`,
+			},
+		},
+		{
+			in: "export define A\na\nendef\n",
+			want: []string{
+				`1:1-3:6 assign "A" = "a" export define=true`,
+				`1:1-3:6 export=true "A" hasEqual=false`,
+			},
+		},
+		{
+			in: "ifdef A\nB = b\nelse ifeq ($(A),a)\nC = c\nendif\ninclude $(C).mk\n",
+			want: []string{
+				`1:1-5:6 ifdef "A" <nil>`,
+				` 2:1-2:6 assign "B" = "b"  define=false`,
+				`else`,
+				` 3:1-5:6 ifeq "$(A)" a`,
+				`  4:1-4:6 assign "C" = "c"  define=false`,
+				` else`,
+				`6:1-6:16 include "$(C).mk"`,
+			},
+		},
+	} {
+		f, err := ParseAST([]byte(tc.in), "test.mk")
+		if err != nil {
+			t.Errorf("ParseAST(%q)=_, %v; want no error", tc.in, err)
+			continue
+		}
+		got := showStmts(f.Stmts, "")
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseAST(%q)=\n%s\nwant\n%s", tc.in, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+func TestParseASTExpr(t *testing.T) {
+	f, err := ParseAST([]byte("A = $(subst a,b,$(B)) ${C:.c=.o} $1 $D\n"), "test.mk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := f.Stmts[0].(*mkparser.AssignStmt)
+	want := &mkparser.Concat{Parts: []mkparser.Expr{
+		&mkparser.Call{
+			Func: "subst",
+			Args: []mkparser.Expr{
+				&mkparser.Literal{Text: "a"},
+				&mkparser.Literal{Text: "b"},
+				&mkparser.VarRef{Name: &mkparser.Literal{Text: "B"}, Paren: '('},
+			},
+			Paren: '(',
+		},
+		&mkparser.Literal{Text: " "},
+		&mkparser.SubstRef{
+			Name:        &mkparser.Literal{Text: "C"},
+			Pattern:     &mkparser.Literal{Text: ".c"},
+			Replacement: &mkparser.Literal{Text: ".o"},
+			Paren:       '{',
+		},
+		&mkparser.Literal{Text: " "},
+		&mkparser.ParamRef{N: 1},
+		&mkparser.Literal{Text: " "},
+		&mkparser.VarRef{Name: &mkparser.Literal{Text: "D"}},
+	}}
+	if !reflect.DeepEqual(a.Value, want) {
+		t.Errorf("ParseAST: value=%#v; want %#v", a.Value, want)
+	}
+	if got, want := a.Value.String(), "$(subst a,b,$(B)) ${C:.c=.o} $1 $D"; got != want {
+		t.Errorf("ParseAST: value.String()=%q; want %q", got, want)
+	}
+}
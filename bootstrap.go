@@ -17,36 +17,195 @@ package kati
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 const bootstrapMakefileName = "*bootstrap*"
 
-func bootstrapMakefile(targets []string) (makefile, error) {
-	bootstrap := `
+// fileOriginVars are variables set in the bootstrap makefile whose
+// origin is "file" rather than "default", as GNU make does.
+var fileOriginVars = map[string]bool{
+	"CURDIR":    true,
+	"MAKEFLAGS": true,
+	"SHELL":     true,
+}
+
+// noEnvOverrideVars are variables set in the bootstrap makefile which
+// environment variables don't override even with EnvironmentOverrides,
+// as GNU make does.
+var noEnvOverrideVars = []string{"MAKEFLAGS", "MFLAGS", "SHELL"}
+
+// builtinVars are the builtin variables of GNU make, used by
+// builtinRules. See default.c:
+// http://git.savannah.gnu.org/cgit/make.git/tree/default.c?id=4.1
+const builtinVars = `
 CC:=cc
 CXX:=g++
 AR:=ar
-MAKE:=kati
-# Pretend to be GNU make 3.81, for compatibility.
-MAKE_VERSION:=3.81
-SHELL:=/bin/sh
-# TODO: Add more builtin vars.
-
-# http://www.gnu.org/software/make/manual/make.html#Catalogue-of-Rules
-# The document above is actually not correct. See default.c:
-# http://git.savannah.gnu.org/cgit/make.git/tree/default.c?id=4.1
+AS = as
+CPP = $(CC) -E
+FC = f77
+LEX = lex
+YACC = yacc
+RM = rm -f
+ARFLAGS = rv
+OUTPUT_OPTION = -o $@
+COMPILE.c = $(CC) $(CFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c
+COMPILE.cc = $(CXX) $(CXXFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c
+COMPILE.C = $(COMPILE.cc)
+COMPILE.cpp = $(COMPILE.cc)
+COMPILE.s = $(AS) $(ASFLAGS) $(TARGET_MACH)
+COMPILE.S = $(CC) $(ASFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c
+COMPILE.f = $(FC) $(FFLAGS) $(TARGET_ARCH) -c
+COMPILE.F = $(FC) $(FFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c
+PREPROCESS.S = $(CC) -E $(CPPFLAGS)
+LINK.o = $(CC) $(LDFLAGS) $(TARGET_ARCH)
+LINK.c = $(CC) $(CFLAGS) $(CPPFLAGS) $(LDFLAGS) $(TARGET_ARCH)
+LINK.cc = $(CXX) $(CXXFLAGS) $(CPPFLAGS) $(LDFLAGS) $(TARGET_ARCH)
+LINK.C = $(LINK.cc)
+LINK.cpp = $(LINK.cc)
+LINK.s = $(CC) $(ASFLAGS) $(LDFLAGS) $(TARGET_MACH)
+LINK.S = $(CC) $(ASFLAGS) $(CPPFLAGS) $(LDFLAGS) $(TARGET_MACH)
+LEX.l = $(LEX) $(LFLAGS) -t
+YACC.y = $(YACC) $(YFLAGS)
+SUFFIXES := .out .a .ln .o .c .cc .C .cpp .p .f .F .m .r .y .l .ym .yl .s .S .mod .sym .def .h .info .dvi .tex .texinfo .texi .txinfo .w .ch .web .sh .elc .el
+`
+
+// builtinRules are the builtin implicit rules of GNU make, except
+// rules for RCS and SCCS. They are suffix rules, so they are used only
+// for suffixes in .SUFFIXES, except the pattern rule for archive
+// members.
+// http://www.gnu.org/software/make/manual/make.html#Catalogue-of-Rules
+const builtinRules = `
+.SUFFIXES: $(SUFFIXES)
+.o:
+	$(LINK.o) $^ $(LOADLIBES) $(LDLIBS) -o $@
+.c:
+	$(LINK.c) $^ $(LOADLIBES) $(LDLIBS) -o $@
+.cc:
+	$(LINK.cc) $^ $(LOADLIBES) $(LDLIBS) -o $@
+.C:
+	$(LINK.C) $^ $(LOADLIBES) $(LDLIBS) -o $@
+.cpp:
+	$(LINK.cpp) $^ $(LOADLIBES) $(LDLIBS) -o $@
+.s:
+	$(LINK.s) $^ $(LOADLIBES) $(LDLIBS) -o $@
+.S:
+	$(LINK.S) $^ $(LOADLIBES) $(LDLIBS) -o $@
+.sh:
+	cat $< >$@
+	chmod a+x $@
 .c.o:
-	$(CC) $(CFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c -o $@ $<
+	$(COMPILE.c) $(OUTPUT_OPTION) $<
 .cc.o:
-	$(CXX) $(CXXFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c -o $@ $<
-# TODO: Add more builtin rules.
+	$(COMPILE.cc) $(OUTPUT_OPTION) $<
+.C.o:
+	$(COMPILE.C) $(OUTPUT_OPTION) $<
+.cpp.o:
+	$(COMPILE.cpp) $(OUTPUT_OPTION) $<
+.s.o:
+	$(COMPILE.s) -o $@ $<
+.S.o:
+	$(COMPILE.S) -o $@ $<
+.S.s:
+	$(PREPROCESS.S) $< > $@
+.f.o:
+	$(COMPILE.f) $(OUTPUT_OPTION) $<
+.F.o:
+	$(COMPILE.F) $(OUTPUT_OPTION) $<
+.y.c:
+	$(YACC.y) $<
+	mv -f y.tab.c $@
+.l.c:
+	@$(RM) $@
+	$(LEX.l) $< > $@
+(%): %
+	$(AR) $(ARFLAGS) $@ $<
 `
-	bootstrap += fmt.Sprintf("MAKECMDGOALS:=%s\n", strings.Join(targets, " "))
+
+// features are features of GNU make in .FEATURES which kati supports,
+// with the version of GNU make which introduced them.
+var features = []struct {
+	name    string
+	version string
+}{
+	{"target-specific", "3.81"},
+	{"order-only", "3.81"},
+	{"else-if", "3.81"},
+	{"oneshell", "3.82"},
+	{"grouped-target", "4.3"},
+	{"extra-prereqs", "4.3"},
+	{"archives", "3.81"},
+	{"jobserver", "3.81"},
+	{"jobserver-fifo", "4.4"},
+	{"output-sync", "4.0"},
+	{"load", "4.0"},
+}
+
+// makeFeatures returns .FEATURES of GNU make version, i.e. features
+// which kati supports and the version has.
+func makeFeatures(version string) string {
+	var r []string
+	for _, f := range features {
+		if compareVersions(f.version, version) <= 0 {
+			r = append(r, f.name)
+		}
+	}
+	return strings.Join(r, " ")
+}
+
+// compareVersions compares dotted versions, e.g. "3.81" and "4.0",
+// and returns -1, 0 or 1. A component which is not a number is
+// compared as 0.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func bootstrapMakefile(targets []string) (makefile, error) {
+	bootstrap := `
+MAKE:=kati
+`
+	// Pretend to be GNU make 3.81 by default, for compatibility.
+	bootstrap += fmt.Sprintf("MAKE_VERSION:=%s\n", MakeVersion)
+	bootstrap += fmt.Sprintf(".FEATURES:=%s\n", makeFeatures(MakeVersion))
+	if !NoBuiltinVars {
+		bootstrap += builtinVars
+		if !NoBuiltinRules {
+			bootstrap += builtinRules
+		}
+	}
+	bootstrap += fmt.Sprintf("SHELL:=%s\n", filepath.ToSlash(defaultShell()))
+	// MAKEOVERRIDES is defined by load. see makeflags.go
+	flags := flagsMakeflags() + debugMakeflags()
+	bootstrap += fmt.Sprintf("MAKEFLAGS=%s\n", flags)
+	bootstrap += fmt.Sprintf("MFLAGS:=%s\n", mflags(flags))
+	if len(targets) > 0 {
+		bootstrap += fmt.Sprintf("MAKECMDGOALS:=%s\n", strings.Join(targets, " "))
+	}
 	cwd, err := filepath.Abs(".")
 	if err != nil {
 		return makefile{}, err
 	}
-	bootstrap += fmt.Sprintf("CURDIR:=%s\n", cwd)
+	// Use '/' for CURDIR as make for windows does, so that
+	// $(CURDIR)/foo is a valid path.
+	bootstrap += fmt.Sprintf("CURDIR:=%s\n", filepath.ToSlash(cwd))
 	return parseMakefileString(bootstrap, srcpos{bootstrapMakefileName, 0})
 }
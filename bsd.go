@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Detection of BSD make makefiles.
+//
+// BSD make has its own syntax, e.g. directives start with '.' (.if,
+// .include) and variable references take modifiers (${SRCS:M*.c}).
+// kati doesn't support it, but reports BSD make constructs with their
+// locations, rather than "missing separator" or empty expansions.
+
+import "strings"
+
+var bsdDirectives = map[string]bool{
+	"if":             true,
+	"ifdef":          true,
+	"ifndef":         true,
+	"ifmake":         true,
+	"ifnmake":        true,
+	"elif":           true,
+	"elifdef":        true,
+	"elifndef":       true,
+	"elifmake":       true,
+	"elifnmake":      true,
+	"else":           true,
+	"endif":          true,
+	"for":            true,
+	"endfor":         true,
+	"break":          true,
+	"include":        true,
+	"-include":       true,
+	"sinclude":       true,
+	"dinclude":       true,
+	"undef":          true,
+	"error":          true,
+	"warning":        true,
+	"info":           true,
+	"export":         true,
+	"export-env":     true,
+	"export-all":     true,
+	"export-literal": true,
+	"unexport":       true,
+	"unexport-env":   true,
+}
+
+// bsdDirective returns the BSD make directive line starts with, e.g.
+// ".include", or "" if line doesn't start with BSD make directive.
+// line is trimmed.
+func bsdDirective(line []byte) string {
+	if len(line) == 0 || line[0] != '.' {
+		return ""
+	}
+	// BSD make allows spaces after '.' for indentation.
+	s := strings.TrimLeft(string(line[1:]), " \t")
+	i := strings.IndexAny(s, " \t!(\"<")
+	if i < 0 {
+		i = len(s)
+	}
+	if !bsdDirectives[s[:i]] {
+		return ""
+	}
+	return "." + s[:i]
+}
+
+// bsdModifier returns the modifier if name looks like a variable
+// reference with BSD make modifiers, e.g. "M*.c" for "SRCS:M*.c".
+func bsdModifier(name string) (string, bool) {
+	i := strings.IndexByte(name, ':')
+	if i <= 0 || i+1 == len(name) {
+		return "", false
+	}
+	for _, c := range name[:i] {
+		if !(c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return "", false
+		}
+	}
+	mod := name[i+1:]
+	if strings.IndexByte("CEHLMNOPQRSTtu", mod[0]) < 0 {
+		return "", false
+	}
+	return mod, true
+}
+
+// checkBSDModifier warns if an undefined variable name looks like a
+// variable reference with BSD make modifiers. It warns once per name.
+func (ev *Evaluator) checkBSDModifier(name string) {
+	mod, ok := bsdModifier(name)
+	if !ok {
+		return
+	}
+	if ev.bsdWarned == nil {
+		ev.bsdWarned = make(map[string]bool)
+	}
+	if ev.bsdWarned[name] {
+		return
+	}
+	ev.bsdWarned[name] = true
+	warn(ev.srcpos, DiagBSDMakefile, "variable %q is undefined. %q is a BSD make variable modifier; this looks like a BSD makefile, which kati doesn't support.", name, ":"+mod[:1])
+}
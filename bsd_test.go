@@ -0,0 +1,71 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBSDDirective(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: ".include <bsd.prog.mk>", want: ".include"},
+		{in: `.include "config.mk"`, want: ".include"},
+		{in: ".if !defined(FOO)", want: ".if"},
+		{in: ".if defined(FOO)", want: ".if"},
+		{in: ".  endif", want: ".endif"},
+		{in: ".for f in ${SRCS}", want: ".for"},
+		{in: ".PHONY: all"},
+		{in: ".SUFFIXES: .c .o"},
+		{in: ".if: foo"},
+		{in: "include foo.mk"},
+	} {
+		if got := bsdDirective([]byte(tc.in)); got != tc.want {
+			t.Errorf("bsdDirective(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestBSDModifier(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{in: "SRCS:M*.c", want: "M*.c", ok: true},
+		{in: "SRCS:S/.c/.o/", want: "S/.c/.o/", ok: true},
+		{in: "FILE:T", want: "T", ok: true},
+		{in: "SRCS"},
+		{in: "SRCS:"},
+		{in: ":M*.c"},
+		{in: "a b:M"},
+		{in: "SRCS:x"},
+	} {
+		got, ok := bsdModifier(tc.in)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("bsdModifier(%q)=%q, %t; want %q, %t", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseBSDMakefile(t *testing.T) {
+	_, err := parseMakefile([]byte("PROG= foo\n.include <bsd.prog.mk>\n"), "Makefile")
+	if err == nil || !strings.Contains(err.Error(), "BSD") || !strings.Contains(err.Error(), "Makefile:2") {
+		t.Errorf("parse BSD makefile: %v; want BSD make error at Makefile:2", err)
+	}
+}
@@ -15,10 +15,16 @@
 package kati
 
 import (
+	"bytes"
 	"io"
 	"sync"
 )
 
+// maxPooledBufSize is the maximum capacity of buffers returned to the pools.
+// Larger buffers are left to GC not to keep huge memory in the pools.
+// Note that sync.Pool drops pooled buffers on GC anyway.
+const maxPooledBufSize = 1 << 20
+
 var (
 	ebufFree = sync.Pool{
 		New: func() interface{} { return new(evalBuffer) },
@@ -59,6 +65,16 @@ func (w *ssvWriter) writeWordString(word string) {
 	io.WriteString(w.Writer, word)
 }
 
+func (w *ssvWriter) writeWordBytes(a, b, c []byte) {
+	if w.sep {
+		writeByte(w.Writer, ' ')
+	}
+	w.sep = true
+	w.Writer.Write(a)
+	w.Writer.Write(b)
+	w.Writer.Write(c)
+}
+
 func (w *ssvWriter) resetSep() {
 	w.sep = false
 }
@@ -79,7 +95,7 @@ func (b *buffer) WriteByte(c byte) error {
 }
 
 func (b *buffer) WriteString(s string) (int, error) {
-	b.buf = append(b.buf, []byte(s)...)
+	b.buf = append(b.buf, s...)
 	return len(s), nil
 }
 
@@ -107,7 +123,7 @@ func newEbuf() *evalBuffer {
 }
 
 func (buf *evalBuffer) release() {
-	if cap(buf.Bytes()) > 1024 {
+	if cap(buf.Bytes()) > maxPooledBufSize {
 		return
 	}
 	buf.Reset()
@@ -139,7 +155,7 @@ func newWbuf() *wordBuffer {
 }
 
 func (buf *wordBuffer) release() {
-	if cap(buf.Bytes()) > 1024 {
+	if cap(buf.Bytes()) > maxPooledBufSize {
 		return
 	}
 	buf.Reset()
@@ -156,15 +172,16 @@ func (wb *wordBuffer) Write(data []byte) (int, error) {
 		cont = !isWhitespace(rune(wb.buf.buf[off-1]))
 	}
 	ws := newWordScanner(data)
+	if len(data) >= largeWriteSize {
+		wb.grow(data, ws.spaceOnly)
+	}
 	for ws.Scan() {
 		if cont {
-			word := wb.words[len(wb.words)-1]
-			wb.words = wb.words[:len(wb.words)-1]
-			wb.buf.buf = wb.buf.buf[:len(wb.buf.buf)-len(word)]
-			var w []byte
-			w = append(w, word...)
-			w = append(w, ws.Bytes()...)
-			wb.writeWord(w)
+			// the last word ends at the end of buf, so extend it in place.
+			last := len(wb.words) - 1
+			off := len(wb.buf.buf) - len(wb.words[last])
+			wb.buf.buf = append(wb.buf.buf, ws.Bytes()...)
+			wb.words[last] = wb.buf.buf[off:]
 			cont = false
 			continue
 		}
@@ -176,6 +193,27 @@ func (wb *wordBuffer) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// largeWriteSize is the size of data to wordBuffer.Write, for which
+// buffers are grown at once instead of growing gradually.
+const largeWriteSize = 4096
+
+// grow grows buf and words to hold data.
+func (wb *wordBuffer) grow(data []byte, spaceOnly bool) {
+	if n := len(wb.buf.buf) + len(data) + 1; cap(wb.buf.buf) < n {
+		buf := make([]byte, len(wb.buf.buf), n)
+		copy(buf, wb.buf.buf)
+		wb.buf.buf = buf
+	}
+	if !spaceOnly {
+		return
+	}
+	if n := len(wb.words) + bytes.Count(data, []byte{' '}) + 1; cap(wb.words) < n {
+		words := make([][]byte, len(wb.words), n)
+		copy(words, wb.words)
+		wb.words = words
+	}
+}
+
 func (wb *wordBuffer) WriteByte(c byte) error {
 	_, err := wb.Write([]byte{c})
 	return err
@@ -195,12 +233,28 @@ func (wb *wordBuffer) writeWord(word []byte) {
 }
 
 func (wb *wordBuffer) writeWordString(word string) {
-	wb.writeWord([]byte(word))
+	if len(wb.buf.buf) > 0 {
+		wb.buf.buf = append(wb.buf.buf, ' ')
+	}
+	off := len(wb.buf.buf)
+	wb.buf.buf = append(wb.buf.buf, word...)
+	wb.words = append(wb.words, wb.buf.buf[off:])
+}
+
+func (wb *wordBuffer) writeWordBytes(a, b, c []byte) {
+	if len(wb.buf.buf) > 0 {
+		wb.buf.buf = append(wb.buf.buf, ' ')
+	}
+	off := len(wb.buf.buf)
+	wb.buf.buf = append(wb.buf.buf, a...)
+	wb.buf.buf = append(wb.buf.buf, b...)
+	wb.buf.buf = append(wb.buf.buf, c...)
+	wb.words = append(wb.words, wb.buf.buf[off:])
 }
 
 func (wb *wordBuffer) Reset() {
 	wb.buf.Reset()
-	wb.words = nil
+	wb.words = wb.words[:0]
 }
 
 func (wb *wordBuffer) resetSep() {}
@@ -67,3 +67,15 @@ func TestWordBuffer(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkWordBufferWrite(b *testing.B) {
+	in := genWords(4<<20, " ")
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wb := newWbuf()
+		wb.Write(in)
+		wb.release()
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The build log records commands run by Executor, e.g.
+//
+//	# kati log v1
+//	# build 1445000000
+//	0	1200	0	foo.o
+//	1200	1250	1	bar.o
+//
+// Lines after "# build <unix time>" are commands of a build: when they
+// started and ended in milliseconds since the build started, their
+// exit statuses and their targets. Commands of the latest build of a
+// target tell how long the target takes. The log is appended by each
+// build which runs commands, and compacted when more than half of it
+// is stale.
+
+const buildLogHeader = "# kati log v1"
+
+type buildLogEntry struct {
+	// build is the index of the build in the log.
+	build  int
+	start  int64
+	end    int64
+	exit   int
+	target string
+}
+
+func (e buildLogEntry) duration() time.Duration {
+	return time.Duration(e.end-e.start) * time.Millisecond
+}
+
+// readBuildLog reads entries in the build log.
+func readBuildLog(filename string) ([]buildLogEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []buildLogEntry
+	s := bufio.NewScanner(f)
+	lineno := 0
+	build := -1
+	for s.Scan() {
+		lineno++
+		line := s.Text()
+		if lineno == 1 {
+			if line != buildLogHeader {
+				return nil, fmt.Errorf("%s: unknown header %q", filename, line)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "# build ") {
+			build++
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 4)
+		if build < 0 || len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: malformed line %q", filename, lineno, line)
+		}
+		e := buildLogEntry{build: build, target: fields[3]}
+		for i, p := range []*int64{&e.start, &e.end} {
+			*p, err = strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+			}
+		}
+		e.exit, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// latestBuildLogEntries returns entries of the latest build of each
+// target.
+func latestBuildLogEntries(entries []buildLogEntry) []buildLogEntry {
+	latest := make(map[string]int)
+	for _, e := range entries {
+		latest[e.target] = e.build
+	}
+	var r []buildLogEntry
+	for _, e := range entries {
+		if latest[e.target] == e.build {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+// buildLog writes the build log of a build. The file is opened when the
+// first command finishes, so builds running no commands don't write
+// it.
+type buildLog struct {
+	filename string
+	start    time.Time
+
+	mu  sync.Mutex
+	f   *os.File
+	err error
+}
+
+func newBuildLog(filename string) *buildLog {
+	return &buildLog{
+		filename: filename,
+		start:    time.Now(),
+	}
+}
+
+// open opens the log to append the build, after compacting it if
+// needed.
+func (l *buildLog) open() (*os.File, error) {
+	entries, err := readBuildLog(l.filename)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("%v; recreating build log", err)
+	}
+	latest := latestBuildLogEntries(entries)
+	var f *os.File
+	if err == nil && len(latest)*2 >= len(entries) {
+		f, err = os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		f, err = os.Create(l.filename)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(f, buildLogHeader)
+		build := -1
+		for _, e := range latest {
+			if e.build != build {
+				// unix times of old builds are lost.
+				fmt.Fprintf(f, "# build %d\n", 0)
+				build = e.build
+			}
+			fmt.Fprintf(f, "%d\t%d\t%d\t%s\n", e.start, e.end, e.exit, e.target)
+		}
+	}
+	_, err = fmt.Fprintf(f, "# build %d\n", l.start.Unix())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// record records the command of target which started at start and
+// exited with exit just now.
+func (l *buildLog) record(target string, start time.Time, exit int) {
+	if l == nil {
+		return
+	}
+	end := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	if l.f == nil {
+		l.f, l.err = l.open()
+		if l.err != nil {
+			glog.Warningf("build log: %v", l.err)
+			return
+		}
+	}
+	ms := func(t time.Time) int64 { return int64(t.Sub(l.start) / time.Millisecond) }
+	_, l.err = fmt.Fprintf(l.f, "%d\t%d\t%d\t%s\n", ms(start), ms(end), exit, target)
+	if l.err != nil {
+		glog.Warningf("build log: %v", l.err)
+	}
+}
+
+func (l *buildLog) close() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// ReportBuildLog writes the critical path of targets of g, i.e. the
+// chain of prerequisites which takes the longest, and top slowest
+// targets, by how long commands of targets took in the build log in
+// filename, e.g.
+//
+//	critical path: 3.200s
+//	  1.000s gen.h
+//	  2.000s foo.o
+//	  0.200s app
+//	slowest targets:
+//	  2.000s foo.o
+//	  1.000s gen.h
+//	  0.200s app
+func ReportBuildLog(w io.Writer, g *DepGraph, filename string, top int) error {
+	entries, err := readBuildLog(filename)
+	if err != nil {
+		return err
+	}
+	durations := make(map[string]time.Duration)
+	for _, e := range latestBuildLogEntries(entries) {
+		durations[e.target] += e.duration()
+	}
+
+	// costs are durations of the critical paths to nodes, and next
+	// are prerequisites on them.
+	costs := make(map[*DepNode]time.Duration)
+	next := make(map[*DepNode]*DepNode)
+	var cost func(n *DepNode) time.Duration
+	cost = func(n *DepNode) time.Duration {
+		if c, ok := costs[n]; ok {
+			return c
+		}
+		// against cycles.
+		costs[n] = 0
+		var max time.Duration
+		for _, deps := range [][]*DepNode{n.Deps, n.OrderOnlys} {
+			for _, d := range deps {
+				if c := cost(d); next[n] == nil || c > max {
+					max = c
+					next[n] = d
+				}
+			}
+		}
+		c := durations[n.Output] + max
+		costs[n] = c
+		return c
+	}
+	var root *DepNode
+	for _, n := range g.nodes {
+		if c := cost(n); root == nil || c > costs[root] {
+			root = n
+		}
+	}
+	var path []*DepNode
+	for n := root; n != nil; n = next[n] {
+		path = append(path, n)
+	}
+	fmt.Fprintf(w, "critical path: %.3fs\n", costs[root].Seconds())
+	for i := len(path) - 1; i >= 0; i-- {
+		if d, ok := durations[path[i].Output]; ok {
+			fmt.Fprintf(w, "  %.3fs %s\n", d.Seconds(), path[i].Output)
+		}
+	}
+
+	var targets []string
+	walkNodes(g.nodes, make(map[*DepNode]bool), func(n *DepNode) {
+		if _, ok := durations[n.Output]; ok {
+			targets = append(targets, n.Output)
+		}
+	})
+	sort.SliceStable(targets, func(i, j int) bool { return durations[targets[i]] > durations[targets[j]] })
+	if len(targets) > top {
+		targets = targets[:top]
+	}
+	fmt.Fprintf(w, "slowest targets:\n")
+	for _, t := range targets {
+		_, err = fmt.Fprintf(w, "  %.3fs %s\n", durations[t].Seconds(), t)
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestReportBuildLog(t *testing.T) {
+	chdirTestMakefile(t, `app: foo.o bar.o
+foo.o: gen.h
+gen.h:
+bar.o:
+`)
+	err := ioutil.WriteFile(".kati_log", []byte(`# kati log v1
+# build 100
+0	5000	0	foo.o
+# build 200
+0	1000	0	gen.h
+1000	3000	0	foo.o
+0	2500	0	bar.o
+3000	3200	0	app
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = ReportBuildLog(&buf, g, ".kati_log", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `critical path: 3.200s
+  1.000s gen.h
+  2.000s foo.o
+  0.200s app
+slowest targets:
+  2.500s bar.o
+  2.000s foo.o
+`
+	if got := buf.String(); got != want {
+		t.Errorf("ReportBuildLog:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExecBuildLog(t *testing.T) {
+	chdirTestMakefile(t, `all: foo
+	true
+foo:
+	touch foo
+fail:
+	exit 3
+`)
+	g, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"all", "fail"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the log is compacted by the first build, as more than half of
+	// it is stale.
+	err = ioutil.WriteFile(".kati_log", []byte(`# kati log v1
+# build 100
+0	10	0	foo
+0	10	0	all
+# build 200
+0	10	0	all
+# build 300
+0	10	0	all
+# build 400
+0	10	0	all
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		build  int
+		exit   int
+		target string
+	}
+	for i, tc := range []struct {
+		targets []string
+		want    []result
+	}{
+		{
+			targets: []string{"all"},
+			want:    []result{{0, 0, "foo"}, {1, 0, "all"}, {2, 0, "foo"}, {2, 0, "all"}},
+		},
+		{
+			// foo is up to date.
+			targets: []string{"all", "fail"},
+			want:    []result{{0, 0, "foo"}, {1, 0, "all"}, {2, 0, "foo"}, {2, 0, "all"}, {3, 0, "all"}, {3, 3, "fail"}},
+		},
+	} {
+		ex, err := NewExecutor(&ExecutorOpt{BuildLog: ".kati_log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.Exec(g, tc.targets)
+		entries, err := readBuildLog(".kati_log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []result
+		for _, e := range entries {
+			if e.end < e.start {
+				t.Errorf("exec #%d: %s ended at %d before it started at %d", i, e.target, e.end, e.start)
+			}
+			got = append(got, result{e.build, e.exit, e.target})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("exec #%d: log=%v; want %v", i, got, tc.want)
+		}
+	}
+}
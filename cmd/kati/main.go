@@ -16,8 +16,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -33,9 +35,22 @@ import (
 
 const shellDateTimeformat = time.RFC3339
 
+// katiLogFile is the build log written by -kati_log.
+const katiLogFile = ".kati_log"
+
 var (
-	makefileFlag string
-	jobsFlag     int
+	makefileFlag   string
+	jobsFlag       int
+	jobserverStyle string
+	outputSync     string
+	sandboxFlag    bool
+	accessReport   string
+	restatFlag     bool
+	katiLogFlag    bool
+	katiLogReport  bool
+	stopFlag       bool
+	debugAllFlag   bool
+	debugLevel     debugFlag
 
 	loadJSON string
 	saveJSON string
@@ -43,6 +58,8 @@ var (
 	saveGOB  string
 	useCache bool
 
+	saveFormat string
+
 	m2n  bool
 	goma bool
 
@@ -50,28 +67,65 @@ var (
 	heapprofile         string
 	memstats            string
 	traceEventFile      string
+	evalProfileFile     string
+	shellLogFile        string
 	syntaxCheckOnlyFlag bool
 	queryFlag           string
+	queryJSONFlag       bool
+	graphDotFile        string
+	graphJSONFile       string
+	graphPattern        string
+	symbolsJSONFile     string
+	traceVarFlag        string
+	graphDepth          int
 	eagerCmdEvalFlag    bool
 	generateNinja       bool
 	ninjaSuffix         string
+	productsFlag        string
+	productJobs         int
 	gomaDir             string
 	detectAndroidEcho   bool
+	rspfileThreshold    int
+	ninjaIncremental    bool
+	katiStamp           bool
+	regenFlag           bool
 	findCachePrunes     string
 	findCacheLeafNames  string
+	findCacheIgnore     string
+	findCacheIgnoreFile string
+	findCacheRoots      string
 	shellDate           string
+	serverSocket        string
+	clientSocket        string
+	watchFlag           bool
+	fmtFlag             bool
+	fmtAlignFlag        bool
+
+	warnUndefined       string
+	warnUnknownFunction string
+	warnInvalidOverride string
 )
 
 func init() {
 	// TODO: Make this default and replace this by -d flag.
 	flag.StringVar(&makefileFlag, "f", "", "Use it as a makefile")
 	flag.IntVar(&jobsFlag, "j", 1, "Allow N jobs at once.")
+	flag.StringVar(&outputSync, "output_sync", "", "Synchronize output of parallel jobs by type: none, line, target or recurse.")
+	flag.BoolVar(&sandboxFlag, "sandbox", false, "Run each command in a sandbox which has only prerequisites of the target, to check they are declared.")
+	flag.StringVar(&accessReport, "access_report", "", "Trace files which commands read and write, and write prerequisites missing in makefiles and files written by multiple targets to the file.")
+	flag.BoolVar(&restatFlag, "restat", false, "Record hashes of outputs in .kati_restat, and don't remake targets depending on outputs which commands regenerate with the same contents.")
+	flag.BoolVar(&katiLogFlag, "kati_log", false, "Log commands run and how long they took in .kati_log.")
+	flag.BoolVar(&katiLogReport, "kati_log_report", false, "Show the critical path and the slowest targets by .kati_log, instead of building targets.")
+	flag.StringVar(&jobserverStyle, "jobserver_style", "", "Style of the jobserver for -j: fifo or pipe. fifo by default except on windows.")
 
 	flag.StringVar(&loadGOB, "load", "", "")
 	flag.StringVar(&saveGOB, "save", "", "")
 	flag.StringVar(&loadJSON, "load_json", "", "")
 	flag.StringVar(&saveJSON, "save_json", "", "")
 	flag.BoolVar(&useCache, "use_cache", false, "Use cache.")
+	flag.StringVar(&saveFormat, "save_format", "gob", "Format of -load, -save and -use_cache: gob, json or proto.")
+	flag.BoolVar(&kati.CacheFingerprints, "cache_fingerprints", false, "Expire the cache if results of $(wildcard), environment variables used or outputs of $(shell) change.")
+	flag.BoolVar(&kati.RegenDebug, "regen_debug", false, "Print why makefiles are loaded again instead of using the cache.")
 
 	flag.BoolVar(&m2n, "m2n", false, "m2n mode")
 	flag.BoolVar(&goma, "goma", false, "ensure goma start")
@@ -80,32 +134,106 @@ func init() {
 	flag.StringVar(&heapprofile, "kati_heapprofile", "", "write heap profile to `file`")
 	flag.StringVar(&memstats, "kati_memstats", "", "Show memstats with given templates")
 	flag.StringVar(&traceEventFile, "kati_trace_event", "", "write trace event to `file`")
+	flag.StringVar(&evalProfileFile, "kati_eval_profile", "", "profile evaluation time and allocation of each makefile, rule, variable and function, and write the report to `file`, or stdout if -")
 	flag.BoolVar(&syntaxCheckOnlyFlag, "c", false, "Syntax check only.")
-	flag.StringVar(&queryFlag, "query", "", "Show the target info")
+	flag.StringVar(&queryFlag, "query", "", "Show the target info, or query the graph by deps:X, rules:PATTERN, cmd:X or why:X")
+	flag.BoolVar(&queryJSONFlag, "query_json", false, "Print the result of -query in JSON.")
+	flag.StringVar(&graphDotFile, "graph_dot", "", "write the dependency graph in DOT to `file`")
+	flag.StringVar(&graphJSONFile, "graph_json", "", "write the dependency graph in JSON to `file`")
+	flag.StringVar(&symbolsJSONFile, "symbols_json", "", "write where variables are assigned and expanded, and rules of targets, in JSON to `file`")
+	flag.StringVar(&traceVarFlag, "trace_var", "", "Comma separated names of variables whose assignments and expansions are printed to stderr with their locations.")
+	flag.StringVar(&graphPattern, "graph_pattern", "", "shell pattern of targets for -graph_dot and -graph_json")
+	flag.IntVar(&graphDepth, "graph_depth", 0, "maximum depth of prerequisites for -graph_dot and -graph_json. 0 means no limit.")
 	flag.BoolVar(&eagerCmdEvalFlag, "eager_cmd_eval", false, "Eval commands first.")
 	flag.BoolVar(&generateNinja, "ninja", false, "Generate build.ninja.")
 	flag.StringVar(&ninjaSuffix, "ninja_suffix", "", "suffix for ninja files.")
+	flag.StringVar(&productsFlag, "products", "", "Comma separated TARGET_PRODUCT-TARGET_BUILD_VARIANT combinations, e.g. aosp_arm-eng,aosp_x86-userdebug. With -ninja, evaluate the tree for them concurrently, and generate ninja files with the suffix followed by -<product> for each.")
+	flag.IntVar(&productJobs, "product_jobs", 0, "Evaluate at most N products of -products at once. 0 means all at once.")
 	flag.StringVar(&gomaDir, "goma_dir", "", "If specified, use goma to build C/C++ files.")
 	flag.BoolVar(&detectAndroidEcho, "detect_android_echo", false, "detect echo as ninja description.")
+	flag.IntVar(&rspfileThreshold, "ninja_rspfile_threshold", 0, "write commands longer than this into rspfiles in ninja files. 0 means the limit of the shell.")
+	flag.BoolVar(&ninjaIncremental, "ninja_incremental", false, "regenerate only changed build statements in ninja files.")
+	flag.BoolVar(&katiStamp, "kati_stamp", false, "write .kati_stamp<suffix> of ckati with ninja files.")
+	flag.BoolVar(&regenFlag, "regen", false, "regenerate ninja files only if .kati_stamp<suffix> says inputs were changed, as ckati --regen. Implies -kati_stamp.")
 
 	flag.StringVar(&findCachePrunes, "find_cache_prunes", "",
 		"space separated prune directories for find cache.")
 	flag.StringVar(&findCacheLeafNames, "find_cache_leaf_names", "",
 		"space separated leaf names for find cache.")
+	flag.StringVar(&findCacheIgnore, "find_cache_ignore", "",
+		"space separated .gitignore-style patterns of directories find cache doesn't scan, e.g. \"node_modules /out-*\".")
+	flag.StringVar(&findCacheIgnoreFile, "find_cache_ignore_file", "",
+		"read .gitignore-style patterns of directories find cache doesn't scan from `file`.")
+	flag.StringVar(&findCacheRoots, "find_cache_roots", "",
+		"space separated directories find cache scans in addition to the current directory, e.g. \"out ../overlay\".")
+	flag.StringVar(&kati.FindCacheFile, "find_cache_file", "",
+		"save the scanned files of find cache into `file`, and load them if the tree is not modified.")
+	flag.IntVar(&kati.FindCacheSymlinkDepth, "find_cache_symlink_depth", kati.FindCacheSymlinkDepth,
+		"maximum number of symlinks to directories followed in a path by find cache for find -L and findleaves. Deeper ones run in the shell.")
+	flag.StringVar(&shellLogFile, "shell_log", "", "write $(shell) commands evaluated in makefiles to `file` as JSON lines, with their locations, durations and output sizes.")
+	flag.StringVar(&kati.ShellCacheFile, "shell_cache_file", "",
+		"save outputs of $(shell) run while .KATI_SHELL_DEPS is defined into `file`, and reuse them while the files listed in it are not modified.")
 	flag.StringVar(&shellDate, "shell_date", "", "specify $(shell date) time as "+shellDateTimeformat)
+	flag.StringVar(&serverSocket, "kati_server", "", "Run as a server listening on unix domain `socket`.")
+	flag.StringVar(&clientSocket, "kati_client", "", "Send the request to a server listening on unix domain `socket`.")
+	flag.BoolVar(&fmtFlag, "fmt", false, "Print the makefile formatted, with whitespace normalized, to stdout.")
+	flag.BoolVar(&fmtAlignFlag, "fmt_align", false, "Align operators of consecutive assignments with -fmt.")
+	flag.BoolVar(&watchFlag, "watch", false, "Keep running, and generate ninja files again when makefiles are changed.")
 
 	flag.BoolVar(&kati.StatsFlag, "kati_stats", false, "Show a bunch of statistics")
 	flag.BoolVar(&kati.PeriodicStatsFlag, "kati_periodic_stats", false, "Show a bunch of periodic statistics")
 	flag.BoolVar(&kati.EvalStatsFlag, "kati_eval_stats", false, "Show eval statistics")
 
 	flag.BoolVar(&kati.DryRunFlag, "n", false, "Only print the commands that would be executed")
+	flag.BoolVar(&kati.QuestionFlag, "q", false, "Run no commands; exit status is 1 if targets are not up to date.")
+	flag.BoolVar(&kati.TouchFlag, "t", false, "Touch targets instead of remaking them.")
+	flag.BoolVar(&kati.KeepGoingFlag, "k", false, "Keep going when some targets can't be made.")
+	flag.BoolVar(&stopFlag, "S", false, "Turns off -k.")
+	flag.BoolVar(&kati.TraceFlag, "trace", false, "Print why each target is remade, and its commands even if they are silent.")
+	flag.Var(&debugLevel, "debug", "Print debug messages of comma separated categories: a (all), b (basic), v (verbose), i (implicit), j (jobs), m (makefiles) or n (none). b if no categories are given, as --debug.")
+	flag.BoolVar(&debugAllFlag, "d", false, "Print all debug messages. Same as --debug=a.")
 
 	// TODO: Make this default.
 	flag.BoolVar(&kati.UseFindCache, "use_find_cache", false, "Use find cache.")
 	flag.BoolVar(&kati.UseShellBuiltins, "use_shell_builtins", true, "Use shell builtins")
+	flag.BoolVar(&kati.CaseInsensitiveFS, "case_insensitive_fs", kati.CaseInsensitiveFS, "Match a file name without wildcards in $(wildcard) ignoring case.")
+	flag.StringVar(&kati.WildcardFold, "wildcard_fold", kati.WildcardFold, "Match names in $(wildcard) ignoring case and Unicode normalization: off, on, or auto (as each file system does, e.g. APFS on macOS).")
+	flag.StringVar(&kati.WildcardOrder, "wildcard_order", kati.WildcardOrder, "Order of names in each directory which $(wildcard) returns: sorted, directory (as GNU make 3.82 to 4.2), or check (sorted, warning about results which differ in directory order).")
+	flag.BoolVar(&kati.UseExpandCache, "use_expand_cache", false, "Cache expansions of recursive variables.")
 	flag.StringVar(&kati.IgnoreOptionalInclude, "ignore_optional_include", "", "If specified, skip reading -include directives start with the specified path.")
+	flag.BoolVar(&kati.NoBuiltinRules, "r", false, "Eliminate use of the built-in implicit rules.")
+	flag.BoolVar(&kati.NoBuiltinRules, "no_builtin_rules", false, "Same as -r.")
+	flag.BoolVar(&kati.NoBuiltinVars, "R", false, "Eliminate use of the built-in variables. It implies -r.")
+	flag.BoolVar(&kati.NoBuiltinVars, "no_builtin_variables", false, "Same as -R.")
+	flag.BoolVar(&kati.EnvironmentOverrides, "e", false, "Environment variables override makefiles.")
+	flag.BoolVar(&kati.EnvironmentOverrides, "environment_overrides", false, "Same as -e.")
+	flag.BoolVar(&kati.PosixMode, "posix", false, "POSIX make compatibility mode. Warn GNU make extensions.")
+	flag.StringVar(&kati.MakeVersion, "make_version", kati.MakeVersion, "Version of GNU make to pretend to be in $(MAKE_VERSION) and $(.FEATURES).")
+	flag.BoolVar(&kati.DiagnosticsJSON, "diagnostics_json", false, "Print warnings and errors in makefiles to stderr as JSON lines.")
+	flag.BoolVar(&kati.WarnFlag, "warn", false, "Warn about suspicious constructs in makefiles, e.g. undefined variables.")
+	flag.StringVar(&warnUndefined, "warn_undefined", "", "Level of references to undefined variables: off, warn or error.")
+	flag.StringVar(&warnUnknownFunction, "warn_unknown_function", "", "Level of references to unknown functions: off, warn or error.")
+	flag.StringVar(&warnInvalidOverride, "warn_invalid_override", "", "Level of invalid override directives: off, warn or error.")
+	flag.IntVar(&kati.ParallelEvalJobs, "parallel_eval", 0, "Evaluate files of an include directive with N goroutines if they are isolated.")
+	flag.IntVar(&kati.ShellJobs, "shell_jobs", 0, "Run at most N $(shell) commands of simple assignments in parallel while evaluating makefiles, until their variables are used. 0 or 1 runs them sequentially.")
 }
 
+// debugFlag is the value of --debug, which may have no argument.
+type debugFlag string
+
+func (f *debugFlag) String() string { return string(*f) }
+
+func (f *debugFlag) Set(s string) error {
+	if s == "true" {
+		// --debug without argument.
+		s = "b"
+	}
+	*f = debugFlag(s)
+	return nil
+}
+
+func (f *debugFlag) IsBoolFlag() bool { return true }
+
 func writeHeapProfile() {
 	f, err := os.Create(heapprofile)
 	if err != nil {
@@ -115,6 +243,31 @@ func writeHeapProfile() {
 	f.Close()
 }
 
+// evalProfileTop is the number of entries of each kind in the report of
+// -kati_eval_profile.
+const evalProfileTop = 30
+
+func writeEvalProfile() {
+	if evalProfileFile == "-" {
+		kati.WriteEvalProfile(os.Stdout, evalProfileTop)
+		return
+	}
+	f, err := os.Create(evalProfileFile)
+	if err != nil {
+		glog.Errorf("eval profile: %v", err)
+		return
+	}
+	err = kati.WriteEvalProfile(f, evalProfileTop)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		glog.Errorf("eval profile: %v", err)
+	}
+}
+
 type memStatsDumper struct {
 	*template.Template
 }
@@ -132,7 +285,7 @@ func (t memStatsDumper) dump() {
 
 func load(req kati.LoadReq) (*kati.DepGraph, error) {
 	if loadGOB != "" {
-		g, err := kati.GOB.Load(loadGOB)
+		g, err := kati.CacheFormat.Load(loadGOB)
 		return g, err
 	}
 	if loadJSON != "" {
@@ -143,10 +296,37 @@ func load(req kati.LoadReq) (*kati.DepGraph, error) {
 	return g, err
 }
 
+// loadRemade loads makefiles and remakes them as GNU make does, and
+// loads them again while any of them is remade.
+func loadRemade(req kati.LoadReq, execOpt *kati.ExecutorOpt) (*kati.DepGraph, error) {
+	req.RemakeMakefiles = true
+	for {
+		g, err := kati.Load(req)
+		if err != nil {
+			return nil, err
+		}
+		ex, err := kati.NewExecutor(execOpt)
+		if err != nil {
+			return nil, err
+		}
+		remade, err := ex.RemakeMakefiles(g)
+		if err != nil {
+			return nil, err
+		}
+		if !remade {
+			return g, nil
+		}
+		req.Restarts++
+		if kati.Debug&kati.DebugBasic != 0 {
+			fmt.Printf("Re-executing[%d]: %s\n", req.Restarts, strings.Join(os.Args, " "))
+		}
+	}
+}
+
 func save(g *kati.DepGraph, targets []string) error {
 	var err error
 	if saveGOB != "" {
-		err = kati.GOB.Save(g, saveGOB, targets)
+		err = kati.CacheFormat.Save(g, saveGOB, targets)
 	}
 	if saveJSON != "" {
 		serr := kati.JSON.Save(g, saveJSON, targets)
@@ -157,6 +337,52 @@ func save(g *kati.DepGraph, targets []string) error {
 	return err
 }
 
+// writeGraph writes the dependency graph to -graph_dot and -graph_json.
+func writeGraph(g *kati.DepGraph) error {
+	opt := &kati.GraphOpt{
+		Pattern: graphPattern,
+		Depth:   graphDepth,
+	}
+	for _, out := range []struct {
+		filename string
+		write    func(io.Writer, *kati.GraphOpt) error
+	}{
+		{filename: graphDotFile, write: g.WriteDot},
+		{filename: graphJSONFile, write: g.WriteJSON},
+	} {
+		if out.filename == "" {
+			continue
+		}
+		f, err := os.Create(out.filename)
+		if err != nil {
+			return err
+		}
+		err = out.write(f, opt)
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSymbols writes the symbol index to -symbols_json.
+func writeSymbols(g *kati.DepGraph) error {
+	f, err := os.Create(symbolsJSONFile)
+	if err != nil {
+		return err
+	}
+	err = g.WriteSymbolsJSON(f)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func m2nsetup() {
 	fmt.Println("kati: m2n mode")
 	generateNinja = true
@@ -202,6 +428,48 @@ func main() {
 	}
 	flag.Parse()
 	args := flag.Args()
+	// run by $(MAKE) of "make -n", "make -t", "make -q" or "make -k".
+	makeflags := os.Getenv("MAKEFLAGS")
+	kati.DryRunFlag = kati.DryRunFlag || kati.MakeflagsHas(makeflags, 'n')
+	kati.TouchFlag = kati.TouchFlag || kati.MakeflagsHas(makeflags, 't')
+	kati.QuestionFlag = kati.QuestionFlag || kati.MakeflagsHas(makeflags, 'q')
+	kati.KeepGoingFlag = (kati.KeepGoingFlag || kati.MakeflagsHas(makeflags, 'k')) && !stopFlag
+	kati.NoBuiltinRules = kati.NoBuiltinRules || kati.MakeflagsHas(makeflags, 'r')
+	kati.NoBuiltinVars = kati.NoBuiltinVars || kati.MakeflagsHas(makeflags, 'R')
+	kati.EnvironmentOverrides = kati.EnvironmentOverrides || kati.MakeflagsHas(makeflags, 'e')
+	if jobsFlag == 1 {
+		if n := kati.MakeflagsJobs(makeflags); n > 0 {
+			jobsFlag = n
+		}
+	}
+	if outputSync == "" {
+		outputSync = kati.OutputSyncMakeflag(makeflags)
+	}
+	kati.TraceFlag = kati.TraceFlag || kati.MakeflagsTrace(makeflags)
+	debugArg := string(debugLevel)
+	if debugAllFlag {
+		debugArg += ",a"
+	}
+	if debugArg == "" {
+		debugArg = kati.MakeflagsDebug(makeflags)
+	}
+	if debug, err := kati.ParseDebugFlags(debugArg); err != nil {
+		fmt.Printf("kati: *** %v.  Stop.\n", err)
+		os.Exit(2)
+	} else {
+		kati.Debug = debug
+	}
+	for code, level := range map[string]string{
+		kati.DiagUndefinedVariable: warnUndefined,
+		kati.DiagUnknownFunction:   warnUnknownFunction,
+		kati.DiagInvalidOverride:   warnInvalidOverride,
+	} {
+		err := kati.SetDiagLevel(code, level)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
 	if m2n {
 		generateNinja = true
 		if !m2ncmd {
@@ -224,7 +492,13 @@ func main() {
 		gomasetup()
 	}
 	err := katiMain(args)
+	if err == kati.ErrOutOfDate {
+		os.Exit(1)
+	}
 	if err != nil {
+		if d, ok := kati.ErrorDiagnostic(err); ok && kati.DiagnosticsJSON {
+			kati.ReportDiagnostic(d)
+		}
 		fmt.Println(err)
 		// http://www.gnu.org/software/make/manual/html_node/Running.html
 		os.Exit(2)
@@ -260,6 +534,35 @@ func katiMain(args []string) error {
 		kati.TraceEventStart(f)
 		defer kati.TraceEventStop()
 	}
+	if evalProfileFile != "" {
+		kati.EvalProfileFlag = true
+		defer writeEvalProfile()
+	}
+	if symbolsJSONFile != "" {
+		kati.SymbolIndexFlag = true
+	}
+	if traceVarFlag != "" {
+		kati.TraceVars = make(map[string]bool)
+		for _, name := range strings.Split(traceVarFlag, ",") {
+			kati.TraceVars[strings.TrimSpace(name)] = true
+		}
+	}
+	if shellLogFile != "" {
+		f, err := os.Create(shellLogFile)
+		if err != nil {
+			return err
+		}
+		kati.StartShellLog(f)
+		defer func() {
+			err := kati.StopShellLog()
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				glog.Errorf("shell log: %v", err)
+			}
+		}()
+	}
 
 	if shellDate != "" {
 		if shellDate == "ref" {
@@ -276,20 +579,109 @@ func katiMain(args []string) error {
 	if findCacheLeafNames != "" {
 		leafNames = strings.Fields(findCacheLeafNames)
 	}
+	kati.FindCacheIgnore = strings.Fields(findCacheIgnore)
+	kati.FindCacheRoots = strings.Fields(findCacheRoots)
+	if findCacheIgnoreFile != "" {
+		patterns, err := kati.ReadFindCacheIgnoreFile(findCacheIgnoreFile)
+		if err != nil {
+			return err
+		}
+		kati.FindCacheIgnore = append(kati.FindCacheIgnore, patterns...)
+	}
 	if findCachePrunes != "" {
 		kati.UseFindCache = true
 		kati.AndroidFindCacheInit(strings.Fields(findCachePrunes), leafNames)
 	}
 
+	if fmtFlag {
+		out, err := kati.FormatFile(makefileFlag, &kati.FormatOpt{AlignAssigns: fmtAlignFlag})
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	if serverSocket != "" {
+		return kati.ListenAndServe(serverSocket)
+	}
+
+	format, err := kati.LoadSaverFormat(saveFormat)
+	if err != nil {
+		return err
+	}
+	kati.CacheFormat = format
+
 	req := kati.FromCommandLine(args)
+	// variables in MAKEFLAGS are overridden by ones on the command line.
+	req.CommandLineVars = append(kati.MakeflagsVars(os.Getenv("MAKEFLAGS")), req.CommandLineVars...)
 	if makefileFlag != "" {
 		req.Makefile = makefileFlag
 	}
 	req.EnvironmentVars = os.Environ()
-	req.UseCache = useCache
+	// the cache has no symbol index, and makefiles are not evaluated
+	// to trace variables.
+	req.UseCache = useCache && symbolsJSONFile == "" && traceVarFlag == ""
 	req.EagerEvalCommand = eagerCmdEvalFlag
 
-	g, err := load(req)
+	if clientSocket != "" {
+		return client(req)
+	}
+	if productsFlag != "" {
+		return generateProducts(req)
+	}
+	if generateNinja && regenFlag {
+		r, err := kati.CheckKatiStamp(ninjaSuffix, req.EnvironmentVars)
+		switch {
+		case err != nil:
+			glog.Warningf("regen: %v", err)
+		case r == nil:
+			fmt.Fprintln(os.Stderr, "No need to regenerate ninja file")
+			return nil
+		case kati.RegenDebug:
+			fmt.Fprintf(os.Stderr, "kati: regenerating: %v\n", r)
+		}
+	}
+	if generateNinja && (katiStamp || regenFlag) {
+		req.TrackMakefiles = true
+		kati.CacheFingerprints = true
+	}
+	if watchFlag {
+		return watch(req)
+	}
+
+	execOpt := &kati.ExecutorOpt{
+		NumJobs:        jobsFlag,
+		JobserverStyle: jobserverStyle,
+		OutputSync:     outputSync,
+	}
+	if restatFlag {
+		execOpt.RestatFile = ".kati_restat"
+	}
+	if katiLogFlag {
+		execOpt.BuildLog = katiLogFile
+	}
+	if sandboxFlag {
+		execOpt.CommandRunner = kati.SandboxCommandRunner{}
+	}
+	var tracer *kati.FileAccessTracer
+	if accessReport != "" {
+		if sandboxFlag {
+			return fmt.Errorf("-access_report doesn't support -sandbox")
+		}
+		tracer, err = kati.NewFileAccessTracer()
+		if err != nil {
+			return err
+		}
+		execOpt.CommandRunner = tracer
+	}
+	var g *kati.DepGraph
+	if loadGOB == "" && loadJSON == "" && !generateNinja && !syntaxCheckOnlyFlag && graphDotFile == "" && graphJSONFile == "" && symbolsJSONFile == "" && queryFlag == "" && !katiLogReport {
+		// makefiles are remade only when targets are built.
+		g, err = loadRemade(req, execOpt)
+	} else {
+		g, err = load(req)
+	}
 	if err != nil {
 		return err
 	}
@@ -303,6 +695,9 @@ func katiMain(args []string) error {
 		n := kati.NinjaGenerator{
 			GomaDir:           gomaDir,
 			DetectAndroidEcho: detectAndroidEcho,
+			RspfileThreshold:  rspfileThreshold,
+			Incremental:       ninjaIncremental,
+			KatiStamp:         katiStamp || regenFlag,
 		}
 		return n.Save(g, ninjaSuffix, req.Targets)
 	}
@@ -311,21 +706,182 @@ func katiMain(args []string) error {
 		return nil
 	}
 
+	if graphDotFile != "" || graphJSONFile != "" {
+		return writeGraph(g)
+	}
+
+	if symbolsJSONFile != "" {
+		return writeSymbols(g)
+	}
+
 	if queryFlag != "" {
+		if queryJSONFlag {
+			return kati.QueryJSON(os.Stdout, queryFlag, g)
+		}
 		kati.Query(os.Stdout, queryFlag, g)
 		return nil
 	}
 
-	execOpt := &kati.ExecutorOpt{
-		NumJobs: jobsFlag,
+	if katiLogReport {
+		return kati.ReportBuildLog(os.Stdout, g, katiLogFile, 10)
 	}
+
 	ex, err := kati.NewExecutor(execOpt)
 	if err != nil {
 		return err
 	}
 	err = ex.Exec(g, req.Targets)
+	if tracer != nil {
+		// the report tells why commands failed, too.
+		rerr := writeAccessReport(tracer)
+		if err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func writeAccessReport(tracer *kati.FileAccessTracer) error {
+	f, err := os.Create(accessReport)
 	if err != nil {
 		return err
 	}
+	err = tracer.WriteReport(f)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// generateProducts generates ninja files for each product of -products
+// concurrently.
+func generateProducts(req kati.LoadReq) error {
+	if !generateNinja {
+		return fmt.Errorf("-products supports only -ninja")
+	}
+	if useCache || loadGOB != "" || loadJSON != "" {
+		return fmt.Errorf("-products doesn't support -use_cache or -load")
+	}
+	products, err := kati.ParseProducts(productsFlag)
+	if err != nil {
+		return err
+	}
+	if regenFlag {
+		var stale []kati.Product
+		for _, p := range products {
+			r, err := kati.CheckKatiStamp(p.NinjaSuffix(ninjaSuffix), req.EnvironmentVars)
+			switch {
+			case err != nil:
+				glog.Warningf("regen %s: %v", p, err)
+			case r == nil:
+				fmt.Fprintf(os.Stderr, "No need to regenerate ninja file for %s\n", p)
+				continue
+			case kati.RegenDebug:
+				fmt.Fprintf(os.Stderr, "kati: regenerating %s: %v\n", p, r)
+			}
+			stale = append(stale, p)
+		}
+		products = stale
+		if len(products) == 0 {
+			return nil
+		}
+	}
+	if katiStamp || regenFlag {
+		req.TrackMakefiles = true
+		kati.CacheFingerprints = true
+	}
+	n := kati.NinjaGenerator{
+		GomaDir:           gomaDir,
+		DetectAndroidEcho: detectAndroidEcho,
+		RspfileThreshold:  rspfileThreshold,
+		Incremental:       ninjaIncremental,
+		KatiStamp:         katiStamp || regenFlag,
+	}
+	return kati.DefaultSession.GenerateProductsNinja(context.Background(), n, req, products, ninjaSuffix, productJobs)
+}
+
+// client sends req to the kati server. The server loads makefiles, and
+// generates ninja files or answers the query.
+func client(req kati.LoadReq) error {
+	if useCache {
+		return fmt.Errorf("-kati_client doesn't support -use_cache")
+	}
+	method := "Load"
+	switch {
+	case generateNinja:
+		method = "GenerateNinja"
+	case syntaxCheckOnlyFlag:
+	case queryFlag != "":
+		method = "Query"
+	default:
+		return fmt.Errorf("-kati_client supports only -ninja, -c or -query")
+	}
+	c, err := kati.DialServer(clientSocket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	reply, err := c.Call(method, kati.ServerReq{
+		LoadReq:           req,
+		Query:             queryFlag,
+		QueryJSON:         queryJSONFlag,
+		NinjaSuffix:       ninjaSuffix,
+		GomaDir:           gomaDir,
+		DetectAndroidEcho: detectAndroidEcho,
+		RspfileThreshold:  rspfileThreshold,
+		NinjaIncremental:  ninjaIncremental,
+	})
+	if err != nil {
+		return err
+	}
+	if reply.Loaded {
+		glog.Infof("kati server loaded %s: %s", req.Makefile, reply.Reason)
+		if kati.RegenDebug && reply.RegenReason != nil {
+			fmt.Fprintf(os.Stderr, "kati: regenerating: %v\n", reply.RegenReason)
+		}
+	}
+	fmt.Print(reply.Output)
 	return nil
 }
+
+// watch generates ninja files for req, and generates them again
+// whenever makefiles are changed.
+func watch(req kati.LoadReq) error {
+	if !generateNinja {
+		return fmt.Errorf("-watch supports only -ninja")
+	}
+	if useCache {
+		return fmt.Errorf("-watch doesn't support -use_cache")
+	}
+	s, err := kati.NewServer()
+	if err != nil {
+		return err
+	}
+	stop, err := s.Watch()
+	if err != nil {
+		return err
+	}
+	defer stop()
+	sreq := kati.ServerReq{
+		LoadReq:           req,
+		NinjaSuffix:       ninjaSuffix,
+		GomaDir:           gomaDir,
+		DetectAndroidEcho: detectAndroidEcho,
+		RspfileThreshold:  rspfileThreshold,
+		NinjaIncremental:  ninjaIncremental,
+	}
+	for {
+		var reply kati.ServerReply
+		err = s.GenerateNinja(sreq, &reply)
+		if err != nil {
+			return err
+		}
+		fmt.Println("kati: waiting for changes of makefiles")
+		reason, err := s.WaitStale(sreq)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("kati: %s\n", reason)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// CommandRunner runs commands of recipes. ExecutorOpt.CommandRunner
+// dispatches commands to e.g. a remote execution service or a
+// container, instead of LocalCommandRunner.
+//
+// Commands for recursive makes, i.e. prefixed with '+' or referring
+// to $(MAKE), always run by LocalCommandRunner, as they share the
+// jobserver and the output of the parent make.
+type CommandRunner interface {
+	// RunCommand runs c and waits for it. If the command fails, the
+	// error should have the method "ExitStatus() int", e.g.
+	// *ExitError or *exec.ExitError, which tells its exit status.
+	RunCommand(ctx context.Context, c *Command) error
+}
+
+// Command is a command line of a recipe.
+type Command struct {
+	// Target is the target whose recipe has the command.
+	Target string
+	// Script runs by Shell with ShellFlags, e.g. "/bin/sh" and "-c".
+	Shell      string
+	ShellFlags string
+	Script     string
+	// Dir is the working directory of the command. If empty, the
+	// current directory is used.
+	Dir string
+	// Env is the environment of the command, or nil to use
+	// os.Environ().
+	Env []string
+	// Inputs are files the command reads as far as the dependency
+	// graph knows, i.e. prerequisites of the target including
+	// order-only ones. Outputs are files the command makes, i.e. the
+	// target, or all targets of a grouped rule.
+	Inputs  []string
+	Outputs []string
+	// Stdout and Stderr are where the output of the command is
+	// written.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// extraFiles are the jobserver passed to recursive makes.
+	extraFiles []*os.File
+	// debugJobs prints the child process by DebugJobs.
+	debugJobs bool
+}
+
+// ExitError is an error of a command which exits with Status.
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// ExitStatus returns the exit status of the command.
+func (e *ExitError) ExitStatus() int {
+	return e.Status
+}
+
+// LocalCommandRunner runs commands in subprocesses of the shell.
+type LocalCommandRunner struct{}
+
+// RunCommand runs c in a subprocess.
+func (LocalCommandRunner) RunCommand(ctx context.Context, c *Command) error {
+	cmd, cleanup, err := localCommand(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if !c.debugJobs {
+		return cmd.Run()
+	}
+	return runChild(cmd, c.Target)
+}
+
+// localCommand returns the subprocess of the shell for c. cleanup
+// removes the temporary script, if any, after the subprocess exits.
+func localCommand(ctx context.Context, c *Command) (cmd *exec.Cmd, cleanup func(), err error) {
+	cmd, cleanup, err = shellCommand(ctx, c.Shell, c.ShellFlags, c.Script)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cmd.Dir = c.Dir
+	cmd.Env = c.Env
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	cmd.ExtraFiles = c.extraFiles
+	return cmd, cleanup, nil
+}
+
+// runChild runs cmd for the target, printing messages of DebugJobs to
+// the output of cmd. Unless the output is a file which cmd writes
+// directly, the output is buffered so that it is written between the
+// messages.
+func runChild(cmd *exec.Cmd, target string) error {
+	w := cmd.Stdout
+	var out bytes.Buffer
+	if _, ok := w.(*os.File); !ok {
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+	}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	fmt.Fprintf(w, "Putting child (%s) PID %d on the chain.\n", target, pid)
+	fmt.Fprintf(w, "Live child (%s) PID %d\n", target, pid)
+	err = cmd.Wait()
+	w.Write(out.Bytes())
+	result := "winning"
+	if err != nil {
+		result = "losing"
+	}
+	fmt.Fprintf(w, "Reaping %s child (%s) PID %d\n", result, target, pid)
+	fmt.Fprintf(w, "Removing child (%s) PID %d from chain.\n", target, pid)
+	return err
+}
+
+// errRemoteExecution is returned by RemoteCommandRunner, which can't
+// connect to the service yet.
+var errRemoteExecution = errors.New("remote execution is not supported")
+
+// RemoteCommandRunner is a stub of the runner which sends commands to
+// a remote execution service over gRPC, e.g. one implementing the
+// Remote Execution API of Bazel. It makes the action of each command,
+// i.e. its arguments, environment, input and output files, but doesn't
+// send it. Commands run by Fallback, or fail if it is nil.
+type RemoteCommandRunner struct {
+	// Addr is the address of the service, e.g. "localhost:8980".
+	Addr string
+	// Instance is the instance name of the service.
+	Instance string
+	// Fallback runs commands instead of the service, or nil.
+	Fallback CommandRunner
+}
+
+// remoteAction is what RemoteCommandRunner would send for a command.
+type remoteAction struct {
+	args    []string
+	env     []string
+	inputs  []string
+	outputs []string
+}
+
+func newRemoteAction(c *Command) *remoteAction {
+	shell := c.Shell
+	if shell == "" {
+		shell = defaultShell()
+	}
+	flags := c.ShellFlags
+	if flags == "" {
+		flags = shellFlag(shell)
+	}
+	a := &remoteAction{
+		args:    append(append([]string{shell}, strings.Fields(flags)...), c.Script),
+		env:     c.Env,
+		outputs: c.Outputs,
+	}
+	if a.env == nil {
+		a.env = os.Environ()
+	}
+	for _, in := range c.Inputs {
+		// inputs which don't exist are phony targets.
+		if exists(in) {
+			a.inputs = append(a.inputs, in)
+		}
+	}
+	return a
+}
+
+// RunCommand runs c by Fallback, after making its action.
+func (r RemoteCommandRunner) RunCommand(ctx context.Context, c *Command) error {
+	a := newRemoteAction(c)
+	glog.V(1).Infof("remote action for %s at %s/%s: args:%q inputs:%q outputs:%q", c.Target, r.Addr, r.Instance, a.args, a.inputs, a.outputs)
+	if r.Fallback == nil {
+		return fmt.Errorf("%s: %v", r.Addr, errRemoteExecution)
+	}
+	return r.Fallback.RunCommand(ctx, c)
+}
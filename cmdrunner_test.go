@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingRunner records commands instead of running them. Commands
+// whose script starts with "exit " fail.
+type recordingRunner struct {
+	cmds []Command
+}
+
+func (r *recordingRunner) RunCommand(ctx context.Context, c *Command) error {
+	r.cmds = append(r.cmds, Command{
+		Target:  c.Target,
+		Script:  c.Script,
+		Inputs:  c.Inputs,
+		Outputs: c.Outputs,
+	})
+	if strings.HasPrefix(c.Script, "exit ") {
+		return &ExitError{Status: 3}
+	}
+	return nil
+}
+
+func TestCommandRunner(t *testing.T) {
+	mk := writeTestMakefile(t, `all: a b | c
+	echo $@ > $@
+a b &: d
+	touch a b
+c:
+d:
+	+true
+fail:
+	exit 3
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+	g, err := Load(LoadReq{Makefile: mk, Targets: []string{"all", "fail"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := &recordingRunner{}
+	for _, cr := range []CommandRunner{rr, RemoteCommandRunner{Addr: "localhost:8980", Fallback: rr}} {
+		rr.cmds = nil
+		ex, err := NewExecutor(&ExecutorOpt{CommandRunner: cr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the command with '+' runs locally.
+		want := []Command{
+			{Target: "a", Script: "touch a b", Inputs: []string{"d"}, Outputs: []string{"a", "b"}},
+			{Target: "all", Script: "echo all > all", Inputs: []string{"a", "b", "c"}, Outputs: []string{"all"}},
+		}
+		if !reflect.DeepEqual(rr.cmds, want) {
+			t.Errorf("%T: commands=%+v; want %+v", cr, rr.cmds, want)
+		}
+
+		ex, err = NewExecutor(&ExecutorOpt{CommandRunner: cr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, []string{"fail"})
+		if err == nil || err.Error() != "*** [fail] Error 3" {
+			t.Errorf("%T: Exec(fail)=%v; want *** [fail] Error 3", cr, err)
+		}
+	}
+
+	ex, err := NewExecutor(&ExecutorOpt{CommandRunner: RemoteCommandRunner{Addr: "localhost:8980"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err == nil {
+		t.Errorf("Exec with RemoteCommandRunner without Fallback succeeded; want error")
+	}
+}
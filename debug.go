@@ -0,0 +1,249 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Debug output of --debug and --trace, in the same format as GNU make,
+// so that output of kati and GNU make can be compared.
+//
+// GNU make prints messages of a target when it considers the target,
+// before its prerequisites, and when it remakes the target, after
+// them. Executor makes jobs of all targets first, so the messages
+// printed before prerequisites are deferred until a job or one of its
+// descendants is built. As jobs are built in depth first order if they
+// run one by one, the messages are in the same order as GNU make.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// DebugFlags are categories of debug messages.
+type DebugFlags int
+
+const (
+	// DebugBasic prints targets which are out of date, and whether
+	// they are remade successfully.
+	DebugBasic DebugFlags = 1 << iota
+	// DebugVerbose prints makefiles read, and targets considered
+	// even if they are up to date.
+	DebugVerbose
+	// DebugImplicit prints implicit rules searched for targets.
+	DebugImplicit
+	// DebugJobs prints child processes which run commands.
+	DebugJobs
+	// DebugMakefiles prints messages while remaking makefiles,
+	// which are suppressed otherwise.
+	DebugMakefiles
+
+	DebugAll = DebugBasic | DebugVerbose | DebugImplicit | DebugJobs | DebugMakefiles
+)
+
+var debugLetters = []struct {
+	c     byte
+	flags DebugFlags
+}{
+	{'b', DebugBasic},
+	{'v', DebugVerbose},
+	{'i', DebugImplicit},
+	{'j', DebugJobs},
+	{'m', DebugMakefiles},
+}
+
+// ParseDebugFlags parses the argument of --debug, i.e. categories
+// separated by commas or spaces, e.g. "b,v". Categories are a (all),
+// b (basic), v (verbose), i (implicit), j (jobs), m (makefiles) and
+// n (none). As GNU make, only the first letter of each is significant,
+// and v, i and m imply b.
+func ParseDebugFlags(s string) (DebugFlags, error) {
+	var f DebugFlags
+	for _, w := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		switch w[0] {
+		case 'a':
+			f |= DebugAll
+		case 'n':
+			f = 0
+		case 'b':
+			f |= DebugBasic
+		case 'v':
+			f |= DebugBasic | DebugVerbose
+		case 'i':
+			f |= DebugBasic | DebugImplicit
+		case 'm':
+			f |= DebugBasic | DebugMakefiles
+		case 'j':
+			f |= DebugJobs
+		default:
+			return 0, fmt.Errorf("unknown debug level specification '%s'", w)
+		}
+	}
+	return f, nil
+}
+
+// String returns the argument of --debug for f, e.g. "b,v".
+func (f DebugFlags) String() string {
+	if f == DebugAll {
+		return "a"
+	}
+	var s []string
+	for _, l := range debugLetters {
+		if f&l.flags != 0 {
+			s = append(s, string(l.c))
+		}
+	}
+	if len(s) == 0 {
+		return "n"
+	}
+	return strings.Join(s, ",")
+}
+
+// debugMakeflags returns long options for TraceFlag and Debug in
+// MAKEFLAGS, e.g. " --trace --debug=b".
+func debugMakeflags() string {
+	var s string
+	if TraceFlag {
+		s += " --trace"
+	}
+	if Debug != 0 {
+		s += " --debug=" + Debug.String()
+	}
+	return s
+}
+
+var debugMu sync.Mutex
+
+// debugf prints the message at the level to stdout, as GNU make does.
+func debugf(level DebugFlags, format string, args ...interface{}) {
+	if Debug&level == 0 {
+		return
+	}
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	fmt.Printf(format+"\n", args...)
+}
+
+// debugf prints the message while evaluating makefiles. An isolated
+// evaluator leaves the makefile to the parent, so messages are in
+// evaluation order.
+func (ev *Evaluator) debugf(level DebugFlags, format string, args ...interface{}) error {
+	if Debug&level == 0 {
+		return nil
+	}
+	if err := ev.checkIsolated("debug message"); err != nil {
+		return err
+	}
+	debugf(level, format, args...)
+	return nil
+}
+
+// debugging reports whether j prints messages of --debug or --trace.
+func (j *job) debugging() bool {
+	return j.ex.debug != 0 || TraceFlag
+}
+
+// debugf prints the message at the level for the target of j, indented
+// by the depth of j, and indent more spaces.
+func (j *job) debugf(level DebugFlags, indent int, format string, args ...interface{}) {
+	if j.ex.debug&level == 0 {
+		return
+	}
+	j.printf("%s%s\n", strings.Repeat(" ", j.ex.indent+2*j.depth+indent), fmt.Sprintf(format, args...))
+}
+
+func (j *job) printf(format string, args ...interface{}) {
+	j.ex.ctx.outputSync.write([]byte(fmt.Sprintf(format, args...)))
+}
+
+// consider prints messages of the target of j before its
+// prerequisites, after ones of its ancestors.
+func (j *job) consider() {
+	if j.considered {
+		return
+	}
+	j.considered = true
+	if j.neededBy != nil {
+		j.neededBy.consider()
+	}
+	if j.doubleColon > 0 {
+		// the job of the output printed them.
+		return
+	}
+	j.debugf(DebugVerbose, 0, "Considering target file '%s'.", j.n.Output)
+	if j.n.IsPhony || getTimestamp(j.n.Output) < 0 {
+		j.debugf(DebugBasic, 1, "File '%s' does not exist.", j.n.Output)
+	}
+	for _, msg := range j.n.implicitDebug {
+		j.debugf(DebugImplicit, 1, "%s", msg)
+	}
+}
+
+// debugPrereqs prints messages of the target of j after its
+// prerequisites are made.
+func (j *job) debugPrereqs() {
+	j.ex.debugMu.Lock()
+	j.consider()
+	j.ex.debugMu.Unlock()
+	j.debugf(DebugVerbose, 1, "Finished prerequisites of target file '%s'.", j.n.Output)
+	if j.outputTs < 0 {
+		return
+	}
+	for _, d := range j.n.Deps {
+		dj := j.doneDeps[d]
+		if dj == nil {
+			continue
+		}
+		if dj.outputTs > j.outputTs {
+			j.debugf(DebugBasic, 1, "Prerequisite '%s' is newer than target '%s'.", d.Output, j.n.Output)
+		} else {
+			j.debugf(DebugVerbose, 1, "Prerequisite '%s' is older than target '%s'.", d.Output, j.n.Output)
+		}
+	}
+	for _, d := range j.n.OrderOnlys {
+		j.debugf(DebugVerbose, 1, "Prerequisite '%s' is order-only for target '%s'.", d.Output, j.n.Output)
+	}
+}
+
+// trace prints why the commands of n run for --trace, i.e.
+// prerequisites newer than the target, or all prerequisites if the
+// target doesn't exist.
+func (j *job) trace(n *DepNode) {
+	if !TraceFlag || len(n.Cmds) == 0 {
+		return
+	}
+	var changed []string
+	for _, d := range j.n.Deps {
+		if dj := j.doneDeps[d]; j.outputTs < 0 || (dj != nil && dj.outputTs > j.outputTs) {
+			changed = append(changed, d.Output)
+		}
+	}
+	if j.outputTs < 0 && len(changed) == 0 {
+		j.printf("%s:%d: target '%s' does not exist\n", n.Filename, n.Lineno, j.n.Output)
+		return
+	}
+	j.printf("%s:%d: update target '%s' due to: %s\n", n.Filename, n.Lineno, j.n.Output, strings.Join(changed, " "))
+}
+
+// readingMakefile prints the message of DebugVerbose for the makefile
+// read by the include directive.
+func (ev *Evaluator) readingMakefile(ast *includeAST, fn string) error {
+	if Debug&DebugVerbose == 0 {
+		return nil
+	}
+	flags := " (search path)"
+	if ast.op == "-include" {
+		flags += " (don't care)"
+	}
+	return ev.debugf(DebugVerbose, "Reading makefile '%s'%s (no ~ expansion)...", fn, flags)
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseDebugFlags(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want DebugFlags
+		str  string
+	}{
+		{in: "", want: 0, str: "n"},
+		{in: "b", want: DebugBasic, str: "b"},
+		{in: "b,v", want: DebugBasic | DebugVerbose, str: "b,v"},
+		{in: "verbose", want: DebugBasic | DebugVerbose, str: "b,v"},
+		{in: "j", want: DebugJobs, str: "j"},
+		{in: "i m", want: DebugBasic | DebugImplicit | DebugMakefiles, str: "b,i,m"},
+		{in: "a", want: DebugAll, str: "a"},
+		{in: "a,n,j", want: DebugJobs, str: "j"},
+	} {
+		got, err := ParseDebugFlags(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseDebugFlags(%q)=%v, %v; want %v, nil", tc.in, got, err, tc.want)
+			continue
+		}
+		if got.String() != tc.str {
+			t.Errorf("ParseDebugFlags(%q).String()=%q; want %q", tc.in, got.String(), tc.str)
+		}
+	}
+	if _, err := ParseDebugFlags("b,x"); err == nil {
+		t.Errorf(`ParseDebugFlags("b,x")=_, nil; want error`)
+	}
+}
+
+func TestExecDebug(t *testing.T) {
+	chdirTestMakefile(t, `all: foo bar
+	@echo all
+foo: baz
+	@touch foo
+bar:
+baz:
+`)
+	err := ioutil.WriteFile("baz", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// debug messages and commands are written to stdout.
+	out, err := os.Create("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	Debug = DebugBasic | DebugVerbose
+	TraceFlag = true
+	defer func() {
+		os.Stdout = stdout
+		Debug = 0
+		TraceFlag = false
+	}()
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Updating goal targets....
+Considering target file 'all'.
+ File 'all' does not exist.
+  Considering target file 'foo'.
+   File 'foo' does not exist.
+    Considering target file 'baz'.
+     Finished prerequisites of target file 'baz'.
+    No need to remake target 'baz'.
+   Finished prerequisites of target file 'foo'.
+  Must remake target 'foo'.
+Makefile:4: update target 'foo' due to: baz
+touch foo
+  Successfully remade target file 'foo'.
+  Considering target file 'bar'.
+   File 'bar' does not exist.
+   Finished prerequisites of target file 'bar'.
+  Must remake target 'bar'.
+  Successfully remade target file 'bar'.
+ Finished prerequisites of target file 'all'.
+Must remake target 'all'.
+Makefile:2: update target 'all' due to: foo bar
+echo all
+all
+Successfully remade target file 'all'.
+`
+	if got := string(b); got != want {
+		t.Errorf("Exec with Debug and TraceFlag:\n%s\nwant\n%s", got, want)
+	}
+}
@@ -36,6 +36,44 @@ type DepNode struct {
 	TargetSpecificVars Vars
 	Filename           string
 	Lineno             int
+	// NotParallel is true if the commands must not run in parallel
+	// with other commands by .NOTPARALLEL, i.e. .NOTPARALLEL has no
+	// prerequisites, or it is a prerequisite of a prerequisite of
+	// .NOTPARALLEL.
+	NotParallel bool
+	// Stem is the stem of Output matched with a pattern rule, a
+	// static pattern rule, or a suffix rule, for $*.
+	Stem string
+	// DoubleColons are nodes of each double-colon rule of Output,
+	// whose commands run only if its own prerequisites are newer
+	// than Output, or always if it has no prerequisites. Cmds and
+	// Deps of the node are merged ones of all the rules.
+	DoubleColons []*DepNode
+	// IsIntermediate is true if Output is an intermediate file by
+	// .INTERMEDIATE, which is deleted after the build if it is made.
+	// Files in .SECONDARY or .PRECIOUS are never intermediate.
+	IsIntermediate bool
+	// DeleteOnError is true if Output is deleted when its commands
+	// fail, by .DELETE_ON_ERROR, unless it is in .PRECIOUS.
+	DeleteOnError bool
+	// OneShell is true if all lines of Cmds run in a single shell by
+	// .ONESHELL.
+	OneShell bool
+	// GroupOutputs are all outputs of the grouped rule "a b &: c" of
+	// Output, including Output, whose commands make all of them at
+	// once, or nil.
+	GroupOutputs []string
+	// Waits are indexes of Deps where .WAIT appears in prerequisites,
+	// e.g. [2] for "a b .WAIT c d". Deps from an index are built after
+	// all Deps before it.
+	Waits []int
+
+	// inputFiles are inputs of merged rules by makefiles, to find
+	// inputs declared only in a depfile.
+	inputFiles []ruleInputs
+	// implicitDebug are messages of DebugImplicit printed when the
+	// target is considered.
+	implicitDebug []string
 }
 
 func (n *DepNode) String() string {
@@ -46,16 +84,59 @@ func (n *DepNode) String() string {
 type depBuilder struct {
 	rules    map[string]*rule
 	ruleVars map[string]Vars
+	// patternVars are pattern-specific variables, sorted from the
+	// least specific pattern, i.e. the shortest one.
+	patternVars []patternVars
 
 	implicitRules *ruleTrie
 
 	suffixRules map[string][]*rule
-	firstRule   *rule
-	vars        Vars
-	ev          *Evaluator
-	vpaths      searchPaths
-	done        map[string]*DepNode
-	phony       map[string]bool
+	// singleSuffixRules are suffix rules with only a source suffix,
+	// e.g. ".c:", which make a file without the suffix.
+	singleSuffixRules []*rule
+	// suffixes are the known suffixes in .SUFFIXES. Only suffix rules
+	// of known suffixes are used.
+	suffixes  map[string]bool
+	firstRule *rule
+	vars      Vars
+	ev        *Evaluator
+	vpaths    searchPaths
+	done      map[string]*DepNode
+	phony     map[string]bool
+	// notParallel are prerequisites of .NOTPARALLEL, whose
+	// prerequisites are built serially. If notParallelAll is true,
+	// .NOTPARALLEL has no prerequisites, and all targets are built
+	// serially.
+	notParallel    map[string]bool
+	notParallelAll bool
+	// oneShell is true if .ONESHELL is a target.
+	oneShell bool
+	// intermediate are prerequisites of .INTERMEDIATE, and secondary
+	// are ones of .SECONDARY. If secondaryAll is true, .SECONDARY has
+	// no prerequisites, and no files are intermediate.
+	intermediate map[string]bool
+	secondary    map[string]bool
+	secondaryAll bool
+	// chained are prerequisites made by chains of implicit rules,
+	// which are intermediate as prerequisites of .INTERMEDIATE.
+	chained map[string]bool
+	// chaining are implicit rules in the chain being searched, and
+	// unmakable are targets which no chain makes.
+	chaining  map[*rule]bool
+	unmakable map[string]bool
+	// precious are prerequisites of .PRECIOUS, which may be target
+	// patterns of implicit rules, e.g. "%.o".
+	precious      map[string]bool
+	deleteOnError bool
+	// extraPrereqs are words of .EXTRA_PREREQS, and targetExtraPrereqs
+	// are ones of target-specific .EXTRA_PREREQS, which override it.
+	// They are prerequisites not in automatic variables.
+	extraPrereqs       []string
+	targetExtraPrereqs map[string][]string
+
+	// implicitDebug are messages of DebugImplicit of the target whose
+	// implicit rule is being searched.
+	implicitDebug []string
 
 	trace                         []string
 	nodeCnt                       int
@@ -70,9 +151,20 @@ type ruleTrieEntry struct {
 	suffix string
 }
 
+// ruleTrie is a trie of implicit rules by prefix of output patterns.
+// Rules of a node are indexed by suffix of output patterns.
 type ruleTrie struct {
 	rules    []ruleTrieEntry
 	children map[byte]*ruleTrie
+
+	// suffixes is indexes of rules by suffix after '%'.
+	suffixes map[string][]int
+	// suffixLens is distinct lengths of keys in suffixes, in
+	// ascending order.
+	suffixLens []int
+	// exact is indexes of rules whose pattern is fully consumed by
+	// the path to the node.
+	exact []int
 }
 
 func newRuleTrie() *ruleTrie {
@@ -82,42 +174,88 @@ func newRuleTrie() *ruleTrie {
 }
 
 func (rt *ruleTrie) add(name string, r *rule) {
-	glog.V(1).Infof("rule trie: add %q %v %s", name, r.outputPatterns[0], r)
-	if name == "" || name[0] == '%' {
-		glog.V(1).Infof("rule trie: add entry %q %v %s", name, r.outputPatterns[0], r)
-		rt.rules = append(rt.rules, ruleTrieEntry{
-			rule:   r,
-			suffix: name,
-		})
+	if glog.V(1) {
+		glog.Infof("rule trie: add %q %v %s", name, r.outputPatterns[0], r)
+	}
+	for name != "" && name[0] != '%' {
+		c, found := rt.children[name[0]]
+		if !found {
+			c = newRuleTrie()
+			rt.children[name[0]] = c
+		}
+		rt = c
+		name = name[1:]
+	}
+	if glog.V(1) {
+		glog.Infof("rule trie: add entry %q %v %s", name, r.outputPatterns[0], r)
+	}
+	i := len(rt.rules)
+	rt.rules = append(rt.rules, ruleTrieEntry{
+		rule:   r,
+		suffix: name,
+	})
+	if name == "" {
+		rt.exact = append(rt.exact, i)
 		return
 	}
-	c, found := rt.children[name[0]]
-	if !found {
-		c = newRuleTrie()
-		rt.children[name[0]] = c
+	suffix := name[1:]
+	if rt.suffixes == nil {
+		rt.suffixes = make(map[string][]int)
 	}
-	c.add(name[1:], r)
+	if _, ok := rt.suffixes[suffix]; !ok {
+		n := sort.SearchInts(rt.suffixLens, len(suffix))
+		if n == len(rt.suffixLens) || rt.suffixLens[n] != len(suffix) {
+			rt.suffixLens = append(rt.suffixLens, 0)
+			copy(rt.suffixLens[n+1:], rt.suffixLens[n:])
+			rt.suffixLens[n] = len(suffix)
+		}
+	}
+	rt.suffixes[suffix] = append(rt.suffixes[suffix], i)
 }
 
+// lookup returns rules whose output pattern matches name, in the order
+// of prefix length, and then in the order of add.
 func (rt *ruleTrie) lookup(name string) []*rule {
-	glog.V(1).Infof("rule trie: lookup %q", name)
-	if rt == nil {
-		return nil
+	if glog.V(1) {
+		glog.Infof("rule trie: lookup %q", name)
 	}
 	var rules []*rule
-	for _, entry := range rt.rules {
-		if (entry.suffix == "" && name == "") || strings.HasSuffix(name, entry.suffix[1:]) {
-			rules = append(rules, entry.rule)
+	var idx []int
+	for n := name; rt != nil; {
+		idx = rt.match(idx[:0], n)
+		for _, i := range idx {
+			rules = append(rules, rt.rules[i].rule)
+		}
+		if n == "" {
+			break
 		}
+		rt = rt.children[n[0]]
+		n = n[1:]
 	}
-	if name == "" {
-		return rules
+	if glog.V(1) {
+		glog.Infof("rule trie: lookup %q => %v", name, rules)
 	}
-	rules = append(rules, rt.children[name[0]].lookup(name[1:])...)
-	glog.V(1).Infof("rule trie: lookup %q => %v", name, rules)
 	return rules
 }
 
+// match appends indexes of rules of rt which match name, in
+// ascending order.
+func (rt *ruleTrie) match(idx []int, name string) []int {
+	if name == "" {
+		idx = append(idx, rt.exact...)
+	}
+	for _, l := range rt.suffixLens {
+		if l > len(name) {
+			break
+		}
+		idx = append(idx, rt.suffixes[name[len(name)-l:]]...)
+	}
+	if len(rt.exact) > 0 || len(rt.suffixLens) > 1 {
+		sort.Ints(idx)
+	}
+	return idx
+}
+
 func (rt *ruleTrie) size() int {
 	if rt == nil {
 		return 0
@@ -148,39 +286,28 @@ func (db *depBuilder) exists(target string) bool {
 	return ok
 }
 
-func (db *depBuilder) canPickImplicitRule(r *rule, output string) bool {
-	outputPattern := r.outputPatterns[0]
-	if !outputPattern.match(output) {
-		return false
-	}
-	for _, input := range r.inputs {
-		input = outputPattern.subst(input, output)
-		if !db.exists(input) {
-			return false
-		}
-	}
-	return true
+// patternVars are pattern-specific variables, e.g. "%.o: CFLAGS += -g".
+type patternVars struct {
+	pat  pattern
+	vars Vars
 }
 
-func (db *depBuilder) mergeImplicitRuleVars(outputs []string, vars Vars) Vars {
-	if len(outputs) != 1 {
-		// TODO(ukai): should return error?
-		panic(fmt.Sprintf("FIXME: Implicit rule should have only one output but %q", outputs))
-	}
-	glog.V(1).Infof("merge? %q", db.ruleVars)
-	glog.V(1).Infof("merge? %q", outputs[0])
-	ivars, present := db.ruleVars[outputs[0]]
-	if !present {
-		return vars
-	}
-	if vars == nil {
-		return ivars
+func (db *depBuilder) populatePatternVars() {
+	for output, vars := range db.ruleVars {
+		pat, ok := isPatternRule([]byte(output))
+		if !ok {
+			continue
+		}
+		db.patternVars = append(db.patternVars, patternVars{pat: pat, vars: vars})
 	}
-	glog.V(1).Info("merge!")
-	v := make(Vars)
-	v.Merge(ivars)
-	v.Merge(vars)
-	return v
+	sort.Slice(db.patternVars, func(i, j int) bool {
+		pi, pj := db.patternVars[i].pat, db.patternVars[j].pat
+		li, lj := len(pi.prefix)+len(pi.suffix), len(pj.prefix)+len(pj.suffix)
+		if li != lj {
+			return li < lj
+		}
+		return pi.String() < pj.String()
+	})
 }
 
 func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
@@ -196,11 +323,131 @@ func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
 		// find some commands.
 		db.pickExplicitRuleWithoutCmdCnt++
 	}
+	// Implicit rules are not searched for phony targets.
+	if db.phony[output] {
+		return r, vars, r != nil
+	}
+
+	db.debugImplicit("Looking for an implicit rule for '%s'.", output)
+	if ir, ok := db.pickImplicitRuleOrChain(output, output, r); ok {
+		db.debugImplicit("Found an implicit rule for '%s'.", output)
+		return ir, vars, true
+	}
+	// An archive member "a(m)" is also searched by its member name
+	// "(m)", e.g. for the rule "(%): %".
+	if _, member, ok := splitArchiveMember(output); ok {
+		if ir, ok := db.pickImplicitRuleOrChain("("+member+")", output, r); ok {
+			db.debugImplicit("Found an implicit rule for '%s'.", output)
+			return ir, vars, true
+		}
+	}
+	db.debugImplicit("No implicit rule found for '%s'.", output)
+	return r, vars, r != nil
+}
+
+// debugImplicit records a message of DebugImplicit for the target
+// being built, which is printed when the target is considered.
+func (db *depBuilder) debugImplicit(format string, args ...interface{}) {
+	if Debug&DebugImplicit == 0 {
+		return
+	}
+	db.implicitDebug = append(db.implicitDebug, fmt.Sprintf(format, args...))
+}
+
+// debugTrying records messages of DebugImplicit for the rule tried
+// with stem and its prerequisites inputs, unless it is in a chain.
+func (db *depBuilder) debugTrying(stem string, inputs []string, inChain bool) {
+	if inChain {
+		return
+	}
+	db.debugImplicit("Trying pattern rule with stem '%s'.", stem)
+	for _, input := range inputs {
+		db.debugImplicit("Trying implicit prerequisite '%s'.", input)
+	}
+}
+
+// pickImplicitRuleOrChain picks an implicit rule for name, whose
+// prerequisites exist or ought to exist, or else can be made by chains
+// of implicit rules. r is the explicit rule of output without commands,
+// or nil. name is output, or the member name of an archive member.
+func (db *depBuilder) pickImplicitRuleOrChain(name, output string, r *rule) (*rule, bool) {
+	ir, _, ok := db.pickImplicitRule(name, r, db.exists, false)
+	if ok {
+		return ir, true
+	}
+	// If no implicit rule has prerequisites which exist or ought to
+	// exist, prerequisites may be made by chains of implicit rules.
+	// They are intermediate files.
+	ir, inputs, ok := db.pickImplicitRule(name, r, db.canMake, false)
+	if ok {
+		for _, input := range inputs {
+			if !db.exists(input) {
+				glog.Infof("intermediate %q for %q", input, output)
+				db.chained[input] = true
+			}
+		}
+		return ir, true
+	}
+	return nil, false
+}
+
+// implicitName returns the name of output matched with the output
+// pattern of rule, i.e. its member name "(m)" if rule is an implicit
+// rule picked for the member name of an archive member "a(m)".
+func implicitName(rule *rule, output string) string {
+	if len(rule.outputPatterns) == 0 || rule.outputPatterns[0].match(output) {
+		return output
+	}
+	if _, member, ok := splitArchiveMember(output); ok {
+		return "(" + member + ")"
+	}
+	return output
+}
 
+// canMake reports whether target exists or ought to exist, or can be
+// made by a chain of implicit rules.
+func (db *depBuilder) canMake(target string) bool {
+	if db.exists(target) {
+		return true
+	}
+	// A target which no chain makes is remembered, though other
+	// rules may be excluded from the chain, not to search chains of
+	// the target again.
+	if db.unmakable[target] {
+		return false
+	}
+	_, _, ok := db.pickImplicitRule(target, nil, db.canMake, true)
+	if !ok {
+		db.unmakable[target] = true
+	}
+	return ok
+}
+
+// pickImplicitRule picks a pattern rule or a suffix rule for output,
+// whose prerequisites exist by exists. r is the explicit rule of
+// output without commands, or nil. It returns the rule merged with r,
+// and prerequisites given by the implicit rule. If inChain is true,
+// output is a prerequisite of a chain of implicit rules, for which
+// match-anything rules, i.e. "%:" or single suffix rules, are not
+// used, as GNU make does. Rules in the chain are never used twice.
+func (db *depBuilder) pickImplicitRule(output string, r *rule, exists func(string) bool, inChain bool) (*rule, []string, bool) {
 	irules := db.implicitRules.lookup(output)
 	for i := len(irules) - 1; i >= 0; i-- {
 		irule := irules[i]
-		if !db.canPickImplicitRule(irule, output) {
+		outputPattern := irule.outputPatterns[0]
+		if inChain && outputPattern == (pattern{}) {
+			continue
+		}
+		stem, ok := outputPattern.stem(output)
+		if !ok {
+			continue
+		}
+		var inputs []string
+		for _, input := range irule.inputs {
+			inputs = append(inputs, outputPattern.subst(input, output))
+		}
+		db.debugTrying(stem, inputs, inChain)
+		if !db.canChain(irule, inputs, exists) {
 			glog.Infof("ignore implicit rule %q %s", output, irule)
 			continue
 		}
@@ -212,76 +459,139 @@ func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
 			ir.outputPatterns = irule.outputPatterns
 			// implicit rule's prerequisites will be used for $<
 			ir.inputs = append(irule.inputs, ir.inputs...)
+			ir.orderOnlyInputs = append(irule.orderOnlyInputs, ir.orderOnlyInputs...)
 			ir.cmds = irule.cmds
 			// TODO(ukai): filename, lineno?
 			ir.cmdLineno = irule.cmdLineno
-			return ir, vars, true
-		}
-		if vars != nil {
-			var outputs []string
-			for _, op := range irule.outputPatterns {
-				outputs = append(outputs, op.String())
-			}
-			vars = db.mergeImplicitRuleVars(outputs, vars)
+			return ir, inputs, true
 		}
 		// TODO(ukai): check len(irule.cmd) ?
-		return irule, vars, true
+		return irule, inputs, true
 	}
 
 	outputSuffix := filepath.Ext(output)
-	if !strings.HasPrefix(outputSuffix, ".") {
-		return r, vars, r != nil
+	if strings.HasPrefix(outputSuffix, ".") && db.suffixes[outputSuffix] {
+		rules := db.suffixRules[outputSuffix[1:]]
+		for i := len(rules) - 1; i >= 0; i-- {
+			irule := rules[i]
+			if len(irule.inputs) != 1 {
+				glog.Warningf("unexpected number of input for a suffix rule %s: %q", irule.srcpos, irule.inputs)
+				continue
+			}
+			if !db.suffixes["."+irule.inputs[0]] {
+				continue
+			}
+			input := replaceSuffix(output, irule.inputs[0])
+			db.debugTrying(stripExt(output), []string{input}, inChain)
+			if !db.canChain(irule, []string{input}, exists) {
+				continue
+			}
+			db.pickSuffixRuleCnt++
+			if r != nil {
+				sr := &rule{}
+				*sr = *r
+				// TODO(ukai): input order is correct?
+				sr.inputs = append([]string{input}, r.inputs...)
+				sr.cmds = irule.cmds
+				// TODO(ukai): filename, lineno?
+				sr.cmdLineno = irule.cmdLineno
+				return sr, []string{input}, true
+			}
+			// TODO(ukai): check len(irule.cmd) ?
+			return irule, []string{input}, true
+		}
 	}
-	rules, present := db.suffixRules[outputSuffix[1:]]
-	if !present {
-		return r, vars, r != nil
+	if inChain {
+		return nil, nil, false
+	}
+	return db.pickSingleSuffixRule(output, r, exists)
+}
+
+// canChain reports whether all inputs of irule exist by exists. irule
+// is excluded from chains of the inputs.
+func (db *depBuilder) canChain(irule *rule, inputs []string, exists func(string) bool) bool {
+	if db.chaining[irule] {
+		return false
+	}
+	db.chaining[irule] = true
+	defer delete(db.chaining, irule)
+	for _, input := range inputs {
+		if input != ".WAIT" && !exists(input) {
+			return false
+		}
 	}
-	for _, irule := range rules {
-		if len(irule.inputs) != 1 {
-			// TODO(ukai): should return error?
-			panic(fmt.Sprintf("FIXME: unexpected number of input for a suffix rule (%d)", len(irule.inputs)))
+	return true
+}
+
+// pickSingleSuffixRule picks a single suffix rule, e.g. ".c:" for
+// output "foo" if "foo.c" exists by exists. r is an explicit rule
+// without commands for output, or nil.
+func (db *depBuilder) pickSingleSuffixRule(output string, r *rule, exists func(string) bool) (*rule, []string, bool) {
+	for i := len(db.singleSuffixRules) - 1; i >= 0; i-- {
+		irule := db.singleSuffixRules[i]
+		if !db.suffixes["."+irule.inputs[0]] {
+			continue
 		}
-		if !db.exists(replaceSuffix(output, irule.inputs[0])) {
+		input := output + "." + irule.inputs[0]
+		db.debugTrying(output, []string{input}, false)
+		if !db.canChain(irule, []string{input}, exists) {
 			continue
 		}
 		db.pickSuffixRuleCnt++
+		sr := &rule{}
 		if r != nil {
-			sr := &rule{}
 			*sr = *r
-			// TODO(ukai): input order is correct?
-			sr.inputs = append([]string{replaceSuffix(output, irule.inputs[0])}, r.inputs...)
-			sr.cmds = irule.cmds
-			// TODO(ukai): filename, lineno?
-			sr.cmdLineno = irule.cmdLineno
-			return sr, vars, true
-		}
-		if vars != nil {
-			vars = db.mergeImplicitRuleVars(irule.outputs, vars)
+			sr.inputs = append([]string{input}, r.inputs...)
+		} else {
+			*sr = *irule
+			sr.inputs = []string{input}
+			sr.isSuffixRule = false
 		}
-		// TODO(ukai): check len(irule.cmd) ?
-		return irule, vars, true
+		sr.cmds = irule.cmds
+		sr.cmdLineno = irule.cmdLineno
+		return sr, []string{input}, true
 	}
-	return r, vars, r != nil
+	return nil, nil, false
 }
 
-func expandInputs(rule *rule, output string) []string {
+// ruleStem returns the stem of output for rule, or "" if rule isn't a
+// pattern rule, a static pattern rule, or a suffix rule.
+func ruleStem(rule *rule, output string) string {
+	switch {
+	case len(rule.outputPatterns) > 0:
+		stem, _ := rule.outputPatterns[0].stem(output)
+		return stem
+	case rule.stem != "":
+		return rule.stem
+	case rule.isSuffixRule:
+		return stripExt(output)
+	}
+	return ""
+}
+
+// expandInputs expands inputs of rule, i.e. rule.inputs or
+// rule.orderOnlyInputs, for output.
+func expandInputs(rule *rule, ruleInputs []string, output string) ([]string, error) {
+	if len(rule.outputPatterns) > 1 {
+		return nil, rule.errorf("*** multiple target patterns are not supported yet.")
+	}
 	var inputs []string
-	for _, input := range rule.inputs {
+	for _, input := range ruleInputs {
 		if len(rule.outputPatterns) > 0 {
-			if len(rule.outputPatterns) != 1 {
-				panic(fmt.Sprintf("FIXME: multiple output pattern is not supported yet"))
-			}
 			input = intern(rule.outputPatterns[0].subst(input, output))
 		} else if rule.isSuffixRule {
 			input = intern(replaceSuffix(output, input))
 		}
 		inputs = append(inputs, input)
 	}
-	return inputs
+	return inputs, nil
 }
 
 func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*DepNode, error) {
 	glog.V(1).Infof("Evaluating command: %s", output)
+	if err := db.ev.ctx.Err(); err != nil {
+		return nil, err
+	}
 	db.nodeCnt++
 	if db.nodeCnt%100 == 0 {
 		db.reportStats()
@@ -296,51 +606,55 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 
 	// create depnode for phony targets?
 	rule, vars, present := db.pickRule(output)
+	n.implicitDebug, db.implicitDebug = db.implicitDebug, nil
 	if !present {
+		n.Output = db.vpathOutput(output)
 		return n, nil
 	}
 
 	var restores []func()
-	if vars != nil {
-		for name, v := range vars {
-			// TODO: Consider not updating db.vars.
-			tsv := v.(*targetSpecificVar)
-			restores = append(restores, db.vars.save(name))
-			restores = append(restores, tsvs.save(name))
-			switch tsv.op {
-			case ":=", "=":
-				db.vars[name] = tsv
-				tsvs[name] = v
-			case "+=":
-				oldVar, present := db.vars[name]
-				if !present || oldVar.String() == "" {
-					db.vars[name] = tsv
-				} else {
-					var err error
-					v, err = oldVar.AppendVar(db.ev, tsv)
-					if err != nil {
-						return nil, err
-					}
-					db.vars[name] = v
-				}
-				tsvs[name] = v
-			case "?=":
-				if _, present := db.vars[name]; !present {
-					db.vars[name] = tsv
-					tsvs[name] = v
-				}
-			}
+	defer func() {
+		// a variable may be saved more than once.
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
 		}
-		defer func() {
-			for _, restore := range restores {
-				restore()
-			}
-		}()
+	}()
+	// pattern-specific variables are set before target-specific
+	// variables, from the least specific pattern.
+	for _, pv := range db.patternVars {
+		if _, ok := pv.pat.stem(output); !ok {
+			continue
+		}
+		err := db.setTargetSpecificVars(pv.vars, tsvs, &restores)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := db.setTargetSpecificVars(vars, tsvs, &restores)
+	if err != nil {
+		return nil, err
 	}
 
-	inputs := expandInputs(rule, output)
+	name := implicitName(rule, output)
+	inputs, err := expandInputs(rule, rule.inputs, name)
+	if err != nil {
+		return nil, err
+	}
+	orderOnlyInputs, err := expandInputs(rule, rule.orderOnlyInputs, name)
+	if err != nil {
+		return nil, err
+	}
 	glog.Infof("Evaluating command: %s inputs:%q => %q", output, rule.inputs, inputs)
+	// actualInputs are inputs found by VPATH or vpath, for $^.
+	var actualInputs []string
 	for _, input := range inputs {
+		if input == ".WAIT" {
+			// prerequisites after .WAIT are built after ones before it.
+			if k := len(n.Deps); k > 0 && (len(n.Waits) == 0 || n.Waits[len(n.Waits)-1] != k) {
+				n.Waits = append(n.Waits, k)
+			}
+			continue
+		}
 		db.trace = append(db.trace, input)
 		ni, err := db.buildPlan(input, output, tsvs)
 		db.trace = db.trace[0 : len(db.trace)-1]
@@ -350,25 +664,70 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 		if ni != nil {
 			n.Deps = append(n.Deps, ni)
 			ni.Parents = append(ni.Parents, n)
+			input = ni.Output
 		}
+		actualInputs = append(actualInputs, input)
 	}
 
-	for _, input := range rule.orderOnlyInputs {
+	normal := make(map[string]bool)
+	for _, input := range inputs {
+		normal[input] = true
+	}
+	for _, input := range db.extraPrereqsOf(output) {
+		if normal[input] || input == output {
+			continue
+		}
+		normal[input] = true
 		db.trace = append(db.trace, input)
 		ni, err := db.buildPlan(input, output, tsvs)
 		db.trace = db.trace[0 : len(db.trace)-1]
 		if err != nil {
 			return nil, err
 		}
-		if n != nil {
+		if ni != nil {
+			n.Deps = append(n.Deps, ni)
+			ni.Parents = append(ni.Parents, n)
+		}
+	}
+	for _, input := range orderOnlyInputs {
+		// a normal prerequisite takes precedence.
+		if normal[input] || input == ".WAIT" {
+			continue
+		}
+		db.trace = append(db.trace, input)
+		ni, err := db.buildPlan(input, output, tsvs)
+		db.trace = db.trace[0 : len(db.trace)-1]
+		if err != nil {
+			return nil, err
+		}
+		if ni != nil {
 			n.OrderOnlys = append(n.OrderOnlys, ni)
 			ni.Parents = append(ni.Parents, n)
 		}
 	}
 
+	if db.notParallel[output] {
+		for _, d := range n.Deps {
+			if len(d.Cmds) > 0 {
+				d.NotParallel = true
+			}
+		}
+	}
+
 	n.HasRule = true
 	n.Cmds = rule.cmds
-	n.ActualInputs = inputs
+	n.NotParallel = n.NotParallel || (db.notParallelAll && len(rule.cmds) > 0)
+	n.OneShell = db.oneShell
+	for _, o := range rule.groupOutputs {
+		n.GroupOutputs = append(n.GroupOutputs, trimLeadingCurdir(o))
+	}
+	n.ActualInputs = actualInputs
+	n.Stem = ruleStem(rule, name)
+	if !n.IsPhony {
+		n.IsIntermediate = db.isIntermediate(output, rule)
+		n.DeleteOnError = db.deleteOnError && !db.isPrecious(output, rule)
+	}
+	n.inputFiles = rule.inputFiles
 	n.TargetSpecificVars = make(Vars)
 	for k, v := range tsvs {
 		if glog.V(1) {
@@ -384,18 +743,211 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 			n.Lineno = rule.lineno
 		}
 	}
+	if len(n.Cmds) == 0 && !n.IsPhony {
+		n.Output = db.vpathOutput(output)
+	}
+	if rule.isDoubleColon && len(rule.outputPatterns) == 0 {
+		for _, r := range rule.doubleColons() {
+			n.DoubleColons = append(n.DoubleColons, db.doubleColonNode(n, r))
+		}
+	}
 	return n, nil
 }
 
+// setTargetSpecificVars sets target-specific variables vars to db.vars
+// and tsvs, which are inherited by prerequisites. Functions to restore
+// them are added to restores.
+func (db *depBuilder) setTargetSpecificVars(vars, tsvs Vars, restores *[]func()) error {
+	for name, v := range vars {
+		// TODO: Consider not updating db.vars.
+		tsv := v.(*targetSpecificVar)
+		if old, ok := db.vars[name]; ok && originPrecedence[old.Origin()] > originPrecedence[tsv.Origin()] {
+			// e.g. a command line variable.
+			continue
+		}
+		*restores = append(*restores, db.vars.save(name))
+		*restores = append(*restores, tsvs.save(name))
+		switch tsv.op {
+		case ":=", "=":
+			db.vars[name] = tsv
+			tsvs[name] = v
+		case "+=":
+			oldVar, present := db.vars[name]
+			if !present || oldVar.String() == "" {
+				db.vars[name] = tsv
+			} else {
+				// AppendVar modifies the variable in place, which
+				// is also used by other targets.
+				var err error
+				v, err = copyVar(oldVar).AppendVar(db.ev, tsv)
+				if err != nil {
+					return err
+				}
+				if tsv.export {
+					// export is inherited by the appended variable.
+					if nv, ok := v.(*targetSpecificVar); ok {
+						nv.export = true
+					} else {
+						v = &targetSpecificVar{v: v, op: tsv.op, export: true}
+					}
+				}
+				db.vars[name] = v
+			}
+			tsvs[name] = v
+		case "?=":
+			if _, present := db.vars[name]; !present {
+				db.vars[name] = tsv
+				tsvs[name] = v
+			}
+		}
+	}
+	return nil
+}
+
+// populateExtraPrereqs expands .EXTRA_PREREQS and target-specific
+// ones in the global context, as GNU make does after reading makefiles.
+func (db *depBuilder) populateExtraPrereqs() error {
+	var err error
+	db.extraPrereqs, err = db.expandWords(db.vars.Lookup(".EXTRA_PREREQS"))
+	if err != nil {
+		return err
+	}
+	for output, vars := range db.ruleVars {
+		v, ok := vars[".EXTRA_PREREQS"]
+		if !ok {
+			continue
+		}
+		prereqs, err := db.expandWords(v)
+		if err != nil {
+			return err
+		}
+		switch v.(*targetSpecificVar).op {
+		case "+=":
+			prereqs = append(append([]string(nil), db.extraPrereqs...), prereqs...)
+		case "?=":
+			if db.vars.Lookup(".EXTRA_PREREQS").IsDefined() {
+				prereqs = db.extraPrereqs
+			}
+		}
+		if db.targetExtraPrereqs == nil {
+			db.targetExtraPrereqs = make(map[string][]string)
+		}
+		db.targetExtraPrereqs[output] = prereqs
+	}
+	return nil
+}
+
+func (db *depBuilder) expandWords(v Var) ([]string, error) {
+	var buf evalBuffer
+	buf.resetSep()
+	err := v.Eval(&buf, db.ev)
+	if err != nil {
+		return nil, err
+	}
+	return splitSpaces(buf.String()), nil
+}
+
+// extraPrereqsOf returns .EXTRA_PREREQS of output.
+func (db *depBuilder) extraPrereqsOf(output string) []string {
+	if prereqs, ok := db.targetExtraPrereqs[output]; ok {
+		return prereqs
+	}
+	return db.extraPrereqs
+}
+
+// isPrecious reports whether output made by r is in .PRECIOUS, or a
+// target pattern of r is.
+func (db *depBuilder) isPrecious(output string, r *rule) bool {
+	if db.precious[output] {
+		return true
+	}
+	for _, pat := range r.outputPatterns {
+		if db.precious[pat.String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// isIntermediate reports whether output is an intermediate file, which
+// is deleted after the build.
+func (db *depBuilder) isIntermediate(output string, r *rule) bool {
+	if !(db.intermediate[output] || db.chained[output]) || db.secondaryAll || db.secondary[output] {
+		return false
+	}
+	return !db.isPrecious(output, r)
+}
+
+// vpathOutput returns the path of output found by VPATH or vpath, or
+// output if it is not found.
+func (db *depBuilder) vpathOutput(output string) string {
+	if db.vpaths.empty() {
+		return output
+	}
+	p, _ := db.vpaths.exists(output)
+	return p
+}
+
+// doubleColonNode returns a node of the double-colon rule r of n,
+// whose prerequisites are already built in n.
+func (db *depBuilder) doubleColonNode(n *DepNode, r *rule) *DepNode {
+	dn := &DepNode{
+		Output:             n.Output,
+		Cmds:               r.cmds,
+		HasRule:            true,
+		IsPhony:            n.IsPhony,
+		Stem:               n.Stem,
+		TargetSpecificVars: n.TargetSpecificVars,
+		Filename:           r.filename,
+		Lineno:             r.lineno,
+		NotParallel:        n.NotParallel,
+		DeleteOnError:      n.DeleteOnError,
+		OneShell:           n.OneShell,
+		GroupOutputs:       n.GroupOutputs,
+	}
+	if r.cmdLineno > 0 {
+		dn.Lineno = r.cmdLineno
+	}
+	normal := make(map[string]bool)
+	for _, input := range r.inputs {
+		if input == ".WAIT" {
+			continue
+		}
+		normal[input] = true
+		if d := db.done[input]; d != nil {
+			dn.Deps = append(dn.Deps, d)
+			input = d.Output
+		}
+		dn.ActualInputs = append(dn.ActualInputs, input)
+	}
+	for _, input := range r.orderOnlyInputs {
+		if d := db.done[input]; d != nil && !normal[input] {
+			dn.OrderOnlys = append(dn.OrderOnlys, d)
+		}
+	}
+	return dn
+}
+
 func (db *depBuilder) populateSuffixRule(r *rule, output string) bool {
 	if len(output) == 0 || output[0] != '.' {
 		return false
 	}
 	rest := output[1:]
 	dotIndex := strings.IndexByte(rest, '.')
-	// If there is only a single dot or the third dot, this is not a
-	// suffix rule.
-	if dotIndex < 0 || strings.IndexByte(rest[dotIndex+1:], '.') >= 0 {
+	if dotIndex < 0 {
+		// A single suffix rule, e.g. ".c:". Special targets, e.g.
+		// .DEFAULT, are never used since they are not in .SUFFIXES,
+		// so report false to keep warnings for them.
+		if rest != "" && len(r.inputs) == 0 {
+			sr := &rule{}
+			*sr = *r
+			sr.inputs = []string{rest}
+			db.singleSuffixRules = append(db.singleSuffixRules, sr)
+		}
+		return false
+	}
+	// If there is the third dot, this is not a suffix rule.
+	if strings.IndexByte(rest[dotIndex+1:], '.') >= 0 {
 		return false
 	}
 
@@ -406,25 +958,45 @@ func (db *depBuilder) populateSuffixRule(r *rule, output string) bool {
 	*sr = *r
 	sr.inputs = []string{inputSuffix}
 	sr.isSuffixRule = true
-	db.suffixRules[outputSuffix] = append([]*rule{sr}, db.suffixRules[outputSuffix]...)
+	// suffixRules are looked up in reverse order, so later rules
+	// have priority.
+	db.suffixRules[outputSuffix] = append(db.suffixRules[outputSuffix], sr)
 	return true
 }
 
+// populateSuffixes adds inputs of a .SUFFIXES rule to the known
+// suffixes. A .SUFFIXES rule without inputs clears them.
+func (db *depBuilder) populateSuffixes(r *rule) {
+	if len(r.inputs) == 0 {
+		db.suffixes = make(map[string]bool)
+		return
+	}
+	for _, suffix := range r.inputs {
+		db.suffixes[suffix] = true
+	}
+}
+
 func mergeRules(oldRule, r *rule, output string, isSuffixRule bool) (*rule, error) {
 	if oldRule.isDoubleColon != r.isDoubleColon {
 		return nil, r.errorf("*** target file %q has both : and :: entries.", output)
 	}
 	if len(oldRule.cmds) > 0 && len(r.cmds) > 0 && !isSuffixRule && !r.isDoubleColon {
-		warn(r.cmdpos(), "overriding commands for target %q", output)
-		warn(oldRule.cmdpos(), "ignoring old commands for target %q", output)
+		warn(r.cmdpos(), DiagOverrideCommands, "overriding commands for target %q", output)
+		warn(oldRule.cmdpos(), DiagIgnoreOldCommands, "ignoring old commands for target %q", output)
 	}
 
+	// slices of merged rules are appended in place, as oldRule is
+	// replaced by mr. Those of a rule not merged are allocated by
+	// inputsByFile and doubleColons, since it may be shared by its
+	// outputs.
 	mr := &rule{}
 	*mr = *r
 	if r.isDoubleColon {
 		mr.cmds = append(oldRule.cmds, mr.cmds...)
+		mr.doubleColonRules = append(oldRule.doubleColons(), r)
 	} else if len(oldRule.cmds) > 0 && len(r.cmds) == 0 {
 		mr.cmds = oldRule.cmds
+		mr.groupOutputs = oldRule.groupOutputs
 	}
 	// If the latter rule has a command (regardless of the
 	// commands in oldRule), inputs in the latter rule has a
@@ -437,6 +1009,7 @@ func mergeRules(oldRule, r *rule, output string, isSuffixRule bool) (*rule, erro
 		mr.orderOnlyInputs = append(oldRule.orderOnlyInputs, mr.orderOnlyInputs...)
 	}
 	mr.outputPatterns = append(mr.outputPatterns, oldRule.outputPatterns...)
+	mr.inputFiles = append(oldRule.inputsByFile(), ruleInputs{filename: r.filename, inputs: r.inputs})
 	return mr, nil
 }
 
@@ -452,14 +1025,24 @@ func expandPattern(r *rule) []*rule {
 	var rules []*rule
 	pat := r.outputPatterns[0]
 	for _, output := range r.outputs {
+		stem, ok := pat.stem(output)
+		if !ok {
+			warn(r.srcpos, DiagTargetPattern, "target %q doesn't match the target pattern", output)
+			continue
+		}
 		nr := new(rule)
 		*nr = *r
 		nr.outputs = []string{output}
 		nr.outputPatterns = nil
+		nr.stem = stem
 		nr.inputs = nil
 		for _, input := range r.inputs {
 			nr.inputs = append(nr.inputs, intern(pat.subst(input, output)))
 		}
+		nr.orderOnlyInputs = nil
+		for _, input := range r.orderOnlyInputs {
+			nr.orderOnlyInputs = append(nr.orderOnlyInputs, intern(pat.subst(input, output)))
+		}
 		rules = append(rules, nr)
 	}
 	glog.V(1).Infof("expand static pattern: outputs=%q inputs=%q -> %q", r.outputs, r.inputs, rules)
@@ -471,9 +1054,15 @@ func (db *depBuilder) populateExplicitRule(r *rule) error {
 	if len(r.outputs) == 0 {
 		return nil
 	}
+	if r.groupOutputs != nil && len(r.cmds) == 0 {
+		return r.errorf("*** grouped targets must provide a recipe.")
+	}
 	for _, output := range r.outputs {
 		output = trimLeadingCurdir(output)
 
+		if output == ".SUFFIXES" {
+			db.populateSuffixes(r)
+		}
 		isSuffixRule := db.populateSuffixRule(r, output)
 
 		if oldRule, present := db.rules[output]; present {
@@ -540,26 +1129,69 @@ func newDepBuilder(er *evalResult, vars Vars) (*depBuilder, error) {
 		ruleVars:      er.ruleVars,
 		implicitRules: newRuleTrie(),
 		suffixRules:   make(map[string][]*rule),
+		suffixes:      make(map[string]bool),
 		vars:          vars,
 		ev:            NewEvaluator(vars),
 		vpaths:        er.vpaths,
 		done:          make(map[string]*DepNode),
 		phony:         make(map[string]bool),
+		chained:       make(map[string]bool),
+		chaining:      make(map[*rule]bool),
+		unmakable:     make(map[string]bool),
 	}
+	db.ev.sess = er.vpaths.session()
 
 	err := db.populateRules(er)
 	if err != nil {
 		return nil, err
 	}
+	db.populatePatternVars()
+	err = db.populateExtraPrereqs()
+	if err != nil {
+		return nil, err
+	}
 	rule, present := db.rules[".PHONY"]
 	if present {
 		for _, input := range rule.inputs {
 			db.phony[input] = true
 		}
 	}
+	rule, present = db.rules[".NOTPARALLEL"]
+	if present {
+		if len(rule.inputs) == 0 {
+			db.notParallelAll = true
+		} else {
+			db.notParallel = make(map[string]bool)
+			for _, input := range rule.inputs {
+				db.notParallel[input] = true
+			}
+		}
+	}
+	db.intermediate = db.specialInputs(".INTERMEDIATE")
+	db.secondary = db.specialInputs(".SECONDARY")
+	if rule, present := db.rules[".SECONDARY"]; present && len(rule.inputs) == 0 {
+		db.secondaryAll = true
+	}
+	db.precious = db.specialInputs(".PRECIOUS")
+	_, db.deleteOnError = db.rules[".DELETE_ON_ERROR"]
+	_, db.oneShell = db.rules[".ONESHELL"]
 	return db, nil
 }
 
+// specialInputs returns the set of prerequisites of the special
+// target, e.g. .INTERMEDIATE.
+func (db *depBuilder) specialInputs(target string) map[string]bool {
+	rule, present := db.rules[target]
+	if !present {
+		return nil
+	}
+	inputs := make(map[string]bool)
+	for _, input := range rule.inputs {
+		inputs[input] = true
+	}
+	return inputs
+}
+
 func (db *depBuilder) Eval(targets []string) ([]*DepNode, error) {
 	if len(targets) == 0 {
 		if db.firstRule == nil {
@@ -578,8 +1210,9 @@ func (db *depBuilder) Eval(targets []string) ([]*DepNode, error) {
 		logStats("%d variables", len(db.vars))
 		logStats("%d explicit rules", len(db.rules))
 		logStats("%d implicit rules", db.implicitRules.size())
-		logStats("%d suffix rules", len(db.suffixRules))
-		logStats("%d dirs %d files", wildcardCache.dirs(), wildcardCache.files())
+		logStats("%d suffix rules", len(db.suffixRules)+len(db.singleSuffixRules))
+		wc := db.ev.sess.wildcardCache
+		logStats("%d dirs %d files", wc.dirs(), wc.files())
 	}
 
 	var nodes []*DepNode
@@ -0,0 +1,513 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuleTrieLookup(t *testing.T) {
+	pats := []string{
+		"%.o", "out/%.o", "%", "out/%", "%.o", "o%", "out/obj/%.o", "%.c.o",
+		"out/%.c.o", "%o", "out/%.a", "%.o",
+	}
+	rt := newRuleTrie()
+	var rules []*rule
+	for _, pat := range pats {
+		p, _ := isPatternRule([]byte(pat))
+		r := &rule{outputPatterns: []pattern{p}}
+		rules = append(rules, r)
+		rt.add(pat, r)
+	}
+	for _, name := range []string{"", "a.o", "out/a.o", "out/obj/a.c.o", "o", "out/a.a", "x"} {
+		// rules with shorter prefix first, and then in the order of add.
+		var want []*rule
+		for n := 0; n <= len(name); n++ {
+			for _, r := range rules {
+				p := r.outputPatterns[0]
+				if len(p.prefix) == n && p.match(name) {
+					want = append(want, r)
+				}
+			}
+		}
+		got := rt.lookup(name)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("rt.lookup(%q)=%v; want %v", name, got, want)
+		}
+	}
+}
+
+// genRuleGraph generates an evalResult which has n explicit rules and
+// implicit rules for them.
+func genRuleGraph(n int) *evalResult {
+	const filesPerModule = 1000
+	er := &evalResult{
+		ruleVars: make(map[string]Vars),
+	}
+	for _, pat := range []string{"%.o", "%.a", "%.so", "%.jar", "%.class", "%.h", "%"} {
+		p, _ := isPatternRule([]byte(pat))
+		er.rules = append(er.rules, &rule{
+			outputs:        []string{},
+			outputPatterns: []pattern{p},
+			inputs:         []string{strings.Replace(pat, "%", "%.in", 1)},
+			cmds:           []string{"build " + pat},
+		})
+	}
+	for m := 0; m < n/filesPerModule; m++ {
+		p := pattern{prefix: fmt.Sprintf("out/m%d/", m), suffix: ".o"}
+		er.rules = append(er.rules, &rule{
+			outputs:        []string{},
+			outputPatterns: []pattern{p},
+			inputs:         []string{fmt.Sprintf("src/m%d/%%.c", m)},
+			cmds:           []string{"cc"},
+		})
+	}
+	for i := 0; i < n; i++ {
+		er.rules = append(er.rules, &rule{
+			outputs: []string{fmt.Sprintf("out/m%d/f%d.o", i/filesPerModule, i)},
+			inputs:  []string{fmt.Sprintf("out/m%d/f%d.h", i/filesPerModule, i)},
+		})
+	}
+	return er
+}
+
+func BenchmarkDepBuilder1M(b *testing.B) {
+	er := genRuleGraph(1 << 20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := newDepBuilder(er, make(Vars))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, r := range er.rules {
+			for _, output := range r.outputs {
+				if len(db.implicitRules.lookup(output)) == 0 {
+					b.Fatalf("no implicit rules for %q", output)
+				}
+			}
+		}
+	}
+}
+
+func TestBuiltinRules(t *testing.T) {
+	saved := NoBuiltinRules
+	defer func() { NoBuiltinRules = saved }()
+	for _, tc := range []struct {
+		mk             string
+		target         string
+		noBuiltinRules bool
+		wantInputs     []string
+		wantCmd        string
+	}{
+		{
+			mk:         "foo.c:\n",
+			target:     "foo.o",
+			wantInputs: []string{"foo.c"},
+			wantCmd:    "$(COMPILE.c) $(OUTPUT_OPTION) $<",
+		},
+		{
+			mk:         "foo.c:\n",
+			target:     "foo",
+			wantInputs: []string{"foo.c"},
+			wantCmd:    "$(LINK.c) $^ $(LOADLIBES) $(LDLIBS) -o $@",
+		},
+		{
+			mk:             "foo.c:\n",
+			target:         "foo.o",
+			noBuiltinRules: true,
+		},
+		{
+			mk:         "foo.y:\n",
+			target:     "foo.o",
+			wantInputs: []string{"foo.c"},
+			wantCmd:    "$(COMPILE.c) $(OUTPUT_OPTION) $<",
+		},
+		{
+			mk:             "foo.y:\n",
+			target:         "foo.o",
+			noBuiltinRules: true,
+		},
+		{
+			mk:     ".SUFFIXES:\nfoo.c:\n",
+			target: "foo.o",
+		},
+		{
+			mk:     ".x.y:\n\techo $<\nfoo.x:\n",
+			target: "foo.y",
+		},
+		{
+			mk:         ".SUFFIXES:\n.SUFFIXES: .x .y\n.x.y:\n\techo $<\nfoo.x:\n",
+			target:     "foo.y",
+			wantInputs: []string{"foo.x"},
+			wantCmd:    "echo $<",
+		},
+		{
+			mk:             ".SUFFIXES: .x\n.x:\n\tcp $< $@\nfoo.x:\n",
+			target:         "foo",
+			noBuiltinRules: true,
+			wantInputs:     []string{"foo.x"},
+			wantCmd:        "cp $< $@",
+		},
+	} {
+		NoBuiltinRules = tc.noBuiltinRules
+		bmk, err := bootstrapMakefile(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mk, err := parseMakefileString(tc.mk, srcpos{filename: "test.mk", lineno: 1})
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.mk, err)
+			continue
+		}
+		mk.stmts = append(bmk.stmts, mk.stmts...)
+		vars := make(Vars)
+		er, err := eval(mk, vars, false)
+		if err != nil {
+			t.Errorf("eval %q: %v", tc.mk, err)
+			continue
+		}
+		vars.Merge(er.vars)
+		db, err := newDepBuilder(er, vars)
+		if err != nil {
+			t.Errorf("newDepBuilder %q: %v", tc.mk, err)
+			continue
+		}
+		nodes, err := db.Eval([]string{tc.target})
+		if err != nil {
+			t.Errorf("Eval %q in %q: %v", tc.target, tc.mk, err)
+			continue
+		}
+		n := nodes[0]
+		var cmd string
+		if len(n.Cmds) > 0 {
+			cmd = n.Cmds[0]
+		}
+		if !reflect.DeepEqual(n.ActualInputs, tc.wantInputs) || cmd != tc.wantCmd {
+			t.Errorf("%q in %q (noBuiltinRules=%t): inputs=%q cmd=%q; want %q %q", tc.target, tc.mk, tc.noBuiltinRules, n.ActualInputs, cmd, tc.wantInputs, tc.wantCmd)
+		}
+	}
+}
+
+func TestOrderOnlyInputs(t *testing.T) {
+	for _, tc := range []struct {
+		mk             string
+		target         string
+		wantDeps       []string
+		wantOrderOnlys []string
+	}{
+		{
+			mk:             "foo: a | b c\n",
+			target:         "foo",
+			wantDeps:       []string{"a"},
+			wantOrderOnlys: []string{"b", "c"},
+		},
+		{
+			mk:             "foo: a | a b\n",
+			target:         "foo",
+			wantDeps:       []string{"a"},
+			wantOrderOnlys: []string{"b"},
+		},
+		{
+			mk:             "foo.o bar.o: %.o: %.c | %.d out\n",
+			target:         "bar.o",
+			wantDeps:       []string{"bar.c"},
+			wantOrderOnlys: []string{"bar.d", "out"},
+		},
+		{
+			mk:             "%.o: %.c | %.d\n\tcc $<\nfoo.o: | out\nfoo.c:\n",
+			target:         "foo.o",
+			wantDeps:       []string{"foo.c"},
+			wantOrderOnlys: []string{"foo.d", "out"},
+		},
+	} {
+		n, err := buildTestDepNode(tc.mk, tc.target)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var deps, orderOnlys []string
+		for _, d := range n.Deps {
+			deps = append(deps, d.Output)
+		}
+		for _, d := range n.OrderOnlys {
+			orderOnlys = append(orderOnlys, d.Output)
+		}
+		if !reflect.DeepEqual(deps, tc.wantDeps) || !reflect.DeepEqual(orderOnlys, tc.wantOrderOnlys) {
+			t.Errorf("%q in %q: deps=%q order-only=%q; want %q %q", tc.target, tc.mk, deps, orderOnlys, tc.wantDeps, tc.wantOrderOnlys)
+		}
+	}
+}
+
+func TestStem(t *testing.T) {
+	for _, tc := range []struct {
+		mk         string
+		target     string
+		wantStem   string
+		wantInputs []string
+	}{
+		{
+			mk:         "obj/a.o obj/b.o: obj/%.o: src/%.c\n\tcc $<\n",
+			target:     "obj/b.o",
+			wantStem:   "b",
+			wantInputs: []string{"src/b.c"},
+		},
+		{
+			mk:         "a.o x.y: %.o: %.c\n\tcc $<\n",
+			target:     "x.y",
+			wantStem:   "",
+			wantInputs: nil,
+		},
+		{
+			mk:         "%.o: %.c\n\tcc $<\ndir/a.c:\n",
+			target:     "dir/a.o",
+			wantStem:   "dir/a",
+			wantInputs: []string{"dir/a.c"},
+		},
+		{
+			mk:         "lib%.a:\n\tar $@\n",
+			target:     "libfoo.a",
+			wantStem:   "foo",
+			wantInputs: nil,
+		},
+		{
+			mk:         "foo.o: foo.c\n\tcc $<\n",
+			target:     "foo.o",
+			wantStem:   "",
+			wantInputs: []string{"foo.c"},
+		},
+	} {
+		n, err := buildTestDepNode(tc.mk, tc.target)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if n.Stem != tc.wantStem || !reflect.DeepEqual(n.ActualInputs, tc.wantInputs) {
+			t.Errorf("%q in %q: stem=%q inputs=%q; want %q %q", tc.target, tc.mk, n.Stem, n.ActualInputs, tc.wantStem, tc.wantInputs)
+		}
+	}
+}
+
+// buildTestDepNode returns the node of target in the makefile mk.
+func buildTestDepNode(mk, target string) (*DepNode, error) {
+	m, err := parseMakefileString(mk, srcpos{filename: "test.mk", lineno: 1})
+	if err != nil {
+		return nil, fmt.Errorf("parse %q: %v", mk, err)
+	}
+	vars := make(Vars)
+	er, err := eval(m, vars, false)
+	if err != nil {
+		return nil, fmt.Errorf("eval %q: %v", mk, err)
+	}
+	vars.Merge(er.vars)
+	db, err := newDepBuilder(er, vars)
+	if err != nil {
+		return nil, fmt.Errorf("newDepBuilder %q: %v", mk, err)
+	}
+	nodes, err := db.Eval([]string{target})
+	if err != nil {
+		return nil, fmt.Errorf("Eval %q in %q: %v", target, mk, err)
+	}
+	return nodes[0], nil
+}
+
+func TestTargetSpecificVars(t *testing.T) {
+	n, err := buildTestDepNode(`CFLAGS := -O2
+all: foo.o bar.o baz.c
+all: CFLAGS += -all
+foo.o: CFLAGS += -g
+foo.o: dep.h
+%.o: CFLAGS += -pat
+b%.o: CFLAGS := -bpat
+all foo.o bar.o baz.c dep.h:
+	echo $@
+`, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	var walk func(*DepNode)
+	walk = func(n *DepNode) {
+		if v, ok := n.TargetSpecificVars["CFLAGS"]; ok {
+			got[n.Output] = v.String()
+		}
+		for _, d := range n.Deps {
+			walk(d)
+		}
+	}
+	walk(n)
+	want := map[string]string{
+		"all": "-O2 -all",
+		// pattern-specific variables are set before
+		// target-specific variables.
+		"foo.o": "-O2 -all -pat -g",
+		// inherited from foo.o.
+		"dep.h": "-O2 -all -pat -g",
+		// the more specific pattern is set later.
+		"bar.o": "-bpat",
+		"baz.c": "-O2 -all",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CFLAGS=%q; want %q", got, want)
+	}
+}
+
+func TestVpath(t *testing.T) {
+	chdirTempDir(t)
+	for _, f := range []string{"vpsrc/a.c", "vpsrc/b.c", "vpinc/x.h", "y.h"} {
+		err := os.MkdirAll(filepath.Dir(f), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(f, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		mk         string
+		target     string
+		wantInputs []string
+	}{
+		{
+			mk:         "VPATH = vpsrc\nvpath %.h vpinc\na.o: a.c x.h y.h\n\tcc $^\n",
+			target:     "a.o",
+			wantInputs: []string{"vpsrc/a.c", "vpinc/x.h", "y.h"},
+		},
+		{
+			mk:         "VPATH = vpsrc\n%.o: %.c\n\tcc $<\n",
+			target:     "b.o",
+			wantInputs: []string{"vpsrc/b.c"},
+		},
+		{
+			mk:         "vpath %.h vpsrc\na.o: a.c x.h\n\tcc $^\n",
+			target:     "a.o",
+			wantInputs: []string{"a.c", "x.h"},
+		},
+	} {
+		n, err := buildTestDepNode(tc.mk, tc.target)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !reflect.DeepEqual(n.ActualInputs, tc.wantInputs) {
+			t.Errorf("%q in %q: inputs=%q; want %q", tc.target, tc.mk, n.ActualInputs, tc.wantInputs)
+		}
+	}
+}
+
+func TestImplicitRuleChain(t *testing.T) {
+	chdirTempDir(t)
+	for _, f := range []string{"p.y", "q.a", "r.c"} {
+		err := ioutil.WriteFile(f, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		mk               string
+		target           string
+		wantInputs       []string
+		wantIntermediate bool
+	}{
+		{
+			mk:               "%.b: %.a\n\tcp $< $@\n%.x: %.b\n\tcp $< $@\n",
+			target:           "q.x",
+			wantInputs:       []string{"q.b"},
+			wantIntermediate: true,
+		},
+		{
+			mk:               ".SUFFIXES: .y .c .o\n.y.c:\n\tyacc $<\n.c.o:\n\tcc -c $<\n",
+			target:           "p.o",
+			wantInputs:       []string{"p.c"},
+			wantIntermediate: true,
+		},
+		{
+			mk:         ".SUFFIXES: .y .c .o\n.y.c:\n\tyacc $<\n.c.o:\n\tcc -c $<\n",
+			target:     "r.o",
+			wantInputs: []string{"r.c"},
+		},
+		{
+			mk:         ".SECONDARY:\n%.b: %.a\n\tcp $< $@\n%.x: %.b\n\tcp $< $@\n",
+			target:     "q.x",
+			wantInputs: []string{"q.b"},
+		},
+		{
+			mk:     "%.x: %.x.x\n\tcp $< $@\n",
+			target: "q.x",
+		},
+		{
+			mk:     ".PHONY: q.x\nq.x:\n%.x: %.a\n\tcp $< $@\n",
+			target: "q.x",
+		},
+	} {
+		n, err := buildTestDepNode(tc.mk, tc.target)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !reflect.DeepEqual(n.ActualInputs, tc.wantInputs) {
+			t.Errorf("%q in %q: inputs=%q; want %q", tc.target, tc.mk, n.ActualInputs, tc.wantInputs)
+			continue
+		}
+		if len(n.Deps) > 0 && n.Deps[0].IsIntermediate != tc.wantIntermediate {
+			t.Errorf("%q in %q: %q intermediate=%t; want %t", tc.target, tc.mk, n.Deps[0].Output, n.Deps[0].IsIntermediate, tc.wantIntermediate)
+		}
+	}
+}
+
+func TestMergeRulesInputFiles(t *testing.T) {
+	newRule := func(filename string, outputs ...string) *rule {
+		return &rule{
+			srcpos:  srcpos{filename: filename, lineno: 1},
+			outputs: outputs,
+			inputs:  []string{filename + ".in"},
+		}
+	}
+	// a and b share the rule of x.mk until it is merged.
+	shared := newRule("x.mk", "a", "b")
+	rules := map[string]*rule{"a": shared, "b": shared}
+	for _, m := range []struct {
+		output, filename string
+	}{
+		{"a", "a1.mk"}, {"b", "b1.mk"}, {"a", "a2.mk"}, {"a", "a3.mk"}, {"b", "b2.mk"},
+	} {
+		mr, err := mergeRules(rules[m.output], newRule(m.filename, m.output), m.output, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules[m.output] = mr
+	}
+	for output, want := range map[string][]string{
+		"a": {"x.mk", "a1.mk", "a2.mk", "a3.mk"},
+		"b": {"x.mk", "b1.mk", "b2.mk"},
+	} {
+		var got []string
+		for _, in := range rules[output].inputFiles {
+			got = append(got, in.filename)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("inputFiles of %s=%q; want %q", output, got, want)
+		}
+	}
+}
@@ -15,9 +15,10 @@
 package kati
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
-	"io/ioutil"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,7 +31,26 @@ type DepGraph struct {
 	vars        Vars
 	accessedMks []*accessedMakefile
 	exports     map[string]bool
-	vpaths      searchPaths
+	// exportAll is true if "export" is given without variable names,
+	// or .EXPORT_ALL_VARIABLES is a target.
+	exportAll bool
+	vpaths    searchPaths
+	// usedEnvs are sorted names of environment variables used while
+	// loading.
+	usedEnvs []string
+	// makefiles are nodes of makefiles read or missing while loading,
+	// and missingMakefiles are missing ones, if LoadReq.RemakeMakefiles
+	// is true.
+	makefiles        []*DepNode
+	missingMakefiles []missingMakefile
+	// targetsErr is an error to evaluate targets, which is reported
+	// after makefiles are remade.
+	targetsErr error
+	// loadTime is when loading started. Files modified after it may
+	// not be read. see NewKatiStamp
+	loadTime time.Time
+	// symbols are recorded if SymbolIndexFlag is set.
+	symbols *symbolIndex
 }
 
 // Nodes returns all rules.
@@ -39,6 +59,17 @@ func (g *DepGraph) Nodes() []*DepNode { return g.nodes }
 // Vars returns all variables.
 func (g *DepGraph) Vars() Vars { return g.vars }
 
+// copyVars returns a copy of g with a copy of its variables, for exec
+// contexts which define automatic variables in them.
+func (g *DepGraph) copyVars() *DepGraph {
+	c := *g
+	c.vars = make(Vars, len(g.vars))
+	for k, v := range g.vars {
+		c.vars[k] = v
+	}
+	return &c
+}
+
 // LoadReq is a request to load makefile.
 type LoadReq struct {
 	Makefile         string
@@ -47,6 +78,17 @@ type LoadReq struct {
 	EnvironmentVars  []string
 	UseCache         bool
 	EagerEvalCommand bool
+	// RemakeMakefiles makes missing makefiles of include directives
+	// not errors, so Executor.RemakeMakefiles can make them, as well
+	// as updating makefiles read.
+	RemakeMakefiles bool
+	// Restarts is the number of times makefiles were loaded again
+	// after they were remade, which is MAKE_RESTARTS if not zero.
+	Restarts int
+	// TrackMakefiles records makefiles read while loading, and other
+	// inputs with CacheFingerprints, even if UseCache is false, e.g.
+	// for NewKatiStamp.
+	TrackMakefiles bool
 }
 
 // FromCommandLine creates LoadReq from given command line.
@@ -86,10 +128,101 @@ func initVars(vars Vars, kvlist []string, origin string) error {
 	return nil
 }
 
+// initCommandLineVars defines command line variables in kvlist, e.g.
+// "FOO=bar" or "FOO:=$(BAR)". As GNU make, their values are parsed as
+// in makefiles, and ":=" expands them with variables defined before.
+func initCommandLineVars(vars Vars, kvlist []string) error {
+	ev := NewEvaluator(vars)
+	for _, kv := range kvlist {
+		glog.V(1).Infof("command line var %q", kv)
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return fmt.Errorf("A weird command line variable %q", kv)
+		}
+		name, op := kv[:i], "="
+		for _, o := range []string{"::", ":", "+", "?"} {
+			if strings.HasSuffix(name, o) {
+				name, op = name[:len(name)-len(o)], o[len(o)-1:]+"="
+				break
+			}
+		}
+		name = strings.TrimSpace(name)
+		src := trimLeftSpace(kv[i+1:])
+		val, _, err := parseExpr([]byte(src), nil, parseOp{})
+		if err != nil {
+			return fmt.Errorf("command line variable %q: %v", kv, err)
+		}
+		prev := vars.Lookup(name)
+		switch op {
+		case "?=":
+			if prev.IsDefined() {
+				continue
+			}
+		case "+=":
+			if prev.IsDefined() {
+				prev = withOrigin(prev, "command line")
+				if prev.Flavor() == "recursive" {
+					prev, err = prev.Append(ev, src)
+				} else {
+					prev, err = prev.AppendVar(ev, val)
+				}
+				if err != nil {
+					return err
+				}
+				vars.Assign(name, prev)
+				continue
+			}
+		case ":=":
+			var buf evalBuffer
+			buf.resetSep()
+			err := val.Eval(&buf, ev)
+			if err != nil {
+				return err
+			}
+			vars.Assign(name, &simpleVar{
+				value:  []string{buf.String()},
+				origin: "command line",
+			})
+			continue
+		}
+		v := &recursiveVar{
+			expr:   val,
+			origin: "command line",
+		}
+		if strings.IndexByte(src, '$') >= 0 {
+			v.src = src
+		}
+		vars.Assign(name, v)
+	}
+	return nil
+}
+
 // Load loads makefile.
 func Load(req LoadReq) (*DepGraph, error) {
+	return load(req, req.UseCache || req.TrackMakefiles)
+}
+
+// load loads makefile in DefaultSession. If trackMakefiles is true, all
+// makefiles read while loading are recorded in accessedMks of the
+// DepGraph, even if req.UseCache is false.
+func load(req LoadReq, trackMakefiles bool) (*DepGraph, error) {
+	r, err := DefaultSession.load(context.Background(), req, trackMakefiles)
+	if err != nil {
+		return nil, err
+	}
+	return r.Graph, nil
+}
+
+func (s *Session) load(ctx context.Context, req LoadReq, trackMakefiles bool) (r *LoadResult, err error) {
+	defer recoverPanic(nil, &err)
+	if err := validWildcardOrder(WildcardOrder); err != nil {
+		return nil, err
+	}
+	if err := validWildcardFold(WildcardFold); err != nil {
+		return nil, err
+	}
 	startTime := time.Now()
-	var err error
+	loadTime := startTime
 	if req.Makefile == "" {
 		req.Makefile, err = defaultMakefile()
 		if err != nil {
@@ -98,22 +231,36 @@ func Load(req LoadReq) (*DepGraph, error) {
 	}
 
 	if req.UseCache {
-		g, err := loadCache(req.Makefile, req.Targets)
+		g, err := loadCache(req.Makefile, req.Targets, req.EnvironmentVars)
 		if err == nil {
-			return g, nil
+			// the cache has the same inputs as ones now.
+			g.loadTime = loadTime
+			return newLoadResult(g, true), nil
+		}
+		if r, ok := err.(*RegenReason); ok {
+			logRegen(r)
 		}
 	}
 
+	endLoad := s.androidFindCache.beginLoad()
+	defer endLoad()
+
+	// trace events of loads in LoadAll are in their own threads.
+	tid := traceEvent.newThread(strings.TrimSpace("load " + req.Makefile + " " + strings.Join(req.CommandLineVars, " ")))
 	bmk, err := bootstrapMakefile(req.Targets)
 	if err != nil {
 		return nil, err
 	}
 
-	content, err := ioutil.ReadFile(req.Makefile)
+	debugf(DebugBasic, "Reading makefiles...")
+	debugf(DebugVerbose, "Reading makefile '%s'...", req.Makefile)
+	te := traceEvent.begin("parse", literal(req.Makefile), tid)
+	content, err := readMakefile(req.Makefile)
 	if err != nil {
 		return nil, err
 	}
 	mk, err := parseMakefile(content, req.Makefile)
+	traceEvent.end(te)
 	if err != nil {
 		return nil, err
 	}
@@ -125,36 +272,98 @@ func Load(req LoadReq) (*DepGraph, error) {
 	mk.stmts = append(bmk.stmts, mk.stmts...)
 
 	vars := make(Vars)
-	err = initVars(vars, req.EnvironmentVars, "environment")
+	envOrigin := "environment"
+	if EnvironmentOverrides {
+		envOrigin = "environment override"
+	}
+	err = initVars(vars, req.EnvironmentVars, envOrigin)
 	if err != nil {
 		return nil, err
 	}
-	err = initVars(vars, req.CommandLineVars, "command line")
+	if EnvironmentOverrides {
+		for _, name := range noEnvOverrideVars {
+			if v, ok := vars[name]; ok {
+				vars[name] = withOrigin(v, "environment")
+			}
+		}
+	}
+	envVars := make(Vars)
+	for name, v := range vars {
+		envVars[name] = v
+	}
+	usedEnvs.track(envVars)
+	defer func() {
+		names := usedEnvs.take(envVars)
+		if r != nil {
+			r.Graph.usedEnvs = names
+			r.UsedEnvs = names
+		}
+	}()
+	err = initCommandLineVars(vars, req.CommandLineVars)
 	if err != nil {
 		return nil, err
 	}
-	er, err := eval(mk, vars, req.UseCache)
+	var overrides []string
+	for _, kv := range req.CommandLineVars {
+		overrides = append(overrides, escapeMakeflagsVar(kv))
+	}
+	// GNU make defines them as environment variables.
+	vars.Assign("MAKEOVERRIDES", &simpleVar{
+		value:  []string{strings.Join(overrides, " ")},
+		origin: "environment",
+	})
+	if req.Restarts > 0 {
+		vars.Assign("MAKE_RESTARTS", &simpleVar{
+			value:  []string{strconv.Itoa(req.Restarts)},
+			origin: "environment",
+		})
+	}
+	er, err := evalRemake(ctx, s, tid, mk, vars, trackMakefiles, req.RemakeMakefiles)
 	if err != nil {
 		return nil, err
 	}
 	vars.Merge(er.vars)
 
-	logStats("eval time: %q", time.Since(startTime))
+	evalTime := time.Since(startTime)
+	logStats("eval time: %q", evalTime)
 	logStats("shell func time: %q %d", shellStats.Duration(), shellStats.Count())
+	if ShellCacheFile != "" {
+		err := shellCache.save()
+		if err != nil {
+			glog.Warningf("save shell cache %s: %v", ShellCacheFile, err)
+		}
+	}
 
 	startTime = time.Now()
 	db, err := newDepBuilder(er, vars)
 	if err != nil {
 		return nil, err
 	}
+	db.ev.ctx = ctx
+	db.ev.tid = tid
 	logStats("dep build prepare time: %q", time.Since(startTime))
 
 	startTime = time.Now()
+	te = traceEvent.begin("depbuild", literal(strings.Join(req.Targets, " ")), tid)
+	var makefiles []*DepNode
+	if targets := makefileTargets(vars, er.missingMakefiles); req.RemakeMakefiles && len(targets) > 0 {
+		makefiles, err = db.Eval(targets)
+		if err != nil {
+			return nil, err
+		}
+	}
 	nodes, err := db.Eval(req.Targets)
+	var targetsErr error
 	if err != nil {
-		return nil, err
+		if !req.RemakeMakefiles {
+			return nil, err
+		}
+		// makefiles remade may define the targets.
+		targetsErr = err
 	}
-	logStats("dep build time: %q", time.Since(startTime))
+	traceEvent.end(te)
+	depBuildTime := time.Since(startTime)
+	logStats("dep build time: %q", depBuildTime)
 	var accessedMks []*accessedMakefile
 	// Always put the root Makefile as the first element.
 	accessedMks = append(accessedMks, &accessedMakefile{
@@ -163,12 +372,26 @@ func Load(req LoadReq) (*DepGraph, error) {
 		State:    fileExists,
 	})
 	accessedMks = append(accessedMks, er.accessedMks...)
+	if s.cacheFingerprints() && trackMakefiles {
+		accessedMks = append(accessedMks, envFingerprints(usedEnvs.used(envVars), req.EnvironmentVars)...)
+	}
 	gd := &DepGraph{
 		nodes:       nodes,
 		vars:        vars,
 		accessedMks: accessedMks,
 		exports:     er.exports,
+		exportAll:   er.exportAll,
 		vpaths:      er.vpaths,
+
+		makefiles:        makefiles,
+		missingMakefiles: er.missingMakefiles,
+		targetsErr:       targetsErr,
+		loadTime:         loadTime,
+		symbols:          er.symbols,
+	}
+	er.symbols.merge(db.ev.symbols)
+	if _, ok := db.rules[".EXPORT_ALL_VARIABLES"]; ok {
+		gd.exportAll = true
 	}
 	if req.EagerEvalCommand {
 		startTime := time.Now()
@@ -183,7 +406,45 @@ func Load(req LoadReq) (*DepGraph, error) {
 		saveCache(gd, req.Targets)
 		logStats("serialize time: %q", time.Since(startTime))
 	}
-	return gd, nil
+	r = newLoadResult(gd, false)
+	r.EvalTime = evalTime
+	r.DepBuildTime = depBuildTime
+	return r, nil
+}
+
+func newLoadResult(g *DepGraph, cached bool) *LoadResult {
+	return &LoadResult{
+		Graph:     g,
+		Cached:    cached,
+		Makefiles: strings.Fields(g.vars.Lookup("MAKEFILE_LIST").String()),
+		UsedEnvs:  g.usedEnvs,
+	}
+}
+
+func errLoadAllUseCache(req LoadReq) error {
+	return fmt.Errorf("LoadAll doesn't support UseCache: %q", req.Makefile)
+}
+
+// LoadAll loads makefiles for each request concurrently, e.g. to
+// evaluate the same tree for several TARGET_PRODUCTs at once.
+// Evaluations share the parse cache, the wildcard cache and the find
+// cache, so the tree is read and scanned only once.
+// It returns DepGraphs in the same order as reqs. If some requests
+// failed, it returns the error of the first failed request.
+// parallelism limits the number of concurrent evaluations. If it is
+// not positive, all requests are evaluated at once.
+func LoadAll(reqs []LoadReq, parallelism int) ([]*DepGraph, error) {
+	results, err := DefaultSession.LoadAll(context.Background(), reqs, parallelism)
+	if results == nil {
+		return nil, err
+	}
+	graphs := make([]*DepGraph, len(results))
+	for i, r := range results {
+		if r != nil {
+			graphs[i] = r.Graph
+		}
+	}
+	return graphs, err
 }
 
 // Loader is the interface that loads DepGraph.
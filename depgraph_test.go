@@ -0,0 +1,480 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writeTestMakefile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := filepath.Join(dir, "Makefile")
+	err = ioutil.WriteFile(mk, []byte(content), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return mk
+}
+
+// chdirTempDir changes the current directory to a new temporary
+// directory, and returns it. The directory is removed when the test
+// finishes.
+func chdirTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// chdirTestMakefile writes content to Makefile in a new temporary
+// directory, and changes the current directory to it, as
+// chdirTempDir does.
+func chdirTestMakefile(t *testing.T, content string) string {
+	dir := chdirTempDir(t)
+	err := ioutil.WriteFile("Makefile", []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadAll(t *testing.T) {
+	mk := writeTestMakefile(t, `
+OUTS := $(PRODUCT)/a $(PRODUCT)/b
+OUTS += $(PRODUCT)/c
+all: $(OUTS)
+$(OUTS):
+	echo $@
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	products := []string{"p0", "p1", "p2", "p3", "p4", "p5", "p6", "p7"}
+	var reqs []LoadReq
+	for _, p := range products {
+		reqs = append(reqs, LoadReq{
+			Makefile:        mk,
+			CommandLineVars: []string{"PRODUCT=" + p},
+		})
+	}
+	graphs, err := LoadAll(reqs, 3)
+	if err != nil {
+		t.Fatalf("LoadAll(...)=_, %v; want nil error", err)
+	}
+	for i, g := range graphs {
+		p := products[i]
+		if len(g.Nodes()) != 1 {
+			t.Errorf("%s: len(nodes)=%d; want 1", p, len(g.Nodes()))
+			continue
+		}
+		var got []string
+		for _, d := range g.Nodes()[0].Deps {
+			got = append(got, d.Output)
+		}
+		want := []string{p + "/a", p + "/b", p + "/c"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: deps=%q; want %q", p, got, want)
+		}
+	}
+}
+
+func TestLoadAllError(t *testing.T) {
+	mk := writeTestMakefile(t, `
+ifeq ($(PRODUCT),bad)
+$(error bad product)
+endif
+all:
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	reqs := []LoadReq{
+		{Makefile: mk, CommandLineVars: []string{"PRODUCT=good"}},
+		{Makefile: mk, CommandLineVars: []string{"PRODUCT=bad"}},
+	}
+	graphs, err := LoadAll(reqs, 0)
+	if err == nil {
+		t.Fatalf("LoadAll(...)=_, nil; want error")
+	}
+	if graphs[0] == nil || graphs[1] != nil {
+		t.Errorf("LoadAll(...)=%v; want graph only for first request", graphs)
+	}
+}
+
+func TestCommandLineVars(t *testing.T) {
+	mk := writeTestMakefile(t, `
+A := file
+B += file
+override C := over
+override D += over
+E ?= file
+define F
+file
+endef
+G := $(H)
+H += appended
+I = $(A)
+all:
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	g, err := Load(LoadReq{
+		Makefile:        mk,
+		CommandLineVars: []string{"A=cl", "B=cl", "C=cl", "D=cl", "E=cl", "F=cl", "H=$$(A)", "I:=$$(A)", "J=1", "J+=2", "J?=3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEvaluator(g.vars)
+	for _, tc := range []struct {
+		name   string
+		want   string
+		origin string
+	}{
+		{name: "A", want: "cl", origin: "command line"},
+		{name: "B", want: "cl", origin: "command line"},
+		{name: "C", want: "over", origin: "override"},
+		{name: "D", want: "cl over", origin: "override"},
+		{name: "E", want: "cl", origin: "command line"},
+		{name: "F", want: "cl", origin: "command line"},
+		{name: "G", want: "$(A)", origin: "file"},
+		{name: "H", want: "$(A)", origin: "command line"},
+		{name: "I", want: "$(A)", origin: "command line"},
+		{name: "J", want: "1 2", origin: "command line"},
+	} {
+		got, err := ev.EvaluateVar(tc.name)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		origin := g.vars.Lookup(tc.name).Origin()
+		if got != tc.want || origin != tc.origin {
+			t.Errorf("%s=%q (origin %q); want %q (origin %q)", tc.name, got, origin, tc.want, tc.origin)
+		}
+	}
+}
+
+func TestRecipePrefix(t *testing.T) {
+	mk := writeTestMakefile(t, `
+all:
+>echo a
+P := +
+override .RECIPEPREFIX := $(P)
+b:
++echo b
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	g, err := Load(LoadReq{
+		Makefile:        mk,
+		Targets:         []string{"all", "b"},
+		CommandLineVars: []string{".RECIPEPREFIX=>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"all": {"echo a"},
+		"b":   {"echo b"},
+	}
+	for _, n := range g.Nodes() {
+		if !reflect.DeepEqual(n.Cmds, want[n.Output]) {
+			t.Errorf("%s: Cmds=%q; want %q", n.Output, n.Cmds, want[n.Output])
+		}
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	mk := writeTestMakefile(t, `
+A := file
+B += file
+C ?= file
+override D := over
+E := file
+F := file
+all:
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	for _, tc := range []struct {
+		envOverrides bool
+		want         map[string]string
+	}{
+		{
+			envOverrides: false,
+			want: map[string]string{
+				"A":     "file (file)",
+				"B":     "env file (file)",
+				"C":     "env (environment)",
+				"D":     "over (override)",
+				"E":     "cl (command line)",
+				"F":     "file (file)",
+				"SHELL": "/bin/sh (file)",
+			},
+		},
+		{
+			envOverrides: true,
+			want: map[string]string{
+				"A":     "env (environment override)",
+				"B":     "env (environment override)",
+				"C":     "env (environment override)",
+				"D":     "over (override)",
+				"E":     "cl (command line)",
+				"F":     "file (file)",
+				"SHELL": "/bin/sh (file)",
+			},
+		},
+	} {
+		EnvironmentOverrides = tc.envOverrides
+		g, err := Load(LoadReq{
+			Makefile:        mk,
+			EnvironmentVars: []string{"A=env", "B=env", "C=env", "D=env", "E=env", "SHELL=/bin/env-sh"},
+			CommandLineVars: []string{"E=cl"},
+		})
+		EnvironmentOverrides = false
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for name := range tc.want {
+			v := g.vars.Lookup(name)
+			got[name] = fmt.Sprintf("%s (%s)", v.String(), v.Origin())
+		}
+		if runtime.GOOS == "windows" {
+			delete(got, "SHELL")
+			delete(tc.want, "SHELL")
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("EnvironmentOverrides=%t: %q; want %q", tc.envOverrides, got, tc.want)
+		}
+	}
+}
+
+func TestMakeVersion(t *testing.T) {
+	mk := writeTestMakefile(t, `
+V := $(MAKE_VERSION)
+F := $(.FEATURES)
+A := $(filter A B V,$(.VARIABLES))
+B := $(filter A B V,$(.VARIABLES))
+all:
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	for _, tc := range []struct {
+		version string
+		want    map[string]string
+	}{
+		{
+			version: "3.81",
+			want: map[string]string{
+				"V": "3.81",
+				"F": "target-specific order-only else-if archives jobserver",
+				"A": "V",
+				"B": "A V",
+			},
+		},
+		{
+			version: "4.3",
+			want: map[string]string{
+				"V": "4.3",
+				"F": "target-specific order-only else-if oneshell grouped-target extra-prereqs archives jobserver output-sync load",
+				"A": "V",
+				"B": "A V",
+			},
+		},
+	} {
+		MakeVersion = tc.version
+		g, err := Load(LoadReq{Makefile: mk})
+		MakeVersion = "3.81"
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for name := range tc.want {
+			got[name] = g.vars.Lookup(name).String()
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("MakeVersion=%q: %q; want %q", tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestCheckAccessedMakefilesInclude(t *testing.T) {
+	mk := writeTestMakefile(t, `
+D := $(dir $(lastword $(MAKEFILE_LIST)))
+-include $(D)foo.d
+-include $(D)d/*.d
+all:
+`)
+	dir := filepath.Dir(mk)
+	defer os.RemoveAll(dir)
+	err := os.Mkdir(filepath.Join(dir, "d"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		write string // file to write before the check.
+		stale bool
+	}{
+		{stale: false},
+		{write: "foo.d", stale: true},
+		{write: "d/a.d", stale: true},
+		{write: "d/a.txt", stale: false},
+	} {
+		g, err := load(LoadReq{Makefile: mk}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.write != "" {
+			err = ioutil.WriteFile(filepath.Join(dir, tc.write), []byte("A := a\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = checkAccessedMakefiles(g.accessedMks, nil)
+		if got := err != nil; got != tc.stale {
+			t.Errorf("write %q: checkAccessedMakefiles=%v; want stale=%t", tc.write, err, tc.stale)
+		}
+	}
+}
+
+func TestCacheFingerprints(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("$(shell cat) needs a unix shell")
+	}
+	mk := writeTestMakefile(t, `
+D := $(dir $(lastword $(MAKEFILE_LIST)))
+A := $(wildcard $(D)*.c) $(shell cat $(D)v.txt) $(FOO) $(BAR)
+all:
+`)
+	dir := filepath.Dir(mk)
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("v.txt", "v1")
+	defer func() {
+		CacheFingerprints = false
+	}()
+
+	for _, tc := range []struct {
+		name   string
+		change func()
+		env    string
+		// want is "kind change" of the RegenReason, or "" if the
+		// cache is up to date.
+		want string
+	}{
+		{
+			name:   "touch makefile",
+			change: func() { writeFile("Makefile", string(mustReadFile(t, mk))) },
+		},
+		{
+			name:   "create file matched by wildcard",
+			change: func() { writeFile("a.c", "") },
+			want:   "wildcard changed",
+		},
+		{
+			name:   "create file unmatched by wildcard",
+			change: func() { writeFile("a.h", "") },
+		},
+		{
+			name:   "shell output",
+			change: func() { writeFile("v.txt", "v2") },
+			want:   "shell changed",
+		},
+		{
+			name: "environment variable",
+			env:  "FOO=b",
+			want: "env changed",
+		},
+		{
+			name: "undefined variable",
+			env:  "FOO=a BAR=b",
+			want: "env set",
+		},
+		{
+			name: "unused environment variable",
+			env:  "FOO=a BAZ=b",
+		},
+		{
+			name: "unset environment variable",
+			env:  "BAZ=b",
+			want: "env unset",
+		},
+		{
+			name:   "remove makefile",
+			change: func() { os.Remove(mk) },
+			want:   "makefile removed",
+		},
+	} {
+		CacheFingerprints = true
+		// files were changed by the previous test case.
+		InvalidateAllWildcardCache()
+		env := []string{"FOO=a"}
+		g, err := load(LoadReq{Makefile: mk, EnvironmentVars: env}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.change != nil {
+			tc.change()
+		}
+		if tc.env != "" {
+			env = strings.Fields(tc.env)
+		}
+		err = checkAccessedMakefiles(g.accessedMks, env)
+		var got string
+		if r, ok := err.(*RegenReason); ok {
+			got = r.Kind + " " + r.Change
+		} else if err != nil {
+			t.Fatalf("%s: checkAccessedMakefiles=%v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: checkAccessedMakefiles=%v; want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, fn string) []byte {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Diagnostics are warnings and errors in makefiles, with their
+// location, severity and code. They are printed to stdout as GNU make
+// does, e.g. "Makefile:3: warning: ...", or to stderr as JSON lines
+// with DiagnosticsJSON, or passed to DiagnosticHandler.
+//
+// Messages of $(info), $(warning) and $(error) are not diagnostics,
+// but they can be passed to MessageHandler with their location too.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Severity is the severity of a Diagnostic.
+type Severity string
+
+// Severities of diagnostics.
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Codes of diagnostics.
+const (
+	DiagOverrideCommands  = "override-commands"
+	DiagIgnoreOldCommands = "ignore-old-commands"
+	DiagTargetPattern     = "target-pattern"
+	DiagExtraneousText    = "extraneous-text"
+	DiagInvalidOverride   = "invalid-override"
+	DiagMakefileChanged   = "makefile-changed"
+	DiagGNUExtension      = "gnu-extension"
+	DiagBSDMakefile       = "bsd-makefile"
+	DiagWildcardOrder     = "wildcard-order"
+	// Codes of warnings with WarnFlag.
+	DiagUndefinedVariable = "undefined-variable"
+	DiagSelfReference     = "self-reference"
+	DiagRecipeSpaces      = "recipe-spaces"
+	DiagAutomaticVariable = "automatic-variable"
+	DiagDuplicateTarget   = "duplicate-target"
+	DiagUnknownFunction   = "unknown-function"
+	// DiagError is the code of errors which stop kati, and
+	// DiagInternalError is of kati's internal errors.
+	DiagError         = "error"
+	DiagInternalError = "internal-error"
+)
+
+// Diagnostic is a warning or an error in makefiles.
+type Diagnostic struct {
+	Filename string `json:"file"`
+	Line     int    `json:"line"`
+	// Column is 1-based, or 0 if unknown.
+	Column   int      `json:"column,omitempty"`
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+
+	// noPrefix is true for warnings which GNU make prints without
+	// "warning: ".
+	noPrefix bool
+}
+
+// String returns d as GNU make prints it.
+func (d Diagnostic) String() string {
+	if d.Severity == SeverityWarning && !d.noPrefix {
+		return fmt.Sprintf("%s:%d: warning: %s", d.Filename, d.Line, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", d.Filename, d.Line, d.Message)
+}
+
+var (
+	// DiagnosticsJSON makes kati print diagnostics to stderr as JSON
+	// lines, instead of text to stdout.
+	DiagnosticsJSON bool
+
+	// DiagnosticHandler receives diagnostics instead of printing them
+	// if it is not nil. It may be called concurrently.
+	DiagnosticHandler func(Diagnostic)
+
+	// MessageHandler receives messages of $(info) and $(warning)
+	// instead of printing them if it is not nil, and ones of $(error)
+	// before the evaluation fails with the error. It may be called
+	// concurrently.
+	MessageHandler func(Message)
+)
+
+// Message is a message of $(info), $(warning) or $(error) in
+// makefiles.
+type Message struct {
+	Filename string
+	Line     int
+	// Func is the function, "info", "warning" or "error".
+	Func string
+	Text string
+}
+
+// String returns m as GNU make prints it.
+func (m Message) String() string {
+	switch m.Func {
+	case "info":
+		return m.Text
+	case "error":
+		return fmt.Sprintf("%s:%d: *** %s.", m.Filename, m.Line, m.Text)
+	}
+	return fmt.Sprintf("%s:%d: %s", m.Filename, m.Line, m.Text)
+}
+
+// printMessage passes the message of $(fn) to MessageHandler, or
+// prints it to stdout.
+func printMessage(loc srcpos, fn, text string) {
+	m := Message{
+		Filename: loc.filename,
+		Line:     loc.lineno,
+		Func:     fn,
+		Text:     text,
+	}
+	if MessageHandler != nil {
+		MessageHandler(m)
+		return
+	}
+	fmt.Println(m)
+}
+
+var diagMu sync.Mutex
+
+// ReportDiagnostic reports d to DiagnosticHandler, or prints it.
+func ReportDiagnostic(d Diagnostic) {
+	if DiagnosticHandler != nil {
+		DiagnosticHandler(d)
+		return
+	}
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	if DiagnosticsJSON {
+		b, err := json.Marshal(d)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", b)
+		return
+	}
+	fmt.Println(d)
+}
+
+// ErrorDiagnostic returns the Diagnostic of err if it is an error in
+// makefiles.
+func ErrorDiagnostic(err error) (Diagnostic, bool) {
+	e, ok := err.(EvalError)
+	if !ok {
+		return Diagnostic{}, false
+	}
+	d := Diagnostic{
+		Filename: e.Filename,
+		Line:     e.Lineno,
+		Severity: SeverityError,
+		Code:     DiagError,
+		Message:  e.Err.Error(),
+	}
+	if e.Stack != "" {
+		d.Code = DiagInternalError
+	}
+	return d, true
+}
+
+func warn(loc srcpos, code string, f string, a ...interface{}) {
+	ReportDiagnostic(Diagnostic{
+		Filename: loc.filename,
+		Line:     loc.lineno,
+		Severity: SeverityWarning,
+		Code:     code,
+		Message:  fmt.Sprintf(f, a...),
+	})
+}
+
+// warnNoPrefix reports a warning which GNU make prints without
+// "warning: ". col is its column, or 0 if unknown.
+func warnNoPrefix(loc srcpos, col int, code string, f string, a ...interface{}) {
+	ReportDiagnostic(Diagnostic{
+		Filename: loc.filename,
+		Line:     loc.lineno,
+		Column:   col,
+		Severity: SeverityWarning,
+		Code:     code,
+		Message:  fmt.Sprintf(f, a...),
+		noPrefix: true,
+	})
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	var got []Diagnostic
+	DiagnosticHandler = func(d Diagnostic) {
+		got = append(got, d)
+	}
+	defer func() {
+		DiagnosticHandler = nil
+	}()
+
+	for _, tc := range []struct {
+		in   string
+		want []Diagnostic
+	}{
+		{
+			in: "ifdef A\nelse  foo\nendif\n",
+			want: []Diagnostic{{
+				Filename: "test.mk",
+				Line:     2,
+				Column:   7,
+				Severity: SeverityWarning,
+				Code:     DiagExtraneousText,
+				Message:  "extraneous text after `else' directive",
+				noPrefix: true,
+			}},
+		},
+		{
+			in: "ifdef A\nendif x\n",
+			want: []Diagnostic{{
+				Filename: "test.mk",
+				Line:     2,
+				Column:   7,
+				Severity: SeverityWarning,
+				Code:     DiagExtraneousText,
+				Message:  "extraneous text after `endif' directive",
+				noPrefix: true,
+			}},
+		},
+		{
+			in: ".POSIX:\nA = a\nvpath %.c src\n",
+			want: []Diagnostic{{
+				Filename: "test.mk",
+				Line:     3,
+				Severity: SeverityWarning,
+				Code:     DiagGNUExtension,
+				Message:  `"vpath" directive is a GNU make extension`,
+			}},
+		},
+		{
+			in: ".POSIX:\nA = a\nB = $(notdir x)\n",
+			want: []Diagnostic{{
+				Filename: "test.mk",
+				Line:     3,
+				Severity: SeverityError,
+				Code:     DiagError,
+				Message:  `*** function "notdir" is a GNU make extension, not available in POSIX mode.`,
+			}},
+		},
+	} {
+		got = nil
+		mk, err := parseMakefile([]byte(tc.in), "test.mk")
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.in, err)
+			continue
+		}
+		_, err = eval(mk, make(Vars), false)
+		if err != nil {
+			d, ok := ErrorDiagnostic(err)
+			if !ok {
+				t.Errorf("eval(%q)=_, %v; want EvalError", tc.in, err)
+				continue
+			}
+			got = append(got, d)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("eval(%q): diagnostics=%#v; want %#v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDiagnosticString(t *testing.T) {
+	for _, tc := range []struct {
+		d    Diagnostic
+		want string
+	}{
+		{
+			d:    Diagnostic{Filename: "a.mk", Line: 1, Severity: SeverityWarning, Message: "foo"},
+			want: "a.mk:1: warning: foo",
+		},
+		{
+			d:    Diagnostic{Filename: "a.mk", Line: 1, Severity: SeverityWarning, Message: "foo", noPrefix: true},
+			want: "a.mk:1: foo",
+		},
+		{
+			d:    Diagnostic{Filename: "a.mk", Line: 2, Severity: SeverityError, Message: "*** foo."},
+			want: "a.mk:2: *** foo.",
+		},
+	} {
+		if got := tc.d.String(); got != tc.want {
+			t.Errorf("%+v.String()=%q; want %q", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestMessageHandler(t *testing.T) {
+	var got []Message
+	MessageHandler = func(m Message) {
+		got = append(got, m)
+	}
+	defer func() {
+		MessageHandler = nil
+	}()
+
+	mk, err := parseMakefile([]byte("$(info a b)\nX := $(warning c)\n$(error d)\n"), "test.mk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = eval(mk, make(Vars), false)
+	if err == nil {
+		t.Errorf("eval: no error by $(error)")
+	}
+	want := []Message{
+		{Filename: "test.mk", Line: 1, Func: "info", Text: "a b"},
+		{Filename: "test.mk", Line: 2, Func: "warning", Text: "c"},
+		{Filename: "test.mk", Line: 3, Func: "error", Text: "d"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("messages=%#v; want %#v", got, want)
+	}
+	var strs []string
+	for _, m := range got {
+		strs = append(strs, m.String())
+	}
+	if want := []string{"a b", "test.mk:2: c", "test.mk:3: *** d."}; !reflect.DeepEqual(strs, want) {
+		t.Errorf("String()=%q; want %q", strs, want)
+	}
+}
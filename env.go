@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Commands run by $(shell) and recipes get exported variables in their
+// environment, as GNU make 4.4 does:
+//  - variables marked by "export", or target-specific variables
+//    defined with "export", e.g. "foo: export V := v".
+//  - variables from the environment, even if they are modified in
+//    makefiles, except SHELL.
+//  - variables from the command line.
+//  - all other variables except default and automatic ones if
+//    "export" without variable names or .EXPORT_ALL_VARIABLES is
+//    given.
+// Variables marked by "unexport" are removed from the environment.
+// Only variables whose names are letters, digits and underscores are
+// exported.
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// isExportable reports whether name can be a name of an environment
+// variable.
+func isExportable(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// exported reports whether variable name whose value is v is exported.
+func (ev *Evaluator) exported(name string, v Var) bool {
+	if tsv, ok := v.(*targetSpecificVar); ok && tsv.export {
+		return true
+	}
+	if export, ok := ev.exports[name]; ok {
+		return export
+	}
+	if name == "SHELL" {
+		return false
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		return true
+	}
+	if !isExportable(name) {
+		return false
+	}
+	switch v.Origin() {
+	case "command line", "environment", "environment override":
+		return true
+	case "default", "automatic", "undefined":
+		return false
+	}
+	return ev.exportAll
+}
+
+// envNames returns names of variables which may be exported or
+// unexported, in addition to ones in the environment.
+func (ev *Evaluator) envNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for name := range ev.exports {
+		add(name)
+	}
+	for name := range ev.targetVars {
+		add(name)
+	}
+	if ev.cmdlineVarNames == nil {
+		// command line variables are in ev.vars, which assignments
+		// in makefiles don't modify.
+		ev.cmdlineVarNames = []string{}
+		for name, v := range ev.vars {
+			if v.Origin() == "command line" {
+				ev.cmdlineVarNames = append(ev.cmdlineVarNames, name)
+			}
+		}
+	}
+	for _, name := range ev.cmdlineVarNames {
+		add(name)
+	}
+	if ev.exportAll {
+		for _, vars := range []Vars{ev.vars, ev.outVars} {
+			for name := range vars {
+				add(name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// environ returns the environment for commands, i.e. os.Environ() with
+// exported variables and without unexported ones. It returns nil if it
+// is the same as os.Environ().
+func (ev *Evaluator) environ() ([]string, error) {
+	if ev.inEnviron {
+		// exported variables are being expanded for $(shell).
+		return nil, nil
+	}
+	ev.inEnviron = true
+	defer func() { ev.inEnviron = false }()
+
+	env := os.Environ()
+	index := make(map[string]int)
+	var names []string
+	for i, kv := range env {
+		name := kv
+		if j := strings.IndexByte(kv, '='); j >= 0 {
+			name = kv[:j]
+		}
+		index[name] = i
+		names = append(names, name)
+	}
+	names = append(names, ev.envNames()...)
+
+	modified := false
+	removed := make(map[int]bool)
+	done := make(map[string]bool)
+	for _, name := range names {
+		if done[name] {
+			continue
+		}
+		done[name] = true
+		i, inEnv := index[name]
+		v := ev.lookupVar(name)
+		if !ev.exported(name, v) {
+			if inEnv && name != "SHELL" {
+				removed[i] = true
+				modified = true
+			}
+			continue
+		}
+		if !v.IsDefined() {
+			// e.g. exported but undefined, or in the environment
+			// but not imported as a variable.
+			continue
+		}
+		value, err := ev.EvaluateVar(name)
+		if err != nil {
+			return nil, err
+		}
+		kv := name + "=" + value
+		switch {
+		case !inEnv:
+			index[name] = len(env)
+			env = append(env, kv)
+			modified = true
+		case env[i] != kv:
+			env[i] = kv
+			modified = true
+		}
+	}
+	if !modified {
+		return nil, nil
+	}
+	r := env[:0]
+	for i, kv := range env {
+		if !removed[i] {
+			r = append(r, kv)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestShellExport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	saved, ok := os.LookupEnv("KATI_TEST_ENV")
+	os.Setenv("KATI_TEST_ENV", "env")
+	if ok {
+		defer os.Setenv("KATI_TEST_ENV", saved)
+	} else {
+		defer os.Unsetenv("KATI_TEST_ENV")
+	}
+
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk:   "export A := a\nR := $(shell echo $$A)\n",
+			want: "a",
+		},
+		{
+			mk:   "A := a\nexport A\nA += b\nR := $(shell echo $$A)\n",
+			want: "a b",
+		},
+		{
+			mk:   "A := a\nR := $(shell echo $${A-none})\n",
+			want: "none",
+		},
+		{
+			mk:   "export\nA = a\nR := $(shell echo $$A)\n",
+			want: "a",
+		},
+		{
+			mk:   "export A := a\nunexport A\nR := $(shell echo $${A-none})\n",
+			want: "none",
+		},
+		{
+			mk:   "R := $(shell echo $$KATI_TEST_ENV)\n",
+			want: "env",
+		},
+		{
+			mk:   "KATI_TEST_ENV := mk\nR := $(shell echo $$KATI_TEST_ENV)\n",
+			want: "mk",
+		},
+		{
+			mk:   "unexport KATI_TEST_ENV\nR := $(shell echo $${KATI_TEST_ENV-none})\n",
+			want: "none",
+		},
+		{
+			// A is expanded without exporting itself.
+			mk:   "export A = $(shell echo $${A-x})\nR := $(shell echo $$A)\n",
+			want: "x",
+		},
+	} {
+		got := evalWithExpandCache(t, tc.mk, false).vars.Lookup("R").String()
+		if got != tc.want {
+			t.Errorf("eval(%q): R=%q; want %q", tc.mk, got, tc.want)
+		}
+	}
+}
@@ -16,10 +16,13 @@ package kati
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 
@@ -32,12 +35,30 @@ const (
 	fileExists fileState = iota
 	fileNotExists
 	fileInconsistent // Modified during kati is running.
+	// fileGlob is a glob pattern of an include directive, whose Hash is
+	// of the files it matched.
+	fileGlob
+	// fileWildcard, fileEnv and fileShell are a pattern of $(wildcard),
+	// an environment variable and a command of $(shell), recorded only
+	// with CacheFingerprints. see fingerprint.go
+	fileWildcard
+	fileEnv
+	fileShell
 )
 
 type accessedMakefile struct {
 	Filename string
 	Hash     [sha1.Size]byte
 	State    fileState
+	// Args are the shell and its flags for fileShell, and Env is the
+	// environment of the command if it has exported variables.
+	Args []string
+	Env  []string
+	// written is true if the file is written by $(file).
+	written bool
+	// out is the output of the command for fileShell, which is not
+	// saved in caches. see NewKatiStamp
+	out []byte
 }
 
 type accessCache struct {
@@ -86,6 +107,27 @@ func (ac *accessCache) update(fn string, hash [sha1.Size]byte, st fileState) str
 	return ""
 }
 
+// write records fn written by $(file) with the hash of its content,
+// which the next evaluation will write again.
+func (ac *accessCache) write(fn string, hash [sha1.Size]byte) {
+	if ac == nil {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if rm, present := ac.m[fn]; present && !rm.written && (rm.State != fileExists || !bytes.Equal(hash[:], rm.Hash[:])) {
+		// the evaluation depends on the content before written.
+		rm.State = fileInconsistent
+		return
+	}
+	ac.m[fn] = &accessedMakefile{
+		Filename: fn,
+		Hash:     hash,
+		State:    fileExists,
+		written:  true,
+	}
+}
+
 func (ac *accessCache) Slice() []*accessedMakefile {
 	if ac == nil {
 		return nil
@@ -105,7 +147,13 @@ type evalResult struct {
 	ruleVars    map[string]Vars
 	accessedMks []*accessedMakefile
 	exports     map[string]bool
+	exportAll   bool
 	vpaths      searchPaths
+	// missingMakefiles are makefiles of include directives which
+	// don't exist, if they are remade. see remake.go
+	missingMakefiles []missingMakefile
+	// symbols are recorded if SymbolIndexFlag is set.
+	symbols *symbolIndex
 }
 
 type srcpos struct {
@@ -122,12 +170,37 @@ type EvalError struct {
 	Filename string
 	Lineno   int
 	Err      error
+	// Stack is the stack trace of kati's internal error.
+	// It is empty for errors in makefiles.
+	Stack string
 }
 
 func (e EvalError) Error() string {
 	return fmt.Sprintf("%s:%d: %v", e.Filename, e.Lineno, e.Err)
 }
 
+// recoverPanic converts a panic into an EvalError at pos, so users of
+// kati get an error instead of a crash. It must be deferred directly
+// at API boundaries. pos may be nil if location is unknown.
+func recoverPanic(pos *srcpos, errp *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	e := EvalError{
+		Err:   fmt.Errorf("internal error: %v", r),
+		Stack: string(debug.Stack()),
+	}
+	if pos != nil {
+		e.Filename = pos.filename
+		e.Lineno = pos.lineno
+	}
+	glog.Errorf("%v\n%s", e, e.Stack)
+	*errp = e
+}
+
+func (p srcpos) pos() srcpos { return p }
+
 func (p srcpos) errorf(f string, args ...interface{}) error {
 	return EvalError{
 		Filename: p.filename,
@@ -160,19 +233,93 @@ type Evaluator struct {
 	hasIO        bool
 	cache        *accessCache
 	exports      map[string]bool
-	vpaths       []vpath
+	// exportAll is true if "export" is given without variable names.
+	exportAll bool
+	vpaths    []vpath
+	// posix is true in POSIX make compatibility mode. see posix.go
+	posix bool
+	// bsdWarned is variable names warned as BSD make modifiers.
+	// see bsd.go
+	bsdWarned map[string]bool
+	// expanding is recursive variables being expanded, to detect
+	// infinite recursion.
+	expanding []*recursiveVar
+	// expandCache caches expansions of recursive variables.
+	// see expand_cache.go
+	expandCache *expandCache
+
+	// targetVars are target specific variables of the rule whose
+	// commands are being expanded, and inRecipe is true while they
+	// are expanded. Variables assigned by $(eval) in the commands are
+	// global, so targetVars take precedence over them.
+	targetVars Vars
+	inRecipe   bool
+	// writtenFiles are files written by $(file) in commands for
+	// ninja, which are inputs of the build statement. fileContents
+	// are their contents written while ninja files are generated, to
+	// which $(file >>) appends instead of the files, so generating
+	// them again doesn't append again.
+	writtenFiles []string
+	fileContents map[string][]byte
+	// inEnviron is true while exported variables are expanded for
+	// the environment of commands, and cmdlineVarNames are names of
+	// command line variables, which are exported. see env.go
+	inEnviron       bool
+	cmdlineVarNames []string
+	// remake is true if missing makefiles of include directives are
+	// recorded in missingMakefiles to remake them, instead of errors.
+	remake           bool
+	missingMakefiles []missingMakefile
+
+	// parent and isolation are set for an isolated evaluator, which
+	// evaluates an included makefile in parallel.
+	// see parallel_eval.go
+	parent    *Evaluator
+	isolation *isolation
+
+	// ctx cancels evaluation, and sess has caches of the file system.
+	// see session.go
+	ctx  context.Context
+	sess *Session
+	// tid is the thread id of trace events in this evaluation.
+	tid int
+	// prof is the profiler if EvalProfileFlag is set.
+	prof *evalProfiler
+	// symbols are recorded if SymbolIndexFlag is set.
+	symbols *symbolIndex
+	// shells are $(shell) commands running in parallel if ShellJobs
+	// is set. see shellbatch.go
+	shells *shellBatch
+	// recipePrefix is the first byte of recipe lines by .RECIPEPREFIX,
+	// to parse makefiles included or evaluated later.
+	recipePrefix byte
 
 	srcpos
 }
 
 // NewEvaluator creates new Evaluator.
 func NewEvaluator(vars map[string]Var) *Evaluator {
-	return &Evaluator{
+	ev := &Evaluator{
 		outVars:     make(Vars),
 		vars:        vars,
 		outRuleVars: make(map[string]Vars),
 		exports:     make(map[string]bool),
+		ctx:         context.Background(),
+		sess:        DefaultSession,
+		tid:         traceEventMain,
+
+		recipePrefix: '\t',
 	}
+	if UseExpandCache {
+		ev.expandCache = newExpandCache()
+	}
+	if EvalProfileFlag {
+		ev.prof = &evalProfiler{}
+	}
+	if SymbolIndexFlag {
+		ev.symbols = newSymbolIndex()
+	}
+	return ev
 }
 
 func (ev *Evaluator) args(buf *evalBuffer, args ...Value) ([][]byte, error) {
@@ -207,32 +354,107 @@ func (ev *Evaluator) evalAssign(ast *assignAST) error {
 	if lhs == "" {
 		return ast.errorf("*** empty variable name.")
 	}
+	ev.symbols.assign(lhs, ast.op, "", ast.srcpos)
+	if ev.overridden(lhs, rhs) {
+		glog.V(1).Infof("ASSIGN: %s is overridden", lhs)
+		prev := ev.LookupVar(lhs)
+		return ev.traceVar(lhs, "%s %s %s ignored: overridden by %s %q", lhs, ast.op, ast.rhs, prev.Origin(), prev.String())
+	}
+	if err := ev.traceAssign("", lhs, ast.opt, ast.op, ast.rhs, rhs); err != nil {
+		return err
+	}
+	if err := ev.checkOverride(lhs, rhs); err != nil {
+		return err
+	}
+	if lhs == ".RECIPEPREFIX" {
+		if err := ev.checkIsolated("assignment to %s", lhs); err != nil {
+			return err
+		}
+		ev.recipePrefix = recipePrefixOf(rhs)
+	}
 	ev.outVars.Assign(lhs, rhs)
 	return nil
 }
 
+// recipePrefixOf returns the recipe prefix by the value of
+// .RECIPEPREFIX, i.e. its first byte, which is not expanded for a
+// recursive variable, or a tab if it is empty.
+func recipePrefixOf(v Var) byte {
+	s := v.String()
+	if s == "" {
+		return '\t'
+	}
+	return s[0]
+}
+
+// evalStmts evaluates statements of mk, parsed from a file. If the
+// recipe prefix differs from one the parser assumed, e.g. it is changed
+// by an included makefile, the rest of mk is parsed again with it.
+func (ev *Evaluator) evalStmts(mk makefile) error {
+	stmts := mk.stmts
+	for i := 0; i < len(stmts); i++ {
+		stmt := stmts[i]
+		// statements of the bootstrap makefile are prepended to
+		// the root makefile.
+		pos := stmt.pos()
+		if mk.src != nil && pos.filename == mk.filename && mk.recipePrefixAt(pos.lineno) != ev.recipePrefix {
+			glog.V(1).Infof("%s: parse again with recipe prefix %q", pos, ev.recipePrefix)
+			rest, err := mk.reparseFrom(stmts, i, ev.recipePrefix)
+			if err != nil {
+				return err
+			}
+			mk, stmts, i = rest, rest.stmts, -1
+			continue
+		}
+		err := ev.eval(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overridden reports whether v can't be assigned to the global variable
+// name, because the variable given to the root evaluator, e.g. on the
+// command line, has higher precedence. Variables assigned in makefiles
+// are checked by Vars.Assign.
+func (ev *Evaluator) overridden(name string, v Var) bool {
+	root := ev
+	for root.parent != nil {
+		root = root.parent
+	}
+	// root.vars is not modified while evaluating makefiles, so it
+	// is safe to read it from isolated evaluators.
+	prev, ok := root.vars[name]
+	return ok && originPrecedence[prev.Origin()] > originPrecedence[v.Origin()]
+}
+
 func (ev *Evaluator) evalAssignAST(ast *assignAST) (string, Var, error) {
 	ev.srcpos = ast.srcpos
 
 	var lhs string
 	switch v := ast.lhs.(type) {
 	case literal:
-		lhs = string(v)
+		lhs = intern(string(v))
 	case tmpval:
-		lhs = string(v)
+		lhs = internBytes(v)
 	default:
 		buf := newEbuf()
 		err := v.Eval(buf, ev)
 		if err != nil {
 			return "", nil, err
 		}
-		lhs = string(trimSpaceBytes(buf.Bytes()))
+		lhs = internBytes(trimSpaceBytes(buf.Bytes()))
 		buf.release()
 	}
 	rhs, err := ast.evalRHS(ev, lhs)
 	if err != nil {
 		return "", nil, err
 	}
+	err = ev.lintAssign(ast, lhs, rhs)
+	if err != nil {
+		return "", nil, err
+	}
 	return lhs, rhs, nil
 }
 
@@ -247,10 +469,14 @@ func (ev *Evaluator) setTargetSpecificVar(assign *assignAST, output string) erro
 	if err != nil {
 		return err
 	}
+	ev.symbols.assign(lhs, assign.op, output, assign.srcpos)
+	if err := ev.traceAssign(output, lhs, assign.opt, assign.op, assign.rhs, rhs); err != nil {
+		return err
+	}
 	if glog.V(1) {
 		glog.Infof("rule outputs:%q assign:%q%s%q (flavor:%q)", output, lhs, assign.op, rhs, rhs.Flavor())
 	}
-	vars.Assign(lhs, &targetSpecificVar{v: rhs, op: assign.op})
+	vars.Assign(lhs, &targetSpecificVar{v: rhs, op: assign.op, export: assign.opt == "export"})
 	ev.currentScope = nil
 	return nil
 }
@@ -258,6 +484,7 @@ func (ev *Evaluator) setTargetSpecificVar(assign *assignAST, output string) erro
 func (ev *Evaluator) evalMaybeRule(ast *maybeRuleAST) error {
 	ev.lastRule = nil
 	ev.srcpos = ast.srcpos
+	defer ev.profEnd(ev.profBegin(ProfileRule, ast.srcpos.String()))
 
 	if glog.V(1) {
 		glog.Infof("maybe rule %s: %q assign:%v", ev.srcpos, ast.expr, ast.assign)
@@ -312,16 +539,34 @@ func (ev *Evaluator) evalMaybeRule(ast *maybeRuleAST) error {
 		ws := newWordScanner(line)
 		if ws.Scan() {
 			if string(ws.Bytes()) == "override" {
-				warnNoPrefix(ast.srcpos, "invalid `override' directive")
+				switch DiagLevels[DiagInvalidOverride] {
+				case DiagLevelOff:
+					return nil
+				case DiagLevelError:
+					return ast.errorf("*** invalid `override' directive.")
+				}
+				if err := ev.checkIsolated("invalid override"); err != nil {
+					return err
+				}
+				warnNoPrefix(ast.srcpos, 0, DiagInvalidOverride, "invalid `override' directive")
 				return nil
 			}
 		}
 		return ast.error(err)
 	}
 	abuf.release()
+	ev.globInputs(r)
 	if glog.V(1) {
 		glog.Infof("rule %q assign:%v rhs:%v=> outputs:%q, inputs:%q", ast.expr, ast.assign, rhs, r.outputs, r.inputs)
 	}
+	err = ev.lintOutputs(r.outputs)
+	if err != nil {
+		return err
+	}
+	if ev.inRecipe && r.outputs != nil && assign == nil {
+		// rules are already built when commands are expanded.
+		return ast.errorf("*** prerequisites cannot be defined in recipes.")
+	}
 
 	// TODO: Pretty print.
 	// glog.V(1).Infof("RULE: %s=%s (%d commands)", lhs, rhs, len(cmds))
@@ -329,16 +574,22 @@ func (ev *Evaluator) evalMaybeRule(ast *maybeRuleAST) error {
 	if assign != nil {
 		glog.V(1).Infof("target specific var: %#v", assign)
 		for _, output := range r.outputs {
-			ev.setTargetSpecificVar(assign, output)
+			err = ev.setTargetSpecificVar(assign, output)
+			if err != nil {
+				return err
+			}
 		}
 		for _, output := range r.outputPatterns {
-			ev.setTargetSpecificVar(assign, output.String())
+			err = ev.setTargetSpecificVar(assign, output.String())
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	}
 
 	if semi != nil {
-		r.cmds = append(r.cmds, string(semi))
+		r.cmds = append(r.cmds, internBytes(semi))
 	}
 	if glog.V(1) {
 		glog.Infof("rule outputs:%q cmds:%q", r.outputs, r.cmds)
@@ -359,7 +610,7 @@ func (ev *Evaluator) evalCommand(ast *commandAST) error {
 			if err != nil {
 				return ast.errorf("parse failed: %q: %v", line, err)
 			}
-			if len(mk.stmts) >= 1 && mk.stmts[len(mk.stmts)-1].(*assignAST) != nil {
+			if _, ok := mk.lastStmt().(*assignAST); ok {
 				for _, stmt := range mk.stmts {
 					err = ev.eval(stmt)
 					if err != nil {
@@ -369,8 +620,8 @@ func (ev *Evaluator) evalCommand(ast *commandAST) error {
 			}
 			return nil
 		}
-		// Or, a comment is OK.
-		if strings.TrimSpace(ast.cmd)[0] == '#' {
+		// Or, a comment or an empty line is OK.
+		if cmd := strings.TrimSpace(ast.cmd); cmd == "" || cmd[0] == '#' {
 			return nil
 		}
 		return ast.errorf("*** commands commence before first target.")
@@ -384,17 +635,71 @@ func (ev *Evaluator) evalCommand(ast *commandAST) error {
 
 // LookupVar looks up named variable.
 func (ev *Evaluator) LookupVar(name string) Var {
+	v := ev.lookupVar(name)
+	ev.expandCache.track(name, v)
+	return v
+}
+
+// lookupVar looks up named variable without tracking it for the
+// expansion cache.
+func (ev *Evaluator) lookupVar(name string) Var {
+	if ev.shells != nil {
+		ev.shells.join(name)
+	}
 	if ev.currentScope != nil {
 		v := ev.currentScope.Lookup(name)
 		if v.IsDefined() {
 			return v
 		}
 	}
+	if ev.targetVars != nil {
+		v := ev.targetVars.Lookup(name)
+		if v.IsDefined() {
+			return v
+		}
+	}
 	v := ev.outVars.Lookup(name)
 	if v.IsDefined() {
+		if ev.isolation != nil && name == "MAKEFILE_LIST" {
+			// the value depends on makefiles included before.
+			ev.isolation.read(name, ev.parent.lookupVar(name))
+		}
 		return v
 	}
-	return ev.vars.Lookup(name)
+	if ev.parent != nil {
+		if ev.isolation != nil && name == ".VARIABLES" {
+			// the value depends on variables the child defined.
+			ev.isolation.violate(ev.srcpos, "reads %s", name)
+		}
+		return ev.lookupParentVar(name)
+	}
+	v = ev.vars.Lookup(name)
+	if !v.IsDefined() {
+		if name == ".VARIABLES" {
+			return ev.variablesVar()
+		}
+		ev.fingerprintUndefined(name)
+	}
+	return v
+}
+
+// variablesVar returns the value of .VARIABLES, names of all global
+// variables defined so far, in sorted order.
+func (ev *Evaluator) variablesVar() Var {
+	seen := map[string]bool{".VARIABLES": true}
+	for _, vars := range []Vars{ev.vars, ev.outVars} {
+		for name, v := range vars {
+			if v.IsDefined() {
+				seen[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &simpleVar{value: names, origin: "default"}
 }
 
 func (ev *Evaluator) lookupVarInCurrentScope(name string) Var {
@@ -402,11 +707,7 @@ func (ev *Evaluator) lookupVarInCurrentScope(name string) Var {
 		v := ev.currentScope.Lookup(name)
 		return v
 	}
-	v := ev.outVars.Lookup(name)
-	if v.IsDefined() {
-		return v
-	}
-	return ev.vars.Lookup(name)
+	return ev.LookupVar(name)
 }
 
 // EvaluateVar evaluates variable named name.
@@ -422,11 +723,45 @@ func (ev *Evaluator) EvaluateVar(name string) (string, error) {
 	return buf.String(), nil
 }
 
+// evalVar expands variable v named name into w.
+func (ev *Evaluator) evalVar(w evalWriter, name string, v Var) error {
+	ev.symbols.ref(name, ev.srcpos)
+	if TraceVars[name] {
+		return ev.traceExpand(w, name, v)
+	}
+	return ev.expandVar(w, name, v)
+}
+
+func (ev *Evaluator) expandVar(w evalWriter, name string, v Var) error {
+	rv, ok := v.(*recursiveVar)
+	if !ok {
+		if !v.IsDefined() && strings.IndexByte(name, ':') >= 0 {
+			ev.checkBSDModifier(name)
+		}
+		return v.Eval(w, ev)
+	}
+	for _, e := range ev.expanding {
+		if e == rv {
+			return ev.errorf("*** Recursive variable `%s' references itself (eventually).", name)
+		}
+	}
+	ev.expanding = append(ev.expanding, rv)
+	var err error
+	if ev.expandCache != nil {
+		err = ev.expandCache.eval(w, ev, rv)
+	} else {
+		err = rv.Eval(w, ev)
+	}
+	ev.expanding = ev.expanding[:len(ev.expanding)-1]
+	return err
+}
+
 func (ev *Evaluator) evalIncludeFile(fname string, mk makefile) error {
-	te := traceEvent.begin("include", literal(fname), traceEventMain)
+	te := traceEvent.begin("include", literal(fname), ev.tid)
 	defer func() {
 		traceEvent.end(te)
 	}()
+	defer ev.profEnd(ev.profBegin(ProfileMakefile, fname))
 	var err error
 	makefileList := ev.outVars.Lookup("MAKEFILE_LIST")
 	makefileList, err = makefileList.Append(ev, mk.filename)
@@ -434,14 +769,7 @@ func (ev *Evaluator) evalIncludeFile(fname string, mk makefile) error {
 		return err
 	}
 	ev.outVars.Assign("MAKEFILE_LIST", makefileList)
-
-	for _, stmt := range mk.stmts {
-		err = ev.eval(stmt)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return ev.evalStmts(mk)
 }
 
 func (ev *Evaluator) evalInclude(ast *includeAST) error {
@@ -469,33 +797,33 @@ func (ev *Evaluator) evalInclude(ast *includeAST) error {
 			if err != nil {
 				return ast.errorf("glob error: %s: %v", pat, err)
 			}
+			msg := ev.cache.fingerprint(&accessedMakefile{
+				Filename: pat,
+				Hash:     globHash(matched),
+				State:    fileGlob,
+			})
+			if msg != "" {
+				warn(ev.srcpos, DiagMakefileChanged, "%s", msg)
+			}
 			files = append(files, matched...)
 		} else {
 			files = append(files, pat)
 		}
 	}
 
+	var fns []string
 	for _, fn := range files {
 		fn = trimLeadingCurdir(fn)
 		if IgnoreOptionalInclude != "" && ast.op == "-include" && matchPattern(fn, IgnoreOptionalInclude) {
 			continue
 		}
-		mk, hash, err := makefileCache.parse(fn)
-		if os.IsNotExist(err) {
-			if ast.op == "include" {
-				return ev.errorf("%v\nNOTE: kati does not support generating missing makefiles", err)
-			}
-			msg := ev.cache.update(fn, hash, fileNotExists)
-			if msg != "" {
-				warn(ev.srcpos, "%s", msg)
-			}
-			continue
-		}
-		msg := ev.cache.update(fn, hash, fileExists)
-		if msg != "" {
-			warn(ev.srcpos, "%s", msg)
-		}
-		err = ev.evalIncludeFile(fn, mk)
+		fns = append(fns, fn)
+	}
+	if ev.canEvalIncludesInParallel(fns) {
+		return ev.evalIncludesParallel(ast, fns)
+	}
+	for _, fn := range fns {
+		err := ev.includeFile(ast, fn)
 		if err != nil {
 			return err
 		}
@@ -503,6 +831,34 @@ func (ev *Evaluator) evalInclude(ast *includeAST) error {
 	return nil
 }
 
+func (ev *Evaluator) includeFile(ast *includeAST, fn string) error {
+	if err := ev.readingMakefile(ast, fn); err != nil {
+		return err
+	}
+	mk, hash, err := makefileCache.parse(fn, ev.recipePrefix, ev.tid)
+	if os.IsNotExist(err) {
+		if ev.remake {
+			ev.missingMakefiles = append(ev.missingMakefiles, missingMakefile{
+				filename: fn,
+				pos:      ev.srcpos,
+				optional: ast.op == "-include",
+			})
+		} else if ast.op == "include" {
+			return ev.errorf("%v\nNOTE: kati does not support generating missing makefiles", err)
+		}
+		msg := ev.cache.update(fn, hash, fileNotExists)
+		if msg != "" {
+			warn(ev.srcpos, DiagMakefileChanged, "%s", msg)
+		}
+		return nil
+	}
+	msg := ev.cache.update(fn, hash, fileExists)
+	if msg != "" {
+		warn(ev.srcpos, DiagMakefileChanged, "%s", msg)
+	}
+	return ev.evalIncludeFile(fn, mk)
+}
+
 func (ev *Evaluator) evalIf(iast *ifAST) error {
 	var isTrue bool
 	switch iast.op {
@@ -563,6 +919,9 @@ func (ev *Evaluator) evalIf(iast *ifAST) error {
 func (ev *Evaluator) evalExport(ast *exportAST) error {
 	ev.lastRule = nil
 	ev.srcpos = ast.srcpos
+	if err := ev.checkIsolated("export"); err != nil {
+		return err
+	}
 
 	v, _, err := parseExpr(ast.expr, nil, parseOp{})
 	if err != nil {
@@ -577,7 +936,12 @@ func (ev *Evaluator) evalExport(ast *exportAST) error {
 	if ast.hasEqual {
 		ev.exports[string(trimSpaceBytes(buf.Bytes()))] = ast.export
 	} else {
-		for _, n := range splitSpacesBytes(buf.Bytes()) {
+		names := splitSpacesBytes(buf.Bytes())
+		if len(names) == 0 {
+			// "export" or "unexport" alone.
+			ev.exportAll = ast.export
+		}
+		for _, n := range names {
 			ev.exports[string(n)] = ast.export
 		}
 	}
@@ -587,6 +951,9 @@ func (ev *Evaluator) evalExport(ast *exportAST) error {
 func (ev *Evaluator) evalVpath(ast *vpathAST) error {
 	ev.lastRule = nil
 	ev.srcpos = ast.srcpos
+	if err := ev.checkIsolated("vpath"); err != nil {
+		return err
+	}
 
 	var ebuf evalBuffer
 	ebuf.resetSep()
@@ -631,12 +998,75 @@ func (ev *Evaluator) evalVpath(ast *vpathAST) error {
 	return nil
 }
 
+// globInputs expands wildcards in prerequisites of r, as GNU make does.
+// A pattern which matches nothing is kept as is.
+func (ev *Evaluator) globInputs(r *rule) {
+	r.inputs = ev.globWords(r.inputs)
+	r.orderOnlyInputs = ev.globWords(r.orderOnlyInputs)
+}
+
+func (ev *Evaluator) globWords(words []string) []string {
+	var r []string
+	globbed := false
+	for i, w := range words {
+		if !hasWildcardMeta(w) {
+			if globbed {
+				r = append(r, w)
+			}
+			continue
+		}
+		if !globbed {
+			r = append([]string(nil), words[:i]...)
+			globbed = true
+		}
+		m, _ := ev.sess.wildcardCache.Glob(w)
+		if len(m) == 0 {
+			r = append(r, w)
+			continue
+		}
+		for _, t := range m {
+			r = append(r, intern(t))
+		}
+	}
+	if !globbed {
+		return words
+	}
+	return r
+}
+
 func (ev *Evaluator) eval(stmt ast) error {
+	if err := ev.ctx.Err(); err != nil {
+		return err
+	}
+	if ev.posix && stmt.pos().filename != bootstrapMakefileName {
+		err := ev.checkPosix(stmt)
+		if err != nil {
+			return err
+		}
+	}
 	return stmt.eval(ev)
 }
 
 func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
+	return evalRemake(context.Background(), DefaultSession, traceEventMain, mk, vars, useCache, false)
+}
+
+// evalRemake evaluates mk as eval in sess, with trace events in the
+// thread tid. If remake is true, missing makefiles of include
+// directives are recorded in the result to remake them.
+func evalRemake(ctx context.Context, sess *Session, tid int, mk makefile, vars Vars, useCache, remake bool) (er *evalResult, err error) {
 	ev := NewEvaluator(vars)
+	ev.ctx = ctx
+	ev.sess = sess
+	ev.tid = tid
+	if ShellJobs > 1 {
+		ev.shells = newShellBatch(ShellJobs, tid)
+	}
+	te := traceEvent.begin("eval", literal(mk.filename), tid)
+	defer traceEvent.end(te)
+	defer ev.profEnd(ev.profBegin(ProfileMakefile, mk.filename))
+	ev.remake = remake
+	defer recoverPanic(&ev.srcpos, &err)
 	if useCache {
 		ev.cache = newAccessCache()
 	}
@@ -650,16 +1080,26 @@ func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
 		return nil, err
 	}
 	ev.outVars.Assign("MAKEFILE_LIST", makefileList)
+	ev.posix = PosixMode || isPosixMakefile(mk)
+	if ev.posix && !vars.Lookup(".SHELLFLAGS").IsDefined() {
+		ev.outVars.Assign(".SHELLFLAGS", &simpleVar{value: []string{posixShellFlags}, origin: "default"})
+	}
 
-	for _, stmt := range mk.stmts {
-		err = ev.eval(stmt)
-		if err != nil {
-			return nil, err
-		}
+	if v := vars.Lookup(".RECIPEPREFIX"); v.IsDefined() {
+		ev.recipePrefix = recipePrefixOf(v)
+	}
+	err = ev.evalStmts(mk)
+	if err != nil {
+		return nil, err
+	}
+	err = ev.joinShells()
+	if err != nil {
+		return nil, err
 	}
 
 	vpaths := searchPaths{
 		vpaths: ev.vpaths,
+		sess:   sess,
 	}
 	v, found := ev.outVars["VPATH"]
 	if found {
@@ -677,13 +1117,21 @@ func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
 		}
 	}
 	glog.Infof("vpaths: %#v", vpaths)
+	if c := ev.expandCache; c != nil {
+		logStats("expand cache: hits=%d misses=%d entries=%d", c.hits, c.misses, len(c.entries))
+	}
 
+	ev.symbols.addRules(ev.outRules)
 	return &evalResult{
 		vars:        ev.outVars,
 		rules:       ev.outRules,
 		ruleVars:    ev.outRuleVars,
 		accessedMks: ev.cache.Slice(),
 		exports:     ev.exports,
+		exportAll:   ev.exportAll,
 		vpaths:      vpaths,
+
+		missingMakefiles: ev.missingMakefiles,
+		symbols:          ev.symbols,
 	}, nil
 }
@@ -15,8 +15,10 @@
 package kati
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"os/exec"
+	"os"
 	"strings"
 	"sync"
 
@@ -24,18 +26,27 @@ import (
 )
 
 type execContext struct {
-	shell string
-
-	mu     sync.Mutex
-	ev     *Evaluator
-	vpaths searchPaths
-	output string
-	inputs []string
+	shell      string
+	shellFlags string
+
+	mu         sync.Mutex
+	ev         *Evaluator
+	vpaths     searchPaths
+	output     string
+	inputs     []string
+	orderOnlys []string
+	stem       string
+
+	jobserver     *jobserver
+	outputSync    *outputSyncer
+	debug         DebugFlags
+	commandRunner CommandRunner
 }
 
 func newExecContext(vars Vars, vpaths searchPaths, avoidIO bool) *execContext {
 	ev := NewEvaluator(vars)
 	ev.avoidIO = avoidIO
+	ev.sess = vpaths.session()
 
 	ctx := &execContext{
 		ev:     ev,
@@ -44,6 +55,7 @@ func newExecContext(vars Vars, vpaths searchPaths, avoidIO bool) *execContext {
 	av := autoVar{ctx: ctx}
 	for k, v := range map[string]Var{
 		"@": autoAtVar{autoVar: av},
+		"%": autoPercentVar{autoVar: av},
 		"<": autoLessVar{autoVar: av},
 		"^": autoHatVar{autoVar: av},
 		"+": autoPlusVar{autoVar: av},
@@ -55,15 +67,24 @@ func newExecContext(vars Vars, vpaths searchPaths, avoidIO bool) *execContext {
 		// $<k>F = $(notdir $<k>)
 		ev.vars[k+"F"] = suffixFVar(k)
 	}
+	ev.vars["|"] = autoBarVar{autoVar: av}
+
+	ctx.shell, ctx.shellFlags = commandShell(ev)
+	return ctx
+}
 
-	// TODO: We should move this to somewhere around evalCmd so that
-	// we can handle SHELL in target specific variables.
+// commandShell returns the shell to run commands and its flags, i.e.
+// $(SHELL) and $(.SHELLFLAGS), or their defaults if they are empty.
+func commandShell(ev *Evaluator) (shell, flags string) {
 	shell, err := ev.EvaluateVar("SHELL")
-	if err != nil {
-		shell = "/bin/sh"
+	if err != nil || shell == "" {
+		shell = defaultShell()
 	}
-	ctx.shell = shell
-	return ctx
+	flags, err = ev.EvaluateVar(".SHELLFLAGS")
+	if err != nil || flags == "" {
+		flags = shellFlag(shell)
+	}
+	return shell, flags
 }
 
 func (ec *execContext) uniqueInputs() []string {
@@ -78,11 +99,25 @@ func (ec *execContext) uniqueInputs() []string {
 	return uniqueInputs
 }
 
+// memberNames returns names with archive member references replaced
+// by their members, as $^, $+ and $| expand to.
+func memberNames(names []string) []string {
+	r := make([]string, len(names))
+	for i, name := range names {
+		r[i] = archiveMemberName(name)
+	}
+	return r
+}
+
 type autoVar struct{ ctx *execContext }
 
 func (v autoVar) Flavor() string  { return "undefined" }
 func (v autoVar) Origin() string  { return "automatic" }
 func (v autoVar) IsDefined() bool { return true }
+
+// volatile marks autoVar as volatileVar; its value depends on the
+// current target.
+func (v autoVar) volatile() {}
 func (v autoVar) Append(*Evaluator, string) (Var, error) {
 	return nil, fmt.Errorf("cannot append to autovar")
 }
@@ -102,7 +137,27 @@ func (v autoAtVar) Eval(w evalWriter, ev *Evaluator) error {
 	fmt.Fprint(w, v.String())
 	return nil
 }
-func (v autoAtVar) String() string { return v.ctx.output }
+
+// String returns the output, or the archive of an archive member.
+func (v autoAtVar) String() string {
+	if archive, _, ok := splitArchiveMember(v.ctx.output); ok {
+		return archive
+	}
+	return v.ctx.output
+}
+
+type autoPercentVar struct{ autoVar }
+
+func (v autoPercentVar) Eval(w evalWriter, ev *Evaluator) error {
+	fmt.Fprint(w, v.String())
+	return nil
+}
+
+// String returns the member of an archive member output, or "".
+func (v autoPercentVar) String() string {
+	_, member, _ := splitArchiveMember(v.ctx.output)
+	return member
+}
 
 type autoLessVar struct{ autoVar }
 
@@ -124,7 +179,7 @@ func (v autoHatVar) Eval(w evalWriter, ev *Evaluator) error {
 	return nil
 }
 func (v autoHatVar) String() string {
-	return strings.Join(v.ctx.uniqueInputs(), " ")
+	return strings.Join(memberNames(v.ctx.uniqueInputs()), " ")
 }
 
 type autoPlusVar struct{ autoVar }
@@ -133,7 +188,19 @@ func (v autoPlusVar) Eval(w evalWriter, ev *Evaluator) error {
 	fmt.Fprint(w, v.String())
 	return nil
 }
-func (v autoPlusVar) String() string { return strings.Join(v.ctx.inputs, " ") }
+func (v autoPlusVar) String() string {
+	return strings.Join(memberNames(v.ctx.inputs), " ")
+}
+
+type autoBarVar struct{ autoVar }
+
+func (v autoBarVar) Eval(w evalWriter, ev *Evaluator) error {
+	fmt.Fprint(w, v.String())
+	return nil
+}
+func (v autoBarVar) String() string {
+	return strings.Join(memberNames(v.ctx.orderOnlys), " ")
+}
 
 type autoStarVar struct{ autoVar }
 
@@ -142,8 +209,14 @@ func (v autoStarVar) Eval(w evalWriter, ev *Evaluator) error {
 	return nil
 }
 
-// TODO: Use currentStem. See auto_stem_var.mk
-func (v autoStarVar) String() string { return stripExt(v.ctx.output) }
+// TODO: Use the suffix in .SUFFIXES for explicit rules. See
+// auto_stem_var.mk
+func (v autoStarVar) String() string {
+	if v.ctx.stem != "" {
+		return v.ctx.stem
+	}
+	return stripExt(archiveMemberName(v.ctx.output))
+}
 
 func suffixDVar(k string) Var {
 	return &recursiveVar{
@@ -194,7 +267,29 @@ type runner struct {
 	cmd         string
 	echo        bool
 	ignoreError bool
-	shell       string
+	// force is true if the command runs even with DryRunFlag, i.e.
+	// it is prefixed with '+' or refers to $(MAKE).
+	force      bool
+	shell      string
+	shellFlags string
+	jobserver  *jobserver
+	// env is the environment of the command, or nil to use
+	// os.Environ().
+	env []string
+	// makeflags is MAKEFLAGS for the command, before options for
+	// recursive makes are added.
+	makeflags string
+	// oneShell is true if cmd is a script of all lines of commands
+	// by .ONESHELL.
+	oneShell bool
+	// debugJobs prints child processes by DebugJobs.
+	debugJobs bool
+	// inputs and outputs are files of the command for
+	// commandRunner.
+	inputs  []string
+	outputs []string
+	// commandRunner runs the command, or nil for LocalCommandRunner.
+	commandRunner CommandRunner
 }
 
 func (r runner) String() string {
@@ -205,6 +300,9 @@ func (r runner) String() string {
 	if r.ignoreError {
 		cmd = "-" + cmd
 	}
+	if r.force {
+		cmd = "+" + cmd
+	}
 	return cmd
 }
 
@@ -225,6 +323,10 @@ func (r runner) forCmd(s string) runner {
 			r.ignoreError = true
 			s = s[1:]
 			continue
+		case '+':
+			r.force = true
+			s = s[1:]
+			continue
 		}
 		break
 	}
@@ -234,6 +336,9 @@ func (r runner) forCmd(s string) runner {
 
 func (r runner) eval(ev *Evaluator, s string) ([]runner, error) {
 	r = r.forCmd(s)
+	if isRecursiveMake(r.cmd) {
+		r.force = true
+	}
 	if strings.IndexByte(r.cmd, '$') < 0 {
 		// fast path
 		return []runner{r}, nil
@@ -263,30 +368,157 @@ func (r runner) eval(ev *Evaluator, s string) ([]runner, error) {
 	return runners, nil
 }
 
-func (r runner) run(output string) error {
-	if r.echo || DryRunFlag {
-		fmt.Printf("%s\n", r.cmd)
+// evalOneShell expands cmds into a runner of a single script, for
+// .ONESHELL. Only prefixes of the first line are honored. Prefixes of
+// other lines are removed, as GNU make does for POSIX shells.
+func (r runner) evalOneShell(ev *Evaluator, cmds []string) (runner, error) {
+	lines := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		if isRecursiveMake(cmd) {
+			r.force = true
+		}
+		if strings.IndexByte(cmd, '$') < 0 {
+			lines = append(lines, cmd)
+			continue
+		}
+		expr, _, err := parseExpr([]byte(cmd), nil, parseOp{})
+		if err != nil {
+			return runner{}, ev.errorf("parse cmd %q: %v", cmd, err)
+		}
+		buf := newEbuf()
+		err = expr.Eval(buf, ev)
+		if err != nil {
+			return runner{}, err
+		}
+		lines = append(lines, buf.String())
+		buf.release()
+	}
+	r = r.forCmd(strings.Join(lines, "\n"))
+	r.cmd = stripOneShellPrefixes(r.cmd)
+	r.oneShell = true
+	glog.V(1).Infof("evalcmd oneshell: %q => %q", cmds, r.cmd)
+	return r, nil
+}
+
+// stripOneShellPrefixes removes blanks and prefixes '@', '-' and '+'
+// at the beginning of each line of script, except lines continued by
+// backslash newline.
+func stripOneShellPrefixes(script string) string {
+	var buf bytes.Buffer
+	start := true
+	escape := false
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		if start {
+			if c == ' ' || c == '\t' || c == '@' || c == '-' || c == '+' {
+				continue
+			}
+			start = false
+		}
+		buf.WriteByte(c)
+		switch {
+		case c == '\\':
+			escape = !escape
+		case c == '\n' && !escape:
+			start = true
+		default:
+			escape = false
+		}
+	}
+	return buf.String()
+}
+
+// isRecursiveMake reports whether cmd, before expansion, runs make
+// recursively by $(MAKE) or ${MAKE}.
+func isRecursiveMake(cmd string) bool {
+	return strings.Contains(cmd, "$(MAKE)") || strings.Contains(cmd, "${MAKE}")
+}
+
+func (r runner) run(output string, w *jobOutput) error {
+	// buf holds the command line with its output, so they are
+	// written at once.
+	var buf bytes.Buffer
+	defer func() { w.Write(buf.Bytes()) }()
+	// --trace prints silent commands too.
+	if r.echo || DryRunFlag || TraceFlag {
+		fmt.Fprintf(&buf, "%s\n", r.cmd)
 	}
 	s := cmdline(r.cmd)
 	glog.Infof("sh:%q", s)
-	if DryRunFlag {
+	if DryRunFlag && !r.force {
 		return nil
 	}
-	args := []string{r.shell, "-c", s}
-	cmd := exec.Cmd{
-		Path: args[0],
-		Args: args,
+	c := &Command{
+		Target:     output,
+		Shell:      r.shell,
+		ShellFlags: r.shellFlags,
+		Script:     s,
+		Env:        r.env,
+		Inputs:     r.inputs,
+		Outputs:    r.outputs,
+		debugJobs:  r.debugJobs,
+	}
+	makeflags := r.makeflags
+	if c := noExecMakeflag(); c != 0 {
+		// recursive makes don't run commands either.
+		makeflags = addMakeflag(makeflags, c)
+	}
+	if KeepGoingFlag {
+		makeflags = addMakeflag(makeflags, 'k')
+	} else {
+		makeflags = removeMakeflag(makeflags, 'k')
+	}
+	makeflags = r.jobserver.makeflags(makeflags, r.force)
+	makeflags = w.s.makeflags(makeflags, r.force)
+	mf := mflags(makeflags)
+	if r.env != nil || makeflags != os.Getenv("MAKEFLAGS") || mf != os.Getenv("MFLAGS") {
+		env := r.env
+		if env == nil {
+			env = os.Environ()
+		}
+		c.Env = append(env[:len(env):len(env)], "MAKEFLAGS="+makeflags, "MFLAGS="+mf)
+	}
+	c.extraFiles = r.jobserver.extraFiles(r.force)
+	if w.s.streams(r.force) {
+		// recursive makes sync their own output.
+		w.Write(buf.Bytes())
+		buf.Reset()
+		c.Stdout = w.stdout()
+	} else {
+		c.Stdout = &buf
+	}
+	c.Stderr = c.Stdout
+	cr := r.commandRunner
+	if cr == nil || r.force {
+		cr = LocalCommandRunner{}
 	}
-	out, err := cmd.CombinedOutput()
-	fmt.Printf("%s", out)
+	err := cr.RunCommand(context.Background(), c)
 	exit := exitStatus(err)
 	if r.ignoreError && exit != 0 {
-		fmt.Printf("[%s] Error %d (ignored)\n", output, exit)
+		fmt.Fprintf(&buf, "[%s] Error %d (ignored)\n", output, exit)
 		err = nil
 	}
 	return err
 }
 
+// commandMakeflags returns MAKEFLAGS for commands, i.e. MAKEFLAGS
+// joined with MAKEOVERRIDES. It is the one in the environment if the
+// graph has no MAKEFLAGS, e.g. it is loaded from an old cache.
+func commandMakeflags(ev *Evaluator) (string, error) {
+	if !ev.LookupVar("MAKEFLAGS").IsDefined() {
+		return os.Getenv("MAKEFLAGS"), nil
+	}
+	flags, err := ev.EvaluateVar("MAKEFLAGS")
+	if err != nil {
+		return "", err
+	}
+	overrides, err := ev.EvaluateVar("MAKEOVERRIDES")
+	if err != nil {
+		return "", err
+	}
+	return joinMakeflags(flags, overrides), nil
+}
+
 func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 	var runners []runner
 	if len(n.Cmds) == 0 {
@@ -298,11 +530,19 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 	// For automatic variables.
 	ctx.output = n.Output
 	ctx.inputs = n.ActualInputs
-	for k, v := range n.TargetSpecificVars {
-		restore := ctx.ev.vars.save(k)
-		defer restore()
-		ctx.ev.vars[k] = v
-		if glog.V(1) {
+	ctx.stem = n.Stem
+	ctx.orderOnlys = nil
+	for _, d := range n.OrderOnlys {
+		ctx.orderOnlys = append(ctx.orderOnlys, d.Output)
+	}
+	ctx.ev.targetVars = n.TargetSpecificVars
+	ctx.ev.inRecipe = true
+	defer func() {
+		ctx.ev.targetVars = nil
+		ctx.ev.inRecipe = false
+	}()
+	if glog.V(1) {
+		for k, v := range n.TargetSpecificVars {
 			glog.Infof("set tsv: %s=%s", k, v)
 		}
 	}
@@ -311,9 +551,46 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 	ctx.ev.lineno = n.Lineno
 	glog.Infof("Building: %s cmds:%q", n.Output, n.Cmds)
 	r := runner{
-		output: n.Output,
-		echo:   true,
-		shell:  ctx.shell,
+		output:     n.Output,
+		echo:       true,
+		shell:      ctx.shell,
+		shellFlags: ctx.shellFlags,
+		jobserver:  ctx.jobserver,
+		debugJobs:  ctx.debug&DebugJobs != 0,
+	}
+	if ctx.commandRunner != nil {
+		r.commandRunner = ctx.commandRunner
+		r.inputs = append(ctx.uniqueInputs(), ctx.orderOnlys...)
+		r.outputs = n.GroupOutputs
+		if len(r.outputs) == 0 {
+			r.outputs = []string{n.Output}
+		}
+	}
+	_, tshell := n.TargetSpecificVars["SHELL"]
+	_, tflags := n.TargetSpecificVars[".SHELLFLAGS"]
+	if tshell || tflags {
+		r.shell, r.shellFlags = commandShell(ctx.ev)
+	}
+	if !ctx.ev.avoidIO {
+		env, err := ctx.ev.environ()
+		if err != nil {
+			return nil, false, err
+		}
+		r.env = env
+		r.makeflags, err = commandMakeflags(ctx.ev)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if n.OneShell && !isCmdShell(r.shell) {
+		r, err := r.evalOneShell(ctx.ev, n.Cmds)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(r.cmd) != 0 {
+			runners = append(runners, r)
+		}
+		return runners, ctx.ev.hasIO, nil
 	}
 	for _, cmd := range n.Cmds {
 		rr, err := r.eval(ctx.ev, cmd)
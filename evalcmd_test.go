@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "testing"
+
+func TestRunnerForce(t *testing.T) {
+	ev := NewEvaluator(Vars{
+		"MAKE": &simpleVar{value: []string{"kati"}, origin: "file"},
+	})
+	for _, tc := range []struct {
+		cmd       string
+		wantCmd   string
+		wantForce bool
+	}{
+		{cmd: "echo foo", wantCmd: "echo foo"},
+		{cmd: "+echo foo", wantCmd: "echo foo", wantForce: true},
+		{cmd: "@+-echo foo", wantCmd: "echo foo", wantForce: true},
+		{cmd: "$(MAKE) -C sub", wantCmd: "kati -C sub", wantForce: true},
+		{cmd: "cd sub && ${MAKE}", wantCmd: "cd sub && kati", wantForce: true},
+		{cmd: "echo $(MAKEFILE)", wantCmd: "echo "},
+	} {
+		rr, err := runner{echo: true}.eval(ev, tc.cmd)
+		if err != nil {
+			t.Errorf("eval(%q): %v", tc.cmd, err)
+			continue
+		}
+		if len(rr) != 1 || rr[0].cmd != tc.wantCmd || rr[0].force != tc.wantForce {
+			t.Errorf("eval(%q)=%+v; want cmd=%q force=%t", tc.cmd, rr, tc.wantCmd, tc.wantForce)
+		}
+	}
+}
@@ -17,6 +17,8 @@ package kati
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -30,11 +32,30 @@ type Executor struct {
 	firstRule     *rule
 	// target -> Job, nil means the target is currently being processed.
 	done map[string]*job
+	// groups are jobs of grouped rules by their outputs.
+	groups map[string]*jobGroup
+	// waits are jobs which new jobs wait for, i.e. prerequisites
+	// before .WAIT of the targets being processed.
+	waits []*job
 
 	wm *workerManager
+	// jobserver shares job slots with recursive makes, or nil.
+	jobserver     *jobserver
+	outputSync    string
+	commandRunner CommandRunner
+	restat        *restatLog
+	buildLogFile  string
+	buildLog      *buildLog
 
 	ctx *execContext
 
+	// debug are categories of debug messages printed, and indent is
+	// the indent of messages of goals. debugMu serializes messages
+	// printed before prerequisites. see debug.go
+	debug   DebugFlags
+	indent  int
+	debugMu sync.Mutex
+
 	trace          []string
 	buildCnt       int
 	alreadyDoneCnt int
@@ -43,12 +64,17 @@ type Executor struct {
 	runCommandCnt  int
 }
 
-func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
+// makeJobs makes jobs of n and its dependencies. orderOnly is true if
+// neededBy needs n as an order-only prerequisite.
+func (ex *Executor) makeJobs(n *DepNode, neededBy *job, orderOnly bool) error {
 	output, _ := ex.ctx.vpaths.exists(n.Output)
 	if neededBy != nil {
 		glog.V(1).Infof("MakeJob: %s for %s", output, neededBy.n.Output)
 	}
-	n.Output = output
+	// n may be already posted and built by a worker.
+	if n.Output != output {
+		n.Output = output
+	}
 	ex.buildCnt++
 	if ex.buildCnt%100 == 0 {
 		ex.reportStats()
@@ -65,9 +91,9 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 				neededBy.numDeps--
 			}
 		} else {
-			glog.Infof("%s already done: %d", j.n.Output, j.outputTs)
+			glog.Infof("%s already done", output)
 			if neededBy != nil {
-				ex.wm.ReportNewDep(j, neededBy)
+				ex.wm.ReportNewDep(j, neededBy, orderOnly)
 			}
 		}
 		return nil
@@ -80,10 +106,62 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 		depsTs:  int64(-1),
 	}
 	if neededBy != nil {
-		j.parents = append(j.parents, neededBy)
+		j.addParent(neededBy, orderOnly)
+		j.neededBy = neededBy
+		j.depth = neededBy.depth + 1
 	}
 
 	ex.done[output] = nil
+	if len(n.DoubleColons) > 0 {
+		j.numDeps = len(n.DoubleColons)
+		err := ex.makeDoubleColonJobs(j)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := ex.makeDepJobs(j)
+		if err != nil {
+			return err
+		}
+	}
+	ex.done[output] = j
+	return ex.wm.PostJob(j)
+}
+
+// makeDoubleColonJobs makes jobs of the double-colon rules of j, which
+// are prerequisites of j. As GNU make does, the commands of each rule
+// run after its own prerequisites are made, and prerequisites of the
+// next rule are made after them.
+func (ex *Executor) makeDoubleColonJobs(j *job) error {
+	waits := ex.waits
+	defer func() { ex.waits = waits }()
+	for i, dn := range j.n.DoubleColons {
+		dj := &job{
+			n:           dn,
+			ex:          ex,
+			numDeps:     len(dn.Deps) + len(dn.OrderOnlys),
+			depsTs:      int64(-1),
+			doubleColon: i + 1,
+			neededBy:    j,
+			depth:       j.depth,
+		}
+		dj.addParent(j, false)
+		err := ex.makeDepJobs(dj)
+		if err != nil {
+			return err
+		}
+		err = ex.wm.PostJob(dj)
+		if err != nil {
+			return err
+		}
+		ex.waits = append(ex.waits[:len(ex.waits):len(ex.waits)], dj)
+	}
+	return nil
+}
+
+// makeDepJobs makes jobs of prerequisites of j.
+func (ex *Executor) makeDepJobs(j *job) error {
+	n := j.n
 	// We iterate n.Deps twice. In the first run, we may modify
 	// numDeps. There will be a race if we do so after the first
 	// ex.makeJobs(d, j).
@@ -91,6 +169,7 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 	for _, d := range n.Deps {
 		deps = append(deps, d)
 	}
+	numNormalDeps := len(deps)
 	for _, d := range n.OrderOnlys {
 		if _, ok := ex.ctx.vpaths.exists(d.Output); ok {
 			j.numDeps--
@@ -99,18 +178,119 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 		deps = append(deps, d)
 	}
 	glog.V(1).Infof("new: %s (%d)", j.n.Output, j.numDeps)
+	var waitJobs []*job
+	if len(n.GroupOutputs) > 0 {
+		waitJobs = ex.addToGroup(j)
+	}
+	waitJobs = append(waitJobs, ex.waitsFor(j)...)
+	// numDeps may be updated by the worker manager after j is
+	// reported as a new dep.
+	j.numDeps += len(waitJobs)
+	for _, w := range waitJobs {
+		ex.wm.ReportNewDep(w, j, true)
+	}
 
-	for _, d := range deps {
+	waits := ex.waits
+	defer func() { ex.waits = waits }()
+	w := 0
+	for i, d := range deps {
+		if w < len(n.Waits) && n.Waits[w] == i && i < numNormalDeps {
+			// jobs made for prerequisites after .WAIT, including
+			// their prerequisites, wait for ones before it.
+			ex.waits = waits[:len(waits):len(waits)]
+			for _, ld := range deps[:i] {
+				if lj := ex.done[ld.Output]; lj != nil {
+					ex.waits = append(ex.waits, lj)
+				}
+			}
+			w++
+		} else if i == numNormalDeps {
+			ex.waits = waits
+		}
 		ex.trace = append(ex.trace, d.Output)
-		err := ex.makeJobs(d, j)
+		err := ex.makeJobs(d, j, i >= numNormalDeps)
 		ex.trace = ex.trace[0 : len(ex.trace)-1]
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	ex.done[output] = j
-	return ex.wm.PostJob(j)
+// addToGroup adds j to the group of jobs of its grouped rule, and
+// returns the job added before, if any, which j waits for since its
+// commands may make the output of j too. Each double-colon rule of
+// outputs is a group.
+func (ex *Executor) addToGroup(j *job) []*job {
+	key := func(output string) string {
+		if j.doubleColon > 0 {
+			return fmt.Sprintf("%s::%d", output, j.doubleColon)
+		}
+		return output
+	}
+	g := ex.groups[key(j.n.Output)]
+	if g == nil {
+		g = &jobGroup{}
+		for _, o := range j.n.GroupOutputs {
+			ex.groups[key(o)] = g
+		}
+	}
+	j.group = g
+	last := g.last
+	g.last = j
+	// A job being processed is an ancestor of j, which waits for j.
+	if last != nil && ex.done[last.n.Output] != nil {
+		return []*job{last}
+	}
+	return nil
+}
+
+// waitsFor returns jobs in ex.waits which the new job j waits for as
+// order-only prerequisites, i.e. unless j needs them as normal
+// prerequisites.
+func (ex *Executor) waitsFor(j *job) []*job {
+	var waits []*job
+Loop:
+	for _, w := range ex.waits {
+		for _, d := range j.n.Deps {
+			if d == w.n {
+				continue Loop
+			}
+		}
+		waits = append(waits, w)
+	}
+	return waits
+}
+
+// removeIntermediates deletes intermediate files made by the build,
+// even if the build failed, as GNU make does. Files which the commands
+// didn't create are not reported.
+func (ex *Executor) removeIntermediates(files []string) {
+	if QuestionFlag || TouchFlag {
+		return
+	}
+	if !DryRunFlag {
+		var existing []string
+		for _, f := range files {
+			if _, err := os.Lstat(f); err == nil {
+				existing = append(existing, f)
+			}
+		}
+		files = existing
+	}
+	if len(files) == 0 {
+		return
+	}
+	fmt.Printf("rm %s\n", strings.Join(files, " "))
+	if DryRunFlag {
+		return
+	}
+	for _, f := range files {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "kati: %v\n", err)
+		}
+	}
 }
 
 func (ex *Executor) reportStats() {
@@ -125,9 +305,30 @@ func (ex *Executor) reportStats() {
 	}
 }
 
+// maxJobserverWorkers is the number of workers with a jobserver of
+// another make, which limits jobs running in parallel.
+const maxJobserverWorkers = 64
+
 // ExecutorOpt is an option for Executor.
 type ExecutorOpt struct {
 	NumJobs int
+	// JobserverStyle is the style of the jobserver created for
+	// NumJobs > 1, JobserverFifo or JobserverPipe. If empty,
+	// JobserverFifo is used except on windows.
+	JobserverStyle string
+	// OutputSync is the mode of --output-sync, e.g. OutputSyncTarget.
+	// If empty, OutputSyncNone is used.
+	OutputSync string
+	// CommandRunner runs commands of recipes. If nil,
+	// LocalCommandRunner is used.
+	CommandRunner CommandRunner
+	// RestatFile is the file where hashes of outputs are recorded.
+	// If set, targets depending on an output which its commands
+	// regenerate with the same contents aren't remade.
+	RestatFile string
+	// BuildLog is the file where commands run and how long they took
+	// are logged, for ReportBuildLog.
+	BuildLog string
 }
 
 // NewExecutor creates new Executor.
@@ -138,37 +339,62 @@ func NewExecutor(opt *ExecutorOpt) (*Executor, error) {
 	if opt.NumJobs < 1 {
 		opt.NumJobs = 1
 	}
-	wm, err := newWorkerManager(opt.NumJobs)
+	if err := validOutputSync(opt.OutputSync); err != nil {
+		return nil, err
+	}
+	var restat *restatLog
+	if opt.RestatFile != "" {
+		var err error
+		restat, err = loadRestatLog(opt.RestatFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	numJobs := opt.NumJobs
+	var js *jobserver
+	if auth := jobserverAuth(os.Getenv("MAKEFLAGS")); auth != "" {
+		var err error
+		js, err = openJobserver(auth)
+		if err != nil {
+			glog.Warningf("%v; disabling jobserver mode.", err)
+		} else if numJobs < maxJobserverWorkers {
+			// the jobserver limits jobs.
+			numJobs = maxJobserverWorkers
+		}
+	} else if numJobs > 1 {
+		var err error
+		js, err = newJobserver(numJobs, opt.JobserverStyle)
+		if err != nil {
+			return nil, err
+		}
+	}
+	wm, err := newWorkerManager(numJobs)
 	if err != nil {
+		js.close()
 		return nil, err
 	}
 	ex := &Executor{
-		rules:       make(map[string]*rule),
-		suffixRules: make(map[string][]*rule),
-		done:        make(map[string]*job),
-		wm:          wm,
+		rules:         make(map[string]*rule),
+		suffixRules:   make(map[string][]*rule),
+		done:          make(map[string]*job),
+		groups:        make(map[string]*jobGroup),
+		wm:            wm,
+		jobserver:     js,
+		outputSync:    opt.OutputSync,
+		debug:         Debug,
+		commandRunner: opt.CommandRunner,
+		restat:        restat,
+		buildLogFile:  opt.BuildLog,
 	}
 	return ex, nil
 }
 
 // Exec executes to build targets, or first target in DepGraph.
-func (ex *Executor) Exec(g *DepGraph, targets []string) error {
-	ex.ctx = newExecContext(g.vars, g.vpaths, false)
-
-	// TODO: Handle target specific variables.
-	for name, export := range g.exports {
-		if export {
-			v, err := ex.ctx.ev.EvaluateVar(name)
-			if err != nil {
-				return err
-			}
-			os.Setenv(name, v)
-		} else {
-			os.Unsetenv(name)
-		}
+func (ex *Executor) Exec(g *DepGraph, targets []string) (err error) {
+	defer recoverPanic(nil, &err)
+	if g.targetsErr != nil {
+		return g.targetsErr
 	}
-
-	startTime := time.Now()
 	var nodes []*DepNode
 	if len(targets) == 0 {
 		if len(g.nodes) > 0 {
@@ -186,18 +412,48 @@ func (ex *Executor) Exec(g *DepGraph, targets []string) error {
 			}
 		}
 	}
+	debugf(DebugBasic, "Updating goal targets....")
+	n, err := ex.build(g, nodes)
+	if n == 0 && !QuestionFlag {
+		for _, root := range nodes {
+			fmt.Printf("kati: Nothing to be done for `%s'.\n", root.Output)
+		}
+	}
+	return err
+}
+
+// build makes nodes of g, and returns the number of nodes whose
+// commands ran. An Executor builds only once.
+func (ex *Executor) build(g *DepGraph, nodes []*DepNode) (int, error) {
+	ex.ctx = newExecContext(g.vars, g.vpaths, false)
+	ex.ctx.jobserver = ex.jobserver
+	ex.ctx.outputSync = newOutputSyncer(os.Stdout, ex.outputSync)
+	ex.ctx.debug = ex.debug
+	ex.ctx.commandRunner = ex.commandRunner
+	defer ex.jobserver.close()
+	if ex.buildLogFile != "" && !DryRunFlag {
+		ex.buildLog = newBuildLog(ex.buildLogFile)
+	}
+
+	// exported variables are passed to each command by its runner.
+	ex.ctx.ev.exports = g.exports
+	ex.ctx.ev.exportAll = g.exportAll
+
+	startTime := time.Now()
 	for _, root := range nodes {
-		err := ex.makeJobs(root, nil)
+		err := ex.makeJobs(root, nil, false)
 		if err != nil {
 			break
 		}
 	}
 	n, err := ex.wm.Wait()
-	logStats("exec time: %q", time.Since(startTime))
-	if n == 0 {
-		for _, root := range nodes {
-			fmt.Printf("kati: Nothing to be done for `%s'.\n", root.Output)
-		}
+	if serr := ex.restat.save(); err == nil {
+		err = serr
 	}
-	return err
+	if cerr := ex.buildLog.close(); err == nil {
+		err = cerr
+	}
+	ex.removeIntermediates(ex.wm.intermediates)
+	logStats("exec time: %q", time.Since(startTime))
+	return n, err
 }
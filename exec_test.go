@@ -0,0 +1,579 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecQuestionTouch(t *testing.T) {
+	chdirTestMakefile(t, `all: out
+out: in
+	cp in out
+.PHONY: all
+`)
+	err := ioutil.WriteFile("in", []byte("in"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		QuestionFlag = false
+		TouchFlag = false
+	}()
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := func() error {
+		ex, err := NewExecutor(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex.Exec(g, nil)
+	}
+
+	QuestionFlag = true
+	if err := exec(); err != ErrOutOfDate {
+		t.Errorf("Exec with QuestionFlag=%v; want %v", err, ErrOutOfDate)
+	}
+	if _, err := os.Stat("out"); !os.IsNotExist(err) {
+		t.Errorf("out exists after Exec with QuestionFlag: %v", err)
+	}
+
+	QuestionFlag = false
+	TouchFlag = true
+	if err := exec(); err != nil {
+		t.Errorf("Exec with TouchFlag=%v", err)
+	}
+	b, err := ioutil.ReadFile("out")
+	if err != nil || len(b) != 0 {
+		t.Errorf("out=%q, %v; want empty file", b, err)
+	}
+
+	TouchFlag = false
+	QuestionFlag = true
+	if err := exec(); err != nil {
+		t.Errorf("Exec with QuestionFlag after touch=%v; want nil", err)
+	}
+}
+
+func TestExecKeepGoing(t *testing.T) {
+	chdirTestMakefile(t, `all: a b c
+a:
+	false
+b: d
+	touch b
+d:
+	false
+c:
+	touch c
+`)
+	KeepGoingFlag = true
+	defer func() {
+		KeepGoingFlag = false
+	}()
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	errs, ok := err.(BuildErrors)
+	if !ok {
+		t.Fatalf("Exec with KeepGoingFlag=%v; want BuildErrors", err)
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		`*** [a] Error 1`,
+		`*** [d] Error 1`,
+		`*** Target "all" not remade because of errors.`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Exec with KeepGoingFlag=%q; want %q", got, want)
+	}
+	if _, err := os.Stat("c"); err != nil {
+		t.Errorf("c is not made: %v", err)
+	}
+	if _, err := os.Stat("b"); !os.IsNotExist(err) {
+		t.Errorf("b is made after d failed: %v", err)
+	}
+}
+
+func TestExecOrderOnly(t *testing.T) {
+	chdirTestMakefile(t, `out: in | dir
+	echo $@ $^ $| >> log
+dir:
+	echo $@ >> log
+.PHONY: dir
+`)
+	err := ioutil.WriteFile("in", []byte("in"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		ex, err := NewExecutor(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, []string{"out"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile("out", nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the phony order-only prerequisite doesn't rebuild out.
+	if got, want := string(b), "dir\nout in dir\ndir\n"; got != want {
+		t.Errorf("log=%q; want %q", got, want)
+	}
+}
+
+func TestExecDoubleColon(t *testing.T) {
+	chdirTestMakefile(t, `t:: a
+	echo 1 $^ >> log
+t:: b
+	echo 2 $^ >> log
+t::
+	echo 3 >> log
+`)
+	old := time.Now().Add(-time.Hour)
+	for _, f := range []string{"a", "b", "t"} {
+		err := ioutil.WriteFile(f, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only b is newer than t.
+	for _, f := range []string{"a", "t"} {
+		err := os.Chtimes(f, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "2 b\n3\n"; got != want {
+		t.Errorf("log=%q; want %q", got, want)
+	}
+}
+
+func TestExecDoubleColonOrder(t *testing.T) {
+	chdirTestMakefile(t, `t:: a
+	echo first >> log
+t:: b
+	echo second >> log
+a b:
+	echo make $@ >> log
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// prerequisites of each rule are made before its commands.
+	if got, want := string(b), "make a\nfirst\nmake b\nsecond\n"; got != want {
+		t.Errorf("log=%q; want %q", got, want)
+	}
+}
+
+func TestExecGroupedTargets(t *testing.T) {
+	chdirTestMakefile(t, `all: x y a b
+x: a
+	touch $@
+y: b
+	touch $@
+a b &:
+	echo $@ >> log; sleep 0.1; touch a b
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := writeTestMakefile(t, "a b &: c\n")
+	defer os.RemoveAll(filepath.Dir(bad))
+	_, err = Load(LoadReq{Makefile: bad})
+	if err == nil || !strings.Contains(err.Error(), "grouped targets must provide a recipe") {
+		t.Errorf("Load(a b &: c)=_, %v; want error", err)
+	}
+	for _, jobs := range []int{1, 4} {
+		os.Remove("log")
+		ex, err := NewExecutor(&ExecutorOpt{NumJobs: jobs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "a\n"; got != want {
+			t.Errorf("-j%d: log=%q; want %q", jobs, got, want)
+		}
+		for _, f := range []string{"a", "b", "x", "y"} {
+			os.Remove(f)
+		}
+	}
+}
+
+func TestExecWait(t *testing.T) {
+	chdirTestMakefile(t, `all: a b .WAIT c d
+	echo $^ >> log
+a b:
+	sleep 0.2; echo $@ >> log
+c: e
+	echo $@ >> log
+d e:
+	echo $@ >> log
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, jobs := range []int{1, 4} {
+		os.Remove("log")
+		ex, err := NewExecutor(&ExecutorOpt{NumJobs: jobs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 6 {
+			t.Fatalf("-j%d: log=%q; want 6 lines", jobs, b)
+		}
+		// e is a prerequisite of c, so it waits for a and b too.
+		first := append([]string{}, lines[:2]...)
+		sort.Strings(first)
+		if got, want := strings.Join(first, " "), "a b"; got != want {
+			t.Errorf("-j%d: log=%q; want a and b first", jobs, b)
+		}
+		if got, want := lines[5], "a b c d"; got != want {
+			t.Errorf("-j%d: $^=%q; want %q", jobs, got, want)
+		}
+	}
+}
+
+func TestExecIntermediate(t *testing.T) {
+	chdirTestMakefile(t, `all: a.out c.out
+.INTERMEDIATE: a.mid b.mid c.mid
+.SECONDARY: c.mid
+.PRECIOUS: fail.tmp
+.DELETE_ON_ERROR:
+a.out: a.mid b.mid
+	cat $^ > $@
+c.out: c.mid
+	cp $< $@
+%.mid:
+	echo $@ > $@
+fail.tmp fail.out:
+	echo partial > $@; false
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"all", "fail.tmp", "fail.out"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		targets []string
+		wantErr bool
+	}{
+		{targets: []string{"all"}},
+		{targets: []string{"fail.tmp"}, wantErr: true},
+		{targets: []string{"fail.out"}, wantErr: true},
+	} {
+		ex, err := NewExecutor(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, tc.targets)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Exec(g, %q)=%v; want error %t", tc.targets, err, tc.wantErr)
+		}
+	}
+	for _, tc := range []struct {
+		file string
+		want bool
+	}{
+		{file: "a.out", want: true},
+		{file: "a.mid", want: false},
+		{file: "b.mid", want: false},
+		{file: "c.mid", want: true},
+		{file: "fail.tmp", want: true},
+		{file: "fail.out", want: false},
+	} {
+		_, err := os.Stat(tc.file)
+		if got := err == nil; got != tc.want {
+			t.Errorf("%s exists=%t; want %t", tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestExecMissingIntermediate(t *testing.T) {
+	chdirTestMakefile(t, `a: b
+	cp b a; echo a >> log
+b: c
+	cp c b; echo b >> log
+.INTERMEDIATE: b
+`)
+	err := ioutil.WriteFile("c", []byte("c\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		modify  bool
+		wantLog string
+	}{
+		{wantLog: "b\na\n"},
+		// b was deleted, but c is older than a.
+		{wantLog: "b\na\n"},
+		{modify: true, wantLog: "b\na\nb\na\n"},
+	} {
+		if tc.modify {
+			future := time.Now().Add(time.Hour)
+			err = os.Chtimes("c", future, future)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ex, err := NewExecutor(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, []string{"a"})
+		if err != nil {
+			t.Fatalf("#%d: Exec(g, a)=%v", i, err)
+		}
+		log, err := ioutil.ReadFile("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(log); got != tc.wantLog {
+			t.Errorf("#%d: log=%q; want %q", i, got, tc.wantLog)
+		}
+		if _, err := os.Stat("b"); !os.IsNotExist(err) {
+			t.Errorf("#%d: b exists after the build", i)
+		}
+	}
+}
+
+func TestExecIntermediateNotCreated(t *testing.T) {
+	chdirTestMakefile(t, `a: b c
+	touch a
+b c:
+	touch c
+.INTERMEDIATE: b c
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the commands of b didn't create b, and c which they created
+	// is up to date.
+	if got, want := string(b), "touch c\ntouch a\n"; got != want {
+		t.Errorf("output=%q; want %q", got, want)
+	}
+}
+
+func TestExecImplicitRuleChain(t *testing.T) {
+	chdirTestMakefile(t, `%.b: %.a
+	cp $< $@; echo $@ >> log
+%.x: %.b
+	cp $< $@; echo $@ >> log
+`)
+	err := ioutil.WriteFile("q.a", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"q.x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// q.b is made by the chain and deleted. The second run does
+	// nothing.
+	for i := 0; i < 2; i++ {
+		ex, err := NewExecutor(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, []string{"q.x"})
+		if err != nil {
+			t.Fatalf("#%d: Exec(g, q.x)=%v", i, err)
+		}
+		log, err := ioutil.ReadFile("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(log), "q.b\nq.x\n"; got != want {
+			t.Errorf("#%d: log=%q; want %q", i, got, want)
+		}
+		if _, err := os.Stat("q.b"); !os.IsNotExist(err) {
+			t.Errorf("#%d: q.b exists after the build", i)
+		}
+	}
+}
+
+func TestRemakeMakefiles(t *testing.T) {
+	chdirTestMakefile(t, `include gen.mk
+-include nope.mk
+all:
+gen.mk:
+	echo 'FOO := foo' > $@
+`)
+	defer func() {
+		DryRunFlag = false
+	}()
+	// commands to remake makefiles run even with DryRunFlag.
+	DryRunFlag = true
+
+	if _, err := Load(LoadReq{Makefile: "Makefile"}); err == nil {
+		t.Errorf("Load without RemakeMakefiles succeeded for missing gen.mk")
+	}
+	req := LoadReq{Makefile: "Makefile", RemakeMakefiles: true}
+	for _, want := range []bool{true, false} {
+		g, err := Load(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := NewExecutor(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remade, err := ex.RemakeMakefiles(g)
+		if err != nil || remade != want {
+			t.Fatalf("RemakeMakefiles(restarts=%d)=%t, %v; want %t, <nil>", req.Restarts, remade, err, want)
+		}
+		// automatic variables of the commands don't leak into g.
+		if v := g.vars.Lookup("@"); v.Origin() != "undefined" {
+			t.Errorf("$@ is %s after RemakeMakefiles; want undefined", v.Origin())
+		}
+		if !remade {
+			if got := g.vars.Lookup("FOO").String(); got != "foo" {
+				t.Errorf("FOO=%q; want %q", got, "foo")
+			}
+			if got := g.vars.Lookup("MAKE_RESTARTS").String(); got != "1" {
+				t.Errorf("MAKE_RESTARTS=%q; want %q", got, "1")
+			}
+			break
+		}
+		req.Restarts++
+	}
+
+	err := ioutil.WriteFile("Makefile", []byte("include nope.mk\nall:\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.RemakeMakefiles(g); err == nil {
+		t.Errorf("RemakeMakefiles succeeded for missing nope.mk without rule")
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Expansion cache of recursive variables.
+//
+// A recursive variable is expanded every time it is referenced, e.g.
+//
+//	CFLAGS = $(COMMON_CFLAGS) $(addprefix -I,$(INCLUDES))
+//
+// is expanded for each rule using $(CFLAGS). The expansion cache keeps
+// the output of an expansion with the variables looked up during the
+// expansion. The output is reused while each of these variables is
+// still the same variable at the same version, i.e. it was neither
+// assigned nor appended. Lookups are validated in the current context,
+// so target specific variables, $(foreach) and $(eval) invalidate
+// entries as usual assignments do.
+//
+// Expansions which depend on something other than variables, e.g.
+// $(shell), $(wildcard), $(eval), $(info), automatic variables and
+// parameters of $(call), are not cached.
+
+// maxExpandCacheSize is the maximum number of variables in expandCache.
+// The cache is flushed when it becomes full.
+const maxExpandCacheSize = 1 << 16
+
+// maxExpandEntriesPerVar is the maximum number of entries of a
+// variable, e.g. for different target specific variables.
+const maxExpandEntriesPerVar = 4
+
+// expandDep is a variable looked up in an expansion.
+type expandDep struct {
+	name    string
+	v       Var
+	version int
+}
+
+// volatileVar is a variable whose value may change without assignment,
+// e.g. automatic variables of commands.
+type volatileVar interface {
+	volatile()
+}
+
+func varVersion(v Var) int {
+	switch v := v.(type) {
+	case *simpleVar:
+		return v.version
+	case *recursiveVar:
+		return v.version
+	case *targetSpecificVar:
+		return varVersion(v.v)
+	}
+	return 0
+}
+
+// expandTracker records dependencies of an expansion.
+type expandTracker struct {
+	deps []expandDep
+	seen map[string]bool // names in deps, used if deps is large.
+	// impure is true if the expansion depends on other than variables.
+	impure bool
+	// volatile is true if the expansion depends on volatile variables.
+	volatile bool
+	// params is true if the expansion depends on $1, $2, ...
+	params bool
+}
+
+const expandTrackerSeenThreshold = 16
+
+// add adds d to t. Only the first lookup of a name is recorded, since
+// the later lookups in a cacheable expansion see the same variable,
+// except the variable of $(foreach), whose value is determined by
+// variables looked up before.
+func (t *expandTracker) add(d expandDep) {
+	if t.seen != nil {
+		if t.seen[d.name] {
+			return
+		}
+		t.seen[d.name] = true
+		t.deps = append(t.deps, d)
+		return
+	}
+	for _, dd := range t.deps {
+		if dd.name == d.name {
+			return
+		}
+	}
+	t.deps = append(t.deps, d)
+	if len(t.deps) > expandTrackerSeenThreshold {
+		t.seen = make(map[string]bool)
+		for _, dd := range t.deps {
+			t.seen[dd.name] = true
+		}
+	}
+}
+
+// merge merges dependencies of a nested expansion into t.
+func (t *expandTracker) merge(nt *expandTracker) {
+	for _, d := range nt.deps {
+		t.add(d)
+	}
+	t.impure = t.impure || nt.impure
+	t.volatile = t.volatile || nt.volatile
+	t.params = t.params || nt.params
+}
+
+// expandOp is an operation on evalWriter recorded by expandRecorder.
+type expandOp struct {
+	kind int
+	end  int // end offset of data in expandRecorder.buf.
+}
+
+const (
+	expandOpWrite = iota
+	expandOpWord
+	expandOpResetSep
+)
+
+// expandRecorder is an evalWriter which records operations, to replay
+// them on another evalWriter. Output of an expansion depends on the
+// evalWriter, e.g. wordBuffer separates words written by writeWord,
+// so the cache keeps operations rather than output bytes.
+type expandRecorder struct {
+	buf []byte
+	ops []expandOp
+}
+
+func (r *expandRecorder) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	r.buf = append(r.buf, data...)
+	r.ops = append(r.ops, expandOp{kind: expandOpWrite, end: len(r.buf)})
+	return len(data), nil
+}
+
+func (r *expandRecorder) writeWord(word []byte) {
+	r.buf = append(r.buf, word...)
+	r.ops = append(r.ops, expandOp{kind: expandOpWord, end: len(r.buf)})
+}
+
+func (r *expandRecorder) writeWordString(word string) {
+	r.buf = append(r.buf, word...)
+	r.ops = append(r.ops, expandOp{kind: expandOpWord, end: len(r.buf)})
+}
+
+func (r *expandRecorder) writeWordBytes(a, b, c []byte) {
+	r.buf = append(r.buf, a...)
+	r.buf = append(r.buf, b...)
+	r.buf = append(r.buf, c...)
+	r.ops = append(r.ops, expandOp{kind: expandOpWord, end: len(r.buf)})
+}
+
+func (r *expandRecorder) resetSep() {
+	r.ops = append(r.ops, expandOp{kind: expandOpResetSep, end: len(r.buf)})
+}
+
+func (r *expandRecorder) reset() {
+	r.buf = r.buf[:0]
+	r.ops = r.ops[:0]
+}
+
+// replay writes recorded operations to w.
+func (r *expandRecorder) replay(w evalWriter) {
+	start := 0
+	for _, op := range r.ops {
+		data := r.buf[start:op.end]
+		start = op.end
+		switch op.kind {
+		case expandOpWrite:
+			w.Write(data)
+		case expandOpWord:
+			w.writeWord(data)
+		case expandOpResetSep:
+			w.resetSep()
+		}
+	}
+}
+
+type expandEntry struct {
+	version int // version of the expanded variable.
+	rec     *expandRecorder
+	deps    []expandDep
+}
+
+// valid reports whether rv and every dependency of e are unchanged
+// in ev.
+func (e *expandEntry) valid(ev *Evaluator, rv *recursiveVar) bool {
+	if rv.version != e.version {
+		return false
+	}
+	for _, d := range e.deps {
+		v := ev.lookupVar(d.name)
+		if v != d.v || varVersion(v) != d.version {
+			return false
+		}
+	}
+	return true
+}
+
+// expandCache is a cache of expansions of recursive variables in an
+// evaluator. A nil *expandCache disables caching.
+type expandCache struct {
+	entries map[*recursiveVar][]*expandEntry
+	// tracking is a stack of expansions being evaluated.
+	tracking []*expandTracker
+	free     []*expandRecorder
+
+	hits, misses int
+}
+
+func newExpandCache() *expandCache {
+	return &expandCache{
+		entries: make(map[*recursiveVar][]*expandEntry),
+	}
+}
+
+func (c *expandCache) top() *expandTracker {
+	if c == nil || len(c.tracking) == 0 {
+		return nil
+	}
+	return c.tracking[len(c.tracking)-1]
+}
+
+// track records v looked up by name in the current expansion.
+func (c *expandCache) track(name string, v Var) {
+	t := c.top()
+	if t == nil {
+		return
+	}
+	if _, ok := v.(volatileVar); ok {
+		t.volatile = true
+		return
+	}
+	t.add(expandDep{name: name, v: v, version: varVersion(v)})
+}
+
+// uncacheable marks the current expansion as not cacheable, i.e. it
+// has side effects or depends on other than variables.
+func (c *expandCache) uncacheable() {
+	if t := c.top(); t != nil {
+		t.impure = true
+	}
+}
+
+// useParams marks the current expansion as depending on parameters
+// of $(call).
+func (c *expandCache) useParams() {
+	if t := c.top(); t != nil {
+		t.params = true
+	}
+}
+
+// enterCall is called when $(call) sets parameters. The current
+// expansion doesn't depend on parameters used in the called variable,
+// since the arguments are expanded in the current expansion.
+// It returns a state to pass to leaveCall.
+func (c *expandCache) enterCall() bool {
+	t := c.top()
+	if t == nil {
+		return false
+	}
+	params := t.params
+	t.params = false
+	return params
+}
+
+func (c *expandCache) leaveCall(params bool) {
+	if t := c.top(); t != nil {
+		t.params = params
+	}
+}
+
+func (c *expandCache) newRecorder() *expandRecorder {
+	if n := len(c.free); n > 0 {
+		r := c.free[n-1]
+		c.free = c.free[:n-1]
+		return r
+	}
+	return &expandRecorder{}
+}
+
+func (c *expandCache) freeRecorder(r *expandRecorder) {
+	if cap(r.buf) > maxPooledBufSize {
+		return
+	}
+	r.reset()
+	c.free = append(c.free, r)
+}
+
+func (c *expandCache) lookup(ev *Evaluator, rv *recursiveVar) *expandEntry {
+	for _, e := range c.entries[rv] {
+		if e.valid(ev, rv) {
+			return e
+		}
+	}
+	return nil
+}
+
+// add adds e as the most recent entry of rv.
+func (c *expandCache) add(rv *recursiveVar, e *expandEntry) {
+	es, ok := c.entries[rv]
+	if !ok && len(c.entries) >= maxExpandCacheSize {
+		c.entries = make(map[*recursiveVar][]*expandEntry)
+	}
+	if len(es) >= maxExpandEntriesPerVar {
+		c.freeRecorder(es[len(es)-1].rec)
+		es = es[:len(es)-1]
+	}
+	es = append(es, nil)
+	copy(es[1:], es)
+	es[0] = e
+	c.entries[rv] = es
+}
+
+// eval expands rv into w, using the cached output if it is valid.
+func (c *expandCache) eval(w evalWriter, ev *Evaluator, rv *recursiveVar) error {
+	if e := c.lookup(ev, rv); e != nil {
+		c.hits++
+		if t := c.top(); t != nil {
+			for _, d := range e.deps {
+				t.add(d)
+			}
+		}
+		e.rec.replay(w)
+		return nil
+	}
+	c.misses++
+	t := &expandTracker{}
+	c.tracking = append(c.tracking, t)
+	rec := c.newRecorder()
+	err := rv.Eval(rec, ev)
+	c.tracking = c.tracking[:len(c.tracking)-1]
+	if err != nil {
+		c.freeRecorder(rec)
+		return err
+	}
+	rec.replay(w)
+	if pt := c.top(); pt != nil {
+		pt.merge(t)
+	}
+	if t.impure || t.volatile || t.params {
+		c.freeRecorder(rec)
+		return nil
+	}
+	c.add(rv, &expandEntry{version: rv.version, rec: rec, deps: t.deps})
+	return nil
+}
+
+// trackLookups calls f, and returns the tracker of variables looked up
+// by f, e.g. to find variables which commands of a rule depend on.
+func (c *expandCache) trackLookups(f func() error) (*expandTracker, error) {
+	t := &expandTracker{}
+	c.tracking = append(c.tracking, t)
+	err := f()
+	c.tracking = c.tracking[:len(c.tracking)-1]
+	if pt := c.top(); pt != nil {
+		pt.merge(t)
+	}
+	return t, err
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"reflect"
+	"testing"
+)
+
+func evalWithExpandCache(t *testing.T, mk string, useCache bool) *evalResult {
+	saved := UseExpandCache
+	defer func() { UseExpandCache = saved }()
+	UseExpandCache = useCache
+	m, err := parseMakefileString(mk, srcpos{filename: "test.mk", lineno: 1})
+	if err != nil {
+		t.Fatalf("parse %q: %v", mk, err)
+	}
+	er, err := eval(m, make(Vars), false)
+	if err != nil {
+		t.Fatalf("eval %q: %v", mk, err)
+	}
+	return er
+}
+
+func TestExpandCache(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk:   "A := 1\nX = $(A)\nR := $(X)\nA := 2\nR += $(X)\n",
+			want: "1 2",
+		},
+		{
+			mk:   "A = a\nX = $(A)\nR := $(X)\nA += b\nR += $(X)\n",
+			want: "a a b",
+		},
+		{
+			// A is not looked up until B is set.
+			mk:   "X = $(if $(B),$(A),b)\nR := $(X)\nB := 1\nA := a\nR += $(X)\n",
+			want: "b a",
+		},
+		{
+			mk:   "A := 1\nX = $(A)\nR := $(X)$(eval A := 2)$(X)\n",
+			want: "12",
+		},
+		{
+			// X changes A whenever expanded.
+			mk:   "A := 1\nX = $(A)$(eval A := $(A)1)\nR := $(X) $(X)\n",
+			want: "1 11",
+		},
+		{
+			mk:   "N := 0\nX = $(N)\nY = $(X)$(eval N := 1)\nR := $(Y) $(Y)\n",
+			want: "0 1",
+		},
+		{
+			mk:   "X = $(1)\nF = [$(X)]\nR := $(call F,a) $(call F,b)\n",
+			want: "[a] [b]",
+		},
+		{
+			mk:   "X = $(1)\nF = $(call G,$(1))\nG = <$(X)>\nY = $(call F,a)\nR := $(Y) $(call F,b) $(Y)\n",
+			want: "<a> <b> <a>",
+		},
+		{
+			mk:   "X = $(i)\nR := $(foreach i,a b,$(X)) $(X)\n",
+			want: "a b ",
+		},
+		{
+			mk:   "X = $(i)\nY = $(foreach i,a b,$(X))\nR := $(Y) $(Y)\ni := c\nR += $(Y) $(X)\n",
+			want: "a b a b a b c",
+		},
+		{
+			mk:   "A := a\nX = $(A)\nY = $(X) $(X)\nR := $(Y)\nA := b\nR += $(Y)\n",
+			want: "a a b b",
+		},
+		{
+			mk:   "X = $(sort b a)\nR := $(X)$(X) $(words $(X)$(X))\n",
+			want: "a ba b 4",
+		},
+		{
+			mk:   "A := a\nX = $(A)\nR := $(origin X) $(X)\nX = $(A)$(A)\nR += $(X)\n",
+			want: "file a aa",
+		},
+	} {
+		want := evalWithExpandCache(t, tc.mk, false).vars.Lookup("R").String()
+		if want != tc.want {
+			t.Errorf("eval(%q) without cache: R=%q; want %q", tc.mk, want, tc.want)
+			continue
+		}
+		er := evalWithExpandCache(t, tc.mk, true)
+		if got := er.vars.Lookup("R").String(); got != tc.want {
+			t.Errorf("eval(%q) with cache: R=%q; want %q", tc.mk, got, tc.want)
+		}
+	}
+}
+
+func TestExpandCacheTargetSpecificVar(t *testing.T) {
+	er := evalWithExpandCache(t, `
+A := global
+X = $(A)
+out: A := target
+out2: A := other
+out: ; echo $(X)
+`, true)
+	saved := UseExpandCache
+	defer func() { UseExpandCache = saved }()
+	UseExpandCache = true
+	ev := NewEvaluator(er.vars)
+	x, _, err := parseExpr([]byte("$(X)"), nil, parseOp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		scope string
+		want  string
+	}{
+		{scope: "", want: "global"},
+		{scope: "out", want: "target"},
+		{scope: "", want: "global"},
+		{scope: "out2", want: "other"},
+		{scope: "out", want: "target"},
+		{scope: "", want: "global"},
+	} {
+		ev.currentScope = er.ruleVars[tc.scope]
+		var buf evalBuffer
+		buf.resetSep()
+		err := x.Eval(&buf, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("$(X) in %q=%q; want %q", tc.scope, got, tc.want)
+		}
+	}
+	if ev.expandCache.hits == 0 {
+		t.Errorf("expand cache hits=0; want >0")
+	}
+}
+
+func TestExpandCacheWordBuffer(t *testing.T) {
+	saved := UseExpandCache
+	defer func() { UseExpandCache = saved }()
+	vars := Vars{
+		"X": &recursiveVar{expr: expr{literal("a"), &funcSort{fclosure: fclosure{args: []Value{literal("(sort"), literal("c b")}}}}, origin: "file"},
+	}
+	x := &varref{varname: literal("X")}
+	var want [][]string
+	for _, useCache := range []bool{false, true} {
+		UseExpandCache = useCache
+		ev := NewEvaluator(vars)
+		var got [][]string
+		for i := 0; i < 2; i++ {
+			wb := newWbuf()
+			wb.Write([]byte("x"))
+			x.Eval(wb, ev)
+			var words []string
+			for _, w := range wb.words {
+				words = append(words, string(w))
+			}
+			got = append(got, words)
+			wb.release()
+		}
+		if !useCache {
+			want = got
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("words=%q; want %q", got, want)
+		}
+	}
+}
+
+func BenchmarkExpandCache(b *testing.B) {
+	saved := UseExpandCache
+	defer func() { UseExpandCache = saved }()
+	UseExpandCache = true
+	mk, err := parseMakefileString(`
+INCLUDES := $(foreach d,a b c d e f g h,src/$(d)/include)
+COMMON_CFLAGS := -O2 -Wall -Werror
+CFLAGS = $(COMMON_CFLAGS) $(addprefix -I,$(INCLUDES)) $(patsubst %,-D%,FOO BAR BAZ)
+`, srcpos{filename: "bench.mk", lineno: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	er, err := eval(mk, make(Vars), false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ev := NewEvaluator(er.vars)
+	x := &varref{varname: literal("CFLAGS")}
+	var buf evalBuffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		x.Eval(&buf, ev)
+	}
+}
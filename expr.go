@@ -37,6 +37,8 @@ type evalWriter interface {
 	io.Writer
 	writeWord([]byte)
 	writeWordString(string)
+	// writeWordBytes writes a+b+c as a word, without temporary buffer.
+	writeWordBytes(a, b, c []byte)
 	resetSep()
 }
 
@@ -154,18 +156,25 @@ func (v *varref) String() string {
 }
 
 func (v *varref) Eval(w evalWriter, ev *Evaluator) error {
-	te := traceEvent.begin("var", v, traceEventMain)
+	te := traceEvent.begin("var", v, ev.tid)
 	buf := newEbuf()
 	err := v.varname.Eval(buf, ev)
 	if err != nil {
 		return err
 	}
-	vv := ev.LookupVar(buf.String())
+	name := buf.String()
+	vv := ev.LookupVar(name)
 	buf.release()
-	err = vv.Eval(w, ev)
+	err = ev.lintUndefined(name, vv)
 	if err != nil {
 		return err
 	}
+	pd := ev.profBegin(ProfileVar, name)
+	err = ev.evalVar(w, name, vv)
+	if err != nil {
+		return err
+	}
+	ev.profEnd(pd)
 	traceEvent.end(te)
 	return nil
 }
@@ -191,16 +200,22 @@ func (p paramref) String() string {
 }
 
 func (p paramref) Eval(w evalWriter, ev *Evaluator) error {
-	te := traceEvent.begin("param", p, traceEventMain)
+	te := traceEvent.begin("param", p, ev.tid)
 	n := int(p)
 	if n < len(ev.paramVars) {
+		ev.expandCache.useParams()
 		err := ev.paramVars[n].Eval(w, ev)
 		if err != nil {
 			return err
 		}
 	} else {
-		vv := ev.LookupVar(fmt.Sprintf("%d", n))
-		err := vv.Eval(w, ev)
+		name := fmt.Sprintf("%d", n)
+		vv := ev.LookupVar(name)
+		err := ev.lintUndefined(name, vv)
+		if err != nil {
+			return err
+		}
+		err = vv.Eval(w, ev)
 		if err != nil {
 			return err
 		}
@@ -235,31 +250,50 @@ func (v varsubst) String() string {
 }
 
 func (v varsubst) Eval(w evalWriter, ev *Evaluator) error {
-	te := traceEvent.begin("varsubst", v, traceEventMain)
+	te := traceEvent.begin("varsubst", v, ev.tid)
 	buf := newEbuf()
 	params, err := ev.args(buf, v.varname, v.pat, v.subst)
 	if err != nil {
 		return err
 	}
 	vname := string(params[0])
-	pat := string(params[1])
-	subst := string(params[2])
-	buf.Reset()
+	pat := params[1]
+	subst := params[2]
 	vv := ev.LookupVar(vname)
-	err = vv.Eval(buf, ev)
+	err = ev.lintUndefined(vname, vv)
 	if err != nil {
 		return err
 	}
-	vals := splitSpaces(buf.String())
-	buf.release()
-	space := false
-	for _, val := range vals {
-		if space {
-			io.WriteString(w, " ")
+	wb := newWbuf()
+	pd := ev.profBegin(ProfileVar, vname)
+	err = ev.evalVar(wb, vname, vv)
+	if err != nil {
+		return err
+	}
+	ev.profEnd(pd)
+	if bytes.IndexByte(pat, '%') >= 0 && bytes.IndexByte(subst, '%') >= 0 {
+		ppat := matcherCache.percentPattern(pat)
+		prepl := matcherCache.percentPattern(subst)
+		for i, word := range wb.words {
+			if i > 0 {
+				writeByte(w, ' ')
+			}
+			pre, stem, post := ppat.subst(prepl, word)
+			w.Write(pre)
+			w.Write(stem)
+			w.Write(post)
+		}
+	} else {
+		for i, word := range wb.words {
+			if i > 0 {
+				writeByte(w, ' ')
+			}
+			w.Write(bytes.TrimSuffix(word, pat))
+			w.Write(subst)
 		}
-		io.WriteString(w, substRef(pat, subst, val))
-		space = true
 	}
+	wb.release()
+	buf.release()
 	traceEvent.end(te)
 	return nil
 }
@@ -286,6 +320,9 @@ func (v varsubst) dump(d *dumpbuf) {
 
 func str(buf []byte, alloc bool) Value {
 	if alloc {
+		if len(buf) <= internLiteralMax {
+			return literal(internBytes(buf))
+		}
 		return literal(string(buf))
 	}
 	return tmpval(buf)
@@ -304,7 +341,8 @@ func appendStr(exp expr, buf []byte, alloc bool) expr {
 		exp[len(exp)-1] = v
 		return exp
 	case tmpval:
-		v = append(v, buf...)
+		// v may refer to the input, so don't append to it in place.
+		v = append(v[:len(v):len(v)], buf...)
 		exp[len(exp)-1] = v
 		return exp
 	}
@@ -456,9 +494,13 @@ Again:
 					for i, vn := range varname {
 						if vr, ok := vn.(*varref); ok {
 							if vr.paren == oparen {
+								l := i + 1 + n + 1
+								if l > len(in) {
+									break
+								}
 								varname = varname[:i+1]
 								varname[i] = expr{literal(fmt.Sprintf("$%c", oparen)), vr.varname}
-								return &varref{varname: varname, paren: oparen}, i + 1 + n + 1, nil
+								return &varref{varname: varname, paren: oparen}, l, nil
 							}
 						}
 					}
@@ -484,7 +526,7 @@ Again:
 			switch token := e.(type) {
 			case literal, tmpval:
 				funcName := intern(token.String())
-				if f, ok := funcMap[funcName]; ok {
+				if f, ok := lookupFunc(funcName); ok {
 					return parseFunc(f(), in, i+1, term[:1], funcName, op.alloc)
 				}
 			}
@@ -502,8 +544,10 @@ Again:
 			}
 			i += 1 + n
 			if in[i] == paren {
+				// ${varname:xx} refers the variable "varname:xx".
 				varname = appendStr(varname, colon, op.alloc)
-				return &varref{varname: varname, paren: oparen}, i + 1, nil
+				varname = append(varname, toExpr(e)...)
+				return &varref{varname: compactExpr(varname), paren: oparen}, i + 1, nil
 			}
 			// ${varname:xx=...}
 			pat := e
@@ -664,7 +708,7 @@ func parseFunc(f mkFunc, in []byte, s int, term []byte, funcName string, alloc b
 	if compactor, ok := f.(compactor); ok {
 		fv = compactor.Compact()
 	}
-	if EvalStatsFlag || traceEvent.enabled() {
+	if EvalStatsFlag || EvalProfileFlag || traceEvent.enabled() {
 		fv = funcstats{
 			Value: fv,
 			str:   fv.String(),
@@ -684,11 +728,13 @@ type funcstats struct {
 }
 
 func (f funcstats) Eval(w evalWriter, ev *Evaluator) error {
-	te := traceEvent.begin("func", literal(f.str), traceEventMain)
+	te := traceEvent.begin("func", literal(f.str), ev.tid)
+	pd := ev.profBegin(ProfileFunc, f.str)
 	err := f.Value.Eval(w, ev)
 	if err != nil {
 		return err
 	}
+	ev.profEnd(pd)
 	// TODO(ukai): per functype?
 	traceEvent.end(te)
 	return nil
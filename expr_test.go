@@ -53,6 +53,10 @@ func TestParseExpr(t *testing.T) {
 			in:  "$(foo)",
 			val: &varref{varname: literal("foo"), paren: '('},
 		},
+		{
+			in:  "${foo:M*.c}",
+			val: &varref{varname: expr{literal("foo:"), literal("M*.c")}, paren: '{'},
+		},
 		{
 			in: "$(foo:.c=.o)",
 			val: varsubst{
@@ -35,28 +35,58 @@ type vpath struct {
 type searchPaths struct {
 	vpaths []vpath  // vpath directives
 	dirs   []string // VPATH variable
+	// sess is the Session of the evaluation, or nil for
+	// DefaultSession.
+	sess *Session
 }
 
+func (s searchPaths) session() *Session {
+	if s.sess == nil {
+		return DefaultSession
+	}
+	return s.sess
+}
+
+// exists returns the path of target, which is target itself if it
+// exists, or found in the search paths. Directories of the search
+// paths are read through the wildcard cache. For an archive member
+// reference, the archive is searched, and the member must be in it.
 func (s searchPaths) exists(target string) (string, bool) {
+	if archive, member, ok := splitArchiveMember(target); ok {
+		archive, ok = s.exists(archive)
+		if !ok || archiveMemberTimestamp(archive, member) == -2 {
+			return target, false
+		}
+		return archive + "(" + member + ")", true
+	}
 	if exists(target) {
 		return target, true
 	}
+	if filepath.IsAbs(target) {
+		return target, false
+	}
+	wc := s.session().wildcardCache
 	for _, vpath := range s.vpaths {
 		if !matchPattern(vpath.pattern, target) {
 			continue
 		}
 		for _, dir := range vpath.dirs {
 			vtarget := filepath.Join(dir, target)
-			if exists(vtarget) {
+			if wc.exists(vtarget) {
 				return vtarget, true
 			}
 		}
 	}
 	for _, dir := range s.dirs {
 		vtarget := filepath.Join(dir, target)
-		if exists(vtarget) {
+		if wc.exists(vtarget) {
 			return vtarget, true
 		}
 	}
 	return target, false
 }
+
+// empty reports whether s has no search paths.
+func (s searchPaths) empty() bool {
+	return len(s.vpaths) == 0 && len(s.dirs) == 0
+}
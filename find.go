@@ -0,0 +1,914 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// find command emulator.
+//
+// A $(shell) command running find is served from the find cache if it
+// is in the form
+//
+//	[cd DIR (;|&&)] find [-L|-P] [PATH...] [EXPR] [2>/dev/null]
+//
+// where EXPR consists of -name, -path, -wholename, -type [fdl],
+// -newer, -mtime, -mmin, -prune, -print, -true, -false, -maxdepth,
+// -mindepth, !, -not, -a, -and, -o, -or and parentheses. Other commands, e.g. ones using shell
+// variables, globs or other find predicates, run in the shell. So do
+// commands the cache can't answer, e.g. paths out of the tree, paths
+// in pruned directories, or symlinks with -L to directories out of the
+// tree. see findcache_link.go
+//
+// Files are printed in the order of their paths, which may differ from
+// the order of find, i.e. the order of entries in directories.
+//
+// Files are stat'ed for time predicates, rather than using modification
+// times recorded by the scan, as files may be modified after the scan
+// without modifying their directories, e.g. by $(shell) commands or
+// before the cache loaded from a file is used.
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+var errFindUnsupported = errors.New("unsupported find command")
+
+// findCommand is a parsed find command.
+type findCommand struct {
+	chdir    string
+	follow   bool // -L
+	roots    []string
+	cond     findCond
+	mindepth int
+	maxdepth int // -1 if unlimited.
+	// quiet is true if errors of find are discarded by 2>/dev/null.
+	quiet bool
+	// newers are -newer predicates, whose reference times are set
+	// when fc runs.
+	newers []*findNewer
+
+	// now is set when fc runs. See findCtx.
+	now int64
+}
+
+// findCtx is the state of the evaluation of a find expression for a
+// file.
+type findCtx struct {
+	path string // printed path.
+	name string // base name for -name.
+	typ  findFileType
+	fi   fileInfo
+	// now is the start time of find in nanoseconds.
+	now int64
+	// statMtime is true if mtime of fi must be stat'ed, i.e. until
+	// it is stat'ed once.
+	statMtime bool
+	// follow is true for -L, which stats the file a symlink resolves
+	// to.
+	follow bool
+	// prune is set by -prune.
+	prune bool
+	out   []string
+	// failed is set if the file can't be evaluated with the cache.
+	failed bool
+}
+
+// mtime returns the modification time of the file in nanoseconds.
+func (ctx *findCtx) mtime() int64 {
+	if !ctx.statMtime && ctx.fi.mtime != 0 {
+		return ctx.fi.mtime
+	}
+	stat := os.Lstat
+	if ctx.follow {
+		stat = os.Stat
+	}
+	st, err := stat(filepath.FromSlash(ctx.fi.path))
+	if err != nil {
+		ctx.failed = true
+		return 0
+	}
+	ctx.fi.mtime = st.ModTime().UnixNano()
+	ctx.statMtime = false
+	return ctx.fi.mtime
+}
+
+// findFileType is a file type for -type.
+type findFileType uint8
+
+const (
+	findFileRegular findFileType = iota
+	findFileDir
+	findFileSymlink
+	findFileOther
+)
+
+type findCond interface {
+	eval(ctx *findCtx) bool
+}
+
+type findName string
+
+func (c findName) eval(ctx *findCtx) bool { return fnmatch(string(c), ctx.name) }
+
+type findPath string
+
+func (c findPath) eval(ctx *findCtx) bool { return fnmatch(string(c), ctx.path) }
+
+type findType findFileType
+
+func (c findType) eval(ctx *findCtx) bool { return ctx.typ == findFileType(c) }
+
+// findNewer is -newer, which is true if the file is modified after
+// file.
+type findNewer struct {
+	file  string
+	mtime int64
+}
+
+func (c *findNewer) eval(ctx *findCtx) bool { return ctx.mtime() > c.mtime }
+
+// findTime is -mtime and -mmin, which compare the age of the file in
+// units with n, as GNU find does.
+type findTime struct {
+	unit time.Duration
+	cmp  byte // '+', '-' or 0.
+	n    int64
+}
+
+func (c findTime) eval(ctx *findCtx) bool {
+	mtime := ctx.mtime()
+	// -mtime n is true if the age is in [n, n+1) days, and -mmin n is
+	// true if it is in [n-1, n) minutes.
+	ref := ctx.now - c.n*int64(c.unit)
+	if c.unit == 24*time.Hour {
+		ref -= int64(c.unit)
+	}
+	switch c.cmp {
+	case '+':
+		return mtime < ref
+	case '-':
+		if c.unit == 24*time.Hour {
+			// GNU find counts a partial day for -mtime -n.
+			ref += int64(c.unit - time.Second)
+		}
+		return mtime > ref
+	}
+	return ref < mtime && mtime <= ref+int64(c.unit)
+}
+
+type findPrune struct{}
+
+func (findPrune) eval(ctx *findCtx) bool {
+	ctx.prune = true
+	return true
+}
+
+type findPrint struct{}
+
+func (findPrint) eval(ctx *findCtx) bool {
+	ctx.out = append(ctx.out, ctx.path)
+	return true
+}
+
+type findBool bool
+
+func (c findBool) eval(ctx *findCtx) bool { return bool(c) }
+
+type findNot struct{ c findCond }
+
+func (c findNot) eval(ctx *findCtx) bool { return !c.c.eval(ctx) }
+
+type findAnd struct{ lhs, rhs findCond }
+
+func (c findAnd) eval(ctx *findCtx) bool { return c.lhs.eval(ctx) && c.rhs.eval(ctx) }
+
+type findOr struct{ lhs, rhs findCond }
+
+func (c findOr) eval(ctx *findCtx) bool { return c.lhs.eval(ctx) || c.rhs.eval(ctx) }
+
+// shellToken is a token of a shell command. op is true for unquoted
+// operators, e.g. ";", "&&" or "2>".
+type shellToken struct {
+	s  string
+	op bool
+}
+
+// splitShellCommand splits a simple shell command into tokens. It
+// returns false if cmd has shell constructs other than quotes and
+// operators, e.g. variables, globs or command substitutions.
+func splitShellCommand(cmd string) ([]shellToken, bool) {
+	var toks []shellToken
+	var word []byte
+	inWord := false
+	quoted := false
+	flush := func() {
+		if inWord {
+			toks = append(toks, shellToken{s: string(word)})
+		}
+		word = word[:0]
+		inWord = false
+		quoted = false
+	}
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch c {
+		case ' ', '\t', '\n':
+			flush()
+		case '\\':
+			i++
+			if i == len(cmd) {
+				return nil, false
+			}
+			if cmd[i] != '\n' {
+				word = append(word, cmd[i])
+				inWord = true
+				quoted = true
+			}
+		case '\'':
+			j := strings.IndexByte(cmd[i+1:], '\'')
+			if j < 0 {
+				return nil, false
+			}
+			word = append(word, cmd[i+1:i+1+j]...)
+			i += j + 1
+			inWord = true
+			quoted = true
+		case '"':
+			i++
+			for ; i < len(cmd) && cmd[i] != '"'; i++ {
+				switch cmd[i] {
+				case '$', '`':
+					return nil, false
+				case '\\':
+					if i+1 < len(cmd) && strings.IndexByte("\\\"\n", cmd[i+1]) >= 0 {
+						i++
+					}
+				}
+				word = append(word, cmd[i])
+			}
+			if i == len(cmd) {
+				return nil, false
+			}
+			inWord = true
+			quoted = true
+		case ';':
+			flush()
+			toks = append(toks, shellToken{s: ";", op: true})
+		case '&':
+			if i+1 == len(cmd) || cmd[i+1] != '&' {
+				return nil, false
+			}
+			flush()
+			toks = append(toks, shellToken{s: "&&", op: true})
+			i++
+		case '>':
+			if !inWord || quoted || string(word) != "2" {
+				return nil, false
+			}
+			word = word[:0]
+			inWord = false
+			toks = append(toks, shellToken{s: "2>", op: true})
+		case '$', '`', '|', '<', '(', ')', '*', '?', '[', ']', '{', '}':
+			return nil, false
+		case '~', '#':
+			if !inWord {
+				return nil, false
+			}
+			word = append(word, c)
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+	flush()
+	return toks, true
+}
+
+// parseFindCommand parses cmd as a find command.
+func parseFindCommand(cmd string) (*findCommand, error) {
+	toks, ok := splitShellCommand(cmd)
+	if !ok {
+		return nil, errFindUnsupported
+	}
+	fc := &findCommand{maxdepth: -1}
+	if len(toks) >= 3 && toks[0] == (shellToken{s: "cd"}) && !toks[1].op && (toks[2].s == ";" || toks[2].s == "&&") && toks[2].op {
+		fc.chdir = toks[1].s
+		toks = toks[3:]
+	}
+	if len(toks) > 2 && toks[len(toks)-2] == (shellToken{s: "2>", op: true}) && toks[len(toks)-1] == (shellToken{s: "/dev/null"}) {
+		fc.quiet = true
+		toks = toks[:len(toks)-2]
+	}
+	var args []string
+	for _, tok := range toks {
+		if tok.op {
+			return nil, errFindUnsupported
+		}
+		args = append(args, tok.s)
+	}
+	if len(args) == 0 || args[0] != "find" {
+		return nil, errFindUnsupported
+	}
+	args = args[1:]
+	for len(args) > 0 && (args[0] == "-L" || args[0] == "-P") {
+		fc.follow = args[0] == "-L"
+		args = args[1:]
+	}
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") && args[0] != "!" && args[0] != "(" {
+		fc.roots = append(fc.roots, args[0])
+		args = args[1:]
+	}
+	if len(fc.roots) == 0 {
+		fc.roots = []string{"."}
+	}
+	p := &findParser{args: args, fc: fc}
+	cond := findCond(findBool(true))
+	if len(args) > 0 {
+		var err error
+		cond, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if len(p.args) > 0 {
+			return nil, errFindUnsupported
+		}
+	}
+	if !p.hasPrint {
+		cond = findAnd{cond, findPrint{}}
+	}
+	fc.cond = cond
+	return fc, nil
+}
+
+type findParser struct {
+	args     []string
+	fc       *findCommand
+	hasPrint bool
+}
+
+func (p *findParser) peek() string {
+	if len(p.args) == 0 {
+		return ""
+	}
+	return p.args[0]
+}
+
+func (p *findParser) next() (string, error) {
+	if len(p.args) == 0 {
+		return "", errFindUnsupported
+	}
+	arg := p.args[0]
+	p.args = p.args[1:]
+	return arg, nil
+}
+
+func (p *findParser) parseOr() (findCond, error) {
+	c, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "-o" || p.peek() == "-or" {
+		p.args = p.args[1:]
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		c = findOr{c, rhs}
+	}
+	return c, nil
+}
+
+func (p *findParser) parseAnd() (findCond, error) {
+	c, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "", "-o", "-or", ")":
+			return c, nil
+		case "-a", "-and":
+			p.args = p.args[1:]
+		}
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		c = findAnd{c, rhs}
+	}
+}
+
+func (p *findParser) parseUnary() (findCond, error) {
+	arg, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch arg {
+	case "!", "-not":
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return findNot{c}, nil
+	case "(":
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if arg, err := p.next(); err != nil || arg != ")" {
+			return nil, errFindUnsupported
+		}
+		return c, nil
+	case "-name":
+		pat, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return findName(pat), nil
+	case "-path", "-wholename":
+		pat, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return findPath(pat), nil
+	case "-type":
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case "f":
+			return findType(findFileRegular), nil
+		case "d":
+			return findType(findFileDir), nil
+		case "l":
+			return findType(findFileSymlink), nil
+		}
+	case "-newer":
+		file, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		c := &findNewer{file: file}
+		p.fc.newers = append(p.fc.newers, c)
+		return c, nil
+	case "-mtime", "-mmin":
+		v, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		c := findTime{unit: time.Minute}
+		if arg == "-mtime" {
+			c.unit = 24 * time.Hour
+		}
+		if v != "" && (v[0] == '+' || v[0] == '-') {
+			c.cmp = v[0]
+			v = v[1:]
+		}
+		c.n, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || c.n < 0 {
+			return nil, errFindUnsupported
+		}
+		return c, nil
+	case "-prune":
+		return findPrune{}, nil
+	case "-print":
+		p.hasPrint = true
+		return findPrint{}, nil
+	case "-true":
+		return findBool(true), nil
+	case "-false":
+		return findBool(false), nil
+	case "-maxdepth", "-mindepth":
+		v, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errFindUnsupported
+		}
+		if arg == "-maxdepth" {
+			p.fc.maxdepth = n
+		} else {
+			p.fc.mindepth = n
+		}
+		return findBool(true), nil
+	}
+	return nil, errFindUnsupported
+}
+
+// fnmatch reports whether name matches the shell pattern pat, as
+// fnmatch(3) with no flags does, i.e. '*' and '?' match '/' and '.'.
+func fnmatch(pat, name string) bool {
+	for len(pat) > 0 {
+		switch pat[0] {
+		case '*':
+			pat = pat[1:]
+			if pat == "" {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if fnmatch(pat, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(name)
+			pat, name = pat[1:], name[n:]
+		case '[':
+			if name == "" {
+				return false
+			}
+			r, n := utf8.DecodeRuneInString(name)
+			m, np, ok := matchBracket(pat[1:], r)
+			if !ok {
+				// '[' without ']' matches itself.
+				if name[0] != '[' {
+					return false
+				}
+				pat, name = pat[1:], name[1:]
+				continue
+			}
+			if !m {
+				return false
+			}
+			pat, name = pat[1+np:], name[n:]
+		case '\\':
+			if len(pat) > 1 {
+				pat = pat[1:]
+			}
+			fallthrough
+		default:
+			if name == "" || name[0] != pat[0] {
+				return false
+			}
+			pat, name = pat[1:], name[1:]
+		}
+	}
+	return name == ""
+}
+
+// matchBracket matches r with a bracket expression in pat, which
+// follows '['. It returns the number of bytes of pat consumed including
+// the closing ']', or false if pat has no closing ']'.
+func matchBracket(pat string, r rune) (matched bool, n int, ok bool) {
+	negate := false
+	if len(pat) > 0 && (pat[0] == '!' || pat[0] == '^') {
+		negate = true
+		n++
+	}
+	for first := true; ; first = false {
+		if n == len(pat) {
+			return false, 0, false
+		}
+		if pat[n] == ']' && !first {
+			return matched != negate, n + 1, true
+		}
+		lo, size := utf8.DecodeRuneInString(pat[n:])
+		if lo == '\\' && n+1 < len(pat) {
+			n++
+			lo, size = utf8.DecodeRuneInString(pat[n:])
+		}
+		n += size
+		hi := lo
+		if n+1 < len(pat) && pat[n] == '-' && pat[n+1] != ']' {
+			hi, size = utf8.DecodeRuneInString(pat[n+1:])
+			n += 1 + size
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+	}
+}
+
+// findCacheFileType returns the type of fi in the find cache.
+func findCacheFileType(fi fileInfo) findFileType {
+	switch {
+	case fi.mode.IsDir():
+		return findFileDir
+	case fi.mode&os.ModeSymlink != 0:
+		return findFileSymlink
+	case fi.mode.IsRegular():
+		return findFileRegular
+	}
+	return findFileOther
+}
+
+// evalFindCommand runs cmd with the find cache if cmd is a find
+// command the cache can answer, and returns the size of the output of
+// the command, i.e. found paths in lines. ok is false if cmd must run
+// in the shell.
+func evalFindCommand(w evalWriter, sess *Session, cmd string) (n int, ok bool) {
+	if !UseFindCache || !strings.Contains(cmd, "find") {
+		return 0, false
+	}
+	fc, err := parseFindCommand(cmd)
+	if err != nil {
+		glog.V(1).Infof("find emulator: %q: %v", cmd, err)
+		return 0, false
+	}
+	c := sess.findCache()
+	var out []string
+	ok = c.query(fc.queryPaths(), false, func(c *androidFindCacheT) bool {
+		out, ok = c.find(fc)
+		return ok
+	})
+	c.countFind(ok)
+	if !ok {
+		glog.Warningf("find emulator: androidFindCache is not ready or couldn't handle %q: call original shell", cmd)
+		return 0, false
+	}
+	for _, p := range out {
+		w.writeWordString(p)
+		n += len(p) + 1
+	}
+	return n, true
+}
+
+// queryPaths returns the paths which fc finds files under, for
+// androidFindCacheT.query.
+func (fc *findCommand) queryPaths() []string {
+	chdir := "."
+	if fc.chdir != "" {
+		dir, ok := findCacheDir(fc.chdir)
+		if !ok {
+			return nil
+		}
+		chdir = filepath.ToSlash(dir)
+	}
+	var paths []string
+	if chdir != "." {
+		paths = append(paths, chdir)
+	}
+	for _, root := range fc.roots {
+		paths = append(paths, joinFindPath(chdir, root))
+	}
+	return paths
+}
+
+// joinFindPath returns the path of p, a path given to find, whose current
+// directory is chdir.
+func joinFindPath(chdir, p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(chdir, p)
+}
+
+// lookupFile looks up p in the cache. ok is false if the cache doesn't
+// know whether p exists, e.g. p is in a pruned directory.
+func (c *androidFindCacheT) lookupFile(p string) (fi fileInfo, exists, ok bool) {
+	if p == "." {
+		return fileInfo{path: ".", mode: os.ModeDir}, true, true
+	}
+	i := sort.Search(len(c.files), func(i int) bool { return c.files[i].path >= p })
+	if i < len(c.files) && c.files[i].path == p {
+		return c.files[i], true, true
+	}
+	if c.isPruned(p) {
+		return fileInfo{}, false, false
+	}
+	// parents of roots are out of the cache.
+	if root := c.roots.rootOf(p); root == "" || root == p {
+		return fileInfo{}, false, false
+	}
+	// p doesn't exist if its parent is a scanned directory.
+	parent, exists, ok := c.lookupFile(slashDir(p))
+	if !ok || (exists && !parent.mode.IsDir()) {
+		return fileInfo{}, false, false
+	}
+	return fileInfo{}, false, true
+}
+
+func (c *androidFindCacheT) isPruned(p string) bool {
+	i := sort.SearchStrings(c.pruned, p)
+	return i < len(c.pruned) && c.pruned[i] == p
+}
+
+// find returns files found by fc. It returns false if the cache
+// can't answer fc.
+func (c *androidFindCacheT) find(fc *findCommand) ([]string, bool) {
+	chdir := "."
+	if fc.chdir != "" {
+		dir, ok := findCacheDir(fc.chdir)
+		if !ok {
+			return nil, false
+		}
+		chdir = slashClean(dir)
+		cd, ok := c.roots.cachePath(chdir)
+		if !ok {
+			return nil, false
+		}
+		fi, exists, _ := c.lookupFile(cd)
+		if !exists || !fi.mode.IsDir() {
+			return nil, false
+		}
+	}
+	fc.now = time.Now().UnixNano()
+	for _, n := range fc.newers {
+		ref := filepath.FromSlash(joinFindPath(chdir, n.file))
+		stat := os.Lstat
+		if fc.follow {
+			stat = os.Stat
+		}
+		st, err := stat(ref)
+		if err != nil {
+			// find reports the error.
+			return nil, false
+		}
+		n.mtime = st.ModTime().UnixNano()
+	}
+	var out []string
+	for _, root := range fc.roots {
+		p := joinFindPath(chdir, root)
+		if !isSlashPath(p) {
+			return nil, false
+		}
+		// p is looked up in the root it is in.
+		p, ok := c.roots.cachePath(p)
+		if !ok {
+			return nil, false
+		}
+		fi, exists, ok := c.lookupFile(p)
+		if !ok {
+			return nil, false
+		}
+		if !exists {
+			// find reports the error.
+			if fc.quiet {
+				continue
+			}
+			return nil, false
+		}
+		typ := findCacheFileType(fi)
+		if typ == findFileSymlink && (fc.follow || strings.HasSuffix(root, "/")) {
+			fi, ok = c.followLink(fi)
+			if !ok {
+				return nil, false
+			}
+			typ = findCacheFileType(fi)
+			if typ == findFileDir {
+				p = fi.path
+			}
+		}
+		pruned, ok := fc.visit(&out, root, path.Base(root), fi, 0)
+		if !ok {
+			return nil, false
+		}
+		if pruned || typ != findFileDir || fc.maxdepth == 0 {
+			continue
+		}
+		if !c.findUnder(fc, &out, p, root, 0, nil) {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// findUnder finds files under the directory p, which is printed as
+// root, whose depth is base. spans are the path walked to p by
+// following symlinks.
+func (c *androidFindCacheT) findUnder(fc *findCommand, out *[]string, p, root string, base int, spans []symlinkSpan) bool {
+	prefix := p + "/"
+	if p == "." {
+		prefix = ""
+	}
+	rootPrefix := root
+	if !strings.HasSuffix(root, "/") {
+		rootPrefix += "/"
+	}
+	i := sort.Search(len(c.files), func(i int) bool { return c.files[i].path >= prefix })
+	j := sort.SearchStrings(c.pruned, prefix)
+	// directories pruned by fc.
+	skips := make(map[string]bool)
+	for {
+		var fi fileInfo
+		scanPruned := false
+		switch {
+		case i < len(c.files) && strings.HasPrefix(c.files[i].path, prefix) &&
+			(j == len(c.pruned) || !strings.HasPrefix(c.pruned[j], prefix) || c.files[i].path < c.pruned[j]):
+			fi = c.files[i]
+			i++
+		case j < len(c.pruned) && strings.HasPrefix(c.pruned[j], prefix):
+			// contents of directories pruned by the scan are unknown.
+			fi = fileInfo{path: c.pruned[j], mode: os.ModeDir}
+			scanPruned = true
+			j++
+		default:
+			return true
+		}
+		if prefix == "" && isOutOfTree(fi.path) {
+			// files of extra roots out of the tree.
+			continue
+		}
+		rel := fi.path[len(prefix):]
+		depth := base + 1
+		skipped := false
+		for k := 0; k < len(rel); k++ {
+			if rel[k] == '/' {
+				depth++
+				if skips[rel[:k]] {
+					skipped = true
+					break
+				}
+			}
+		}
+		if skipped || (fc.maxdepth >= 0 && depth > fc.maxdepth) {
+			continue
+		}
+		typ := findCacheFileType(fi)
+		// linkSpans are spans to the directory a followed symlink
+		// resolves to.
+		var linkSpans []symlinkSpan
+		if typ == findFileSymlink && fc.follow {
+			t, ok := c.followLink(fi)
+			if !ok {
+				return false
+			}
+			if t.mode.IsDir() {
+				linkSpans = append(spans[:len(spans):len(spans)], symlinkSpan{start: p, pos: slashDir(fi.path)})
+			}
+			fi, typ = t, findCacheFileType(t)
+		}
+		loopSpans := spans
+		if linkSpans != nil {
+			loopSpans = linkSpans
+		}
+		if typ == findFileDir && symlinkLoop(loopSpans, fi.path) {
+			// find reports the loop.
+			if !fc.quiet {
+				return false
+			}
+			skips[rel] = true
+			continue
+		}
+		pruned, ok := fc.visit(out, rootPrefix+rel, path.Base(rel), fi, depth)
+		if !ok {
+			return false
+		}
+		if typ != findFileDir || (fc.maxdepth >= 0 && depth >= fc.maxdepth) {
+			continue
+		}
+		if pruned {
+			skips[rel] = true
+			continue
+		}
+		if scanPruned {
+			return false
+		}
+		if linkSpans != nil {
+			if len(linkSpans) > FindCacheSymlinkDepth || !c.findUnder(fc, out, fi.path, rootPrefix+rel, depth, linkSpans) {
+				return false
+			}
+		}
+	}
+}
+
+// visit evaluates the expression of fc for fi printed as p, and
+// appends printed paths to out. It returns true if fi is pruned, or
+// false for ok if fi can't be evaluated.
+func (fc *findCommand) visit(out *[]string, p, name string, fi fileInfo, depth int) (pruned, ok bool) {
+	if depth < fc.mindepth {
+		return false, true
+	}
+	ctx := findCtx{
+		path:      p,
+		name:      name,
+		typ:       findCacheFileType(fi),
+		fi:        fi,
+		now:       fc.now,
+		statMtime: true,
+		follow:    fc.follow,
+	}
+	fc.cond.eval(&ctx)
+	if ctx.failed {
+		return false, false
+	}
+	*out = append(*out, ctx.out...)
+	return ctx.prune, true
+}
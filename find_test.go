@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFnmatch(t *testing.T) {
+	for _, tc := range []struct {
+		pat, name string
+		want      bool
+	}{
+		{pat: "*.c", name: "a.c", want: true},
+		{pat: "*.c", name: ".c", want: true},
+		{pat: "*.c", name: "a.h"},
+		{pat: "./a/*", name: "./a/b/c", want: true},
+		{pat: "?", name: "/", want: true},
+		{pat: "x[0-9].c", name: "x1.c", want: true},
+		{pat: "x[!0-9].c", name: "x1.c"},
+		{pat: "x[^0-9].c", name: "xa.c", want: true},
+		{pat: "[]a]", name: "]", want: true},
+		{pat: "a[", name: "a[", want: true},
+		{pat: `\*`, name: "*", want: true},
+		{pat: `\*`, name: "a"},
+	} {
+		if got := fnmatch(tc.pat, tc.name); got != tc.want {
+			t.Errorf("fnmatch(%q, %q)=%t; want %t", tc.pat, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseFindCommandUnsupported(t *testing.T) {
+	for _, cmd := range []string{
+		"find . -name *.c",
+		`find . -name '*.c' -exec rm {} \;`,
+		"find $(HOME) -name x",
+		"find . -name x | sort",
+		"find . -name x > out",
+		"cd a || find .",
+		"find ~ -name x",
+		"find . -type s",
+		"find . ( -name x )",
+		"ls -R",
+	} {
+		if fc, err := parseFindCommand(cmd); err == nil {
+			t.Errorf("parseFindCommand(%q)=%+v; want error", cmd, fc)
+		}
+	}
+}
+
+func TestFindEmulator(t *testing.T) {
+	findPath, err := exec.LookPath("find")
+	if err != nil {
+		t.Skip(err)
+	}
+	chdirTempDir(t)
+	for _, fn := range []string{
+		"a/x1.c", "a/y.c", "a/.hidden.c", "a/sub/x2.c", "a/sub/Android.mk",
+		"b/Android.mk", "b/z.h", "b/.git/config", "c/d/e/f.c",
+		"out/obj/x.o", "a-b.c",
+	} {
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"b/link":   "../a",
+		"c/d/up":   "..",
+		"c/dangle": "none",
+	} {
+		err = os.Symlink(target, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for fn, age := range map[string]time.Duration{
+		"a/x1.c":    72 * time.Hour,
+		"a/y.c":     2 * time.Hour,
+		"b/z.h":     10 * time.Minute,
+		"a/stamp":   time.Hour,
+		"c/d/e/f.c": 30 * time.Hour,
+	} {
+		if fn == "a/stamp" {
+			err = ioutil.WriteFile(fn, nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = os.Chtimes(fn, now.Add(-age), now.Add(-age))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &androidFindCacheT{}
+	c.filesch = make(chan []fileInfo, 1)
+	c.leavesch = make(chan []fileInfo, 1)
+	c.start([]string{"out"}, nil)
+	c.files = <-c.filesch
+
+	for _, tc := range []struct {
+		cmd    string
+		wantOK bool
+	}{
+		{cmd: "find . -name '*.c' -o -name out -prune", wantOK: true},
+		{cmd: "find a -type d", wantOK: true},
+		{cmd: "find a/ b -name Android.mk", wantOK: true},
+		{cmd: `find . -path './a/*' -prune -o -path ./out -prune -o -type f -a -not -path "./b*" -print`, wantOK: true},
+		{cmd: `find . -path './a/*' -prune -o -type f -a -not -path "./out*" -print`, wantOK: false},
+		{cmd: "find . -maxdepth 1", wantOK: true},
+		{cmd: "find a c -mindepth 2 -type f", wantOK: true},
+		{cmd: "find c -maxdepth 2 -mindepth 1", wantOK: true},
+		{cmd: "cd a && find . -type f -a ! -name 'x*'", wantOK: true},
+		{cmd: "cd a/sub ; find ../sub", wantOK: true},
+		{cmd: "cd a ; find ../..", wantOK: false},
+		{cmd: `find . \( -name .git -o -name out \) -prune -o -type f -print`, wantOK: true},
+		{cmd: "find b -type l", wantOK: true},
+		{cmd: "find b/link", wantOK: true},
+		{cmd: "find . -name 'x[0-9].c' -print -o -name out -prune", wantOK: true},
+		{cmd: "find none a/y.c 2>/dev/null", wantOK: true},
+		{cmd: "find none", wantOK: false},
+		{cmd: "find -L b -name '*.c'", wantOK: true},
+		{cmd: "find -L b/link/ -type d", wantOK: true},
+		{cmd: "find -L c -type l", wantOK: false},
+		{cmd: "find -L c -maxdepth 2 2>/dev/null", wantOK: true},
+		{cmd: "find -L c -name '*.c' 2>/dev/null", wantOK: true},
+		{cmd: "find -L .", wantOK: false},
+		{cmd: "find . -type f", wantOK: false},
+		{cmd: "find out/obj", wantOK: false},
+		{cmd: "find . -name out -prune -o -newer a/stamp -type f -print", wantOK: true},
+		{cmd: "cd a && find . ../b ! -newer stamp", wantOK: true},
+		{cmd: "find a b c -mtime +1", wantOK: true},
+		{cmd: "find a b c -mtime -1 -type f", wantOK: true},
+		{cmd: "find a b c -mtime 1", wantOK: true},
+		{cmd: "find a b c -type f -mmin -30", wantOK: true},
+		{cmd: "find a b c -mmin +30", wantOK: true},
+		{cmd: "find a b c -mmin 11", wantOK: true},
+		{cmd: "find a -newer none", wantOK: false},
+	} {
+		fc, err := parseFindCommand(tc.cmd)
+		if err != nil {
+			t.Errorf("parseFindCommand(%q): %v", tc.cmd, err)
+			continue
+		}
+		got, ok := c.find(fc)
+		if ok != tc.wantOK {
+			t.Errorf("find(%q)=%q, %t; want ok=%t", tc.cmd, got, ok, tc.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		out, err := exec.Command("/bin/sh", "-c", strings.Replace(tc.cmd, "find", findPath, 1)).Output()
+		if err != nil && !strings.Contains(tc.cmd, "2>/dev/null") {
+			t.Errorf("%s: %v", tc.cmd, err)
+			continue
+		}
+		want := strings.Fields(string(out))
+		sort.Strings(want)
+		sort.Strings(got)
+		if (len(got) > 0 || len(want) > 0) && !reflect.DeepEqual(got, want) {
+			t.Errorf("find(%q)=%q; want %q", tc.cmd, got, want)
+		}
+	}
+
+	// a/y.c is modified after the scan, which recorded its mtime.
+	for i := range c.files {
+		if c.files[i].path == "a/y.c" {
+			c.files[i].mtime = now.Add(-2 * time.Hour).UnixNano()
+		}
+	}
+	err = os.Chtimes("a/y.c", now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"find a -name y.c -newer a/stamp",
+		"find a -name y.c -mmin -1",
+	} {
+		fc, err := parseFindCommand(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"a/y.c"}
+		got, ok := c.find(fc)
+		if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("find(%q) after a/y.c is modified=%q, %t; want %q, true", cmd, got, ok, want)
+		}
+	}
+}
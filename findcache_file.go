@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Find cache file.
+//
+// The find cache scans the whole source tree, which dominates the time
+// of a null build of a large tree. If FindCacheFile is set, the scanned
+// files are saved into the file with modification times of the
+// scanned directories, and the next kati loads the file instead of
+// scanning the tree again. The file is used only if none of the
+// directories are modified, i.e. no file is created, removed or
+// renamed in them, and it was saved with the same prunes, leaf names,
+// ignore patterns and extra roots in the same directory.
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const findCacheFileVersion = 3
+
+// findCacheDirMtime is a scanned directory and its modification time in
+// nanoseconds.
+type findCacheDirMtime struct {
+	Path  string
+	Mtime int64
+}
+
+type findCacheEntry struct {
+	Path  string
+	Mode  os.FileMode
+	Mtime int64
+}
+
+type findCacheFile struct {
+	Version   int
+	Dir       string // the current directory.
+	Prunes    []string
+	LeafNames []string
+	Ignore    []string
+	Roots     []string
+	Entries   []findCacheEntry
+	Dirs      []findCacheDirMtime
+	Pruned    []string
+	Links     map[string]findCacheLink
+
+	// files are the scanned files sorted by path, saved as Entries.
+	files []fileInfo
+}
+
+func saveFindCacheFile(filename string, fc findCacheFile) error {
+	startTime := time.Now()
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fc.Version = findCacheFileVersion
+	fc.Dir = wd
+	fc.Entries = make([]findCacheEntry, 0, len(fc.files))
+	for _, fi := range fc.files {
+		fc.Entries = append(fc.Entries, findCacheEntry{Path: fi.path, Mode: fi.mode, Mtime: fi.mtime})
+	}
+	tmpfile := filename + ".tmp"
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(fc)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	logStats("find cache save time: %q", time.Since(startTime))
+	return nil
+}
+
+func loadFindCacheFile(filename string) (findCacheFile, error) {
+	var fc findCacheFile
+	f, err := os.Open(filename)
+	if err != nil {
+		return fc, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&fc)
+	if err != nil {
+		return fc, err
+	}
+	if fc.Version != findCacheFileVersion {
+		return fc, fmt.Errorf("version mismatch: %d", fc.Version)
+	}
+	fc.files = make([]fileInfo, 0, len(fc.Entries))
+	for _, e := range fc.Entries {
+		fc.files = append(fc.files, fileInfo{path: e.Path, mode: e.Mode, mtime: e.Mtime})
+	}
+	fc.Entries = nil
+	return fc, nil
+}
+
+// modifiedDir returns a directory in dirs modified after it was
+// scanned, or "" if none of them is modified.
+func modifiedDir(dirs []findCacheDirMtime) string {
+	var modified atomic.Value
+	modified.Store("")
+	ch := make(chan findCacheDirMtime, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range ch {
+				if modified.Load().(string) != "" {
+					continue
+				}
+				fi, err := os.Lstat(filepath.FromSlash(d.Path))
+				if err != nil || !fi.IsDir() || fi.ModTime().UnixNano() != d.Mtime {
+					modified.Store(d.Path)
+				}
+			}
+		}()
+	}
+	for _, d := range dirs {
+		ch <- d
+	}
+	close(ch)
+	wg.Wait()
+	return modified.Load().(string)
+}
+
+// load loads the find cache from filename instead of scanning the
+// tree. It returns false if the file is not found or stale.
+func (c *androidFindCacheT) load(filename string, prunes, leafNames, ignore []string) bool {
+	fc, err := loadFindCacheFile(filename)
+	if err != nil {
+		glog.Infof("find cache file %s: %v", filename, err)
+		return false
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	if fc.Dir != wd || !reflect.DeepEqual(fc.Prunes, prunes) || !reflect.DeepEqual(fc.LeafNames, leafNames) || !reflect.DeepEqual(fc.Ignore, ignore) || !reflect.DeepEqual(fc.Roots, c.roots.paths) {
+		glog.Infof("find cache file %s: different config", filename)
+		return false
+	}
+	if d := modifiedDir(fc.Dirs); d != "" {
+		glog.Infof("find cache file %s: %s modified", filename, d)
+		return false
+	}
+	var leaves []fileInfo
+	for _, fi := range fc.files {
+		base := filepath.Base(fi.path)
+		for _, leaf := range leafNames {
+			if base == leaf {
+				leaves = append(leaves, fi)
+				break
+			}
+		}
+	}
+	for path, l := range fc.Links {
+		if l.Mode.IsDir() {
+			leaves = append(leaves, fileInfo{path: path, mode: os.ModeDir | os.ModeSymlink})
+		}
+	}
+	sort.Strings(fc.Pruned)
+	c.pruned = fc.Pruned
+	c.links = fc.Links
+	c.filesch <- fc.files
+	c.leavesch <- addLeafDirs(leaves)
+	logStats("%d files in find cache file %s", len(fc.files), filename)
+	c.setScanStats(len(fc.Dirs), len(fc.files), true)
+	c.setSnapshot(newFSSnapshot(fc.files, fc.Pruned, fc.Dirs))
+	return true
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindCacheFile(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"src/a/Android.mk", "src/b/x.c", "out/.find_cache"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Chdir("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []fileInfo{
+		{path: "a", mode: os.ModeDir | 0755},
+		{path: "a/Android.mk", mode: 0644},
+		{path: "b", mode: os.ModeDir | 0755},
+		{path: "b/x.c", mode: 0644},
+	}
+	var dirs []findCacheDirMtime
+	for _, d := range []string{".", "a", "b"} {
+		fi, err := os.Lstat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, findCacheDirMtime{Path: d, Mtime: fi.ModTime().UnixNano()})
+	}
+	cacheFile := "../out/.find_cache"
+	err = saveFindCacheFile(cacheFile, findCacheFile{
+		Prunes:    []string{"out"},
+		LeafNames: []string{"Android.mk"},
+		files:     files,
+		Dirs:      dirs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(prunes, leafNames []string, ignore ...string) (*androidFindCacheT, bool) {
+		c := &androidFindCacheT{
+			filesch:  make(chan []fileInfo, 1),
+			leavesch: make(chan []fileInfo, 1),
+		}
+		return c, c.load(cacheFile, prunes, leafNames, ignore)
+	}
+	c, ok := load([]string{"out"}, []string{"Android.mk"})
+	if !ok {
+		t.Fatalf("load=false; want true")
+	}
+	if got := <-c.filesch; !reflect.DeepEqual(got, files) {
+		t.Errorf("files=%v; want %v", got, files)
+	}
+	wantLeaves := []fileInfo{
+		{path: "a", mode: os.ModeDir | 0644},
+		{path: "a/Android.mk", mode: 0644},
+	}
+	if got := <-c.leavesch; !reflect.DeepEqual(got, wantLeaves) {
+		t.Errorf("leaves=%v; want %v", got, wantLeaves)
+	}
+
+	if _, ok := load([]string{"out"}, []string{"CleanSpec.mk"}); ok {
+		t.Errorf("load with other leaf names=true; want false")
+	}
+	if _, ok := load(nil, []string{"Android.mk"}); ok {
+		t.Errorf("load with other prunes=true; want false")
+	}
+	if _, ok := load([]string{"out"}, []string{"Android.mk"}, "node_modules"); ok {
+		t.Errorf("load with ignore patterns=true; want false")
+	}
+
+	err = ioutil.WriteFile("b/y.c", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	err = os.Chtimes("b", mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := load([]string{"out"}, []string{"Android.mk"}); ok {
+		t.Errorf("load after b modified=true; want false")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// Ignore patterns of the find cache.
+//
+// Patterns are in the syntax of .gitignore, relative to the top of the
+// tree, e.g.
+//
+//	# out of tree outputs
+//	/out-*/
+//	node_modules
+//	docs/**/generated
+//	!third_party/foo/node_modules
+//
+// A pattern without "/" but at the end matches directories named by
+// it anywhere, and others match paths from the top. "**" matches zero
+// or more directories. A pattern starting with "!" re-includes
+// directories excluded by earlier patterns. Directories matching the
+// patterns are not scanned, as prunes, and find commands descending
+// into them run in the shell. Files are always scanned, since the
+// cache must see all files in scanned directories to answer finds.
+
+// findCacheIgnore is a list of ignore patterns.
+type findCacheIgnore struct {
+	// patterns are the patterns as given, to tell whether the find
+	// cache file was scanned with the same ones.
+	patterns []string
+	rules    []ignoreRule
+}
+
+type ignoreRule struct {
+	// elems are elements of the pattern.
+	elems []string
+	// anchored is true if the pattern matches paths from the top of
+	// the tree, otherwise it matches names of directories.
+	anchored bool
+	negate   bool
+}
+
+func newFindCacheIgnore(patterns []string) findCacheIgnore {
+	if len(patterns) == 0 {
+		return findCacheIgnore{}
+	}
+	ig := findCacheIgnore{patterns: patterns}
+	for _, pat := range patterns {
+		var r ignoreRule
+		if strings.HasPrefix(pat, "!") {
+			r.negate = true
+			pat = pat[1:]
+		}
+		pat = strings.TrimSuffix(pat, "/")
+		if pat == "" {
+			continue
+		}
+		if strings.Contains(pat, "/") {
+			r.anchored = true
+			pat = strings.TrimPrefix(pat, "/")
+		}
+		r.elems = strings.Split(pat, "/")
+		ig.rules = append(ig.rules, r)
+	}
+	return ig
+}
+
+// ReadFindCacheIgnoreFile reads ignore patterns of the find cache in
+// filename, which is in the syntax of .gitignore. Blank lines and
+// lines starting with "#" are skipped.
+func ReadFindCacheIgnoreFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), " \t\r")
+		// "\ " at the end is a space.
+		if strings.HasSuffix(line, `\`) && len(line) < len(s.Text()) {
+			line += " "
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, s.Err()
+}
+
+// ignored reports whether the directory dir, a path in the cache, is
+// ignored, regardless of its parents.
+func (ig findCacheIgnore) ignored(dir string) bool {
+	if len(ig.rules) == 0 {
+		return false
+	}
+	elems := strings.Split(dir, "/")
+	ignored := false
+	for _, r := range ig.rules {
+		if ignored != r.negate {
+			// r doesn't change the result.
+			continue
+		}
+		var m bool
+		if r.anchored {
+			m = matchIgnoreElems(r.elems, elems)
+		} else {
+			m = fnmatch(r.elems[0], elems[len(elems)-1])
+		}
+		if m {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// underIgnored reports whether p, a path in the cache, is in or is an
+// ignored directory.
+func (ig findCacheIgnore) underIgnored(p string) bool {
+	if len(ig.rules) == 0 {
+		return false
+	}
+	for i := 0; i <= len(p); i++ {
+		if i == len(p) || p[i] == '/' {
+			if ig.ignored(p[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchIgnoreElems reports whether elems of a path match pat, whose
+// "**" elements match zero or more elements.
+func matchIgnoreElems(pat, elems []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchIgnoreElems(pat[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 || !fnmatch(pat[0], elems[0]) {
+			return false
+		}
+		pat, elems = pat[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindCacheIgnore(t *testing.T) {
+	ig := newFindCacheIgnore([]string{
+		"node_modules/",
+		"/out-*",
+		"docs/**/gen",
+		"*.tmp",
+		"!keep.tmp",
+		"!third_party/foo/node_modules",
+	})
+	for _, tc := range []struct {
+		dir  string
+		want bool
+	}{
+		{dir: "node_modules", want: true},
+		{dir: "a/b/node_modules", want: true},
+		{dir: "node_modules2"},
+		{dir: "out-arm", want: true},
+		{dir: "a/out-arm"},
+		{dir: "docs/gen", want: true},
+		{dir: "docs/a/b/gen", want: true},
+		{dir: "a/docs/gen"},
+		{dir: "x.tmp", want: true},
+		{dir: "a/keep.tmp"},
+		{dir: "third_party/foo/node_modules"},
+		{dir: "third_party/bar/node_modules", want: true},
+	} {
+		if got := ig.ignored(tc.dir); got != tc.want {
+			t.Errorf("ignored(%q)=%t; want %t", tc.dir, got, tc.want)
+		}
+	}
+	if !ig.underIgnored("a/node_modules/b/c.js") || ig.underIgnored("a/b/c.js") {
+		t.Errorf("underIgnored: a/node_modules/b/c.js should be ignored, a/b/c.js should not")
+	}
+}
+
+func TestReadFindCacheIgnoreFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# comment\n\nnode_modules/  \r\n\\#x\n!/out\ntrailing\\ \n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFindCacheIgnoreFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"node_modules/", `\#x`, "!/out", `trailing\ `}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFindCacheIgnoreFile=%q; want %q", got, want)
+	}
+}
+
+func TestFindCacheScanIgnore(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"app/a.js", "app/node_modules/m/b.js", "lib/node_modules.js"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &androidFindCacheT{ignore: newFindCacheIgnore([]string{"node_modules*"})}
+	c.filesch = make(chan []fileInfo, 1)
+	c.leavesch = make(chan []fileInfo, 1)
+	c.start(nil, nil)
+	c.files = <-c.filesch
+	var got []string
+	for _, fi := range c.files {
+		got = append(got, fi.path)
+	}
+	want := []string{"app", "app/a.js", "lib", "lib/node_modules.js"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files=%q; want %q", got, want)
+	}
+	if want := []string{"app/node_modules"}; !reflect.DeepEqual(c.pruned, want) {
+		t.Errorf("pruned=%q; want %q", c.pruned, want)
+	}
+	for _, tc := range []struct {
+		cmd    string
+		wantOK bool
+	}{
+		{cmd: "find app -name '*.js'"},
+		{cmd: "find app -name node_modules -prune -o -name '*.js' -print", wantOK: true},
+		{cmd: "find lib", wantOK: true},
+	} {
+		fc, err := parseFindCommand(tc.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.find(fc); ok != tc.wantOK {
+			t.Errorf("find(%q) ok=%t; want %t", tc.cmd, ok, tc.wantOK)
+		}
+	}
+	c.invalidate("app/node_modules/m/c.js")
+	if c.stale != 0 {
+		t.Errorf("stale after change in ignored directory")
+	}
+}
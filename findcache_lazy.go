@@ -0,0 +1,293 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Lazy scan of the find cache.
+//
+// The scan scans each top-level directory of the tree as a unit. While
+// it is running, a query of files under some top-level directories
+// scans them first unless scanned or being scanned, and is answered by
+// the view of them, in which other top-level directories are pruned
+// directories. Top-level files are scanned before directories. Queries
+// the view can't answer, e.g. ones of the whole tree or following
+// symlinks to other top-level directories, wait for the scan to finish
+// as before. Extra roots are scanned as top-level directories.
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// topScan is the scan of a top-level file or directory.
+type topScan struct {
+	path string
+	dir  bool
+	// root is true if path is an extra root.
+	root bool
+	// claimed is set to 1 by the scanner of the top.
+	claimed int32
+	// done is closed when the scan finishes.
+	done chan struct{}
+
+	// files are sorted.
+	files  []fileInfo
+	leaves []fileInfo
+	pruned []string
+	dirs   []findCacheDirMtime
+	links  map[string]findCacheLink
+	err    error
+}
+
+// claim reports whether the caller scans ts, i.e. no one else has
+// claimed it.
+func (ts *topScan) claim() bool {
+	return atomic.CompareAndSwapInt32(&ts.claimed, 0, 1)
+}
+
+// findCacheScanner scans tops with the config of the find cache.
+type findCacheScanner struct {
+	prunes    []string
+	leafNames []string
+	ignore    findCacheIgnore
+	roots     findCacheRoots
+	// wds are paths of the current directory for
+	// resolveFindCacheLink.
+	wds []string
+}
+
+// scan scans ts, and closes ts.done.
+func (s *findCacheScanner) scan(ts *topScan) {
+	defer close(ts.done)
+	ts.links = make(map[string]findCacheLink)
+	err := s.walk(ts)
+	if err != nil && err != filepath.SkipDir {
+		ts.err = err
+		return
+	}
+	sort.Sort(fileInfoByName(ts.files))
+}
+
+// visit records the file at path in ts. Only the type bits of mode may
+// be known, and mtime is 0 if unknown, which find stats when needed.
+// It returns false if path is a directory not to scan, i.e. pruned or
+// ignored.
+func (s *findCacheScanner) visit(ts *topScan, path string, mode os.FileMode, mtime int64) bool {
+	name := path[strings.LastIndexByte(path, '/')+1:]
+	if mode.IsDir() && (!ts.root || path != ts.path) {
+		if s.roots.isRoot(path) {
+			// scanned as a root.
+			return false
+		}
+		for _, prune := range s.prunes {
+			if name == prune {
+				glog.V(1).Infof("find cache prune: %s", path)
+				ts.pruned = append(ts.pruned, path)
+				return false
+			}
+		}
+		if !isOutOfTree(path) && s.ignore.ignored(path) {
+			glog.V(1).Infof("find cache ignore: %s", path)
+			ts.pruned = append(ts.pruned, path)
+			return false
+		}
+	}
+	if mode.IsDir() {
+		ts.dirs = append(ts.dirs, findCacheDirMtime{Path: path, Mtime: mtime})
+	}
+	if mode&os.ModeSymlink != 0 {
+		l := resolveFindCacheLink(filepath.FromSlash(path), s.wds)
+		if l.Exists && l.Target == "" {
+			l.Target = s.roots.linkTarget(filepath.FromSlash(path))
+		}
+		ts.links[path] = l
+		if l.Mode.IsDir() {
+			// findleaves descends into it.
+			ts.leaves = append(ts.leaves, fileInfo{
+				path: path,
+				mode: os.ModeDir | os.ModeSymlink,
+			})
+		}
+	}
+	ts.files = append(ts.files, fileInfo{
+		path:  path,
+		mode:  mode,
+		mtime: mtime,
+	})
+	for _, leaf := range s.leafNames {
+		if name == leaf {
+			glog.V(1).Infof("find cache leaf: %s", path)
+			ts.leaves = append(ts.leaves, fileInfo{
+				path: path,
+				mode: mode,
+			})
+			break
+		}
+	}
+	return true
+}
+
+// lazyScan is the running scan of the find cache.
+type lazyScan struct {
+	scanner findCacheScanner
+	tops    map[string]*topScan
+	// order are tops sorted by path.
+	order []*topScan
+
+	mu sync.Mutex
+	// views are the caches of sets of tops by their paths joined by
+	// " ".
+	views map[string]*androidFindCacheT
+}
+
+// newLazyScan returns the scan of the top-level entries of the tree
+// and the extra roots of s. Files in entries are scanned now, so views
+// of tops tell their types.
+func newLazyScan(s findCacheScanner, entries []os.FileInfo) *lazyScan {
+	l := &lazyScan{
+		scanner: s,
+		tops:    make(map[string]*topScan),
+	}
+	for _, fi := range entries {
+		if s.roots.isRoot(fi.Name()) {
+			continue
+		}
+		ts := &topScan{path: fi.Name(), dir: fi.IsDir(), done: make(chan struct{})}
+		l.tops[ts.path] = ts
+		l.order = append(l.order, ts)
+		if !ts.dir {
+			ts.claim()
+			l.scanner.scan(ts)
+		}
+	}
+	for _, root := range s.roots.paths {
+		ts := &topScan{path: root, dir: true, root: true, done: make(chan struct{})}
+		l.tops[ts.path] = ts
+		l.order = append(l.order, ts)
+	}
+	sort.Slice(l.order, func(i, j int) bool { return l.order[i].path < l.order[j].path })
+	return l
+}
+
+// lazyView returns the cache of the tops of paths, after scanning them
+// unless scanned. It returns nil if the scan has finished, or paths
+// need the whole tree.
+func (c *androidFindCacheT) lazyView(paths []string) *androidFindCacheT {
+	c.topsMu.Lock()
+	l := c.lazy
+	c.topsMu.Unlock()
+	if l == nil || len(paths) == 0 {
+		return nil
+	}
+	need := make(map[string]bool)
+	for _, p := range paths {
+		cp, ok := c.roots.cachePath(p)
+		if !ok {
+			return nil
+		}
+		top := c.roots.topOf(cp)
+		if top == "" {
+			return nil
+		}
+		ts := l.tops[top]
+		if ts == nil {
+			// the view tells it doesn't exist.
+			continue
+		}
+		if ts.claim() {
+			glog.V(1).Infof("find cache: scan %s for query", top)
+			l.scanner.scan(ts)
+		}
+		<-ts.done
+		need[top] = true
+	}
+	return l.view(need)
+}
+
+// view returns the cache of the scanned tops in need and top-level
+// files, in which other tops are pruned directories. It returns nil if
+// the scan of a top failed.
+func (l *lazyScan) view(need map[string]bool) *androidFindCacheT {
+	var tops []string
+	for top := range need {
+		tops = append(tops, top)
+	}
+	sort.Strings(tops)
+	key := strings.Join(tops, " ")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v, ok := l.views[key]; ok {
+		return v
+	}
+	v := &androidFindCacheT{
+		links: make(map[string]findCacheLink),
+		roots: l.scanner.roots,
+	}
+	var leaves []fileInfo
+	for _, ts := range l.order {
+		if ts.dir && !need[ts.path] {
+			v.pruned = append(v.pruned, ts.path)
+			continue
+		}
+		if ts.err != nil {
+			return nil
+		}
+		v.files = append(v.files, ts.files...)
+		leaves = append(leaves, ts.leaves...)
+		v.pruned = append(v.pruned, ts.pruned...)
+		for p, l := range ts.links {
+			v.links[p] = l
+		}
+	}
+	sort.Sort(fileInfoByName(v.files))
+	sort.Strings(v.pruned)
+	v.leaves = addLeafDirs(leaves)
+	if l.views == nil {
+		l.views = make(map[string]*androidFindCacheT)
+	}
+	l.views[key] = v
+	return v
+}
+
+// query answers a query of files under paths by fn, which returns
+// false if the cache passed can't answer it. While the scan is
+// running, fn is called with the view of the tops of paths first. It
+// returns false if no cache answers the query, and the command must run
+// in the shell.
+func (c *androidFindCacheT) query(paths []string, needLeaves bool, fn func(c *androidFindCacheT) bool) bool {
+	if !UseFindCache || atomic.LoadInt32(&c.stale) != 0 {
+		return false
+	}
+	if v := c.lazyView(paths); v != nil {
+		if fn(v) {
+			c.countLazy()
+			return true
+		}
+		glog.V(1).Infof("find cache: query of %q waits for the scan", paths)
+	}
+	if needLeaves {
+		if !c.leavesReady() {
+			return false
+		}
+	} else if !c.ready() {
+		return false
+	}
+	return fn(c)
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindCacheLazy(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"a/x.c", "a/sub/Android.mk", "a-b.c", "b/y.c", "README"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("../b", "a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := UseFindCache
+	defer func() { UseFindCache = saved }()
+	UseFindCache = true
+
+	f, err := os.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the scan hasn't scanned directories, and doesn't finish.
+	c := &androidFindCacheT{
+		filesch:  make(chan []fileInfo, 1),
+		leavesch: make(chan []fileInfo, 1),
+	}
+	c.lazy = newLazyScan(findCacheScanner{leafNames: []string{"Android.mk"}, wds: findCacheWds()}, entries)
+	close(c.filesch)
+	close(c.leavesch)
+
+	for _, tc := range []struct {
+		cmd    string
+		want   []string
+		wantOK bool
+	}{
+		{cmd: "find a -name '*.c'", want: []string{"a/x.c"}, wantOK: true},
+		{cmd: "find a-b.c none README 2>/dev/null", want: []string{"a-b.c", "README"}, wantOK: true},
+		{cmd: "cd a && find ../b", want: []string{"../b", "../b/y.c"}, wantOK: true},
+		{cmd: "find -L a -name '*.c'"},
+		{cmd: "find . -name '*.c'"},
+	} {
+		fc, err := parseFindCommand(tc.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		ok := c.query(fc.queryPaths(), false, func(c *androidFindCacheT) bool {
+			var ok bool
+			got, ok = c.find(fc)
+			return ok
+		})
+		if ok != tc.wantOK || (ok && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("find(%q)=%q, %t; want %q, %t", tc.cmd, got, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	for _, tc := range []struct {
+		dir    string
+		want   []string
+		wantOK bool
+	}{
+		{dir: "a/sub", want: []string{"./a/sub/Android.mk"}, wantOK: true},
+		// findleaves follows a/link to b.
+		{dir: "a"},
+	} {
+		wb := newWbuf()
+		ok := c.query([]string{tc.dir}, true, func(c *androidFindCacheT) bool {
+			return c.findleaves(wb, tc.dir, "Android.mk", nil, 0)
+		})
+		var got []string
+		for _, w := range wb.words {
+			got = append(got, string(w))
+		}
+		wb.release()
+		if ok != tc.wantOK || (ok && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("findleaves(%q)=%q, %t; want %q, %t", tc.dir, got, ok, tc.want, tc.wantOK)
+		}
+	}
+	if got, want := c.statistics().Lazy, 4; got != want {
+		t.Errorf("lazy queries=%d; want %d", got, want)
+	}
+	// b is scanned by the query of ../b.
+	for top, want := range map[string]int32{"a": 1, "b": 1, "a-b.c": 1} {
+		if got := c.lazy.tops[top].claimed; got != want {
+			t.Errorf("%s claimed=%d; want %d", top, got, want)
+		}
+	}
+}
+
+func TestFindCacheScannerTypes(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"top/a.c", "top/sub/b.c", "top/sub/deep/c.c", "top/out/o.o"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("sub", "top/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &findCacheScanner{prunes: []string{"out"}, wds: findCacheWds()}
+	ts := &topScan{path: "top", dir: true, done: make(chan struct{})}
+	s.scan(ts)
+	if ts.err != nil {
+		t.Fatal(ts.err)
+	}
+	var got []string
+	for _, fi := range ts.files {
+		st, err := os.Lstat(fi.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.mode&os.ModeType != st.Mode()&os.ModeType {
+			t.Errorf("mode of %s=%v; want %v", fi.path, fi.mode, st.Mode())
+		}
+		got = append(got, fi.path)
+	}
+	want := []string{"top", "top/a.c", "top/link", "top/sub", "top/sub/b.c", "top/sub/deep", "top/sub/deep/c.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files=%q; want %q", got, want)
+	}
+	if want := []string{"top/out"}; !reflect.DeepEqual(ts.pruned, want) {
+		t.Errorf("pruned=%q; want %q", ts.pruned, want)
+	}
+	for _, d := range ts.dirs {
+		st, err := os.Lstat(d.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Mtime != st.ModTime().UnixNano() {
+			t.Errorf("mtime of %s=%d; want %d", d.Path, d.Mtime, st.ModTime().UnixNano())
+		}
+	}
+	if l := ts.links["top/link"]; l.Target != "top/sub" {
+		t.Errorf("link=%+v; want target top/sub", l)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Symlinks in the find cache.
+//
+// The scan doesn't follow symlinks, but records what each symlink
+// resolves to. A symlink to a directory in the tree is followed by
+// looking up the files of the directory, so find -L and findleaves are
+// served from the cache. As find -L does, a directory which is also an
+// ancestor in the path being walked is a file system loop, which isn't
+// descended into. Commands following more symlinks in a path than
+// FindCacheSymlinkDepth, or symlinks to directories out of the tree,
+// run in the shell.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errStopWalk = errors.New("stop walk")
+
+// findCacheLink is what a symlink in the find cache resolves to.
+type findCacheLink struct {
+	// Exists is false if the symlink is dangling.
+	Exists bool
+	// Target is the path of the file in the tree, or "" if it is out
+	// of the tree.
+	Target string
+	// Mode and Mtime are of the file.
+	Mode  os.FileMode
+	Mtime int64
+}
+
+// resolveFindCacheLink resolves the symlink at path. wds are paths of
+// the current directory, i.e. the top of the tree, to which absolute
+// targets are relative.
+func resolveFindCacheLink(path string, wds []string) findCacheLink {
+	fi, err := os.Stat(path)
+	if err != nil {
+		// dangling, or a loop of symlinks.
+		return findCacheLink{}
+	}
+	l := findCacheLink{
+		Exists: true,
+		Mode:   fi.Mode(),
+		Mtime:  fi.ModTime().UnixNano(),
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return l
+	}
+	if !filepath.IsAbs(real) {
+		if real != ".." && !strings.HasPrefix(real, ".."+string(filepath.Separator)) {
+			l.Target = filepath.ToSlash(real)
+		}
+		return l
+	}
+	for _, wd := range wds {
+		if rel, ok := relToDir(wd, real); ok {
+			l.Target = filepath.ToSlash(rel)
+			break
+		}
+	}
+	return l
+}
+
+// findCacheWds returns paths of the current directory for
+// resolveFindCacheLink.
+func findCacheWds() []string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	wds := []string{wd}
+	if real, err := filepath.EvalSymlinks(wd); err == nil && real != wd {
+		wds = append(wds, real)
+	}
+	return wds
+}
+
+// followLink returns the file which the symlink fi resolves to, whose
+// path is the one in the cache if it is in the tree. A dangling
+// symlink resolves to itself. ok is false if the cache can't answer,
+// e.g. fi is a symlink to a directory out of the tree.
+func (c *androidFindCacheT) followLink(fi fileInfo) (target fileInfo, ok bool) {
+	l, found := c.links[fi.path]
+	if !found {
+		return fileInfo{}, false
+	}
+	if !l.Exists {
+		return fi, true
+	}
+	target = fileInfo{
+		path:  l.Target,
+		mode:  l.Mode,
+		mtime: l.Mtime,
+	}
+	if l.Target == "" {
+		if l.Mode.IsDir() {
+			return fileInfo{}, false
+		}
+		target.path = fi.path
+		return target, true
+	}
+	if l.Mode.IsDir() {
+		// contents of pruned directories are unknown.
+		if _, exists, ok := c.lookupFile(l.Target); !ok || !exists {
+			return fileInfo{}, false
+		}
+	}
+	return target, true
+}
+
+// symlinkSpan is a part of a path walked by following symlinks. The
+// walk started at the directory start, and followed a symlink in the
+// directory pos, which are paths in the cache.
+type symlinkSpan struct {
+	start string
+	pos   string
+}
+
+// isUnderDir reports whether p is dir or under dir in the cache.
+func isUnderDir(p, dir string) bool {
+	return p == dir || dir == "." || strings.HasPrefix(p, dir+"/")
+}
+
+// symlinkLoop reports whether the directory dir is an ancestor in the
+// path walked by spans, i.e. a file system loop.
+func symlinkLoop(spans []symlinkSpan, dir string) bool {
+	for _, s := range spans {
+		if isUnderDir(dir, s.start) && isUnderDir(s.pos, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkFollow calls fn for dir and files under it, following symlinks
+// as find -L does. Files are passed with their paths under printed,
+// which is the path of dir printed. spans are the path walked to dir.
+// It returns false if the cache can't answer, or finds a loop, which
+// find reports as an error.
+func (c *androidFindCacheT) walkFollow(dir, printed string, spans []symlinkSpan, fn func(string, fileInfo)) bool {
+	ok := true
+	c.walk(dir, func(_ int, fi fileInfo) error {
+		p := printed + fi.path[len(dir):]
+		if fi.mode.IsDir() && len(spans) > 0 && symlinkLoop(spans, fi.path) {
+			ok = false
+			return errStopWalk
+		}
+		if fi.mode&os.ModeSymlink == 0 {
+			fn(p, fi)
+			return nil
+		}
+		t, found := c.followLink(fi)
+		if !found {
+			ok = false
+			return errStopWalk
+		}
+		if !t.mode.IsDir() {
+			fn(p, t)
+			return nil
+		}
+		s := append(spans[:len(spans):len(spans)], symlinkSpan{start: dir, pos: slashDir(fi.path)})
+		// c.walk can't walk the top of the tree.
+		if t.path == "." || len(s) > FindCacheSymlinkDepth || symlinkLoop(s, t.path) || !c.walkFollow(t.path, p, s, fn) {
+			ok = false
+			return errStopWalk
+		}
+		return nil
+	})
+	return ok
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Extra roots of the find cache.
+//
+// The find cache scans the current directory, i.e. the top of the
+// source tree. FindCacheRoots are other directories scanned with it,
+// e.g. an out directory pruned in the tree, or overlay repositories
+// next to it. Each root is scanned as a top-level directory of the
+// tree, and its files are in the cache by paths relative to the
+// current directory, e.g. "out/x" or "../overlay/x", or absolute paths
+// if they have none. find and $(wildcard) of absolute paths or paths
+// with ".." are mapped to the root they are in, and ones out of the
+// tree and any root read the file system as before.
+//
+// Prunes apply to directories under roots as in the tree, but not to
+// roots themselves. Ignore patterns are relative to the top of the
+// tree, so they apply to directories in the tree only. A root in the
+// tree is scanned only as a root, not as a part of its parent.
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// findCacheRoots are the extra roots of the find cache.
+type findCacheRoots struct {
+	// wd is the current directory, to which absolute paths are made
+	// relative.
+	wd string
+	// paths are the sorted paths of roots in the cache.
+	paths []string
+}
+
+// newFindCacheRoots returns roots, which may be absolute or relative to
+// the current directory. Roots which are not directories are dropped.
+func newFindCacheRoots(roots []string) findCacheRoots {
+	wd, err := os.Getwd()
+	if err != nil {
+		glog.Warningf("find cache roots: %v", err)
+		return findCacheRoots{}
+	}
+	r := findCacheRoots{wd: wd}
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		p := r.rel(root)
+		if p == "." || seen[p] {
+			continue
+		}
+		fi, err := os.Lstat(filepath.FromSlash(p))
+		if err != nil || !fi.IsDir() {
+			glog.Warningf("find cache root %s is not a directory", root)
+			continue
+		}
+		seen[p] = true
+		r.paths = append(r.paths, p)
+	}
+	sort.Strings(r.paths)
+	return r
+}
+
+// rel returns p in the form of paths in the cache, i.e. relative to
+// the current directory if possible and separated by '/'.
+func (r findCacheRoots) rel(p string) string {
+	p = filepath.Clean(p)
+	if filepath.IsAbs(p) {
+		wd := r.wd
+		if wd == "" {
+			wd, _ = os.Getwd()
+		}
+		if rel, err := filepath.Rel(wd, p); err == nil {
+			p = rel
+		}
+	}
+	return filepath.ToSlash(p)
+}
+
+// isOutOfTree reports whether p, a path in the form of the cache, is
+// out of the current directory.
+func isOutOfTree(p string) bool {
+	return p == ".." || strings.HasPrefix(p, "../") || path.IsAbs(p) || !isSlashPath(p)
+}
+
+// rootOf returns the root which p, a path in the form of the cache, is
+// in, "." if p is in the tree but in no extra root, or "" if p is out
+// of the tree and any root.
+func (r findCacheRoots) rootOf(p string) string {
+	root := ""
+	for _, rp := range r.paths {
+		if len(rp) > len(root) && isUnderDir(p, rp) {
+			root = rp
+		}
+	}
+	if root == "" && !isOutOfTree(p) {
+		root = "."
+	}
+	return root
+}
+
+// isRoot reports whether p, a path in the cache, is an extra root.
+func (r findCacheRoots) isRoot(p string) bool {
+	i := sort.SearchStrings(r.paths, p)
+	return i < len(r.paths) && r.paths[i] == p
+}
+
+// cachePath returns the path of p in the cache. ok is false if p is out
+// of the tree and any root.
+func (r findCacheRoots) cachePath(p string) (cp string, ok bool) {
+	cp = r.rel(p)
+	return cp, r.rootOf(cp) != ""
+}
+
+// topOf returns the top-level file or directory of the tree, or the
+// root, which p, a path in the cache, is in, or "" if p is the top or
+// out of the tree and any root.
+func (r findCacheRoots) topOf(p string) string {
+	root := r.rootOf(p)
+	if root != "." {
+		return root
+	}
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		p = p[:i]
+	}
+	if p == "." {
+		return ""
+	}
+	return p
+}
+
+// linkTarget returns the path in the cache of the file which the
+// symlink at path resolves to, if it is in an extra root out of the
+// tree. It returns "" otherwise.
+func (r findCacheRoots) linkTarget(path string) string {
+	if len(r.paths) == 0 {
+		return ""
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+	real, err = filepath.Abs(real)
+	if err != nil {
+		return ""
+	}
+	p := r.rel(real)
+	if root := r.rootOf(p); root == "" || root == "." {
+		return ""
+	}
+	return p
+}
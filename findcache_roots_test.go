@@ -0,0 +1,129 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindCacheRoots(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"src/a/x.c", "src/a/Android.mk", "src/out/gen/y.c", "overlay/lib/z.c", "overlay/Android.mk", "other/w.c"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("../../overlay/lib", "src/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dir may be a symlink.
+	top, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay := filepath.ToSlash(filepath.Join(filepath.Dir(top), "overlay"))
+	saved := UseFindCache
+	defer func() { UseFindCache = saved }()
+	UseFindCache = true
+
+	c := &androidFindCacheT{}
+	c.filesch = make(chan []fileInfo, 1)
+	c.leavesch = make(chan []fileInfo, 1)
+	c.roots = newFindCacheRoots([]string{"out", "../overlay", overlay, "none"})
+	if got, want := c.roots.paths, []string{"../overlay", "out"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("roots=%q; want %q", got, want)
+	}
+	c.start([]string{"out"}, []string{"Android.mk"})
+	c.files = <-c.filesch
+	c.leaves = <-c.leavesch
+
+	for _, tc := range []struct {
+		cmd    string
+		want   []string
+		wantOK bool
+	}{
+		{cmd: "find . -name '*.c'", want: []string{"./a/x.c", "./out/gen/y.c"}, wantOK: true},
+		{cmd: "find out -name '*.c'", want: []string{"out/gen/y.c"}, wantOK: true},
+		{cmd: "find ../overlay -name '*.c'", want: []string{"../overlay/lib/z.c"}, wantOK: true},
+		{cmd: "find -L a -name '*.c'", want: []string{"a/link/z.c", "a/x.c"}, wantOK: true},
+		{cmd: "cd ../overlay && find lib", want: []string{"lib", "lib/z.c"}, wantOK: true},
+		{cmd: "find " + overlay + "/lib", want: []string{overlay + "/lib", overlay + "/lib/z.c"}, wantOK: true},
+		{cmd: "find ../other"},
+		{cmd: "find .."},
+	} {
+		fc, err := parseFindCommand(tc.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := c.find(fc)
+		if ok != tc.wantOK || (ok && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("find(%q)=%q, %t; want %q, %t", tc.cmd, got, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	for _, tc := range []struct {
+		dir    string
+		want   []string
+		wantOK bool
+	}{
+		{dir: ".", want: []string{"a", "out"}, wantOK: true},
+		{dir: "../overlay", want: []string{"Android.mk", "lib"}, wantOK: true},
+		{dir: overlay + "/lib", want: []string{"z.c"}, wantOK: true},
+		{dir: "../overlay/none", wantOK: true},
+		{dir: ".."},
+		{dir: "../other"},
+	} {
+		got, ok := c.readdirnames(tc.dir)
+		if ok != tc.wantOK || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readdirnames(%q)=%q, %t; want %q, %t", tc.dir, got, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	// findleaves of the tree doesn't descend into roots out of it.
+	wb := newWbuf()
+	defer wb.release()
+	if !c.findleaves(wb, ".", "Android.mk", nil, 0) {
+		t.Fatalf("findleaves(.)=false")
+	}
+	var got []string
+	for _, w := range wb.words {
+		got = append(got, string(w))
+	}
+	if want := []string{"./a/Android.mk"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findleaves(.)=%q; want %q", got, want)
+	}
+
+	c.invalidate("../other/w.c")
+	if c.stale != 0 {
+		t.Errorf("stale after ../other/w.c changed")
+	}
+	c.invalidate(overlay + "/lib/new.c")
+	if c.stale == 0 {
+		t.Errorf("not stale after %s/lib/new.c changed", overlay)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package kati
+
+// getdents64 based scanner of the find cache.
+//
+// filepath.Walk lstats every file, while the scan needs only types of
+// files, which getdents64 tells by d_type on most file systems. Files
+// are lstat'ed only if d_type is DT_UNKNOWN, and directories are
+// fstat'ed after they are opened, for their mtimes in the find cache
+// file. mtimes of other files are left unknown, and find stats them
+// when needed.
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// offsets in struct linux_dirent64.
+const (
+	direntReclenOff = 16
+	direntTypeOff   = 18
+	direntNameOff   = 19
+)
+
+type direntScanner struct {
+	s   *findCacheScanner
+	ts  *topScan
+	buf []byte
+}
+
+// dirent is an entry of a directory. mode is 0 with known false if
+// d_type is DT_UNKNOWN.
+type dirent struct {
+	name  string
+	mode  os.FileMode
+	known bool
+}
+
+// walk visits files of ts by reading directories with getdents64.
+func (s *findCacheScanner) walk(ts *topScan) error {
+	fi, err := os.Lstat(ts.path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		s.visit(ts, ts.path, fi.Mode(), fi.ModTime().UnixNano())
+		return nil
+	}
+	w := &direntScanner{s: s, ts: ts, buf: make([]byte, 32<<10)}
+	return w.scanDir(ts.path)
+}
+
+// scanDir visits the directory path and files under it. As
+// filepath.Walk, a directory which can't be read is visited, but files
+// in it aren't.
+func (w *direntScanner) scanDir(path string) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		w.s.visit(w.ts, path, fi.Mode(), fi.ModTime().UnixNano())
+		return nil
+	}
+	var st syscall.Stat_t
+	err = syscall.Fstat(fd, &st)
+	if err != nil {
+		syscall.Close(fd)
+		return os.NewSyscallError("fstat", err)
+	}
+	if !w.s.visit(w.ts, path, os.ModeDir|os.FileMode(st.Mode)&os.ModePerm, st.Mtim.Nano()) {
+		syscall.Close(fd)
+		return nil
+	}
+	// entries are read before descending, so that directories are
+	// open one at a time.
+	entries, err := w.readDir(fd)
+	syscall.Close(fd)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		p := path + "/" + e.name
+		if !e.known {
+			fi, err := os.Lstat(p)
+			if err != nil {
+				// removed after it was read.
+				continue
+			}
+			e.mode = fi.Mode() & os.ModeType
+		}
+		if e.mode.IsDir() {
+			err = w.scanDir(p)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		w.s.visit(w.ts, p, e.mode, 0)
+	}
+	return nil
+}
+
+// readDir reads entries of the directory fd, except "." and "..".
+func (w *direntScanner) readDir(fd int) ([]dirent, error) {
+	var entries []dirent
+	for {
+		n, err := syscall.Getdents(fd, w.buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return entries, os.NewSyscallError("getdents64", err)
+		}
+		if n <= 0 {
+			return entries, nil
+		}
+		for off := 0; off < n; {
+			reclen := int(*(*uint16)(unsafe.Pointer(&w.buf[off+direntReclenOff])))
+			rec := w.buf[off : off+reclen]
+			off += reclen
+			name := rec[direntNameOff:]
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			mode, known := direntMode(rec[direntTypeOff])
+			entries = append(entries, dirent{name: string(name), mode: mode, known: known})
+		}
+	}
+}
+
+// direntMode returns the type bits of d_type. known is false if the
+// file system doesn't tell the type.
+func direntMode(typ byte) (mode os.FileMode, known bool) {
+	switch typ {
+	case syscall.DT_REG:
+		return 0, true
+	case syscall.DT_DIR:
+		return os.ModeDir, true
+	case syscall.DT_LNK:
+		return os.ModeSymlink, true
+	case syscall.DT_FIFO:
+		return os.ModeNamedPipe, true
+	case syscall.DT_SOCK:
+		return os.ModeSocket, true
+	case syscall.DT_CHR:
+		return os.ModeDevice | os.ModeCharDevice, true
+	case syscall.DT_BLK:
+		return os.ModeDevice, true
+	}
+	return 0, false
+}
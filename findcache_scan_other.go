@@ -0,0 +1,37 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package kati
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// walk visits files of ts by filepath.Walk, which lstats each file.
+func (s *findCacheScanner) walk(ts *topScan) error {
+	return filepath.Walk(ts.path, func(path string, info os.FileInfo, err error) error {
+		if info == nil {
+			return err
+		}
+		// paths in the cache are separated by '/'.
+		if !s.visit(ts, filepath.ToSlash(path), info.Mode(), info.ModTime().UnixNano()) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Fingerprints of inputs other than makefiles.
+//
+// A cached DepGraph, e.g. by -use_cache or the kati server, is reused
+// while the makefiles read to load it have the same content hashes, so
+// touching a makefile doesn't expire it. With CacheFingerprints, the
+// cache also records content hashes of results of $(wildcard),
+// environment variables used and outputs of $(shell), and expires if
+// any of them changes. Variables undefined when they were looked up
+// are recorded as environment variables which are not set. Commands of
+// $(shell) run again to check them, except ones emulated by the find
+// cache, which tracks files itself.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// CacheFingerprints makes caches of loaded DepGraphs check results of
+// $(wildcard), environment variables and outputs of $(shell).
+var CacheFingerprints bool
+
+// globHash returns the hash of files matched by a glob pattern.
+func globHash(matched []string) [sha1.Size]byte {
+	return sha1.Sum([]byte(strings.Join(matched, "\x00")))
+}
+
+// fingerprint records mk, e.g. the hash of files matched by a glob
+// pattern for fileGlob. It returns a message if mk.Filename has been
+// recorded with a different hash.
+func (ac *accessCache) fingerprint(mk *accessedMakefile) string {
+	if ac == nil {
+		return ""
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	// keys may be the same as filenames.
+	mkey := fmt.Sprintf("%d:%s", mk.State, mk.Filename)
+	rm, present := ac.m[mkey]
+	if !present {
+		ac.m[mkey] = mk
+		return ""
+	}
+	if rm.State == mk.State && !bytes.Equal(mk.Hash[:], rm.Hash[:]) {
+		rm.State = fileInconsistent
+		return fmt.Sprintf("result of %s was changed after the previous read", mk.Filename)
+	}
+	return ""
+}
+
+// fingerprintWildcard records files, sorted, matched by pat of
+// $(wildcard).
+func (ev *Evaluator) fingerprintWildcard(pat string, files []string) {
+	if ev.cache == nil || !ev.sess.cacheFingerprints() {
+		return
+	}
+	ev.cache.fingerprint(&accessedMakefile{
+		Filename: pat,
+		Hash:     globHash(files),
+		State:    fileWildcard,
+	})
+}
+
+// fingerprintShell records out of cmd of $(shell), run by shell with
+// flags in env.
+func (ev *Evaluator) fingerprintShell(shell, flags, cmd string, env []string, out []byte) {
+	if ev.cache == nil || !ev.sess.cacheFingerprints() {
+		return
+	}
+	ev.cache.fingerprint(&accessedMakefile{
+		Filename: cmd,
+		Hash:     sha1.Sum(out),
+		State:    fileShell,
+		Args:     []string{shell, flags},
+		Env:      env,
+		out:      out,
+	})
+}
+
+// fingerprintUndefined records that name is not in the environment,
+// since a variable undefined when it was looked up may be defined by
+// the environment later.
+func (ev *Evaluator) fingerprintUndefined(name string) {
+	if ev.cache == nil || !ev.sess.cacheFingerprints() || !isExportable(name) {
+		return
+	}
+	ev.cache.fingerprint(&accessedMakefile{
+		Filename: name,
+		Hash:     envHash("", false),
+		State:    fileEnv,
+	})
+}
+
+// envFingerprints returns fingerprints of environment variables names
+// in env.
+func envFingerprints(names []string, env []string) []*accessedMakefile {
+	var r []*accessedMakefile
+	for _, name := range names {
+		value, ok := lookupEnviron(env, name)
+		r = append(r, &accessedMakefile{
+			Filename: name,
+			Hash:     envHash(value, ok),
+			State:    fileEnv,
+		})
+	}
+	return r
+}
+
+func envHash(value string, ok bool) [sha1.Size]byte {
+	if !ok {
+		return sha1.Sum(nil)
+	}
+	return sha1.Sum([]byte("=" + value))
+}
+
+// lookupEnviron looks up name in env, e.g. os.Environ().
+func lookupEnviron(env []string, name string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], name+"=") {
+			return env[i][len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// checkFingerprint returns why mk, which is not a makefile, is
+// changed, or nil if it is not changed. env is the environment to load
+// the DepGraph.
+func checkFingerprint(mk *accessedMakefile, env []string) (*RegenReason, error) {
+	var hash [sha1.Size]byte
+	r := &RegenReason{Name: mk.Filename, Change: "changed"}
+	switch mk.State {
+	case fileGlob, fileWildcard:
+		var matched []string
+		var err error
+		if mk.State == fileGlob {
+			r.Kind = RegenGlob
+			matched, err = filepath.Glob(mk.Filename)
+		} else {
+			r.Kind = RegenWildcard
+			// wildcardCache may have entries read before files
+			// changed.
+			w := &wildcardCacheT{dirent: make(map[string][]string)}
+			matched, err = w.Glob(mk.Filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hash = globHash(matched)
+	case fileEnv:
+		r.Kind = RegenEnv
+		value, ok := lookupEnviron(env, mk.Filename)
+		hash = envHash(value, ok)
+		unset := envHash("", false)
+		switch {
+		case !ok:
+			r.Change = "unset"
+		case bytes.Equal(mk.Hash[:], unset[:]):
+			r.Change = "set"
+		}
+		r.Value = value
+	case fileShell:
+		r.Kind = RegenShell
+		if len(mk.Args) != 2 {
+			return nil, fmt.Errorf("internal error: broken shell fingerprint: %q", mk.Args)
+		}
+		cmd, cleanup, err := shellCommand(context.Background(), mk.Args[0], mk.Args[1], mk.Filename)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		cmd.Env = mk.Env
+		out, err := cmd.Output()
+		if err != nil {
+			glog.V(1).Infof("fingerprint $(shell %q): %v", mk.Filename, err)
+		}
+		hash = sha1.Sum(out)
+	default:
+		return nil, fmt.Errorf("internal error: broken state: %d", mk.State)
+	}
+	if bytes.Equal(hash[:], mk.Hash[:]) {
+		return nil, nil
+	}
+	return r, nil
+}
@@ -19,11 +19,126 @@ var (
 	StatsFlag         bool
 	PeriodicStatsFlag bool
 	EvalStatsFlag     bool
+	// EvalProfileFlag enables the evaluation profiler, which
+	// WriteEvalProfile reports. see profile.go
+	EvalProfileFlag bool
+	// SymbolIndexFlag records where variables are assigned and
+	// expanded while loading, for DepGraph.Symbols. see symbols.go
+	SymbolIndexFlag bool
+	// TraceVars are names of variables whose assignments and
+	// expansions are written to stderr with their locations. see
+	// tracevar.go
+	TraceVars map[string]bool
 
 	DryRunFlag bool
+	// QuestionFlag runs no commands, and makes Executor.Exec return
+	// ErrOutOfDate if a target is not up to date, as -q of GNU make.
+	QuestionFlag bool
+	// TouchFlag makes Executor.Exec touch targets instead of running
+	// their commands, as -t of GNU make.
+	TouchFlag bool
+	// TraceFlag makes Executor.Exec print why the commands of each
+	// target run, and the commands even if they are silent, as
+	// --trace of GNU make.
+	TraceFlag bool
+	// Debug are categories of debug messages printed while loading
+	// makefiles and building targets, as --debug of GNU make. see
+	// debug.go
+	Debug DebugFlags
+	// KeepGoingFlag makes Executor.Exec continue building targets
+	// which don't depend on failed ones, as -k of GNU make. The
+	// generated ninja wrapper passes "-k 0" to ninja.
+	KeepGoingFlag bool
 
 	UseFindCache     bool
 	UseShellBuiltins bool
 
+	// FindCacheFile is a file to save the scanned files of the find
+	// cache, to load them in the next run instead of scanning. It
+	// should be out of the scanned tree or in a pruned directory,
+	// since saving it modifies its directory.
+	FindCacheFile string
+
+	// FindCacheIgnore are .gitignore-style patterns of directories
+	// which the find cache doesn't scan, in addition to prunes, e.g.
+	// node_modules. see findcache_ignore.go
+	FindCacheIgnore []string
+
+	// FindCacheRoots are directories which the find cache scans in
+	// addition to the current directory, e.g. an out directory or
+	// overlay repositories. see findcache_roots.go
+	FindCacheRoots []string
+
+	// FindCacheSymlinkDepth is the number of symlinks to directories
+	// which the find cache follows in a path for find -L and
+	// findleaves. Commands following more symlinks run in the shell.
+	// see findcache_link.go
+	FindCacheSymlinkDepth = 8
+
+	// ShellCacheFile is a file to save outputs of $(shell), to reuse
+	// them in the next run instead of running the commands. Only
+	// commands run while .KATI_SHELL_DEPS lists the files they read are
+	// cached.
+	ShellCacheFile string
+
+	// CheckWildcardCacheMtime makes the cache of $(wildcard) check
+	// modification times of directories, and read modified directories
+	// again. It is for long running processes.
+	CheckWildcardCacheMtime bool
+
+	// CaseInsensitiveFS makes a file name without wildcards in
+	// $(wildcard) match a file whose name differs only in case, as on
+	// case insensitive file systems. It is true by default on macOS
+	// and windows.
+	CaseInsensitiveFS = defaultCaseInsensitiveFS
+
+	// WildcardOrder is the order of names in each directory which
+	// $(wildcard) returns, e.g. WildcardOrderDirectory. If empty,
+	// WildcardOrderSorted is used.
+	WildcardOrder = WildcardOrderSorted
+
+	// WildcardFold makes $(wildcard) match names ignoring case and
+	// Unicode normalization, e.g. WildcardFoldAuto. If empty,
+	// WildcardFoldOff is used.
+	WildcardFold = WildcardFoldOff
+
+	// UseExpandCache enables the cache of expansions of recursive
+	// variables.
+	UseExpandCache bool
+
 	IgnoreOptionalInclude string
+
+	// PosixMode enables POSIX make compatibility mode, as the special
+	// target .POSIX does.
+	PosixMode bool
+
+	// WarnFlag makes kati warn about suspicious constructs in
+	// makefiles, e.g. references to undefined variables. see lint.go
+	WarnFlag bool
+
+	// ParallelEvalJobs is the number of goroutines to evaluate files
+	// of an include directive in parallel. 0 or 1 disables it.
+	ParallelEvalJobs int
+
+	// ShellJobs is the number of $(shell) commands of simple
+	// assignments run in parallel while evaluating makefiles. 0 or 1
+	// disables it. see shellbatch.go
+	ShellJobs int
+
+	// NoBuiltinRules disables the builtin implicit rules and clears
+	// the default list of suffixes, as -r of GNU make does.
+	NoBuiltinRules bool
+	// NoBuiltinVars disables the builtin variables, e.g. CC and
+	// COMPILE.c, as -R of GNU make does. It implies NoBuiltinRules.
+	NoBuiltinVars bool
+
+	// EnvironmentOverrides makes environment variables take
+	// precedence over assignments in makefiles except override, as
+	// -e of GNU make does. Their origin is "environment override".
+	EnvironmentOverrides bool
+
+	// MakeVersion is the version of GNU make which kati pretends to
+	// be in $(MAKE_VERSION). $(.FEATURES) lists features of the
+	// version which kati supports.
+	MakeVersion = "3.81"
 )
@@ -0,0 +1,381 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Formatter of makefiles.
+//
+// FormatMakefile classifies logical lines by the parser, and rewrites
+// only whitespace which make ignores:
+//  - assignments are written as "NAME OP VALUE", and operators of
+//    consecutive ones are aligned with FormatOpt.AlignAssigns.
+//  - continuation lines of assignments and rules are indented by
+//    FormatOpt.Indent, with a space before the backslash.
+//  - trailing whitespace of rules, directives, comments and blank
+//    lines is removed.
+// Recipes, define directives, values and comments are kept as they are,
+// as well as the number of lines, so locations in messages don't
+// change. The formatted makefile is parsed again to check it has the
+// same statements.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+)
+
+// FormatOpt is options of FormatMakefile.
+type FormatOpt struct {
+	// AlignAssigns aligns operators of consecutive assignments.
+	AlignAssigns bool
+	// Indent is the indentation of continuation lines. If empty, a
+	// tab is used.
+	Indent string
+}
+
+// FormatMakefile formats the makefile src read from filename.
+func FormatMakefile(src []byte, filename string, opt *FormatOpt) ([]byte, error) {
+	if opt == nil {
+		opt = &FormatOpt{}
+	}
+	indent := opt.Indent
+	if indent == "" {
+		indent = "\t"
+	}
+	p := newParser(src, filename)
+	p.recordLines = true
+	p.quiet = true
+	mk, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	lines := p.lines
+	if n := len(lines); n > 0 && len(lines[n-1].line) == 0 && bytes.HasSuffix(src, []byte("\n")) {
+		// the empty line after the last newline.
+		lines = lines[:n-1]
+	}
+
+	var out []string
+	// block is assignments in out to be aligned.
+	var block []formattedAssign
+	flush := func() {
+		width := 0
+		if opt.AlignAssigns {
+			for _, a := range block {
+				if w := len(a.name) + len(a.op); w > width {
+					width = w
+				}
+			}
+		}
+		for _, a := range block {
+			out[a.index] = a.format(width)
+		}
+		block = nil
+	}
+	for _, l := range lines {
+		if l.kind == lineAssign {
+			if a, ok := splitAssign(l.physicalLines()); ok {
+				a.index = len(out)
+				block = append(block, a)
+				out = append(out, "")
+				out = append(out, a.continuations(indent)...)
+				continue
+			}
+		}
+		flush()
+		switch l.kind {
+		case lineRule:
+			out = append(out, formatRule(l.physicalLines(), indent)...)
+		case lineOther:
+			out = append(out, formatOther(l.physicalLines())...)
+		default:
+			out = append(out, l.physicalLines()...)
+		}
+	}
+	flush()
+
+	var buf bytes.Buffer
+	for _, line := range out {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	formatted := buf.Bytes()
+	fp := newParser(formatted, filename)
+	fp.quiet = true
+	fmk, err := fp.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%s: formatted makefile is broken: %v", filename, err)
+	}
+	if pos, ok := sameStmts(mk.stmts, fmk.stmts); !ok {
+		return nil, fmt.Errorf("%s: formatting changes the makefile", pos)
+	}
+	return formatted, nil
+}
+
+// FormatFile formats the makefile filename, or the default makefile
+// if filename is empty.
+func FormatFile(filename string, opt *FormatOpt) ([]byte, error) {
+	if filename == "" {
+		var err error
+		filename, err = defaultMakefile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return FormatMakefile(src, filename, opt)
+}
+
+// physicalLines splits the logical line l into physical lines, which
+// end with backslashes except the last one.
+func (l parsedLine) physicalLines() []string {
+	phys := strings.Split(strings.Replace(string(l.line), "\r\n", "\n", -1), "\n")
+	for len(phys) < l.nlines {
+		phys = append(phys, "")
+	}
+	return phys
+}
+
+// trimContinuation removes the backslash of a physical line continued
+// by the next one.
+func trimContinuation(s string) string {
+	return strings.TrimSuffix(s, `\`)
+}
+
+// trimRightSafe removes trailing whitespace of a physical line, unless
+// it makes the line continued by a backslash.
+func trimRightSafe(s string) string {
+	t := strings.TrimRight(s, " \t")
+	if strings.HasSuffix(t, `\`) {
+		return s
+	}
+	return t
+}
+
+// rewrap formats a logical line of segments, which are physical lines
+// without backslashes, as the first segment followed by indented ones.
+// make joins them with a space, ignoring whitespace around backslash
+// newlines. The last segment keeps trailing whitespace.
+func rewrap(head string, segs []string, indent string) []string {
+	var r []string
+	line := head
+	for i, seg := range segs {
+		if i < len(segs)-1 {
+			seg = strings.TrimSpace(seg)
+		} else {
+			seg = strings.TrimLeft(seg, " \t")
+		}
+		switch {
+		case i == 0 && seg == "":
+		case i == 0 && line == "":
+			line = seg
+		case i == 0:
+			line += " " + seg
+		case i == len(segs)-1 && seg == "":
+			// an empty line, which must not be a recipe.
+			line = ""
+		default:
+			line = indent + seg
+		}
+		if i < len(segs)-1 {
+			// a single backslash doesn't continue the line, so an
+			// empty segment in the middle is indented.
+			if line == "" || line == indent {
+				line += `\`
+			} else {
+				line += ` \`
+			}
+		}
+		r = append(r, line)
+	}
+	return r
+}
+
+// formattedAssign is an assignment being formatted.
+type formattedAssign struct {
+	// name is the variable name with directives, e.g. "override A".
+	name string
+	op   string
+	// segs are the value in segments of physical lines.
+	segs  []string
+	index int
+}
+
+// splitAssign splits physical lines phys of an assignment. It returns
+// false if the line is not formatted, e.g. it has a comment continued
+// by a backslash newline.
+func splitAssign(phys []string) (formattedAssign, bool) {
+	if len(phys) > 1 && strings.Contains(strings.Join(phys, "\n"), "#") {
+		return formattedAssign{}, false
+	}
+	first := []byte(phys[0])
+	if len(phys) > 1 {
+		first = first[:len(first)-1]
+	}
+	var name []string
+	s := trimLeftSpaceBytes(first)
+	for {
+		w, rest := firstWord(s)
+		if (string(w) != "override" && string(w) != "export") || len(rest) == 0 {
+			break
+		}
+		name = append(name, string(w))
+		s = rest
+	}
+	i := findLiteralChar(s, ':', '=', skipVar)
+	if i < 0 {
+		return formattedAssign{}, false
+	}
+	if h := bytes.IndexByte(s, '#'); h >= 0 && h < i {
+		return formattedAssign{}, false
+	}
+	sep := i
+	if s[i] == ':' {
+		if i+1 >= len(s) || s[i+1] != '=' {
+			return formattedAssign{}, false
+		}
+		sep = i + 1
+	}
+	opStart := sep
+	if sep > 0 {
+		switch s[sep-1] {
+		case ':', '+', '?':
+			opStart = sep - 1
+		}
+	}
+	lhs := trimSpaceBytes(s[:opStart])
+	if len(lhs) == 0 {
+		return formattedAssign{}, false
+	}
+	if w, _ := firstWord(lhs); makeDirectives[string(w)] != nil {
+		// e.g. "export=a" would be an export directive.
+		return formattedAssign{}, false
+	}
+	name = append(name, string(lhs))
+	segs := append([]string{string(s[sep+1:])}, phys[1:]...)
+	for i := 1; i < len(segs)-1; i++ {
+		segs[i] = trimContinuation(segs[i])
+	}
+	return formattedAssign{
+		name: strings.Join(name, " "),
+		op:   string(s[opStart : sep+1]),
+		segs: segs,
+	}, true
+}
+
+// format returns the first line of a, whose name and operator are
+// padded to width.
+func (a formattedAssign) format(width int) string {
+	head := a.name
+	if w := len(a.name) + len(a.op); width > w {
+		head += strings.Repeat(" ", width-w)
+	}
+	head += " " + a.op
+	seg := a.segs[0]
+	if len(a.segs) > 1 {
+		seg = strings.TrimRight(seg, " \t")
+	}
+	return rewrap(head, []string{seg}, "")[0] + a.continued()
+}
+
+func (a formattedAssign) continued() string {
+	if len(a.segs) > 1 {
+		return ` \`
+	}
+	return ""
+}
+
+// continuations returns the physical lines after the first one.
+func (a formattedAssign) continuations(indent string) []string {
+	if len(a.segs) <= 1 {
+		return nil
+	}
+	return rewrap("", append([]string{""}, a.segs[1:]...), indent)[1:]
+}
+
+// formatRule formats physical lines phys of a rule. Rules with recipes
+// after ';', target specific variables or comments are kept.
+func formatRule(phys []string, indent string) []string {
+	line := []byte(strings.Join(phys, "\n"))
+	if findLiteralChar(line, ';', '=', skipVar) >= 0 || bytes.IndexByte(line, '#') >= 0 {
+		return phys
+	}
+	segs := make([]string, len(phys))
+	for i, s := range phys {
+		if i < len(phys)-1 {
+			s = trimContinuation(s)
+		}
+		segs[i] = s
+	}
+	r := rewrap("", segs, indent)
+	r[len(r)-1] = trimRightSafe(r[len(r)-1])
+	return r
+}
+
+// formatOther formats physical lines phys of a directive, a comment
+// or a blank line, which has trailing whitespace removed.
+func formatOther(phys []string) []string {
+	if len(phys) == 1 {
+		phys[0] = trimRightSafe(phys[0])
+	}
+	return phys
+}
+
+// sameStmts reports whether statements a and b are the same, except
+// whitespace which doesn't matter. It returns the position of the
+// first different statement if not.
+func sameStmts(a, b []ast) (srcpos, bool) {
+	for i, s := range a {
+		if i >= len(b) {
+			return s.pos(), false
+		}
+		if !sameStmt(s, b[i]) {
+			return s.pos(), false
+		}
+	}
+	if len(b) > len(a) {
+		return b[len(a)].pos(), false
+	}
+	return srcpos{}, true
+}
+
+func sameStmt(a, b ast) bool {
+	switch a := a.(type) {
+	case *maybeRuleAST:
+		b, ok := b.(*maybeRuleAST)
+		return ok && a.srcpos == b.srcpos && a.isRule == b.isRule &&
+			strings.TrimSpace(a.expr.String()) == strings.TrimSpace(b.expr.String()) &&
+			reflect.DeepEqual(a.assign, b.assign) && bytes.Equal(a.semi, b.semi)
+	case *exportAST:
+		b, ok := b.(*exportAST)
+		return ok && a.srcpos == b.srcpos && a.hasEqual == b.hasEqual && a.export == b.export &&
+			bytes.Equal(trimSpaceBytes(a.expr), trimSpaceBytes(b.expr))
+	case *ifAST:
+		b, ok := b.(*ifAST)
+		if !ok || a.srcpos != b.srcpos || a.op != b.op || !reflect.DeepEqual(a.lhs, b.lhs) || !reflect.DeepEqual(a.rhs, b.rhs) {
+			return false
+		}
+		if _, ok := sameStmts(a.trueStmts, b.trueStmts); !ok {
+			return false
+		}
+		_, ok = sameStmts(a.falseStmts, b.falseStmts)
+		return ok
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "testing"
+
+func TestFormatMakefile(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		opt  FormatOpt
+		want string
+	}{
+		{
+			in:   "A=a\nBB  :=   b  # c\n",
+			want: "A = a\nBB := b  # c\n",
+		},
+		{
+			in:   "A=a\nBB  ?= b\noverride   CCC+=c\n\nD = d\n",
+			opt:  FormatOpt{AlignAssigns: true},
+			want: "A             = a\nBB           ?= b\noverride CCC += c\n\nD = d\n",
+		},
+		{
+			in:   "export A:=a\n",
+			want: "export A := a\n",
+		},
+		{
+			in:   "A := a\\\n   b   \\\n c\n",
+			want: "A := a \\\n\tb \\\n\tc\n",
+		},
+		{
+			in:   "A := \\\n  a\n",
+			opt:  FormatOpt{Indent: "  "},
+			want: "A := \\\n  a\n",
+		},
+		{
+			in:   "foo:   bar\\\n  baz   \n\techo  $@  \n",
+			want: "foo:   bar \\\n\tbaz\n\techo  $@  \n",
+		},
+		{
+			in:   "foo: A=a\nfoo: ; echo\n",
+			want: "foo: A=a\nfoo: ; echo\n",
+		},
+		{
+			in:   "# comment   \nifdef A  \nendif\t\n",
+			want: "# comment\nifdef A\nendif\n",
+		},
+		{
+			in:   "define A  \n  x  \nendef\n",
+			want: "define A  \n  x  \nendef\n",
+		},
+		{
+			in:   "A = a # \\\n  b\n",
+			want: "A = a # \\\n  b\n",
+		},
+		{
+			in:   "A:=X \\\n\ntest:\n\techo\n",
+			want: "A := X \\\n\ntest:\n\techo\n",
+		},
+		{
+			in:   "export=a\n",
+			want: "export=a\n",
+		},
+		{
+			in:   "A = a",
+			want: "A = a\n",
+		},
+	} {
+		opt := tc.opt
+		got, err := FormatMakefile([]byte(tc.in), "test.mk", &opt)
+		if err != nil {
+			t.Errorf("FormatMakefile(%q)=_, %v; want no error", tc.in, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("FormatMakefile(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
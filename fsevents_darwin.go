@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+// +build cgo
+
+package kati
+
+// FSEvents based file system watcher for macOS.
+
+/*
+#cgo LDFLAGS: -framework CoreServices
+#include <stdint.h>
+#include <stdlib.h>
+#include <CoreServices/CoreServices.h>
+#include <dispatch/dispatch.h>
+
+extern void katiFSEvents(uintptr_t handle, size_t n, char **paths, uint32_t *flags);
+
+static void katiFSEventsCallback(ConstFSEventStreamRef stream, void *info, size_t n, void *paths, const FSEventStreamEventFlags flags[], const FSEventStreamEventId ids[]) {
+	katiFSEvents((uintptr_t)info, n, (char **)paths, (uint32_t *)flags);
+}
+
+static FSEventStreamRef katiFSEventsStart(const char *root, uintptr_t handle) {
+	FSEventStreamContext ctx = {0, (void *)handle, NULL, NULL, NULL};
+	CFStringRef path = CFStringCreateWithCString(NULL, root, kCFStringEncodingUTF8);
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&path, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamRef stream = FSEventStreamCreate(NULL, katiFSEventsCallback, &ctx, paths,
+		kFSEventStreamEventIdSinceNow, 0.05,
+		kFSEventStreamCreateFlagFileEvents | kFSEventStreamCreateFlagNoDefer | kFSEventStreamCreateFlagWatchRoot);
+	CFRelease(paths);
+	CFRelease(path);
+	if (stream == NULL) {
+		return NULL;
+	}
+	FSEventStreamSetDispatchQueue(stream, dispatch_queue_create("kati.fsevents", DISPATCH_QUEUE_SERIAL));
+	if (!FSEventStreamStart(stream)) {
+		FSEventStreamInvalidate(stream);
+		FSEventStreamRelease(stream);
+		return NULL;
+	}
+	return stream;
+}
+
+static void katiFSEventsStop(FSEventStreamRef stream) {
+	FSEventStreamStop(stream);
+	FSEventStreamInvalidate(stream);
+	FSEventStreamRelease(stream);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// fsEventsWatchers maps a handle passed to FSEvents to its callback.
+var fsEventsWatchers = struct {
+	mu   sync.Mutex
+	next uintptr
+	fns  map[uintptr]func([]fsChange)
+}{
+	fns: make(map[uintptr]func([]fsChange)),
+}
+
+// skip is not used, as a stream of FSEvents watches the whole tree at
+// once.
+func watchFileSystem(root string, skip func(string) bool, fn func([]fsChange)) (func(), error) {
+	w := &fsEventsWatchers
+	w.mu.Lock()
+	w.next++
+	h := w.next
+	w.fns[h] = fn
+	w.mu.Unlock()
+	unregister := func() {
+		w.mu.Lock()
+		delete(w.fns, h)
+		w.mu.Unlock()
+	}
+
+	croot := C.CString(root)
+	defer C.free(unsafe.Pointer(croot))
+	stream := C.katiFSEventsStart(croot, C.uintptr_t(h))
+	if stream == nil {
+		unregister()
+		return nil, fmt.Errorf("failed to watch %s by FSEvents", root)
+	}
+	glog.Infof("watch %s by FSEvents", root)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			C.katiFSEventsStop(stream)
+			unregister()
+		})
+	}, nil
+}
+
+// fsEventsCallback is called on a dispatch queue of FSEvents.
+func fsEventsCallback(h uintptr, paths []string, flags []uint32) {
+	w := &fsEventsWatchers
+	w.mu.Lock()
+	fn := w.fns[h]
+	w.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	var changes []fsChange
+	for i, path := range paths {
+		f := flags[i]
+		switch {
+		case f&(C.kFSEventStreamEventFlagMustScanSubDirs|C.kFSEventStreamEventFlagRootChanged) != 0:
+			// events were coalesced or dropped.
+			changes = append(changes, fsChange{path: path, recursive: true})
+		case f&(C.kFSEventStreamEventFlagItemCreated|C.kFSEventStreamEventFlagItemRemoved|C.kFSEventStreamEventFlagItemRenamed) != 0:
+			changes = append(changes, fsChange{
+				path:      path,
+				recursive: f&C.kFSEventStreamEventFlagItemIsDir != 0,
+			})
+		case f&(C.kFSEventStreamEventFlagItemModified|C.kFSEventStreamEventFlagItemInodeMetaMod) != 0:
+			changes = append(changes, fsChange{path: path, modified: true})
+		}
+	}
+	if len(changes) > 0 {
+		if glog.V(1) {
+			glog.Infof("FSEvents: %v", changes)
+		}
+		fn(changes)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+// +build cgo
+
+package kati
+
+// The exported callback of FSEvents is in its own file, since a file
+// which has //export can't define C functions in its preamble.
+
+// #include <stddef.h>
+// #include <stdint.h>
+import "C"
+
+import "unsafe"
+
+//export katiFSEvents
+func katiFSEvents(handle C.uintptr_t, n C.size_t, cpaths **C.char, cflags *C.uint32_t) {
+	ps := (*[1 << 28]*C.char)(unsafe.Pointer(cpaths))[:n:n]
+	fs := (*[1 << 28]C.uint32_t)(unsafe.Pointer(cflags))[:n:n]
+	paths := make([]string, len(ps))
+	flags := make([]uint32, len(fs))
+	for i := range ps {
+		paths[i] = C.GoString(ps[i])
+		flags[i] = uint32(fs[i])
+	}
+	fsEventsCallback(uintptr(handle), paths, flags)
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// File system snapshot shared by $(wildcard) and find commands.
+//
+// The find cache scans the source tree once, in parallel, when it is
+// initialized. When the scan finishes, entries of the scanned
+// directories are indexed, and the wildcard cache reads directories in
+// the tree and its extra roots from the index instead of the file
+// system. Directories pruned by the find cache, directories out of the
+// current directory and extra roots, and symlinks are read from the
+// file system as usual.
+//
+// The snapshot is used only once the scan finishes, so $(wildcard)
+// evaluated while scanning doesn't wait for it. A stale find cache
+// isn't used for $(wildcard) either. A directory modified after it was
+// scanned, e.g. by a command of $(shell), is read from the file system,
+// which costs an lstat instead of reading the directory.
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// fsSnapshot is an index of directory entries of the scanned tree.
+type fsSnapshot struct {
+	// dirent has sorted names of each scanned directory, which is
+	// relative to the current directory and separated by '/'.
+	dirent map[string][]string
+	// mtime has modification times of scanned directories when they
+	// were scanned, or is nil if they are not checked.
+	mtime map[string]int64
+}
+
+// newFSSnapshot indexes files sorted by path. pruned are directories
+// not scanned, which are listed in their parents. Extra roots out of
+// the tree aren't listed in their parents, which are not scanned. dirs
+// are the scanned directories with their modification times.
+func newFSSnapshot(files []fileInfo, pruned []string, dirs []findCacheDirMtime) *fsSnapshot {
+	s := &fsSnapshot{
+		dirent: map[string][]string{".": nil},
+	}
+	if dirs != nil {
+		s.mtime = make(map[string]int64, len(dirs))
+		for _, d := range dirs {
+			s.mtime[d.Path] = d.Mtime
+		}
+	}
+	for _, fi := range files {
+		dir := slashDir(fi.path)
+		// parents precede their files.
+		if names, ok := s.dirent[dir]; ok {
+			s.dirent[dir] = append(names, fi.path[strings.LastIndexByte(fi.path, '/')+1:])
+		}
+		if fi.mode.IsDir() {
+			if _, ok := s.dirent[fi.path]; !ok {
+				s.dirent[fi.path] = nil
+			}
+		}
+	}
+	for _, p := range pruned {
+		dir := slashDir(p)
+		names := append(s.dirent[dir], p[strings.LastIndexByte(p, '/')+1:])
+		sort.Strings(names)
+		s.dirent[dir] = names
+	}
+	return s
+}
+
+// readdirnames returns the entries of dir, a path in the cache. ok is
+// false if dir is not in the snapshot, e.g. pruned, a symlink, or out
+// of the tree and extra roots. A missing directory in a scanned
+// directory has no entries.
+func (s *fsSnapshot) readdirnames(dir string) (names []string, ok bool) {
+	dir = slashClean(dir)
+	if dir == ".." {
+		// the parent of the tree isn't scanned.
+		return nil, false
+	}
+	names, ok = s.dirent[dir]
+	if ok {
+		if s.modified(dir) {
+			return nil, false
+		}
+		return names, true
+	}
+	parent, ok := s.dirent[slashDir(dir)]
+	if !ok {
+		return nil, false
+	}
+	base := dir[strings.LastIndexByte(dir, '/')+1:]
+	i := sort.SearchStrings(parent, base)
+	if i < len(parent) && parent[i] == base {
+		// a file, a symlink, or a pruned directory.
+		return nil, false
+	}
+	// dir may be created after the scan.
+	return nil, !s.modified(slashDir(dir))
+}
+
+// modified reports whether the scanned directory dir may be modified
+// after it was scanned.
+func (s *fsSnapshot) modified(dir string) bool {
+	if s.mtime == nil {
+		return false
+	}
+	mtime, ok := s.mtime[dir]
+	if !ok || mtime == 0 {
+		return true
+	}
+	fi, err := os.Lstat(filepath.FromSlash(dir))
+	if err != nil || fi.ModTime().UnixNano() != mtime {
+		glog.V(1).Infof("fs snapshot: %s modified", dir)
+		return true
+	}
+	return false
+}
+
+// snapshotT holds the snapshot of the find cache.
+type snapshotT struct {
+	mu sync.Mutex
+	s  *fsSnapshot
+}
+
+func (c *androidFindCacheT) setSnapshot(s *fsSnapshot) {
+	c.snapshot.mu.Lock()
+	c.snapshot.s = s
+	c.snapshot.mu.Unlock()
+	logStats("%d dirs in fs snapshot", len(s.dirent))
+}
+
+// readdirnames returns entries of dir from the snapshot if the scan
+// finished and the find cache is not stale. dir may be absolute, or
+// relative to the current directory.
+func (c *androidFindCacheT) readdirnames(dir string) ([]string, bool) {
+	if !UseFindCache || atomic.LoadInt32(&c.stale) != 0 {
+		return nil, false
+	}
+	dir, ok := c.roots.cachePath(dir)
+	if !ok {
+		return nil, false
+	}
+	c.snapshot.mu.Lock()
+	s := c.snapshot.s
+	c.snapshot.mu.Unlock()
+	if s == nil {
+		return nil, false
+	}
+	return s.readdirnames(dir)
+}
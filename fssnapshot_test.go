@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFSSnapshot(t *testing.T) {
+	files := []fileInfo{
+		{path: "Android.mk"},
+		{path: "a", mode: os.ModeDir},
+		{path: "a/b.c"},
+		{path: "a/c", mode: os.ModeDir},
+		{path: "a/empty", mode: os.ModeDir},
+		{path: "a/c/d.c"},
+		{path: "a/link", mode: os.ModeSymlink},
+		{path: "a-b.c"},
+	}
+	sort.Sort(fileInfoByName(files))
+	s := newFSSnapshot(files, []string{"out", "a/.git"}, nil)
+	for _, tc := range []struct {
+		dir    string
+		want   []string
+		wantOK bool
+	}{
+		{dir: ".", want: []string{"Android.mk", "a", "a-b.c", "out"}, wantOK: true},
+		{dir: "", want: []string{"Android.mk", "a", "a-b.c", "out"}, wantOK: true},
+		{dir: "a", want: []string{".git", "b.c", "c", "empty", "link"}, wantOK: true},
+		{dir: "./a/", want: []string{".git", "b.c", "c", "empty", "link"}, wantOK: true},
+		{dir: "a/c", want: []string{"d.c"}, wantOK: true},
+		{dir: "a/empty", wantOK: true},
+		{dir: "a/none", wantOK: true},
+		{dir: "a/link"},
+		{dir: "a/.git"},
+		{dir: "out"},
+		{dir: "out/x"},
+		{dir: "a/none/x"},
+		{dir: "../a"},
+		{dir: "/a"},
+	} {
+		got, ok := s.readdirnames(tc.dir)
+		if ok != tc.wantOK || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readdirnames(%q)=%q, %t; want %q, %t", tc.dir, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestFSSnapshotModified(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"d/a.c", "e/b.c"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := UseFindCache
+	defer func() { UseFindCache = saved }()
+	UseFindCache = true
+	c := &androidFindCacheT{}
+	c.filesch = make(chan []fileInfo, 1)
+	c.leavesch = make(chan []fileInfo, 1)
+	c.start(nil, nil)
+	c.files = <-c.filesch
+
+	if got, ok := c.readdirnames("d"); !ok || !reflect.DeepEqual(got, []string{"a.c"}) {
+		t.Errorf("readdirnames(d)=%q, %t; want %q, true", got, ok, []string{"a.c"})
+	}
+	// e.g. by $(shell touch d/new.c).
+	err := ioutil.WriteFile("d/new.c", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes("d", future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		dir    string
+		want   []string
+		wantOK bool
+	}{
+		{dir: "d"},
+		{dir: "d/new"},
+		{dir: "e", want: []string{"b.c"}, wantOK: true},
+	} {
+		got, ok := c.readdirnames(tc.dir)
+		if ok != tc.wantOK || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readdirnames(%q)=%q, %t; want %q, %t", tc.dir, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
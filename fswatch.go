@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// File system watchers invalidate the wildcard cache and the find cache
+// when files are created, removed or renamed, so that a long running
+// process which evaluates makefiles repeatedly sees the current files.
+//
+// Directories pruned by the find cache, e.g. out, are not watched where
+// every directory costs a watch, as builds create many files in them.
+// The wildcard cache checks modification times of directories under
+// them instead.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errFSWatchUnsupported = errors.New("file system watch is not supported on this platform")
+
+// fsChange is a change of the file system reported by a watcher.
+type fsChange struct {
+	path string // absolute path of a file or a directory.
+	// recursive is true if anything under path may be changed, e.g.
+	// path is a removed directory or events were dropped.
+	recursive bool
+	// modified is true if only contents or attributes of path are
+	// changed, which don't change entries of directories.
+	modified bool
+}
+
+// invalidateCaches invalidates caches of s for changes.
+func (s *Session) invalidateCaches(changes []fsChange) {
+	for _, ch := range changes {
+		if ch.modified {
+			// find stats files for mtimes.
+			continue
+		}
+		if isFSNoise(filepath.Base(ch.path)) {
+			continue
+		}
+		// entries of the parent directory, and entries of path itself
+		// if it is a directory.
+		s.wildcardCache.invalidate(filepath.Dir(ch.path), false)
+		s.wildcardCache.invalidate(ch.path, ch.recursive)
+		s.androidFindCache.invalidate(ch.path)
+	}
+}
+
+// unwatchedFunc returns a function reporting whether a directory is
+// not watched when root is watched, i.e. it is a directory under root
+// pruned by the find cache, or under one. dir may be absolute or
+// relative to the current directory. It returns nil if nothing is
+// pruned.
+func (s *Session) unwatchedFunc(root string) func(dir string) bool {
+	c := s.androidFindCache
+	if len(c.prunes) == 0 {
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	return func(dir string) bool {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(wd, dir)
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return false
+		}
+		return c.underPrune(filepath.ToSlash(rel))
+	}
+}
+
+// watch starts watching root except unwatched directories, and calls
+// fn for changes.
+func (s *Session) watch(root string, unwatched func(string) bool, fn func([]fsChange)) (stop func(), err error) {
+	stop, err = watchFileSystem(root, unwatched, fn)
+	if err != nil {
+		return nil, err
+	}
+	s.wildcardCache.unwatched = unwatched
+	return stop, nil
+}
+
+// WatchFileSystem starts watching changes of files under root, and
+// invalidates caches of $(wildcard) and find commands for them.
+// It returns a function to stop watching.
+func WatchFileSystem(root string) (stop func(), err error) {
+	return DefaultSession.WatchFileSystem(root)
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package kati
+
+// inotify based file system watcher for Linux.
+//
+// inotify watches directories, not trees, so every directory under the
+// root is watched, and a directory created later is watched when it is
+// created. Files created in the new directory before it is watched are
+// covered by a recursive change of the directory. Directories for which
+// skip returns true are not watched, nor directories under them.
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+type inotifyWatcher struct {
+	fd   int
+	f    *os.File
+	root string
+	skip func(string) bool
+	fn   func([]fsChange)
+	// dirs maps watch descriptors to watched directories. It is
+	// accessed only by the goroutine reading events once watching
+	// started.
+	dirs    map[int32]string
+	stopped chan struct{}
+}
+
+func watchFileSystem(root string, skip func(string) bool, fn func([]fsChange)) (func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		fd: fd,
+		// a non-blocking file is read by the runtime poller, so that
+		// Close interrupts Read.
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		root:    root,
+		skip:    skip,
+		fn:      fn,
+		dirs:    make(map[int32]string),
+		stopped: make(chan struct{}),
+	}
+	err = w.addTree(root)
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	glog.Infof("watch %s by inotify: %d dirs", root, len(w.dirs))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run()
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(w.stopped)
+			w.f.Close()
+			<-done
+		})
+	}, nil
+}
+
+// addTree watches dir and directories under it.
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir && !os.IsNotExist(err) {
+				return err
+			}
+			// removed or unreadable after its parent was read.
+			glog.V(1).Infof("inotify: %v", err)
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != w.root && w.skip != nil && w.skip(path) {
+			glog.V(1).Infof("inotify: skip %s", path)
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		switch err {
+		case nil:
+		case syscall.ENOENT, syscall.ENOTDIR:
+			return nil
+		case syscall.ENOSPC:
+			return &os.PathError{Op: "inotify_add_watch", Path: path, Err: errInotifyWatchLimit}
+		default:
+			return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// errInotifyWatchLimit is returned when the tree has more directories
+// than the limit of watches.
+var errInotifyWatchLimit = errors.New("too many directories to watch; increase fs.inotify.max_user_watches")
+
+// removeTree stops watching dir and directories under it. Entries of
+// dirs are removed by IN_IGNORED events.
+func (w *inotifyWatcher) removeTree(dir string) {
+	for wd, d := range w.dirs {
+		if d == dir || strings.HasPrefix(d, dir+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	}
+}
+
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			select {
+			case <-w.stopped:
+			default:
+				glog.Warningf("inotify: %v", err)
+			}
+			return
+		}
+		changes := w.changes(buf[:n])
+		if len(changes) > 0 {
+			if glog.V(1) {
+				glog.Infof("inotify: %v", changes)
+			}
+			w.fn(changes)
+		}
+	}
+}
+
+// changes converts inotify events in buf to changes.
+func (w *inotifyWatcher) changes(buf []byte) []fsChange {
+	var changes []fsChange
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		name := buf[syscall.SizeofInotifyEvent : syscall.SizeofInotifyEvent+ev.Len]
+		buf = buf[syscall.SizeofInotifyEvent+ev.Len:]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			// events were dropped.
+			changes = append(changes, fsChange{path: w.root, recursive: true})
+			continue
+		}
+		path, ok := w.dirs[ev.Wd]
+		if !ok {
+			continue
+		}
+		if len(name) > 0 {
+			path = filepath.Join(path, string(name))
+		}
+		isDir := ev.Mask&syscall.IN_ISDIR != 0
+		switch {
+		case ev.Mask&syscall.IN_IGNORED != 0:
+			// the watch was removed, e.g. the directory was removed.
+			delete(w.dirs, ev.Wd)
+		case ev.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+			// reported as an entry of the parent, except the root.
+			if path == w.root {
+				changes = append(changes, fsChange{path: path, recursive: true})
+			}
+		case ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			if isDir {
+				err := w.addTree(path)
+				if err != nil {
+					glog.Warningf("inotify: %v", err)
+				}
+			}
+			changes = append(changes, fsChange{path: path, recursive: isDir})
+		case ev.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+			if isDir && ev.Mask&syscall.IN_MOVED_FROM != 0 {
+				// watched again if it is moved into the tree.
+				w.removeTree(path)
+			}
+			changes = append(changes, fsChange{path: path, recursive: isDir})
+		case ev.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_ATTRIB) != 0:
+			changes = append(changes, fsChange{path: path, modified: true})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInotifyWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "a"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan fsChange, 100)
+	stop, err := watchFileSystem(dir, nil, func(changes []fsChange) {
+		for _, c := range changes {
+			ch <- c
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for _, tc := range []struct {
+		op   func(path string) error
+		path string
+		want fsChange
+	}{
+		{
+			op:   func(path string) error { return ioutil.WriteFile(path, nil, 0644) },
+			path: "a/x.mk",
+			want: fsChange{path: "a/x.mk"},
+		},
+		{
+			op:   func(path string) error { return ioutil.WriteFile(path, []byte("x"), 0644) },
+			path: "a/x.mk",
+			want: fsChange{path: "a/x.mk", modified: true},
+		},
+		{
+			op:   func(path string) error { return os.Mkdir(path, 0755) },
+			path: "b",
+			want: fsChange{path: "b", recursive: true},
+		},
+		{
+			// b is watched after it is created.
+			op:   func(path string) error { return ioutil.WriteFile(path, nil, 0644) },
+			path: "b/y.mk",
+			want: fsChange{path: "b/y.mk"},
+		},
+		{
+			op:   func(path string) error { return os.Rename(filepath.Join(dir, "a"), path) },
+			path: "c",
+			want: fsChange{path: "c", recursive: true},
+		},
+		{
+			op:   os.Remove,
+			path: "c/x.mk",
+			want: fsChange{path: "c/x.mk"},
+		},
+	} {
+		tc.want.path = filepath.Join(dir, tc.want.path)
+		err := tc.op(filepath.Join(dir, tc.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		timeout := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case c := <-ch:
+				if c == tc.want {
+					break wait
+				}
+			case <-timeout:
+				t.Errorf("%s: no change %v", tc.path, tc.want)
+				break wait
+			}
+		}
+	}
+}
+
+func TestInotifyWatcherSkipsPruned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"a", "out/gen"} {
+		err = os.MkdirAll(filepath.Join(dir, d), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewSession()
+	s.androidFindCache.prunes = []string{"out"}
+	unwatched := s.unwatchedFunc(dir)
+	for _, tc := range []struct {
+		dir  string
+		want bool
+	}{
+		{dir: dir, want: false},
+		{dir: filepath.Join(dir, "a"), want: false},
+		{dir: filepath.Join(dir, "out"), want: true},
+		{dir: filepath.Join(dir, "out/gen"), want: true},
+		{dir: filepath.Dir(dir), want: false},
+	} {
+		if got := unwatched(tc.dir); got != tc.want {
+			t.Errorf("unwatched(%q)=%t; want %t", tc.dir, got, tc.want)
+		}
+	}
+
+	ch := make(chan fsChange, 100)
+	stop, err := watchFileSystem(dir, unwatched, func(changes []fsChange) {
+		for _, c := range changes {
+			ch <- c
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	for _, fn := range []string{"out/gen/x.mk", "a/y.mk"} {
+		err = ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// events are read in order, so a change of out/gen/x.mk would be
+	// read before a/y.mk.
+	want := filepath.Join(dir, "a/y.mk")
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-ch:
+			if c.path == want {
+				return
+			}
+			t.Errorf("change %v in a pruned directory", c)
+		case <-timeout:
+			t.Fatalf("no change of %s", want)
+		}
+	}
+}
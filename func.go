@@ -16,14 +16,17 @@ package kati
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -72,9 +75,10 @@ var (
 		"realpath":  func() mkFunc { return &funcRealpath{} },
 		"abspath":   func() mkFunc { return &funcAbspath{} },
 
-		"if":  func() mkFunc { return &funcIf{} },
-		"and": func() mkFunc { return &funcAnd{} },
-		"or":  func() mkFunc { return &funcOr{} },
+		"if":     func() mkFunc { return &funcIf{} },
+		"and":    func() mkFunc { return &funcAnd{} },
+		"or":     func() mkFunc { return &funcOr{} },
+		"intcmp": func() mkFunc { return &funcIntcmp{} },
 
 		"value": func() mkFunc { return &funcValue{} },
 
@@ -83,7 +87,9 @@ var (
 		"shell":   func() mkFunc { return &funcShell{} },
 		"call":    func() mkFunc { return &funcCall{} },
 		"foreach": func() mkFunc { return &funcForeach{} },
+		"let":     func() mkFunc { return &funcLet{} },
 
+		"file":    func() mkFunc { return &funcFile{} },
 		"origin":  func() mkFunc { return &funcOrigin{} },
 		"flavor":  func() mkFunc { return &funcFlavor{} },
 		"info":    func() mkFunc { return &funcInfo{} },
@@ -92,6 +98,39 @@ var (
 	}
 )
 
+// funcMapMu protects funcMap from RegisterFunc called while parsing,
+// e.g. by objects loaded with the load directive.
+var funcMapMu sync.RWMutex
+
+// lookupFunc returns the constructor of function name.
+func lookupFunc(name string) (func() mkFunc, bool) {
+	funcMapMu.RLock()
+	f, ok := funcMap[name]
+	funcMapMu.RUnlock()
+	return f, ok
+}
+
+// RegisterFunc registers fn as a make function called name, so
+// makefiles can call it as $(name arg1,arg2,...). fn receives expanded
+// arguments and its result is the expansion of the call.
+// Makefiles parsed before fn is registered don't see it, so it should
+// be called in init or in setup of an object for the load directive.
+// It panics if name is empty, contains whitespace, or is already defined.
+func RegisterFunc(name string, fn func(args []string) string) {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		panic(fmt.Sprintf("kati: invalid function name %q", name))
+	}
+	if fn == nil {
+		panic(fmt.Sprintf("kati: RegisterFunc %s: nil func", name))
+	}
+	funcMapMu.Lock()
+	defer funcMapMu.Unlock()
+	if _, dup := funcMap[name]; dup {
+		panic(fmt.Sprintf("kati: RegisterFunc called twice for %s", name))
+	}
+	funcMap[name] = func() mkFunc { return &funcCustom{name: name, fn: fn} }
+}
+
 type arityError struct {
 	narg int
 	name string
@@ -131,6 +170,8 @@ func (c *fclosure) AddArg(v Value) {
 	c.args = append(c.args, v)
 }
 
+func (c *fclosure) closure() *fclosure { return c }
+
 func (c *fclosure) String() string {
 	if len(c.args) == 0 {
 		return "$(func)"
@@ -214,17 +255,15 @@ func (f *funcPatsubst) Eval(w evalWriter, ev *Evaluator) error {
 		return err
 	}
 	t := time.Now()
-	pat := fargs[0]
-	repl := fargs[1]
+	pat := matcherCache.percentPattern(fargs[0])
+	repl := matcherCache.percentPattern(fargs[1])
 	for _, word := range wb.words {
-		pre, subst, post := substPatternBytes(pat, repl, word)
-		var sword []byte
-		sword = append(sword, pre...)
-		if subst != nil {
-			sword = append(sword, subst...)
-			sword = append(sword, post...)
+		pre, subst, post := pat.subst(repl, word)
+		if subst == nil {
+			w.writeWord(pre)
+			continue
 		}
-		w.writeWord(sword)
+		w.writeWordBytes(pre, subst, post)
 	}
 	abuf.release()
 	wb.release()
@@ -297,9 +336,11 @@ func (f *funcFilter) Eval(w evalWriter, ev *Evaluator) error {
 		return err
 	}
 	t := time.Now()
+	var pbuf [8]*percentPattern
+	pats := matcherCache.percentPatterns(pbuf[:0], patternsBuffer.words)
 	for _, text := range textBuffer.words {
-		for _, pat := range patternsBuffer.words {
-			if matchPatternBytes(pat, text) {
+		for _, pat := range pats {
+			if pat.match(text) {
 				w.writeWord(text)
 			}
 		}
@@ -329,10 +370,12 @@ func (f *funcFilterOut) Eval(w evalWriter, ev *Evaluator) error {
 		return err
 	}
 	t := time.Now()
+	var pbuf [8]*percentPattern
+	pats := matcherCache.percentPatterns(pbuf[:0], patternsBuffer.words)
 Loop:
 	for _, text := range textBuffer.words {
-		for _, pat := range patternsBuffer.words {
-			if matchPatternBytes(pat, text) {
+		for _, pat := range pats {
+			if pat.match(text) {
 				continue Loop
 			}
 		}
@@ -545,14 +588,14 @@ func (f *funcJoin) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	t := time.Now()
 	for i := 0; i < len(wb1.words) || i < len(wb2.words); i++ {
-		var word []byte
+		var w1, w2 []byte
 		if i < len(wb1.words) {
-			word = append(word, wb1.words[i]...)
+			w1 = wb1.words[i]
 		}
 		if i < len(wb2.words) {
-			word = append(word, wb2.words[i]...)
+			w2 = wb2.words[i]
 		}
-		w.writeWord(word)
+		w.writeWordBytes(w1, w2, nil)
 	}
 	wb1.release()
 	wb2.release()
@@ -564,6 +607,7 @@ type funcWildcard struct{ fclosure }
 
 func (f *funcWildcard) Arity() int { return 1 }
 func (f *funcWildcard) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
 	err := assertArity("wildcard", 1, len(f.args))
 	if err != nil {
 		return err
@@ -573,7 +617,7 @@ func (f *funcWildcard) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	te := traceEvent.begin("wildcard", tmpval(wb.Bytes()), traceEventMain)
+	te := traceEvent.begin("wildcard", tmpval(wb.Bytes()), ev.tid)
 	if ev.avoidIO {
 		ev.hasIO = true
 		io.WriteString(w, "$(/bin/ls -d ")
@@ -584,12 +628,23 @@ func (f *funcWildcard) Eval(w evalWriter, ev *Evaluator) error {
 		return nil
 	}
 	t := time.Now()
+	home := func() string {
+		h, _ := ev.EvaluateVar("HOME")
+		return h
+	}
 	for _, word := range wb.words {
-		pat := string(word)
-		err = wildcard(w, pat)
+		pat := expandTilde(string(word), home)
+		files, unsorted, err := ev.sess.wildcard(w, pat)
 		if err != nil {
 			return err
 		}
+		if unsorted != nil {
+			if err := ev.checkIsolated("$(wildcard)"); err != nil {
+				return err
+			}
+			warn(ev.srcpos, DiagWildcardOrder, "$(wildcard %s) is %q in directory order", pat, strings.Join(unsorted, " "))
+		}
+		ev.fingerprintWildcard(pat, files)
 	}
 	wb.release()
 	traceEvent.end(te)
@@ -722,10 +777,7 @@ func (f *funcAddsuffix) Eval(w evalWriter, ev *Evaluator) error {
 	t := time.Now()
 	suf := abuf.Bytes()
 	for _, word := range wb.words {
-		var name []byte
-		name = append(name, word...)
-		name = append(name, suf...)
-		w.writeWord(name)
+		w.writeWordBytes(word, suf, nil)
 	}
 	wb.release()
 	abuf.release()
@@ -754,10 +806,7 @@ func (f *funcAddprefix) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	t := time.Now()
 	for _, word := range wb.words {
-		var name []byte
-		name = append(name, pre...)
-		name = append(name, word...)
-		w.writeWord(name)
+		w.writeWordBytes(pre, word, nil)
 	}
 	wb.release()
 	abuf.release()
@@ -769,6 +818,7 @@ type funcRealpath struct{ fclosure }
 
 func (f *funcRealpath) Arity() int { return 1 }
 func (f *funcRealpath) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
 	err := assertArity("realpath", 1, len(f.args))
 	if err != nil {
 		return err
@@ -856,6 +906,56 @@ func (f *funcIf) Eval(w evalWriter, ev *Evaluator) error {
 	return nil
 }
 
+// https://www.gnu.org/software/make/manual/html_node/Conditional-Functions.html
+type funcIntcmp struct{ fclosure }
+
+func (f *funcIntcmp) Arity() int { return 5 }
+func (f *funcIntcmp) Eval(w evalWriter, ev *Evaluator) error {
+	err := assertArity("intcmp", 2, len(f.args))
+	if err != nil {
+		return err
+	}
+	var nums [2]*big.Int
+	for i, nth := range []string{"first", "second"} {
+		abuf := newEbuf()
+		err = f.args[i+1].Eval(abuf, ev)
+		if err != nil {
+			return err
+		}
+		v := string(trimSpaceBytes(abuf.Bytes()))
+		abuf.release()
+		n, ok := new(big.Int).SetString(strings.TrimPrefix(v, "+"), 10)
+		if !ok || strings.HasPrefix(v, "+-") {
+			return ev.errorf(`*** non-numeric %s argument to "intcmp" function: %q.`, nth, v)
+		}
+		nums[i] = n
+	}
+	c := nums[0].Cmp(nums[1])
+	if len(f.args) == 3 {
+		// the value if equal, or empty.
+		if c == 0 {
+			io.WriteString(w, nums[0].String())
+		}
+		return nil
+	}
+	// lt-part, eq-part and gt-part, where gt-part defaults to
+	// eq-part.
+	i := 3
+	switch {
+	case c == 0:
+		i = 4
+	case c > 0:
+		i = 5
+		if len(f.args) <= 5 {
+			i = 4
+		}
+	}
+	if i >= len(f.args) {
+		return nil
+	}
+	return f.args[i].Eval(w, ev)
+}
+
 type funcAnd struct{ fclosure }
 
 func (f *funcAnd) Arity() int { return 0 }
@@ -931,50 +1031,153 @@ func hasNoIoInShellScript(s []byte) bool {
 	return true
 }
 
+// shellRun is a command of $(shell) to run in the shell.
+type shellRun struct {
+	shell, flags, cmd string
+	env               []string
+	sc                *shellCacheCmd
+	// pos is the position of $(shell), for the shell log.
+	pos     srcpos
+	logging bool
+}
+
 func (f *funcShell) Eval(w evalWriter, ev *Evaluator) error {
-	err := assertArity("shell", 1, len(f.args))
+	sr, err := f.eval(w, ev)
+	if err != nil || sr == nil {
+		return err
+	}
+	out, err := ev.runShell(sr, ev.tid)
 	if err != nil {
 		return err
 	}
+	w.Write(formatCommandOutput(out))
+	return nil
+}
+
+// eval expands the command of f. It returns the command to run in the
+// shell, or nil if the output is already written to w, e.g. by the find
+// cache.
+func (f *funcShell) eval(w evalWriter, ev *Evaluator) (*shellRun, error) {
+	ev.expandCache.uncacheable()
+	err := assertArity("shell", 1, len(f.args))
+	if err != nil {
+		return nil, err
+	}
 	abuf := newEbuf()
 	err = f.args[1].Eval(abuf, ev)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if ev.avoidIO && !hasNoIoInShellScript(abuf.Bytes()) {
-		te := traceEvent.begin("shell", tmpval(abuf.Bytes()), traceEventMain)
+		te := traceEvent.begin("shell", tmpval(abuf.Bytes()), ev.tid)
 		ev.hasIO = true
 		io.WriteString(w, "$(")
 		w.Write(abuf.Bytes())
 		writeByte(w, ')')
 		traceEvent.end(te)
 		abuf.release()
-		return nil
+		return nil, nil
 	}
 	arg := abuf.String()
 	abuf.release()
+	if err := ev.checkIsolated("$(shell %s)", arg); err != nil {
+		return nil, err
+	}
 	shellVar, err := ev.EvaluateVar("SHELL")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	shellFlags, err := ev.EvaluateVar(".SHELLFLAGS")
+	if err != nil {
+		return nil, err
 	}
-	cmdline := []string{shellVar, "-c", arg}
+	logging := shellLog.isEnabled()
+	start := time.Now()
+	if !isCmdShell(shellVar) {
+		if n, ok := evalFindCommand(w, ev.sess, arg); ok {
+			if logging {
+				shellLog.add(ev.srcpos, shellVar, arg, ShellFromFindCache, start, n, nil)
+			}
+			return nil, nil
+		}
+	}
+	env, err := ev.environ()
+	if err != nil {
+		return nil, err
+	}
+	if UseShellBuiltins {
+		if out, ok := shellFastPath(shellVar, shellFlags, arg, env); ok {
+			glog.V(1).Infof("shell fast path: %q", arg)
+			ev.fingerprintShell(shellVar, shellFlags, arg, env, out)
+			w.Write(formatCommandOutput(out))
+			if logging {
+				shellLog.add(ev.srcpos, shellVar, arg, ShellFastPath, start, len(out), nil)
+			}
+			return nil, nil
+		}
+	}
+	sc, err := newShellCacheCmd(ev, shellVar, shellFlags, arg, env)
+	if err != nil {
+		return nil, err
+	}
+	if sc != nil {
+		if out, ok := shellCache.lookup(sc); ok {
+			glog.V(1).Infof("shell cache hit: %q", arg)
+			ev.fingerprintShell(shellVar, shellFlags, arg, env, out)
+			w.Write(formatCommandOutput(out))
+			if logging {
+				shellLog.add(ev.srcpos, shellVar, arg, ShellFromCache, start, len(out), nil)
+			}
+			return nil, nil
+		}
+	}
+	return &shellRun{
+		shell:   shellVar,
+		flags:   shellFlags,
+		cmd:     arg,
+		env:     env,
+		sc:      sc,
+		pos:     ev.srcpos,
+		logging: logging,
+	}, nil
+}
+
+// runShell runs sr, and returns its output. It is also called on
+// workers of batched commands, so it must not use fields of ev which
+// are modified while evaluating.
+func (ev *Evaluator) runShell(sr *shellRun, tid int) ([]byte, error) {
+	cmd, cleanup, err := shellCommand(ev.ctx, sr.shell, sr.flags, sr.cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if ev.ctx.Done() != nil {
+		killShellGroup(cmd)
+		// children of the shell may still keep the output open
+		// after it is killed.
+		cmd.WaitDelay = time.Second
+	}
+	cmd.Env = sr.env
 	if glog.V(1) {
-		glog.Infof("shell %q", cmdline)
+		glog.Infof("shell %q", cmd.Args)
 	}
-	cmd := exec.Cmd{
-		Path:   cmdline[0],
-		Args:   cmdline,
-		Stderr: os.Stderr,
+	cmd.Stderr = os.Stderr
+	if sr.sc != nil {
+		cmd.Stderr = sr.sc
 	}
-	te := traceEvent.begin("shell", literal(arg), traceEventMain)
+	te := traceEvent.begin("shell", literal(sr.cmd), tid)
+	defer traceEvent.end(te)
 	out, err := cmd.Output()
 	shellStats.add(time.Since(te.t))
+	if sr.logging {
+		shellLog.add(sr.pos, sr.shell, sr.cmd, ShellRun, te.t, len(out), err)
+	}
+	shellCache.update(sr.sc, out, err)
 	if err != nil {
-		glog.Warningf("$(shell %q) failed: %q", arg, err)
+		glog.Warningf("$(shell %q) failed: %q", sr.cmd, err)
 	}
-	w.Write(formatCommandOutput(out))
-	traceEvent.end(te)
-	return nil
+	ev.fingerprintShell(sr.shell, sr.flags, sr.cmd, sr.env, out)
+	return out, nil
 }
 
 func (f *funcShell) Compact() Value {
@@ -1011,6 +1214,9 @@ type funcCall struct{ fclosure }
 func (f *funcCall) Arity() int { return 0 }
 
 func (f *funcCall) Eval(w evalWriter, ev *Evaluator) error {
+	if len(f.args) < 2 {
+		return nil
+	}
 	abuf := newEbuf()
 	fargs, err := ev.args(abuf, f.args[1:]...)
 	if err != nil {
@@ -1018,11 +1224,16 @@ func (f *funcCall) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	varname := fargs[0]
 	variable := string(varname)
-	te := traceEvent.begin("call", literal(variable), traceEventMain)
+	te := traceEvent.begin("call", literal(variable), ev.tid)
+	pd := ev.profBegin(ProfileCall, variable)
 	if glog.V(1) {
 		glog.Infof("call %q variable %q", f.args[1], variable)
 	}
 	v := ev.LookupVar(variable)
+	ev.symbols.ref(variable, ev.srcpos)
+	if err := ev.traceVar(variable, "%s called with %q", variable, fargs[1:]); err != nil {
+		return err
+	}
 	// Evalualte all arguments first before we modify the table.
 	var args []tmpval
 	// $0 is variable.
@@ -1040,6 +1251,7 @@ func (f *funcCall) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	oldParams := ev.paramVars
 	ev.paramVars = args
+	params := ev.expandCache.enterCall()
 
 	var buf bytes.Buffer
 	if glog.V(1) {
@@ -1050,6 +1262,8 @@ func (f *funcCall) Eval(w evalWriter, ev *Evaluator) error {
 		return err
 	}
 	ev.paramVars = oldParams
+	ev.expandCache.leaveCall(params)
+	ev.profEnd(pd)
 	traceEvent.end(te)
 	if glog.V(1) {
 		glog.Infof("call %q variable %q return %q", f.args[1], variable, buf.Bytes())
@@ -1072,8 +1286,13 @@ func (f *funcValue) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	v := ev.LookupVar(abuf.String())
+	name := abuf.String()
+	v := ev.LookupVar(name)
+	ev.symbols.ref(name, ev.srcpos)
 	abuf.release()
+	if err := ev.traceVar(name, "$(value %s): %q", name, v.String()); err != nil {
+		return err
+	}
 	io.WriteString(w, v.String())
 	return nil
 }
@@ -1083,6 +1302,7 @@ type funcEval struct{ fclosure }
 
 func (f *funcEval) Arity() int { return 1 }
 func (f *funcEval) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
 	err := assertArity("eval", 1, len(f.args))
 	if err != nil {
 		return err
@@ -1094,7 +1314,7 @@ func (f *funcEval) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	s := abuf.Bytes()
 	glog.V(1).Infof("eval %v=>%q at %s", f.args[1], s, ev.srcpos)
-	mk, err := parseMakefileBytes(trimSpaceBytes(s), ev.srcpos)
+	mk, err := parseMakefileBytes(trimSpaceBytes(s), ev.srcpos, ev.recipePrefix)
 	if err != nil {
 		return ev.errorf("%v", err)
 	}
@@ -1200,8 +1420,8 @@ func parseAssignLiteral(s string) (lhs, op string, rhs Value, ok bool) {
 		op = s[eq-1 : eq+1]
 	}
 	lhs = strings.TrimSpace(lhs)
-	if strings.IndexAny(lhs, ":$") >= 0 {
-		// target specific var, or need eval.
+	if strings.IndexAny(lhs, ":$ \t") >= 0 {
+		// target specific var, need eval, or override/export.
 		return "", "", nil, false
 	}
 	r := strings.TrimLeft(s[eq+1:], " \t")
@@ -1220,6 +1440,7 @@ func (f *funcEvalAssign) String() string {
 }
 
 func (f *funcEvalAssign) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
 	var abuf evalBuffer
 	abuf.resetSep()
 	err := f.rhs.Eval(&abuf, ev)
@@ -1228,6 +1449,7 @@ func (f *funcEvalAssign) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	rhs := trimLeftSpaceBytes(abuf.Bytes())
 	glog.V(1).Infof("evalAssign: lhs=%q rhs=%s %q", f.lhs, f.rhs, rhs)
+	ev.symbols.assign(f.lhs, f.op, "", ev.srcpos)
 	var rvalue Var
 	switch f.op {
 	case ":=":
@@ -1249,6 +1471,13 @@ func (f *funcEvalAssign) Eval(w evalWriter, ev *Evaluator) error {
 	case "+=":
 		prev := ev.LookupVar(f.lhs)
 		if prev.IsDefined() {
+			if err := ev.checkAppend(f.lhs, prev); err != nil {
+				return err
+			}
+			if ev.inRecipe {
+				// see assignAST.evalRHS.
+				prev = copyVar(prev)
+			}
 			rvalue, err = prev.Append(ev, string(rhs))
 			if err != nil {
 				return err
@@ -1259,13 +1488,19 @@ func (f *funcEvalAssign) Eval(w evalWriter, ev *Evaluator) error {
 	case "?=":
 		prev := ev.LookupVar(f.lhs)
 		if prev.IsDefined() {
-			return nil
+			return ev.traceAssign("", f.lhs, "", f.op, tmpval(rhs), prev)
 		}
 		rvalue = &recursiveVar{expr: tmpval(rhs), origin: "file"}
 	}
 	if glog.V(1) {
 		glog.Infof("Eval ASSIGN: %s=%q (flavor:%q)", f.lhs, rvalue, rvalue.Flavor())
 	}
+	if err := ev.traceAssign("", f.lhs, "", f.op, tmpval(rhs), rvalue); err != nil {
+		return err
+	}
+	if err := ev.checkOverride(f.lhs, rvalue); err != nil {
+		return err
+	}
 	ev.outVars.Assign(f.lhs, rvalue)
 	return nil
 }
@@ -1333,6 +1568,7 @@ type funcInfo struct{ fclosure }
 
 func (f *funcInfo) Arity() int { return 1 }
 func (f *funcInfo) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
 	err := assertArity("info", 1, len(f.args))
 	if err != nil {
 		return err
@@ -1347,7 +1583,10 @@ func (f *funcInfo) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%s\n", abuf.String())
+	if err := ev.checkIsolated("$(info)"); err != nil {
+		return err
+	}
+	printMessage(ev.srcpos, "info", abuf.String())
 	abuf.release()
 	return nil
 }
@@ -1356,6 +1595,7 @@ type funcWarning struct{ fclosure }
 
 func (f *funcWarning) Arity() int { return 1 }
 func (f *funcWarning) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
 	err := assertArity("warning", 1, len(f.args))
 	if err != nil {
 		return err
@@ -1370,7 +1610,10 @@ func (f *funcWarning) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%s: %s\n", ev.srcpos, abuf.String())
+	if err := ev.checkIsolated("$(warning)"); err != nil {
+		return err
+	}
+	printMessage(ev.srcpos, "warning", abuf.String())
 	abuf.release()
 	return nil
 }
@@ -1379,6 +1622,7 @@ type funcError struct{ fclosure }
 
 func (f *funcError) Arity() int { return 1 }
 func (f *funcError) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
 	err := assertArity("error", 1, len(f.args))
 	if err != nil {
 		return err
@@ -1394,6 +1638,15 @@ func (f *funcError) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
+	// an isolated evaluator evaluates the file again by the error.
+	if MessageHandler != nil && ev.isolation == nil {
+		MessageHandler(Message{
+			Filename: ev.srcpos.filename,
+			Line:     ev.srcpos.lineno,
+			Func:     "error",
+			Text:     abuf.String(),
+		})
+	}
 	return ev.errorf("*** %s.", abuf.String())
 }
 
@@ -1440,3 +1693,226 @@ func (f *funcForeach) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	return nil
 }
+
+// https://www.gnu.org/software/make/manual/html_node/Let-Function.html
+type funcLet struct{ fclosure }
+
+func (f *funcLet) Arity() int { return 3 }
+
+func (f *funcLet) Eval(w evalWriter, ev *Evaluator) error {
+	err := assertArity("let", 3, len(f.args))
+	if err != nil {
+		return err
+	}
+	abuf := newEbuf()
+	err = f.args[1].Eval(abuf, ev)
+	if err != nil {
+		return err
+	}
+	varnames := splitSpaces(abuf.String())
+	abuf.Reset()
+	err = f.args[2].Eval(abuf, ev)
+	if err != nil {
+		return err
+	}
+	list := abuf.Bytes()
+	// each variable is set to a word of list, and the last one is set
+	// to the rest of list.
+	values := make([][]byte, len(varnames))
+	for i := range varnames {
+		list = trimLeftSpaceBytes(list)
+		if i == len(varnames)-1 {
+			values[i] = append([]byte(nil), trimRightSpaceBytes(list)...)
+			break
+		}
+		word, rest := firstWord(list)
+		values[i] = append([]byte(nil), word...)
+		list = rest
+	}
+	abuf.release()
+
+	olds := make([]Var, len(varnames))
+	lets := make([]*automaticVar, len(varnames))
+	for i, name := range varnames {
+		olds[i] = ev.outVars.Lookup(name)
+		lets[i] = &automaticVar{value: values[i]}
+		ev.outVars.Assign(name, lets[i])
+	}
+	err = f.args[3].Eval(w, ev)
+	for i := len(varnames) - 1; i >= 0; i-- {
+		// keep variables assigned in text.
+		if ev.outVars.Lookup(varnames[i]) != Var(lets[i]) {
+			continue
+		}
+		if olds[i].IsDefined() {
+			ev.outVars[varnames[i]] = olds[i]
+		} else {
+			delete(ev.outVars, varnames[i])
+		}
+	}
+	return err
+}
+
+// http://www.gnu.org/software/make/manual/make.html#File-Function
+type funcFile struct{ fclosure }
+
+func (f *funcFile) Arity() int { return 2 }
+
+func (f *funcFile) Eval(w evalWriter, ev *Evaluator) error {
+	ev.expandCache.uncacheable()
+	err := assertArity("file", 1, len(f.args))
+	if err != nil {
+		return err
+	}
+	abuf := newEbuf()
+	err = f.args[1].Eval(abuf, ev)
+	if err != nil {
+		return err
+	}
+	arg := strings.TrimSpace(abuf.String())
+	abuf.release()
+	var op string
+	switch {
+	case strings.HasPrefix(arg, ">>"):
+		op = ">>"
+	case strings.HasPrefix(arg, ">"), strings.HasPrefix(arg, "<"):
+		op = arg[:1]
+	default:
+		return ev.errorf("*** file: invalid file operation: %s.", arg)
+	}
+	fn := strings.TrimSpace(arg[len(op):])
+	if fn == "" {
+		return ev.errorf("*** file: missing filename.")
+	}
+	if op == "<" {
+		if len(f.args) > 2 {
+			return ev.errorf("*** file: too many arguments.")
+		}
+		return ev.readFile(w, fn)
+	}
+	var text []byte
+	if len(f.args) > 2 {
+		abuf = newEbuf()
+		err = f.args[2].Eval(abuf, ev)
+		if err != nil {
+			return err
+		}
+		text = append(text, abuf.Bytes()...)
+		abuf.release()
+		if len(text) > 0 && text[len(text)-1] != '\n' {
+			text = append(text, '\n')
+		}
+	}
+	return ev.writeFile(fn, text, op == ">>")
+}
+
+// readFile writes the content of fn to w without its last newline, for
+// $(file <fn). A missing file is empty. Commands read it when they run.
+func (ev *Evaluator) readFile(w evalWriter, fn string) error {
+	if ev.avoidIO {
+		ev.hasIO = true
+		io.WriteString(w, "$(cat ")
+		io.WriteString(w, fn)
+		io.WriteString(w, " 2> /dev/null)")
+		return nil
+	}
+	if err := ev.checkIsolated("$(file <%s)", fn); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		ev.cache.update(fn, [sha1.Size]byte{}, fileNotExists)
+		return nil
+	}
+	if err != nil {
+		return ev.errorf("*** %v.", err)
+	}
+	ev.cache.update(fn, sha1.Sum(b), fileExists)
+	w.Write(bytes.TrimSuffix(b, []byte{'\n'}))
+	return nil
+}
+
+// writeFile writes text to fn, or appends it if appending is true, for
+// $(file >fn,text). In commands for ninja, fn is written when they are
+// generated, and only if the content changes, so fn is an input of the
+// commands whose timestamp changes when the commands change. Appending
+// to fn there appends to the content written in the generation, not
+// to fn written by the previous one. see saveWrittenFiles.
+func (ev *Evaluator) writeFile(fn string, text []byte, appending bool) error {
+	if err := ev.checkIsolated("$(file >%s)", fn); err != nil {
+		return err
+	}
+	if ev.avoidIO {
+		if ev.fileContents == nil {
+			ev.fileContents = make(map[string][]byte)
+		}
+		if appending {
+			text = append(ev.fileContents[fn], text...)
+		}
+		ev.fileContents[fn] = text
+		ev.hasIO = true
+		ev.writtenFiles = append(ev.writtenFiles, fn)
+		return nil
+	}
+	content := text
+	if appending {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil && !os.IsNotExist(err) {
+			return ev.errorf("*** %v.", err)
+		}
+		content = append(b, text...)
+	}
+	err := ioutil.WriteFile(fn, content, 0666)
+	if err != nil {
+		return ev.errorf("*** %v.", err)
+	}
+	ev.cache.write(fn, sha1.Sum(content))
+	return nil
+}
+
+// saveWrittenFiles writes writtenFiles with their contents written in
+// commands for ninja, if they change.
+func (ev *Evaluator) saveWrittenFiles() error {
+	for _, fn := range ev.writtenFiles {
+		content := ev.fileContents[fn]
+		b, err := ioutil.ReadFile(fn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && bytes.Equal(b, content) {
+			continue
+		}
+		err = ioutil.WriteFile(fn, content, 0666)
+		if err != nil {
+			return err
+		}
+		ev.cache.write(fn, sha1.Sum(content))
+	}
+	return nil
+}
+
+// funcCustom is a function registered by RegisterFunc.
+type funcCustom struct {
+	fclosure
+	name string
+	fn   func(args []string) string
+}
+
+func (f *funcCustom) Arity() int { return 0 }
+func (f *funcCustom) Eval(w evalWriter, ev *Evaluator) error {
+	// fn may depend on state outside of make.
+	ev.expandCache.uncacheable()
+	args := make([]string, 0, len(f.args)-1)
+	abuf := newEbuf()
+	for _, arg := range f.args[1:] {
+		abuf.Reset()
+		err := arg.Eval(abuf, ev)
+		if err != nil {
+			return err
+		}
+		args = append(args, abuf.String())
+	}
+	abuf.release()
+	io.WriteString(w, f.fn(args))
+	return nil
+}
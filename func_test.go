@@ -14,7 +14,11 @@
 
 package kati
 
-import "testing"
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func BenchmarkFuncStrip(b *testing.B) {
 	strip := &funcStrip{
@@ -74,3 +78,139 @@ func BenchmarkFuncPatsubst(b *testing.B) {
 		patsubst.Eval(&buf, ev)
 	}
 }
+
+func BenchmarkFuncAddprefix(b *testing.B) {
+	addprefix := &funcAddprefix{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(addprefix"),
+				literal("out/obj/"),
+				literal("foo.o bar.o baz.o"),
+			},
+		},
+	}
+	ev := NewEvaluator(make(map[string]Var))
+	var buf evalBuffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		addprefix.Eval(&buf, ev)
+	}
+}
+
+var testFuncCount int
+
+func TestRegisterFunc(t *testing.T) {
+	if _, ok := lookupFunc("test-join"); !ok {
+		RegisterFunc("test-join", func(args []string) string {
+			return strings.Join(args, "+")
+		})
+		RegisterFunc("test-count", func(args []string) string {
+			testFuncCount++
+			return strconv.Itoa(testFuncCount)
+		})
+	}
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk:   "A := a\nR := $(test-join $(A),b c,d)\n",
+			want: "a+b c+d",
+		},
+		{
+			mk:   "R := [$(test-join )]\n",
+			want: "[]",
+		},
+		{
+			mk:   "R := $(call test-join,a,b)\n",
+			want: "",
+		},
+		{
+			// the result isn't cached.
+			mk:   "X = $(test-count )\nR := $(X) $(X)\n",
+			want: "1 2",
+		},
+	} {
+		testFuncCount = 0
+		got := evalWithExpandCache(t, tc.mk, true).vars.Lookup("R").String()
+		if got != tc.want {
+			t.Errorf("eval(%q): R=%q; want %q", tc.mk, got, tc.want)
+		}
+	}
+}
+
+func TestFuncIntcmp(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: "$(intcmp 1,2,lt,eq,gt)", want: "lt"},
+		{expr: "$(intcmp 2,2,lt,eq,gt)", want: "eq"},
+		{expr: "$(intcmp 3,2,lt,eq,gt)", want: "gt"},
+		{expr: "$(intcmp 3,2,lt,eq)", want: "eq"},
+		{expr: "$(intcmp 3,2,lt)", want: ""},
+		{expr: "$(intcmp -5, +3 ,lt)", want: "lt"},
+		{expr: "$(intcmp 007,7)", want: "7"},
+		{expr: "$(intcmp 1,7)", want: ""},
+		{expr: "$(intcmp 99999999999999999999,1,lt,eq,gt)", want: "gt"},
+		{expr: "$(intcmp 1,2,$(A),$(error not expanded))", want: "a"},
+		{expr: "$(intcmp x,2)", wantErr: true},
+		{expr: "$(intcmp 1,+-2)", wantErr: true},
+	} {
+		mk := "A := a\nR := " + tc.expr + "\n"
+		m, err := parseMakefileString(mk, srcpos{filename: "test.mk", lineno: 1})
+		if err != nil {
+			t.Fatalf("parse %q: %v", mk, err)
+		}
+		er, err := eval(m, make(Vars), false)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tc.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := er.vars.Lookup("R").String(); got != tc.want {
+			t.Errorf("%s=%q; want %q", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestFuncLet(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk:   "R := $(let a b,1 2  3 ,$(a)-$(b))\n",
+			want: "1-2  3",
+		},
+		{
+			mk:   "R := $(let a b c,1,[$(a)][$(b)][$(c)])\n",
+			want: "[1][][]",
+		},
+		{
+			mk:   "A := x\nR := $(let A,y,$(A) $(origin A)) $(A) $(origin A)\n",
+			want: "y automatic x file",
+		},
+		{
+			mk:   "R := $(let A,y,$(A)) $(origin A)\n",
+			want: "y undefined",
+		},
+		{
+			mk:   "F = $(let first rest,$(1),$(rest) $(first))\nR := $(call F,a b c)\n",
+			want: "b c a",
+		},
+	} {
+		got := evalWithExpandCache(t, tc.mk, true).vars.Lookup("R").String()
+		if got != tc.want {
+			t.Errorf("eval(%q): R=%q; want %q", tc.mk, got, tc.want)
+		}
+	}
+}
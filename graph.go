@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Exporters of the dependency graph for external tools, e.g.
+//
+//	kati -graph_dot=deps.dot -graph_pattern='out/*.so' -graph_depth=2
+//	dot -Tsvg deps.dot > deps.svg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// GraphOpt is options to export the dependency graph.
+type GraphOpt struct {
+	// Pattern is a shell pattern of targets to export with their
+	// prerequisites, e.g. "out/*.o". If empty, top level targets are
+	// exported.
+	Pattern string
+	// Depth is the maximum depth of prerequisites from the targets.
+	// If 0, all prerequisites are exported.
+	Depth int
+}
+
+// subgraph returns nodes selected by opt in breadth-first order.
+func (g *DepGraph) subgraph(opt *GraphOpt) ([]*DepNode, map[*DepNode]bool) {
+	if opt == nil {
+		opt = &GraphOpt{}
+	}
+	roots := g.nodes
+	if opt.Pattern != "" {
+		roots = nil
+		walkNodes(g.nodes, make(map[*DepNode]bool), func(n *DepNode) {
+			if fnmatch(opt.Pattern, n.Output) {
+				roots = append(roots, n)
+			}
+		})
+	}
+	depth := make(map[*DepNode]int)
+	var nodes []*DepNode
+	for _, n := range roots {
+		if _, ok := depth[n]; ok {
+			continue
+		}
+		depth[n] = 0
+		nodes = append(nodes, n)
+	}
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		if opt.Depth > 0 && depth[n] >= opt.Depth {
+			continue
+		}
+		for _, ds := range [][]*DepNode{n.Deps, n.OrderOnlys} {
+			for _, d := range ds {
+				if _, ok := depth[d]; ok {
+					continue
+				}
+				depth[d] = depth[n] + 1
+				nodes = append(nodes, d)
+			}
+		}
+	}
+	included := make(map[*DepNode]bool)
+	for _, n := range nodes {
+		included[n] = true
+	}
+	return nodes, included
+}
+
+// WriteDot writes the dependency graph in the DOT language of Graphviz.
+// Order-only prerequisites are dashed edges, and phony targets are
+// dotted nodes. opt may be nil.
+func (g *DepGraph) WriteDot(w io.Writer, opt *GraphOpt) error {
+	nodes, included := g.subgraph(opt)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph kati {\n")
+	for _, n := range nodes {
+		if n.IsPhony {
+			fmt.Fprintf(bw, "  %s [style=dotted];\n", strconv.Quote(n.Output))
+		} else {
+			fmt.Fprintf(bw, "  %s;\n", strconv.Quote(n.Output))
+		}
+		for _, d := range n.Deps {
+			if included[d] {
+				fmt.Fprintf(bw, "  %s -> %s;\n", strconv.Quote(n.Output), strconv.Quote(d.Output))
+			}
+		}
+		for _, d := range n.OrderOnlys {
+			if included[d] {
+				fmt.Fprintf(bw, "  %s -> %s [style=dashed];\n", strconv.Quote(n.Output), strconv.Quote(d.Output))
+			}
+		}
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+type graphJSONNode struct {
+	Output     string   `json:"output"`
+	Phony      bool     `json:"phony,omitempty"`
+	Location   string   `json:"location,omitempty"`
+	Deps       []string `json:"deps,omitempty"`
+	OrderOnlys []string `json:"order_onlys,omitempty"`
+}
+
+type graphJSON struct {
+	Nodes []graphJSONNode `json:"nodes"`
+}
+
+// WriteJSON writes the dependency graph in JSON, as a list of targets
+// with their prerequisites. opt may be nil.
+func (g *DepGraph) WriteJSON(w io.Writer, opt *GraphOpt) error {
+	nodes, included := g.subgraph(opt)
+	gj := graphJSON{Nodes: []graphJSONNode{}}
+	for _, n := range nodes {
+		jn := graphJSONNode{
+			Output: n.Output,
+			Phony:  n.IsPhony,
+		}
+		if n.Filename != "" {
+			jn.Location = fmt.Sprintf("%s:%d", n.Filename, n.Lineno)
+		}
+		for _, d := range n.Deps {
+			if included[d] {
+				jn.Deps = append(jn.Deps, d.Output)
+			}
+		}
+		for _, d := range n.OrderOnlys {
+			if included[d] {
+				jn.OrderOnlys = append(jn.OrderOnlys, d.Output)
+			}
+		}
+		gj.Nodes = append(gj.Nodes, jn)
+	}
+	b, err := json.MarshalIndent(gj, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func loadGraphTestMakefile(t *testing.T) *DepGraph {
+	chdirTestMakefile(t, `all: out/app | dirs
+out/app: out/a.o out/b.o
+	link -o $@ $^
+out/%.o: %.c
+	cc -c -o $@ $<
+dirs:
+	mkdir -p out
+.PHONY: all dirs
+`)
+	err := ioutil.WriteFile("a.c", nil, 0644)
+	if err == nil {
+		err = ioutil.WriteFile("b.c", nil, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestWriteDot(t *testing.T) {
+	g := loadGraphTestMakefile(t)
+
+	for _, tc := range []struct {
+		opt  *GraphOpt
+		want string
+	}{
+		{
+			want: `digraph kati {
+  "all" [style=dotted];
+  "all" -> "out/app";
+  "all" -> "dirs" [style=dashed];
+  "dirs" [style=dotted];
+  "out/app";
+  "out/app" -> "out/a.o";
+  "out/app" -> "out/b.o";
+  "out/a.o";
+  "out/a.o" -> "a.c";
+  "out/b.o";
+  "out/b.o" -> "b.c";
+  "a.c";
+  "b.c";
+}
+`,
+		},
+		{
+			opt: &GraphOpt{Pattern: "out/*.o"},
+			want: `digraph kati {
+  "out/a.o";
+  "out/a.o" -> "a.c";
+  "out/b.o";
+  "out/b.o" -> "b.c";
+  "a.c";
+  "b.c";
+}
+`,
+		},
+		{
+			opt: &GraphOpt{Depth: 1},
+			want: `digraph kati {
+  "all" [style=dotted];
+  "all" -> "out/app";
+  "all" -> "dirs" [style=dashed];
+  "dirs" [style=dotted];
+  "out/app";
+}
+`,
+		},
+	} {
+		var buf bytes.Buffer
+		err := g.WriteDot(&buf, tc.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("WriteDot(%+v)=\n%s\nwant:\n%s", tc.opt, got, tc.want)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	g := loadGraphTestMakefile(t)
+
+	var buf bytes.Buffer
+	err := g.WriteJSON(&buf, &GraphOpt{Pattern: "out/app", Depth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got graphJSON
+	err = json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf.Bytes(), err)
+	}
+	want := graphJSON{
+		Nodes: []graphJSONNode{
+			{
+				Output:   "out/app",
+				Location: "Makefile:3",
+				Deps:     []string{"out/a.o", "out/b.o"},
+			},
+			{Output: "out/a.o", Location: "Makefile:5"},
+			{Output: "out/b.o", Location: "Makefile:5"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WriteJSON=%+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// GNU make compatible jobserver.
+//
+// Makes share job slots by a pipe holding a token byte per slot except
+// the implicit slot, which each make has without a token. A make reads
+// a token from the pipe before it runs another job in parallel, and
+// writes it back when the job finishes.
+//
+// With -j N (N > 1), kati creates a jobserver with N-1 tokens, and
+// passes it to commands by MAKEFLAGS, e.g. " -j4
+// --jobserver-auth=fifo:/tmp/kati-jobserver-1234", so recursive makes
+// and ninja share the job slots. In the "pipe" style, the pipe is
+// passed to recursive commands as file descriptors, e.g.
+// "--jobserver-auth=3,4", which GNU make before 4.4 understands.
+// kati run by another make uses the jobserver in MAKEFLAGS.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// JobserverFifo is the style of jobserver by a named pipe.
+	JobserverFifo = "fifo"
+	// JobserverPipe is the style of jobserver by file descriptors of
+	// an anonymous pipe.
+	JobserverPipe = "pipe"
+)
+
+// jobserver is a client of a jobserver, or the jobserver created by
+// kati. A nil *jobserver has unlimited tokens.
+type jobserver struct {
+	r, w *os.File
+	// auth is the value of --jobserver-auth for commands.
+	auth string
+	// jobs is the number of job slots, or 0 if unknown.
+	jobs int
+	// fifo is the named pipe created by kati, removed by close.
+	fifo string
+
+	mu sync.Mutex
+	// implicit is true while the implicit slot is used.
+	implicit bool
+}
+
+// jobToken is a token acquired from a jobserver.
+type jobToken struct {
+	b        byte
+	implicit bool
+}
+
+// newJobserver creates a jobserver of numJobs slots in style.
+func newJobserver(numJobs int, style string) (*jobserver, error) {
+	js := &jobserver{jobs: numJobs}
+	if style == "" {
+		style = defaultJobserverStyle
+	}
+	var err error
+	switch style {
+	case JobserverFifo:
+		js.fifo, js.r, err = createFifo()
+		if err != nil {
+			return nil, err
+		}
+		js.w = js.r
+		js.auth = "fifo:" + js.fifo
+	case JobserverPipe:
+		js.r, js.w, err = os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		js.auth = "pipe"
+	default:
+		return nil, fmt.Errorf("unknown jobserver style %q", style)
+	}
+	_, err = js.w.Write([]byte(strings.Repeat("+", numJobs-1)))
+	if err != nil {
+		js.close()
+		return nil, err
+	}
+	glog.Infof("jobserver %s: %d jobs", js.auth, numJobs)
+	return js, nil
+}
+
+// jobserverAuth returns the jobserver in makeflags, e.g.
+// "fifo:/tmp/GMfifo1" or "3,4", or "" if makeflags has none.
+func jobserverAuth(makeflags string) string {
+	var auth string
+	for _, w := range splitSpaces(makeflags) {
+		if w == "--" {
+			break
+		}
+		for _, p := range []string{"--jobserver-auth=", "--jobserver-fds="} {
+			if strings.HasPrefix(w, p) {
+				auth = w[len(p):]
+			}
+		}
+	}
+	return auth
+}
+
+// openJobserver opens the jobserver of auth given by another make.
+func openJobserver(auth string) (*jobserver, error) {
+	js := &jobserver{auth: auth}
+	if strings.HasPrefix(auth, "fifo:") {
+		f, err := os.OpenFile(auth[len("fifo:"):], os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		js.r, js.w = f, f
+		return js, nil
+	}
+	fds := strings.Split(auth, ",")
+	if len(fds) != 2 {
+		return nil, fmt.Errorf("unsupported jobserver %q", auth)
+	}
+	var files [2]*os.File
+	for i, s := range fds {
+		fd, err := strconv.Atoi(s)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("unsupported jobserver %q", auth)
+		}
+		files[i] = os.NewFile(uintptr(fd), fmt.Sprintf("jobserver%d", i))
+		if _, err := files[i].Stat(); err != nil {
+			// the parent make didn't pass the pipe, e.g. to a
+			// command without '+'.
+			return nil, fmt.Errorf("jobserver %q is not available: %v", auth, err)
+		}
+	}
+	js.r, js.w = files[0], files[1]
+	return js, nil
+}
+
+// acquire acquires a token, waiting for another job to release one.
+func (js *jobserver) acquire() (jobToken, error) {
+	if js == nil {
+		return jobToken{}, nil
+	}
+	js.mu.Lock()
+	if !js.implicit {
+		js.implicit = true
+		js.mu.Unlock()
+		return jobToken{implicit: true}, nil
+	}
+	js.mu.Unlock()
+	var b [1]byte
+	_, err := js.r.Read(b[:])
+	if err != nil {
+		return jobToken{}, fmt.Errorf("jobserver %s: %v", js.auth, err)
+	}
+	return jobToken{b: b[0]}, nil
+}
+
+// release releases tok acquired by acquire.
+func (js *jobserver) release(tok jobToken) {
+	if js == nil {
+		return
+	}
+	if tok.implicit {
+		js.mu.Lock()
+		js.implicit = false
+		js.mu.Unlock()
+		return
+	}
+	_, err := js.w.Write([]byte{tok.b})
+	if err != nil {
+		glog.Errorf("jobserver %s: %v", js.auth, err)
+	}
+}
+
+// isPipe reports whether js is of the "pipe" style.
+func (js *jobserver) isPipe() bool {
+	return js.r != js.w
+}
+
+// makeflags returns MAKEFLAGS for a command to share the jobserver.
+// The "pipe" style is shared only with recursive commands, which get
+// the pipe as fds 3 and 4 by extraFiles.
+func (js *jobserver) makeflags(makeflags string, recursive bool) string {
+	if js == nil || (js.isPipe() && !recursive) {
+		return makeflags
+	}
+	auth := js.auth
+	if js.isPipe() {
+		auth = "3,4"
+	}
+	var words, rest []string
+	all := splitSpaces(makeflags)
+	for i, w := range all {
+		if w == "--" {
+			rest = all[i:]
+			break
+		}
+		if strings.HasPrefix(w, "-j") || strings.HasPrefix(w, "--jobserver-") {
+			continue
+		}
+		words = append(words, w)
+	}
+	j := "-j"
+	if js.jobs > 0 {
+		j += strconv.Itoa(js.jobs)
+	}
+	words = append(words, j, "--jobserver-auth="+auth)
+	return strings.Join(append(words, rest...), " ")
+}
+
+// extraFiles returns files for a command to share the jobserver.
+func (js *jobserver) extraFiles(recursive bool) []*os.File {
+	if js == nil || !js.isPipe() || !recursive {
+		return nil
+	}
+	return []*os.File{js.r, js.w}
+}
+
+func (js *jobserver) close() {
+	if js == nil {
+		return
+	}
+	js.r.Close()
+	if js.w != js.r {
+		js.w.Close()
+	}
+	if js.fifo != "" {
+		os.Remove(js.fifo)
+	}
+}
+
+// tempFifoName returns a name of a named pipe to create.
+func tempFifoName() (string, error) {
+	f, err := ioutil.TempFile("", "kati-jobserver-")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	f.Close()
+	err = os.Remove(name)
+	return name, err
+}
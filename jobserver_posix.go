@@ -0,0 +1,43 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package kati
+
+import (
+	"os"
+	"syscall"
+)
+
+const defaultJobserverStyle = JobserverFifo
+
+// createFifo creates a named pipe for a jobserver, and opens it.
+func createFifo() (string, *os.File, error) {
+	name, err := tempFifoName()
+	if err != nil {
+		return "", nil, err
+	}
+	err = syscall.Mkfifo(name, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		os.Remove(name)
+		return "", nil, err
+	}
+	return name, f, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestJobserverAuth(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "k", want: ""},
+		{in: " -j4 --jobserver-auth=3,4", want: "3,4"},
+		{in: "n -j --jobserver-fds=5,6", want: "5,6"},
+		{in: "-j4 --jobserver-auth=fifo:/tmp/GMfifo1", want: "fifo:/tmp/GMfifo1"},
+		{in: "k -- --jobserver-auth=3,4", want: ""},
+	} {
+		if got := jobserverAuth(tc.in); got != tc.want {
+			t.Errorf("jobserverAuth(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestJobserverTokens(t *testing.T) {
+	styles := []string{JobserverPipe}
+	if runtime.GOOS != "windows" {
+		styles = append(styles, JobserverFifo)
+	}
+	for _, style := range styles {
+		js, err := newJobserver(3, style)
+		if err != nil {
+			t.Fatalf("newJobserver(3, %q): %v", style, err)
+		}
+		var toks []jobToken
+		for i := 0; i < 3; i++ {
+			tok, err := js.acquire()
+			if err != nil {
+				t.Fatalf("%s: acquire: %v", style, err)
+			}
+			toks = append(toks, tok)
+		}
+		if !toks[0].implicit || toks[1].implicit || toks[1].b != '+' {
+			t.Errorf("%s: tokens=%+v; want the implicit token and '+'", style, toks)
+		}
+		acquired := make(chan jobToken)
+		go func() {
+			tok, err := js.acquire()
+			if err != nil {
+				t.Errorf("%s: acquire: %v", style, err)
+			}
+			acquired <- tok
+		}()
+		select {
+		case tok := <-acquired:
+			t.Errorf("%s: acquired %+v with no tokens", style, tok)
+		case <-time.After(50 * time.Millisecond):
+		}
+		js.release(toks[2])
+		select {
+		case <-acquired:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: acquire is blocked after release", style)
+		}
+		js.close()
+	}
+}
+
+func TestJobserverMakeflags(t *testing.T) {
+	pipe := &jobserver{jobs: 4, auth: "pipe", r: os.Stdin, w: os.Stdout}
+	fifo := &jobserver{jobs: 4, auth: "fifo:/tmp/f", r: os.Stdin, w: os.Stdin}
+	for _, tc := range []struct {
+		js        *jobserver
+		in        string
+		recursive bool
+		want      string
+	}{
+		{js: nil, in: "k", recursive: true, want: "k"},
+		{js: pipe, in: "k", recursive: false, want: "k"},
+		{js: pipe, in: "k", recursive: true, want: "k -j4 --jobserver-auth=3,4"},
+		{js: fifo, in: "", recursive: false, want: "-j4 --jobserver-auth=fifo:/tmp/f"},
+		{js: fifo, in: "n -j2 --jobserver-auth=3,4 -- A=1", recursive: true, want: "n -j4 --jobserver-auth=fifo:/tmp/f -- A=1"},
+	} {
+		if got := tc.js.makeflags(tc.in, tc.recursive); got != tc.want {
+			t.Errorf("makeflags(%q, %t)=%q; want %q", tc.in, tc.recursive, got, tc.want)
+		}
+	}
+}
+
+func TestExecJobserver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	chdirTestMakefile(t, `all: a b
+a:
+	+echo "$$MAKEFLAGS" > $@
+b:
+	echo "$$MAKEFLAGS" > $@
+`)
+	saved, ok := os.LookupEnv("MAKEFLAGS")
+	os.Unsetenv("MAKEFLAGS")
+	if ok {
+		defer os.Setenv("MAKEFLAGS", saved)
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 2, JobserverStyle: JobserverPipe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		file string
+		want string
+	}{
+		{file: "a", want: "-j2 --jobserver-auth=3,4\n"},
+		{file: "b", want: "\n"},
+	} {
+		b, err := ioutil.ReadFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tc.want {
+			t.Errorf("MAKEFLAGS of %s=%q; want %q", tc.file, got, tc.want)
+		}
+	}
+}
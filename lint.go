@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// With WarnFlag, kati warns about suspicious constructs in makefiles
+// while evaluating them:
+//  - references to undefined variables, as
+//    --warn-undefined-variables of GNU make.
+//  - recursive variables which reference themselves, which fail
+//    when they are expanded.
+//  - recipe lines indented with spaces instead of a tab.
+//  - assignments to automatic variables, which are hidden by the
+//    automatic ones in recipes.
+//  - rules which list a target more than once.
+//  - references to unknown functions, e.g. $(foo a), which are
+//    references to undefined variables for make.
+//
+// DiagLevels turns each kind of them, except recipe lines which the
+// parser checks, on or off regardless of WarnFlag, or into errors for
+// strict makefiles. The invalid override directive, which GNU make
+// always warns about, can be made an error too.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiagLevel is the level of diagnostics of a code.
+type DiagLevel string
+
+// Levels of diagnostics.
+const (
+	DiagLevelOff   DiagLevel = "off"
+	DiagLevelWarn  DiagLevel = "warn"
+	DiagLevelError DiagLevel = "error"
+)
+
+// DiagLevels are levels of diagnostics by their codes, which override
+// the default levels, e.g. DiagLevelError for DiagUndefinedVariable
+// makes references to undefined variables errors.
+var DiagLevels = make(map[string]DiagLevel)
+
+// SetDiagLevel sets the level of diagnostics of code by its name:
+// "off", "warn" or "error". An empty name keeps the default level.
+func SetDiagLevel(code, level string) error {
+	switch l := DiagLevel(level); l {
+	case "":
+		delete(DiagLevels, code)
+	case DiagLevelOff, DiagLevelWarn, DiagLevelError:
+		DiagLevels[code] = l
+	default:
+		return fmt.Errorf("invalid level of %s: %q; must be off, warn or error", code, level)
+	}
+	return nil
+}
+
+// linting reports whether any lint may be reported.
+func linting() bool {
+	return WarnFlag || len(DiagLevels) > 0
+}
+
+// lint reports a warning of code at the current location if WarnFlag
+// is set, or fails if its level is DiagLevelError. Isolated evaluators
+// return errNotIsolated instead, so the statement is evaluated again,
+// and warned once, by the parent.
+func (ev *Evaluator) lint(code string, f string, a ...interface{}) error {
+	level, ok := DiagLevels[code]
+	if !ok {
+		if !WarnFlag {
+			return nil
+		}
+		level = DiagLevelWarn
+	}
+	switch level {
+	case DiagLevelOff:
+		return nil
+	case DiagLevelError:
+		return ev.errorf("*** %s.", fmt.Sprintf(f, a...))
+	}
+	if err := ev.checkIsolated("warning"); err != nil {
+		return err
+	}
+	warn(ev.srcpos, code, f, a...)
+	return nil
+}
+
+// isAutomaticVar reports whether name is a name of an automatic
+// variable, e.g. "@" or "<D".
+func isAutomaticVar(name string) bool {
+	if len(name) == 2 && (name[1] == 'D' || name[1] == 'F') {
+		name = name[:1]
+	}
+	return len(name) == 1 && strings.Contains("@%<?^+|*", name)
+}
+
+// lintUndefined warns about the reference to variable name if v is
+// undefined. A name with spaces is likely a call of an unknown
+// function.
+func (ev *Evaluator) lintUndefined(name string, v Var) error {
+	if !linting() || v.IsDefined() || isAutomaticVar(name) {
+		return nil
+	}
+	if i := strings.IndexAny(name, " \t"); i > 0 {
+		return ev.lint(DiagUnknownFunction, "unknown function '%s'", name[:i])
+	}
+	return ev.lint(DiagUndefinedVariable, "undefined variable '%s'", name)
+}
+
+// lintAssign checks the assignment of rhs to variable lhs by ast.
+func (ev *Evaluator) lintAssign(ast *assignAST, lhs string, rhs Var) error {
+	if !linting() || ast.filename == bootstrapMakefileName {
+		return nil
+	}
+	if isAutomaticVar(lhs) {
+		err := ev.lint(DiagAutomaticVariable, "assignment to automatic variable '%s'", lhs)
+		if err != nil {
+			return err
+		}
+	}
+	if rhs.Flavor() == "recursive" && ast.op != ":=" && refersTo(ast.rhs, lhs) {
+		return ev.lint(DiagSelfReference, "recursive variable '%s' references itself", lhs)
+	}
+	return nil
+}
+
+// lintOutputs warns about targets listed more than once in outputs of
+// a rule.
+func (ev *Evaluator) lintOutputs(outputs []string) error {
+	if !linting() || len(outputs) < 2 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, output := range outputs {
+		if seen[output] {
+			err := ev.lint(DiagDuplicateTarget, "target '%s' given more than once in the same rule", output)
+			if err != nil {
+				return err
+			}
+		}
+		seen[output] = true
+	}
+	return nil
+}
+
+// refersTo reports whether expanding v expands the variable name.
+func refersTo(v Value, name string) bool {
+	switch v := v.(type) {
+	case expr:
+		for _, e := range v {
+			if refersTo(e, name) {
+				return true
+			}
+		}
+	case *varref:
+		return v.varname.String() == name || refersTo(v.varname, name)
+	case varsubst:
+		return v.varname.String() == name || refersTo(v.varname, name) || refersTo(v.pat, name) || refersTo(v.subst, name)
+	case interface {
+		closureArgs() []Value
+	}:
+		args := v.closureArgs()
+		if len(args) > 0 {
+			switch strings.TrimLeft(args[0].String(), "({") {
+			case "value", "origin", "flavor":
+				// they don't expand the variable.
+				return false
+			}
+			args = args[1:]
+		}
+		for _, arg := range args {
+			if refersTo(arg, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
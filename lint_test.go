@@ -0,0 +1,167 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestWarnFlag(t *testing.T) {
+	var got []string
+	DiagnosticHandler = func(d Diagnostic) {
+		got = append(got, fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Column, d.Code, d.Message))
+	}
+	WarnFlag = true
+	defer func() {
+		DiagnosticHandler = nil
+		WarnFlag = false
+	}()
+
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{
+			in: "A := $(B) $(C:.c=.o)\n$(info $(1))\n",
+			want: []string{
+				"1:0: undefined-variable: undefined variable 'B'",
+				"1:0: undefined-variable: undefined variable 'C'",
+				"2:0: undefined-variable: undefined variable '1'",
+			},
+		},
+		{
+			in: "B = b\nA := $(B) $(origin C) $(value D)\nifdef E\nendif\n",
+		},
+		{
+			in: "A = $(A) a\nB = b\nB += $(filter x,$(B))\nC = $(value C)\nD := $(D)\n",
+			want: []string{
+				"1:0: self-reference: recursive variable 'A' references itself",
+				"3:0: self-reference: recursive variable 'B' references itself",
+				"5:0: undefined-variable: undefined variable 'D'",
+			},
+		},
+		{
+			in: "all:\n    echo foo\n\techo bar\n  $(CC) -o $@\nA = a\n  B = b\n",
+			want: []string{
+				"2:5: recipe-spaces: recipe line starts with spaces instead of a tab",
+				"4:3: recipe-spaces: recipe line starts with spaces instead of a tab",
+				"test.mk:2: *** missing separator.",
+			},
+		},
+		{
+			in: "@ = a\n<F := b\n",
+			want: []string{
+				"1:0: automatic-variable: assignment to automatic variable '@'",
+				"2:0: automatic-variable: assignment to automatic variable '<F'",
+			},
+		},
+		{
+			in: "a b a: c\nd e: f\n",
+			want: []string{
+				"1:0: duplicate-target: target 'a' given more than once in the same rule",
+			},
+		},
+		{
+			in: "A := $(foo a,b) $(subst a,b,c)\n",
+			want: []string{
+				"1:0: unknown-function: unknown function 'foo'",
+			},
+		},
+	} {
+		got = nil
+		mk, err := parseMakefile([]byte(tc.in), "test.mk")
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.in, err)
+			continue
+		}
+		_, err = eval(mk, make(Vars), false)
+		if err != nil {
+			got = append(got, err.Error())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("eval(%q): warnings=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDiagLevels(t *testing.T) {
+	var got []string
+	DiagnosticHandler = func(d Diagnostic) {
+		got = append(got, fmt.Sprintf("%d: %s: %s", d.Line, d.Code, d.Message))
+	}
+	defer func() {
+		DiagnosticHandler = nil
+		DiagLevels = make(map[string]DiagLevel)
+	}()
+
+	for _, tc := range []struct {
+		levels map[string]string
+		in     string
+		want   []string
+	}{
+		{
+			levels: map[string]string{DiagUndefinedVariable: "error"},
+			in:     "A := a\nB := $(A) $(duplicate)\na a:\n",
+			want: []string{
+				"test.mk:2: *** undefined variable 'duplicate'.",
+			},
+		},
+		{
+			levels: map[string]string{DiagUndefinedVariable: "warn", DiagUnknownFunction: "error"},
+			in:     "A := $(B)\nC := $(fo o)\n",
+			want: []string{
+				"1: undefined-variable: undefined variable 'B'",
+				"test.mk:2: *** unknown function 'fo'.",
+			},
+		},
+		{
+			levels: map[string]string{DiagInvalidOverride: "error"},
+			in:     "A := $(B)\noverride\n",
+			want: []string{
+				"test.mk:2: *** invalid `override' directive.",
+			},
+		},
+		{
+			levels: map[string]string{DiagInvalidOverride: "off"},
+			in:     "override\n",
+		},
+	} {
+		got = nil
+		DiagLevels = make(map[string]DiagLevel)
+		for code, level := range tc.levels {
+			err := SetDiagLevel(code, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		mk, err := parseMakefile([]byte(tc.in), "test.mk")
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.in, err)
+			continue
+		}
+		_, err = eval(mk, make(Vars), false)
+		if err != nil {
+			got = append(got, err.Error())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("levels=%v eval(%q): %q; want %q", tc.levels, tc.in, got, tc.want)
+		}
+	}
+	if err := SetDiagLevel(DiagUndefinedVariable, "fatal"); err == nil {
+		t.Errorf("SetDiagLevel(%q, fatal)=nil; want error", DiagUndefinedVariable)
+	}
+}
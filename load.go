@@ -0,0 +1,163 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// The load directive loads objects which define functions, e.g.
+// "load mk_temp.so" or "load mk_temp.so(setup)". An object is either
+// registered by RegisterLoad, looked up by the base name of its file
+// without extension, e.g. "mk_temp", or a Go plugin which registers
+// functions by RegisterFunc in its init or in its setup symbol.
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// defaultLoadSymbol is the setup symbol of a plugin if the load
+// directive doesn't specify one. Unlike a specified one, the plugin
+// may not have it.
+const defaultLoadSymbol = "GmkSetup"
+
+var loader = struct {
+	mu       sync.Mutex
+	registry map[string]func() error
+	// loaded is keyed by names for registered objects, or by filenames
+	// for plugins.
+	loaded map[string]bool
+}{
+	registry: make(map[string]func() error),
+	loaded:   make(map[string]bool),
+}
+
+// RegisterLoad registers setup for objects named name in the load
+// directive, so "load name.so" calls setup instead of opening a plugin.
+// setup typically registers functions by RegisterFunc. It panics if
+// name is already registered.
+func RegisterLoad(name string, setup func() error) {
+	loader.mu.Lock()
+	defer loader.mu.Unlock()
+	if _, dup := loader.registry[name]; dup {
+		panic(fmt.Sprintf("kati: RegisterLoad called twice for %s", name))
+	}
+	loader.registry[name] = setup
+}
+
+// parseLoadObject splits obj, e.g. "mk_temp.so(setup)", into its
+// filename and setup symbol.
+func parseLoadObject(obj string) (string, string) {
+	if strings.HasSuffix(obj, ")") {
+		if i := strings.IndexByte(obj, '('); i > 0 {
+			return obj[:i], obj[i+1 : len(obj)-1]
+		}
+	}
+	return obj, ""
+}
+
+// loadObject loads obj unless it has been loaded.
+func loadObject(obj string) error {
+	fn, sym := parseLoadObject(obj)
+	loader.mu.Lock()
+	defer loader.mu.Unlock()
+	name := strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+	if setup, ok := loader.registry[name]; ok {
+		if loader.loaded[name] {
+			return nil
+		}
+		glog.V(1).Infof("load %s: registered %s", obj, name)
+		err := setup()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		loader.loaded[name] = true
+		return nil
+	}
+	fn = filepath.Clean(fn)
+	if loader.loaded[fn] {
+		return nil
+	}
+	glog.V(1).Infof("load %s: plugin", obj)
+	p, err := plugin.Open(fn)
+	if err != nil {
+		return err
+	}
+	optional := sym == ""
+	if optional {
+		sym = defaultLoadSymbol
+	}
+	s, err := p.Lookup(sym)
+	switch {
+	case err != nil && optional:
+	case err != nil:
+		return fmt.Errorf("%s: %v", fn, err)
+	default:
+		setup, ok := s.(func() error)
+		if !ok {
+			return fmt.Errorf("%s: %s is %T, not func() error", fn, sym, s)
+		}
+		err = setup()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	loader.loaded[fn] = true
+	return nil
+}
+
+func (ev *Evaluator) evalLoad(ast *loadAST) error {
+	ev.lastRule = nil
+	ev.srcpos = ast.srcpos
+	if err := ev.checkIsolated("%s", ast.op); err != nil {
+		return err
+	}
+	abuf := newEbuf()
+	err := ast.expr.Eval(abuf, ev)
+	if err != nil {
+		return ast.errorf("%v", err)
+	}
+	objs := splitSpaces(abuf.String())
+	abuf.release()
+
+	var loaded []string
+	if v, ok := ev.lookupVar(".LOADED").(*simpleVar); ok {
+		loaded = splitSpaces(v.String())
+	}
+	n := len(loaded)
+	for _, obj := range objs {
+		err := loadObject(obj)
+		if err != nil {
+			if ast.op == "-load" {
+				glog.V(1).Infof("%s: ignore %v", ast.srcpos, err)
+				continue
+			}
+			return ast.errorf("%v", err)
+		}
+		fn, _ := parseLoadObject(obj)
+		if !contains(loaded, fn) {
+			loaded = append(loaded, fn)
+		}
+	}
+	if len(loaded) > n {
+		ev.outVars.Assign(".LOADED", &simpleVar{
+			value:  []string{strings.Join(loaded, " ")},
+			origin: "file",
+		})
+	}
+	return nil
+}
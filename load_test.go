@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+var registerTestLoad sync.Once
+
+func TestLoad(t *testing.T) {
+	var setups int
+	registerTestLoad.Do(func() {
+		RegisterLoad("test_load", func() error {
+			setups++
+			RegisterFunc("test-hello", func(args []string) string {
+				return "hello " + strings.Join(args, " ")
+			})
+			return nil
+		})
+	})
+	for _, tc := range []struct {
+		mk      string
+		want    string
+		loaded  string
+		wantErr bool
+	}{
+		{
+			mk:     "load test_load.so\nR := $(test-hello world)\n",
+			want:   "hello world",
+			loaded: "test_load.so",
+		},
+		{
+			// a loaded object is not set up again.
+			mk:     "load ./test_load.so(setup) test_load.so\nR := $(test-hello )\n",
+			want:   "hello ",
+			loaded: "./test_load.so test_load.so",
+		},
+		{
+			mk:     "-load no_such_object.so\nR := ok\n",
+			want:   "ok",
+			loaded: "",
+		},
+		{
+			mk:      "load no_such_object.so\nR := ok\n",
+			wantErr: true,
+		},
+		{
+			// not loaded in a false conditional.
+			mk:     "ifdef USE_PLUGIN\nload no_such_object.so\nendif\nR := ok\n",
+			want:   "ok",
+			loaded: "",
+		},
+		{
+			mk:     "USE_PLUGIN := 1\nifdef USE_PLUGIN\nload test_load.so\nendif\n$(eval R := $$(test-hello plugin))\n",
+			want:   "hello plugin",
+			loaded: "test_load.so",
+		},
+	} {
+		m, err := parseMakefileString(tc.mk, srcpos{filename: "test.mk", lineno: 1})
+		if err == nil {
+			var er *evalResult
+			er, err = eval(m, make(Vars), false)
+			if err == nil {
+				if got := er.vars.Lookup("R").String(); got != tc.want {
+					t.Errorf("eval(%q): R=%q; want %q", tc.mk, got, tc.want)
+				}
+				if got := er.vars.Lookup(".LOADED").String(); got != tc.loaded {
+					t.Errorf("eval(%q): .LOADED=%q; want %q", tc.mk, got, tc.loaded)
+				}
+			}
+		}
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("eval(%q): err=%v; want error %t", tc.mk, err, tc.wantErr)
+		}
+	}
+	if setups != 1 {
+		t.Errorf("setup called %d times; want 1", setups)
+	}
+}
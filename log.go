@@ -15,8 +15,6 @@
 package kati
 
 import (
-	"fmt"
-
 	"github.com/golang/glog"
 )
 
@@ -27,13 +25,3 @@ func logStats(f string, a ...interface{}) {
 	}
 	glog.Infof(f, a...)
 }
-
-func warn(loc srcpos, f string, a ...interface{}) {
-	f = fmt.Sprintf("%s: warning: %s\n", loc, f)
-	fmt.Printf(f, a...)
-}
-
-func warnNoPrefix(loc srcpos, f string, a ...interface{}) {
-	f = fmt.Sprintf("%s: %s\n", loc, f)
-	fmt.Printf(f, a...)
-}
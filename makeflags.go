@@ -0,0 +1,334 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// MAKEFLAGS passes options of make to recursive makes through the
+// environment. Its first word has single letter options without '-',
+// e.g. "kn" for -k and -n, followed by long options and variables,
+// e.g. "n -- FOO=bar". Spaces in variables are escaped by '\'. MFLAGS
+// has the same options without variables, e.g. "-n".
+//
+// kati defines MAKEFLAGS with single letter options given by flags,
+// and MAKEOVERRIDES with command line variables. Commands get
+// MAKEFLAGS joined with MAKEOVERRIDES, so makefiles may modify them,
+// e.g. "MAKEOVERRIDES :=" not to pass variables to recursive makes.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// makeflagsOrder is the order of single letter options in MAKEFLAGS,
+// as GNU make writes them.
+const makeflagsOrder = "eknqrRt"
+
+// makeflagsWordLetters returns single letter options in the word w of
+// MAKEFLAGS, e.g. "kn" for "kn" or "-kn". Long options, e.g.
+// "--trace", and variables have none.
+func makeflagsWordLetters(w string) string {
+	if strings.HasPrefix(w, "--") || strings.IndexByte(w, '=') >= 0 {
+		return ""
+	}
+	w = strings.TrimPrefix(w, "-")
+	// options with an argument, e.g. "j4", end letters.
+	if i := strings.IndexAny(w, "CIOWfjlo"); i >= 0 {
+		w = w[:i]
+	}
+	return w
+}
+
+// makeflagsEnd reports whether the word w of MAKEFLAGS starts
+// variables, i.e. "--" or the first variable.
+func makeflagsEnd(w string) bool {
+	return w == "--" || (!strings.HasPrefix(w, "-") && strings.IndexByte(w, '=') >= 0)
+}
+
+// makeflagsLetters returns single letter options in makeflags, e.g.
+// "ke" for "k -e -j4". An option with an argument, e.g. -Otarget,
+// ends letters of its word.
+func makeflagsLetters(makeflags string) string {
+	var letters string
+	for _, w := range splitSpaces(makeflags) {
+		if makeflagsEnd(w) {
+			break
+		}
+		letters += makeflagsWordLetters(w)
+	}
+	return letters
+}
+
+// MakeflagsHas reports whether makeflags has the single letter option
+// c, e.g. 'n' for "MAKEFLAGS=kn".
+func MakeflagsHas(makeflags string, c byte) bool {
+	return strings.IndexByte(makeflagsLetters(makeflags), c) >= 0
+}
+
+// noExecMakeflag returns the option of MAKEFLAGS which makes make
+// not run commands, i.e. 'n', 't' or 'q', or 0 if none is set.
+func noExecMakeflag() byte {
+	switch {
+	case DryRunFlag:
+		return 'n'
+	case TouchFlag:
+		return 't'
+	case QuestionFlag:
+		return 'q'
+	}
+	return 0
+}
+
+// addMakeflag adds the single letter option c to makeflags.
+func addMakeflag(makeflags string, c byte) string {
+	if MakeflagsHas(makeflags, c) {
+		return makeflags
+	}
+	makeflags = trimLeftSpace(makeflags)
+	i := strings.IndexAny(makeflags, " \t")
+	if i < 0 {
+		i = len(makeflags)
+	}
+	// adds c to the first word without '-', e.g. "k".
+	w := makeflags[:i]
+	letters := makeflagsWordLetters(w)
+	if strings.HasPrefix(w, "-") || letters == "" {
+		if makeflags == "" {
+			return string(c)
+		}
+		return string(c) + " " + makeflags
+	}
+	return makeflags[:len(letters)] + string(c) + makeflags[len(letters):]
+}
+
+// removeMakeflag removes the single letter option c from makeflags.
+func removeMakeflag(makeflags string, c byte) string {
+	if !MakeflagsHas(makeflags, c) {
+		return makeflags
+	}
+	var words []string
+	rest := trimLeftSpace(makeflags)
+	for rest != "" {
+		i := strings.IndexAny(rest, " \t")
+		if i < 0 {
+			i = len(rest)
+		}
+		w := rest[:i]
+		if makeflagsEnd(w) {
+			break
+		}
+		rest = trimLeftSpace(rest[i:])
+		if letters := makeflagsWordLetters(w); strings.IndexByte(letters, c) >= 0 {
+			dash := w[:len(w)-len(strings.TrimPrefix(w, "-"))]
+			w = dash + strings.Replace(letters, string(c), "", -1) + w[len(dash)+len(letters):]
+			if w == dash {
+				continue
+			}
+		}
+		words = append(words, w)
+	}
+	if rest != "" {
+		// variables are kept as is, which may have escaped spaces.
+		words = append(words, rest)
+	}
+	return strings.Join(words, " ")
+}
+
+// makeflagSet reports whether the single letter option c is set by
+// flags.
+func makeflagSet(c byte) bool {
+	switch c {
+	case 'e':
+		return EnvironmentOverrides
+	case 'k':
+		return KeepGoingFlag
+	case 'n':
+		return DryRunFlag
+	case 'q':
+		return QuestionFlag
+	case 'r':
+		return NoBuiltinRules || NoBuiltinVars
+	case 'R':
+		return NoBuiltinVars
+	case 't':
+		return TouchFlag
+	}
+	return false
+}
+
+// flagsMakeflags returns single letter options set by flags, e.g. "kn"
+// for KeepGoingFlag and DryRunFlag.
+func flagsMakeflags() string {
+	var letters []byte
+	for i := 0; i < len(makeflagsOrder); i++ {
+		if c := makeflagsOrder[i]; makeflagSet(c) {
+			letters = append(letters, c)
+		}
+	}
+	return string(letters)
+}
+
+// makeflagsWords splits makeflags into words. A space escaped by '\'
+// doesn't split words, and is unescaped.
+func makeflagsWords(makeflags string) []string {
+	var words []string
+	var w []byte
+	inWord := false
+	for i := 0; i < len(makeflags); i++ {
+		c := makeflags[i]
+		switch {
+		case c == '\\' && i+1 < len(makeflags) && isWhitespace(rune(makeflags[i+1])):
+			i++
+			w = append(w, makeflags[i])
+			inWord = true
+		case isWhitespace(rune(c)):
+			if inWord {
+				words = append(words, string(w))
+				w = w[:0]
+				inWord = false
+			}
+		default:
+			w = append(w, c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, string(w))
+	}
+	return words
+}
+
+// MakeflagsVars returns variables in makeflags, e.g. ["FOO=a b"] for
+// "k -- FOO=a\ b", which recursive makes define as command line
+// variables.
+func MakeflagsVars(makeflags string) []string {
+	var vars []string
+	words := makeflagsWords(makeflags)
+	for i, w := range words {
+		if w == "--" {
+			return append(vars, words[i+1:]...)
+		}
+		if i == 0 && makeflagsWordLetters(w) != "" {
+			continue
+		}
+		if !strings.HasPrefix(w, "-") && strings.IndexByte(w, '=') > 0 {
+			vars = append(vars, w)
+		}
+	}
+	return vars
+}
+
+// MakeflagsJobs returns the number of jobs given by -j in makeflags,
+// e.g. 4 for " -j4", or 0 if it has none.
+func MakeflagsJobs(makeflags string) int {
+	words := splitSpaces(makeflags)
+	for i, w := range words {
+		if w == "--" {
+			break
+		}
+		var arg string
+		switch {
+		case strings.HasPrefix(w, "--jobs="):
+			arg = strings.TrimPrefix(w, "--jobs=")
+		case strings.HasPrefix(w, "-j"):
+			arg = strings.TrimPrefix(w, "-j")
+		case i == 0 && strings.IndexByte(w, 'j') >= 0 && makeflagsWordLetters(w) == w[:strings.IndexByte(w, 'j')]:
+			// e.g. "kj4"
+			arg = w[strings.IndexByte(w, 'j')+1:]
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err == nil && n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// MakeflagsTrace reports whether makeflags has --trace.
+func MakeflagsTrace(makeflags string) bool {
+	for _, w := range splitSpaces(makeflags) {
+		if w == "--" {
+			break
+		}
+		if w == "--trace" {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeflagsDebug returns the argument of --debug in makeflags, e.g.
+// "b,v" for " --debug=b,v", "b" for --debug without argument, or "a"
+// for -d. It returns "" if makeflags has none.
+func MakeflagsDebug(makeflags string) string {
+	var arg string
+	if MakeflagsHas(makeflags, 'd') {
+		arg = "a"
+	}
+	for _, w := range splitSpaces(makeflags) {
+		if w == "--" {
+			break
+		}
+		switch {
+		case w == "--debug":
+			arg = "b"
+		case strings.HasPrefix(w, "--debug="):
+			arg = strings.TrimPrefix(w, "--debug=")
+		}
+	}
+	return arg
+}
+
+// escapeMakeflagsVar escapes spaces in a variable kv for MAKEFLAGS.
+func escapeMakeflagsVar(kv string) string {
+	var buf []byte
+	for i := 0; i < len(kv); i++ {
+		if isWhitespace(rune(kv[i])) {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, kv[i])
+	}
+	return string(buf)
+}
+
+// joinMakeflags returns MAKEFLAGS for commands from the value of
+// MAKEFLAGS and MAKEOVERRIDES, e.g. "k -- FOO=bar".
+func joinMakeflags(flags, overrides string) string {
+	if trimLeftSpace(overrides) == "" {
+		return flags
+	}
+	return flags + " -- " + overrides
+}
+
+// mflags returns MFLAGS for makeflags, i.e. options without
+// variables, where single letter options are prefixed by '-', e.g.
+// "-k -j4" for "k -j4 -- FOO=bar".
+func mflags(makeflags string) string {
+	var words []string
+	for i, w := range splitSpaces(makeflags) {
+		if w == "--" {
+			break
+		}
+		if strings.IndexByte(w, '=') > 0 && !strings.HasPrefix(w, "-") {
+			// a variable without "--".
+			continue
+		}
+		if i == 0 && !strings.HasPrefix(w, "-") {
+			w = "-" + w
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMakeflagsLetters(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "kn", want: "kn"},
+		{in: "kn -j4", want: "kn"},
+		{in: "kj4", want: "k"},
+		{in: "knOtarget", want: "kn"},
+		{in: " -Otarget", want: ""},
+		{in: " -Onone", want: ""},
+		{in: " -j4 -l2.5", want: ""},
+		{in: "-k", want: "k"},
+		{in: "-k -e", want: "ke"},
+		{in: "k -- FOO=bar -n", want: "k"},
+		{in: "--no-print-directory", want: ""},
+		{in: "FOO=bar", want: ""},
+	} {
+		got := makeflagsLetters(tc.in)
+		if got != tc.want {
+			t.Errorf("makeflagsLetters(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAddMakeflag(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "n"},
+		{in: "k", want: "kn"},
+		{in: "-k", want: "n -k"},
+		{in: "kn", want: "kn"},
+		{in: "kj4", want: "knj4"},
+		{in: " -Otarget", want: "n -Otarget"},
+		{in: "k -- FOO=bar", want: "kn -- FOO=bar"},
+		{in: "FOO=bar", want: "n FOO=bar"},
+		{in: "--no-print-directory", want: "n --no-print-directory"},
+	} {
+		got := addMakeflag(tc.in, 'n')
+		if got != tc.want {
+			t.Errorf("addMakeflag(%q, 'n')=%q; want %q", tc.in, got, tc.want)
+		}
+		if !MakeflagsHas(got, 'n') {
+			t.Errorf("MakeflagsHas(%q, 'n')=false; want true", got)
+		}
+	}
+	for _, s := range []string{"", "k", "FOO=n", "--dry-run", " -Onone", "-k -- FOO=n"} {
+		if MakeflagsHas(s, 'n') {
+			t.Errorf("MakeflagsHas(%q, 'n')=true; want false", s)
+		}
+	}
+}
+
+func TestRemoveMakeflag(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "k", want: ""},
+		{in: "kn", want: "n"},
+		{in: "-kn", want: "-n"},
+		{in: "-k -e", want: "-e"},
+		{in: "n -k -j4", want: "n -j4"},
+		{in: "nkj4", want: "nj4"},
+		{in: "k -- FOO=bar", want: "-- FOO=bar"},
+		{in: "k --no-print-directory", want: "--no-print-directory"},
+		{in: "FOO=k", want: "FOO=k"},
+		{in: "j4k", want: "j4k"},
+	} {
+		got := removeMakeflag(tc.in, 'k')
+		if got != tc.want {
+			t.Errorf("removeMakeflag(%q, 'k')=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMakeflagsVars(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{in: "", want: nil},
+		{in: "kn", want: nil},
+		{in: "k -- FOO=bar", want: []string{"FOO=bar"}},
+		{in: " -j4 --jobserver-auth=3,4 -- FOO=a\\ b BAR=", want: []string{"FOO=a b", "BAR="}},
+		{in: "FOO=bar", want: []string{"FOO=bar"}},
+		{in: "k FOO=bar", want: []string{"FOO=bar"}},
+		{in: "--eval=A=b", want: nil},
+	} {
+		got := MakeflagsVars(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("MakeflagsVars(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMakeflagsJobs(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int
+	}{
+		{in: "", want: 0},
+		{in: "k", want: 0},
+		{in: "-j3", want: 3},
+		{in: "j3", want: 3},
+		{in: "kj3", want: 3},
+		{in: "k -j4 --jobserver-auth=3,4", want: 4},
+		{in: "--jobs=2", want: 2},
+		{in: "-j", want: 0},
+		{in: "k -- J=-j3", want: 0},
+	} {
+		got := MakeflagsJobs(tc.in)
+		if got != tc.want {
+			t.Errorf("MakeflagsJobs(%q)=%d; want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMakeflagsDebug(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		trace bool
+		debug string
+	}{
+		{in: ""},
+		{in: "k"},
+		{in: " --trace", trace: true},
+		{in: "k --trace --debug=b,v", trace: true, debug: "b,v"},
+		{in: " --debug", debug: "b"},
+		{in: "d", debug: "a"},
+		{in: "k -- X=--trace"},
+	} {
+		if got := MakeflagsTrace(tc.in); got != tc.trace {
+			t.Errorf("MakeflagsTrace(%q)=%t; want %t", tc.in, got, tc.trace)
+		}
+		if got := MakeflagsDebug(tc.in); got != tc.debug {
+			t.Errorf("MakeflagsDebug(%q)=%q; want %q", tc.in, got, tc.debug)
+		}
+	}
+}
+
+func TestMflags(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "kn", want: "-kn"},
+		{in: "k -- FOO=bar", want: "-k"},
+		{in: " -j4 --jobserver-auth=3,4 -- FOO=bar", want: "-j4 --jobserver-auth=3,4"},
+		{in: "FOO=bar", want: ""},
+	} {
+		got := mflags(tc.in)
+		if got != tc.want {
+			t.Errorf("mflags(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestJoinMakeflags(t *testing.T) {
+	for _, tc := range []struct {
+		flags, overrides string
+		want             string
+	}{
+		{flags: "k", overrides: "", want: "k"},
+		{flags: "", overrides: "FOO=bar", want: " -- FOO=bar"},
+		{flags: "kn", overrides: escapeMakeflagsVar("FOO=a b"), want: "kn -- FOO=a\\ b"},
+	} {
+		got := joinMakeflags(tc.flags, tc.overrides)
+		if got != tc.want {
+			t.Errorf("joinMakeflags(%q, %q)=%q; want %q", tc.flags, tc.overrides, got, tc.want)
+		}
+		if vars := MakeflagsVars(got); tc.overrides != "" && len(vars) != 1 {
+			t.Errorf("MakeflagsVars(%q)=%q; want 1 variable", got, vars)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxMatcherCacheSize is the maximum number of compiled patterns kept
+// in matcherCache. The cache is flushed when it becomes full.
+const maxMatcherCacheSize = 1 << 14
+
+// matcherCacheT caches compiled % patterns and glob patterns, so the
+// same pattern is not rescanned for each word.
+type matcherCacheT struct {
+	mu      sync.RWMutex
+	percent map[string]*percentPattern
+	glob    map[string]*globPattern
+}
+
+var matcherCache = &matcherCacheT{
+	percent: make(map[string]*percentPattern),
+	glob:    make(map[string]*globPattern),
+}
+
+// percentPattern is a compiled pattern used in $(filter), $(patsubst),
+// vpath etc. The first '%' matches any string; other '%'s are literal.
+type percentPattern struct {
+	pat string
+	b   []byte // pat in bytes.
+	pct int    // index of '%' in pat, or -1.
+}
+
+func (c *matcherCacheT) percentPattern(pat []byte) *percentPattern {
+	c.mu.RLock()
+	p, ok := c.percent[string(pat)]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+	p = newPercentPattern(string(pat))
+	c.mu.Lock()
+	if len(c.percent) >= maxMatcherCacheSize {
+		c.percent = make(map[string]*percentPattern)
+	}
+	c.percent[p.pat] = p
+	c.mu.Unlock()
+	return p
+}
+
+func (c *matcherCacheT) percentPatternString(pat string) *percentPattern {
+	c.mu.RLock()
+	p, ok := c.percent[pat]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+	return c.percentPattern([]byte(pat))
+}
+
+// percentPatterns appends compiled patterns of pats to ps.
+func (c *matcherCacheT) percentPatterns(ps []*percentPattern, pats [][]byte) []*percentPattern {
+	for _, pat := range pats {
+		ps = append(ps, c.percentPattern(pat))
+	}
+	return ps
+}
+
+func newPercentPattern(pat string) *percentPattern {
+	return &percentPattern{
+		pat: pat,
+		b:   []byte(pat),
+		pct: strings.IndexByte(pat, '%'),
+	}
+}
+
+// stem returns the string matched with '%' in s.
+func (p *percentPattern) stem(s []byte) ([]byte, bool) {
+	if p.pct < 0 {
+		return nil, string(s) == p.pat
+	}
+	prefix, suffix := p.pat[:p.pct], p.pat[p.pct+1:]
+	if len(s) < len(prefix)+len(suffix) {
+		return nil, false
+	}
+	if string(s[:len(prefix)]) != prefix {
+		return nil, false
+	}
+	if string(s[len(s)-len(suffix):]) != suffix {
+		return nil, false
+	}
+	return s[len(prefix) : len(s)-len(suffix)], true
+}
+
+func (p *percentPattern) match(s []byte) bool {
+	_, ok := p.stem(s)
+	return ok
+}
+
+func (p *percentPattern) matchString(s string) bool {
+	if p.pct < 0 {
+		return s == p.pat
+	}
+	prefix, suffix := p.pat[:p.pct], p.pat[p.pct+1:]
+	return len(s) >= len(prefix)+len(suffix) && strings.HasPrefix(s, prefix) && strings.HasSuffix(s, suffix)
+}
+
+// subst returns pre, subst, post, where pre+subst+post is s substituted
+// with repl. subst is nil if s is replaced with the whole repl or s
+// doesn't match.
+func (p *percentPattern) subst(repl *percentPattern, s []byte) (pre, subst, post []byte) {
+	stem, ok := p.stem(s)
+	if !ok {
+		return s, nil, nil
+	}
+	if p.pct < 0 || repl.pct < 0 {
+		return repl.b, nil, nil
+	}
+	return repl.b[:repl.pct], stem, repl.b[repl.pct+1:]
+}
+
+// glob kinds. globGeneral uses elems.
+const (
+	globLiteral = iota
+	globPrefix
+	globSuffix
+	globPrefixSuffix
+	globGeneral
+	globFallback
+)
+
+// glob elem ops.
+const (
+	globOpLit = iota
+	globOpAny
+	globOpStar
+	globOpClass
+)
+
+// byteSet is a set of ASCII bytes.
+type byteSet [2]uint64
+
+func (s *byteSet) add(lo, hi byte) {
+	for c := int(lo); c <= int(hi); c++ {
+		s[c>>6] |= 1 << uint(c&63)
+	}
+}
+
+func (s *byteSet) has(c byte) bool {
+	if c >= utf8.RuneSelf {
+		return false
+	}
+	return s[c>>6]&(1<<uint(c&63)) != 0
+}
+
+type globElem struct {
+	op     int
+	lit    string
+	set    byteSet
+	negate bool
+}
+
+// globPattern is a compiled pattern for filepath.Match.
+// Patterns which are not supported by the compiler, i.e. malformed
+// patterns or character classes with non ASCII characters, fall back
+// to filepath.Match.
+type globPattern struct {
+	pat    string
+	kind   int
+	prefix string
+	suffix string
+	elems  []globElem
+}
+
+func (c *matcherCacheT) globPattern(pat string) *globPattern {
+	c.mu.RLock()
+	g, ok := c.glob[pat]
+	c.mu.RUnlock()
+	if ok {
+		return g
+	}
+	g = compileGlob(pat)
+	c.mu.Lock()
+	if len(c.glob) >= maxMatcherCacheSize {
+		c.glob = make(map[string]*globPattern)
+	}
+	c.glob[pat] = g
+	c.mu.Unlock()
+	return g
+}
+
+func compileGlob(pat string) *globPattern {
+	g := &globPattern{pat: pat, kind: globFallback}
+	if filepath.Separator == '\\' {
+		// '\\' is not an escape char on windows.
+		if !hasWildcardMeta(pat) {
+			g.kind = globLiteral
+			g.prefix = pat
+		}
+		return g
+	}
+	var elems []globElem
+	var lit []byte
+	flush := func() {
+		if len(lit) > 0 {
+			elems = append(elems, globElem{op: globOpLit, lit: string(lit)})
+			lit = nil
+		}
+	}
+	for i := 0; i < len(pat); i++ {
+		switch pat[i] {
+		case '\\':
+			i++
+			if i == len(pat) {
+				return g
+			}
+			lit = append(lit, pat[i])
+		case '?':
+			flush()
+			elems = append(elems, globElem{op: globOpAny})
+		case '*':
+			flush()
+			if len(elems) > 0 && elems[len(elems)-1].op == globOpStar {
+				continue
+			}
+			elems = append(elems, globElem{op: globOpStar})
+		case '[':
+			flush()
+			e, n, ok := compileGlobClass(pat[i+1:])
+			if !ok {
+				return g
+			}
+			elems = append(elems, e)
+			i += n
+		default:
+			lit = append(lit, pat[i])
+		}
+	}
+	flush()
+
+	g.kind = globGeneral
+	g.elems = elems
+	switch {
+	case len(elems) == 0:
+		g.kind = globLiteral
+	case len(elems) == 1 && elems[0].op == globOpLit:
+		g.kind = globLiteral
+		g.prefix = elems[0].lit
+	case len(elems) == 1 && elems[0].op == globOpStar:
+		g.kind = globPrefix
+	case len(elems) == 2 && elems[0].op == globOpLit && elems[1].op == globOpStar:
+		g.kind = globPrefix
+		g.prefix = elems[0].lit
+	case len(elems) == 2 && elems[0].op == globOpStar && elems[1].op == globOpLit:
+		g.kind = globSuffix
+		g.suffix = elems[1].lit
+	case len(elems) == 3 && elems[0].op == globOpLit && elems[1].op == globOpStar && elems[2].op == globOpLit:
+		g.kind = globPrefixSuffix
+		g.prefix = elems[0].lit
+		g.suffix = elems[2].lit
+	}
+	return g
+}
+
+// compileGlobClass compiles a character class in s, which follows '['.
+// It returns the number of bytes consumed including the closing ']'.
+func compileGlobClass(s string) (globElem, int, bool) {
+	e := globElem{op: globOpClass}
+	i := 0
+	if i < len(s) && s[i] == '^' {
+		e.negate = true
+		i++
+	}
+	getc := func() (byte, bool) {
+		if i == len(s) || s[i] == '-' || s[i] == ']' {
+			return 0, false
+		}
+		if s[i] == '\\' {
+			i++
+			if i == len(s) {
+				return 0, false
+			}
+		}
+		c := s[i]
+		i++
+		return c, c < utf8.RuneSelf
+	}
+	for nrange := 0; ; nrange++ {
+		if i < len(s) && s[i] == ']' && nrange > 0 {
+			return e, i + 1, true
+		}
+		lo, ok := getc()
+		if !ok {
+			return e, 0, false
+		}
+		hi := lo
+		if i < len(s) && s[i] == '-' {
+			i++
+			hi, ok = getc()
+			if !ok {
+				return e, 0, false
+			}
+		}
+		if lo <= hi {
+			e.set.add(lo, hi)
+		}
+	}
+}
+
+func (g *globPattern) match(name string) (bool, error) {
+	switch g.kind {
+	case globLiteral:
+		return name == g.prefix, nil
+	case globPrefix:
+		return strings.HasPrefix(name, g.prefix) && strings.IndexByte(name[len(g.prefix):], filepath.Separator) < 0, nil
+	case globSuffix:
+		return strings.HasSuffix(name, g.suffix) && strings.IndexByte(name[:len(name)-len(g.suffix)], filepath.Separator) < 0, nil
+	case globPrefixSuffix:
+		return len(name) >= len(g.prefix)+len(g.suffix) &&
+			strings.HasPrefix(name, g.prefix) &&
+			strings.HasSuffix(name, g.suffix) &&
+			strings.IndexByte(name[len(g.prefix):len(name)-len(g.suffix)], filepath.Separator) < 0, nil
+	case globGeneral:
+		return g.matchElems(name), nil
+	}
+	return filepath.Match(g.pat, name)
+}
+
+// matchElems matches name with elems, backtracking to the last star.
+func (g *globPattern) matchElems(name string) bool {
+	ei, ni := 0, 0
+	star, starNi := -1, 0
+	for {
+		if ei < len(g.elems) {
+			e := &g.elems[ei]
+			if e.op == globOpStar {
+				star, starNi = ei, ni
+				ei++
+				continue
+			}
+			if n, ok := e.match(name[ni:]); ok {
+				ei++
+				ni += n
+				continue
+			}
+		} else if ni == len(name) {
+			return true
+		}
+		// let the last star consume one more byte, as filepath.Match
+		// does.
+		if star < 0 || starNi == len(name) || name[starNi] == filepath.Separator {
+			return false
+		}
+		starNi++
+		ei, ni = star+1, starNi
+	}
+}
+
+// match matches the head of s with e, and returns the number of bytes
+// matched.
+func (e *globElem) match(s string) (int, bool) {
+	switch e.op {
+	case globOpLit:
+		if strings.HasPrefix(s, e.lit) {
+			return len(e.lit), true
+		}
+		return 0, false
+	case globOpAny:
+		if len(s) == 0 || s[0] == filepath.Separator {
+			return 0, false
+		}
+		_, n := utf8.DecodeRuneInString(s)
+		return n, true
+	case globOpClass:
+		if len(s) == 0 {
+			return 0, false
+		}
+		_, n := utf8.DecodeRuneInString(s)
+		if e.set.has(s[0]) != e.negate {
+			return n, true
+		}
+		return 0, false
+	}
+	return 0, false
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPercentPatternMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pat  string
+		in   string
+		want bool
+	}{
+		{pat: "%.c", in: "foo.c", want: true},
+		{pat: "%.c", in: "foo.h", want: false},
+		{pat: "%.c", in: ".c", want: true},
+		{pat: "foo%", in: "foo", want: true},
+		{pat: "a%a", in: "a", want: false},
+		{pat: "a%a", in: "aa", want: true},
+		{pat: "%", in: "", want: true},
+		{pat: "foo", in: "foo", want: true},
+		{pat: "foo", in: "foobar", want: false},
+		{pat: "%.%", in: "x.%", want: true},
+		{pat: "%.%", in: "x.y", want: false},
+	} {
+		if got := matchPattern(tc.pat, tc.in); got != tc.want {
+			t.Errorf("matchPattern(%q, %q)=%t; want %t", tc.pat, tc.in, got, tc.want)
+		}
+		if got := matchPatternBytes([]byte(tc.pat), []byte(tc.in)); got != tc.want {
+			t.Errorf("matchPatternBytes(%q, %q)=%t; want %t", tc.pat, tc.in, got, tc.want)
+		}
+	}
+}
+
+var globTestPatterns = []string{
+	"foo.c", "*", "*.c", "foo*", "f*.c", "f?o.c", "*o*.c", "[a-f]oo.c",
+	"[^a-f]oo.c", "[]", "[", "\\*.c", "foo\\", "[a-]", "[\\]]*", "*[é]",
+	"a*b*c", "**", "?", "[!a]*",
+}
+
+func TestGlobPatternMatch(t *testing.T) {
+	names := []string{"", "foo.c", "boo.c", "zoo.c", "foo.h", "*.c", "abc", "abbc", "aXbYc", "]x", "é", "xé", "!a"}
+	for _, pat := range globTestPatterns {
+		g := compileGlob(pat)
+		for _, name := range names {
+			got, err := g.match(name)
+			want, werr := filepath.Match(pat, name)
+			if got != want || (err == nil) != (werr == nil) {
+				t.Errorf("compileGlob(%q).match(%q)=%t, %v; want %t, %v", pat, name, got, err, want, werr)
+			}
+		}
+	}
+}
+
+func FuzzGlobPatternMatch(f *testing.F) {
+	for _, pat := range globTestPatterns {
+		f.Add(pat, "foo.c")
+	}
+	f.Fuzz(func(t *testing.T, pat, name string) {
+		got, err := compileGlob(pat).match(name)
+		want, werr := filepath.Match(pat, name)
+		if got != want || (err == nil) != (werr == nil) {
+			t.Errorf("compileGlob(%q).match(%q)=%t, %v; want %t, %v", pat, name, got, err, want, werr)
+		}
+	})
+}
+
+var globBenchNames = []string{
+	"Android.mk", "CleanSpec.mk", "foo.c", "foo.cpp", "foo.h", "bar_test.cc",
+	"README", "NOTICE", "MODULE_LICENSE_APACHE2", "libfoo.so", "proguard.flags",
+}
+
+func BenchmarkGlobPatternMatch(b *testing.B) {
+	g := compileGlob("*.c[cp]*")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, n := range globBenchNames {
+			g.match(n)
+		}
+	}
+}
+
+func BenchmarkFilepathMatch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, n := range globBenchNames {
+			filepath.Match("*.c[cp]*", n)
+		}
+	}
+}
+
+func BenchmarkFuncFilter(b *testing.B) {
+	filter := &funcFilter{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(filter"),
+				literal("%.c %.cc %.cpp"),
+				literal("a.c b.h c.cc d.java e.cpp f.S g.c h.mk"),
+			},
+		},
+	}
+	ev := NewEvaluator(make(map[string]Var))
+	var buf evalBuffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		filter.Eval(&buf, ev)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Modes of WildcardFold.
+const (
+	// WildcardFoldOff matches names byte-wise.
+	WildcardFoldOff = "off"
+	// WildcardFoldOn matches names ignoring case and Unicode
+	// normalization on all file systems.
+	WildcardFoldOn = "on"
+	// WildcardFoldAuto detects how each file system matches names,
+	// e.g. APFS on macOS ignores normalization, and case unless it is
+	// formatted case-sensitive.
+	WildcardFoldAuto = "auto"
+)
+
+func validWildcardFold(mode string) error {
+	switch mode {
+	case "", WildcardFoldOff, WildcardFoldOn, WildcardFoldAuto:
+		return nil
+	}
+	return fmt.Errorf("unknown wildcard fold mode %q", mode)
+}
+
+// nameFolding is how a file system matches names.
+type nameFolding struct {
+	caseInsensitive bool
+	// normInsensitive is true if names in NFC and NFD are the same,
+	// e.g. "é" and "é".
+	normInsensitive bool
+}
+
+var defaultNameFolding = nameFolding{
+	caseInsensitive: defaultCaseInsensitiveFS,
+	normInsensitive: defaultNormInsensitiveFS,
+}
+
+func (f nameFolding) folds() bool {
+	return f.caseInsensitive || f.normInsensitive
+}
+
+// fold returns the name which names matching s fold to.
+func (f nameFolding) fold(s string) string {
+	if f.normInsensitive {
+		s = decomposeName(s)
+	}
+	if f.caseInsensitive {
+		s = strings.ToLower(s)
+	}
+	return s
+}
+
+// fsFolding is how a file system matches names, as far as detected.
+type fsFolding struct {
+	nameFolding
+	caseKnown bool
+	normKnown bool
+}
+
+// probe detects how the file system of dir matches names, by looking
+// up names in dir with their case or normalization changed.
+func (f *fsFolding) probe(dir string, names []string) {
+	for _, name := range names {
+		if f.caseKnown && f.normKnown {
+			return
+		}
+		if !f.caseKnown {
+			alt := strings.ToUpper(name)
+			if alt == name {
+				alt = strings.ToLower(name)
+			}
+			if alt != name {
+				f.caseInsensitive, f.caseKnown = sameFileName(dir, name, alt)
+			}
+		}
+		if !f.normKnown {
+			alt := decomposeName(name)
+			if alt == name {
+				alt = composeName(name)
+			}
+			if alt != name {
+				f.normInsensitive, f.normKnown = sameFileName(dir, name, alt)
+			}
+		}
+	}
+}
+
+// folding returns how the file system matches names. Undetected ones
+// are the default of the platform.
+func (f fsFolding) folding() nameFolding {
+	r := defaultNameFolding
+	if f.caseKnown {
+		r.caseInsensitive = f.caseInsensitive
+	}
+	if f.normKnown {
+		r.normInsensitive = f.normInsensitive
+	}
+	return r
+}
+
+// sameFileName reports whether alt is the name of the file name in
+// dir. ok is false if it can't be told.
+func sameFileName(dir, name, alt string) (same, ok bool) {
+	fi, err := os.Lstat(filepath.Join(dir, name))
+	if err != nil {
+		return false, false
+	}
+	afi, err := os.Lstat(filepath.Join(dir, alt))
+	if os.IsNotExist(err) {
+		return false, true
+	}
+	if err != nil {
+		return false, false
+	}
+	return os.SameFile(fi, afi), true
+}
+
+// Hangul syllables are decomposed algorithmically.
+const (
+	hangulBase   = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// latinCompositions are canonical compositions of Latin-1 Supplement
+// and Latin Extended-A, i.e. letters with a combining mark, which are
+// common in file names.
+var latinCompositions = []struct {
+	mark     rune
+	composed string
+	bases    string
+}{
+	{0x0300, "ÀÈÌÒÙàèìòù", "AEIOUaeiou"},
+	{0x0301, "ÁÉÍÓÚÝáéíóúýĆćĹĺŃńŔŕŚśŹź", "AEIOUYaeiouyCcLlNnRrSsZz"},
+	{0x0302, "ÂÊÎÔÛâêîôûĈĉĜĝĤĥĴĵŜŝŴŵŶŷ", "AEIOUaeiouCcGgHhJjSsWwYy"},
+	{0x0303, "ÃÑÕãñõĨĩŨũ", "ANOanoIiUu"},
+	{0x0304, "ĀāĒēĪīŌōŪū", "AaEeIiOoUu"},
+	{0x0306, "ĂăĔĕĞğĬĭŎŏŬŭ", "AaEeGgIiOoUu"},
+	{0x0307, "ĊċĖėĠġİŻż", "CcEeGgIZz"},
+	{0x0308, "ÄËÏÖÜäëïöüÿŸ", "AEIOUaeiouyY"},
+	{0x030A, "ÅåŮů", "AaUu"},
+	{0x030B, "ŐőŰű", "OoUu"},
+	{0x030C, "ČčĎďĚěĽľŇňŘřŠšŤťŽž", "CcDdEeLlNnRrSsTtZz"},
+	{0x0327, "ÇçĢģĶķĻļŅņŖŗŞşŢţ", "CcGgKkLlNnRrSsTt"},
+	{0x0328, "ĄąĘęĮįŲų", "AaEeIiUu"},
+}
+
+var (
+	latinDecomposition map[rune][2]rune
+	latinComposition   map[[2]rune]rune
+)
+
+func init() {
+	latinDecomposition = make(map[rune][2]rune)
+	latinComposition = make(map[[2]rune]rune)
+	for _, c := range latinCompositions {
+		bases := []rune(c.bases)
+		for i, r := range []rune(c.composed) {
+			d := [2]rune{bases[i], c.mark}
+			latinDecomposition[r] = d
+			latinComposition[d] = r
+		}
+	}
+}
+
+// decomposeName returns s in NFD, as far as Hangul syllables and
+// letters in latinCompositions.
+func decomposeName(s string) string {
+	i := 0
+	for i < len(s) && s[i] < utf8.RuneSelf {
+		i++
+	}
+	if i == len(s) {
+		return s
+	}
+	var buf bytes.Buffer
+	buf.WriteString(s[:i])
+	for _, r := range s[i:] {
+		if d, ok := latinDecomposition[r]; ok {
+			buf.WriteRune(d[0])
+			buf.WriteRune(d[1])
+			continue
+		}
+		if n := r - hangulBase; n >= 0 && n < hangulSCount {
+			buf.WriteRune(hangulLBase + n/hangulNCount)
+			buf.WriteRune(hangulVBase + n%hangulNCount/hangulTCount)
+			if t := n % hangulTCount; t > 0 {
+				buf.WriteRune(hangulTBase + t)
+			}
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// composeName returns s in NFC, as far as decomposeName decomposes.
+func composeName(s string) string {
+	rs := []rune(s)
+	var r []rune
+	for _, c := range rs {
+		if len(r) == 0 {
+			r = append(r, c)
+			continue
+		}
+		last := &r[len(r)-1]
+		if comp, ok := latinComposition[[2]rune{*last, c}]; ok {
+			*last = comp
+			continue
+		}
+		if l, v := *last-hangulLBase, c-hangulVBase; l >= 0 && l < hangulLCount && v >= 0 && v < hangulVCount {
+			*last = hangulBase + (l*hangulVCount+v)*hangulTCount
+			continue
+		}
+		if lv, t := *last-hangulBase, c-hangulTBase; lv >= 0 && lv < hangulSCount && lv%hangulTCount == 0 && t > 0 && t < hangulTCount {
+			*last += t
+			continue
+		}
+		r = append(r, c)
+	}
+	return string(r)
+}
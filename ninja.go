@@ -22,34 +22,111 @@ import (
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	// ninjaPoolVar is the variable to run commands of a target in a
+	// ninja pool, e.g. "out/app: .KATI_NINJA_POOL := highmem". As
+	// other target specific variables, prerequisites inherit it.
+	ninjaPoolVar = ".KATI_NINJA_POOL"
+	// ninjaPoolsVar declares ninja pools with their depths, e.g.
+	// ".KATI_NINJA_POOLS := highmem:2 link:4".
+	ninjaPoolsVar = ".KATI_NINJA_POOLS"
+	// notParallelPool is the pool of commands of .NOTPARALLEL.
+	notParallelPool = "kati_notparallel"
+	// ninjaDepfileVar is the variable to declare a depfile generated
+	// by commands of a target, e.g. ".KATI_DEPFILE = $(@:.o=.d)".
+	// Prerequisites only in the depfile are left to ninja. An empty
+	// value disables detection of -MD and -MF in commands.
+	ninjaDepfileVar = ".KATI_DEPFILE"
+)
+
 // NinjaGenerator generates ninja build files from DepGraph.
 type NinjaGenerator struct {
 	// GomaDir is goma directory.  If empty, goma will not be used.
 	GomaDir string
 	// DetectAndroidEcho detects echo as description.
 	DetectAndroidEcho bool
+	// RspfileThreshold is the length of a command line to write the
+	// command into a rspfile, which the shell runs as a script.
+	// If 0, the limit of the shell is used.
+	RspfileThreshold int
+	// Incremental reuses build statements of unchanged nodes in the
+	// previous generation, and writes ninja files only if changed.
+	Incremental bool
+	// KatiStamp writes the stamp file of ckati, so kati -regen or
+	// ckati --regen can check whether ninja files need to be generated
+	// again. see stamp.go
+	KatiStamp bool
 
-	f       *os.File
-	nodes   []*DepNode
-	exports map[string]bool
+	f        *os.File
+	nodes    []*DepNode
+	exports  map[string]bool
+	usedEnvs []string
 
 	ctx *execContext
+	// pools are the declared pools.
+	pools map[string]bool
+	// state is the state of incremental generation, or nil.
+	state *ninjaState
 
 	ruleID     int
 	done       map[string]bool
 	shortNames map[string][]string
+	// waits are order-only inputs of outputs by .WAIT.
+	waits map[string][]string
+	// tid is the thread id of trace events, or 0 for traceEventMain.
+	tid int
 }
 
 func (n *NinjaGenerator) init(g *DepGraph) {
 	n.nodes = g.nodes
 	n.exports = g.exports
+	n.usedEnvs = usedEnvNames(g)
 	n.ctx = newExecContext(g.vars, g.vpaths, true)
 	n.done = make(map[string]bool)
 	n.shortNames = make(map[string][]string)
+	n.waits = waitOrderOnlys(g.nodes)
+	n.state = nil
+}
+
+// waitOrderOnlys returns order-only inputs of outputs by .WAIT in
+// prerequisites of nodes and their dependencies. For "a b .WAIT c",
+// c has order-only inputs a and b, unless they depend on c. Unlike
+// make, they are waited for even if c is built for other targets.
+func waitOrderOnlys(nodes []*DepNode) map[string][]string {
+	waits := make(map[string][]string)
+	seen := make(map[*DepNode]bool)
+	var walk func(*DepNode)
+	walk = func(node *DepNode) {
+		if seen[node] {
+			return
+		}
+		seen[node] = true
+		for _, w := range node.Waits {
+			for _, d := range node.Deps[w:] {
+				for _, ld := range node.Deps[:w] {
+					if dependsOn(ld, d, make(map[*DepNode]bool)) {
+						continue
+					}
+					waits[d.Output] = append(waits[d.Output], escapeBuildTarget(ld.Output))
+				}
+			}
+		}
+		for _, d := range node.Deps {
+			walk(d)
+		}
+		for _, d := range node.OrderOnlys {
+			walk(d)
+		}
+	}
+	for _, node := range nodes {
+		walk(node)
+	}
+	return waits
 }
 
 func getDepfileImpl(ss string) (string, error) {
@@ -227,21 +304,31 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 	const defaultDesc = "build $out"
 	var useGomacc bool
 	var buf bytes.Buffer
+	// cmd.exe has no ';' nor true.
+	seq, nop := " ; ", "true"
+	if len(runners) > 0 && isCmdShell(runners[0].shell) {
+		seq, nop = " & ", "cd ."
+	}
 	for i, r := range runners {
 		if i > 0 {
 			if runners[i-1].ignoreError {
-				buf.WriteString(" ; ")
+				buf.WriteString(seq)
 			} else {
 				buf.WriteString(" && ")
 			}
 		}
-		cmd := stripShellComment(r.cmd)
-		cmd = trimLeftSpace(cmd)
-		cmd = strings.Replace(cmd, "\\\n", "", -1)
-		cmd = strings.TrimRight(cmd, " \t\n;")
+		var cmd string
+		if r.oneShell && strings.IndexByte(r.cmd, '\n') >= 0 {
+			cmd = oneShellCommand(cmdline(r.cmd))
+		} else {
+			cmd = stripShellComment(r.cmd)
+			cmd = trimLeftSpace(cmd)
+			cmd = strings.Replace(cmd, "\\\n", "", -1)
+			cmd = strings.TrimRight(cmd, " \t\n;")
+		}
 		cmd = strings.Replace(cmd, "$", "$$", -1) // for ninja
 		if cmd == "" {
-			cmd = "true"
+			cmd = nop
 		}
 		if n.GomaDir != "" {
 			rcmd, ok := gomaCmdForAndroidCompileCmd(cmd)
@@ -254,7 +341,7 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 			d, ok := descriptionFromCmd(cmd)
 			if ok {
 				desc = d
-				cmd = "true"
+				cmd = nop
 			}
 		}
 		needsSubShell := i > 0 || len(runners) > 1
@@ -267,7 +354,7 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 		}
 		buf.WriteString(cmd)
 		if i == len(runners)-1 && r.ignoreError {
-			buf.WriteString(" ; true")
+			buf.WriteString(seq + nop)
 		}
 		if needsSubShell {
 			buf.WriteByte(')')
@@ -279,14 +366,33 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 	return buf.String(), desc, n.GomaDir != "" && !useGomacc
 }
 
+// oneShellCommand returns a command which runs script of .ONESHELL.
+// ninja can't write newlines in commands, so the shell evaluates the
+// script printed line by line.
+func oneShellCommand(script string) string {
+	var buf bytes.Buffer
+	buf.WriteString(`eval "$(printf '%s\n'`)
+	for _, line := range strings.Split(script, "\n") {
+		buf.WriteString(" '")
+		buf.WriteString(strings.Replace(line, "'", `'\''`, -1))
+		buf.WriteByte('\'')
+	}
+	buf.WriteString(`)"`)
+	return buf.String()
+}
+
 func (n *NinjaGenerator) genRuleName() string {
 	ruleName := fmt.Sprintf("rule%d", n.ruleID)
 	n.ruleID++
 	return ruleName
 }
 
-func (n *NinjaGenerator) emitBuild(output, rule, inputs, orderOnlys string) {
-	fmt.Fprintf(n.f, "build %s: %s", escapeBuildTarget(output), rule)
+func (n *NinjaGenerator) emitBuild(outputs []string, rule, inputs, orderOnlys string) {
+	fmt.Fprint(n.f, "build")
+	for _, output := range outputs {
+		fmt.Fprintf(n.f, " %s", escapeBuildTarget(output))
+	}
+	fmt.Fprintf(n.f, ": %s", rule)
 	if inputs != "" {
 		fmt.Fprintf(n.f, " %s", inputs)
 	}
@@ -311,10 +417,13 @@ func escapeBuildTarget(s string) string {
 	return buf.String()
 }
 
-func getDepString(node *DepNode) (string, string) {
+func getDepString(node *DepNode, depfileOnly map[string]bool) (string, string) {
 	var deps []string
 	seen := make(map[string]bool)
 	for _, d := range node.Deps {
+		if depfileOnly[d.Output] {
+			continue
+		}
 		t := escapeBuildTarget(d.Output)
 		if seen[t] {
 			continue
@@ -334,6 +443,46 @@ func getDepString(node *DepNode) (string, string) {
 	return strings.Join(deps, " "), strings.Join(orderOnlys, " ")
 }
 
+// dependsOn reports whether node is d or depends on d.
+func dependsOn(node, d *DepNode, seen map[*DepNode]bool) bool {
+	if node == d || node.Output == d.Output {
+		return true
+	}
+	if seen[node] {
+		return false
+	}
+	seen[node] = true
+	for _, c := range node.Deps {
+		if dependsOn(c, d, seen) {
+			return true
+		}
+	}
+	for _, c := range node.OrderOnlys {
+		if dependsOn(c, d, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// addOrderOnlys returns a copy of stmt with order-only inputs added,
+// except ones already in its inputs.
+func addOrderOnlys(stmt *ninjaStmt, orderOnlys []string) *ninjaStmt {
+	s := *stmt
+	seen := make(map[string]bool)
+	for _, t := range splitSpaces(s.Inputs + " " + s.OrderOnlys) {
+		seen[t] = true
+	}
+	for _, t := range orderOnlys {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		s.OrderOnlys = strings.TrimLeft(s.OrderOnlys+" "+t, " ")
+	}
+	return &s
+}
+
 func escapeShell(s string) string {
 	i := strings.IndexAny(s, "$`!\\\"")
 	if i < 0 {
@@ -361,6 +510,13 @@ func escapeShell(s string) string {
 	return buf.String()
 }
 
+// emitNode emits the build statement of node and its dependencies.
+// Intermediate files are emitted as normal outputs, i.e. they are
+// kept as .SECONDARY ones, since ninja never deletes outputs after
+// the build. Outputs of failed commands are not deleted either, but
+// ninja reruns the commands the next time because they are not
+// recorded in .ninja_log, so .DELETE_ON_ERROR and .PRECIOUS need
+// nothing.
 func (n *NinjaGenerator) emitNode(node *DepNode) error {
 	if n.done[node.Output] {
 		return nil
@@ -371,7 +527,7 @@ func (n *NinjaGenerator) emitNode(node *DepNode) error {
 		if _, ok := n.ctx.vpaths.exists(node.Output); ok {
 			return nil
 		}
-		n.emitBuild(node.Output, "phony", "", "")
+		n.emitBuild([]string{node.Output}, "phony", "", "")
 		fmt.Fprintln(n.f)
 		return nil
 	}
@@ -381,56 +537,64 @@ func (n *NinjaGenerator) emitNode(node *DepNode) error {
 		n.shortNames[base] = append(n.shortNames[base], node.Output)
 	}
 
-	runners, _, err := createRunners(n.ctx, node)
+	if len(node.DoubleColons) > 0 {
+		return n.emitDoubleColons(node)
+	}
+	stmt, err := n.buildStmt(node)
 	if err != nil {
 		return err
 	}
-	ruleName := "phony"
-	useLocalPool := false
-	inputs, orderOnlys := getDepString(node)
-	if len(runners) > 0 {
-		ruleName = n.genRuleName()
-		fmt.Fprintf(n.f, "\n# rule for %s\n", node.Output)
-		fmt.Fprintf(n.f, "rule %s\n", ruleName)
+	if waits := n.waits[node.Output]; len(waits) > 0 {
+		stmt = addOrderOnlys(stmt, waits)
+	}
+	// A grouped rule is a build statement of all its outputs, so
+	// ninja runs the commands once.
+	outputs := []string{node.Output}
+	for _, o := range node.GroupOutputs {
+		if !n.done[o] {
+			n.done[o] = true
+			outputs = append(outputs, o)
+		}
+	}
+	n.emitStmt(outputs, stmt)
+	depfileOnly := depfileOnlyInputs(node, stmt.Depfile)
 
-		ss, desc, ulp := n.genShellScript(runners)
-		if ulp {
-			useLocalPool = true
+	for _, d := range node.Deps {
+		if depfileOnly[d.Output] {
+			continue
 		}
-		fmt.Fprintf(n.f, " description = %s\n", desc)
-		cmdline, depfile, err := getDepfile(ss)
+		err := n.emitNode(d)
 		if err != nil {
 			return err
 		}
-		if depfile != "" {
-			fmt.Fprintf(n.f, " depfile = %s\n", depfile)
-			fmt.Fprintf(n.f, " deps = gcc\n")
-		}
-		// It seems Linux is OK with ~130kB.
-		// TODO: Find this number automatically.
-		ArgLenLimit := 100 * 1000
-		if len(cmdline) > ArgLenLimit {
-			fmt.Fprintf(n.f, " rspfile = $out.rsp\n")
-			if inputs != "" {
-				cmdline = strings.Replace(cmdline, inputs, "$in", -1)
-			}
-			cmdline = strings.Replace(cmdline, node.Output, "$out", -1)
-			fmt.Fprintf(n.f, " rspfile_content = %s\n", cmdline)
-			fmt.Fprintf(n.f, " command = %s $out.rsp\n", n.ctx.shell)
-		} else {
-			cmdline = escapeShell(cmdline)
-			if inputs != "" {
-				cmdline = strings.Replace(cmdline, escapeShell(inputs), "$in", -1)
-			}
-			cmdline = strings.Replace(cmdline, escapeShell(node.Output), "$out", -1)
-			fmt.Fprintf(n.f, " command = %s -c \"%s\"\n", n.ctx.shell, cmdline)
+	}
+	for _, d := range node.OrderOnlys {
+		err := n.emitNode(d)
+		if err != nil {
+			return err
 		}
 	}
-	n.emitBuild(node.Output, ruleName, inputs, orderOnlys)
-	if useLocalPool {
-		fmt.Fprintf(n.f, " pool = local_pool\n")
+	return nil
+}
+
+// emitDoubleColons emits double-colon rules of node. ninja can't run
+// each rule by its own prerequisites, since they make the same output.
+// So the rules are lowered to phony intermediate targets "output::N",
+// which are never made and run every time, and the output is a phony
+// target of them.
+func (n *NinjaGenerator) emitDoubleColons(node *DepNode) error {
+	var outputs []string
+	for i, dn := range node.DoubleColons {
+		output := fmt.Sprintf("%s::%d", node.Output, i+1)
+		stmt, err := n.genStmt(dn, node.Output)
+		if err != nil {
+			return err
+		}
+		n.emitStmt([]string{output}, stmt)
+		outputs = append(outputs, escapeBuildTarget(output))
 	}
-	fmt.Fprintf(n.f, "\n")
+	n.emitBuild([]string{node.Output}, "phony", strings.Join(outputs, " "), "")
+	fmt.Fprintln(n.f)
 
 	for _, d := range node.Deps {
 		err := n.emitNode(d)
@@ -447,7 +611,269 @@ func (n *NinjaGenerator) emitNode(node *DepNode) error {
 	return nil
 }
 
+// ninjaStmt is a build statement of a node, with its rule.
+type ninjaStmt struct {
+	// Rule is variables of the rule, or empty for a phony target.
+	Rule       string
+	Inputs     string
+	OrderOnlys string
+	// Implicits are files written by $(file) in the commands.
+	Implicits string
+	Pool      string
+	// Depfile is the value of .KATI_DEPFILE.
+	Depfile string
+}
+
+func (n *NinjaGenerator) buildStmt(node *DepNode) (*ninjaStmt, error) {
+	if n.state != nil {
+		return n.incrementalStmt(node)
+	}
+	return n.genStmt(node, "$out")
+}
+
+// genStmt generates the build statement of node by its commands.
+// out replaces the output in the commands, i.e. "$out" if node.Output
+// is the output of the statement.
+func (n *NinjaGenerator) genStmt(node *DepNode, out string) (*ninjaStmt, error) {
+	if len(node.GroupOutputs) > 0 {
+		// $out is all the outputs of the group.
+		out = node.Output
+	}
+	n.ctx.ev.writtenFiles = nil
+	runners, _, err := createRunners(n.ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	err = n.ctx.ev.saveWrittenFiles()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &ninjaStmt{}
+	seen := make(map[string]bool)
+	var implicits []string
+	for _, f := range n.ctx.ev.writtenFiles {
+		if !seen[f] {
+			seen[f] = true
+			implicits = append(implicits, escapeBuildTarget(f))
+		}
+	}
+	stmt.Implicits = strings.Join(implicits, " ")
+	var hasDepfileVar bool
+	if len(runners) > 0 {
+		stmt.Depfile, hasDepfileVar, err = n.nodeVar(node, ninjaDepfileVar)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Depfile = strings.TrimSpace(stmt.Depfile)
+	}
+	inputs, orderOnlys := getDepString(node, depfileOnlyInputs(node, stmt.Depfile))
+	stmt.Inputs, stmt.OrderOnlys = inputs, orderOnlys
+	if len(runners) == 0 {
+		return stmt, nil
+	}
+	var buf bytes.Buffer
+	ss, desc, useLocalPool := n.genShellScript(runners)
+	fmt.Fprintf(&buf, " description = %s\n", desc)
+	cmdline, depfile := ss, stmt.Depfile
+	if !hasDepfileVar {
+		cmdline, depfile, err = getDepfile(ss)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if depfile != "" {
+		fmt.Fprintf(&buf, " depfile = %s\n", strings.Replace(depfile, "$", "$$", -1))
+		fmt.Fprintf(&buf, " deps = gcc\n")
+	}
+	// SHELL and .SHELLFLAGS may be target specific.
+	shell, shellFlags := runners[0].shell, runners[0].shellFlags
+	cmdShell := isCmdShell(shell)
+	if len(cmdline) > n.rspfileThreshold(shell) {
+		rspfile := "$out.rsp"
+		if cmdShell {
+			// cmd.exe runs only .bat or .cmd files.
+			rspfile = "$out.rsp.cmd"
+		}
+		fmt.Fprintf(&buf, " rspfile = %s\n", rspfile)
+		if inputs != "" {
+			cmdline = strings.Replace(cmdline, inputs, "$in", -1)
+		}
+		cmdline = strings.Replace(cmdline, node.Output, out, -1)
+		fmt.Fprintf(&buf, " rspfile_content = %s\n", cmdline)
+		if cmdShell {
+			fmt.Fprintf(&buf, " command = %s /c %s\n", shell, rspfile)
+		} else if flags := scriptShellFlags(shellFlags); flags != "" {
+			fmt.Fprintf(&buf, " command = %s %s %s\n", shell, flags, rspfile)
+		} else {
+			fmt.Fprintf(&buf, " command = %s %s\n", shell, rspfile)
+		}
+	} else if cmdShell {
+		// ninja passes the command to CreateProcess as is, and
+		// cmd.exe doesn't unescape '\\'.
+		if inputs != "" {
+			cmdline = strings.Replace(cmdline, inputs, "$in", -1)
+		}
+		cmdline = strings.Replace(cmdline, node.Output, out, -1)
+		fmt.Fprintf(&buf, " command = %s /s /c \"%s\"\n", shell, cmdline)
+	} else {
+		cmdline = escapeShell(cmdline)
+		if inputs != "" {
+			cmdline = strings.Replace(cmdline, escapeShell(inputs), "$in", -1)
+		}
+		if out != node.Output {
+			cmdline = strings.Replace(cmdline, escapeShell(node.Output), out, -1)
+		}
+		fmt.Fprintf(&buf, " command = %s %s \"%s\"\n", shell, shellFlags, cmdline)
+	}
+	stmt.Rule = buf.String()
+	stmt.Pool, err = n.pool(node)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.Pool == "" && useLocalPool {
+		stmt.Pool = "local_pool"
+	}
+	return stmt, nil
+}
+
+// emitStmt writes stmt of outputs with a new rule name.
+func (n *NinjaGenerator) emitStmt(outputs []string, stmt *ninjaStmt) {
+	ruleName := "phony"
+	if stmt.Rule != "" {
+		ruleName = n.genRuleName()
+		fmt.Fprintf(n.f, "\n# rule for %s\n", strings.Join(outputs, " "))
+		fmt.Fprintf(n.f, "rule %s\n", ruleName)
+		fmt.Fprint(n.f, stmt.Rule)
+	}
+	inputs := stmt.Inputs
+	if stmt.Implicits != "" {
+		inputs = strings.TrimLeft(inputs+" | "+stmt.Implicits, " ")
+	}
+	n.emitBuild(outputs, ruleName, inputs, stmt.OrderOnlys)
+	if stmt.Pool != "" {
+		fmt.Fprintf(n.f, "\n pool = %s", stmt.Pool)
+	}
+	fmt.Fprintf(n.f, "\n")
+}
+
+// emitPools declares pools in .KATI_NINJA_POOLS, and the pool of
+// .NOTPARALLEL if used.
+func (n *NinjaGenerator) emitPools() error {
+	n.pools = map[string]bool{"console": true}
+	if n.GomaDir != "" {
+		n.pools["local_pool"] = true
+	}
+	s, err := n.ctx.ev.EvaluateVar(ninjaPoolsVar)
+	if err != nil {
+		return err
+	}
+	for _, p := range splitSpaces(s) {
+		i := strings.LastIndexByte(p, ':')
+		if i <= 0 {
+			return fmt.Errorf("*** invalid pool %q in %s: want name:depth.", p, ninjaPoolsVar)
+		}
+		depth, err := strconv.Atoi(p[i+1:])
+		if err != nil || depth <= 0 {
+			return fmt.Errorf("*** invalid depth of pool %q in %s.", p, ninjaPoolsVar)
+		}
+		name := p[:i]
+		if n.pools[name] {
+			return fmt.Errorf("*** duplicate pool %q in %s.", name, ninjaPoolsVar)
+		}
+		n.pools[name] = true
+		fmt.Fprintf(n.f, "pool %s\n", name)
+		fmt.Fprintf(n.f, " depth = %d\n", depth)
+	}
+	if hasNotParallel(n.nodes, make(map[*DepNode]bool)) {
+		fmt.Fprintf(n.f, "pool %s\n", notParallelPool)
+		fmt.Fprintf(n.f, " depth = 1\n")
+	}
+	return nil
+}
+
+func hasNotParallel(nodes []*DepNode, seen map[*DepNode]bool) bool {
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		if node.NotParallel || hasNotParallel(node.Deps, seen) || hasNotParallel(node.OrderOnlys, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeVar evaluates the variable name for node, with its target
+// specific variables. It also reports whether the variable is defined.
+// Automatic variables are of node after createRunners.
+func (n *NinjaGenerator) nodeVar(node *DepNode, name string) (string, bool, error) {
+	ev := n.ctx.ev
+	saved := ev.currentScope
+	ev.currentScope = node.TargetSpecificVars
+	defer func() { ev.currentScope = saved }()
+	if !ev.LookupVar(name).IsDefined() {
+		return "", false, nil
+	}
+	s, err := ev.EvaluateVar(name)
+	return s, true, err
+}
+
+// depfileOnlyInputs returns inputs of node declared only in depfile,
+// e.g. header dependencies of the previous build included by
+// "-include foo.d". ninja reads them from the depfile instead.
+func depfileOnlyInputs(node *DepNode, depfile string) map[string]bool {
+	if depfile == "" || node.inputFiles == nil {
+		return nil
+	}
+	depfile = filepath.Clean(depfile)
+	r := make(map[string]bool)
+	others := make(map[string]bool)
+	for _, ri := range node.inputFiles {
+		m := others
+		if filepath.Clean(ri.filename) == depfile {
+			m = r
+		}
+		for _, input := range ri.inputs {
+			m[input] = true
+		}
+	}
+	for input := range others {
+		delete(r, input)
+	}
+	return r
+}
+
+// pool returns the pool of node, by .KATI_NINJA_POOL or .NOTPARALLEL.
+func (n *NinjaGenerator) pool(node *DepNode) (string, error) {
+	pool, _, err := n.nodeVar(node, ninjaPoolVar)
+	if err != nil {
+		return "", err
+	}
+	pool = strings.TrimSpace(pool)
+	if pool == "" {
+		if node.NotParallel {
+			return notParallelPool, nil
+		}
+		return "", nil
+	}
+	if !n.pools[pool] {
+		return "", fmt.Errorf("%s:%d: *** pool %q of %s is not declared in %s.", node.Filename, node.Lineno, pool, node.Output, ninjaPoolsVar)
+	}
+	return pool, nil
+}
+
+func (n *NinjaGenerator) rspfileThreshold(shell string) int {
+	if n.RspfileThreshold > 0 {
+		return n.RspfileThreshold
+	}
+	return shellArgLimit(shell)
+}
+
 func (n *NinjaGenerator) shName(suffix string) string {
+	if isCmdShell(n.ctx.shell) {
+		return fmt.Sprintf("ninja%s.cmd", suffix)
+	}
 	return fmt.Sprintf("ninja%s.sh", suffix)
 }
 
@@ -467,12 +893,15 @@ func (n *NinjaGenerator) generateShell(suffix string) (err error) {
 		}
 	}()
 
+	if isCmdShell(n.ctx.shell) {
+		return n.generateCmdShell(f, suffix)
+	}
 	fmt.Fprintf(f, "#!%s\n", n.ctx.shell)
 	fmt.Fprintf(f, "# Generated by kati %s\n", gitVersion)
 	fmt.Fprintln(f)
 	fmt.Fprintln(f, `cd $(dirname "$0")`)
-	for name, export := range n.exports {
-		if export {
+	for _, name := range n.exportNames() {
+		if n.exports[name] {
 			v, err := n.ctx.ev.EvaluateVar(name)
 			if err != nil {
 				return err
@@ -482,17 +911,85 @@ func (n *NinjaGenerator) generateShell(suffix string) (err error) {
 			fmt.Fprintf(f, "unset %s\n", name)
 		}
 	}
-	if n.GomaDir == "" {
-		fmt.Fprintf(f, `exec ninja -f %s "$@"`+"\n", n.ninjaName(suffix))
-	} else {
-		fmt.Fprintf(f, `exec ninja -f %s -j500 "$@"`+"\n", n.ninjaName(suffix))
-	}
+	fmt.Fprintf(f, `exec ninja -f %s%s "$@"`+"\n", n.ninjaName(suffix), n.ninjaArgs())
 
 	return f.Chmod(0755)
 }
 
+// usedEnvNames returns sorted names of environment variables used by
+// g, including exported ones which ninja.sh sets.
+func usedEnvNames(g *DepGraph) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range g.usedEnvs {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name, export := range g.exports {
+		if !export || seen[name] {
+			continue
+		}
+		if v, ok := g.vars[name]; ok && strings.HasPrefix(v.Origin(), "environment") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exportNames returns sorted names of exported or unexported
+// variables.
+func (n *NinjaGenerator) exportNames() []string {
+	names := make([]string, 0, len(n.exports))
+	for name := range n.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// generateCmdShell writes a batch file for cmd.exe to run ninja.
+func (n *NinjaGenerator) generateCmdShell(f *os.File, suffix string) error {
+	fmt.Fprintf(f, "@echo off\r\n")
+	fmt.Fprintf(f, "rem Generated by kati %s\r\n", gitVersion)
+	fmt.Fprintf(f, "\r\n")
+	fmt.Fprintf(f, "setlocal\r\n")
+	fmt.Fprintf(f, "cd /d \"%%~dp0\"\r\n")
+	for _, name := range n.exportNames() {
+		if n.exports[name] {
+			v, err := n.ctx.ev.EvaluateVar(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(f, "set \"%s=%s\"\r\n", name, v)
+		} else {
+			fmt.Fprintf(f, "set %s=\r\n", name)
+		}
+	}
+	fmt.Fprintf(f, "ninja -f %s%s %%*\r\n", n.ninjaName(suffix), n.ninjaArgs())
+	return nil
+}
+
+// ninjaArgs returns options of ninja in the wrapper script, which
+// precede its arguments so they can override them.
+func (n *NinjaGenerator) ninjaArgs() string {
+	var args string
+	if n.GomaDir != "" {
+		args += " -j500"
+	}
+	if KeepGoingFlag {
+		// keep going until any number of jobs fail, as -k of make.
+		args += " -k 0"
+	}
+	return args
+}
+
 func (n *NinjaGenerator) generateNinja(suffix, defaultTarget string) (err error) {
-	f, err := os.Create(n.ninjaName(suffix))
+	filename := n.ninjaName(suffix)
+	if n.state != nil {
+		filename += ".tmp"
+	}
+	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
@@ -501,20 +998,24 @@ func (n *NinjaGenerator) generateNinja(suffix, defaultTarget string) (err error)
 		if err == nil {
 			err = cerr
 		}
+		if n.state == nil {
+			return
+		}
+		if err == nil {
+			err = replaceIfChanged(filename, n.ninjaName(suffix))
+		}
+		if err != nil {
+			os.Remove(filename)
+		}
 	}()
 
 	n.f = f
 	fmt.Fprintf(n.f, "# Generated by kati %s\n", gitVersion)
 	fmt.Fprintf(n.f, "\n")
 
-	if len(usedEnvs) > 0 {
+	if len(n.usedEnvs) > 0 {
 		fmt.Fprintln(n.f, "# Environment variables used:")
-		var names []string
-		for name := range usedEnvs {
-			names = append(names, name)
-		}
-		sort.Strings(names)
-		for _, name := range names {
+		for _, name := range n.usedEnvs {
 			v, err := n.ctx.ev.EvaluateVar(name)
 			if err != nil {
 				return err
@@ -528,6 +1029,10 @@ func (n *NinjaGenerator) generateNinja(suffix, defaultTarget string) (err error)
 		fmt.Fprintf(n.f, "pool local_pool\n")
 		fmt.Fprintf(n.f, " depth = %d\n", runtime.NumCPU())
 	}
+	err = n.emitPools()
+	if err != nil {
+		return err
+	}
 
 	// defining $out for $@ and $in for $^ here doesn't work well,
 	// because these texts will be processed in escapeShell...
@@ -564,10 +1069,20 @@ func (n *NinjaGenerator) generateNinja(suffix, defaultTarget string) (err error)
 }
 
 // Save generates build.ninja from DepGraph.
-func (n *NinjaGenerator) Save(g *DepGraph, suffix string, targets []string) error {
+func (n *NinjaGenerator) Save(g *DepGraph, suffix string, targets []string) (err error) {
+	defer recoverPanic(nil, &err)
 	startTime := time.Now()
+	tid := n.tid
+	if tid == 0 {
+		tid = traceEventMain
+	}
+	te := traceEvent.begin("ninja", literal("build"+suffix+".ninja"), tid)
+	defer traceEvent.end(te)
 	n.init(g)
-	err := n.generateShell(suffix)
+	if n.Incremental {
+		n.initState(suffix)
+	}
+	err = n.generateShell(suffix)
 	if err != nil {
 		return err
 	}
@@ -579,6 +1094,23 @@ func (n *NinjaGenerator) Save(g *DepGraph, suffix string, targets []string) erro
 	if err != nil {
 		return err
 	}
+	if n.state != nil {
+		err = n.saveState(suffix)
+		if err != nil {
+			return err
+		}
+	}
+	if n.KatiStamp {
+		stamp, err := NewKatiStamp(g, os.Environ())
+		if err != nil {
+			return err
+		}
+		stamp.Args = stampArgs()
+		err = stamp.Save(KatiStampFilename(suffix))
+		if err != nil {
+			return err
+		}
+	}
 	logStats("generate ninja time: %q", time.Since(startTime))
 	return nil
 }
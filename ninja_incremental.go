@@ -0,0 +1,259 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Incremental generation of ninja files.
+//
+// Most of the time to generate build.ninja is spent to evaluate
+// commands of rules. If NinjaGenerator.Incremental is set, the build
+// statement of each node is saved into a state file with what it was
+// generated from: the node in the dependency graph, and the variables
+// looked up while its commands were evaluated. The next generation
+// reuses a statement if neither of them changed, and evaluates commands
+// of changed nodes only. Commands which depend on other than variables,
+// e.g. by $(shell) or $(wildcard), are evaluated every time.
+//
+// The ninja file is written only if its content is changed, so ninja
+// doesn't need to reload an unchanged build.ninja.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const ninjaStateFileVersion = 1
+
+// ninjaVarDep is a variable looked up to generate a build statement.
+type ninjaVarDep struct {
+	Name   string
+	Flavor string
+	Origin string
+	Value  string
+}
+
+type ninjaStateEntry struct {
+	Node [sha1.Size]byte // fingerprint of the node.
+	Vars []ninjaVarDep
+	Stmt ninjaStmt
+}
+
+type ninjaStateFile struct {
+	Version int
+	Config  [sha1.Size]byte // fingerprint of the generator.
+	Entries map[string]*ninjaStateEntry
+}
+
+// ninjaState is the state of incremental generation.
+type ninjaState struct {
+	config [sha1.Size]byte
+	prev   map[string]*ninjaStateEntry
+	next   map[string]*ninjaStateEntry
+
+	reused, generated int
+}
+
+func (n *NinjaGenerator) stateName(suffix string) string {
+	return fmt.Sprintf(".kati_ninja%s.state", suffix)
+}
+
+// configFingerprint returns the fingerprint of options of the
+// generator, which affect every build statement.
+func (n *NinjaGenerator) configFingerprint() [sha1.Size]byte {
+	h := sha1.New()
+	for _, s := range []string{
+		gitVersion,
+		n.GomaDir,
+		strconv.FormatBool(n.DetectAndroidEcho),
+		strconv.Itoa(n.rspfileThreshold(n.ctx.shell)),
+		n.ctx.shell,
+		n.ctx.shellFlags,
+	} {
+		fmt.Fprintf(h, "%q\n", s)
+	}
+	var r [sha1.Size]byte
+	copy(r[:], h.Sum(nil))
+	return r
+}
+
+// nodeFingerprint returns the fingerprint of node in the dependency
+// graph, except its target specific variables, which are checked as
+// other variables.
+func nodeFingerprint(node *DepNode) [sha1.Size]byte {
+	h := sha1.New()
+	fmt.Fprintf(h, "%q %q %q %q\n", node.Output, node.Cmds, node.ActualInputs, node.Stem)
+	for _, d := range node.Deps {
+		fmt.Fprintf(h, "dep %q\n", d.Output)
+	}
+	for _, d := range node.OrderOnlys {
+		fmt.Fprintf(h, "orderonly %q\n", d.Output)
+	}
+	for _, ri := range node.inputFiles {
+		fmt.Fprintf(h, "inputs %q %q\n", ri.filename, ri.inputs)
+	}
+	fmt.Fprintf(h, "%t %t %t %q %d %q\n", node.IsPhony, node.NotParallel, node.OneShell, node.Filename, node.Lineno, node.GroupOutputs)
+	var r [sha1.Size]byte
+	copy(r[:], h.Sum(nil))
+	return r
+}
+
+// initState loads the state file of the previous generation.
+func (n *NinjaGenerator) initState(suffix string) {
+	if n.ctx.ev.expandCache == nil {
+		// expandCache tracks variables looked up.
+		n.ctx.ev.expandCache = newExpandCache()
+	}
+	n.state = &ninjaState{
+		config: n.configFingerprint(),
+		prev:   make(map[string]*ninjaStateEntry),
+		next:   make(map[string]*ninjaStateEntry),
+	}
+	sf, err := loadNinjaStateFile(n.stateName(suffix))
+	if err != nil {
+		glog.Infof("ninja state file %s: %v", n.stateName(suffix), err)
+		return
+	}
+	if sf.Config != n.state.config {
+		glog.Infof("ninja state file %s: different config", n.stateName(suffix))
+		return
+	}
+	n.state.prev = sf.Entries
+}
+
+// validVars reports whether variables in vars are not changed for node.
+func (n *NinjaGenerator) validVars(node *DepNode, vars []ninjaVarDep) bool {
+	ev := n.ctx.ev
+	saved := ev.currentScope
+	ev.currentScope = node.TargetSpecificVars
+	defer func() { ev.currentScope = saved }()
+	for _, d := range vars {
+		v := ev.lookupVar(d.Name)
+		if v.Flavor() != d.Flavor || v.Origin() != d.Origin || v.String() != d.Value {
+			glog.V(1).Infof("ninja %s: %s changed", node.Output, d.Name)
+			return false
+		}
+	}
+	return true
+}
+
+// incrementalStmt returns the build statement of node in the previous
+// generation if it is still valid, or generates it.
+func (n *NinjaGenerator) incrementalStmt(node *DepNode) (*ninjaStmt, error) {
+	fp := nodeFingerprint(node)
+	if e, ok := n.state.prev[node.Output]; ok && e.Node == fp && (e.Stmt.Pool == "" || n.pools[e.Stmt.Pool]) && n.validVars(node, e.Vars) {
+		n.state.reused++
+		n.state.next[node.Output] = e
+		return &e.Stmt, nil
+	}
+	var stmt *ninjaStmt
+	t, err := n.ctx.ev.expandCache.trackLookups(func() error {
+		var err error
+		stmt, err = n.genStmt(node, "$out")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.state.generated++
+	if t.impure {
+		glog.V(1).Infof("ninja %s: not cacheable", node.Output)
+		return stmt, nil
+	}
+	e := &ninjaStateEntry{Node: fp, Stmt: *stmt}
+	for _, d := range t.deps {
+		e.Vars = append(e.Vars, ninjaVarDep{
+			Name:   d.name,
+			Flavor: d.v.Flavor(),
+			Origin: d.v.Origin(),
+			Value:  d.v.String(),
+		})
+	}
+	n.state.next[node.Output] = e
+	return stmt, nil
+}
+
+// saveState saves the state file for the next generation.
+func (n *NinjaGenerator) saveState(suffix string) error {
+	logStats("ninja incremental: %d reused, %d generated", n.state.reused, n.state.generated)
+	return saveNinjaStateFile(n.stateName(suffix), ninjaStateFile{
+		Config:  n.state.config,
+		Entries: n.state.next,
+	})
+}
+
+func saveNinjaStateFile(filename string, sf ninjaStateFile) error {
+	startTime := time.Now()
+	sf.Version = ninjaStateFileVersion
+	tmpfile := filename + ".tmp"
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(sf)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	logStats("ninja state save time: %q", time.Since(startTime))
+	return nil
+}
+
+func loadNinjaStateFile(filename string) (ninjaStateFile, error) {
+	var sf ninjaStateFile
+	f, err := os.Open(filename)
+	if err != nil {
+		return sf, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&sf)
+	if err != nil {
+		return sf, err
+	}
+	if sf.Version != ninjaStateFileVersion {
+		return sf, fmt.Errorf("version mismatch: %d", sf.Version)
+	}
+	if sf.Entries == nil {
+		sf.Entries = make(map[string]*ninjaStateEntry)
+	}
+	return sf, nil
+}
+
+// replaceIfChanged renames tmpfile to filename if their contents
+// differ, or removes tmpfile, to keep the timestamp of filename.
+func replaceIfChanged(tmpfile, filename string) error {
+	b, err := ioutil.ReadFile(tmpfile)
+	if err != nil {
+		return err
+	}
+	if ob, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(b, ob) {
+		glog.Infof("%s is not changed", filename)
+		return os.Remove(tmpfile)
+	}
+	return os.Rename(tmpfile, filename)
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNinjaIncremental(t *testing.T) {
+	chdirTestMakefile(t, "")
+
+	past := time.Now().Add(-time.Hour)
+	for i, tc := range []struct {
+		mk                string
+		reused, generated int
+		changed           bool
+	}{
+		{
+			mk: `
+CFLAGS := -O2
+LIBS = $(LIB)
+LIB := -lm
+all: a b c
+a: ; cc $(CFLAGS) -o $@ a.c
+b: ; cc -o $@ b.c $(LIBS)
+c: ; echo $(shell echo c) > $@
+`,
+			generated: 4,
+			changed:   true,
+		},
+		{
+			mk: `
+CFLAGS := -O2
+LIBS = $(LIB)
+LIB := -lm
+all: a b c
+a: ; cc $(CFLAGS) -o $@ a.c
+b: ; cc -o $@ b.c $(LIBS)
+c: ; echo $(shell echo c) > $@
+`,
+			// c runs $(shell).
+			reused:    3,
+			generated: 1,
+		},
+		{
+			mk: `
+CFLAGS := -O0
+LIBS = $(LIB)
+LIB := -lz
+all: a b c
+a: ; cc $(CFLAGS) -o $@ a.c
+b: ; cc -o $@ b.c $(LIBS)
+c: ; echo $(shell echo c) > $@
+`,
+			reused:    1,
+			generated: 3,
+			changed:   true,
+		},
+		{
+			mk: `
+CFLAGS := -O0
+LIBS = $(LIB)
+LIB := -lz
+all: a b c
+a: ; cc $(CFLAGS) -o $@ a.c
+b: ; cc -o $@ b.c $(LIBS)
+b: LIB := -lm
+c: ; echo $(shell echo c) > $@
+`,
+			reused:    2,
+			generated: 2,
+			changed:   true,
+		},
+	} {
+		err := ioutil.WriteFile("Makefile", []byte(tc.mk), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := Load(LoadReq{Makefile: "Makefile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want NinjaGenerator
+		err = want.Save(g, "_want", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			err = os.Chtimes("build.ninja", past, past)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		n := NinjaGenerator{Incremental: true}
+		err = n.Save(g, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.state.reused != tc.reused || n.state.generated != tc.generated {
+			t.Errorf("%d: reused=%d generated=%d; want reused=%d generated=%d", i, n.state.reused, n.state.generated, tc.reused, tc.generated)
+		}
+		got, err := ioutil.ReadFile("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantNinja, err := ioutil.ReadFile("build_want.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(wantNinja) {
+			t.Errorf("%d: build.ninja:\n%s\nwant:\n%s", i, got, wantNinja)
+		}
+		fi, err := os.Stat("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := !fi.ModTime().Equal(past); changed != tc.changed {
+			t.Errorf("%d: build.ninja changed=%t; want %t", i, changed, tc.changed)
+		}
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "-O0") {
+		t.Errorf("build.ninja doesn't have -O0:\n%s", b)
+	}
+}
@@ -14,7 +14,16 @@
 
 package kati
 
-import "testing"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestStripShellComment(t *testing.T) {
 	for _, tc := range []struct {
@@ -200,3 +209,415 @@ func TestGomaCmdForAndroidCompileCmd(t *testing.T) {
 		}
 	}
 }
+
+func TestNinjaPools(t *testing.T) {
+	chdirTestMakefile(t, `
+.KATI_NINJA_POOLS := highmem:2
+.PHONY: all
+all: app lib
+app: a.o
+	link $^ -o $@
+app: .KATI_NINJA_POOL := highmem
+lib: c.o
+	ar $@ $^
+%.o:
+	cc -c $@
+.NOTPARALLEL: lib
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n NinjaGenerator
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		"pool highmem\n depth = 2\n",
+		"pool kati_notparallel\n depth = 1\n",
+		"build app: rule0 a.o\n pool = highmem\n",
+		// target specific variables are inherited by prerequisites.
+		"build a.o: rule1\n pool = highmem\n",
+		"build lib: rule2 c.o\n\n",
+		"build c.o: rule3\n pool = kati_notparallel\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't have %q:\n%s", want, ninja)
+		}
+	}
+
+	err = ioutil.WriteFile("Makefile", []byte("all: ; echo\nall: .KATI_NINJA_POOL := unknown\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Save(g, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Save with undeclared pool: %v; want error", err)
+	}
+}
+
+func TestNinjaDepfile(t *testing.T) {
+	chdirTestMakefile(t, `
+all: foo.o bar.o
+foo.o: foo.c
+	cc -c foo.c -o $@
+foo.o: .KATI_DEPFILE = $(@:.o=.d)
+bar.o: bar.c
+	cc -MD -MF bar.d -c bar.c -o $@
+bar.o: .KATI_DEPFILE :=
+-include foo.d
+`)
+	err := ioutil.WriteFile("foo.d", []byte("foo.o: foo.c foo.h\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n NinjaGenerator
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		" depfile = foo.d\n deps = gcc\n",
+		` command = /bin/sh -c "cc -c $in -o $out"` + "\n",
+		// foo.h is only in foo.d.
+		"build foo.o: rule0 foo.c\n",
+		"build bar.o: rule1 bar.c\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't have %q:\n%s", want, ninja)
+		}
+	}
+	for _, notWant := range []string{"depfile = bar.d", "foo.h"} {
+		if strings.Contains(ninja, notWant) {
+			t.Errorf("build.ninja has %q:\n%s", notWant, ninja)
+		}
+	}
+}
+
+func TestNinjaTargetSpecificShell(t *testing.T) {
+	chdirTestMakefile(t, `
+SHELL := /bin/bash
+.SHELLFLAGS := -ec
+all: foo bar
+foo: SHELL := /bin/sh
+foo: .SHELLFLAGS := -c
+foo: baz
+	echo 1
+bar:
+	echo 2
+baz:
+	echo 3
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NinjaGenerator{RspfileThreshold: 1 << 20}
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		` command = /bin/sh -c "echo 1"` + "\n",
+		// prerequisites inherit target specific variables.
+		` command = /bin/sh -c "echo 3"` + "\n",
+		` command = /bin/bash -ec "echo 2"` + "\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't have %q:\n%s", want, ninja)
+		}
+	}
+}
+
+func TestNinjaOneShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	chdirTestMakefile(t, `
+.ONESHELL:
+all:
+	-@x='a b'
+	-if [ -n "$$x" ]; then
+	@  echo "$$x" \
+	    c
+	fi # comment
+	false
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n NinjaGenerator
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var command string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, " command = ") {
+			command = strings.TrimPrefix(line, " command = ")
+		}
+	}
+	if !strings.HasSuffix(command, " ; true\"") {
+		t.Errorf("command=%q; want to ignore errors", command)
+	}
+	out, err := exec.Command("/bin/sh", "-c", strings.Replace(command, "$$", "$", -1)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", command, err, out)
+	}
+	if got, want := string(out), "a b c\n"; got != want {
+		t.Errorf("%s: output=%q; want %q", command, got, want)
+	}
+}
+
+func TestNinjaDoubleColon(t *testing.T) {
+	chdirTestMakefile(t, `
+t:: a
+	echo 1 $@ $^
+t:: b
+	echo 2 $@ $^
+t::
+	echo 3 $@
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n NinjaGenerator
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		` command = /bin/sh -c "echo 1 t $in"` + "\n",
+		"build t$:$:1: rule0 a\n",
+		"build t$:$:2: rule1 b\n",
+		"build t$:$:3: rule2\n",
+		"build t: phony t$:$:1 t$:$:2 t$:$:3\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't have %q:\n%s", want, ninja)
+		}
+	}
+}
+
+func TestNinjaGroupedTargets(t *testing.T) {
+	chdirTestMakefile(t, `
+all: b a c
+a b c &: in
+	gen $@ $^
+in:
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n NinjaGenerator
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		// $@ is the output which the statement is generated for.
+		` command = /bin/sh -c "gen b $in"` + "\n",
+		"build b a c: rule0 in\n",
+		"build all: phony b a c\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't have %q:\n%s", want, ninja)
+		}
+	}
+	if got := strings.Count(ninja, "rule0"); got != 2 {
+		t.Errorf("rule0 is used %d times; want once:\n%s", got-1, ninja)
+	}
+}
+
+func TestNinjaWait(t *testing.T) {
+	chdirTestMakefile(t, `
+all: a b .WAIT c d
+a b c d:
+	gen $@
+a: d
+`)
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n NinjaGenerator
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		"build all: phony a b c d\n",
+		"build a: rule0 d\n",
+		// a depends on d, so d doesn't wait for a.
+		"build d: rule1 || b\n",
+		"build b: rule2\n",
+		"build c: rule3 || a b\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't have %q:\n%s", want, ninja)
+		}
+	}
+	if strings.Contains(ninja, ".WAIT") {
+		t.Errorf("build.ninja has .WAIT:\n%s", ninja)
+	}
+}
+
+func TestNinjaDeterministic(t *testing.T) {
+	chdirTestMakefile(t, `
+export E D C B A
+unexport Z
+ifeq ($(PRODUCT),p0)
+X := $(FOO)
+else
+X := $(BAR)
+endif
+all:
+	echo $(X)
+`)
+
+	env := []string{"FOO=foo", "BAR=bar", "A=a", "B=b", "C=c", "D=d", "E=e"}
+	var reqs []LoadReq
+	for _, p := range []string{"p0", "p1"} {
+		reqs = append(reqs, LoadReq{
+			Makefile:        "Makefile",
+			CommandLineVars: []string{"PRODUCT=" + p},
+			EnvironmentVars: env,
+		})
+	}
+	graphs, err := LoadAll(reqs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		ninja string
+		sh    string
+	}{
+		{
+			ninja: "# Environment variables used:\n# A=a\n# B=b\n# C=c\n# D=d\n# E=e\n# FOO=foo\n\n",
+			sh:    "export A=\"a\"\nexport B=\"b\"\nexport C=\"c\"\nexport D=\"d\"\nexport E=\"e\"\nunset Z\n",
+		},
+		{
+			ninja: "# Environment variables used:\n# A=a\n# B=b\n# BAR=bar\n# C=c\n# D=d\n# E=e\n\n",
+			sh:    "export A=\"a\"\nexport B=\"b\"\nexport C=\"c\"\nexport D=\"d\"\nexport E=\"e\"\nunset Z\n",
+		},
+	} {
+		var n NinjaGenerator
+		suffix := fmt.Sprintf("-%d", i)
+		err = n.Save(graphs[i], suffix, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for fn, want := range map[string]string{
+			"build" + suffix + ".ninja": tc.ninja,
+			"ninja" + suffix + ".sh":    tc.sh,
+		} {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), want) {
+				t.Errorf("%s doesn't have %q:\n%s", fn, want, b)
+			}
+		}
+	}
+}
+
+func TestNinjaFileFunc(t *testing.T) {
+	chdirTestMakefile(t, `
+app: a.o
+	$(file >$@.rsp,$^)$(file >>$@.rsp,-lm)ld @$@.rsp -o $@
+a.o:
+	cc -c a.c
+`)
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 2; i++ {
+		g, err := Load(LoadReq{Makefile: "Makefile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n NinjaGenerator
+		err = n.Save(g, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "build app: rule0 a.o | app.rsp\n"; !strings.Contains(string(b), want) {
+			t.Errorf("build.ninja doesn't have %q:\n%s", want, b)
+		}
+		b, err = ioutil.ReadFile("app.rsp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "a.o\n-lm\n"; got != want {
+			t.Errorf("app.rsp=%q; want %q", got, want)
+		}
+		fi, err := os.Stat("app.rsp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && !fi.ModTime().Equal(past) {
+			t.Errorf("app.rsp is written again: %v", fi.ModTime())
+		}
+		err = os.Chtimes("app.rsp", past, past)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Modes of --output-sync.
+const (
+	// OutputSyncNone writes output of commands as soon as they finish.
+	OutputSyncNone = "none"
+	// OutputSyncLine writes each command line with its output at once.
+	OutputSyncLine = "line"
+	// OutputSyncTarget writes output of the whole recipe of a target
+	// at once. Recursive makes sync their own output.
+	OutputSyncTarget = "target"
+	// OutputSyncRecurse is OutputSyncTarget, but output of recursive
+	// makes is also grouped with the target.
+	OutputSyncRecurse = "recurse"
+)
+
+func validOutputSync(mode string) error {
+	switch mode {
+	case "", OutputSyncNone, OutputSyncLine, OutputSyncTarget, OutputSyncRecurse:
+		return nil
+	}
+	return fmt.Errorf("unknown output-sync type %q", mode)
+}
+
+// outputSyncer serializes output of jobs running in parallel.
+type outputSyncer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	mode string
+}
+
+func newOutputSyncer(w io.Writer, mode string) *outputSyncer {
+	if mode == "" {
+		mode = OutputSyncNone
+	}
+	return &outputSyncer{w: w, mode: mode}
+}
+
+func (s *outputSyncer) write(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(b)
+}
+
+// buffered reports whether output of a target is buffered until
+// its recipe finishes.
+func (s *outputSyncer) buffered() bool {
+	return s.mode == OutputSyncTarget || s.mode == OutputSyncRecurse
+}
+
+// streams reports whether a recursive command writes its output
+// directly, so recursive makes can sync their own output.
+func (s *outputSyncer) streams(recursive bool) bool {
+	return recursive && s.mode != OutputSyncNone && s.mode != OutputSyncRecurse
+}
+
+// makeflags returns MAKEFLAGS for a recursive command to sync its
+// own output.
+func (s *outputSyncer) makeflags(makeflags string, recursive bool) string {
+	if !s.streams(recursive) {
+		return makeflags
+	}
+	var words, rest []string
+	all := splitSpaces(makeflags)
+	for i, w := range all {
+		if w == "--" {
+			rest = all[i:]
+			break
+		}
+		if strings.HasPrefix(w, "--output-sync") || strings.HasPrefix(w, "-O") {
+			continue
+		}
+		words = append(words, w)
+	}
+	words = append(words, "--output-sync="+s.mode)
+	return strings.Join(append(words, rest...), " ")
+}
+
+// OutputSyncMakeflag returns the mode of --output-sync in makeflags,
+// or "" if not set.
+func OutputSyncMakeflag(makeflags string) string {
+	var mode string
+	for _, w := range splitSpaces(makeflags) {
+		if w == "--" {
+			break
+		}
+		switch {
+		case strings.HasPrefix(w, "--output-sync="):
+			mode = w[len("--output-sync="):]
+		case w == "--output-sync" || w == "-O":
+			mode = OutputSyncTarget
+		case strings.HasPrefix(w, "-O"):
+			mode = w[len("-O"):]
+		}
+	}
+	return mode
+}
+
+// jobOutput is output of a job. It is written to the outputSyncer
+// by each write, or at flush for buffered modes.
+type jobOutput struct {
+	s   *outputSyncer
+	buf bytes.Buffer
+}
+
+func (s *outputSyncer) newJobOutput() *jobOutput {
+	return &jobOutput{s: s}
+}
+
+func (o *jobOutput) Write(b []byte) (int, error) {
+	if o.s.buffered() {
+		return o.buf.Write(b)
+	}
+	o.s.write(b)
+	return len(b), nil
+}
+
+func (o *jobOutput) flush() {
+	o.s.write(o.buf.Bytes())
+	o.buf.Reset()
+}
+
+// stdout returns a writer for a command writing its output directly.
+func (o *jobOutput) stdout() io.Writer {
+	o.flush()
+	return o.s.w
+}
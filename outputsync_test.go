@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOutputSyncMakeflag(t *testing.T) {
+	for _, tc := range []struct {
+		makeflags string
+		want      string
+	}{
+		{makeflags: "", want: ""},
+		{makeflags: "n", want: ""},
+		{makeflags: "n -O", want: OutputSyncTarget},
+		{makeflags: "-Oline", want: OutputSyncLine},
+		{makeflags: "n --output-sync=recurse", want: OutputSyncRecurse},
+		{makeflags: "n -- --output-sync=line", want: ""},
+	} {
+		if got := OutputSyncMakeflag(tc.makeflags); got != tc.want {
+			t.Errorf("OutputSyncMakeflag(%q)=%q; want %q", tc.makeflags, got, tc.want)
+		}
+	}
+}
+
+func TestOutputSyncerMakeflags(t *testing.T) {
+	for _, tc := range []struct {
+		mode      string
+		makeflags string
+		recursive bool
+		want      string
+	}{
+		{mode: OutputSyncTarget, makeflags: "n", want: "n"},
+		{mode: OutputSyncTarget, makeflags: "n -Oline -- X=1", recursive: true, want: "n --output-sync=target -- X=1"},
+		{mode: OutputSyncLine, makeflags: "", recursive: true, want: "--output-sync=line"},
+		{mode: OutputSyncRecurse, makeflags: "n", recursive: true, want: "n"},
+		{mode: OutputSyncNone, makeflags: "n", recursive: true, want: "n"},
+	} {
+		s := newOutputSyncer(nil, tc.mode)
+		if got := s.makeflags(tc.makeflags, tc.recursive); got != tc.want {
+			t.Errorf("%s: makeflags(%q, %t)=%q; want %q", tc.mode, tc.makeflags, tc.recursive, got, tc.want)
+		}
+	}
+}
+
+func TestJobOutput(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want string
+	}{
+		{mode: OutputSyncNone, want: "a1\nb1\na2\nb2\n"},
+		{mode: OutputSyncLine, want: "a1\nb1\na2\nb2\n"},
+		{mode: OutputSyncTarget, want: "b1\nb2\na1\na2\n"},
+		{mode: OutputSyncRecurse, want: "b1\nb2\na1\na2\n"},
+	} {
+		var buf bytes.Buffer
+		s := newOutputSyncer(&buf, tc.mode)
+		a := s.newJobOutput()
+		b := s.newJobOutput()
+		a.Write([]byte("a1\n"))
+		b.Write([]byte("b1\n"))
+		a.Write([]byte("a2\n"))
+		b.Write([]byte("b2\n"))
+		b.flush()
+		a.flush()
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: output=%q; want %q", tc.mode, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Parallel evaluation of included makefiles.
+//
+// When an include directive has several files, e.g.
+//
+//	include $(subdir_makefiles)
+//
+// each file is evaluated by an isolated child evaluator on a worker
+// goroutine. A child writes variables and rules only into its own
+// state, and looks up the parent evaluator (which is not modified while
+// children run) for variables it doesn't have. It records the
+// variables it read from the parent.
+//
+// Then children are merged into the parent in include order. A child
+// is merged only if every variable it read still has the same value in
+// the parent, i.e. earlier files didn't modify it, so the result is the
+// same as sequential evaluation. Otherwise, or if the child did
+// something which can't be isolated (running $(shell), printing
+// messages, export, vpath, or appending to a variable of the parent),
+// the file is evaluated again sequentially in the parent.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+var errNotIsolated = errors.New("not isolated")
+
+// isolatedRead is a variable read from the parent evaluator.
+type isolatedRead struct {
+	v Var
+	s string // v.String() at read time.
+}
+
+// isolation tracks an isolated child evaluator.
+type isolation struct {
+	reads map[string]isolatedRead
+	// makefileList is MAKEFILE_LIST of the child, initialized by
+	// MAKEFILE_LIST of the parent.
+	makefileList *simpleVar
+	nparent      int // len(makefileList.value) when created.
+	// violated is the reason why the child is not isolated.
+	violated string
+}
+
+func (iso *isolation) read(name string, v Var) {
+	if _, ok := iso.reads[name]; ok {
+		return
+	}
+	iso.reads[name] = isolatedRead{v: v, s: v.String()}
+}
+
+func (iso *isolation) violate(pos srcpos, format string, args ...interface{}) error {
+	if iso.violated == "" {
+		iso.violated = fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, args...))
+	}
+	return errNotIsolated
+}
+
+// checkIsolated returns errNotIsolated if ev is an isolated child
+// evaluator, for operations which have side effects outside of ev.
+func (ev *Evaluator) checkIsolated(format string, args ...interface{}) error {
+	if ev.isolation == nil {
+		return nil
+	}
+	return ev.isolation.violate(ev.srcpos, format, args...)
+}
+
+// checkAppend checks prev of the variable name can be modified in place
+// by Append. It must not be owned by the parent evaluator.
+func (ev *Evaluator) checkAppend(name string, prev Var) error {
+	if ev.isolation == nil || !prev.IsDefined() {
+		return nil
+	}
+	if r, ok := ev.isolation.reads[name]; ok && r.v == prev {
+		return ev.isolation.violate(ev.srcpos, "append to %s of parent", name)
+	}
+	return nil
+}
+
+// checkOverride checks the assignment of v to the variable name doesn't
+// hide a variable of the parent evaluator which has higher precedence,
+// e.g. by override, and ignores the assignment in sequential evaluation.
+func (ev *Evaluator) checkOverride(name string, v Var) error {
+	if ev.isolation == nil {
+		return nil
+	}
+	if _, ok := ev.outVars[name]; ok {
+		return nil
+	}
+	prev := ev.parent.lookupVar(name)
+	if originPrecedence[prev.Origin()] > originPrecedence[v.Origin()] {
+		return ev.isolation.violate(ev.srcpos, "assignment to %s overridden by %s", name, prev.Origin())
+	}
+	return nil
+}
+
+// lookupParentVar looks up the variable in the parent evaluator.
+func (ev *Evaluator) lookupParentVar(name string) Var {
+	v := ev.parent.lookupVar(name)
+	ev.isolation.read(name, v)
+	return v
+}
+
+// isolatedMakefile reports whether mk has no statements which can't be
+// evaluated in an isolated evaluator. It is a quick check to avoid
+// evaluating mk twice; the child evaluator checks isolation while
+// evaluating, e.g. for included makefiles or expanded variables.
+func isolatedMakefile(mk makefile) bool {
+	return isolatedStmts(mk.stmts)
+}
+
+func isolatedStmts(stmts []ast) bool {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *exportAST, *vpathAST, *loadAST:
+			return false
+		case *assignAST:
+			if hasSideEffectFunc(s.lhs) || hasSideEffectFunc(s.rhs) {
+				return false
+			}
+		case *maybeRuleAST:
+			if hasSideEffectFunc(s.expr) {
+				return false
+			}
+		case *ifAST:
+			if hasSideEffectFunc(s.lhs) || (s.rhs != nil && hasSideEffectFunc(s.rhs)) {
+				return false
+			}
+			if !isolatedStmts(s.trueStmts) || !isolatedStmts(s.falseStmts) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasSideEffectFunc reports whether v calls a function with side
+// effects when it is expanded.
+func hasSideEffectFunc(v Value) bool {
+	switch v := v.(type) {
+	case expr:
+		for _, e := range v {
+			if hasSideEffectFunc(e) {
+				return true
+			}
+		}
+	case *varref:
+		return hasSideEffectFunc(v.varname)
+	case varsubst:
+		return hasSideEffectFunc(v.varname) || hasSideEffectFunc(v.pat) || hasSideEffectFunc(v.subst)
+	case *funcShell, *funcInfo, *funcWarning:
+		return true
+	case interface {
+		closureArgs() []Value
+	}:
+		for _, a := range v.closureArgs() {
+			if hasSideEffectFunc(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *fclosure) closureArgs() []Value { return c.args }
+
+// canEvalIncludesInParallel reports whether ev can evaluate files in
+// isolated child evaluators.
+func (ev *Evaluator) canEvalIncludesInParallel(files []string) bool {
+	if ParallelEvalJobs <= 1 || len(files) <= 1 {
+		return false
+	}
+	// makefiles read are printed in order.
+	if Debug&DebugVerbose != 0 {
+		return false
+	}
+	if ev.isolation != nil || ev.cache != nil || ev.currentScope != nil {
+		return false
+	}
+	_, ok := ev.outVars.Lookup("MAKEFILE_LIST").(*simpleVar)
+	return ok
+}
+
+func (ev *Evaluator) newIsolatedEvaluator() *Evaluator {
+	mkl := ev.outVars.Lookup("MAKEFILE_LIST").(*simpleVar)
+	n := len(mkl.value)
+	iso := &isolation{
+		reads: make(map[string]isolatedRead),
+		makefileList: &simpleVar{
+			value:  mkl.value[:n:n],
+			origin: mkl.origin,
+		},
+		nparent: n,
+	}
+	child := NewEvaluator(nil)
+	child.parent = ev
+	child.isolation = iso
+	child.paramVars = ev.paramVars[:len(ev.paramVars):len(ev.paramVars)]
+	child.expanding = append([]*recursiveVar(nil), ev.expanding...)
+	child.avoidIO = ev.avoidIO
+	child.posix = ev.posix
+	child.remake = ev.remake
+	child.srcpos = ev.srcpos
+	child.ctx = ev.ctx
+	child.sess = ev.sess
+	child.tid = ev.tid
+	child.recipePrefix = ev.recipePrefix
+	child.outVars["MAKEFILE_LIST"] = iso.makefileList
+	return child
+}
+
+type isolatedResult struct {
+	child *Evaluator
+	err   error
+}
+
+// evalIncludesParallel evaluates files in isolated child evaluators,
+// and merges them into ev.
+func (ev *Evaluator) evalIncludesParallel(ast *includeAST, files []string) error {
+	// children look up variables of ev concurrently.
+	err := ev.joinShells()
+	if err != nil {
+		return err
+	}
+	results := make([]isolatedResult, len(files))
+	var wg sync.WaitGroup
+	// workers take thread ids of trace events from tids.
+	tids := make(chan int, ParallelEvalJobs)
+	for i := 0; i < ParallelEvalJobs; i++ {
+		tid := ev.tid
+		if traceEvent.enabled() {
+			tid = traceEvent.newThread(fmt.Sprintf("parallel eval %s", ast.srcpos))
+		}
+		tids <- tid
+	}
+	for i, fn := range files {
+		wg.Add(1)
+		go func(i int, fn string) {
+			defer wg.Done()
+			tid := <-tids
+			defer func() { tids <- tid }()
+			results[i] = ev.evalIsolated(fn, tid)
+		}(i, fn)
+	}
+	wg.Wait()
+
+	nparallel := 0
+	for i, fn := range files {
+		r := results[i]
+		reason := ev.mergeIsolated(r)
+		if reason == "" {
+			nparallel++
+			continue
+		}
+		glog.V(1).Infof("parallel include %s: %s", fn, reason)
+		err := ev.includeFile(ast, fn)
+		if err != nil {
+			return err
+		}
+	}
+	glog.V(1).Infof("%s parallel include: %d/%d files", ast.srcpos, nparallel, len(files))
+	return nil
+}
+
+func (ev *Evaluator) evalIsolated(fn string, tid int) (r isolatedResult) {
+	defer recoverPanic(nil, &r.err)
+	mk, _, err := makefileCache.parse(fn, ev.recipePrefix, tid)
+	if err != nil {
+		return isolatedResult{err: err}
+	}
+	if !isolatedMakefile(mk) {
+		return isolatedResult{err: errNotIsolated}
+	}
+	child := ev.newIsolatedEvaluator()
+	child.tid = tid
+	err = child.evalIncludeFile(fn, mk)
+	return isolatedResult{child: child, err: err}
+}
+
+// mergeIsolated merges the result of the child evaluator into ev.
+// It returns the reason if it can't be merged.
+func (ev *Evaluator) mergeIsolated(r isolatedResult) string {
+	if r.err != nil {
+		if r.child != nil && r.child.isolation.violated != "" {
+			return r.child.isolation.violated
+		}
+		return r.err.Error()
+	}
+	child := r.child
+	iso := child.isolation
+	if child.outVars["MAKEFILE_LIST"] != iso.makefileList {
+		return "MAKEFILE_LIST modified"
+	}
+	for name, rv := range iso.reads {
+		v := ev.LookupVar(name)
+		if v != rv.v || v.String() != rv.s {
+			return fmt.Sprintf("%s modified", name)
+		}
+	}
+	// earlier files may override variables the child assigned.
+	for name, v := range child.outVars {
+		if v.Origin() == "automatic" {
+			continue
+		}
+		if originPrecedence[ev.outVars.Lookup(name).Origin()] > originPrecedence[v.Origin()] {
+			return fmt.Sprintf("%s overridden", name)
+		}
+	}
+
+	for _, fn := range iso.makefileList.value[iso.nparent:] {
+		mkl, err := ev.outVars.Lookup("MAKEFILE_LIST").Append(ev, fn)
+		if err != nil {
+			return err.Error()
+		}
+		ev.outVars.Assign("MAKEFILE_LIST", mkl)
+	}
+	for name, v := range child.outVars {
+		if name == "MAKEFILE_LIST" {
+			continue
+		}
+		ev.outVars.Assign(name, v)
+	}
+	ev.outRules = append(ev.outRules, child.outRules...)
+	ev.missingMakefiles = append(ev.missingMakefiles, child.missingMakefiles...)
+	ev.symbols.merge(child.symbols)
+	for output, vars := range child.outRuleVars {
+		ovars, ok := ev.outRuleVars[output]
+		if !ok {
+			ev.outRuleVars[output] = vars
+			continue
+		}
+		for name, v := range vars {
+			ovars.Assign(name, v)
+		}
+	}
+	ev.lastRule = child.lastRule
+	ev.srcpos = child.srcpos
+	return ""
+}
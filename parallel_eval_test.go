@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var parallelEvalTestFiles = map[string]string{
+	"a.mk": `
+LOCAL_MODULE := a
+$(LOCAL_MODULE)_SRCS := $(patsubst %.c,%.o,a1.c a2.c)
+out/a: $(a_SRCS)
+	cc -o $@ $^
+out/a: FLAGS := -O2
+`,
+	"b.mk": `
+LOCAL_MODULE := b
+B_FROM_A := $(a_SRCS)
+out/b: out/a
+`,
+	"c.mk": `
+ALL_MODULES += c
+C_DIR := $(lastword $(MAKEFILE_LIST))
+`,
+	"d.mk": `
+include sub/d_sub.mk
+D := $(D_SUB) d
+$(foreach m,x y,$(eval $(m)_D := $(m)))
+`,
+	"sub/d_sub.mk": `
+D_SUB := sub
+D_ONCE ?= once
+`,
+	"e.mk": `
+E = $(D)
+out/e: out/b
+	echo $(E)
+`,
+	"f.mk": `
+export F := f
+`,
+	// FOO is overridden by the parent.
+	"g.mk": `
+FOO := g
+G := $(FOO)
+`,
+	// BAR is overridden by h.mk, an earlier file.
+	"h.mk": `
+override BAR := h
+`,
+	"i.mk": `
+BAR := i
+I := $(BAR)
+`,
+}
+
+// writeParallelEvalTestFiles writes parallelEvalTestFiles to the current
+// directory.
+func writeParallelEvalTestFiles(t *testing.T) {
+	for name, content := range parallelEvalTestFiles {
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(name, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// dumpEvalResult returns a string representation of er to compare.
+func dumpEvalResult(t *testing.T, er *evalResult) []string {
+	var r []string
+	for name, v := range er.vars {
+		r = append(r, fmt.Sprintf("var %s %s %s=%s", name, v.Flavor(), v.Origin(), v.String()))
+	}
+	sort.Strings(r)
+	for _, rule := range er.rules {
+		r = append(r, fmt.Sprintf("rule %q %q %q", rule.outputs, rule.inputs, rule.cmds))
+	}
+	var outputs []string
+	for output := range er.ruleVars {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	for _, output := range outputs {
+		for name, v := range er.ruleVars[output] {
+			r = append(r, fmt.Sprintf("rulevar %s %s=%s", output, name, v.String()))
+		}
+	}
+	for name, export := range er.exports {
+		r = append(r, fmt.Sprintf("export %s %t", name, export))
+	}
+	return r
+}
+
+func TestParallelEval(t *testing.T) {
+	chdirTempDir(t)
+	writeParallelEvalTestFiles(t)
+
+	mk, err := parseMakefile([]byte(`
+ALL_MODULES := top
+override FOO := top
+include a.mk b.mk c.mk d.mk e.mk f.mk g.mk h.mk i.mk
+$(info $(ALL_MODULES) $(C_DIR) $(D) $(E))
+`), "Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := ParallelEvalJobs
+	defer func() { ParallelEvalJobs = saved }()
+
+	var results [][]string
+	for _, jobs := range []int{0, 4} {
+		ParallelEvalJobs = jobs
+		vars := make(Vars)
+		er, err := eval(mk, vars, false)
+		if err != nil {
+			t.Fatalf("eval with jobs=%d: %v", jobs, err)
+		}
+		results = append(results, dumpEvalResult(t, er))
+	}
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("parallel eval:\n%q\nwant:\n%q", results[1], results[0])
+	}
+}
+
+func TestIsolatedMakefile(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{in: "A := a\nout/a: b\n\techo $(shell date)\n", want: true},
+		{in: "ifdef A\nB := $(A)\nendif\n", want: true},
+		{in: "A := $(shell date)\n", want: false},
+		{in: "ifdef A\n$(info $(A))\nendif\n", want: false},
+		{in: "A := $(call f,$(warning w))\n", want: false},
+		{in: "export A\n", want: false},
+		{in: "vpath %.c src\n", want: false},
+	} {
+		mk, err := parseMakefileString(tc.in, srcpos{filename: "test.mk", lineno: 1})
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.in, err)
+			continue
+		}
+		if got := isolatedMakefile(mk); got != tc.want {
+			t.Errorf("isolatedMakefile(%q)=%t; want %t", tc.in, got, tc.want)
+		}
+	}
+}
@@ -20,14 +20,11 @@ package kati
 // $ go test -bench .
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"errors"
-	"fmt"
 	"io"
-	"io/ioutil"
-	"strings"
+	"os"
 	"sync"
 	"time"
 
@@ -37,6 +34,42 @@ import (
 type makefile struct {
 	filename string
 	stmts    []ast
+	// src is the content of the makefile, to parse it again from a
+	// line with another recipe prefix. It is nil if lines are not
+	// numbered, e.g. for $(eval).
+	src []byte
+	// recipePrefix is the recipe prefix at the beginning, and
+	// recipePrefixes are changes of it by .RECIPEPREFIX found by the
+	// parser. see recipePrefixAt.
+	recipePrefix   byte
+	recipePrefixes []recipePrefixChange
+}
+
+// recipePrefixChange is an assignment to .RECIPEPREFIX at lineno,
+// which changes the recipe prefix of later lines to prefix.
+type recipePrefixChange struct {
+	lineno int
+	prefix byte
+}
+
+// recipePrefixAt returns the recipe prefix which the parser used for
+// the line lineno.
+func (mk makefile) recipePrefixAt(lineno int) byte {
+	prefix := mk.recipePrefix
+	for _, c := range mk.recipePrefixes {
+		if c.lineno >= lineno {
+			break
+		}
+		prefix = c.prefix
+	}
+	return prefix
+}
+
+func (mk makefile) lastStmt() ast {
+	if len(mk.stmts) == 0 {
+		return nil
+	}
+	return mk.stmts[len(mk.stmts)-1]
 }
 
 type ifState struct {
@@ -46,7 +79,10 @@ type ifState struct {
 }
 
 type parser struct {
-	rd          *bufio.Reader
+	// buf is the content of the makefile. It must not be modified
+	// since lines and parsed values refer to it.
+	buf         []byte
+	off         int
 	mk          makefile
 	lineno      int
 	elineno     int // lineno == elineno unless there is trailing '\'.
@@ -58,21 +94,128 @@ type parser struct {
 
 	defineVar []byte
 	inDef     []byte
+	// defineOp is the assign operator of the define directive, and
+	// defineNest is the number of nested defines in its body.
+	defineOp   string
+	defineNest int
 
 	defOpt    string
 	numIfNest int
 	err       error
+
+	// recipePrefix is the first byte of recipe lines, which is
+	// changed by .RECIPEPREFIX.
+	recipePrefix byte
+
+	// lines are logical lines parsed, recorded if recordLines is
+	// set, for the formatter. lineStmt is the last statement added
+	// for the current line.
+	recordLines bool
+	lines       []parsedLine
+	lineStmt    ast
+
+	// quiet suppresses warnings.
+	quiet bool
+
+	// spans are byte offsets of statements in buf, recorded if not
+	// nil. lineOff and lineEnd are offsets of the current logical
+	// line, and defineOff is of the current define directive.
+	spans     map[ast]srcspan
+	lineOff   int
+	lineEnd   int
+	defineOff int
+}
+
+// srcspan is a range of bytes in a makefile.
+type srcspan struct {
+	start, end int
+}
+
+func (p *parser) reportDiagnostic(d Diagnostic) {
+	if p.quiet {
+		return
+	}
+	ReportDiagnostic(d)
+}
+
+func (p *parser) warnNoPrefix(col int, code string, f string, a ...interface{}) {
+	if p.quiet {
+		return
+	}
+	warnNoPrefix(p.srcpos(), col, code, f, a...)
+}
+
+// lineKind is the kind of a logical line of a makefile.
+type lineKind int
+
+const (
+	// lineOther is a directive, a comment or a blank line.
+	lineOther lineKind = iota
+	// lineDefine is a line of a define directive, i.e. define, its
+	// body or endef.
+	lineDefine
+	lineRecipe
+	lineAssign
+	lineRule
+)
+
+// parsedLine is a logical line parsed, which may have backslash
+// newlines.
+type parsedLine struct {
+	line []byte
+	// nlines is the number of physical lines, which may be more than
+	// lines in line, as empty lines after a backslash are trimmed.
+	nlines int
+	kind   lineKind
 }
 
-func newParser(rd io.Reader, filename string) *parser {
+func newParser(buf []byte, filename string) *parser {
 	p := &parser{
-		rd: bufio.NewReader(rd),
+		buf:          buf,
+		recipePrefix: '\t',
 	}
-	p.mk.filename = filename
+	p.mk.filename = intern(filename)
+	p.mk.src = buf
+	p.mk.recipePrefix = '\t'
 	p.outStmts = &p.mk.stmts
 	return p
 }
 
+// isRecipeLine reports whether line starts with the recipe prefix.
+func (p *parser) isRecipeLine(line []byte) bool {
+	return len(line) > 0 && line[0] == p.recipePrefix
+}
+
+// setRecipePrefix sets the recipe prefix for later lines if lhs is
+// .RECIPEPREFIX. As GNU make, the prefix is the first byte of the value
+// of the variable, which is not expanded for a recursive variable, or
+// a tab if it is empty. The parser doesn't know values of expanded
+// ones, which the evaluator finds and parses the rest of the makefile
+// again.
+func (p *parser) setRecipePrefix(lhs, rhs []byte, op string) {
+	if string(trimSpaceBytes(lhs)) != ".RECIPEPREFIX" {
+		return
+	}
+	switch op {
+	case "=":
+	case ":=", "::=":
+		if bytes.IndexByte(rhs, '$') >= 0 {
+			return
+		}
+	default:
+		return
+	}
+	prefix := byte('\t')
+	if len(rhs) > 0 {
+		prefix = rhs[0]
+	}
+	p.recipePrefix = prefix
+	p.mk.recipePrefixes = append(p.mk.recipePrefixes, recipePrefixChange{
+		lineno: p.lineno,
+		prefix: prefix,
+	})
+}
+
 func (p *parser) srcpos() srcpos {
 	return srcpos{
 		filename: p.mk.filename,
@@ -80,12 +223,39 @@ func (p *parser) srcpos() srcpos {
 	}
 }
 
+// column returns the 1-based column of the first non-space byte of
+// data in the last line read, or 0 if data is not in p.buf, e.g. it is
+// in a concatenated line.
+func (p *parser) column(data []byte) int {
+	data = trimLeftSpaceBytes(data)
+	if len(data) == 0 {
+		return 0
+	}
+	for off := p.off - 1; off >= 0; off-- {
+		if &p.buf[off] == &data[0] {
+			return off - bytes.LastIndexByte(p.buf[:off], '\n')
+		}
+		if p.buf[off] == '\n' && off < p.off-1 {
+			break
+		}
+	}
+	return 0
+}
+
 func (p *parser) addStatement(stmt ast) {
 	*p.outStmts = append(*p.outStmts, stmt)
+	p.lineStmt = stmt
+	if p.spans != nil {
+		start := p.lineOff
+		if p.defineVar != nil {
+			start = p.defineOff
+		}
+		p.spans[stmt] = srcspan{start: start, end: p.lineEnd}
+	}
 	switch stmt.(type) {
 	case *maybeRuleAST:
 		p.inRecipe = true
-	case *assignAST, *includeAST, *exportAST:
+	case *assignAST, *includeAST, *exportAST, *loadAST:
 		p.inRecipe = false
 	}
 }
@@ -94,19 +264,19 @@ func (p *parser) readLine() []byte {
 	if !p.linenoFixed {
 		p.lineno = p.elineno + 1
 	}
-	var line []byte
+	start := p.off
 	for !p.done {
-		buf, err := p.rd.ReadBytes('\n')
+		var buf []byte
+		if i := bytes.IndexByte(p.buf[p.off:], '\n'); i >= 0 {
+			buf = p.buf[p.off : p.off+i+1]
+		} else {
+			buf = p.buf[p.off:]
+			p.done = true
+		}
+		p.off += len(buf)
 		if !p.linenoFixed {
 			p.elineno++
 		}
-		if err == io.EOF {
-			p.done = true
-		} else if err != nil {
-			p.err = fmt.Errorf("readline %s: %v", p.srcpos(), err)
-			p.done = true
-		}
-		line = append(line, buf...)
 		buf = bytes.TrimRight(buf, "\r\n")
 		backslash := false
 		for len(buf) > 1 && buf[len(buf)-1] == '\\' {
@@ -117,8 +287,11 @@ func (p *parser) readLine() []byte {
 			break
 		}
 	}
-	line = bytes.TrimRight(line, "\r\n")
-	return line
+	line := bytes.TrimRight(p.buf[start:p.off], "\r\n")
+	p.lineOff = start
+	p.lineEnd = start + len(line)
+	// cap line so appending to it never overwrites the next line.
+	return line[:len(line):len(line)]
 }
 
 func newAssignAST(p *parser, lhsBytes []byte, rhsBytes []byte, op string) (*assignAST, error) {
@@ -133,10 +306,16 @@ func newAssignAST(p *parser, lhsBytes []byte, rhsBytes []byte, op string) (*assi
 	opt := ""
 	if p != nil {
 		opt = p.defOpt
+		p.setRecipePrefix(lhsBytes, rhsBytes, op)
+	}
+	var src string
+	if bytes.IndexByte(rhsBytes, '$') >= 0 {
+		src = string(rhsBytes)
 	}
 	return &assignAST{
 		lhs: lhs,
 		rhs: rhs,
+		src: src,
 		op:  op,
 		opt: opt,
 	}, nil
@@ -156,7 +335,9 @@ func (p *parser) handleRuleOrAssign(line []byte) {
 	var semi []byte
 	if i := findLiteralChar(line, ';', 0, skipVar); i >= 0 {
 		// preserve after semicolon
-		semi = append(semi, line[i+1:]...)
+		if i+1 < len(line) {
+			semi = line[i+1:]
+		}
 		rline = concatline(line[:i])
 	} else {
 		rline = concatline(line)
@@ -216,7 +397,7 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 		p.err = p.srcpos().errorf("*** missing rule before commands.")
 		return
 	}
-	if line[0] == '\t' {
+	if p.isRecipeLine(line) {
 		p.err = p.srcpos().errorf("*** commands commence before first target.")
 		return
 	}
@@ -225,7 +406,8 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 	if ci >= 0 {
 		eqi := findLiteralChar(line[ci+1:], '=', 0, skipVar)
 		if eqi == 0 {
-			panic(fmt.Sprintf("unexpected eq after colon: %q", line))
+			p.err = p.srcpos().errorf("*** unexpected '=' after ':': %q", line)
+			return
 		}
 		if eqi > 0 {
 			var lhsbytes []byte
@@ -239,6 +421,12 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 			}
 
 			lhsbytes = trimSpaceBytes(lhsbytes)
+			var opt string
+			if w, rest := firstWord(lhsbytes); string(w) == "export" && len(rest) > 0 {
+				// e.g. "foo: export V := v"
+				opt = "export"
+				lhsbytes = rest
+			}
 			lhs, _, err := parseExpr(lhsbytes, nil, parseOp{})
 			if err != nil {
 				p.err = p.srcpos().error(err)
@@ -258,11 +446,12 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 				return
 			}
 
-			// TODO(ukai): support override, export in target specific var.
+			// TODO(ukai): support override in target specific var.
 			assign = &assignAST{
 				lhs: lhs,
 				rhs: rhs,
 				op:  op,
+				opt: opt,
 			}
 			assign.srcpos = p.srcpos()
 			line = line[:ci+1]
@@ -322,10 +511,11 @@ func (p *parser) parseTwoQuotes(s []byte) (string, string, []byte, bool) {
 		if quote != '\'' && quote != '"' {
 			return "", "", nil, false
 		}
-		end := bytes.IndexByte(s[1:], quote) + 1
+		end := bytes.IndexByte(s[1:], quote)
 		if end < 0 {
 			return "", "", nil, false
 		}
+		end++
 		args = append(args, string(s[1:end]))
 		s = s[end+1:]
 	}
@@ -348,6 +538,9 @@ func (p *parser) parseEq(s []byte) (string, string, []byte, bool) {
 			glog.V(1).Infof("parse eq: %q: %v", in, err)
 			return "", "", nil, false
 		}
+		if n >= len(in) {
+			return "", "", nil, false
+		}
 		lhs := v.String()
 		n++
 		n += skipSpaces(in[n:], nil)
@@ -358,6 +551,9 @@ func (p *parser) parseEq(s []byte) (string, string, []byte, bool) {
 			glog.V(1).Infof("parse eq 2nd: %q: %v", in, err)
 			return "", "", nil, false
 		}
+		if n >= len(in) {
+			return "", "", nil, false
+		}
 		rhs := v.String()
 		in = in[n+1:]
 		in = trimSpaceBytes(in)
@@ -437,7 +633,7 @@ func (p *parser) parseElse(data []byte) {
 		return
 	}
 	p.numIfNest = 0
-	warnNoPrefix(p.srcpos(), "extraneous text after `else' directive")
+	p.warnNoPrefix(p.column(data), DiagExtraneousText, "extraneous text after `else' directive")
 	return
 }
 
@@ -449,6 +645,10 @@ func (p *parser) parseEndif(data []byte) {
 	}
 	state := p.ifStack[len(p.ifStack)-1]
 	for t := 0; t <= state.numNest; t++ {
+		if p.spans != nil {
+			iast := p.ifStack[len(p.ifStack)-1].ast
+			p.spans[iast] = srcspan{start: p.spans[iast].start, end: p.lineEnd}
+		}
 		p.ifStack = p.ifStack[0 : len(p.ifStack)-1]
 		if len(p.ifStack) == 0 {
 			p.outStmts = &p.mk.stmts
@@ -462,15 +662,38 @@ func (p *parser) parseEndif(data []byte) {
 		}
 	}
 	if len(trimSpaceBytes(data)) > 0 {
-		warnNoPrefix(p.srcpos(), "extraneous text after `endif' directive")
+		p.warnNoPrefix(p.column(data), DiagExtraneousText, "extraneous text after `endif' directive")
 	}
 	return
 }
 
+// defineOps are assign operators of the define directive, e.g.
+// "define foo :=".
+var defineOps = []string{"::=", ":=", "+=", "?=", "="}
+
 func (p *parser) parseDefine(data []byte) {
+	name := trimSpaceBytes(data)
+	op := "="
+	for _, o := range defineOps {
+		if bytes.HasSuffix(name, []byte(o)) {
+			name = trimRightSpaceBytes(name[:len(name)-len(o)])
+			op = o
+			break
+		}
+	}
+	if op == "::=" {
+		op = ":="
+	}
+	if len(name) == 0 {
+		p.err = p.srcpos().errorf("*** empty variable name.")
+		return
+	}
 	p.defineVar = nil
 	p.inDef = nil
-	p.defineVar = append(p.defineVar, trimSpaceBytes(data)...)
+	p.defineVar = append(p.defineVar, name...)
+	p.defineOp = op
+	p.defineNest = 0
+	p.defineOff = p.lineOff
 	return
 }
 
@@ -489,6 +712,40 @@ func (p *parser) parseVpath(data []byte) {
 	p.addStatement(vast)
 }
 
+func (p *parser) parseLoad(op string, data []byte) {
+	line, _ := removeComment(concatline(data))
+	line = trimLeftSpaceBytes(line)
+	v, _, err := parseExpr(line, nil, parseOp{alloc: true})
+	if err != nil {
+		p.err = p.srcpos().errorf("parse error %q: %v", string(line), err)
+		return
+	}
+	last := &loadAST{
+		expr: v,
+		op:   op,
+	}
+	last.srcpos = p.srcpos()
+	// Objects may define functions used in the rest of this makefile,
+	// so load them before parsing it if they are known here. In a
+	// conditional, objects are loaded only when the directive is
+	// evaluated, so their functions can be used in makefiles parsed
+	// after that, e.g. by include or $(eval).
+	switch v.(type) {
+	case literal, tmpval:
+		if len(p.ifStack) > 0 {
+			break
+		}
+		for _, obj := range splitSpaces(v.String()) {
+			err := loadObject(obj)
+			if err != nil && op == "load" {
+				p.err = last.errorf("%v", err)
+				return
+			}
+		}
+	}
+	p.addStatement(last)
+}
+
 type directiveFunc func(*parser, []byte)
 
 var makeDirectives map[string]directiveFunc
@@ -509,6 +766,8 @@ func init() {
 		"export":   exportDirective,
 		"unexport": unexportDirective,
 		"vpath":    vpathDirective,
+		"load":     loadDirective,
+		"-load":    sloadDirective,
 	}
 }
 
@@ -520,6 +779,14 @@ func sincludeDirective(p *parser, data []byte) {
 	p.parseInclude("-include", data)
 }
 
+func loadDirective(p *parser, data []byte) {
+	p.parseLoad("load", data)
+}
+
+func sloadDirective(p *parser, data []byte) {
+	p.parseLoad("-load", data)
+}
+
 func ifdefDirective(p *parser, data []byte) {
 	p.parseIfdef("ifdef", data)
 }
@@ -630,25 +897,96 @@ func (p *parser) parse() (mk makefile, err error) {
 			if p.err != nil {
 				return makefile{}, p.err
 			}
+			p.recordLine(line, lineDefine)
 			continue
 		}
 		p.defOpt = ""
 		if p.inRecipe {
-			if len(line) > 0 && line[0] == '\t' {
-				cast := &commandAST{cmd: string(line[1:])}
+			if p.isRecipeLine(line) {
+				cast := &commandAST{cmd: internBytes(line[1:])}
 				cast.srcpos = p.srcpos()
 				p.addStatement(cast)
+				p.recordLine(line, lineRecipe)
 				continue
 			}
+			if WarnFlag {
+				p.lintRecipeSpaces(line)
+			}
 		}
+		p.lineStmt = nil
 		p.parseLine(line)
 		if p.err != nil {
 			return makefile{}, p.err
 		}
+		kind := lineOther
+		switch p.lineStmt.(type) {
+		case *assignAST:
+			kind = lineAssign
+		case *maybeRuleAST:
+			kind = lineRule
+		}
+		if p.defineVar != nil {
+			kind = lineDefine
+		}
+		p.recordLine(line, kind)
+	}
+	if p.defineVar != nil {
+		pos := p.srcpos()
+		pos.lineno -= bytes.Count(p.inDef, []byte{'\n'}) + 1
+		return makefile{}, pos.errorf("*** missing `endef', unterminated `define'.")
 	}
 	return p.mk, p.err
 }
 
+func (p *parser) recordLine(line []byte, kind lineKind) {
+	if !p.recordLines {
+		return
+	}
+	p.lines = append(p.lines, parsedLine{
+		line:   append([]byte(nil), line...),
+		nlines: p.elineno - p.lineno + 1,
+		kind:   kind,
+	})
+}
+
+// lintRecipeSpaces warns if line after a rule looks like a recipe line
+// indented with spaces instead of a tab.
+func (p *parser) lintRecipeSpaces(line []byte) {
+	if len(line) == 0 || line[0] != ' ' || len(*p.outStmts) == 0 {
+		return
+	}
+	switch s := (*p.outStmts)[len(*p.outStmts)-1].(type) {
+	case *maybeRuleAST:
+		if s.assign != nil {
+			return
+		}
+	case *commandAST:
+	default:
+		return
+	}
+	cline, _ := removeComment(concatline(line))
+	dline := trimSpaceBytes(cline)
+	if len(dline) == 0 || findLiteralChar(dline, ':', '=', skipVar) >= 0 {
+		return
+	}
+	w, _ := firstWord(dline)
+	if _, ok := makeDirectives[string(w)]; ok {
+		return
+	}
+	if bsdDirective(dline) != "" {
+		return
+	}
+	pos := p.srcpos()
+	p.reportDiagnostic(Diagnostic{
+		Filename: pos.filename,
+		Line:     pos.lineno,
+		Column:   p.column(line),
+		Severity: SeverityWarning,
+		Code:     DiagRecipeSpaces,
+		Message:  "recipe line starts with spaces instead of a tab",
+	})
+}
+
 func (p *parser) parseLine(line []byte) {
 	cline := concatline(line)
 	if len(cline) == 0 {
@@ -657,10 +995,8 @@ func (p *parser) parseLine(line []byte) {
 	if glog.V(1) {
 		glog.Infof("concatline:%q", cline)
 	}
-	var dline []byte
 	cline, _ = removeComment(cline)
-	dline = append(dline, cline...)
-	dline = trimSpaceBytes(dline)
+	dline := trimSpaceBytes(cline)
 	if len(dline) == 0 {
 		return
 	}
@@ -670,6 +1006,10 @@ func (p *parser) parseLine(line []byte) {
 	if p.handleDirective(dline, makeDirectives) {
 		return
 	}
+	if d := bsdDirective(dline); d != "" {
+		p.err = p.srcpos().errorf("*** %q is a BSD make directive; this looks like a BSD makefile, which kati doesn't support.", d)
+		return
+	}
 	if glog.V(1) {
 		glog.Infof("rule or assign?: %q", line)
 	}
@@ -681,18 +1021,28 @@ func (p *parser) processDefine(line []byte) {
 	if glog.V(1) {
 		glog.Infof("concatline:%q", line)
 	}
-	if !p.isEndef(line) {
-		if p.inDef != nil {
-			p.inDef = append(p.inDef, '\n')
+	switch {
+	case p.isDefine(line):
+		p.defineNest++
+	case p.isEndef(line):
+		if p.defineNest == 0 {
+			p.endDefine()
+			return
 		}
-		p.inDef = append(p.inDef, line...)
-		if p.inDef == nil {
-			p.inDef = []byte{}
-		}
-		return
+		p.defineNest--
+	}
+	if p.inDef != nil {
+		p.inDef = append(p.inDef, '\n')
+	}
+	p.inDef = append(p.inDef, line...)
+	if p.inDef == nil {
+		p.inDef = []byte{}
 	}
-	glog.V(1).Infof("multilineAssign %q %q", p.defineVar, p.inDef)
-	aast, err := newAssignAST(p, p.defineVar, p.inDef, "=")
+}
+
+func (p *parser) endDefine() {
+	glog.V(1).Infof("multilineAssign %q %s %q", p.defineVar, p.defineOp, p.inDef)
+	aast, err := newAssignAST(p, p.defineVar, p.inDef, p.defineOp)
 	if err != nil {
 		p.err = p.srcpos().errorf("assign error %q=%q: %v", p.defineVar, p.inDef, err)
 		return
@@ -700,21 +1050,37 @@ func (p *parser) processDefine(line []byte) {
 	aast.srcpos = p.srcpos()
 	aast.srcpos.lineno -= bytes.Count(p.inDef, []byte{'\n'})
 	p.addStatement(aast)
+	if p.defOpt == "export" {
+		handleExport(p, p.defineVar, true)
+	}
 	p.defineVar = nil
 	p.inDef = nil
-	return
+}
+
+// isDefine reports whether line starts a define nested in the body
+// of a define. As GNU make, lines starting with the recipe prefix are
+// not directives there.
+func (p *parser) isDefine(line []byte) bool {
+	if p.isRecipeLine(line) {
+		return false
+	}
+	w, _ := firstWord(line)
+	return bytes.Equal(w, []byte("define"))
 }
 
 func (p *parser) isEndef(line []byte) bool {
 	if bytes.Equal(line, []byte("endef")) {
 		return true
 	}
+	if p.isRecipeLine(line) {
+		return false
+	}
 	w, data := firstWord(line)
 	if bytes.Equal(w, []byte("endef")) {
 		data, _ = removeComment(data)
 		data = trimLeftSpaceBytes(data)
 		if len(data) > 0 {
-			warnNoPrefix(p.srcpos(), `extraneous text after "endef" directive`)
+			p.warnNoPrefix(p.column(data), DiagExtraneousText, `extraneous text after "endef" directive`)
 		}
 		return true
 	}
@@ -731,20 +1097,56 @@ func defaultMakefile() (string, error) {
 	return "", errors.New("no targets specified and no makefile found")
 }
 
-func parseMakefileReader(rd io.Reader, loc srcpos) (makefile, error) {
-	parser := newParser(rd, loc.filename)
+// parseMakefileLoc parses s at loc with the recipe prefix. Lines of s
+// are reported at loc.lineno. parser takes ownership of s.
+func parseMakefileLoc(s []byte, loc srcpos, recipePrefix byte) (makefile, error) {
+	parser := newParser(s, loc.filename)
 	parser.lineno = loc.lineno
 	parser.elineno = loc.lineno
 	parser.linenoFixed = true
+	parser.mk.src = nil
+	parser.recipePrefix = recipePrefix
+	parser.mk.recipePrefix = recipePrefix
 	return parser.parse()
 }
 
 func parseMakefileString(s string, loc srcpos) (makefile, error) {
-	return parseMakefileReader(strings.NewReader(s), loc)
+	return parseMakefileLoc([]byte(s), loc, '\t')
 }
 
-func parseMakefileBytes(s []byte, loc srcpos) (makefile, error) {
-	return parseMakefileReader(bytes.NewReader(s), loc)
+// parseMakefileBytes parses s at loc with the recipe prefix. s is
+// copied, so the caller may reuse s.
+func parseMakefileBytes(s []byte, loc srcpos, recipePrefix byte) (makefile, error) {
+	return parseMakefileLoc(append([]byte(nil), s...), loc, recipePrefix)
+}
+
+// reparseFrom parses mk again from the statement stmts[i] with the
+// recipe prefix. stmts are statements of mk from its beginning, or the
+// last reparse.
+func (mk makefile) reparseFrom(stmts []ast, i int, recipePrefix byte) (makefile, error) {
+	lineno := stmts[i].pos().lineno
+	off := 0
+	for n := 1; n < lineno && off < len(mk.src); n++ {
+		j := bytes.IndexByte(mk.src[off:], '\n')
+		if j < 0 {
+			off = len(mk.src)
+			break
+		}
+		off += j + 1
+	}
+	p := newParser(mk.src[off:], mk.filename)
+	p.mk.src = mk.src
+	p.lineno = lineno - 1
+	p.elineno = lineno - 1
+	p.recipePrefix = recipePrefix
+	p.mk.recipePrefix = recipePrefix
+	if i > 0 {
+		switch stmts[i-1].(type) {
+		case *maybeRuleAST, *commandAST:
+			p.inRecipe = true
+		}
+	}
+	return p.parse()
 }
 
 type mkCacheEntry struct {
@@ -763,10 +1165,10 @@ var makefileCache = &makefileCacheT{
 	mk: make(map[string]mkCacheEntry),
 }
 
-func (mc *makefileCacheT) lookup(filename string) (makefile, [sha1.Size]byte, bool, error) {
+func (mc *makefileCacheT) lookup(filename, key string) (makefile, [sha1.Size]byte, bool, error) {
 	var hash [sha1.Size]byte
 	mc.mu.Lock()
-	c, present := mc.mk[filename]
+	c, present := mc.mk[key]
 	mc.mu.Unlock()
 	if !present {
 		return makefile{}, hash, false, nil
@@ -778,9 +1180,15 @@ func (mc *makefileCacheT) lookup(filename string) (makefile, [sha1.Size]byte, bo
 	return c.mk, c.hash, true, c.err
 }
 
-func (mc *makefileCacheT) parse(filename string) (makefile, [sha1.Size]byte, error) {
+// parse parses filename with the recipe prefix, or returns the cached
+// result. The trace event of parsing is in the thread tid.
+func (mc *makefileCacheT) parse(filename string, recipePrefix byte, tid int) (makefile, [sha1.Size]byte, error) {
 	glog.Infof("parse Makefile %q", filename)
-	mk, hash, ok, err := makefileCache.lookup(filename)
+	key := filename
+	if recipePrefix != '\t' {
+		key = filename + "\x00" + string(recipePrefix)
+	}
+	mk, hash, ok, err := makefileCache.lookup(filename, key)
 	if ok {
 		if glog.V(1) {
 			glog.Infof("makefile cache hit for %q", filename)
@@ -790,17 +1198,22 @@ func (mc *makefileCacheT) parse(filename string) (makefile, [sha1.Size]byte, err
 	if glog.V(1) {
 		glog.Infof("reading makefile %q", filename)
 	}
-	c, err := ioutil.ReadFile(filename)
+	te := traceEvent.begin("parse", literal(filename), tid)
+	defer traceEvent.end(te)
+	c, err := readMakefile(filename)
 	if err != nil {
 		return makefile{}, hash, err
 	}
 	hash = sha1.Sum(c)
-	mk, err = parseMakefile(c, filename)
+	parser := newParser(c, filename)
+	parser.recipePrefix = recipePrefix
+	parser.mk.recipePrefix = recipePrefix
+	mk, err = parser.parse()
 	if err != nil {
 		return makefile{}, hash, err
 	}
 	makefileCache.mu.Lock()
-	makefileCache.mk[filename] = mkCacheEntry{
+	makefileCache.mk[key] = mkCacheEntry{
 		mk:   mk,
 		hash: hash,
 		err:  err,
@@ -810,7 +1223,68 @@ func (mc *makefileCacheT) parse(filename string) (makefile, [sha1.Size]byte, err
 	return mk, hash, err
 }
 
+// parseMakefile parses the content s of the makefile filename.
+// parser takes ownership of s, i.e. the caller must not modify s.
 func parseMakefile(s []byte, filename string) (makefile, error) {
-	parser := newParser(bytes.NewReader(s), filename)
+	parser := newParser(s, filename)
 	return parser.parse()
 }
+
+// arenaChunkSize is the size of memory chunks which makefiles are read
+// into. Larger files are read into their own buffers.
+const arenaChunkSize = 1 << 20
+
+// makefileArena allocates buffers to read makefiles into. Content of
+// makefiles is never freed while the parsed makefiles are cached, so
+// it is allocated in large chunks rather than per file.
+type makefileArena struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+var mkArena = &makefileArena{}
+
+func (a *makefileArena) alloc(n int) []byte {
+	if n > arenaChunkSize/4 {
+		return make([]byte, n)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cap(a.buf)-len(a.buf) < n {
+		a.buf = make([]byte, 0, arenaChunkSize)
+	}
+	off := len(a.buf)
+	a.buf = a.buf[:off+n]
+	return a.buf[off : off+n : off+n]
+}
+
+// readMakefile reads the content of filename into mkArena with a
+// single read.
+func readMakefile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := int(fi.Size())
+	// read one more byte to detect the file grown after Stat.
+	buf := mkArena.alloc(size + 1)
+	n, err := io.ReadFull(f, buf)
+	switch err {
+	case io.ErrUnexpectedEOF, io.EOF:
+		return buf[:n:n], nil
+	case nil:
+		// the file was modified during read. read the rest.
+		var rest bytes.Buffer
+		_, err = rest.ReadFrom(f)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf[:n:n], rest.Bytes()...), nil
+	}
+	return nil, err
+}
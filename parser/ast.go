@@ -0,0 +1,265 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package parser provides the syntax tree of makefiles parsed by kati,
+e.g. for language servers.
+
+kati.ParseAST parses a makefile into a File. Statements have positions
+in the makefile, while expressions don't. Included makefiles are not
+read, and nothing is evaluated, so names of variables and targets may
+be expressions.
+*/
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pos is a position in a makefile.
+type Pos struct {
+	Filename string
+	// Offset is the byte offset, starting at 0.
+	Offset int
+	// Line and Column start at 1. Column is in bytes.
+	Line   int
+	Column int
+}
+
+// IsValid reports whether p is a position.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// Span is the range of a statement. To is just after its last byte,
+// excluding the newline.
+type Span struct {
+	From, To Pos
+}
+
+// Pos returns the position of the first byte.
+func (s Span) Pos() Pos { return s.From }
+
+// End returns the position just after the last byte.
+func (s Span) End() Pos { return s.To }
+
+// File is a parsed makefile.
+type File struct {
+	Name  string
+	Stmts []Stmt
+}
+
+// Stmt is a statement of a makefile.
+type Stmt interface {
+	Pos() Pos
+	End() Pos
+	stmtNode()
+}
+
+// AssignStmt is a variable assignment, e.g. "A := b", or a define
+// directive.
+type AssignStmt struct {
+	Span
+	Name Expr
+	// Op is "=", ":=", "+=" or "?=".
+	Op    string
+	Value Expr
+	// Directive is "override" or "export", if any.
+	Directive string
+	// Define is true if it is a define directive.
+	Define bool
+}
+
+// RuleStmt is a line which will be a rule, e.g. "a: b", unless it
+// is empty after expansion.
+type RuleStmt struct {
+	Span
+	// Expr is the line before ';' or the target specific variable.
+	Expr Expr
+	// IsRule is true if Expr has a literal ':'.
+	IsRule bool
+	// Assign is the target specific variable, e.g. "a: A := b".
+	// Its Name is the variable name.
+	Assign *AssignStmt
+	// Recipe is after ';', if HasRecipe is true.
+	Recipe    string
+	HasRecipe bool
+}
+
+// CommandStmt is a recipe line, without the recipe prefix.
+type CommandStmt struct {
+	Span
+	Command string
+}
+
+// IncludeStmt is an include directive.
+type IncludeStmt struct {
+	Span
+	// Op is "include" or "-include".
+	Op    string
+	Files Expr
+}
+
+// IfStmt is a conditional directive. "else ifeq" is IfStmt in Else.
+type IfStmt struct {
+	Span
+	// Op is "ifdef", "ifndef", "ifeq" or "ifneq".
+	Op string
+	// RHS is nil for ifdef and ifndef.
+	LHS, RHS Expr
+	Then     []Stmt
+	Else     []Stmt
+}
+
+// ExportStmt is an export or unexport directive.
+type ExportStmt struct {
+	Span
+	Export bool
+	// Names are the variables, or empty for all variables.
+	Names Expr
+	// HasEqual is true if it is followed by an assignment, e.g.
+	// "export A = b".
+	HasEqual bool
+}
+
+// VpathStmt is a vpath directive.
+type VpathStmt struct {
+	Span
+	Expr Expr
+}
+
+// LoadStmt is a load directive.
+type LoadStmt struct {
+	Span
+	// Op is "load" or "-load".
+	Op   string
+	Expr Expr
+}
+
+func (*AssignStmt) stmtNode()  {}
+func (*RuleStmt) stmtNode()    {}
+func (*CommandStmt) stmtNode() {}
+func (*IncludeStmt) stmtNode() {}
+func (*IfStmt) stmtNode()      {}
+func (*ExportStmt) stmtNode()  {}
+func (*VpathStmt) stmtNode()   {}
+func (*LoadStmt) stmtNode()    {}
+
+// Expr is an unexpanded expression. String returns it in make syntax.
+type Expr interface {
+	String() string
+	exprNode()
+}
+
+// Literal is a text without references.
+type Literal struct {
+	Text string
+}
+
+// Concat is a concatenation of expressions.
+type Concat struct {
+	Parts []Expr
+}
+
+// VarRef is a variable reference, e.g. "$(A)" or "$A".
+type VarRef struct {
+	Name Expr
+	// Paren is '(', '{', or 0 for a single letter name without
+	// parenthesis.
+	Paren byte
+}
+
+// ParamRef is a reference to a parameter of call, e.g. "$1".
+type ParamRef struct {
+	N int
+}
+
+// SubstRef is a substitution reference, e.g. "$(A:.c=.o)".
+type SubstRef struct {
+	Name, Pattern, Replacement Expr
+	Paren                      byte
+}
+
+// Call is a function call, e.g. "$(subst a,b,c)".
+type Call struct {
+	Func  string
+	Args  []Expr
+	Paren byte
+}
+
+func (*Literal) exprNode()  {}
+func (*Concat) exprNode()   {}
+func (*VarRef) exprNode()   {}
+func (*ParamRef) exprNode() {}
+func (*SubstRef) exprNode() {}
+func (*Call) exprNode()     {}
+
+func (e *Literal) String() string { return e.Text }
+
+func (e *Concat) String() string {
+	var s []string
+	for _, p := range e.Parts {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, "")
+}
+
+func (e *VarRef) String() string {
+	if e.Paren == 0 {
+		return "$" + e.Name.String()
+	}
+	return fmt.Sprintf("$%c%s%c", e.Paren, e.Name, closeParen(e.Paren))
+}
+
+func (e *ParamRef) String() string {
+	return fmt.Sprintf("$%d", e.N)
+}
+
+func (e *SubstRef) String() string {
+	return fmt.Sprintf("$%c%s:%s=%s%c", e.paren(), e.Name, e.Pattern, e.Replacement, closeParen(e.paren()))
+}
+
+func (e *SubstRef) paren() byte {
+	if e.Paren == 0 {
+		return '('
+	}
+	return e.Paren
+}
+
+func (e *Call) String() string {
+	paren := e.Paren
+	if paren == 0 {
+		paren = '('
+	}
+	var args []string
+	for _, a := range e.Args {
+		args = append(args, a.String())
+	}
+	return fmt.Sprintf("$%c%s %s%c", paren, e.Func, strings.Join(args, ","), closeParen(paren))
+}
+
+func closeParen(paren byte) byte {
+	if paren == '{' {
+		return '}'
+	}
+	return ')'
+}
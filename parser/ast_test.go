@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "testing"
+
+func TestExprString(t *testing.T) {
+	for _, tc := range []struct {
+		e    Expr
+		want string
+	}{
+		{
+			e:    &VarRef{Name: &Literal{Text: "A"}},
+			want: "$A",
+		},
+		{
+			e:    &VarRef{Name: &Literal{Text: "AB"}, Paren: '{'},
+			want: "${AB}",
+		},
+		{
+			e: &SubstRef{
+				Name:        &Literal{Text: "A"},
+				Pattern:     &Literal{Text: "%.c"},
+				Replacement: &Literal{Text: "%.o"},
+			},
+			want: "$(A:%.c=%.o)",
+		},
+		{
+			e: &Call{
+				Func: "join",
+				Args: []Expr{
+					&Literal{Text: "a"},
+					&Concat{Parts: []Expr{&ParamRef{N: 1}, &Literal{Text: "b"}}},
+				},
+				Paren: '(',
+			},
+			want: "$(join a,$1b)",
+		},
+	} {
+		if got := tc.e.String(); got != tc.want {
+			t.Errorf("%#v.String()=%q; want %q", tc.e, got, tc.want)
+		}
+	}
+}
+
+func TestPosString(t *testing.T) {
+	if got, want := (Pos{Filename: "a.mk", Offset: 10, Line: 2, Column: 3}).String(), "a.mk:2:3"; got != want {
+		t.Errorf("Pos.String()=%q; want %q", got, want)
+	}
+	if got, want := (Pos{}).String(), "-"; got != want {
+		t.Errorf("Pos{}.String()=%q; want %q", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+var fuzzSeeds = []string{
+	"all:\n\techo $@\n",
+	"A := $(patsubst %.c,%.o,a.c b.c)\n$(info $(A))\n",
+	"define FOO\n$(1) $(2)\nendef\nX := $(call FOO,a,b)\n",
+	"ifeq ($(X),)\nY = 1\nelse ifdef Z\nY = 2\nendif\n",
+	"%.o: %.c | dir\n\tcc -c $< -o $@\nfoo: X := 1\nfoo.o: ; @:\n",
+	"a b:: c\n\ttouch $@\nvpath %.c src\nexport A B\n",
+	"x: y: z\n",
+	"$(foreach v,a b c,$(eval $(v) := $(v)))\n",
+	"a::=b\nc:=d\n",
+	// Inputs which used to crash kati.
+	"ifeq \"000",
+	"00$(0$()",
+	"$0 \n\t\n0000",
+	"\\",
+	"$(call  ",
+	":\\$",
+	"A=\x00$A;$\n$A;$",
+}
+
+// isFuzzUnsafe reports whether the makefile may touch outside world.
+func isFuzzUnsafe(mk []byte) bool {
+	for _, w := range []string{"shell", "include", "eval", "file", "load", "wildcard", "realpath", "abspath"} {
+		if bytes.Contains(mk, []byte(w)) {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzParseMakefile(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		if isFuzzUnsafe(in) {
+			t.Skip()
+		}
+		mk, err := parseMakefileBytes(in, srcpos{filename: "fuzz.mk", lineno: 1}, '\t')
+		if err != nil {
+			return
+		}
+		_, err = eval(mk, make(Vars), false)
+		if e, ok := err.(EvalError); ok && e.Stack != "" {
+			t.Fatalf("eval(%q): %v\n%s", in, e, e.Stack)
+		}
+	})
+}
+
+func TestParseMakefileKeepsInput(t *testing.T) {
+	seeds := append([]string{
+		"a: b$$c$$d\n\techo $$$$\n",
+		"a b: c ; echo $@ \\\n  $$x\n",
+	}, fuzzSeeds...)
+	for _, s := range seeds {
+		if isFuzzUnsafe([]byte(s)) {
+			continue
+		}
+		in := []byte(s)
+		mk, err := parseMakefile(in, "test.mk")
+		if err == nil {
+			eval(mk, make(Vars), false)
+		}
+		if string(in) != s {
+			t.Errorf("parseMakefile(%q) modified input to %q", s, in)
+		}
+	}
+}
+
+func genMakefile(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "LOCAL_SRC_FILES_%d := a%d.c \\\n\tb%d.c\n", i, i, i)
+		fmt.Fprintf(&buf, "out/%d.o: src/%d.c | out\n\t$(CC) -c $< -o $@ # %d\n", i, i, i)
+		fmt.Fprintf(&buf, "ifdef FOO_%d\n$(info $$FOO_%d)\nendif\n", i, i)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkParseMakefile(b *testing.B) {
+	in := genMakefile(1000)
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := parseMakefile(in, "bench.mk")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
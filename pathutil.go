@@ -19,11 +19,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -32,10 +34,45 @@ import (
 type wildcardCacheT struct {
 	mu     sync.Mutex
 	dirent map[string][]string
+	// subdir has names of subdirectories to descend into for "**".
+	subdir map[string][]string
+	// order has names of directories in directory order, recorded
+	// unless WildcardOrder is WildcardOrderSorted.
+	order map[string][]string
+	// fsFolding is how file systems match names by their devices,
+	// and dirFolding is by directories, for WildcardFoldAuto.
+	fsFolding  map[uint64]*fsFolding
+	dirFolding map[string]nameFolding
+	// mtime has modification times of directories when they were
+	// read, used if CheckWildcardCacheMtime or checkMtime is true.
+	mtime map[string]time.Time
+	// checkMtime is CheckWildcardCacheMtime of w, e.g. for a server
+	// not watching the file system.
+	checkMtime bool
+	// unwatched reports whether a directory is not watched while the
+	// file system is watched, whose mtime is checked. It is set
+	// before makefiles are evaluated.
+	unwatched func(dir string) bool
+	// snapshot is the find cache to read directories from its
+	// snapshot, if not nil.
+	snapshot *androidFindCacheT
+	// gen is incremented when entries are invalidated, so that
+	// readdirnames doesn't store names read before invalidation.
+	gen int
+
+	// hits and misses count lookups of directories. snapshotReads
+	// counts misses read from the snapshot.
+	hits, misses, snapshotReads int
 }
 
-var wildcardCache = &wildcardCacheT{
-	dirent: make(map[string][]string),
+var wildcardCache = newWildcardCache(&androidFindCache)
+
+func newWildcardCache(snapshot *androidFindCacheT) *wildcardCacheT {
+	return &wildcardCacheT{
+		dirent:   make(map[string][]string),
+		subdir:   make(map[string][]string),
+		snapshot: snapshot,
+	}
 }
 
 func (w *wildcardCacheT) dirs() int {
@@ -58,10 +95,6 @@ func hasWildcardMeta(pat string) bool {
 	return strings.IndexAny(pat, "*?[") >= 0
 }
 
-func hasWildcardMetaByte(pat []byte) bool {
-	return bytes.IndexAny(pat, "*?[") >= 0
-}
-
 func wildcardUnescape(pat string) string {
 	var buf bytes.Buffer
 	for i := 0; i < len(pat); i++ {
@@ -77,63 +110,318 @@ func wildcardUnescape(pat string) string {
 	return buf.String()
 }
 
+// cleanBuf builds a cleaned path. It doesn't allocate while the
+// result is a prefix of path.
+type cleanBuf struct {
+	path string
+	buf  []byte // nil while the result is path[:n].
+	n    int
+}
+
+func (b *cleanBuf) materialize() {
+	if b.buf == nil {
+		b.buf = make([]byte, b.n, len(b.path)+1)
+		copy(b.buf, b.path[:b.n])
+	}
+}
+
+func (b *cleanBuf) appendRange(s, e int) {
+	if b.buf == nil && s == b.n {
+		b.n = e
+		return
+	}
+	b.materialize()
+	b.buf = append(b.buf, b.path[s:e]...)
+}
+
+func (b *cleanBuf) appendSep() {
+	if b.buf == nil && b.n < len(b.path) && b.path[b.n] == filepath.Separator {
+		b.n++
+		return
+	}
+	b.materialize()
+	b.buf = append(b.buf, filepath.Separator)
+}
+
+func (b *cleanBuf) appendDot() {
+	b.materialize()
+	b.buf = append(b.buf, '.')
+}
+
+func (b *cleanBuf) String() string {
+	if b.buf == nil {
+		return b.path[:b.n]
+	}
+	return string(b.buf)
+}
+
+// nextSeparator returns the index of the first separator in path[i:],
+// or len(path) if not found.
+func nextSeparator(path string, i int) int {
+	for ; i < len(path); i++ {
+		if os.IsPathSeparator(path[i]) {
+			break
+		}
+	}
+	return i
+}
+
+// filepathClean cleans path. Unlike filepath.Clean, it keeps ".." since
+// "dir/.." is not the same as "." if dir is a symlink.
+// It removes "." elements and collapses multiple separators, but keeps
+// the leading "./", "/." and the trailing separator, and cleans an
+// empty path or a path starting with multiple separators relative to
+// ".". A volume name, e.g. "C:" or `\\host\share` on windows, is kept
+// with the first element, or with the root separator if it is followed
+// by separators. It doesn't allocate if path is already clean.
 func filepathClean(path string) string {
 	if path == "" {
 		return "."
 	}
-	dir, file := filepath.Split(path)
-	if dir == "" {
-		return file
+	v := volumeNameLen(path)
+	i := nextSeparator(path, v)
+	if i == len(path) {
+		return path
 	}
-	if dir == string(filepath.Separator) {
-		return dir + file
+	b := cleanBuf{path: path}
+	if i > v {
+		b.appendRange(0, i)
+	} else {
+		j := i
+		for j < len(path) && os.IsPathSeparator(path[j]) {
+			j++
+		}
+		switch {
+		case v > 0:
+			// the root of the volume, e.g. "C:\\".
+			b.appendRange(0, v)
+			b.appendSep()
+			i = nextSeparator(path, j)
+			b.appendRange(j, i)
+		case j == 1:
+			// the first element after the root is kept as is.
+			i = nextSeparator(path, j)
+			b.appendRange(0, i)
+		default:
+			b.appendDot()
+		}
 	}
-	dir = strings.TrimRight(dir, string(filepath.Separator))
-	dir = filepathClean(dir)
-	if file == "." {
-		return dir
+	// TODO(ukai): when an element is "..", and the previous element
+	// is not symlink, we can remove "..".
+	for i < len(path) {
+		j := i
+		for j < len(path) && os.IsPathSeparator(path[j]) {
+			j++
+		}
+		k := nextSeparator(path, j)
+		if path[j:k] != "." {
+			b.appendSep()
+			b.appendRange(j, k)
+		}
+		i = k
 	}
-	// TODO(ukai): when file == "..", and dir is not symlink,
-	// we can remove "..".
-	return dir + string(filepath.Separator) + file
+	return b.String()
 }
 
 func (w *wildcardCacheT) readdirnames(dir string) []string {
 	dir = filepathClean(dir)
+	checkMtime := CheckWildcardCacheMtime || w.checkMtime || (w.unwatched != nil && w.unwatched(dir))
+	var mtime time.Time
+	if checkMtime {
+		if fi, err := os.Stat(dir); err == nil {
+			mtime = fi.ModTime()
+		}
+	}
 	w.mu.Lock()
 	names, ok := w.dirent[dir]
+	if ok && checkMtime && !w.mtime[dir].Equal(mtime) {
+		glog.V(1).Infof("wildcard cache: %s modified", dir)
+		ok = false
+		w.gen++
+		delete(w.dirent, dir)
+		delete(w.subdir, dir)
+		delete(w.order, dir)
+		if w.snapshot != nil {
+			w.snapshot.invalidate(dir)
+		}
+	}
+	gen := w.gen
+	if ok {
+		w.hits++
+	} else {
+		w.misses++
+	}
 	w.mu.Unlock()
 	if ok {
 		return names
 	}
-	d, err := os.Open(dir)
-	if err != nil {
+	names = nil
+	var order []string
+	if w.snapshot != nil {
+		names, ok = w.snapshot.readdirnames(dir)
+	}
+	if ok {
 		w.mu.Lock()
-		w.dirent[dir] = nil
+		w.snapshotReads++
 		w.mu.Unlock()
-		return nil
+	} else {
+		d, err := os.Open(dir)
+		if err == nil {
+			names, _ = d.Readdirnames(-1)
+			d.Close()
+			if WildcardOrder != "" && WildcardOrder != WildcardOrderSorted {
+				order = append([]string(nil), names...)
+			}
+			sort.Strings(names)
+		}
 	}
-	defer d.Close()
-	names, _ = d.Readdirnames(-1)
-	sort.Strings(names)
 	w.mu.Lock()
-	w.dirent[dir] = names
+	if w.gen == gen {
+		w.dirent[dir] = names
+		if order != nil {
+			if w.order == nil {
+				w.order = make(map[string][]string)
+			}
+			w.order[dir] = order
+		}
+		if checkMtime {
+			if w.mtime == nil {
+				w.mtime = make(map[string]time.Time)
+			}
+			w.mtime[dir] = mtime
+		}
+	}
 	w.mu.Unlock()
 	return names
 }
 
+// Invalidate invalidates cached entries of dir, so that the next
+// glob reads dir again. dir may be absolute or relative to the current
+// directory.
+func (w *wildcardCacheT) Invalidate(dir string) {
+	w.invalidate(dir, false)
+}
+
+// InvalidateAll invalidates all cached entries.
+func (w *wildcardCacheT) InvalidateAll() {
+	if w.snapshot != nil {
+		w.snapshot.invalidate(".")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.gen++
+	w.dirent = make(map[string][]string)
+	w.subdir = nil
+	w.order = nil
+	w.mtime = nil
+	w.fsFolding = nil
+	w.dirFolding = nil
+}
+
+// InvalidateWildcardCache invalidates the cache of $(wildcard) for
+// entries of dir, e.g. when a long running process knows files are
+// created or removed in dir.
+func InvalidateWildcardCache(dir string) {
+	wildcardCache.Invalidate(dir)
+}
+
+// InvalidateAllWildcardCache invalidates all entries of the cache of
+// $(wildcard).
+func InvalidateAllWildcardCache() {
+	wildcardCache.InvalidateAll()
+}
+
+// invalidate invalidates cached entries of dir. If recursive is true,
+// entries of its subdirectories are also invalidated. dir may be
+// absolute or relative to the current directory.
+func (w *wildcardCacheT) invalidate(dir string, recursive bool) {
+	keys := []string{filepathClean(dir)}
+	if wd, err := os.Getwd(); err == nil {
+		if filepath.IsAbs(dir) {
+			if rel, err := filepath.Rel(wd, dir); err == nil {
+				keys = append(keys, filepathClean(rel))
+			}
+		} else {
+			keys = append(keys, filepathClean(filepath.Join(wd, dir)))
+		}
+	}
+	if w.snapshot != nil {
+		w.snapshot.invalidate(dir)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.gen++
+	for _, key := range keys {
+		delete(w.dirent, key)
+		delete(w.subdir, key)
+		delete(w.order, key)
+	}
+	if !recursive {
+		return
+	}
+	for _, m := range []map[string][]string{w.dirent, w.subdir, w.order} {
+		for d := range m {
+			for _, key := range keys {
+				if key == "." && !filepath.IsAbs(d) || strings.HasPrefix(d, key+string(filepath.Separator)) {
+					delete(m, d)
+					break
+				}
+			}
+		}
+	}
+}
+
+// subdirs returns sorted names of subdirectories of dir which "**"
+// descends into. As shells do, it doesn't descend into hidden
+// directories, nor symlinks to directories to avoid loops.
+func (w *wildcardCacheT) subdirs(dir string) []string {
+	key := filepathClean(dir)
+	// readdirnames drops subdirs of dir if dir is modified.
+	names := w.readdirnames(dir)
+	w.mu.Lock()
+	subdirs, ok := w.subdir[key]
+	gen := w.gen
+	w.mu.Unlock()
+	if ok {
+		return subdirs
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		if err == nil && fi.IsDir() {
+			subdirs = append(subdirs, name)
+		}
+	}
+	w.mu.Lock()
+	if w.gen == gen {
+		if w.subdir == nil {
+			w.subdir = make(map[string][]string)
+		}
+		w.subdir[key] = subdirs
+	}
+	w.mu.Unlock()
+	return subdirs
+}
+
 // glob searches for files matching pattern in the directory dir
 // and appends them to matches. ignore I/O errors.
 func (w *wildcardCacheT) glob(dir, pattern string, matches []string) ([]string, error) {
 	names := w.readdirnames(dir)
-	switch dir {
-	case "", string(filepath.Separator):
-		// nothing
-	default:
-		dir += string(filepath.Separator) // add trailing separator back
+	f := w.nameFolding(dir, names)
+	if !isGlobRoot(dir) {
+		dir += "/" // add trailing separator back
+	}
+	g := matcherCache.globPattern(pattern)
+	if g.kind == globLiteral {
+		return w.globLiteral(dir, g.prefix, names, matches, f), nil
+	}
+	if f.folds() {
+		g = matcherCache.globPattern(f.fold(pattern))
 	}
 	for _, n := range names {
-		matched, err := filepath.Match(pattern, n)
+		matched, err := g.match(f.fold(n))
 		if err != nil {
 			return nil, err
 		}
@@ -144,16 +432,86 @@ func (w *wildcardCacheT) glob(dir, pattern string, matches []string) ([]string,
 	return matches, nil
 }
 
+// globLiteral appends dir+name to matches if name exists in names.
+// On case insensitive file systems, or ones folding names by f, name
+// matches a file whose name differs only in case or normalization,
+// and name is appended as is, as a shell doesn't rewrite a word
+// without wildcards and stat(2) finds the file.
+func (w *wildcardCacheT) globLiteral(dir, name string, names, matches []string, f nameFolding) []string {
+	i := sort.SearchStrings(names, name)
+	if i < len(names) && names[i] == name {
+		return append(matches, dir+name)
+	}
+	if !CaseInsensitiveFS && !f.folds() {
+		return matches
+	}
+	folded := f.fold(name)
+	for _, n := range names {
+		if CaseInsensitiveFS && strings.EqualFold(n, name) || f.folds() && f.fold(n) == folded {
+			return append(matches, dir+name)
+		}
+	}
+	return matches
+}
+
+// nameFolding returns how names of dir, which are names, are matched
+// by WildcardFold.
+func (w *wildcardCacheT) nameFolding(dir string, names []string) nameFolding {
+	switch WildcardFold {
+	case WildcardFoldOn:
+		return nameFolding{caseInsensitive: true, normInsensitive: true}
+	case WildcardFoldAuto:
+	default:
+		return nameFolding{}
+	}
+	dir = filepathClean(dir)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if f, ok := w.dirFolding[dir]; ok {
+		return f
+	}
+	fs := &fsFolding{}
+	if fi, err := os.Stat(dir); err == nil {
+		if dev, ok := deviceID(fi); ok {
+			if w.fsFolding == nil {
+				w.fsFolding = make(map[uint64]*fsFolding)
+			}
+			if w.fsFolding[dev] == nil {
+				w.fsFolding[dev] = fs
+			}
+			fs = w.fsFolding[dev]
+		}
+	}
+	fs.probe(dir, names)
+	f := fs.folding()
+	if w.dirFolding == nil {
+		w.dirFolding = make(map[string]nameFolding)
+	}
+	w.dirFolding[dir] = f
+	return f
+}
+
+// exists reports whether the file at path exists, by names of its
+// directory in the cache.
+func (w *wildcardCacheT) exists(path string) bool {
+	dir, name := filepath.Split(path)
+	if name == "" {
+		return false
+	}
+	dir = filepath.Clean(dir)
+	names := w.readdirnames(dir)
+	return len(w.globLiteral("", name, names, nil, w.nameFolding(dir, names))) > 0
+}
+
 func (w *wildcardCacheT) Glob(pat string) ([]string, error) {
-	// TODO(ukai): expand ~ to user's home directory.
 	// TODO(ukai): use find cache for glob if exists
 	// or use wildcardCache for find cache.
 	pat = wildcardUnescape(pat)
+	if i := globStarIndex(pat); i >= 0 {
+		return w.globStar(pat[:i], pat[i+2:])
+	}
 	dir, file := filepath.Split(pat)
-	switch dir {
-	case "", string(filepath.Separator):
-		// nothing
-	default:
+	if !isGlobRoot(dir) {
 		dir = dir[:len(dir)-1] // chop off trailing separator
 	}
 	if !hasWildcardMeta(dir) {
@@ -174,29 +532,264 @@ func (w *wildcardCacheT) Glob(pat string) ([]string, error) {
 	return matches, nil
 }
 
-func wildcard(w evalWriter, pat string) error {
-	files, err := wildcardCache.Glob(pat)
+// globStarIndex returns the index of the first "**" element of pat,
+// or -1 if pat has no "**" element.
+func globStarIndex(pat string) int {
+	for i := 0; i+1 < len(pat); i++ {
+		if pat[i] != '*' || pat[i+1] != '*' {
+			continue
+		}
+		if (i == 0 || os.IsPathSeparator(pat[i-1])) && (i+2 == len(pat) || os.IsPathSeparator(pat[i+2])) {
+			return i
+		}
+	}
+	return -1
+}
+
+// globStar globs dir+"**"+rest. "**" matches zero or more
+// directories, e.g. "src/**/*.c" matches "src/a.c" and "src/x/y/b.c".
+// "**" at the end matches all files and directories under dir.
+// Directories are read by the cache, so a repeated glob doesn't walk
+// the tree again.
+func (w *wildcardCacheT) globStar(dir, rest string) ([]string, error) {
+	if !isGlobRoot(dir) {
+		dir = dir[:len(dir)-1] // chop off trailing separator
+	}
+	if rest != "" {
+		rest = rest[1:] // chop off leading separator
+	}
+	dirs := []string{dir}
+	if hasWildcardMeta(dir) {
+		var err error
+		dirs, err = w.Glob(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var matches []string
+	for _, d := range dirs {
+		var err error
+		matches, err = w.globStarDir(d, rest, matches)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// globStarDir appends files matching rest in dir and its
+// subdirectories to matches.
+func (w *wildcardCacheT) globStarDir(dir, rest string, matches []string) ([]string, error) {
+	prefix := dir
+	if !isGlobRoot(dir) {
+		prefix += "/"
+	}
+	if dir == "" {
+		dir = "."
+	}
+	subdirs := w.subdirs(dir)
+	if rest == "" {
+		for _, name := range w.readdirnames(dir) {
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			matches = append(matches, prefix+name)
+			if len(subdirs) > 0 && subdirs[0] == name {
+				subdirs = subdirs[1:]
+				var err error
+				matches, err = w.globStarDir(prefix+name, rest, matches)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return matches, nil
+	}
+	m, err := w.Glob(prefix + rest)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	matches = append(matches, m...)
+	for _, name := range subdirs {
+		matches, err = w.globStarDir(prefix+name, rest, matches)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// isGlobRoot reports whether dir is empty or a root directory, e.g. "/"
+// or "C:\\", which keeps its trailing separator. A volume name without
+// a separator, e.g. "C:", is also kept as is, since it means the
+// current directory of the drive.
+func isGlobRoot(dir string) bool {
+	v := len(filepath.VolumeName(dir))
+	switch len(dir) - v {
+	case 0:
+		return true
+	case 1:
+		return os.IsPathSeparator(dir[v])
 	}
-	for _, file := range files {
+	return false
+}
+
+// expandTilde expands a leading "~" or "~user" of pat to the home
+// directory as GNU make does. home returns $(HOME), which is used for
+// "~". If it is empty, $HOME of kati or the home directory of the
+// current user is used. If user is unknown, pat is returned as is.
+func expandTilde(pat string, home func() string) string {
+	if !strings.HasPrefix(pat, "~") {
+		return pat
+	}
+	i := nextSeparator(pat, 1)
+	var dir string
+	if name := pat[1:i]; name == "" {
+		dir = home()
+		if dir == "" {
+			dir = os.Getenv("HOME")
+		}
+		if dir == "" {
+			if u, err := user.Current(); err == nil {
+				dir = u.HomeDir
+			}
+		}
+	} else if u, err := user.Lookup(name); err == nil {
+		dir = u.HomeDir
+	}
+	if dir == "" {
+		return pat
+	}
+	return dir + pat[i:]
+}
+
+// wildcard writes files matching pat, ordered by WildcardOrder, and
+// returns them sorted. In WildcardOrderCheck, it also returns the files
+// in directory order if the order differs from the sorted one.
+func (s *Session) wildcard(w evalWriter, pat string) (files, unsorted []string, err error) {
+	files, err = s.wildcardCache.Glob(pat)
+	if err != nil {
+		return nil, nil, err
+	}
+	written := files
+	switch WildcardOrder {
+	case WildcardOrderDirectory:
+		written = s.wildcardCache.directoryOrder(files)
+	case WildcardOrderCheck:
+		d := s.wildcardCache.directoryOrder(files)
+		for i := range d {
+			if d[i] != files[i] {
+				unsorted = d
+				break
+			}
+		}
+	}
+	for _, file := range written {
 		w.writeWordString(file)
 	}
-	return nil
+	return files, unsorted, nil
+}
+
+// directoryOrder returns files which Glob returned, ordering names in
+// each directory in directory order as glob(3) of GNU make 3.82 to 4.2
+// does. Directories read from the find cache are kept sorted.
+func (w *wildcardCacheT) directoryOrder(files []string) []string {
+	r := append([]string(nil), files...)
+	for i := 0; i < len(r); {
+		dir := filepath.Dir(r[i])
+		j := i + 1
+		for j < len(r) && filepath.Dir(r[j]) == dir {
+			j++
+		}
+		w.mu.Lock()
+		order := w.order[filepathClean(dir)]
+		w.mu.Unlock()
+		if j-i > 1 && order != nil {
+			index := make(map[string]int, len(order))
+			for k, name := range order {
+				index[name] = k
+			}
+			run := r[i:j]
+			sort.SliceStable(run, func(a, b int) bool {
+				return index[filepath.Base(run[a])] < index[filepath.Base(run[b])]
+			})
+		}
+		i = j
+	}
+	return r
+}
+
+// Orders of names in a directory which $(wildcard) returns.
+const (
+	// WildcardOrderSorted sorts names, as GNU make 3.81 and 4.3 or
+	// later do.
+	WildcardOrderSorted = "sorted"
+	// WildcardOrderDirectory keeps names in directory order, as GNU
+	// make 3.82 to 4.2 do. The order depends on file systems.
+	WildcardOrderDirectory = "directory"
+	// WildcardOrderCheck sorts names, and warns about $(wildcard)
+	// whose result differs in directory order, e.g. linker inputs of
+	// makefiles depending on the first match.
+	WildcardOrderCheck = "check"
+)
+
+func validWildcardOrder(order string) error {
+	switch order {
+	case "", WildcardOrderSorted, WildcardOrderDirectory, WildcardOrderCheck:
+		return nil
+	}
+	return fmt.Errorf("unknown wildcard order %q", order)
 }
 
 type fileInfo struct {
-	path string
-	mode os.FileMode
+	path  string
+	mode  os.FileMode
+	mtime int64 // modification time in nanoseconds.
 }
 
 type androidFindCacheT struct {
 	once     sync.Once
 	filesch  chan []fileInfo
 	leavesch chan []fileInfo
-	files    []fileInfo
-	leaves   []fileInfo
-	scanTime time.Duration
+	// readyMu guards receiving files and leaves, which are read
+	// freely once received, as concurrent evaluations may wait for
+	// the scan at once.
+	readyMu sync.Mutex
+	files   []fileInfo
+	leaves  []fileInfo
+	// pruned are sorted directories pruned by the scan. It is set
+	// before files are sent to filesch.
+	pruned []string
+	// links are what symlinks resolve to by their paths. It is set
+	// before files and leaves are sent.
+	links map[string]findCacheLink
+	// stale is set to 1 when files are changed after the scan, until
+	// the tree is scanned again.
+	stale int32
+	// loads is the number of running loads, guarded by loadMu. The
+	// tree is scanned again only when no load is running.
+	loadMu sync.Mutex
+	loads  int
+	// snapshot is the index of the scanned files for the wildcard
+	// cache.
+	snapshot snapshotT
+
+	prunes    []string
+	leafNames []string
+	// ignore are the ignore patterns of the scan.
+	ignore findCacheIgnore
+	// roots are the extra roots scanned with the tree. see
+	// findcache_roots.go
+	roots findCacheRoots
+	// lazy is the running scan, which answers queries before it
+	// finishes. see findcache_lazy.go
+	topsMu sync.Mutex
+	lazy   *lazyScan
+	// scanning is done when the running scan finishes.
+	scanning sync.WaitGroup
+
+	statsMu sync.Mutex
+	stats   FindCacheStats
 }
 
 var (
@@ -209,175 +802,319 @@ func AndroidFindCacheInit(prunes, leafNames []string) {
 	if !UseFindCache {
 		return
 	}
-	if leafNames != nil {
-		androidDefaultLeafNames = leafNames
-	}
-	androidFindCache.init(prunes)
+	DefaultSession.InitAndroidFindCache(prunes, leafNames)
 }
 
 func (c *androidFindCacheT) ready() bool {
-	if !UseFindCache {
+	if !UseFindCache || atomic.LoadInt32(&c.stale) != 0 {
 		return false
 	}
-	if c.files != nil {
-		return true
-	}
-	select {
-	case c.files = <-c.filesch:
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+	if c.files == nil {
+		c.files = <-c.filesch
 	}
 	return c.files != nil
 }
 
 func (c *androidFindCacheT) leavesReady() bool {
-	if !UseFindCache {
+	if !UseFindCache || atomic.LoadInt32(&c.stale) != 0 {
 		return false
 	}
-	if c.leaves != nil {
-		return true
-	}
-	select {
-	case c.leaves = <-c.leavesch:
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+	if c.leaves == nil {
+		c.leaves = <-c.leavesch
 	}
 	return c.leaves != nil
 }
 
+// invalidate marks the cache stale if path is in the scanned tree, i.e.
+// the current directory, or an extra root. A stale cache is not used,
+// and find commands run in the shell, until the next load scans the
+// tree again.
+func (c *androidFindCacheT) invalidate(path string) {
+	p, ok := c.roots.cachePath(path)
+	if !ok {
+		return
+	}
+	root := c.roots.rootOf(p)
+	rel := p
+	if root != "." {
+		rel = strings.TrimPrefix(p[len(root):], "/")
+	}
+	// changes in pruned directories, e.g. out, don't matter.
+	if c.underPrune(rel) {
+		return
+	}
+	if root == "." && c.ignore.underIgnored(p) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.stale, 0, 1) {
+		glog.Infof("find cache: %s changed", path)
+	}
+}
+
+// underPrune reports whether rel, a path relative to a root of the
+// scan, is a pruned directory or under one.
+func (c *androidFindCacheT) underPrune(rel string) bool {
+	for _, elem := range strings.Split(rel, "/") {
+		for _, prune := range c.prunes {
+			if elem == prune {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *androidFindCacheT) init(prunes []string) {
 	if !UseFindCache {
 		return
 	}
 	c.once.Do(func() {
-		c.filesch = make(chan []fileInfo, 1)
-		c.leavesch = make(chan []fileInfo, 1)
-		go c.start(prunes, androidDefaultLeafNames)
+		c.prunes = prunes
+		c.leafNames = androidDefaultLeafNames
+		c.ignore = newFindCacheIgnore(FindCacheIgnore)
+		c.roots = newFindCacheRoots(FindCacheRoots)
+		c.scan()
 	})
 }
 
+func (c *androidFindCacheT) scan() {
+	c.filesch = make(chan []fileInfo, 1)
+	c.leavesch = make(chan []fileInfo, 1)
+	c.scanning.Add(1)
+	go func() {
+		defer c.scanning.Done()
+		c.start(c.prunes, c.leafNames)
+	}()
+}
+
+// beginLoad starts a load, which evaluates makefiles with the cache.
+// If the cache is stale and no other load is running, it scans the tree
+// again. It returns the function to end the load.
+func (c *androidFindCacheT) beginLoad() (end func()) {
+	c.loadMu.Lock()
+	if c.loads == 0 {
+		c.rescan()
+	}
+	c.loads++
+	c.loadMu.Unlock()
+	return func() {
+		c.loadMu.Lock()
+		c.loads--
+		c.loadMu.Unlock()
+	}
+}
+
+// rescan scans the tree again if the cache is stale, to keep the cache
+// of a long running process. It must not be called while makefiles are
+// evaluated. see beginLoad
+func (c *androidFindCacheT) rescan() {
+	if !UseFindCache || c.filesch == nil || atomic.LoadInt32(&c.stale) == 0 {
+		return
+	}
+	c.scanning.Wait()
+	c.files = nil
+	c.leaves = nil
+	c.pruned = nil
+	c.links = nil
+	c.snapshot.mu.Lock()
+	c.snapshot.s = nil
+	c.snapshot.mu.Unlock()
+	// changes after this are not missed by the new scan.
+	atomic.StoreInt32(&c.stale, 0)
+	glog.Infof("find cache rescan")
+	c.scan()
+}
+
 func (c *androidFindCacheT) start(prunes, leafNames []string) {
-	glog.Infof("find cache init: prunes=%q leafNames=%q", prunes, leafNames)
+	ignore := c.ignore
+	glog.Infof("find cache init: prunes=%q leafNames=%q ignore=%q roots=%q", prunes, leafNames, ignore.patterns, c.roots.paths)
 	te := traceEvent.begin("findcache", literal("init"), traceEventFindCache)
 	defer func() {
 		traceEvent.end(te)
-		c.scanTime = time.Since(te.t)
-		logStats("android find cache scan: %v", c.scanTime)
+		scanTime := time.Since(te.t)
+		c.statsMu.Lock()
+		c.stats.ScanTime = scanTime
+		c.statsMu.Unlock()
+		logStats("android find cache scan: %v", scanTime)
 	}()
+	if FindCacheFile != "" && c.load(FindCacheFile, prunes, leafNames, ignore.patterns) {
+		return
+	}
+	var topMtime int64
+	if fi, err := os.Lstat("."); err == nil {
+		topMtime = fi.ModTime().UnixNano()
+	}
+
+	curdir, err := os.Open(".")
+	if err != nil {
+		glog.Warningf("open . failed: %v", err)
+		close(c.filesch)
+		close(c.leavesch)
+		return
+	}
+	entries, err := curdir.Readdir(-1)
+	if err != nil {
+		glog.Warningf("readdir . failed: %v", err)
+		close(c.filesch)
+		close(c.leavesch)
+		return
+	}
+	curdir.Close()
+
+	l := newLazyScan(findCacheScanner{
+		prunes:    prunes,
+		leafNames: leafNames,
+		ignore:    ignore,
+		roots:     c.roots,
+		wds:       findCacheWds(),
+	}, entries)
+	order := l.order
+	topdirs := make(chan *topScan, 32)
+	c.topsMu.Lock()
+	c.lazy = l
+	c.topsMu.Unlock()
 
-	dirs := make(chan string, 32)
-	filech := make(chan fileInfo, 1000)
-	leafch := make(chan fileInfo, 1000)
 	var wg sync.WaitGroup
 	numWorker := runtime.NumCPU() - 1
+	if numWorker < 1 {
+		// no directories would be scanned.
+		numWorker = 1
+	}
 	wg.Add(numWorker)
 	for i := 0; i < numWorker; i++ {
 		go func() {
 			defer wg.Done()
-			for dir := range dirs {
-				err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-					if info.IsDir() {
-						for _, prune := range prunes {
-							if info.Name() == prune {
-								glog.V(1).Infof("find cache prune: %s", path)
-								return filepath.SkipDir
-							}
-						}
-					}
-					filech <- fileInfo{
-						path: path,
-						mode: info.Mode(),
-					}
-					for _, leaf := range leafNames {
-						if info.Name() == leaf {
-							glog.V(1).Infof("find cache leaf: %s", path)
-							leafch <- fileInfo{
-								path: path,
-								mode: info.Mode(),
-							}
-							break
-						}
-					}
-					return nil
-				})
-				if err != nil && err != filepath.SkipDir {
-					glog.Warningf("error in adnroid find cache: %v", err)
-					close(c.filesch)
-					close(c.leavesch)
-					return
+			for ts := range topdirs {
+				// tops queried before are scanned by the queries.
+				if ts.claim() {
+					l.scanner.scan(ts)
 				}
 			}
 		}()
 	}
+	for _, ts := range order {
+		topdirs <- ts
+	}
+	close(topdirs)
+	wg.Wait()
 
-	go func() {
-		dirs := make(map[string]bool)
-		leavesTe := traceEvent.begin("findcache", literal("leaves"), traceEventFindCacheLeaves)
-		var leaves []fileInfo
-		nfiles := 0
-		for leaf := range leafch {
-			leaves = append(leaves, leaf)
-			nfiles++
-			for dir := filepath.Dir(leaf.path); dir != "."; dir = filepath.Dir(dir) {
-				if dirs[dir] {
-					break
-				}
-				leaves = append(leaves, fileInfo{
-					path: dir,
-					mode: leaf.mode | os.ModeDir,
-				})
-				dirs[dir] = true
-			}
-		}
-		sort.Sort(fileInfoByLeaf(leaves))
-		c.leavesch <- leaves
-		traceEvent.end(leavesTe)
-		logStats("%d leaves %d dirs in find cache", nfiles, len(dirs))
-		if !glog.V(1) {
+	// pruned and dirs are collected from tops for the snapshot and
+	// the find cache file.
+	var files, leaves []fileInfo
+	var pruned []string
+	dirs := []findCacheDirMtime{{Path: ".", Mtime: topMtime}}
+	links := make(map[string]findCacheLink)
+	for _, ts := range order {
+		<-ts.done
+		if ts.err != nil {
+			glog.Warningf("error in adnroid find cache: %v", ts.err)
+			c.topsMu.Lock()
+			c.lazy = nil
+			c.topsMu.Unlock()
+			close(c.filesch)
+			close(c.leavesch)
 			return
 		}
-		for i, leaf := range leaves {
-			glog.Infof("android findleaves cache: %d: %s %v", i, leaf.path, leaf.mode)
+		files = append(files, ts.files...)
+		leaves = append(leaves, ts.leaves...)
+		pruned = append(pruned, ts.pruned...)
+		dirs = append(dirs, ts.dirs...)
+		for p, l := range ts.links {
+			links[p] = l
 		}
-	}()
+	}
+	c.topsMu.Lock()
+	c.lazy = nil
+	c.topsMu.Unlock()
 
-	go func() {
-		filesTe := traceEvent.begin("findcache", literal("files"), traceEventFindCacheFiles)
-		var files []fileInfo
-		for file := range filech {
-			files = append(files, file)
-		}
-		sort.Sort(fileInfoByName(files))
-		c.filesch <- files
-		traceEvent.end(filesTe)
-		logStats("%d files in find cache", len(files))
-		if !glog.V(1) {
-			return
-		}
-		for i, fi := range files {
-			glog.Infof("android find cache: %d: %s %v", i, fi.path, fi.mode)
-		}
-	}()
+	leavesTe := traceEvent.begin("findcache", literal("leaves"), traceEventFindCacheLeaves)
+	leaves = addLeafDirs(leaves)
+	traceEvent.end(leavesTe)
 
-	curdir, err := os.Open(".")
-	if err != nil {
-		glog.Warningf("open . failed: %v", err)
-		close(c.filesch)
-		close(c.leavesch)
-		return
+	filesTe := traceEvent.begin("findcache", literal("files"), traceEventFindCacheFiles)
+	sort.Sort(fileInfoByName(files))
+	sort.Strings(pruned)
+	c.pruned = pruned
+	c.links = links
+	c.filesch <- files
+	c.leavesch <- leaves
+	traceEvent.end(filesTe)
+	logStats("%d files in find cache", len(files))
+	c.setScanStats(len(dirs), len(files), false)
+	c.setSnapshot(newFSSnapshot(files, pruned, dirs))
+	if FindCacheFile != "" {
+		err := saveFindCacheFile(FindCacheFile, findCacheFile{
+			Prunes:    prunes,
+			LeafNames: leafNames,
+			Ignore:    ignore.patterns,
+			Roots:     c.roots.paths,
+			files:     files,
+			Dirs:      dirs,
+			Pruned:    pruned,
+			Links:     links,
+		})
+		if err != nil {
+			glog.Warningf("save find cache %s: %v", FindCacheFile, err)
+		}
 	}
-	names, err := curdir.Readdirnames(-1)
-	if err != nil {
-		glog.Warningf("readdir . failed: %v", err)
-		close(c.filesch)
-		close(c.leavesch)
+	if !glog.V(1) {
 		return
 	}
-	curdir.Close()
+	for i, fi := range files {
+		glog.Infof("android find cache: %d: %s %v", i, fi.path, fi.mode)
+	}
+}
 
-	for _, name := range names {
-		dirs <- name
+// addLeafDirs adds parent directories of leaves, and sorts them for
+// findleaves. Parents of extra roots out of the tree are added up to
+// the one below ".." or the file system root, which findleaves of the
+// tree doesn't descend into.
+func addLeafDirs(leaves []fileInfo) []fileInfo {
+	dirs := make(map[string]bool)
+	nfiles := len(leaves)
+	for _, leaf := range leaves[:nfiles] {
+		for dir := slashDir(leaf.path); dir != "." && dir != ".." && slashDir(dir) != dir; dir = slashDir(dir) {
+			if dirs[dir] {
+				break
+			}
+			leaves = append(leaves, fileInfo{
+				path: dir,
+				mode: leaf.mode&os.ModePerm | os.ModeDir,
+			})
+			dirs[dir] = true
+		}
 	}
-	close(dirs)
-	wg.Wait()
-	close(filech)
-	close(leafch)
+	sort.Sort(fileInfoByLeaf(leaves))
+	logStats("%d leaves %d dirs in find cache", nfiles, len(dirs))
+	if glog.V(1) {
+		for i, leaf := range leaves {
+			glog.Infof("android findleaves cache: %d: %s %v", i, leaf.path, leaf.mode)
+		}
+	}
+	return leaves
+}
+
+// isFSNoise reports whether name is a file created by a file manager
+// etc., which is not a part of source trees, e.g. .DS_Store of Finder.
+// find commands served by the find cache exclude these files, so
+// changes of them don't invalidate caches.
+func isFSNoise(name string) bool {
+	return name == ".DS_Store"
+}
+
+// slashClean is filepath.Clean for paths in the find cache, which are
+// separated by '/' on any platform.
+func slashClean(p string) string {
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+// slashDir is filepath.Dir for paths in the find cache.
+func slashDir(p string) string {
+	return filepath.ToSlash(filepath.Dir(p))
 }
 
 type fileInfoByName []fileInfo
@@ -398,8 +1135,8 @@ func (f fileInfoByLeaf) Less(i, j int) bool {
 	if di != dj {
 		return di < dj
 	}
-	diri := filepath.Dir(f[i].path) + "/"
-	dirj := filepath.Dir(f[j].path) + "/"
+	diri := slashDir(f[i].path) + "/"
+	dirj := slashDir(f[j].path) + "/"
 	if diri != dirj {
 		return diri < dirj
 	}
@@ -419,6 +1156,7 @@ func (c *androidFindCacheT) walk(dir string, walkFn func(int, fileInfo) error) e
 	})
 	glog.V(1).Infof("android find in dir cache: %s i=%d/%d", dir, i, len(c.files))
 	start := i
+	dirPrefix := dir + "/"
 	var skipdirs []string
 Loop:
 	for i := start; i < len(c.files); i++ {
@@ -433,7 +1171,7 @@ Loop:
 			glog.V(1).Infof("android find in dir cache: %s end=%d/%d", dir, i, len(c.files))
 			return nil
 		}
-		if !strings.HasPrefix(c.files[i].path, dir+"/") {
+		if !strings.HasPrefix(c.files[i].path, dirPrefix) {
 			continue
 		}
 		for _, skip := range skipdirs {
@@ -459,8 +1197,10 @@ Loop:
 // find-subdir-assets
 // if [ -d $1 ] ; then cd $1 ; find ./ -not -name '.*' -and -type f -and -not -type l ; fi
 func (c *androidFindCacheT) findInDir(w evalWriter, dir string) {
-	dir = filepath.Clean(dir)
+	dir = slashClean(dir)
 	glog.V(1).Infof("android find in dir cache: %s", dir)
+	dirPrefix := dir + "/"
+	var name []byte
 	c.walk(dir, func(_ int, fi fileInfo) error {
 		// -not -name '.*'
 		if strings.HasPrefix(filepath.Base(fi.path), ".") {
@@ -471,10 +1211,12 @@ func (c *androidFindCacheT) findInDir(w evalWriter, dir string) {
 		if !fi.mode.IsRegular() {
 			return nil
 		}
-		name := strings.TrimPrefix(fi.path, dir+"/")
-		name = "./" + name
-		w.writeWordString(name)
-		glog.V(1).Infof("android find in dir cache: %s=> %s", dir, name)
+		name = append(name[:0], "./"...)
+		name = append(name, strings.TrimPrefix(fi.path, dirPrefix)...)
+		w.writeWord(name)
+		if glog.V(1) {
+			glog.Infof("android find in dir cache: %s=> %s", dir, name)
+		}
 		return nil
 	})
 }
@@ -482,39 +1224,35 @@ func (c *androidFindCacheT) findInDir(w evalWriter, dir string) {
 // pattern in repo/android/build/core/definitions.mk
 // all-java-files-under etc
 // cd ${LOCAL_PATH} ; find -L $1 -name "*<ext>" -and -not -name ".*"
-// returns false if symlink is found.
+// returns false if the cache can't answer, e.g. a symlink to a
+// directory out of the tree is found.
 func (c *androidFindCacheT) findExtFilesUnder(w evalWriter, chdir, root, ext string) bool {
-	chdir = filepath.Clean(chdir)
-	dir := filepath.Join(chdir, root)
+	chdir = slashClean(chdir)
+	dir := filepath.ToSlash(filepath.Join(chdir, root))
 	glog.V(1).Infof("android find %s in dir cache: %s %s", ext, chdir, root)
-	// check symlinks
-	var matches []int
-	err := c.walk(dir, func(i int, fi fileInfo) error {
-		if fi.mode&os.ModeSymlink == os.ModeSymlink {
-			glog.Warningf("android find %s in dir cache: detect symlink %s %v", ext, c.files[i].path, c.files[i].mode)
-			return fmt.Errorf("symlink %s", fi.path)
-		}
-		matches = append(matches, i)
-		return nil
-	})
-	if err != nil {
-		return false
-	}
-	// no symlinks
-	for _, i := range matches {
-		fi := c.files[i]
-		base := filepath.Base(fi.path)
+	var names []string
+	chdirPrefix := chdir + "/"
+	ok := c.walkFollow(dir, dir, nil, func(p string, fi fileInfo) {
+		base := filepath.Base(p)
 		// -name "*<ext>"
 		if filepath.Ext(base) != ext {
-			continue
+			return
 		}
 		// -not -name ".*"
 		if strings.HasPrefix(base, ".") {
-			continue
+			return
 		}
-		name := strings.TrimPrefix(fi.path, chdir+"/")
+		names = append(names, strings.TrimPrefix(p, chdirPrefix))
+	})
+	if !ok {
+		glog.Warningf("android find %s in dir cache: can't follow symlinks under %s", ext, dir)
+		return false
+	}
+	for _, name := range names {
 		w.writeWordString(name)
-		glog.V(1).Infof("android find %s in dir cache: %s=> %s", ext, dir, name)
+		if glog.V(1) {
+			glog.Infof("android find %s in dir cache: %s=> %s", ext, dir, name)
+		}
 	}
 	return true
 }
@@ -527,7 +1265,9 @@ func (c *androidFindCacheT) findExtFilesUnder(w evalWriter, chdir, root, ext str
 // -a \! -name "*~" -print )
 func (c *androidFindCacheT) findJavaResourceFileGroup(w evalWriter, dir string) {
 	glog.V(1).Infof("android find java resource in dir cache: %s", dir)
-	c.walk(filepath.Clean(dir), func(_ int, fi fileInfo) error {
+	dirPrefix := filepath.ToSlash(dir) + "/"
+	var name []byte
+	c.walk(slashClean(dir), func(_ int, fi fileInfo) error {
 		// -type d -a -name ".svn" -prune
 		if fi.mode.IsDir() && filepath.Base(fi.path) == ".svn" {
 			return errSkipDir
@@ -548,26 +1288,43 @@ func (c *androidFindCacheT) findJavaResourceFileGroup(w evalWriter, dir string)
 			strings.HasSuffix(base, "~") {
 			return nil
 		}
-		name := strings.TrimPrefix(fi.path, dir+"/")
-		name = "./" + name
-		w.writeWordString(name)
-		glog.V(1).Infof("android find java resource in dir cache: %s=> %s", dir, name)
+		name = append(name[:0], "./"...)
+		name = append(name, strings.TrimPrefix(fi.path, dirPrefix)...)
+		w.writeWord(name)
+		if glog.V(1) {
+			glog.Infof("android find java resource in dir cache: %s=> %s", dir, name)
+		}
 		return nil
 	})
 }
 
+// findleaves emulates findleaves.py, which follows symlinks to
+// directories, and doesn't descend into a directory seen before. It
+// returns false if the cache can't answer.
 func (c *androidFindCacheT) findleaves(w evalWriter, dir, name string, prunes []string, mindepth int) bool {
+	// leafDir is a directory to scan, which is printed as printed
+	// under symlinks.
+	type leafDir struct {
+		path    string
+		printed string
+		links   int
+	}
 	var found []string
-	var dirs []string
-	dir = filepath.Clean(dir)
+	dir = slashClean(dir)
 	topdepth := strings.Count(dir, "/")
-	dirs = append(dirs, dir)
+	dirs := []leafDir{{path: dir, printed: dir}}
+	seen := make(map[string]bool)
 	for len(dirs) > 0 {
-		dir = filepath.Clean(dirs[0]) + "/"
+		ld := dirs[0]
 		dirs = dirs[1:]
+		dir = slashClean(ld.path) + "/"
+		printed := slashClean(ld.printed) + "/"
 		if dir == "./" {
 			dir = ""
 		}
+		if printed == "./" {
+			printed = ""
+		}
 		depth := strings.Count(dir, "/")
 		// glog.V(1).Infof("android findleaves dir=%q depth=%d dirs=%q", dir, depth, dirs)
 		i := sort.Search(len(c.leaves), func(i int) bool {
@@ -575,7 +1332,7 @@ func (c *androidFindCacheT) findleaves(w evalWriter, dir, name string, prunes []
 			if di != depth {
 				return di >= depth
 			}
-			diri := filepath.Dir(c.leaves[i].path) + "/"
+			diri := slashDir(c.leaves[i].path) + "/"
 			if diri != dir {
 				return diri >= dir
 			}
@@ -591,17 +1348,36 @@ func (c *androidFindCacheT) findleaves(w evalWriter, dir, name string, prunes []
 			if !strings.HasPrefix(c.leaves[i].path, dir) {
 				break
 			}
-			if mindepth < 0 || depth >= topdepth+mindepth {
+			if mindepth < 0 || strings.Count(printed, "/") >= topdepth+mindepth {
 				if !c.leaves[i].mode.IsDir() && filepath.Base(c.leaves[i].path) == name {
-					n := "./" + c.leaves[i].path
+					n := "./" + printed + c.leaves[i].path[len(dir):]
 					found = append(found, n)
 					glog.V(1).Infof("android findleaves name=%s=> %s (depth=%d topdepth=%d mindepth=%d)", name, n, depth, topdepth, mindepth)
 					break Scandir
 				}
 			}
-			if c.leaves[i].mode.IsDir() {
-				dirs = append(dirs, c.leaves[i].path)
+			if !c.leaves[i].mode.IsDir() {
+				continue
+			}
+			next := leafDir{
+				path:    c.leaves[i].path,
+				printed: printed + c.leaves[i].path[len(dir):],
+				links:   ld.links,
+			}
+			if c.leaves[i].mode&os.ModeSymlink != 0 {
+				t, ok := c.followLink(c.leaves[i])
+				if !ok || ld.links >= FindCacheSymlinkDepth {
+					glog.Warningf("android findleaves: can't follow symlink %s", c.leaves[i].path)
+					return false
+				}
+				next.path = t.path
+				next.links++
+			}
+			if seen[next.path] {
+				continue
 			}
+			seen[next.path] = true
+			dirs = append(dirs, next)
 		}
 		// glog.V(1).Infof("android findleaves next dirs=%q", dirs)
 	}
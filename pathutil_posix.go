@@ -0,0 +1,53 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package kati
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// defaultCaseInsensitiveFS is the default of CaseInsensitiveFS. APFS
+// on macOS is case insensitive by default.
+const defaultCaseInsensitiveFS = runtime.GOOS == "darwin"
+
+// defaultNormInsensitiveFS tells whether file systems ignore Unicode
+// normalization of names, unless detected. APFS and HFS+ on macOS do.
+const defaultNormInsensitiveFS = runtime.GOOS == "darwin"
+
+// deviceID returns the device of the file system which has fi.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// volumeNameLen returns the length of the volume name of path, which
+// is always 0.
+func volumeNameLen(path string) int {
+	return 0
+}
+
+// isSlashPath reports whether p can be looked up in the find cache,
+// whose paths are separated by '/'.
+func isSlashPath(p string) bool {
+	return true
+}
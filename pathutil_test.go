@@ -0,0 +1,751 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filepathCleanRecursive is the previous implementation of
+// filepathClean, to check filepathClean keeps its semantics.
+func filepathCleanRecursive(path string) string {
+	if path == "" {
+		return "."
+	}
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		return file
+	}
+	if dir == string(filepath.Separator) {
+		return dir + file
+	}
+	dir = strings.TrimRight(dir, string(filepath.Separator))
+	dir = filepathCleanRecursive(dir)
+	if file == "." {
+		return dir
+	}
+	return dir + string(filepath.Separator) + file
+}
+
+func TestFilepathClean(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "."},
+		{in: ".", want: "."},
+		{in: "..", want: ".."},
+		{in: "foo", want: "foo"},
+		{in: "foo/bar", want: "foo/bar"},
+		{in: "foo//bar", want: "foo/bar"},
+		{in: "foo/./bar", want: "foo/bar"},
+		{in: "foo/bar/.", want: "foo/bar"},
+		{in: "foo/bar/", want: "foo/bar/"},
+		{in: "foo/bar//", want: "foo/bar/"},
+		{in: "foo/../bar", want: "foo/../bar"},
+		{in: "foo/bar/..", want: "foo/bar/.."},
+		{in: "./foo", want: "./foo"},
+		{in: "././foo", want: "./foo"},
+		{in: "../foo", want: "../foo"},
+		{in: "/", want: "/"},
+		{in: "/foo", want: "/foo"},
+		{in: "/./foo", want: "/./foo"},
+		{in: "/foo/./bar/", want: "/foo/bar/"},
+		{in: "//foo", want: "./foo"},
+		{in: "//", want: "./"},
+	} {
+		got := filepathClean(tc.in)
+		if got != tc.want {
+			t.Errorf("filepathClean(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+		if old := filepathCleanRecursive(tc.in); got != old {
+			t.Errorf("filepathClean(%q)=%q; old implementation %q", tc.in, got, old)
+		}
+	}
+}
+
+func TestFilepathCleanNoAlloc(t *testing.T) {
+	for _, in := range []string{"foo/bar/baz.c", "./foo/bar", "/foo/bar/", "foo/./bar"} {
+		allocs := testing.AllocsPerRun(100, func() {
+			filepathClean(in)
+		})
+		want := 0.0
+		if strings.Contains(in, "/./") {
+			want = 2
+		}
+		if allocs > want {
+			t.Errorf("filepathClean(%q) allocs=%v; want <= %v", in, allocs, want)
+		}
+	}
+}
+
+func FuzzFilepathClean(f *testing.F) {
+	for _, s := range []string{"", ".", "a/b", "a//b/./c/", "/./a", "//a/../b", "./."} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		got := filepathClean(in)
+		want := filepathCleanRecursive(in)
+		if got != want {
+			t.Errorf("filepathClean(%q)=%q; want %q", in, got, want)
+		}
+	})
+}
+
+var cleanBenchPaths = []string{
+	"frameworks/base/core/java/android/app/Activity.java",
+	"./out/target/product/generic/obj/SHARED_LIBRARIES/libc_intermediates/",
+	"external//chromium/./net/base/../../third_party/libevent",
+	"/usr/include/./sys/../linux/types.h",
+}
+
+func BenchmarkFilepathClean(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, p := range cleanBenchPaths {
+			filepathClean(p)
+		}
+	}
+}
+
+func BenchmarkFilepathCleanRecursive(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, p := range cleanBenchPaths {
+			filepathCleanRecursive(p)
+		}
+	}
+}
+
+// newTestFindCache returns an android find cache which has n files
+// under dir, 16 files per subdirectory.
+func newTestFindCache(dir string, n int) *androidFindCacheT {
+	files := []fileInfo{{path: dir, mode: os.ModeDir}}
+	for i := 0; i < n; i++ {
+		sub := fmt.Sprintf("%s/sub%d", dir, i/16)
+		if i%16 == 0 {
+			files = append(files, fileInfo{path: sub, mode: os.ModeDir})
+		}
+		files = append(files, fileInfo{path: fmt.Sprintf("%s/File%d.java", sub, i)})
+	}
+	sort.Sort(fileInfoByName(files))
+	return &androidFindCacheT{files: files}
+}
+
+func TestIsGlobRoot(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{in: "", want: true},
+		{in: "/", want: true},
+		{in: "a/", want: false},
+		{in: "//", want: false},
+		{in: "/a/", want: false},
+	} {
+		if got := isGlobRoot(tc.in); got != tc.want {
+			t.Errorf("isGlobRoot(%q)=%t; want %t", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAndroidFindInDir(t *testing.T) {
+	c := newTestFindCache("src", 3)
+	c.files = append(c.files, fileInfo{path: "src/sub0/.hidden"})
+	sort.Sort(fileInfoByName(c.files))
+	wb := newWbuf()
+	defer wb.release()
+	c.findInDir(wb, "src/")
+	var got []string
+	for _, w := range wb.words {
+		got = append(got, string(w))
+	}
+	want := []string{"./sub0/File0.java", "./sub0/File1.java", "./sub0/File2.java"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findInDir(src/)=%q; want %q", got, want)
+	}
+}
+
+func BenchmarkAndroidFindInDir(b *testing.B) {
+	c := newTestFindCache("packages/apps/Foo/res", 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wb := newWbuf()
+		c.findInDir(wb, "packages/apps/Foo/res")
+		wb.release()
+	}
+}
+
+func BenchmarkAndroidFindExtFilesUnder(b *testing.B) {
+	c := newTestFindCache("packages/apps/Foo/src", 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wb := newWbuf()
+		c.findExtFilesUnder(wb, "packages/apps/Foo", "src", ".java")
+		wb.release()
+	}
+}
+
+func TestWildcardCacheInvalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := &wildcardCacheT{dirent: make(map[string][]string)}
+	glob := func(pat string) []string {
+		m, err := w.Glob(pat)
+		if err != nil {
+			t.Fatalf("Glob(%q): %v", pat, err)
+		}
+		return m
+	}
+	pat := filepath.Join(dir, "*.c")
+	if got := glob(pat); len(got) != 0 {
+		t.Errorf("Glob(%q)=%q; want none", pat, got)
+	}
+	fn := filepath.Join(dir, "a.c")
+	err = ioutil.WriteFile(fn, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := glob(pat); len(got) != 0 {
+		t.Errorf("Glob(%q)=%q before invalidate; want cached none", pat, got)
+	}
+	w.invalidate(filepath.Dir(fn), false)
+	if got, want := glob(pat), []string{fn}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Glob(%q)=%q; want %q", pat, got, want)
+	}
+}
+
+func TestWildcardCacheInvalidateAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := CheckWildcardCacheMtime
+	defer func() { CheckWildcardCacheMtime = saved }()
+	CheckWildcardCacheMtime = false
+	w := &wildcardCacheT{dirent: make(map[string][]string)}
+	pat := filepath.Join(dir, "*.c")
+	glob := func() []string {
+		m, err := w.Glob(pat)
+		if err != nil {
+			t.Fatalf("Glob(%q): %v", pat, err)
+		}
+		return m
+	}
+	writeFile := func(name string) string {
+		fn := filepath.Join(dir, name)
+		err := ioutil.WriteFile(fn, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+
+	glob()
+	a := writeFile("a.c")
+	if got := glob(); len(got) != 0 {
+		t.Errorf("Glob(%q)=%q before InvalidateAll; want cached none", pat, got)
+	}
+	w.InvalidateAll()
+	if got, want := glob(), []string{a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Glob(%q)=%q after InvalidateAll; want %q", pat, got, want)
+	}
+
+	CheckWildcardCacheMtime = true
+	glob()
+	b := writeFile("b.c")
+	// make sure the mtime changes on file systems with coarse mtime.
+	mtime := time.Now().Add(time.Hour)
+	err = os.Chtimes(dir, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := glob(), []string{a, b}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Glob(%q)=%q with mtime check; want %q", pat, got, want)
+	}
+}
+
+func TestGlobLiteralCaseInsensitive(t *testing.T) {
+	saved := CaseInsensitiveFS
+	defer func() { CaseInsensitiveFS = saved }()
+	w := &wildcardCacheT{}
+	names := []string{"Android.mk", "foo.c"}
+	for _, tc := range []struct {
+		name            string
+		caseInsensitive bool
+		want            []string
+	}{
+		{name: "foo.c", want: []string{"d/foo.c"}},
+		{name: "Foo.c"},
+		{name: "Foo.c", caseInsensitive: true, want: []string{"d/Foo.c"}},
+		{name: "android.mk", caseInsensitive: true, want: []string{"d/android.mk"}},
+		{name: "bar.c", caseInsensitive: true},
+	} {
+		CaseInsensitiveFS = tc.caseInsensitive
+		got := w.globLiteral("d/", tc.name, names, nil, nameFolding{})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("globLiteral(d/, %q) caseInsensitive=%t: %q; want %q", tc.name, tc.caseInsensitive, got, tc.want)
+		}
+	}
+}
+
+func TestWildcardDirectoryOrder(t *testing.T) {
+	w := &wildcardCacheT{
+		dirent: map[string][]string{
+			".":   {"a.c", "b.c", "sub"},
+			"sub": {"x.c", "y.c", "z.c"},
+			"/d":  {"p.c", "q.c"},
+		},
+		order: map[string][]string{
+			".":   {"sub", "b.c", "a.c"},
+			"sub": {"z.c", "x.c", "y.c"},
+		},
+	}
+	for _, tc := range []struct {
+		files []string
+		want  []string
+	}{
+		{
+			files: []string{"a.c", "b.c"},
+			want:  []string{"b.c", "a.c"},
+		},
+		{
+			files: []string{"./a.c", "./b.c", "./sub"},
+			want:  []string{"./sub", "./b.c", "./a.c"},
+		},
+		{
+			// directories are kept in the order of the glob.
+			files: []string{"a.c", "b.c", "sub/x.c", "sub/z.c"},
+			want:  []string{"b.c", "a.c", "sub/z.c", "sub/x.c"},
+		},
+		{
+			// the order of /d isn't known.
+			files: []string{"/d/p.c", "/d/q.c"},
+			want:  []string{"/d/p.c", "/d/q.c"},
+		},
+	} {
+		got := w.directoryOrder(tc.files)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("directoryOrder(%q)=%q; want %q", tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestNameFolding(t *testing.T) {
+	for _, tc := range []struct {
+		s, nfd, nfc string
+	}{
+		{s: "foo.c", nfd: "foo.c", nfc: "foo.c"},
+		{s: "caf\u00e9.c", nfd: "cafe\u0301.c", nfc: "caf\u00e9.c"},
+		{s: "cafe\u0301.c", nfd: "cafe\u0301.c", nfc: "caf\u00e9.c"},
+		{s: "\u017d\u00fc", nfd: "Z\u030cu\u0308", nfc: "\u017d\u00fc"},
+		// Hangul syllables with and without a final consonant.
+		{s: "\ud55c\uae00", nfd: "\u1112\u1161\u11ab\u1100\u1173\u11af", nfc: "\ud55c\uae00"},
+		{s: "\u1112\u1161\u11ab\u1100\u1173\u11af", nfd: "\u1112\u1161\u11ab\u1100\u1173\u11af", nfc: "\ud55c\uae00"},
+		{s: "\uac00", nfd: "\u1100\u1161", nfc: "\uac00"},
+	} {
+		if got := decomposeName(tc.s); got != tc.nfd {
+			t.Errorf("decomposeName(%q)=%q; want %q", tc.s, got, tc.nfd)
+		}
+		if got := composeName(tc.s); got != tc.nfc {
+			t.Errorf("composeName(%q)=%q; want %q", tc.s, got, tc.nfc)
+		}
+	}
+}
+
+func TestGlobFold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"cafe\u0301.c", "Foo.C", "bar.c"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := WildcardFold
+	defer func() { WildcardFold = saved }()
+	for _, tc := range []struct {
+		fold string
+		pat  string
+		want []string
+	}{
+		{fold: WildcardFoldOff, pat: "*.c", want: []string{"bar.c", "cafe\u0301.c"}},
+		{fold: WildcardFoldOn, pat: "*.c", want: []string{"Foo.C", "bar.c", "cafe\u0301.c"}},
+		{fold: WildcardFoldOn, pat: "caf\u00e9.*", want: []string{"cafe\u0301.c"}},
+		{fold: WildcardFoldOn, pat: "F[a-z]o.c", want: []string{"Foo.C"}},
+		{fold: WildcardFoldOn, pat: "foo.c", want: []string{"foo.c"}},
+		{fold: WildcardFoldOn, pat: "caf\u00e9.c", want: []string{"caf\u00e9.c"}},
+		{fold: WildcardFoldOff, pat: "caf\u00e9.c"},
+	} {
+		WildcardFold = tc.fold
+		w := &wildcardCacheT{dirent: make(map[string][]string)}
+		got, err := w.Glob(filepath.Join(dir, tc.pat))
+		if err != nil {
+			t.Errorf("Glob(%q) fold=%s: %v", tc.pat, tc.fold, err)
+			continue
+		}
+		var want []string
+		for _, name := range tc.want {
+			want = append(want, filepath.Join(dir, name))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Glob(%q) fold=%s=%q; want %q", tc.pat, tc.fold, got, want)
+		}
+	}
+}
+
+func TestNameFoldingAuto(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	names := []string{"Foo.c", "caf\u00e9.c"}
+	for _, name := range names {
+		err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want nameFolding
+	for i, alt := range []string{"FOO.C", "cafe\u0301.c"} {
+		_, err := os.Stat(filepath.Join(dir, alt))
+		if i == 0 {
+			want.caseInsensitive = err == nil
+		} else {
+			want.normInsensitive = err == nil
+		}
+	}
+	saved := WildcardFold
+	defer func() { WildcardFold = saved }()
+	WildcardFold = WildcardFoldAuto
+	w := &wildcardCacheT{dirent: make(map[string][]string)}
+	if got := w.nameFolding(dir, w.readdirnames(dir)); got != want {
+		t.Errorf("nameFolding(%q)=%+v; want %+v", dir, got, want)
+	}
+}
+
+func TestAndroidFindCacheInvalidate(t *testing.T) {
+	c := newTestFindCache("src", 1)
+	c.invalidate("/nonexistent-outside-of-tree/src")
+	if c.stale != 0 {
+		t.Errorf("stale after change outside of tree")
+	}
+	c.invalidate("src/sub0/File0.java")
+	if c.stale == 0 {
+		t.Errorf("not stale after change in tree")
+	}
+	if !isFSNoise(".DS_Store") || isFSNoise("Android.mk") {
+		t.Errorf("isFSNoise: .DS_Store should be noise, Android.mk should not")
+	}
+}
+
+func TestAndroidFindCacheRescan(t *testing.T) {
+	chdirTempDir(t)
+	for _, d := range []string{"a", "b"} {
+		err := os.Mkdir(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile("a/Android.mk", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := UseFindCache
+	defer func() { UseFindCache = saved }()
+	UseFindCache = true
+
+	c := &androidFindCacheT{}
+	c.init(nil)
+	found := func() []string {
+		if !c.leavesReady() {
+			t.Fatal("the cache is not ready")
+		}
+		wb := newWbuf()
+		defer wb.release()
+		if !c.findleaves(wb, ".", "Android.mk", nil, 0) {
+			t.Fatal("findleaves with the cache failed")
+		}
+		var r []string
+		for _, w := range wb.words {
+			r = append(r, string(w))
+		}
+		return r
+	}
+	end := c.beginLoad()
+	if got, want := found(), []string{"./a/Android.mk"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findleaves=%q; want %q", got, want)
+	}
+	end()
+
+	err = ioutil.WriteFile("b/Android.mk", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.invalidate("b/Android.mk")
+	if c.leavesReady() {
+		t.Errorf("ready after b/Android.mk changed")
+	}
+	// the next load scans the tree again.
+	end = c.beginLoad()
+	defer end()
+	if got, want := found(), []string{"./a/Android.mk", "./b/Android.mk"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findleaves=%q; want %q", got, want)
+	}
+}
+
+func TestAndroidFindCacheSymlinks(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"src/lib/Android.mk", "src/lib/A.java", "app/B.java", "loop/sub/C.java"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"app/lib":     "../src/lib",
+		"app/dangle":  "none.java",
+		"loop/sub/up": "..",
+		"out":         "/",
+	} {
+		err := os.Symlink(target, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &androidFindCacheT{}
+	c.filesch = make(chan []fileInfo, 1)
+	c.leavesch = make(chan []fileInfo, 1)
+	c.start(nil, []string{"Android.mk"})
+	c.files = <-c.filesch
+	c.leaves = <-c.leavesch
+
+	for _, tc := range []struct {
+		chdir, root string
+		want        []string
+		wantOK      bool
+	}{
+		{chdir: "app", root: ".", want: []string{"B.java", "lib/A.java"}, wantOK: true},
+		{chdir: ".", root: "app", want: []string{"app/B.java", "app/lib/A.java"}, wantOK: true},
+		{chdir: ".", root: "loop"},
+		{chdir: "src", root: "../out"},
+	} {
+		wb := newWbuf()
+		ok := c.findExtFilesUnder(wb, tc.chdir, tc.root, ".java")
+		var got []string
+		for _, w := range wb.words {
+			got = append(got, string(w))
+		}
+		wb.release()
+		sort.Strings(got)
+		if ok != tc.wantOK || (ok && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("findExtFilesUnder(%q, %q)=%q, %t; want %q, %t", tc.chdir, tc.root, got, ok, tc.want, tc.wantOK)
+		}
+	}
+
+	wb := newWbuf()
+	defer wb.release()
+	if !c.findleaves(wb, "app", "Android.mk", nil, 0) {
+		t.Fatalf("findleaves(app)=false")
+	}
+	var got []string
+	for _, w := range wb.words {
+		got = append(got, string(w))
+	}
+	want := []string{"./app/lib/Android.mk"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findleaves(app)=%q; want %q", got, want)
+	}
+}
+
+func TestGlobStar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, fn := range []string{"a.c", "x/b.c", "x/y/c.c", "x/y/d.h", ".git/e.c", "z/"} {
+		fn = filepath.Join(dir, fn)
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil && !strings.HasSuffix(fn, "/") {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &wildcardCacheT{dirent: make(map[string][]string)}
+	for _, tc := range []struct {
+		pat  string
+		want []string
+	}{
+		{pat: "**/*.c", want: []string{"a.c", "x/b.c", "x/y/c.c"}},
+		{pat: "**/y/*.h", want: []string{"x/y/d.h"}},
+		{pat: "x/**", want: []string{"x/b.c", "x/y", "x/y/c.c", "x/y/d.h"}},
+		{pat: "[xz]/**/*.c", want: []string{"x/b.c", "x/y/c.c"}},
+		{pat: "x/**/**/c.c", want: []string{"x/y/c.c", "x/y/c.c"}},
+		{pat: "z/**/*.c"},
+		{pat: "x**/*.c", want: []string{"x/b.c"}},
+	} {
+		got, err := w.Glob(filepath.Join(dir, tc.pat))
+		if err != nil {
+			t.Errorf("Glob(%q): %v", tc.pat, err)
+			continue
+		}
+		var want []string
+		for _, fn := range tc.want {
+			want = append(want, filepath.Join(dir, fn))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Glob(%q)=%q; want %q", tc.pat, got, want)
+		}
+	}
+
+	// directories are not read again.
+	err = ioutil.WriteFile(filepath.Join(dir, "x/y/f.c"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pat := filepath.Join(dir, "**/*.c")
+	got, err := w.Glob(pat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Errorf("Glob(%q)=%q; want cached 3 files", pat, got)
+	}
+}
+
+func TestExpandTilde(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("user.Current: %v", err)
+	}
+	savedHome := os.Getenv("HOME")
+	defer os.Setenv("HOME", savedHome)
+	for _, tc := range []struct {
+		pat     string
+		home    string // $(HOME)
+		envHome string // $HOME of kati
+		want    string
+	}{
+		{pat: "foo", home: "/h", want: "foo"},
+		{pat: "~", home: "/h", want: "/h"},
+		{pat: "~/src/*.c", home: "/h", envHome: "/e", want: "/h/src/*.c"},
+		{pat: "~/src", envHome: "/e", want: "/e/src"},
+		{pat: "~/src", want: u.HomeDir + "/src"},
+		{pat: "a/~/b", home: "/h", want: "a/~/b"},
+		{pat: "~" + u.Username + "/x", home: "/h", want: u.HomeDir + "/x"},
+		{pat: "~nonexistent-kati-user/x", home: "/h", want: "~nonexistent-kati-user/x"},
+	} {
+		os.Setenv("HOME", tc.envHome)
+		got := expandTilde(tc.pat, func() string { return tc.home })
+		if got != tc.want {
+			t.Errorf("expandTilde(%q) HOME=%q $HOME=%q: %q; want %q", tc.pat, tc.home, tc.envHome, got, tc.want)
+		}
+	}
+}
+
+func TestWildcardTilde(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.c", "sub/b.c"} {
+		fn := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fn, nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		mk     string
+		origin string // origin of HOME given to eval.
+		want   string
+	}{
+		{mk: "R := $(wildcard ~/*.c)\n", origin: "environment", want: dir + "/a.c"},
+		{mk: "R := $(wildcard ~/sub/*.c ~/none)\n", origin: "command line", want: dir + "/sub/b.c"},
+		{mk: "override HOME := " + dir + "/sub\nR := $(wildcard ~/*.c)\n", origin: "environment", want: dir + "/sub/b.c"},
+		{mk: "HOME = $(TOP)/sub\nTOP := " + dir + "\nR := $(wildcard ~/*.c)\n", origin: "environment", want: dir + "/sub/b.c"},
+	} {
+		mk, err := parseMakefileString(tc.mk, srcpos{filename: "test.mk", lineno: 1})
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.mk, err)
+			continue
+		}
+		vars := make(Vars)
+		vars.Assign("HOME", &recursiveVar{expr: literal(dir), origin: tc.origin})
+		er, err := eval(mk, vars, false)
+		if err != nil {
+			t.Errorf("eval %q: %v", tc.mk, err)
+			continue
+		}
+		if got := er.vars.Lookup("R").String(); got != tc.want {
+			t.Errorf("eval %q HOME from %s: R=%q; want %q", tc.mk, tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestWildcardCacheStatistics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.c", "b.c", "c.h"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &wildcardCacheT{dirent: make(map[string][]string)}
+	for _, pat := range []string{"*.c", "*.h", "*.c"} {
+		_, err := w.Glob(filepath.Join(dir, pat))
+		if err != nil {
+			t.Fatalf("Glob(%q): %v", pat, err)
+		}
+	}
+	got := w.statistics()
+	want := WildcardCacheStats{Dirs: 1, Files: 3, Hits: 2, Misses: 1}
+	if got != want {
+		t.Errorf("statistics()=%+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultCaseInsensitiveFS is the default of CaseInsensitiveFS. NTFS
+// is case insensitive.
+const defaultCaseInsensitiveFS = true
+
+// defaultNormInsensitiveFS tells whether file systems ignore Unicode
+// normalization of names, unless detected. NTFS doesn't.
+const defaultNormInsensitiveFS = false
+
+// deviceID returns the device of the file system which has fi, which
+// is unknown on windows, so defaults are used.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// volumeNameLen returns the length of the volume name of path, e.g.
+// "C:" or `\\host\share`.
+func volumeNameLen(path string) int {
+	return len(filepath.VolumeName(path))
+}
+
+// isSlashPath reports whether p has neither a volume name nor '\\',
+// i.e. p can be looked up in the find cache, whose paths are separated
+// by '/'.
+func isSlashPath(p string) bool {
+	return volumeNameLen(p) == 0 && strings.IndexByte(p, '\\') < 0
+}
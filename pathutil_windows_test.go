@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "testing"
+
+func TestFilepathCleanVolume(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: `C:`, want: `C:`},
+		{in: `C:foo`, want: `C:foo`},
+		{in: `C:foo\.\bar`, want: `C:foo\bar`},
+		{in: `C:\`, want: `C:\`},
+		{in: `C:\\foo`, want: `C:\foo`},
+		{in: `C:/foo/./bar/`, want: `C:\foo\bar\`},
+		{in: `C:\foo\..\bar`, want: `C:\foo\..\bar`},
+		{in: `\\host\share\foo`, want: `\\host\share\foo`},
+		{in: `\\host\share\\foo\.\bar`, want: `\\host\share\foo\bar`},
+		{in: `\foo\.\bar`, want: `\foo\bar`},
+		{in: `foo\\bar`, want: `foo\bar`},
+	} {
+		if got := filepathClean(tc.in); got != tc.want {
+			t.Errorf("filepathClean(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestIsSlashPath(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{in: "foo/bar", want: true},
+		{in: `foo\bar`, want: false},
+		{in: "C:/foo", want: false},
+		{in: "//host/share/foo", want: false},
+	} {
+		if got := isSlashPath(tc.in); got != tc.want {
+			t.Errorf("isSlashPath(%q)=%t; want %t", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// POSIX make compatibility mode.
+//
+// The mode is enabled by PosixMode, or by the special target .POSIX as
+// the first non-comment line of a makefile, as GNU make does. In the
+// mode, commands run with "-ec" (.SHELLFLAGS), functions, which are
+// GNU make extensions, are errors, and other GNU make extensions are
+// warned with their locations, to check a makefile is portable.
+
+import "strings"
+
+// posixShellFlags is the default of .SHELLFLAGS in POSIX mode.
+// POSIX requires commands to run with "sh -e".
+const posixShellFlags = "-ec"
+
+// isPosixMakefile reports whether the first statement of mk, other
+// than bootstrap statements, is the special target .POSIX.
+func isPosixMakefile(mk makefile) bool {
+	for _, stmt := range mk.stmts {
+		if stmt.pos().filename == bootstrapMakefileName {
+			continue
+		}
+		r, ok := stmt.(*maybeRuleAST)
+		if !ok || !r.isRule || r.assign != nil {
+			return false
+		}
+		return strings.TrimSpace(r.expr.String()) == ".POSIX:"
+	}
+	return false
+}
+
+// checkPosix checks stmt uses only POSIX make features.
+func (ev *Evaluator) checkPosix(stmt ast) error {
+	var pos srcpos
+	var values []Value
+	switch s := stmt.(type) {
+	case *assignAST:
+		pos = s.srcpos
+		if s.op != "=" {
+			warnPosix(pos, "%q assignment", s.op)
+		}
+		if s.opt != "" {
+			warnPosix(pos, "%q directive", s.opt)
+		}
+		values = append(values, s.lhs, s.rhs)
+	case *maybeRuleAST:
+		pos = s.srcpos
+		if strings.Contains(s.expr.String(), "%") {
+			warnPosix(pos, "pattern rule")
+		}
+		values = append(values, s.expr)
+		if s.assign != nil {
+			warnPosix(pos, "target-specific variable")
+			values = append(values, s.assign.lhs, s.assign.rhs)
+		}
+	case *commandAST:
+		pos = s.srcpos
+		v, _, err := parseExpr([]byte(s.cmd), nil, parseOp{})
+		if err != nil {
+			// evalCommand reports it.
+			return nil
+		}
+		values = append(values, v)
+	case *ifAST:
+		pos = s.srcpos
+		warnPosix(pos, "%q conditional", s.op)
+		values = append(values, s.lhs)
+		if s.rhs != nil {
+			values = append(values, s.rhs)
+		}
+	case *exportAST:
+		pos = s.srcpos
+		if s.export {
+			warnPosix(pos, "\"export\" directive")
+		} else {
+			warnPosix(pos, "\"unexport\" directive")
+		}
+	case *vpathAST:
+		pos = s.srcpos
+		warnPosix(pos, "\"vpath\" directive")
+	case *loadAST:
+		pos = s.srcpos
+		warnPosix(pos, "%q directive", s.op)
+	}
+	for _, v := range values {
+		if name := gnuFunc(v); name != "" {
+			return pos.errorf("*** function %q is a GNU make extension, not available in POSIX mode.", name)
+		}
+	}
+	return nil
+}
+
+func warnPosix(pos srcpos, format string, args ...interface{}) {
+	warn(pos, DiagGNUExtension, format+" is a GNU make extension", args...)
+}
+
+// gnuFunc returns the name of a function used in v, or "" if v uses
+// no functions.
+func gnuFunc(v Value) string {
+	switch v := v.(type) {
+	case expr:
+		for _, e := range v {
+			if name := gnuFunc(e); name != "" {
+				return name
+			}
+		}
+	case *varref:
+		return gnuFunc(v.varname)
+	case varsubst:
+		if name := gnuFunc(v.varname); name != "" {
+			return name
+		}
+		if name := gnuFunc(v.pat); name != "" {
+			return name
+		}
+		return gnuFunc(v.subst)
+	case interface {
+		closureArgs() []Value
+	}:
+		args := v.closureArgs()
+		if len(args) == 0 {
+			return "func"
+		}
+		return strings.TrimLeft(args[0].String(), "({")
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsPosixMakefile(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{in: ".POSIX:\nall:\n", want: true},
+		{in: "# comment\n\n.POSIX:\n", want: true},
+		{in: "A = a\n.POSIX:\n", want: false},
+		{in: ".POSIX: all\n", want: false},
+		{in: "all:\n", want: false},
+	} {
+		mk, err := parseMakefileString(tc.in, srcpos{filename: "test.mk", lineno: 1})
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.in, err)
+			continue
+		}
+		if got := isPosixMakefile(mk); got != tc.want {
+			t.Errorf("isPosixMakefile(%q)=%t; want %t", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestPosixMode(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		wantErr string
+		flags   string
+	}{
+		{in: ".POSIX:\nA = a\nall: $(A)\n", flags: "-ec"},
+		{in: ".POSIX:\n.SHELLFLAGS = -c\n", flags: "-c"},
+		{in: "A = a\n", flags: ""},
+		{in: ".POSIX:\nA = $(patsubst %.c,%.o,a.c)\n", wantErr: `"patsubst"`},
+		{in: ".POSIX:\nall:\n\techo $(shell date)\n", wantErr: `"shell"`},
+		{in: ".POSIX:\nA = $(B:.c=$(notdir x))\n", wantErr: `"notdir"`},
+		{in: "all:\n\techo $(shell date)\n"},
+	} {
+		mk, err := parseMakefileString(tc.in, srcpos{filename: "test.mk", lineno: 1})
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.in, err)
+			continue
+		}
+		er, err := eval(mk, make(Vars), false)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("eval(%q)=_, %v; want error %s", tc.in, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("eval(%q): %v", tc.in, err)
+			continue
+		}
+		if got := er.vars.Lookup(".SHELLFLAGS").String(); got != tc.flags {
+			t.Errorf("eval(%q): .SHELLFLAGS=%q; want %q", tc.in, got, tc.flags)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Product is a combination of TARGET_PRODUCT and TARGET_BUILD_VARIANT
+// of Android.
+type Product struct {
+	Name string
+	// Variant is TARGET_BUILD_VARIANT, e.g. eng, or empty not to set
+	// it.
+	Variant string
+}
+
+// ParseProduct parses a product as lunch, e.g. "aosp_arm-eng".
+// The variant is after the last '-', and may be omitted.
+func ParseProduct(s string) (Product, error) {
+	name, variant := s, ""
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		name, variant = s[:i], s[i+1:]
+		if variant == "" {
+			return Product{}, fmt.Errorf("empty variant in product %q", s)
+		}
+	}
+	if name == "" || strings.ContainsAny(name, " \t=") {
+		return Product{}, fmt.Errorf("invalid product %q", s)
+	}
+	return Product{Name: name, Variant: variant}, nil
+}
+
+// ParseProducts parses comma separated products.
+func ParseProducts(s string) ([]Product, error) {
+	var products []Product
+	seen := make(map[Product]bool)
+	for _, ps := range strings.Split(s, ",") {
+		p, err := ParseProduct(strings.TrimSpace(ps))
+		if err != nil {
+			return nil, err
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("duplicated product %q", p)
+		}
+		seen[p] = true
+		products = append(products, p)
+	}
+	return products, nil
+}
+
+func (p Product) String() string {
+	if p.Variant == "" {
+		return p.Name
+	}
+	return p.Name + "-" + p.Variant
+}
+
+// NinjaSuffix returns the suffix of ninja files for p, i.e. suffix
+// followed by "-" and p, e.g. build-aosp_arm-eng.ninja.
+func (p Product) NinjaSuffix(suffix string) string {
+	return suffix + "-" + p.String()
+}
+
+// LoadReq returns req with TARGET_PRODUCT and TARGET_BUILD_VARIANT of p
+// on the command line, which override ones in req.
+func (p Product) LoadReq(req LoadReq) LoadReq {
+	vars := make([]string, len(req.CommandLineVars), len(req.CommandLineVars)+2)
+	copy(vars, req.CommandLineVars)
+	vars = append(vars, "TARGET_PRODUCT="+p.Name)
+	if p.Variant != "" {
+		vars = append(vars, "TARGET_BUILD_VARIANT="+p.Variant)
+	}
+	req.CommandLineVars = vars
+	return req
+}
+
+// LoadProducts evaluates req for each product concurrently, at most
+// parallelism at once, or all at once if it is not positive.
+// Each product is evaluated in a Session made by s.ShareSnapshot, so
+// the tree is scanned by the find cache only once, and strings in the
+// graphs are interned in the same tables. It returns the results in the
+// same order as products, and the error of the first failed product.
+func (s *Session) LoadProducts(ctx context.Context, req LoadReq, products []Product, parallelism int) ([]*LoadResult, error) {
+	if req.UseCache {
+		return nil, errLoadAllUseCache(req)
+	}
+	results := make([]*LoadResult, len(products))
+	err := runParallel(len(products), parallelism, func(i int) error {
+		var err error
+		results[i], err = s.ShareSnapshot().Load(ctx, products[i].LoadReq(req))
+		if err != nil && err != ctx.Err() {
+			err = fmt.Errorf("%s: %v", products[i], err)
+		}
+		return err
+	})
+	return results, err
+}
+
+// GenerateProductsNinja loads req for each product by LoadProducts,
+// and generates ninja files of each product with the options of n and
+// the suffix of Product.NinjaSuffix.
+func (s *Session) GenerateProductsNinja(ctx context.Context, n NinjaGenerator, req LoadReq, products []Product, suffix string, parallelism int) error {
+	results, err := s.LoadProducts(ctx, req, products, parallelism)
+	if err != nil {
+		return err
+	}
+	return runParallel(len(products), parallelism, func(i int) error {
+		pn := n
+		pn.tid = traceEvent.newThread("ninja " + products[i].String())
+		err := pn.Save(results[i].Graph, products[i].NinjaSuffix(suffix), req.Targets)
+		if err != nil {
+			return fmt.Errorf("%s: %v", products[i], err)
+		}
+		return nil
+	})
+}
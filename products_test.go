@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProducts(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []Product
+	}{
+		{
+			in:   "aosp_arm-eng",
+			want: []Product{{Name: "aosp_arm", Variant: "eng"}},
+		},
+		{
+			in: "aosp_arm-eng, aosp_x86,my-product-userdebug",
+			want: []Product{
+				{Name: "aosp_arm", Variant: "eng"},
+				{Name: "aosp_x86"},
+				{Name: "my-product", Variant: "userdebug"},
+			},
+		},
+		{in: ""},
+		{in: "aosp_arm-"},
+		{in: "-eng"},
+		{in: "a b-eng"},
+		{in: "aosp_arm-eng,aosp_arm-eng"},
+	} {
+		got, err := ParseProducts(tc.in)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("ParseProducts(%q)=%v, nil; want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseProducts(%q)=%v, %v; want %v, nil", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestGenerateProductsNinja(t *testing.T) {
+	chdirTestMakefile(t, `
+TARGET_PRODUCT := default
+all: out/$(TARGET_PRODUCT)/$(TARGET_BUILD_VARIANT)/$(notdir $(shell find src -name '*.c'))
+out/%.c:
+	echo $(PRODUCT_FLAG) $(TARGET_PRODUCT)
+`)
+	err := os.Mkdir("src", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join("src", "a.c"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseFindCache = true
+	defer func() {
+		UseFindCache = false
+	}()
+
+	products := []Product{
+		{Name: "p0", Variant: "eng"},
+		{Name: "p1", Variant: "user"},
+		{Name: "p2"},
+	}
+	req := LoadReq{
+		Makefile:        "Makefile",
+		CommandLineVars: []string{"PRODUCT_FLAG=-x"},
+	}
+	s := NewSession()
+	err = s.GenerateProductsNinja(context.Background(), NinjaGenerator{}, req, products, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(req.CommandLineVars, []string{"PRODUCT_FLAG=-x"}) {
+		t.Errorf("command line vars of req were modified: %q", req.CommandLineVars)
+	}
+	for fn, wants := range map[string][]string{
+		"build-p0-eng.ninja":  {"build out/p0/eng/a.c:", "echo -x p0"},
+		"build-p1-user.ninja": {"build out/p1/user/a.c:", "echo -x p1"},
+		"build-p2.ninja":      {"build out/p2//a.c:", "echo -x p2"},
+	} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for _, want := range wants {
+			if !strings.Contains(string(b), want) {
+				t.Errorf("%s doesn't have %q:\n%s", fn, want, b)
+			}
+		}
+	}
+	if got := s.androidFindCache.statistics().Emulated; got != len(products) {
+		t.Errorf("emulated find commands=%d; want %d", got, len(products))
+	}
+
+	_, err = s.LoadProducts(context.Background(), LoadReq{Makefile: "missing.mk"}, products[:1], 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "p0-eng: ") {
+		t.Errorf("LoadProducts(missing.mk)=_, %v; want error of p0-eng", err)
+	}
+}
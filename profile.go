@@ -0,0 +1,233 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of entries of the evaluation profiler.
+const (
+	// ProfileMakefile is a makefile, named by its filename.
+	ProfileMakefile = "makefile"
+	// ProfileRule is a rule line, named by its position.
+	ProfileRule = "rule"
+	// ProfileVar is an expansion of a variable, named by the variable.
+	ProfileVar = "var"
+	// ProfileFunc is a call of a builtin function, named by the
+	// expression, e.g. $(shell ls).
+	ProfileFunc = "func"
+	// ProfileCall is $(call), named by the called variable.
+	ProfileCall = "call"
+)
+
+// EvalProfileEntry is the time and allocation attributed to a makefile,
+// a rule, or an expansion while EvalProfileFlag is set.
+type EvalProfileEntry struct {
+	Kind  string
+	Name  string
+	Count int
+	// Time includes everything evaluated in the entry. SelfTime
+	// excludes nested entries of the same group, i.e. included
+	// makefiles for a makefile, or expansions of other variables and
+	// functions for an expansion, so self times of a group add up to
+	// the time in the group.
+	Time     time.Duration
+	SelfTime time.Duration
+	// Alloc and SelfAlloc are bytes allocated in the heap, as Time
+	// and SelfTime. They are measured only for makefiles and rules,
+	// as reading them costs as much as a few expansions. They are
+	// approximate, as allocations are counted per span, and include
+	// allocations of other goroutines, e.g. evaluations in parallel.
+	Alloc     uint64
+	SelfAlloc uint64
+}
+
+type evalProfileKey struct {
+	kind, name string
+}
+
+type evalProfileT struct {
+	mu   sync.Mutex
+	data map[evalProfileKey]*EvalProfileEntry
+}
+
+var evalProfile = &evalProfileT{
+	data: make(map[evalProfileKey]*EvalProfileEntry),
+}
+
+func (p *evalProfileT) add(f *profFrame, d time.Duration, alloc uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k := evalProfileKey{kind: f.kind, name: f.name}
+	e := p.data[k]
+	if e == nil {
+		e = &EvalProfileEntry{Kind: f.kind, Name: f.name}
+		p.data[k] = e
+	}
+	e.Count++
+	e.Time += d
+	e.SelfTime += d - f.childTime
+	e.Alloc += alloc
+	e.SelfAlloc += alloc - f.childAlloc
+}
+
+// EvalProfile returns entries of the evaluation profiler collected so
+// far, sorted by kinds, and self times in descending order.
+func EvalProfile() []EvalProfileEntry {
+	evalProfile.mu.Lock()
+	entries := make([]EvalProfileEntry, 0, len(evalProfile.data))
+	for _, e := range evalProfile.data {
+		entries = append(entries, *e)
+	}
+	evalProfile.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		if entries[i].SelfTime != entries[j].SelfTime {
+			return entries[i].SelfTime > entries[j].SelfTime
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// ResetEvalProfile clears entries of the evaluation profiler.
+func ResetEvalProfile() {
+	evalProfile.mu.Lock()
+	evalProfile.data = make(map[evalProfileKey]*EvalProfileEntry)
+	evalProfile.mu.Unlock()
+}
+
+// WriteEvalProfile writes the report of the evaluation profiler, i.e.
+// top entries of each kind with the largest self times.
+func WriteEvalProfile(w io.Writer, top int) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	var kind string
+	n := 0
+	for _, e := range EvalProfile() {
+		if e.Kind != kind {
+			if kind != "" {
+				fmt.Fprintln(tw)
+			}
+			kind = e.Kind
+			n = 0
+			fmt.Fprintf(tw, "count\tself\ttotal\tself alloc\ttotal alloc\t %s\n", kind)
+		}
+		if n >= top {
+			continue
+		}
+		n++
+		alloc, selfAlloc := "-", "-"
+		if e.Kind == ProfileMakefile || e.Kind == ProfileRule {
+			alloc, selfAlloc = formatBytes(e.Alloc), formatBytes(e.SelfAlloc)
+		}
+		fmt.Fprintf(tw, "%d\t%v\t%v\t%s\t%s\t %s\n", e.Count, e.SelfTime.Round(time.Microsecond), e.Time.Round(time.Microsecond), selfAlloc, alloc, e.Name)
+	}
+	return tw.Flush()
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// evalProfiler is the stack of entries being evaluated by an Evaluator.
+type evalProfiler struct {
+	stack []profFrame
+}
+
+type profFrame struct {
+	kind, name string
+	t          time.Time
+	// alloc is heap allocations at the start, or 0 if not measured.
+	alloc      uint64
+	childTime  time.Duration
+	childAlloc uint64
+}
+
+// profileGroup returns the group of kind, whose nested entries are
+// excluded from self times.
+func profileGroup(kind string) string {
+	switch kind {
+	case ProfileVar, ProfileFunc, ProfileCall:
+		return "expansion"
+	}
+	return kind
+}
+
+func heapAllocs() uint64 {
+	s := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return s[0].Value.Uint64()
+}
+
+// profBegin starts an entry of the profiler, and returns the depth to
+// pass to profEnd.
+func (ev *Evaluator) profBegin(kind, name string) int {
+	p := ev.prof
+	if p == nil {
+		return 0
+	}
+	f := profFrame{kind: kind, name: name}
+	if kind == ProfileMakefile || kind == ProfileRule {
+		f.alloc = heapAllocs()
+	}
+	f.t = time.Now()
+	p.stack = append(p.stack, f)
+	return len(p.stack) - 1
+}
+
+// profEnd ends the entry started at depth. Entries nested in it which
+// were not ended, i.e. failed, are dropped.
+func (ev *Evaluator) profEnd(depth int) {
+	p := ev.prof
+	if p == nil || depth >= len(p.stack) {
+		return
+	}
+	f := p.stack[depth]
+	p.stack = p.stack[:depth]
+	d := time.Since(f.t)
+	var alloc uint64
+	if f.kind == ProfileMakefile || f.kind == ProfileRule {
+		alloc = heapAllocs() - f.alloc
+	}
+	group := profileGroup(f.kind)
+	for i := depth - 1; i >= 0; i-- {
+		if profileGroup(p.stack[i].kind) == group {
+			p.stack[i].childTime += d
+			p.stack[i].childAlloc += alloc
+			break
+		}
+	}
+	evalProfile.add(&f, d, alloc)
+}
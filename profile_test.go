@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvalProfile(t *testing.T) {
+	mk := writeTestMakefile(t, `
+D := $(dir $(lastword $(MAKEFILE_LIST)))
+include $(D)sub.mk
+f = $(1)-$(1)
+A := $(call f,$(WORDS)) $(WORDS)
+all: $(A)
+`)
+	dir := filepath.Dir(mk)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub.mk")
+	err := ioutil.WriteFile(sub, []byte("WORDS = $(foreach i,a b c,$(i))\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	EvalProfileFlag = true
+	defer func() {
+		EvalProfileFlag = false
+		ResetEvalProfile()
+	}()
+	ResetEvalProfile()
+	_, err = Load(LoadReq{Makefile: mk})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[evalProfileKey]EvalProfileEntry)
+	for _, e := range EvalProfile() {
+		entries[evalProfileKey{kind: e.Kind, name: e.Name}] = e
+		if e.SelfTime > e.Time || e.SelfAlloc > e.Alloc {
+			t.Errorf("self is larger than total: %+v", e)
+		}
+	}
+	for _, tc := range []struct {
+		kind, name string
+		count      int
+	}{
+		{ProfileMakefile, mk, 1},
+		{ProfileMakefile, sub, 1},
+		{ProfileRule, mk + ":6", 1},
+		{ProfileVar, "WORDS", 2},
+		{ProfileCall, "f", 1},
+		{ProfileFunc, "$(foreach i,a b c,$(i))", 2},
+	} {
+		e, ok := entries[evalProfileKey{kind: tc.kind, name: tc.name}]
+		if !ok {
+			t.Errorf("no %s %s in %v", tc.kind, tc.name, entries)
+			continue
+		}
+		if e.Count != tc.count {
+			t.Errorf("%s %s: count=%d; want %d", tc.kind, tc.name, e.Count, tc.count)
+		}
+	}
+	top, included := entries[evalProfileKey{ProfileMakefile, mk}], entries[evalProfileKey{ProfileMakefile, sub}]
+	if top.Time-top.SelfTime != included.Time {
+		t.Errorf("time of %s excluded from its self time=%v; want %v of %s", mk, top.Time-top.SelfTime, included.Time, sub)
+	}
+
+	var buf bytes.Buffer
+	err = WriteEvalProfile(&buf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// a header and an entry for each of 5 kinds, and blank lines
+	// between them.
+	if len(lines) != 14 || !strings.HasSuffix(lines[0], " call") {
+		t.Errorf("WriteEvalProfile(top=1)=\n%s", buf.String())
+	}
+}
@@ -0,0 +1,676 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// PROTO saves DepGraphs in the protocol buffers wire format, which is
+// faster to load than gob or json for large graphs. Node messages are
+// indexed by their outputs first, and then decoded in parallel directly
+// into DepNodes, without intermediate structures. Nodes refer to
+// strings by their indexes in the string table, which is interned once.
+//
+// The schema is:
+//
+//	message Graph {
+//	  repeated string strs = 1;
+//	  repeated Node nodes = 2;
+//	  repeated NamedVar vars = 3;
+//	  repeated NamedVar tsvs = 4;
+//	  repeated string roots = 5;
+//	  repeated AccessedMakefile accessed_makefiles = 6;
+//	  repeated Export exports = 7;
+//	  bool export_all = 8;
+//	}
+//	message Node {
+//	  int32 output = 1;  // index of strs, as other int32s.
+//	  repeated int32 cmds = 2;
+//	  repeated int32 deps = 3;
+//	  repeated int32 order_onlys = 4;
+//	  repeated int32 parents = 5;
+//	  bool has_rule = 6;
+//	  bool is_phony = 7;
+//	  repeated int32 actual_inputs = 8;
+//	  repeated int32 target_specific_vars = 9;  // index of tsvs.
+//	  int32 filename = 10;
+//	  int32 lineno = 11;
+//	  bool not_parallel = 12;
+//	  repeated DoubleColon double_colons = 13;
+//	  int32 stem = 14;
+//	  bool is_intermediate = 15;
+//	  bool delete_on_error = 16;
+//	  bool one_shell = 17;
+//	  repeated int32 group_outputs = 18;
+//	  repeated int32 waits = 19;
+//	}
+//	message DoubleColon {
+//	  repeated int32 cmds = 1;
+//	  repeated int32 deps = 2;
+//	  repeated int32 order_onlys = 3;
+//	  repeated int32 actual_inputs = 4;
+//	  int32 filename = 5;
+//	  int32 lineno = 6;
+//	}
+//	message NamedVar {
+//	  string name = 1;
+//	  Var value = 2;
+//	}
+//	message Var {
+//	  string type = 1;
+//	  string v = 2;
+//	  string origin = 3;
+//	  repeated Var children = 4;
+//	}
+//	message AccessedMakefile {
+//	  string filename = 1;
+//	  bytes hash = 2;
+//	  int32 state = 3;
+//	  repeated string args = 4;
+//	  repeated string env = 5;
+//	}
+//	message Export {
+//	  string name = 1;
+//	  bool export = 2;
+//	}
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PROTO is a protocol buffers loader/saver.
+var PROTO LoadSaver = protoLoadSaver{}
+
+type protoLoadSaver struct{}
+
+// Wire types of protocol buffers.
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+var errProtoBroken = errors.New("broken proto")
+
+// protoWriter encodes a message.
+type protoWriter struct {
+	b   []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *protoWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.b = append(w.b, w.tmp[:n]...)
+}
+
+func (w *protoWriter) tag(field, wireType int) {
+	w.uvarint(uint64(field<<3 | wireType))
+}
+
+func (w *protoWriter) Int(field, v int) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, protoVarint)
+	w.uvarint(uint64(v))
+}
+
+func (w *protoWriter) Bool(field int, v bool) {
+	if v {
+		w.Int(field, 1)
+	}
+}
+
+func (w *protoWriter) Str(field int, s string) {
+	if s == "" {
+		return
+	}
+	w.tag(field, protoBytes)
+	w.uvarint(uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *protoWriter) Strs(field int, ss []string) {
+	for _, s := range ss {
+		// an empty string in a repeated field is still an element.
+		w.tag(field, protoBytes)
+		w.uvarint(uint64(len(s)))
+		w.b = append(w.b, s...)
+	}
+}
+
+// Ints writes a packed repeated field.
+func (w *protoWriter) Ints(field int, vs []int) {
+	if len(vs) == 0 {
+		return
+	}
+	var p protoWriter
+	for _, v := range vs {
+		p.uvarint(uint64(v))
+	}
+	w.Message(field, &p)
+}
+
+func (w *protoWriter) Message(field int, m *protoWriter) {
+	w.tag(field, protoBytes)
+	w.uvarint(uint64(len(m.b)))
+	w.b = append(w.b, m.b...)
+}
+
+// protoReader decodes fields of a message.
+type protoReader struct {
+	b   []byte
+	err error
+
+	// field, and v or data of the current field.
+	field int
+	v     uint64
+	data  []byte
+}
+
+func (r *protoReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errProtoBroken
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// Next reads the next field, and reports whether it exists.
+func (r *protoReader) Next() bool {
+	if r.err != nil || len(r.b) == 0 {
+		return false
+	}
+	tag := r.uvarint()
+	r.field = int(tag >> 3)
+	switch tag & 7 {
+	case protoVarint:
+		r.v = r.uvarint()
+	case protoBytes:
+		n := r.uvarint()
+		if r.err != nil || n > uint64(len(r.b)) {
+			r.err = errProtoBroken
+			return false
+		}
+		r.data = r.b[:n]
+		r.b = r.b[n:]
+	default:
+		r.err = fmt.Errorf("unsupported wire type %d", tag&7)
+	}
+	return r.err == nil
+}
+
+func (r *protoReader) Int() int { return int(r.v) }
+
+func (r *protoReader) Bool() bool { return r.v != 0 }
+
+func (r *protoReader) Str() string { return string(r.data) }
+
+func (r *protoReader) Ints() []int {
+	p := protoReader{b: r.data}
+	var vs []int
+	for len(p.b) > 0 && p.err == nil {
+		vs = append(vs, int(p.uvarint()))
+	}
+	if p.err != nil {
+		r.err = p.err
+	}
+	return vs
+}
+
+func encodeProtoVar(sv serializableVar) *protoWriter {
+	w := &protoWriter{}
+	w.Str(1, sv.Type)
+	w.Str(2, sv.V)
+	w.Str(3, sv.Origin)
+	for _, c := range sv.Children {
+		w.Message(4, encodeProtoVar(c))
+	}
+	return w
+}
+
+func decodeProtoVar(b []byte) (serializableVar, error) {
+	var sv serializableVar
+	r := protoReader{b: b}
+	for r.Next() {
+		switch r.field {
+		case 1:
+			sv.Type = r.Str()
+		case 2:
+			sv.V = r.Str()
+		case 3:
+			sv.Origin = r.Str()
+		case 4:
+			c, err := decodeProtoVar(r.data)
+			if err != nil {
+				return sv, err
+			}
+			sv.Children = append(sv.Children, c)
+		}
+	}
+	return sv, r.err
+}
+
+func encodeProtoNamedVar(name string, sv serializableVar) *protoWriter {
+	w := &protoWriter{}
+	w.Str(1, name)
+	w.Message(2, encodeProtoVar(sv))
+	return w
+}
+
+func decodeProtoNamedVar(b []byte) (string, serializableVar, error) {
+	var name string
+	var sv serializableVar
+	r := protoReader{b: b}
+	for r.Next() {
+		switch r.field {
+		case 1:
+			name = r.Str()
+		case 2:
+			var err error
+			sv, err = decodeProtoVar(r.data)
+			if err != nil {
+				return "", sv, err
+			}
+		}
+	}
+	return name, sv, r.err
+}
+
+func encodeProtoNode(n *serializableDepNode) *protoWriter {
+	w := &protoWriter{}
+	w.Int(1, n.Output)
+	w.Ints(2, n.Cmds)
+	w.Ints(3, n.Deps)
+	w.Ints(4, n.OrderOnlys)
+	w.Ints(5, n.Parents)
+	w.Bool(6, n.HasRule)
+	w.Bool(7, n.IsPhony)
+	w.Ints(8, n.ActualInputs)
+	w.Ints(9, n.TargetSpecificVars)
+	w.Int(10, n.Filename)
+	w.Int(11, n.Lineno)
+	w.Bool(12, n.NotParallel)
+	for _, dc := range n.DoubleColons {
+		d := &protoWriter{}
+		d.Ints(1, dc.Cmds)
+		d.Ints(2, dc.Deps)
+		d.Ints(3, dc.OrderOnlys)
+		d.Ints(4, dc.ActualInputs)
+		d.Int(5, dc.Filename)
+		d.Int(6, dc.Lineno)
+		w.Message(13, d)
+	}
+	w.Int(14, n.Stem)
+	w.Bool(15, n.IsIntermediate)
+	w.Bool(16, n.DeleteOnError)
+	w.Bool(17, n.OneShell)
+	w.Ints(18, n.GroupOutputs)
+	w.Ints(19, n.Waits)
+	return w
+}
+
+func (protoLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
+	startTime := time.Now()
+	te := traceEvent.begin("serialize", literal(filename), traceEventMain)
+	defer traceEvent.end(te)
+	sg, err := makeSerializableGraph(g, roots)
+	if err != nil {
+		return err
+	}
+	w := &protoWriter{}
+	w.Strs(1, sg.Strs)
+	for _, n := range sg.Nodes {
+		w.Message(2, encodeProtoNode(n))
+	}
+	// Sort names for consistent serialization.
+	var names []string
+	for name := range sg.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.Message(3, encodeProtoNamedVar(name, sg.Vars[name]))
+	}
+	for _, tsv := range sg.Tsvs {
+		w.Message(4, encodeProtoNamedVar(tsv.Name, tsv.Value))
+	}
+	w.Strs(5, sg.Roots)
+	for _, mk := range sg.AccessedMks {
+		m := &protoWriter{}
+		m.Str(1, mk.Filename)
+		m.Str(2, string(mk.Hash[:]))
+		m.Int(3, int(mk.State))
+		m.Strs(4, mk.Args)
+		m.Strs(5, mk.Env)
+		w.Message(6, m)
+	}
+	names = names[:0]
+	for name := range sg.Exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := &protoWriter{}
+		e.Str(1, name)
+		e.Bool(2, sg.Exports[name])
+		w.Message(7, e)
+	}
+	w.Bool(8, sg.ExportAll)
+	err = ioutil.WriteFile(filename, w.b, 0644)
+	if err != nil {
+		return err
+	}
+	logStats("proto serialize time: %q", time.Since(startTime))
+	return nil
+}
+
+func (protoLoadSaver) Load(filename string) (*DepGraph, error) {
+	startTime := time.Now()
+	te := traceEvent.begin("deserialize", literal(filename), traceEventMain)
+	defer traceEvent.end(te)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	g, err := decodeProtoGraph(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	logStats("proto deserialize time: %q", time.Since(startTime))
+	return g, nil
+}
+
+func decodeProtoGraph(b []byte) (*DepGraph, error) {
+	var strs []string
+	var nodes [][]byte
+	var tsvs []protoTsv
+	var accessedMks []*accessedMakefile
+	svars := make(map[string]serializableVar)
+	exports := make(map[string]bool)
+	g := &DepGraph{}
+	r := protoReader{b: b}
+	for r.Next() {
+		switch r.field {
+		case 1:
+			strs = append(strs, r.Str())
+		case 2:
+			nodes = append(nodes, r.data)
+		case 3, 4:
+			name, sv, err := decodeProtoNamedVar(r.data)
+			if err != nil {
+				return nil, err
+			}
+			if r.field == 3 {
+				svars[name] = sv
+				continue
+			}
+			// Deserialize all TSVs first so that multiple rules
+			// can share memory.
+			dv, err := deserializeVar(sv)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := dv.(Var)
+			if !ok {
+				return nil, fmt.Errorf("not var: %s %T", dv, dv)
+			}
+			tsvs = append(tsvs, protoTsv{name: name, v: v})
+		case 6:
+			mk := &accessedMakefile{}
+			m := protoReader{b: r.data}
+			for m.Next() {
+				switch m.field {
+				case 1:
+					mk.Filename = m.Str()
+				case 2:
+					copy(mk.Hash[:], m.data)
+				case 3:
+					mk.State = fileState(m.Int())
+				case 4:
+					mk.Args = append(mk.Args, m.Str())
+				case 5:
+					mk.Env = append(mk.Env, m.Str())
+				}
+			}
+			if m.err != nil {
+				return nil, m.err
+			}
+			accessedMks = append(accessedMks, mk)
+		case 7:
+			var name string
+			var export bool
+			e := protoReader{b: r.data}
+			for e.Next() {
+				switch e.field {
+				case 1:
+					name = e.Str()
+				case 2:
+					export = e.Bool()
+				}
+			}
+			if e.err != nil {
+				return nil, e.err
+			}
+			exports[name] = export
+		case 8:
+			g.exportAll = r.Bool()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	vars, err := deserializeVars(svars)
+	if err != nil {
+		return nil, err
+	}
+	g.vars = vars
+	g.accessedMks = accessedMks
+	g.exports = exports
+	g.nodes, err = decodeProtoNodes(nodes, internStrs(strs), tsvs)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// protoTsv is a decoded target specific variable with its name.
+type protoTsv struct {
+	name string
+	v    Var
+}
+
+// decodeProtoNodes decodes node messages. It indexes nodes by their
+// outputs first, so each node can be decoded independently. strs is
+// the interned string table.
+func decodeProtoNodes(msgs [][]byte, strs []string, tsvs []protoTsv) ([]*DepNode, error) {
+	str := func(r *protoReader, i int) string {
+		if i < 0 || i >= len(strs) {
+			if r.err == nil {
+				r.err = fmt.Errorf("unknown string: %d", i)
+			}
+			return ""
+		}
+		return strs[i]
+	}
+	strList := func(r *protoReader, ids []int) []string {
+		var ss []string
+		for _, id := range ids {
+			ss = append(ss, str(r, id))
+		}
+		return ss
+	}
+	nodes := make([]*DepNode, len(msgs))
+	nodeMap := make(map[string]*DepNode, len(msgs))
+	for i, msg := range msgs {
+		output := 0
+		r := protoReader{b: msg}
+		for r.Next() {
+			if r.field == 1 {
+				output = r.Int()
+				break
+			}
+		}
+		// TargetSpecificVars is allocated only if the node has
+		// any, since most nodes don't.
+		d := &DepNode{Output: str(&r, output)}
+		if r.err != nil {
+			return nil, r.err
+		}
+		nodes[i] = d
+		nodeMap[d.Output] = d
+	}
+	lookup := func(r *protoReader, ids []int) []*DepNode {
+		var ns []*DepNode
+		for _, id := range ids {
+			t := str(r, id)
+			n, ok := nodeMap[t]
+			if !ok {
+				if r.err == nil {
+					r.err = fmt.Errorf("unknown target: %d (%s)", id, t)
+				}
+				return nil
+			}
+			ns = append(ns, n)
+		}
+		return ns
+	}
+
+	decode := func(d *DepNode, msg []byte) error {
+		// absent fields are 0, which is an index of strs.
+		var filename, stem int
+		r := protoReader{b: msg}
+		for r.Next() {
+			switch r.field {
+			case 2:
+				d.Cmds = strList(&r, r.Ints())
+			case 3:
+				d.Deps = lookup(&r, r.Ints())
+			case 4:
+				d.OrderOnlys = lookup(&r, r.Ints())
+			case 5:
+				d.Parents = lookup(&r, r.Ints())
+			case 6:
+				d.HasRule = r.Bool()
+			case 7:
+				d.IsPhony = r.Bool()
+			case 8:
+				d.ActualInputs = strList(&r, r.Ints())
+			case 9:
+				if d.TargetSpecificVars == nil {
+					d.TargetSpecificVars = make(Vars)
+				}
+				for _, id := range r.Ints() {
+					if id < 0 || id >= len(tsvs) {
+						return fmt.Errorf("unknown target specific var: %d", id)
+					}
+					d.TargetSpecificVars[tsvs[id].name] = tsvs[id].v
+				}
+			case 10:
+				filename = r.Int()
+			case 11:
+				d.Lineno = r.Int()
+			case 12:
+				d.NotParallel = r.Bool()
+			case 13:
+				dn := &DepNode{HasRule: true}
+				dcFilename := 0
+				dc := protoReader{b: r.data}
+				for dc.Next() {
+					switch dc.field {
+					case 1:
+						dn.Cmds = strList(&dc, dc.Ints())
+					case 2:
+						dn.Deps = lookup(&dc, dc.Ints())
+					case 3:
+						dn.OrderOnlys = lookup(&dc, dc.Ints())
+					case 4:
+						dn.ActualInputs = strList(&dc, dc.Ints())
+					case 5:
+						dcFilename = dc.Int()
+					case 6:
+						dn.Lineno = dc.Int()
+					}
+				}
+				dn.Filename = str(&dc, dcFilename)
+				if dc.err != nil {
+					return dc.err
+				}
+				d.DoubleColons = append(d.DoubleColons, dn)
+			case 14:
+				stem = r.Int()
+			case 15:
+				d.IsIntermediate = r.Bool()
+			case 16:
+				d.DeleteOnError = r.Bool()
+			case 17:
+				d.OneShell = r.Bool()
+			case 18:
+				d.GroupOutputs = strList(&r, r.Ints())
+			case 19:
+				d.Waits = r.Ints()
+			}
+		}
+		d.Filename = str(&r, filename)
+		d.Stem = str(&r, stem)
+		if r.err != nil {
+			return r.err
+		}
+		// double-colon rules share fields of the node.
+		for _, dn := range d.DoubleColons {
+			dn.Output = d.Output
+			dn.IsPhony = d.IsPhony
+			dn.Stem = d.Stem
+			dn.TargetSpecificVars = d.TargetSpecificVars
+			dn.NotParallel = d.NotParallel
+			dn.DeleteOnError = d.DeleteOnError
+			dn.OneShell = d.OneShell
+			dn.GroupOutputs = d.GroupOutputs
+		}
+		return nil
+	}
+
+	workers := runtime.NumCPU()
+	if workers > len(msgs) {
+		workers = len(msgs)
+	}
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(msgs); i += workers {
+				err := decode(nodes[i], msgs[i])
+				if err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProtoLoadSaver(t *testing.T) {
+	chdirTestMakefile(t, `
+export E := e
+unexport U
+A = $(B) $(notdir a/b)
+B := b
+all: a.o b.o | dir
+	echo $(A)
+%.o: %.c
+	cc -c $< -o $@
+a.o: X := x
+a.o b.o: Y = $(X) y
+dir:
+	mkdir $@
+.PHONY: all
+d::
+	echo 1
+d:: a.o
+	echo 2
+`)
+	for _, fn := range []string{"a.c", "b.c"} {
+		err := ioutil.WriteFile(fn, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := load(LoadReq{Makefile: "Makefile", Targets: []string{"all", "d"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := []string{"all", "d"}
+	var want serializableGraph
+	for _, ls := range []LoadSaver{GOB, PROTO} {
+		fn := "graph"
+		err = ls.Save(g, fn, roots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lg, err := ls.Load(fn)
+		if err != nil {
+			t.Fatalf("%T.Load: %v", ls, err)
+		}
+		got, err := makeSerializableGraph(lg, roots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ls == GOB {
+			want = got
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: loaded %#v; want %#v", ls, got, want)
+		}
+	}
+}
+
+func TestProtoBroken(t *testing.T) {
+	for _, in := range []string{
+		"\x0a\x05ab",           // truncated targets
+		"\x12\x02\x08\x01",     // unknown output
+		"\x0b",                 // unsupported wire type
+		"\x12\x04\x1a\x02\x01", // truncated message
+	} {
+		_, err := decodeProtoGraph([]byte(in))
+		if err == nil {
+			t.Errorf("decodeProtoGraph(%q)=_, nil; want error", in)
+		}
+	}
+}
+
+func BenchmarkLoadGraph(b *testing.B) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var sb strings.Builder
+	sb.WriteString("CFLAGS := -O2\n")
+	const n = 10000
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "out/%d.o: src/%d.c src/%d.h\n\tcc $(CFLAGS) -c $< -o $@\n", i, i, i%100)
+	}
+	sb.WriteString("all:")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, " out/%d.o", i)
+	}
+	sb.WriteString("\n")
+	mk := filepath.Join(dir, "Makefile")
+	err = ioutil.WriteFile(mk, []byte(sb.String()), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: mk, Targets: []string{"all"}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		ls   LoadSaver
+	}{
+		{"gob", GOB},
+		{"json", JSON},
+		{"proto", PROTO},
+	} {
+		fn := filepath.Join(dir, "graph."+tc.name)
+		err := tc.ls.Save(g, fn, []string{"all"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := tc.ls.Load(fn)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
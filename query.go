@@ -14,11 +14,51 @@
 
 package kati
 
+// Queries of the dependency graph, e.g. by -query.
+//
+//	*               top level targets.
+//	$*              global variables.
+//	$MAKEFILE_LIST  makefiles read.
+//	deps:X          transitive prerequisites of X.
+//	rules:PATTERN   targets with rules matching the shell pattern.
+//	cmd:X           expanded commands to build X.
+//	why:X           reasons why X is rebuilt.
+//	X               the rule of X.
+
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 )
 
+// QueryResult is a result of QueryGraph.
+type QueryResult struct {
+	Query string      `json:"query"`
+	Nodes []QueryNode `json:"nodes"`
+}
+
+// QueryNode is a target in QueryResult.
+type QueryNode struct {
+	Output   string   `json:"output"`
+	Location string   `json:"location,omitempty"`
+	Phony    bool     `json:"phony,omitempty"`
+	Inputs   []string `json:"inputs,omitempty"`
+	Cmds     []string `json:"cmds,omitempty"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
+
+func newQueryNode(n *DepNode) QueryNode {
+	qn := QueryNode{
+		Output: n.Output,
+		Phony:  n.IsPhony,
+	}
+	if n.Filename != "" {
+		qn.Location = fmt.Sprintf("%s:%d", n.Filename, n.Lineno)
+	}
+	return qn
+}
+
 func showDeps(w io.Writer, n *DepNode, indent int, seen map[string]int) {
 	id, present := seen[n.Output]
 	if !present {
@@ -64,13 +104,168 @@ func showNode(w io.Writer, n *DepNode) {
 	showDeps(w, n, 1, seen)
 }
 
-func handleNodeQuery(w io.Writer, q string, nodes []*DepNode) {
+// walkNodes calls f for each node reachable from nodes once, in
+// depth-first pre-order.
+func walkNodes(nodes []*DepNode, seen map[*DepNode]bool, f func(*DepNode)) {
 	for _, n := range nodes {
-		if n.Output == q {
-			showNode(w, n)
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		f(n)
+		walkNodes(n.Deps, seen, f)
+		walkNodes(n.OrderOnlys, seen, f)
+	}
+}
+
+// findNode finds the node of output in g.
+func findNode(g *DepGraph, output string) (*DepNode, error) {
+	var found *DepNode
+	walkNodes(g.nodes, make(map[*DepNode]bool), func(n *DepNode) {
+		if found == nil && n.Output == output {
+			found = n
+		}
+	})
+	if found == nil {
+		return nil, fmt.Errorf("*** no target %q.", output)
+	}
+	return found, nil
+}
+
+func handleNodeQuery(w io.Writer, q string, g *DepGraph) {
+	n, err := findNode(g, q)
+	if err != nil {
+		return
+	}
+	showNode(w, n)
+}
+
+// whyRebuilt returns reasons why n is rebuilt. rebuilt caches
+// whether a node is rebuilt.
+func whyRebuilt(n *DepNode, rebuilt map[*DepNode]bool) []string {
+	if n.IsPhony {
+		return []string{fmt.Sprintf("%s is phony", n.Output)}
+	}
+	ts := getTimestamp(n.Output)
+	if ts < 0 {
+		if !n.HasRule {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s doesn't exist", n.Output)}
+	}
+	var reasons []string
+	for _, d := range n.Deps {
+		if isRebuilt(d, rebuilt) {
+			reasons = append(reasons, fmt.Sprintf("prerequisite %s is rebuilt", d.Output))
+			continue
+		}
+		if dts := getTimestamp(d.Output); dts > ts {
+			reasons = append(reasons, fmt.Sprintf("prerequisite %s is newer than %s", d.Output, n.Output))
+		}
+	}
+	return reasons
+}
+
+func isRebuilt(n *DepNode, rebuilt map[*DepNode]bool) bool {
+	r, ok := rebuilt[n]
+	if ok {
+		return r
+	}
+	// a cyclic dependency is not rebuilt by itself.
+	rebuilt[n] = false
+	r = len(whyRebuilt(n, rebuilt)) > 0
+	rebuilt[n] = r
+	return r
+}
+
+var queryKinds = map[string]bool{"deps": true, "rules": true, "cmd": true, "why": true}
+
+// splitQuery splits q into its kind and argument, e.g. "deps" and "X"
+// for "deps:X". kind is empty for a target.
+func splitQuery(q string) (kind, arg string) {
+	if i := strings.IndexByte(q, ':'); i > 0 && queryKinds[q[:i]] {
+		return q[:i], q[i+1:]
+	}
+	return "", q
+}
+
+// QueryGraph queries q in g, except queries of variables and
+// makefiles.
+func QueryGraph(g *DepGraph, q string) (*QueryResult, error) {
+	r := &QueryResult{Query: q}
+	kind, arg := splitQuery(q)
+	switch kind {
+	case "deps":
+		n, err := findNode(g, arg)
+		if err != nil {
+			return nil, err
+		}
+		seen := map[*DepNode]bool{n: true}
+		walkNodes(n.Deps, seen, func(d *DepNode) {
+			r.Nodes = append(r.Nodes, newQueryNode(d))
+		})
+		walkNodes(n.OrderOnlys, seen, func(d *DepNode) {
+			r.Nodes = append(r.Nodes, newQueryNode(d))
+		})
+	case "rules":
+		walkNodes(g.nodes, make(map[*DepNode]bool), func(n *DepNode) {
+			if n.HasRule && fnmatch(arg, n.Output) {
+				r.Nodes = append(r.Nodes, newQueryNode(n))
+			}
+		})
+	case "cmd":
+		n, err := findNode(g, arg)
+		if err != nil {
+			return nil, err
+		}
+		runners, _, err := createRunners(newExecContext(g.vars, g.vpaths, true), n)
+		if err != nil {
+			return nil, err
+		}
+		qn := newQueryNode(n)
+		for _, r := range runners {
+			qn.Cmds = append(qn.Cmds, r.cmd)
+		}
+		r.Nodes = append(r.Nodes, qn)
+	case "why":
+		n, err := findNode(g, arg)
+		if err != nil {
+			return nil, err
+		}
+		qn := newQueryNode(n)
+		qn.Reasons = whyRebuilt(n, make(map[*DepNode]bool))
+		r.Nodes = append(r.Nodes, qn)
+	default:
+		if q == "*" {
+			for _, n := range g.nodes {
+				r.Nodes = append(r.Nodes, newQueryNode(n))
+			}
 			break
 		}
+		n, err := findNode(g, q)
+		if err != nil {
+			return nil, err
+		}
+		qn := newQueryNode(n)
+		qn.Inputs = n.ActualInputs
+		qn.Cmds = n.Cmds
+		r.Nodes = append(r.Nodes, qn)
+	}
+	return r, nil
+}
+
+// QueryJSON queries q in g, and writes the result in JSON.
+func QueryJSON(w io.Writer, q string, g *DepGraph) error {
+	r, err := QueryGraph(g, q)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
 	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
 }
 
 // Query queries q in g.
@@ -95,5 +290,33 @@ func Query(w io.Writer, q string, g *DepGraph) {
 		}
 		return
 	}
-	handleNodeQuery(w, q, g.nodes)
+	kind, _ := splitQuery(q)
+	if kind == "" {
+		handleNodeQuery(w, q, g)
+		return
+	}
+	r, err := QueryGraph(g, q)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+	for _, n := range r.Nodes {
+		switch {
+		case kind == "cmd":
+			for _, c := range n.Cmds {
+				fmt.Fprintln(w, c)
+			}
+		case kind == "why":
+			if len(n.Reasons) == 0 {
+				fmt.Fprintf(w, "%s is up to date\n", n.Output)
+			}
+			for _, reason := range n.Reasons {
+				fmt.Fprintln(w, reason)
+			}
+		case n.Location != "":
+			fmt.Fprintf(w, "%s\t%s\n", n.Output, n.Location)
+		default:
+			fmt.Fprintln(w, n.Output)
+		}
+	}
 }
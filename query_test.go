@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	chdirTestMakefile(t, `all: out/a.o out/b.o
+out/a.o: a.c | out
+	cc -c $< -o $@
+out/b.o: b.c
+	cc -c $< -o $@
+out:
+	mkdir -p $@
+.PHONY: all
+`)
+
+	now := time.Now()
+	for _, f := range []struct {
+		name  string
+		mtime time.Time
+	}{
+		{name: "a.c", mtime: now.Add(-2 * time.Hour)},
+		{name: "out/a.o", mtime: now.Add(-time.Hour)},
+		{name: "b.c", mtime: now},
+		{name: "out/b.o", mtime: now.Add(-time.Hour)},
+	} {
+		err := os.MkdirAll(filepath.Dir(f.name), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(f.name, nil, 0644)
+		}
+		if err == nil {
+			err = os.Chtimes(f.name, f.mtime, f.mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		q    string
+		want string
+	}{
+		{
+			q:    "deps:all",
+			want: "out/a.o\tMakefile:3\na.c\nout\tMakefile:7\nout/b.o\tMakefile:5\nb.c\n",
+		},
+		{
+			q:    "rules:out/*.o",
+			want: "out/a.o\tMakefile:3\nout/b.o\tMakefile:5\n",
+		},
+		{
+			q:    "cmd:out/a.o",
+			want: "cc -c a.c -o out/a.o\n",
+		},
+		{
+			q:    "why:out/a.o",
+			want: "out/a.o is up to date\n",
+		},
+		{
+			q:    "why:out/b.o",
+			want: "prerequisite b.c is newer than out/b.o\n",
+		},
+		{
+			q:    "why:all",
+			want: "all is phony\n",
+		},
+		{
+			q:    "deps:b.c",
+			want: "",
+		},
+		{
+			q:    "cmd:nothing",
+			want: "*** no target \"nothing\".\n",
+		},
+	} {
+		var buf bytes.Buffer
+		Query(&buf, tc.q, g)
+		if got := buf.String(); got != tc.want {
+			t.Errorf("Query(%q)=%q; want %q", tc.q, got, tc.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = QueryJSON(&buf, "why:out/b.o", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r QueryResult
+	err = json.Unmarshal(buf.Bytes(), &r)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf.Bytes(), err)
+	}
+	want := QueryResult{
+		Query: "why:out/b.o",
+		Nodes: []QueryNode{
+			{
+				Output:   "out/b.o",
+				Location: "Makefile:5",
+				Reasons:  []string{"prerequisite b.c is newer than out/b.o"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("QueryJSON=%+v; want %+v", r, want)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"os"
+)
+
+// RegenDebug makes kati print why makefiles are loaded again instead
+// of reusing a cached DepGraph, e.g. by -use_cache or the kati server.
+var RegenDebug bool
+
+// Kinds of RegenReason.
+const (
+	RegenCache    = "cache"    // no cached DepGraph.
+	RegenMakefile = "makefile" // a makefile read or missing.
+	RegenGlob     = "glob"     // a glob pattern of an include directive.
+	RegenWildcard = "wildcard" // a pattern of $(wildcard).
+	RegenEnv      = "env"      // an environment variable.
+	RegenShell    = "shell"    // a command of $(shell).
+)
+
+// RegenReason is why a cached DepGraph is stale.
+type RegenReason struct {
+	// Kind is what changed, e.g. RegenMakefile.
+	Kind string `json:"kind"`
+	// Name is the makefile, the pattern, the name of the environment
+	// variable or the command.
+	Name string `json:"name,omitempty"`
+	// Change is how it changed: "created", "removed", "modified",
+	// "set", "unset" or "changed", or "not found" for RegenCache.
+	Change string `json:"change"`
+	// Value is the current value of the environment variable.
+	Value string `json:"value,omitempty"`
+}
+
+func (r *RegenReason) Error() string {
+	switch r.Kind {
+	case RegenCache:
+		if r.Name == "" {
+			return fmt.Sprintf("cache %s", r.Change)
+		}
+		return fmt.Sprintf("cache %s %s", r.Name, r.Change)
+	case RegenMakefile:
+		return fmt.Sprintf("%s was %s", r.Name, r.Change)
+	case RegenGlob:
+		return fmt.Sprintf("files matched by include %s %s", r.Name, r.Change)
+	case RegenWildcard:
+		return fmt.Sprintf("$(wildcard %s) %s", r.Name, r.Change)
+	case RegenEnv:
+		if r.Change == "unset" {
+			return fmt.Sprintf("environment variable %s unset", r.Name)
+		}
+		return fmt.Sprintf("environment variable %s %s: %s=%s", r.Name, r.Change, r.Name, r.Value)
+	case RegenShell:
+		return fmt.Sprintf("output of $(shell %s) %s", r.Name, r.Change)
+	}
+	return fmt.Sprintf("%s %s %s", r.Kind, r.Name, r.Change)
+}
+
+// logRegen prints r if RegenDebug is true.
+func logRegen(r *RegenReason) {
+	if RegenDebug {
+		fmt.Fprintf(os.Stderr, "kati: regenerating: %v\n", r)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Remaking makefiles, as GNU make does: after makefiles are loaded
+// with LoadReq.RemakeMakefiles, Executor.RemakeMakefiles makes the
+// makefiles read, and the missing makefiles of include directives, as
+// targets. If any of them is remade, makefiles should be loaded again
+// with LoadReq.Restarts incremented. A missing makefile of an include
+// directive which can't be made is an error, but one of a -include
+// directive is ignored.
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// missingMakefile is a makefile of an include directive which doesn't
+// exist.
+type missingMakefile struct {
+	filename string
+	pos      srcpos
+	// optional is true for a -include directive.
+	optional bool
+}
+
+// makefileTargets returns makefiles in MAKEFILE_LIST of vars and
+// missing makefiles, which are remade. As GNU make, makefiles read
+// later are remade earlier.
+func makefileTargets(vars Vars, missing []missingMakefile) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	add := func(fn string) {
+		if fn == "" || seen[fn] {
+			return
+		}
+		seen[fn] = true
+		targets = append(targets, fn)
+	}
+	for _, fn := range splitSpaces(vars.Lookup("MAKEFILE_LIST").String()) {
+		add(fn)
+	}
+	for _, m := range missing {
+		add(m.filename)
+	}
+	for i, j := 0, len(targets)-1; i < j; i, j = i+1, j-1 {
+		targets[i], targets[j] = targets[j], targets[i]
+	}
+	return targets
+}
+
+// RemakeMakefiles makes makefiles of g loaded with
+// LoadReq.RemakeMakefiles, and reports whether any of them is remade,
+// i.e. g is stale and makefiles should be loaded again. As GNU make,
+// commands to remake makefiles run even with DryRunFlag, TouchFlag or
+// QuestionFlag. An Executor runs either Exec or RemakeMakefiles only
+// once.
+func (ex *Executor) RemakeMakefiles(g *DepGraph) (remade bool, err error) {
+	defer recoverPanic(nil, &err)
+	var nodes []*DepNode
+	mtimes := make(map[string]int64)
+	for _, n := range g.makefiles {
+		if !n.HasRule || n.IsPhony {
+			continue
+		}
+		nodes = append(nodes, n)
+		mtimes[n.Output] = getTimestamp(n.Output)
+	}
+	debugf(DebugBasic, "Updating makefiles....")
+	// as GNU make, messages of makefiles are printed only with
+	// DebugMakefiles.
+	if ex.debug&DebugMakefiles == 0 {
+		ex.debug &= DebugJobs
+	}
+	ex.indent = 1
+	dryRun, touch, question := DryRunFlag, TouchFlag, QuestionFlag
+	DryRunFlag, TouchFlag, QuestionFlag = false, false, false
+	// the exec context defines automatic variables in the graph's
+	// vars, which can't be saved.
+	_, err = ex.build(g.copyVars(), nodes)
+	DryRunFlag, TouchFlag, QuestionFlag = dryRun, touch, question
+	if err != nil {
+		return false, err
+	}
+	for fn, t := range mtimes {
+		if getTimestamp(fn) != t {
+			glog.Infof("makefile %s is remade", fn)
+			remade = true
+		}
+	}
+	if remade {
+		return true, nil
+	}
+	for _, m := range g.missingMakefiles {
+		if m.optional || exists(m.filename) {
+			continue
+		}
+		return false, fmt.Errorf("%s: %s: No such file or directory\n*** No rule to make target `%s'.", m.pos, m.filename, m.filename)
+	}
+	return false, g.targetsErr
+}
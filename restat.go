@@ -0,0 +1,220 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// restatLog records hashes of outputs made by commands, so that targets
+// depending on an output which the commands regenerate with the same
+// contents aren't remade, as restat of ninja.
+//
+// An output has two timestamps. Its modification time tells whether it
+// is out of date, as usual. The time when its contents changed last is
+// its timestamp for targets depending on it, as long as its
+// modification time is the one recorded in the log.
+//
+// The log is a text file whose lines are
+//
+//	<mtime> <ts> <sha256 in hex> <output>
+type restatLog struct {
+	filename string
+
+	mu      sync.Mutex
+	entries map[string]restatEntry
+	dirty   bool
+}
+
+type restatEntry struct {
+	// mtime is the modification time of the output when recorded.
+	mtime int64
+	// ts is when the contents changed last.
+	ts   int64
+	hash [sha256.Size]byte
+}
+
+// restatState is an output before its commands run.
+type restatState struct {
+	ts   int64
+	hash [sha256.Size]byte
+	ok   bool
+}
+
+// loadRestatLog loads the log in filename. The log is empty if the
+// file doesn't exist.
+func loadRestatLog(filename string) (*restatLog, error) {
+	l := &restatLog{
+		filename: filename,
+		entries:  make(map[string]restatEntry),
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		output, e, err := parseRestatEntry(s.Text())
+		if err != nil {
+			// commands will run again at worst.
+			glog.Warningf("%s:%d: %v; ignoring restat log", filename, lineno, err)
+			l.entries = make(map[string]restatEntry)
+			return l, nil
+		}
+		l.entries[output] = e
+	}
+	return l, s.Err()
+}
+
+func parseRestatEntry(line string) (string, restatEntry, error) {
+	var e restatEntry
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 {
+		return "", e, fmt.Errorf("malformed entry %q", line)
+	}
+	var err error
+	e.mtime, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", e, err
+	}
+	e.ts, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", e, err
+	}
+	h, err := hex.DecodeString(fields[2])
+	if err != nil || len(h) != len(e.hash) {
+		return "", e, fmt.Errorf("malformed hash %q", fields[2])
+	}
+	copy(e.hash[:], h)
+	return fields[3], e, nil
+}
+
+// save writes the log if it is updated.
+func (l *restatLog) save() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	var buf bytes.Buffer
+	for output, e := range l.entries {
+		fmt.Fprintf(&buf, "%d %d %x %s\n", e.mtime, e.ts, e.hash, output)
+	}
+	tmp := l.filename + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, l.filename)
+	if err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// timestamp returns the timestamp of output for targets depending on
+// it, whose modification time is mtime.
+func (l *restatLog) timestamp(output string, mtime int64) int64 {
+	if l == nil || mtime < 0 {
+		return mtime
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[output]; ok && e.mtime == mtime {
+		return e.ts
+	}
+	return mtime
+}
+
+// before returns the state of output, whose modification time is
+// mtime, before its commands run.
+func (l *restatLog) before(output string, mtime int64) restatState {
+	if l == nil || mtime < 0 {
+		return restatState{}
+	}
+	l.mu.Lock()
+	e, ok := l.entries[output]
+	l.mu.Unlock()
+	if ok && e.mtime == mtime {
+		return restatState{ts: e.ts, hash: e.hash, ok: true}
+	}
+	h, err := hashFile(output)
+	if err != nil {
+		return restatState{}
+	}
+	return restatState{ts: mtime, hash: h, ok: true}
+}
+
+// after records output, whose modification time is mtime after its
+// commands ran, and returns its timestamp for targets depending on
+// it. The timestamp is the one in b if the contents are the same.
+func (l *restatLog) after(output string, b restatState, mtime int64) int64 {
+	if l == nil || mtime < 0 {
+		return mtime
+	}
+	h, err := hashFile(output)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dirty = true
+	if err != nil {
+		delete(l.entries, output)
+		return mtime
+	}
+	ts := mtime
+	if b.ok && b.hash == h && b.ts <= mtime {
+		glog.V(1).Infof("restat: %s is unchanged", output)
+		ts = b.ts
+	}
+	l.entries[output] = restatEntry{mtime: mtime, ts: ts, hash: h}
+	return ts
+}
+
+func hashFile(filename string) ([sha256.Size]byte, error) {
+	var h [sha256.Size]byte
+	f, err := os.Open(filename)
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+	d := sha256.New()
+	_, err = io.Copy(d, f)
+	if err != nil {
+		return h, err
+	}
+	copy(h[:], d.Sum(nil))
+	return h, nil
+}
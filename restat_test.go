@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestatLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	write := func(content string, mtime int64) {
+		err := ioutil.WriteFile(out, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(out, time.Unix(mtime, 0), time.Unix(mtime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logfile := filepath.Join(dir, ".kati_restat")
+	l, err := loadRestatLog(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("a", 1000)
+	b := l.before(out, 1000)
+	write("a", 2000)
+	if got, want := l.after(out, b, 2000), int64(1000); got != want {
+		t.Errorf("after(unchanged)=%d; want %d", got, want)
+	}
+	err = l.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = loadRestatLog(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		mtime, want int64
+	}{
+		{mtime: 2000, want: 1000},
+		// modified by others.
+		{mtime: 3000, want: 3000},
+		{mtime: -2, want: -2},
+	} {
+		if got := l.timestamp(out, tc.mtime); got != tc.want {
+			t.Errorf("timestamp(out, %d)=%d; want %d", tc.mtime, got, tc.want)
+		}
+	}
+
+	b = l.before(out, 2000)
+	write("b", 3000)
+	if got, want := l.after(out, b, 3000), int64(3000); got != want {
+		t.Errorf("after(changed)=%d; want %d", got, want)
+	}
+}
+
+func TestExecRestat(t *testing.T) {
+	chdirTestMakefile(t, `all: gen.h
+	cat gen.h > all; echo all >> log
+gen.h: src
+	cp src gen.h
+`)
+	err := ioutil.WriteFile("src", []byte("src\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = os.Chtimes("src", now.Add(-100*time.Second), now.Add(-100*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mtime := range []time.Time{now, now.Add(100 * time.Second)} {
+		if i > 0 {
+			// gen.h is regenerated with the same contents,
+			// newer than all.
+			for f, d := range map[string]time.Duration{"gen.h": -60 * time.Second, "all": -50 * time.Second} {
+				err = os.Chtimes(f, now.Add(d), now.Add(d))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		err = os.Chtimes("src", mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := NewExecutor(&ExecutorOpt{RestatFile: ".kati_restat"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "all\n"; got != want {
+			t.Errorf("exec #%d: log=%q; want %q", i, got, want)
+		}
+	}
+}
@@ -33,6 +33,14 @@ func (p pattern) match(s string) bool {
 	return strings.HasPrefix(s, p.prefix) && strings.HasSuffix(s, p.suffix)
 }
 
+// stem returns the part of s matched with '%' of p.
+func (p pattern) stem(s string) (string, bool) {
+	if len(s) < len(p.prefix)+len(p.suffix) || !p.match(s) {
+		return "", false
+	}
+	return s[len(p.prefix) : len(s)-len(p.suffix)], true
+}
+
 func (p pattern) subst(repl, str string) string {
 	in := str
 	trimed := str
@@ -70,6 +78,39 @@ type rule struct {
 	isSuffixRule    bool
 	cmds            []string
 	cmdLineno       int
+	// inputFiles are inputs of merged rules by their makefiles.
+	// nil if the rule is not merged.
+	inputFiles []ruleInputs
+	// doubleColonRules are merged double-colon rules in order.
+	// nil if the rule is not merged.
+	doubleColonRules []*rule
+	// stem is the stem of the output of a static pattern rule.
+	stem string
+	// groupOutputs are outputs of a grouped rule "a b &: c", whose
+	// commands make all of them at once, or nil.
+	groupOutputs []string
+}
+
+// ruleInputs are inputs of a rule in a makefile.
+type ruleInputs struct {
+	filename string
+	inputs   []string
+}
+
+// inputsByFile returns inputs of r by makefiles which declared them.
+func (r *rule) inputsByFile() []ruleInputs {
+	if r.inputFiles != nil {
+		return r.inputFiles
+	}
+	return []ruleInputs{{filename: r.filename, inputs: r.inputs}}
+}
+
+// doubleColons returns double-colon rules merged into r.
+func (r *rule) doubleColons() []*rule {
+	if r.doubleColonRules != nil {
+		return r.doubleColonRules
+	}
+	return []*rule{r}
 }
 
 func (r *rule) cmdpos() srcpos {
@@ -91,7 +132,7 @@ func unescapeInput(s []byte) []byte {
 		if s[i] != '\\' {
 			continue
 		}
-		if i+1 < len(s) && s[i+1] == ' ' || s[i+1] == '=' {
+		if i+1 < len(s) && (s[i+1] == ' ' || s[i+1] == '=') {
 			copy(s[i:], s[i+1:])
 			s = s[:len(s)-1]
 		}
@@ -124,28 +165,19 @@ func (r *rule) parseInputs(s []byte) {
 			}
 			continue
 		}
-		input = unescapeInput(input)
-		if !hasWildcardMetaByte(input) {
-			add(internBytes(input))
-			continue
-		}
-		m, _ := wildcardCache.Glob(string(input))
-		if len(m) == 0 {
-			add(internBytes(input))
-			continue
-		}
-		for _, t := range m {
-			add(intern(t))
-		}
+		// wildcards are expanded by Evaluator.globInputs.
+		add(internBytes(unescapeInput(input)))
 	}
+	r.inputs = expandArchiveMembers(r.inputs)
+	r.orderOnlyInputs = expandArchiveMembers(r.orderOnlyInputs)
 }
 
 func (r *rule) parseVar(s []byte, rhs expr) (*assignAST, error) {
 	var lhsBytes []byte
 	var op string
-	// TODO(ukai): support override, export.
-	if s[len(s)-1] != '=' {
-		panic(fmt.Sprintf("unexpected lhs %q", s))
+	// TODO(ukai): support override.
+	if len(s) < 2 || s[len(s)-1] != '=' {
+		return nil, fmt.Errorf("unexpected lhs %q", s)
 	}
 	switch s[len(s)-2] { // s[len(s)-1] is '='
 	case ':':
@@ -161,10 +193,17 @@ func (r *rule) parseVar(s []byte, rhs expr) (*assignAST, error) {
 		lhsBytes = trimSpaceBytes(s[:len(s)-1])
 		op = "="
 	}
+	var opt string
+	if w, rest := firstWord(lhsBytes); string(w) == "export" && len(rest) > 0 {
+		// e.g. "foo: export V := v"
+		opt = "export"
+		lhsBytes = rest
+	}
 	assign := &assignAST{
 		lhs: literal(string(lhsBytes)),
 		rhs: compactExpr(rhs),
 		op:  op,
+		opt: opt,
 	}
 	assign.srcpos = r.srcpos
 	return assign, nil
@@ -196,6 +235,11 @@ func (r *rule) parse(line []byte, assign *assignAST, rhs expr) (*assignAST, erro
 	}
 
 	first := line[:index]
+	// "a b &: c" is a grouped rule.
+	grouped := index > 0 && line[index-1] == '&'
+	if grouped {
+		first = line[:index-1]
+	}
 	ws := newWordScanner(first)
 	ws.esc = true
 	pat, isFirstPattern := isPatternRule(first)
@@ -213,6 +257,7 @@ func (r *rule) parse(line []byte, assign *assignAST, rhs expr) (*assignAST, erro
 			// TODO(ukai): expand raw wildcard for output. any usage?
 			r.outputs = append(r.outputs, internBytes(unescapeTarget(ws.Bytes())))
 		}
+		r.outputs = expandArchiveMembers(r.outputs)
 	}
 
 	index++
@@ -224,7 +269,7 @@ func (r *rule) parse(line []byte, assign *assignAST, rhs expr) (*assignAST, erro
 	rest := line[index:]
 	if assign != nil {
 		if len(rest) > 0 {
-			panic(fmt.Sprintf("pattern specific var? line:%q", line))
+			return nil, fmt.Errorf("*** unexpected text after target specific variable: %q", line)
 		}
 		return assign, nil
 	}
@@ -235,6 +280,9 @@ func (r *rule) parse(line []byte, assign *assignAST, rhs expr) (*assignAST, erro
 		}
 		return assign, nil
 	}
+	if grouped && len(r.outputs) > 1 {
+		r.groupOutputs = r.outputs
+	}
 	index = bytes.IndexByte(rest, ';')
 	if index >= 0 {
 		r.cmds = append(r.cmds, string(rest[index+1:]))
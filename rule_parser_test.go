@@ -50,6 +50,30 @@ func TestRuleParser(t *testing.T) {
 				isDoubleColon: true,
 			},
 		},
+		{
+			in: "foo bar &: baz",
+			want: rule{
+				outputs:      []string{"foo", "bar"},
+				inputs:       []string{"baz"},
+				groupOutputs: []string{"foo", "bar"},
+			},
+		},
+		{
+			in: "foo bar &:: baz",
+			want: rule{
+				outputs:       []string{"foo", "bar"},
+				inputs:        []string{"baz"},
+				isDoubleColon: true,
+				groupOutputs:  []string{"foo", "bar"},
+			},
+		},
+		{
+			in: "foo &: baz",
+			want: rule{
+				outputs: []string{"foo"},
+				inputs:  []string{"baz"},
+			},
+		},
 		{
 			in:  "foo",
 			err: "*** missing separator.",
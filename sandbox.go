@@ -0,0 +1,275 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// SandboxCommandRunner runs each command in a sandbox, i.e. a
+// temporary directory which has only symbolic links to the declared
+// prerequisites of the target, so a command reading a file which
+// isn't a prerequisite fails. Outputs of the target made in the
+// sandbox are moved to the working directory after the command
+// succeeds, and other files are discarded with warnings.
+//
+// Only relative paths are sandboxed. Commands can still read files by
+// absolute paths, e.g. in /usr/include.
+type SandboxCommandRunner struct {
+	// Dir is where sandboxes are created. If empty, the default
+	// directory for temporary files is used.
+	Dir string
+	// Runner runs commands in sandboxes. If nil, LocalCommandRunner
+	// is used.
+	Runner CommandRunner
+}
+
+// RunCommand runs c in a new sandbox.
+func (r SandboxCommandRunner) RunCommand(ctx context.Context, c *Command) error {
+	wd := c.Dir
+	if wd == "" {
+		var err error
+		wd, err = os.Getwd()
+		if err != nil {
+			return err
+		}
+	}
+	root, err := ioutil.TempDir(r.Dir, "kati-sandbox")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	s := newSandbox(root, wd, c)
+	err = s.prepare(c)
+	if err != nil {
+		return err
+	}
+	runner := r.Runner
+	if runner == nil {
+		runner = LocalCommandRunner{}
+	}
+	sc := *c
+	sc.Dir = s.work
+	err = runner.RunCommand(ctx, &sc)
+	if err != nil {
+		fmt.Fprintf(c.Stderr, "kati: %s: commands ran in a sandbox with only prerequisites: %s\n", c.Target, strings.Join(s.inputs, " "))
+		return err
+	}
+	return s.collect(c)
+}
+
+// sandbox is a directory in which a command runs. work in root is the
+// working directory of the command for wd. It is deep enough that
+// relative paths with ".." are in root too.
+type sandbox struct {
+	root string
+	work string
+	wd   string
+	// inputs are prerequisites linked in the sandbox.
+	inputs []string
+}
+
+func newSandbox(root, wd string, c *Command) *sandbox {
+	depth := 0
+	for _, paths := range [][]string{c.Inputs, c.Outputs} {
+		for _, p := range paths {
+			if d := parentDepth(p); d > depth {
+				depth = d
+			}
+		}
+	}
+	work := root
+	for i := 0; i < depth; i++ {
+		work = filepath.Join(work, "w")
+	}
+	return &sandbox{
+		root: root,
+		work: work,
+		wd:   wd,
+	}
+}
+
+// parentDepth returns the number of leading ".." of the relative path
+// p.
+func parentDepth(p string) int {
+	d := 0
+	for _, e := range strings.Split(filepath.ToSlash(filepath.Clean(p)), "/") {
+		if e != ".." {
+			break
+		}
+		d++
+	}
+	return d
+}
+
+// path returns the path of the relative path p in the sandbox, or ""
+// if p isn't sandboxed.
+func (s *sandbox) path(p string) string {
+	if filepath.IsAbs(p) {
+		return ""
+	}
+	return filepath.Join(s.work, p)
+}
+
+// prepare creates the working directory, links the inputs of c, and
+// copies outputs of c which exist, as commands may update them, e.g.
+// archives.
+func (s *sandbox) prepare(c *Command) error {
+	err := os.MkdirAll(s.work, 0755)
+	if err != nil {
+		return err
+	}
+	for _, in := range c.Inputs {
+		sp := s.path(in)
+		if sp == "" {
+			continue
+		}
+		src := filepath.Join(s.wd, in)
+		if _, err := os.Stat(src); err != nil {
+			// phony targets don't exist.
+			continue
+		}
+		if _, err := os.Lstat(sp); err == nil {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(sp), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(src, sp)
+		if err != nil {
+			return err
+		}
+		s.inputs = append(s.inputs, in)
+	}
+	for _, out := range c.Outputs {
+		sp := s.path(out)
+		if sp == "" {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(sp), 0755)
+		if err != nil {
+			return err
+		}
+		src := filepath.Join(s.wd, out)
+		fi, err := os.Stat(src)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if _, err := os.Lstat(sp); err == nil {
+			// the output is an input too.
+			continue
+		}
+		err = copyFile(src, sp, fi)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collect moves outputs of c made in the sandbox to the working
+// directory, and warns about other files.
+func (s *sandbox) collect(c *Command) error {
+	outputs := make(map[string]bool)
+	for _, out := range c.Outputs {
+		sp := s.path(out)
+		if sp == "" {
+			continue
+		}
+		outputs[sp] = true
+		fi, err := os.Lstat(sp)
+		if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		dst := filepath.Join(s.wd, out)
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			err = os.RemoveAll(dst)
+			if err != nil {
+				return err
+			}
+		}
+		err = moveFile(sp, dst, fi)
+		if err != nil {
+			return err
+		}
+	}
+	return filepath.Walk(s.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if outputs[path] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.work, path)
+		if err != nil {
+			rel = path
+		}
+		fmt.Fprintf(c.Stderr, "kati: warning: %s: %s is not an output of the target; discarded\n", c.Target, rel)
+		return nil
+	})
+}
+
+// moveFile moves src to dst, or copies src if they are on different
+// file systems.
+func moveFile(src, dst string, fi os.FileInfo) error {
+	err := os.Rename(src, dst)
+	if err == nil || !fi.Mode().IsRegular() {
+		return err
+	}
+	glog.V(1).Infof("sandbox: rename %s: %v; copying", src, err)
+	return copyFile(src, dst, fi)
+}
+
+// copyFile copies the regular file src whose FileInfo is fi to dst,
+// with its mode and modification time.
+func copyFile(src, dst string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
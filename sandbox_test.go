@@ -0,0 +1,98 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParentDepth(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int
+	}{
+		{in: "a", want: 0},
+		{in: "a/../b", want: 0},
+		{in: "../a", want: 1},
+		{in: "../../a/b", want: 2},
+		{in: "./../a", want: 1},
+	} {
+		if got := parentDepth(tc.in); got != tc.want {
+			t.Errorf("parentDepth(%q)=%d; want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSandboxCommandRunner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need a privilege on windows")
+	}
+	dir := chdirTestMakefile(t, `all: out/b
+	cat out/b > all
+out/b: a
+	mkdir -p out; cat a > out/b; echo x > junk
+c: a
+	cat a undeclared > c
+`)
+	for _, f := range []string{"a", "undeclared"} {
+		err := ioutil.WriteFile(f, []byte(f+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"all", "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := &ExecutorOpt{CommandRunner: SandboxCommandRunner{Dir: dir}}
+	ex, err := NewExecutor(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "a\n"; got != want {
+		t.Errorf("all=%q; want %q", got, want)
+	}
+	if exists("junk") {
+		t.Errorf("junk, not an output, exists")
+	}
+
+	ex, err = NewExecutor(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, []string{"c"})
+	if err == nil || err.Error() != "*** [c] Error 1" {
+		t.Errorf("Exec(c)=%v; want *** [c] Error 1", err)
+	}
+	if exists("c") {
+		t.Errorf("c, made from the undeclared file, exists")
+	}
+	matches, err := filepath.Glob("kati-sandbox*")
+	if err != nil || len(matches) != 0 {
+		t.Errorf("sandboxes=%q, %v; want removed", matches, err)
+	}
+}
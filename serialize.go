@@ -55,9 +55,28 @@ var JSON LoadSaver
 // GOB is a gob loader/saver.
 var GOB LoadSaver
 
+// CacheFormat is the format of caches of loaded DepGraphs, GOB by
+// default.
+var CacheFormat LoadSaver
+
 func init() {
 	JSON = jsonLoadSaver{}
 	GOB = gobLoadSaver{}
+	CacheFormat = GOB
+}
+
+// LoadSaverFormat returns the LoadSaver of format, which is "gob",
+// "json" or "proto".
+func LoadSaverFormat(format string) (LoadSaver, error) {
+	switch format {
+	case "gob":
+		return GOB, nil
+	case "json":
+		return JSON, nil
+	case "proto":
+		return PROTO, nil
+	}
+	return nil, fmt.Errorf("unknown format: %q", format)
 }
 
 type jsonLoadSaver struct{}
@@ -112,9 +131,11 @@ type serializableVar struct {
 	Children []serializableVar
 }
 
+// serializableDepNode refers to strings by their indexes in
+// serializableGraph.Strs.
 type serializableDepNode struct {
 	Output             int
-	Cmds               []string
+	Cmds               []int
 	Deps               []int
 	OrderOnlys         []int
 	Parents            []int
@@ -122,8 +143,27 @@ type serializableDepNode struct {
 	IsPhony            bool
 	ActualInputs       []int
 	TargetSpecificVars []int
-	Filename           string
+	Filename           int
 	Lineno             int
+	NotParallel        bool
+	DoubleColons       []serializableDoubleColon
+	Stem               int
+	IsIntermediate     bool
+	DeleteOnError      bool
+	OneShell           bool
+	GroupOutputs       []int
+	Waits              []int
+}
+
+// serializableDoubleColon is a double-colon rule of a node, which
+// shares its output and target specific variables.
+type serializableDoubleColon struct {
+	Cmds         []int
+	Deps         []int
+	OrderOnlys   []int
+	ActualInputs []int
+	Filename     int
+	Lineno       int
 }
 
 type serializableTargetSpecificVar struct {
@@ -131,14 +171,18 @@ type serializableTargetSpecificVar struct {
 	Value serializableVar
 }
 
+// serializableGraph.Strs is the string table of target names, commands
+// and filenames in nodes. Each string appears once, and is interned
+// once when the graph is loaded.
 type serializableGraph struct {
 	Nodes       []*serializableDepNode
 	Vars        map[string]serializableVar
 	Tsvs        []serializableTargetSpecificVar
-	Targets     []string
+	Strs        []string
 	Roots       []string
 	AccessedMks []*accessedMakefile
 	Exports     map[string]bool
+	ExportAll   bool
 }
 
 func encGob(v interface{}) (string, error) {
@@ -159,34 +203,42 @@ func encVar(k string, v Var) (string, error) {
 }
 
 type depNodesSerializer struct {
-	nodes     []*serializableDepNode
-	tsvs      []serializableTargetSpecificVar
-	tsvMap    map[string]int
-	targets   []string
-	targetMap map[string]int
-	done      map[string]bool
-	err       error
+	nodes  []*serializableDepNode
+	tsvs   []serializableTargetSpecificVar
+	tsvMap map[string]int
+	strs   []string
+	strMap map[string]int
+	done   map[string]bool
+	err    error
 }
 
 func newDepNodesSerializer() *depNodesSerializer {
 	return &depNodesSerializer{
-		tsvMap:    make(map[string]int),
-		targetMap: make(map[string]int),
-		done:      make(map[string]bool),
+		tsvMap: make(map[string]int),
+		strMap: make(map[string]int),
+		done:   make(map[string]bool),
 	}
 }
 
-func (ns *depNodesSerializer) serializeTarget(t string) int {
-	id, present := ns.targetMap[t]
+func (ns *depNodesSerializer) serializeStr(s string) int {
+	id, present := ns.strMap[s]
 	if present {
 		return id
 	}
-	id = len(ns.targets)
-	ns.targetMap[t] = id
-	ns.targets = append(ns.targets, t)
+	id = len(ns.strs)
+	ns.strMap[s] = id
+	ns.strs = append(ns.strs, s)
 	return id
 }
 
+func (ns *depNodesSerializer) serializeStrs(ss []string) []int {
+	var ids []int
+	for _, s := range ss {
+		ids = append(ids, ns.serializeStr(s))
+	}
+	return ids
+}
+
 func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 	if ns.err != nil {
 		return
@@ -199,19 +251,19 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 
 		var deps []int
 		for _, d := range n.Deps {
-			deps = append(deps, ns.serializeTarget(d.Output))
+			deps = append(deps, ns.serializeStr(d.Output))
 		}
 		var orderonlys []int
 		for _, d := range n.OrderOnlys {
-			orderonlys = append(orderonlys, ns.serializeTarget(d.Output))
+			orderonlys = append(orderonlys, ns.serializeStr(d.Output))
 		}
 		var parents []int
 		for _, d := range n.Parents {
-			parents = append(parents, ns.serializeTarget(d.Output))
+			parents = append(parents, ns.serializeStr(d.Output))
 		}
 		var actualInputs []int
 		for _, i := range n.ActualInputs {
-			actualInputs = append(actualInputs, ns.serializeTarget(i))
+			actualInputs = append(actualInputs, ns.serializeStr(i))
 		}
 
 		// Sort keys for consistent serialization.
@@ -240,9 +292,28 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 			vars = append(vars, id)
 		}
 
+		var doubleColons []serializableDoubleColon
+		for _, dn := range n.DoubleColons {
+			dc := serializableDoubleColon{
+				Cmds:     ns.serializeStrs(dn.Cmds),
+				Filename: ns.serializeStr(dn.Filename),
+				Lineno:   dn.Lineno,
+			}
+			for _, d := range dn.Deps {
+				dc.Deps = append(dc.Deps, ns.serializeStr(d.Output))
+			}
+			for _, d := range dn.OrderOnlys {
+				dc.OrderOnlys = append(dc.OrderOnlys, ns.serializeStr(d.Output))
+			}
+			for _, i := range dn.ActualInputs {
+				dc.ActualInputs = append(dc.ActualInputs, ns.serializeStr(i))
+			}
+			doubleColons = append(doubleColons, dc)
+		}
+
 		ns.nodes = append(ns.nodes, &serializableDepNode{
-			Output:             ns.serializeTarget(n.Output),
-			Cmds:               n.Cmds,
+			Output:             ns.serializeStr(n.Output),
+			Cmds:               ns.serializeStrs(n.Cmds),
 			Deps:               deps,
 			OrderOnlys:         orderonlys,
 			Parents:            parents,
@@ -250,8 +321,16 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 			IsPhony:            n.IsPhony,
 			ActualInputs:       actualInputs,
 			TargetSpecificVars: vars,
-			Filename:           n.Filename,
+			Filename:           ns.serializeStr(n.Filename),
 			Lineno:             n.Lineno,
+			NotParallel:        n.NotParallel,
+			DoubleColons:       doubleColons,
+			Stem:               ns.serializeStr(n.Stem),
+			IsIntermediate:     n.IsIntermediate,
+			DeleteOnError:      n.DeleteOnError,
+			OneShell:           n.OneShell,
+			GroupOutputs:       ns.serializeStrs(n.GroupOutputs),
+			Waits:              n.Waits,
 		})
 		ns.serializeDepNodes(n.Deps)
 		if ns.err != nil {
@@ -280,15 +359,18 @@ func makeSerializableGraph(g *DepGraph, roots []string) (serializableGraph, erro
 		Nodes:       ns.nodes,
 		Vars:        v,
 		Tsvs:        ns.tsvs,
-		Targets:     ns.targets,
+		Strs:        ns.strs,
 		Roots:       roots,
 		AccessedMks: g.accessedMks,
 		Exports:     g.exports,
+		ExportAll:   g.exportAll,
 	}, ns.err
 }
 
 func (jsonLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
 	startTime := time.Now()
+	te := traceEvent.begin("serialize", literal(filename), traceEventMain)
+	defer traceEvent.end(te)
 	sg, err := makeSerializableGraph(g, roots)
 	if err != nil {
 		return err
@@ -316,6 +398,8 @@ func (jsonLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
 
 func (gobLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
 	startTime := time.Now()
+	te := traceEvent.begin("serialize", literal(filename), traceEventMain)
+	defer traceEvent.end(te)
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -351,6 +435,12 @@ func cacheFilename(mk string, roots []string) string {
 	for _, r := range roots {
 		filename += "." + r
 	}
+	switch CacheFormat {
+	case JSON:
+		filename += ".json"
+	case PROTO:
+		filename += ".proto"
+	}
 	return url.QueryEscape(filename)
 }
 
@@ -368,7 +458,7 @@ func saveCache(g *DepGraph, roots []string) error {
 			return nil
 		}
 	}
-	return GOB.Save(g, cacheFile, roots)
+	return CacheFormat.Save(g, cacheFile, roots)
 }
 
 func deserializeSingleChild(sv serializableVar) (Value, error) {
@@ -435,7 +525,11 @@ func deserializeVar(sv serializableVar) (r Value, err error) {
 		if !ok {
 			return nil, fmt.Errorf("func name is not literal %s: %T", dv, dv)
 		}
-		f := funcMap[string(name[1:])]()
+		mkf, ok := lookupFunc(string(name[1:]))
+		if !ok {
+			return nil, fmt.Errorf("unknown func %s", name[1:])
+		}
+		f := mkf()
 		f.AddArg(name)
 		for _, a := range sv.Children[1:] {
 			dv, err := deserializeVar(a)
@@ -470,6 +564,7 @@ func deserializeVar(sv serializableVar) (r Value, err error) {
 		}
 		return &recursiveVar{
 			expr:   expr,
+			src:    sv.V,
 			origin: sv.Origin,
 		}, nil
 
@@ -483,8 +578,9 @@ func deserializeVar(sv serializableVar) (r Value, err error) {
 			return nil, fmt.Errorf("not var: target specific var %s %T", dv, dv)
 		}
 		return &targetSpecificVar{
-			v:  v,
-			op: sv.Type,
+			v:      v,
+			op:     sv.Type,
+			export: sv.V == "export",
 		}, nil
 
 	default:
@@ -511,7 +607,24 @@ func deserializeVars(vars map[string]serializableVar) (Vars, error) {
 func deserializeNodes(g serializableGraph) (r []*DepNode, err error) {
 	nodes := g.Nodes
 	tsvs := g.Tsvs
-	targets := g.Targets
+	strs := internStrs(g.Strs)
+	str := func(id int) (string, error) {
+		if id < 0 || id >= len(strs) {
+			return "", fmt.Errorf("unknown string: %d", id)
+		}
+		return strs[id], nil
+	}
+	strList := func(ids []int) ([]string, error) {
+		var r []string
+		for _, id := range ids {
+			s, err := str(id)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, s)
+		}
+		return r, nil
+	}
 	// Deserialize all TSVs first so that multiple rules can share memory.
 	var tsvValues []Var
 	for _, sv := range tsvs {
@@ -528,19 +641,46 @@ func deserializeNodes(g serializableGraph) (r []*DepNode, err error) {
 
 	nodeMap := make(map[string]*DepNode)
 	for _, n := range nodes {
-		var actualInputs []string
-		for _, i := range n.ActualInputs {
-			actualInputs = append(actualInputs, targets[i])
+		output, err := str(n.Output)
+		if err != nil {
+			return nil, err
+		}
+		actualInputs, err := strList(n.ActualInputs)
+		if err != nil {
+			return nil, err
+		}
+		cmds, err := strList(n.Cmds)
+		if err != nil {
+			return nil, err
+		}
+		filename, err := str(n.Filename)
+		if err != nil {
+			return nil, err
+		}
+		stem, err := str(n.Stem)
+		if err != nil {
+			return nil, err
+		}
+		groupOutputs, err := strList(n.GroupOutputs)
+		if err != nil {
+			return nil, err
 		}
 
 		d := &DepNode{
-			Output:             targets[n.Output],
-			Cmds:               n.Cmds,
+			Output:             output,
+			Cmds:               cmds,
 			HasRule:            n.HasRule,
 			IsPhony:            n.IsPhony,
 			ActualInputs:       actualInputs,
-			Filename:           n.Filename,
+			Filename:           filename,
 			Lineno:             n.Lineno,
+			NotParallel:        n.NotParallel,
+			Stem:               stem,
+			IsIntermediate:     n.IsIntermediate,
+			DeleteOnError:      n.DeleteOnError,
+			OneShell:           n.OneShell,
+			GroupOutputs:       groupOutputs,
+			Waits:              n.Waits,
 			TargetSpecificVars: make(Vars),
 		}
 
@@ -549,33 +689,76 @@ func deserializeNodes(g serializableGraph) (r []*DepNode, err error) {
 			d.TargetSpecificVars[sv.Name] = tsvValues[id]
 		}
 
-		nodeMap[targets[n.Output]] = d
+		nodeMap[output] = d
 		r = append(r, d)
 	}
 
 	for _, n := range nodes {
-		d := nodeMap[targets[n.Output]]
+		d := nodeMap[strs[n.Output]]
 		for _, o := range n.Deps {
-			c, present := nodeMap[targets[o]]
+			c, present := nodeMap[strs[o]]
 			if !present {
-				return nil, fmt.Errorf("unknown target: %d (%s)", o, targets[o])
+				return nil, fmt.Errorf("unknown target: %d (%s)", o, strs[o])
 			}
 			d.Deps = append(d.Deps, c)
 		}
 		for _, o := range n.OrderOnlys {
-			c, present := nodeMap[targets[o]]
+			c, present := nodeMap[strs[o]]
 			if !present {
-				return nil, fmt.Errorf("unknown target: %d (%s)", o, targets[o])
+				return nil, fmt.Errorf("unknown target: %d (%s)", o, strs[o])
 			}
 			d.OrderOnlys = append(d.OrderOnlys, c)
 		}
 		for _, o := range n.Parents {
-			c, present := nodeMap[targets[o]]
+			c, present := nodeMap[strs[o]]
 			if !present {
-				return nil, fmt.Errorf("unknown target: %d (%s)", o, targets[o])
+				return nil, fmt.Errorf("unknown target: %d (%s)", o, strs[o])
 			}
 			d.Parents = append(d.Parents, c)
 		}
+		for _, dc := range n.DoubleColons {
+			cmds, err := strList(dc.Cmds)
+			if err != nil {
+				return nil, err
+			}
+			filename, err := str(dc.Filename)
+			if err != nil {
+				return nil, err
+			}
+			dn := &DepNode{
+				Output:             d.Output,
+				Cmds:               cmds,
+				HasRule:            true,
+				IsPhony:            d.IsPhony,
+				Stem:               d.Stem,
+				TargetSpecificVars: d.TargetSpecificVars,
+				Filename:           filename,
+				Lineno:             dc.Lineno,
+				NotParallel:        d.NotParallel,
+				DeleteOnError:      d.DeleteOnError,
+				OneShell:           d.OneShell,
+				GroupOutputs:       d.GroupOutputs,
+			}
+			dn.ActualInputs, err = strList(dc.ActualInputs)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range dc.Deps {
+				c, present := nodeMap[strs[o]]
+				if !present {
+					return nil, fmt.Errorf("unknown target: %d (%s)", o, strs[o])
+				}
+				dn.Deps = append(dn.Deps, c)
+			}
+			for _, o := range dc.OrderOnlys {
+				c, present := nodeMap[strs[o]]
+				if !present {
+					return nil, fmt.Errorf("unknown target: %d (%s)", o, strs[o])
+				}
+				dn.OrderOnlys = append(dn.OrderOnlys, c)
+			}
+			d.DoubleColons = append(d.DoubleColons, dn)
+		}
 	}
 
 	return r, nil
@@ -605,14 +788,12 @@ func showSerializedNodesStats(nodes []*serializableDepNode) {
 	linenoSize := 0
 	for _, n := range nodes {
 		outputSize += 4
-		for _, c := range n.Cmds {
-			cmdSize += len(c)
-		}
+		cmdSize += 4 * len(n.Cmds)
 		depsSize += 4 * len(n.Deps)
 		orderOnlysSize += 4 * len(n.OrderOnlys)
 		actualInputSize += 4 * len(n.ActualInputs)
 		tsvSize += 4 * len(n.TargetSpecificVars)
-		filenameSize += len(n.Filename)
+		filenameSize += 4
 		linenoSize += 4
 	}
 	size := outputSize + cmdSize + depsSize + orderOnlysSize + actualInputSize + tsvSize + filenameSize + linenoSize
@@ -664,12 +845,12 @@ func showSerializedTsvsStats(vars []serializableTargetSpecificVar) {
 	logStats(" value %s", human(valueSize))
 }
 
-func showSerializedTargetsStats(targets []string) {
+func showSerializedStrsStats(strs []string) {
 	size := 0
-	for _, t := range targets {
-		size += len(t)
+	for _, s := range strs {
+		size += len(s)
 	}
-	logStats("%d targets %s", len(targets), human(size))
+	logStats("%d strs %s", len(strs), human(size))
 }
 
 func showSerializedAccessedMksStats(accessedMks []*accessedMakefile) {
@@ -684,7 +865,7 @@ func showSerializedGraphStats(g serializableGraph) {
 	showSerializedNodesStats(g.Nodes)
 	showSerializedVarsStats(g.Vars)
 	showSerializedTsvsStats(g.Tsvs)
-	showSerializedTargetsStats(g.Targets)
+	showSerializedStrsStats(g.Strs)
 	showSerializedAccessedMksStats(g.AccessedMks)
 }
 
@@ -705,11 +886,14 @@ func deserializeGraph(g serializableGraph) (*DepGraph, error) {
 		vars:        vars,
 		accessedMks: g.AccessedMks,
 		exports:     g.Exports,
+		exportAll:   g.ExportAll,
 	}, nil
 }
 
 func (jsonLoadSaver) Load(filename string) (*DepGraph, error) {
 	startTime := time.Now()
+	te := traceEvent.begin("deserialize", literal(filename), traceEventMain)
+	defer traceEvent.end(te)
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -732,6 +916,8 @@ func (jsonLoadSaver) Load(filename string) (*DepGraph, error) {
 
 func (gobLoadSaver) Load(filename string) (*DepGraph, error) {
 	startTime := time.Now()
+	te := traceEvent.begin("deserialize", literal(filename), traceEventMain)
+	defer traceEvent.end(te)
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -752,7 +938,7 @@ func (gobLoadSaver) Load(filename string) (*DepGraph, error) {
 	return dg, nil
 }
 
-func loadCache(makefile string, roots []string) (*DepGraph, error) {
+func loadCache(makefile string, roots []string, env []string) (*DepGraph, error) {
 	startTime := time.Now()
 	defer func() {
 		logStats("Cache lookup time: %q", time.Since(startTime))
@@ -761,36 +947,55 @@ func loadCache(makefile string, roots []string) (*DepGraph, error) {
 	filename := cacheFilename(makefile, roots)
 	if !exists(filename) {
 		glog.Warningf("Cache not found %q", filename)
-		return nil, fmt.Errorf("cache not found: %s", filename)
+		return nil, &RegenReason{Kind: RegenCache, Name: filename, Change: "not found"}
 	}
 
-	g, err := GOB.Load(filename)
+	g, err := CacheFormat.Load(filename)
 	if err != nil {
 		glog.Warning("Cache load error %q: %v", filename, err)
 		return nil, err
 	}
-	for _, mk := range g.accessedMks {
-		if mk.State != fileExists && mk.State != fileNotExists {
-			return nil, fmt.Errorf("internal error: broken state: %d", mk.State)
-		}
-		if mk.State == fileNotExists {
+	err = checkAccessedMakefiles(g.accessedMks, env)
+	if err != nil {
+		return nil, err
+	}
+	glog.Info("Cache found in %q", filename)
+	return g, nil
+}
+
+// checkAccessedMakefiles returns a *RegenReason if some of mks was
+// modified, created or removed since they were read, or other inputs
+// recorded in mks were changed. env is the environment to load the
+// DepGraph.
+func checkAccessedMakefiles(mks []*accessedMakefile, env []string) error {
+	for _, mk := range mks {
+		var r *RegenReason
+		switch mk.State {
+		case fileNotExists:
 			if exists(mk.Filename) {
-				glog.Infof("Cache expired: %s", mk.Filename)
-				return nil, fmt.Errorf("cache expired: %s", mk.Filename)
+				r = &RegenReason{Kind: RegenMakefile, Name: mk.Filename, Change: "created"}
 			}
-		} else {
+		case fileExists:
 			c, err := ioutil.ReadFile(mk.Filename)
 			if err != nil {
-				glog.Infof("Cache expired: %s", mk.Filename)
-				return nil, fmt.Errorf("cache expired: %s", mk.Filename)
+				r = &RegenReason{Kind: RegenMakefile, Name: mk.Filename, Change: "removed"}
+				break
 			}
 			h := sha1.Sum(c)
 			if !bytes.Equal(h[:], mk.Hash[:]) {
-				glog.Infof("Cache expired: %s", mk.Filename)
-				return nil, fmt.Errorf("cache expired: %s", mk.Filename)
+				r = &RegenReason{Kind: RegenMakefile, Name: mk.Filename, Change: "modified"}
+			}
+		default:
+			var err error
+			r, err = checkFingerprint(mk, env)
+			if err != nil {
+				return err
 			}
 		}
+		if r != nil {
+			glog.Infof("Cache expired: %v", r)
+			return r
+		}
 	}
-	glog.Info("Cache found in %q", filename)
-	return g, nil
+	return nil
 }
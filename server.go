@@ -0,0 +1,526 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Server mode.
+//
+// A kati server is a long running process which keeps loaded DepGraphs,
+// parsed makefiles, and the wildcard and find caches in memory, and
+// serves requests of kati clients over a unix domain socket by net/rpc.
+// A DepGraph is reused while none of the makefiles read to load it are
+// modified, created or removed, so repeated invocations skip parsing
+// and evaluation of the whole tree.
+//
+// Each server loads makefiles in its own Session, which shares the find
+// cache of DefaultSession but has its own wildcard cache, and records
+// fingerprints of results of $(wildcard), $(shell) and environment
+// variables, so a DepGraph is stale if any of them changes. Requests
+// are served one by one, since evaluation uses the caches of the
+// session. They are served with a copy of variables of the DepGraph,
+// so commands and expressions evaluated for a request don't leak into
+// others. A server and its clients must run in the same directory.
+//
+// While a server watches the file system, the wildcard cache is
+// invalidated per directory, and the find cache is scanned again
+// before loading if files in the tree were created or removed. Only
+// makefiles modified since they were parsed are parsed again, but all
+// of them are evaluated again, as a makefile may depend on variables
+// of any makefile evaluated before it. Makefiles in directories not
+// watched, e.g. generated in out, are checked every pollInterval.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ServerReq is a request to Server.
+type ServerReq struct {
+	LoadReq
+	// Dir is the working directory of the client.
+	Dir string
+
+	// Query is a query for Server.Query.
+	Query string
+	// QueryJSON is true to reply the result of Query in JSON.
+	QueryJSON bool
+	// Expr is an expression for Server.Eval.
+	Expr string
+
+	// NinjaSuffix, GomaDir, DetectAndroidEcho, RspfileThreshold and
+	// NinjaIncremental are options for Server.GenerateNinja.
+	NinjaSuffix       string
+	GomaDir           string
+	DetectAndroidEcho bool
+	RspfileThreshold  int
+	NinjaIncremental  bool
+}
+
+// ServerReply is a reply of Server.
+type ServerReply struct {
+	// Loaded is true if makefiles were loaded for the request, i.e.
+	// no DepGraph was cached or it was stale.
+	Loaded bool
+	// Regen is true if the cached DepGraph is stale. It is set by
+	// Server.RegenCheck.
+	Regen bool
+	// Reason is why the DepGraph is (re)loaded or stale, and
+	// RegenReason is the structured one.
+	Reason      string
+	RegenReason *RegenReason
+	// Output is the output of Server.Query and Server.Eval.
+	Output string
+}
+
+// Server keeps DepGraphs and serves requests to them.
+type Server struct {
+	mu     sync.Mutex
+	dir    string
+	sess   *Session
+	graphs map[string]*DepGraph
+
+	// makefiles are absolute paths of makefiles read to load graphs.
+	// It is used only while watching.
+	makefiles map[string]bool
+	// includeGlobs are absolute glob patterns of include directives,
+	// which may match files created or removed.
+	includeGlobs []string
+	// fingerprinted is true if graphs depend on results of
+	// $(wildcard) or $(shell), which any change may make stale.
+	fingerprinted bool
+	watching      bool
+	// unwatched reports whether a directory is not watched, and
+	// polling is true if some of makefiles are in such directories.
+	unwatched func(string) bool
+	polling   bool
+	// changed is signaled when one of makefiles is changed.
+	changed *sync.Cond
+}
+
+// NewServer creates a new server running in the current directory.
+func NewServer() (*Server, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	sess := DefaultSession.ShareSnapshot()
+	sess.fingerprints = true
+	s := &Server{
+		dir:       dir,
+		sess:      sess,
+		graphs:    make(map[string]*DepGraph),
+		makefiles: make(map[string]bool),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// serverKey returns a key of DepGraphs loaded by req.
+func serverKey(req LoadReq) string {
+	var parts []string
+	parts = append(parts, req.Makefile, fmt.Sprint(req.EagerEvalCommand))
+	parts = append(parts, req.Targets...)
+	parts = append(parts, "\x01")
+	parts = append(parts, req.CommandLineVars...)
+	parts = append(parts, "\x01")
+	parts = append(parts, req.EnvironmentVars...)
+	return strings.Join(parts, "\x00")
+}
+
+func (s *Server) check(req *ServerReq) error {
+	if req.Dir != "" && req.Dir != s.dir {
+		return fmt.Errorf("kati server runs in %s, not in %s", s.dir, req.Dir)
+	}
+	if req.UseCache {
+		return errors.New("kati server doesn't support UseCache")
+	}
+	if req.Makefile == "" {
+		var err error
+		req.Makefile, err = defaultMakefile()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stale returns why the DepGraph for req must be loaded, or nil if the
+// cached DepGraph is up to date.
+func (s *Server) stale(req ServerReq) *RegenReason {
+	g, ok := s.graphs[serverKey(req.LoadReq)]
+	if !ok {
+		return &RegenReason{Kind: RegenCache, Change: "not loaded"}
+	}
+	err := checkAccessedMakefiles(g.accessedMks, req.EnvironmentVars)
+	if r, ok := err.(*RegenReason); ok {
+		return r
+	}
+	if err != nil {
+		return &RegenReason{Kind: RegenCache, Change: err.Error()}
+	}
+	return nil
+}
+
+// graph returns the DepGraph for req, loading it if it is stale. It
+// returns a copy with a copy of variables, which the request may
+// modify.
+func (s *Server) graph(req ServerReq, reply *ServerReply) (*DepGraph, error) {
+	err := s.check(&req)
+	if err != nil {
+		return nil, err
+	}
+	key := serverKey(req.LoadReq)
+	reason := s.stale(req)
+	if reason == nil {
+		return s.graphs[key].copyVars(), nil
+	}
+	logRegen(reason)
+	startTime := time.Now()
+	delete(s.graphs, key)
+	if reason.Kind == RegenWildcard {
+		// the cache may have entries read before the change.
+		s.sess.InvalidateAllWildcardCache()
+	}
+	r, err := s.sess.load(context.Background(), req.LoadReq, true)
+	if err != nil {
+		return nil, err
+	}
+	g := r.Graph
+	glog.Infof("server load %s: %s (%s)", req.Makefile, reason, time.Since(startTime))
+	s.graphs[key] = g
+	if s.watching {
+		s.updateMakefiles()
+	}
+	reply.Loaded = true
+	reply.Reason = reason.Error()
+	reply.RegenReason = reason
+	return g.copyVars(), nil
+}
+
+// Load loads makefiles for req unless its DepGraph is cached and up to
+// date.
+func (s *Server) Load(req ServerReq, reply *ServerReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.graph(req, reply)
+	return err
+}
+
+// RegenCheck checks whether the DepGraph for req needs to be loaded
+// again, without loading it.
+func (s *Server) RegenCheck(req ServerReq, reply *ServerReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.check(&req)
+	if err != nil {
+		return err
+	}
+	if reason := s.stale(req); reason != nil {
+		reply.Regen = true
+		reply.Reason = reason.Error()
+		reply.RegenReason = reason
+	}
+	return nil
+}
+
+// GenerateNinja generates ninja files for req.
+func (s *Server) GenerateNinja(req ServerReq, reply *ServerReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.graph(req, reply)
+	if err != nil {
+		return err
+	}
+	n := NinjaGenerator{
+		GomaDir:           req.GomaDir,
+		DetectAndroidEcho: req.DetectAndroidEcho,
+		RspfileThreshold:  req.RspfileThreshold,
+		Incremental:       req.NinjaIncremental,
+	}
+	return n.Save(g, req.NinjaSuffix, req.Targets)
+}
+
+// Query queries req.Query as -query does.
+func (s *Server) Query(req ServerReq, reply *ServerReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.graph(req, reply)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if req.QueryJSON {
+		err = QueryJSON(&buf, req.Query, g)
+		if err != nil {
+			return err
+		}
+	} else {
+		Query(&buf, req.Query, g)
+	}
+	reply.Output = buf.String()
+	return nil
+}
+
+// Eval evaluates req.Expr with global variables of the DepGraph.
+func (s *Server) Eval(req ServerReq, reply *ServerReply) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer recoverPanic(nil, &err)
+	g, err := s.graph(req, reply)
+	if err != nil {
+		return err
+	}
+	v, _, err := parseExpr([]byte(req.Expr), nil, parseOp{})
+	if err != nil {
+		return err
+	}
+	ev := NewEvaluator(g.vars)
+	var buf evalBuffer
+	buf.resetSep()
+	err = v.Eval(&buf, ev)
+	if err != nil {
+		return err
+	}
+	reply.Output = buf.String()
+	return nil
+}
+
+// updateMakefiles updates s.makefiles for the loaded graphs.
+func (s *Server) updateMakefiles() {
+	s.makefiles = make(map[string]bool)
+	s.includeGlobs = nil
+	s.fingerprinted = false
+	s.polling = false
+	for _, g := range s.graphs {
+		for _, mk := range g.accessedMks {
+			if mk.State == fileWildcard || mk.State == fileShell {
+				s.fingerprinted = true
+				continue
+			}
+			if mk.State == fileEnv {
+				continue
+			}
+			fn := mk.Filename
+			if !filepath.IsAbs(fn) {
+				fn = filepath.Join(s.dir, fn)
+			}
+			if s.unwatched != nil && s.unwatched(filepath.Dir(fn)) {
+				s.polling = true
+			}
+			if mk.State == fileGlob {
+				s.includeGlobs = append(s.includeGlobs, fn)
+				continue
+			}
+			s.makefiles[fn] = true
+		}
+	}
+}
+
+// fsChanged is called by the file system watcher. It wakes up WaitStale
+// if changes may make graphs stale.
+func (s *Server) fsChanged(changes []fsChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fingerprinted && len(changes) > 0 {
+		// WaitStale checks fingerprints again.
+		s.changed.Broadcast()
+		return
+	}
+	for _, ch := range changes {
+		if s.makefiles[ch.path] {
+			s.changed.Broadcast()
+			return
+		}
+		if !ch.modified {
+			for _, pat := range s.includeGlobs {
+				if ok, _ := filepath.Match(pat, ch.path); ok {
+					s.changed.Broadcast()
+					return
+				}
+			}
+		}
+		if !ch.recursive {
+			continue
+		}
+		for fn := range s.makefiles {
+			if strings.HasPrefix(fn, ch.path+string(filepath.Separator)) {
+				s.changed.Broadcast()
+				return
+			}
+		}
+		for _, pat := range s.includeGlobs {
+			if strings.HasPrefix(pat, ch.path+string(filepath.Separator)) {
+				s.changed.Broadcast()
+				return
+			}
+		}
+	}
+}
+
+// Watch starts watching the file system under the directory of s, to
+// keep caches for the current files and to notify changes of makefiles
+// to WaitStale. It returns a function to stop watching.
+func (s *Server) Watch() (stop func(), err error) {
+	unwatched := s.sess.unwatchedFunc(s.dir)
+	stopWatch, err := s.sess.watch(s.dir, unwatched, func(changes []fsChange) {
+		s.sess.invalidateCaches(changes)
+		s.fsChanged(changes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.watching = true
+	s.unwatched = unwatched
+	s.updateMakefiles()
+	s.mu.Unlock()
+	return func() {
+		stopWatch()
+		s.mu.Lock()
+		s.watching = false
+		s.changed.Broadcast()
+		s.mu.Unlock()
+	}, nil
+}
+
+// WaitStale waits until the DepGraph for req becomes stale, and returns
+// the reason. It can be used only while s is watching.
+func (s *Server) WaitStale(req ServerReq) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.check(&req)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if !s.watching {
+			return "", errors.New("kati server is not watching")
+		}
+		if reason := s.stale(req); reason != nil {
+			return reason.Error(), nil
+		}
+		if !s.polling {
+			s.changed.Wait()
+			continue
+		}
+		t := time.AfterFunc(pollInterval, func() {
+			s.mu.Lock()
+			s.changed.Broadcast()
+			s.mu.Unlock()
+		})
+		s.changed.Wait()
+		t.Stop()
+	}
+}
+
+// pollInterval is the interval WaitStale checks makefiles which are
+// not watched.
+var pollInterval = time.Second
+
+// Serve serves requests to s on connections accepted by l.
+// It returns when l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	rs := rpc.NewServer()
+	err := rs.RegisterName("Kati", s)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go rs.ServeConn(conn)
+	}
+}
+
+// ListenAndServe serves requests on the unix domain socket. It keeps
+// caches updated by file system events if the platform supports it,
+// or by modification times of directories otherwise.
+func ListenAndServe(socket string) error {
+	s, err := NewServer()
+	if err != nil {
+		return err
+	}
+	// remove a socket left by a previous server.
+	if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(socket)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	stop, err := s.Watch()
+	if err == nil {
+		defer stop()
+	} else {
+		if err != errFSWatchUnsupported {
+			glog.Warningf("watch %s: %v", s.dir, err)
+		}
+		// check directories are not modified instead.
+		s.sess.wildcardCache.checkMtime = true
+	}
+	glog.Infof("kati server listening on %s", socket)
+	return s.Serve(l)
+}
+
+// ServerClient is a client of a kati server.
+type ServerClient struct {
+	c *rpc.Client
+}
+
+// DialServer connects to a kati server listening on the unix domain
+// socket.
+func DialServer(socket string) (*ServerClient, error) {
+	c, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerClient{c: c}, nil
+}
+
+// Close closes the connection.
+func (c *ServerClient) Close() error {
+	return c.c.Close()
+}
+
+// Call calls method of the server, e.g. "Load" or "Query", with req.
+// req.Dir is set to the current directory if it is empty.
+func (c *ServerClient) Call(method string, req ServerReq) (*ServerReply, error) {
+	if req.Dir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		req.Dir = dir
+	}
+	reply := &ServerReply{}
+	err := c.c.Call("Kati."+method, req, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
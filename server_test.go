@@ -0,0 +1,162 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := chdirTempDir(t)
+	writeFile := func(name, content string) {
+		err := ioutil.WriteFile(name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("Makefile", "-include sub.mk\nA := a $(B)\nW := $(wildcard *.c)\nall: ; echo $(A)\n")
+
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "kati.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("listen %s: %v", socket, err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+	c, err := DialServer(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, tc := range []struct {
+		method string
+		expr   string
+		write  string // content of sub.mk to write before the call.
+		create string // a file to create before the call.
+
+		wantLoaded bool
+		wantRegen  bool
+		wantOutput string
+	}{
+		{method: "RegenCheck", wantRegen: true},
+		{method: "Load", wantLoaded: true},
+		{method: "RegenCheck"},
+		{method: "Eval", expr: "$(A)", wantOutput: "a "},
+		{method: "RegenCheck", write: "B := b\n", wantRegen: true},
+		{method: "Eval", expr: "$(A)", wantLoaded: true, wantOutput: "a b"},
+		{method: "Eval", expr: "$(words $(A))", wantOutput: "2"},
+		// variables assigned by a request don't leak into others.
+		{method: "Eval", expr: "$(eval X := x)$(X)", wantOutput: "x"},
+		{method: "Eval", expr: "$(X)"},
+		// the graph depends on the result of $(wildcard).
+		{method: "RegenCheck", create: "new.c", wantRegen: true},
+		{method: "Eval", expr: "$(W)", wantLoaded: true, wantOutput: "new.c"},
+	} {
+		if tc.write != "" {
+			writeFile("sub.mk", tc.write)
+		}
+		if tc.create != "" {
+			writeFile(tc.create, "")
+		}
+		reply, err := c.Call(tc.method, ServerReq{
+			LoadReq: LoadReq{Makefile: "Makefile"},
+			Expr:    tc.expr,
+		})
+		if err != nil {
+			t.Fatalf("%d: %s: %v", i, tc.method, err)
+		}
+		if reply.Loaded != tc.wantLoaded || reply.Regen != tc.wantRegen || reply.Output != tc.wantOutput {
+			t.Errorf("%d: %s=%+v; want loaded=%t regen=%t output=%q", i, tc.method, reply, tc.wantLoaded, tc.wantRegen, tc.wantOutput)
+		}
+	}
+
+	_, err = c.Call("Load", ServerReq{
+		LoadReq: LoadReq{Makefile: "Makefile"},
+		Dir:     wd,
+	})
+	if err == nil {
+		t.Errorf("Load in %s: nil error; want error", wd)
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	chdirTempDir(t)
+	err := ioutil.WriteFile("Makefile", []byte("-include sub.mk\nall: ; echo $(A)\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, err := s.Watch()
+	if err == errFSWatchUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	req := ServerReq{LoadReq: LoadReq{Makefile: "Makefile"}}
+	err = s.Load(req, &ServerReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := make(chan string, 1)
+	go func() {
+		reason, err := s.WaitStale(req)
+		if err != nil {
+			reason = err.Error()
+		}
+		stale <- reason
+	}()
+	// unrelated files don't wake up WaitStale.
+	err = ioutil.WriteFile("other.txt", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reason := <-stale:
+		t.Fatalf("WaitStale=%q before sub.mk is created", reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+	err = ioutil.WriteFile("sub.mk", []byte("A := a\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reason := <-stale:
+		if reason == "" {
+			t.Errorf("WaitStale=%q; want non-empty reason", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("WaitStale didn't return after sub.mk is created")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Session is an environment to evaluate makefiles in. Each Session has
+// its own caches of the file system, i.e. the cache of $(wildcard) and
+// the find cache, so a program embedding kati can evaluate different
+// trees, or a tree before and after it changes, in one process without
+// sharing stale entries. Parsed makefiles are shared by all sessions,
+// as they are validated by timestamps.
+//
+// Package level functions, e.g. Load, use DefaultSession.
+type Session struct {
+	wildcardCache    *wildcardCacheT
+	androidFindCache *androidFindCacheT
+	// fingerprints records fingerprints of loads in s as
+	// CacheFingerprints does, e.g. for a server.
+	fingerprints bool
+}
+
+// DefaultSession is the Session of package level functions.
+var DefaultSession = &Session{
+	wildcardCache:    wildcardCache,
+	androidFindCache: &androidFindCache,
+}
+
+// NewSession creates a Session with empty caches.
+func NewSession() *Session {
+	fc := &androidFindCacheT{}
+	return &Session{
+		wildcardCache:    newWildcardCache(fc),
+		androidFindCache: fc,
+	}
+}
+
+// ShareSnapshot returns a new Session which shares the find cache of
+// s, i.e. the snapshot of the tree scanned once, but has its own
+// wildcard cache, which reads directories from the shared snapshot while
+// it is fresh. It is for concurrent evaluations of the same tree, e.g.
+// for several products in a build server, which shouldn't see entries
+// read or invalidated by each other, but needn't scan the tree again.
+func (s *Session) ShareSnapshot() *Session {
+	return &Session{
+		wildcardCache:    newWildcardCache(s.androidFindCache),
+		androidFindCache: s.androidFindCache,
+	}
+}
+
+// cacheFingerprints reports whether loads in s record fingerprints.
+func (s *Session) cacheFingerprints() bool {
+	return CacheFingerprints || s.fingerprints
+}
+
+// findCache returns the find cache, which starts to scan the tree
+// if it has not yet.
+func (s *Session) findCache() *androidFindCacheT {
+	s.androidFindCache.init(nil)
+	return s.androidFindCache
+}
+
+// InitAndroidFindCache is like the package level AndroidFindCacheInit,
+// but for s.
+func (s *Session) InitAndroidFindCache(prunes, leafNames []string) {
+	if leafNames != nil {
+		androidDefaultLeafNames = leafNames
+	}
+	s.androidFindCache.init(prunes)
+}
+
+// InvalidateWildcardCache is like the package level
+// InvalidateWildcardCache, but for s.
+func (s *Session) InvalidateWildcardCache(dir string) {
+	s.wildcardCache.Invalidate(dir)
+}
+
+// InvalidateAllWildcardCache is like the package level
+// InvalidateAllWildcardCache, but for s.
+func (s *Session) InvalidateAllWildcardCache() {
+	s.wildcardCache.InvalidateAll()
+}
+
+// WatchFileSystem is like the package level WatchFileSystem, but
+// invalidates caches of s.
+func (s *Session) WatchFileSystem(root string) (stop func(), err error) {
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return s.watch(root, s.unwatchedFunc(root), s.invalidateCaches)
+}
+
+// LoadResult is a result of Session.Load.
+type LoadResult struct {
+	Graph *DepGraph
+	// Cached is true if Graph was read from the cache of
+	// LoadReq.UseCache, without evaluating makefiles.
+	Cached bool
+	// Makefiles are makefiles read, as MAKEFILE_LIST.
+	Makefiles []string
+	// UsedEnvs are sorted names of environment variables referred to
+	// while loading.
+	UsedEnvs []string
+	// EvalTime is the time to evaluate makefiles, and DepBuildTime is
+	// the time to build the graph from their rules.
+	EvalTime     time.Duration
+	DepBuildTime time.Duration
+}
+
+// Load loads makefiles for req in s. When ctx is done, it stops
+// evaluating makefiles, killing commands of $(shell), and returns
+// ctx.Err().
+func (s *Session) Load(ctx context.Context, req LoadReq) (*LoadResult, error) {
+	return s.load(ctx, req, req.UseCache || req.TrackMakefiles)
+}
+
+// LoadAll is like the package level LoadAll, but loads in s, and
+// returns the results of Load. All requests are canceled when ctx is
+// done.
+func (s *Session) LoadAll(ctx context.Context, reqs []LoadReq, parallelism int) ([]*LoadResult, error) {
+	for _, req := range reqs {
+		if req.UseCache {
+			return nil, errLoadAllUseCache(req)
+		}
+	}
+	results := make([]*LoadResult, len(reqs))
+	err := runParallel(len(reqs), parallelism, func(i int) error {
+		var err error
+		results[i], err = s.Load(ctx, reqs[i])
+		return err
+	})
+	return results, err
+}
+
+// runParallel calls f for 0..n-1, at most parallelism at once, or all
+// at once if parallelism is not positive. It returns the error of the
+// first failed index.
+func runParallel(n, parallelism int, f func(i int) error) error {
+	if parallelism <= 0 {
+		parallelism = n
+	}
+	errs := make([]error, n)
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
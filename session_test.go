@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionLoadCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("$(shell sleep) needs a unix shell")
+	}
+	mk := writeTestMakefile(t, `
+A := $(shell sleep 10)
+B := $(shell sleep 10)
+all:
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewSession().Load(ctx, LoadReq{Makefile: mk})
+	if err != context.Canceled {
+		t.Errorf("Load(canceled)=_, %v; want %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewSession().Load(ctx, LoadReq{Makefile: mk})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Load(timeout)=_, %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Load(timeout) took %s", d)
+	}
+}
+
+func TestSessionCaches(t *testing.T) {
+	mk := writeTestMakefile(t, `
+D := $(dir $(lastword $(MAKEFILE_LIST)))
+all: $(wildcard $(D)*.c)
+`)
+	dir := filepath.Dir(mk)
+	defer os.RemoveAll(dir)
+
+	deps := func(s *Session) []string {
+		r, err := s.Load(context.Background(), LoadReq{Makefile: mk})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r.Makefiles, []string{mk}) {
+			t.Errorf("makefiles=%q; want %q", r.Makefiles, mk)
+		}
+		var outs []string
+		for _, d := range r.Graph.Nodes()[0].Deps {
+			outs = append(outs, d.Output)
+		}
+		return outs
+	}
+	s := NewSession()
+	if got := deps(s); got != nil {
+		t.Errorf("deps=%q; want nil", got)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "a.c"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// s still has the directory read before.
+	if got := deps(s); got != nil {
+		t.Errorf("deps with cache=%q; want nil", got)
+	}
+	want := []string{filepath.Join(dir, "a.c")}
+	if got := deps(NewSession()); !reflect.DeepEqual(got, want) {
+		t.Errorf("deps in new session=%q; want %q", got, want)
+	}
+	s.InvalidateWildcardCache(dir)
+	if got := deps(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("deps after invalidation=%q; want %q", got, want)
+	}
+}
+
+func TestSessionShareSnapshot(t *testing.T) {
+	chdirTempDir(t)
+	for _, fn := range []string{"a/x.c", "a/b/y.c", "a/z.h"} {
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(fn, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile("Makefile", []byte(`
+all: $(shell find a -name '*.c') $(wildcard a/*.h)
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseFindCache = true
+	defer func() {
+		UseFindCache = false
+	}()
+
+	s := NewSession()
+	const n = 8
+	sessions := make([]*Session, n)
+	deps := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range sessions {
+		sessions[i] = s.ShareSnapshot()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := sessions[i].Load(context.Background(), LoadReq{Makefile: "Makefile"})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			var outs []string
+			for _, d := range r.Graph.Nodes()[0].Deps {
+				outs = append(outs, d.Output)
+			}
+			deps[i] = strings.Join(outs, " ")
+		}(i)
+	}
+	wg.Wait()
+	for i := range sessions {
+		if errs[i] != nil {
+			t.Errorf("session %d: %v", i, errs[i])
+			continue
+		}
+		if want := "a/b/y.c a/x.c a/z.h"; deps[i] != want {
+			t.Errorf("session %d: deps=%q; want %q", i, deps[i], want)
+		}
+		if sessions[i].wildcardCache == s.wildcardCache {
+			t.Errorf("session %d shares the wildcard cache", i)
+		}
+	}
+	if got := s.androidFindCache.statistics().Emulated; got != n {
+		t.Errorf("emulated find commands=%d; want %d", got, n)
+	}
+}
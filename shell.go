@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Shell invocation of recipes and $(shell).
+//
+// Commands run with $(SHELL), which is defaultShell() unless a makefile
+// sets it, and $(.SHELLFLAGS). A POSIX shell takes a command by "-c".
+// cmd.exe takes it by "/c", and its command line can't be longer than
+// 8191 characters.
+// A command longer than the limit of the shell is written into a
+// script file, and the shell runs the script instead.
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// maxCmdShellLen is the maximum length of a command line of cmd.exe.
+const maxCmdShellLen = 8191
+
+// isCmdShell reports whether shell is cmd.exe.
+func isCmdShell(shell string) bool {
+	base := filepath.Base(filepath.FromSlash(shell))
+	// filepath.Base doesn't split by '\\' on POSIX systems.
+	if i := strings.LastIndexByte(base, '\\'); i >= 0 {
+		base = base[i+1:]
+	}
+	return strings.EqualFold(base, "cmd") || strings.EqualFold(base, "cmd.exe")
+}
+
+// shellFlag returns the default flag of shell to run a command.
+func shellFlag(shell string) string {
+	if isCmdShell(shell) {
+		return "/c"
+	}
+	return "-c"
+}
+
+// shellArgLimit returns the maximum length of a command run by shell.
+func shellArgLimit(shell string) int {
+	if isCmdShell(shell) {
+		return maxCmdShellLen
+	}
+	return maxArgLen
+}
+
+// shellScriptExt returns the extension of a script file run by shell.
+func shellScriptExt(shell string) string {
+	if isCmdShell(shell) {
+		return ".cmd"
+	}
+	return ".sh"
+}
+
+// scriptShellFlags returns flags of a POSIX shell to run a script file
+// instead of a command string, i.e. flags without "c", e.g. "-e" for
+// "-ec".
+func scriptShellFlags(flags string) string {
+	var r []string
+	for _, f := range strings.Fields(flags) {
+		if strings.HasPrefix(f, "-") && !strings.HasPrefix(f, "--") {
+			f = strings.Replace(f, "c", "", -1)
+			if f == "-" {
+				continue
+			}
+		}
+		r = append(r, f)
+	}
+	return strings.Join(r, " ")
+}
+
+// shellCommand returns a command to run script by shell with flags.
+// If flags is empty, the default flag of shell is used. cleanup
+// removes a temporary script file, and must be called after the
+// command finishes. The command is killed when ctx is done.
+func shellCommand(ctx context.Context, shell, flags, script string) (cmd *exec.Cmd, cleanup func(), err error) {
+	cleanup = func() {}
+	if shell == "" {
+		shell = defaultShell()
+	}
+	if flags == "" {
+		flags = shellFlag(shell)
+	}
+	if len(script) <= shellArgLimit(shell) {
+		cmd = exec.CommandContext(ctx, shell, append(strings.Fields(flags), script)...)
+		setShellCmdLine(cmd, shell, flags, script)
+		return cmd, cleanup, nil
+	}
+	f, err := ioutil.TempFile("", "kati*"+shellScriptExt(shell))
+	if err != nil {
+		return nil, cleanup, err
+	}
+	fn := f.Name()
+	_, err = f.WriteString(script)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fn)
+		return nil, cleanup, err
+	}
+	cleanup = func() { os.Remove(fn) }
+	if isCmdShell(shell) {
+		cmd = exec.CommandContext(ctx, shell, "/c", fn)
+		setShellCmdLine(cmd, shell, "/c", fn)
+	} else {
+		// read the script by '.' to run it with flags, e.g. "-ec".
+		script = ". '" + strings.Replace(fn, "'", `'\''`, -1) + "'"
+		cmd = exec.CommandContext(ctx, shell, append(strings.Fields(flags), script)...)
+	}
+	return cmd, cleanup, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package kati
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// maxArgLen is the maximum length of a command run by a shell.
+// It seems Linux is OK with ~130kB.
+// TODO: Find this number automatically.
+const maxArgLen = 100 * 1000
+
+func defaultShell() string {
+	return "/bin/sh"
+}
+
+func setShellCmdLine(cmd *exec.Cmd, shell, flags, script string) {}
+
+// killShellGroup runs cmd in its own process group, and kills the group
+// when the context of cmd is done, so children of the shell don't
+// outlive it.
+func killShellGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestIsCmdShell(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{in: "/bin/sh", want: false},
+		{in: "bash", want: false},
+		{in: "cmd", want: true},
+		{in: "CMD.EXE", want: true},
+		{in: `C:\Windows\system32\cmd.exe`, want: true},
+		{in: "C:/Windows/system32/cmd.exe", want: true},
+		{in: `C:\tools\cmdx.exe`, want: false},
+	} {
+		if got := isCmdShell(tc.in); got != tc.want {
+			t.Errorf("isCmdShell(%q)=%t; want %t", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	long := "echo " + strings.Repeat("a", maxArgLen) + " | wc -c"
+	for _, tc := range []struct {
+		script string
+		want   string
+	}{
+		{script: "echo hello", want: "hello\n"},
+		{script: long, want: "100001\n"},
+	} {
+		cmd, cleanup, err := shellCommand(context.Background(), "/bin/sh", "", tc.script)
+		if err != nil {
+			t.Errorf("shellCommand(%.20q): %v", tc.script, err)
+			continue
+		}
+		out, err := cmd.Output()
+		cleanup()
+		if err != nil {
+			t.Errorf("shellCommand(%.20q): %v", tc.script, err)
+			continue
+		}
+		if got := strings.TrimLeft(string(out), " "); got != tc.want {
+			t.Errorf("shellCommand(%.20q)=%q; want %q", tc.script, got, tc.want)
+		}
+	}
+}
+
+func TestScriptShellFlags(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "-c", want: ""},
+		{in: "-ec", want: "-e"},
+		{in: "-e -c", want: "-e"},
+		{in: "-o pipefail -c", want: "-o pipefail"},
+		{in: "--norc -c", want: "--norc"},
+	} {
+		if got := scriptShellFlags(tc.in); got != tc.want {
+			t.Errorf("scriptShellFlags(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// maxArgLen is the maximum length of a command run by a shell, i.e.
+// the limit of a command line of CreateProcess minus room for the shell
+// and its flags.
+const maxArgLen = 32767 - 1024
+
+func defaultShell() string {
+	if s := os.Getenv("ComSpec"); s != "" {
+		return s
+	}
+	return "cmd.exe"
+}
+
+// setShellCmdLine sets the command line of cmd for cmd.exe, which
+// doesn't unquote arguments as CommandLineToArgvW does. With "/s",
+// cmd.exe removes the first and the last quotes, and runs the rest as is.
+func setShellCmdLine(cmd *exec.Cmd, shell, flags, script string) {
+	if !isCmdShell(shell) {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: syscall.EscapeArg(shell) + " /s " + flags + ` "` + script + `"`,
+	}
+}
+
+// killShellGroup does nothing on windows, where only the shell is
+// killed when the context of cmd is done.
+func killShellGroup(cmd *exec.Cmd) {}
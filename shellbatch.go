@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Batched $(shell) commands.
+//
+// When ShellJobs is set, a simple assignment whose value is a $(shell)
+// call, e.g.
+//
+//	FOO := $(shell some-command)
+//
+// doesn't wait for the command. The command is expanded as usual, but
+// it runs on a worker goroutine, and the variable is assigned an empty
+// value which is filled when the command finishes. The evaluator joins
+// the command when the variable is looked up, e.g. by a conditional or
+// another expansion, and joins all commands at the end of the makefile.
+// So a result used in control flow of the makefile is waited for, and
+// commands whose results are used only later, e.g. in rules, run in
+// parallel.
+//
+// Commands run in parallel may see side effects of each other in a
+// different order than sequential evaluation, so it is enabled only by
+// ShellJobs. Commands using the shell cache always run sequentially,
+// since the cache records files modified by each command.
+
+import (
+	"fmt"
+)
+
+// shellBatch is $(shell) commands running in parallel.
+type shellBatch struct {
+	// tids are thread ids of trace events of workers. A worker takes
+	// one while it runs a command, so it limits the number of
+	// commands running at once.
+	tids chan int
+	// pending are commands not joined yet, by the names of variables
+	// assigned their outputs, and all are all commands not joined.
+	pending map[string]*shellFuture
+	all     []*shellFuture
+	// err is the first error of joined commands.
+	err error
+}
+
+// shellFuture is the output of a command running in parallel, which is
+// written into v when it is joined.
+type shellFuture struct {
+	v      *simpleVar
+	done   chan struct{}
+	out    []byte
+	err    error
+	joined bool
+}
+
+func newShellBatch(jobs int, tid int) *shellBatch {
+	b := &shellBatch{
+		tids:    make(chan int, jobs),
+		pending: make(map[string]*shellFuture),
+	}
+	for i := 0; i < jobs; i++ {
+		if traceEvent.enabled() {
+			tid = traceEvent.newThread(fmt.Sprintf("shell %d", i))
+		}
+		b.tids <- tid
+	}
+	return b
+}
+
+// join waits for the command assigned to the variable name.
+func (b *shellBatch) join(name string) {
+	f, ok := b.pending[name]
+	if !ok {
+		return
+	}
+	delete(b.pending, name)
+	b.wait(f)
+}
+
+func (b *shellBatch) wait(f *shellFuture) {
+	if f.joined {
+		return
+	}
+	<-f.done
+	f.joined = true
+	if f.err != nil {
+		if b.err == nil {
+			b.err = f.err
+		}
+		return
+	}
+	f.v.value = []string{string(formatCommandOutput(f.out))}
+}
+
+// canBatchShell reports whether ev may run $(shell) of a simple
+// assignment in parallel.
+func (ev *Evaluator) canBatchShell() bool {
+	return ev.shells != nil && ev.isolation == nil && ev.currentScope == nil && !ev.inRecipe && !ev.avoidIO
+}
+
+// batchShell evaluates $(shell) f for a simple variable name of origin.
+// The command runs in parallel, and the variable is filled when it is
+// joined.
+func (ev *Evaluator) batchShell(f *funcShell, name, origin string) (Var, error) {
+	var buf evalBuffer
+	buf.resetSep()
+	sr, err := f.eval(&buf, ev)
+	if err != nil {
+		return nil, err
+	}
+	v := &simpleVar{origin: origin}
+	if sr != nil && sr.sc == nil {
+		b := ev.shells
+		fut := &shellFuture{v: v, done: make(chan struct{})}
+		b.pending[name] = fut
+		b.all = append(b.all, fut)
+		go func() {
+			tid := <-b.tids
+			defer func() { b.tids <- tid }()
+			fut.out, fut.err = ev.runShell(sr, tid)
+			close(fut.done)
+		}()
+		return v, nil
+	}
+	if sr != nil {
+		out, err := ev.runShell(sr, ev.tid)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(formatCommandOutput(out))
+	}
+	v.value = []string{buf.String()}
+	return v, nil
+}
+
+// joinShells waits for all commands running in parallel, and returns
+// the first error of them.
+func (ev *Evaluator) joinShells() error {
+	b := ev.shells
+	if b == nil {
+		return nil
+	}
+	for _, f := range b.all {
+		b.wait(f)
+	}
+	b.all = nil
+	b.pending = make(map[string]*shellFuture)
+	return b.err
+}
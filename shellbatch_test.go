@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestShellJobs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	mk := writeTestMakefile(t, `
+D := $(dir $(lastword $(MAKEFILE_LIST)))
+# A waits for B, so they must run in parallel.
+A := $(shell i=0; while [ ! -e $(D)b ] && [ $$i -lt 300 ]; do sleep 0.01; i=$$((i+1)); done; [ -e $(D)b ] && echo a)
+B := $(shell touch $(D)b; echo b; echo c)
+ifeq ($(B),b c)
+C := $(A)-$(B)
+endif
+D := $(shell echo d)
+D += $(shell echo e)
+export E := $(shell echo e)
+F := $(shell echo $$E)
+G := $(shell echo g)
+G := $(shell echo h)
+all:
+`)
+	dir := filepath.Dir(mk)
+	defer os.RemoveAll(dir)
+	want := map[string]string{
+		"A": "a",
+		"B": "b c",
+		"C": "a-b c",
+		"D": "d e",
+		"E": "e",
+		"F": "e",
+		"G": "h",
+	}
+
+	ShellJobs = 4
+	defer func() {
+		ShellJobs = 0
+	}()
+	g, err := Load(LoadReq{Makefile: mk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range want {
+		if got := g.vars.Lookup(name).String(); got != value {
+			t.Errorf("$(%s)=%q; want %q", name, got, value)
+		}
+	}
+}
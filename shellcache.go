@@ -0,0 +1,303 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Shell cache file.
+//
+// Makefiles of a large tree run thousands of $(shell) commands, and
+// most of them print the same output in every run. If ShellCacheFile is
+// set, outputs of $(shell) are saved into the file, and the next kati
+// reuses them instead of running the commands again.
+//
+// A command is cached only if the variable .KATI_SHELL_DEPS is defined
+// when it runs. It lists the files which the command reads, e.g.
+//
+//	.KATI_SHELL_DEPS := build/version.txt
+//	VERSION := $(shell cat build/version.txt)
+//
+// An empty .KATI_SHELL_DEPS declares commands which read no files.
+// A cached output is keyed by the command, $(SHELL), $(.SHELLFLAGS),
+// exported variables and the files, and is reused while each file has the same size and
+// modification time, or is still missing, as when the command ran.
+// Commands which fail, write to stderr, or modify the files are not
+// cached. The whole file is discarded if kati runs in another directory
+// or with other environment variables.
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const shellCacheFileVersion = 2
+
+// shellCacheDepsVar is the variable to declare files read by $(shell).
+const shellCacheDepsVar = ".KATI_SHELL_DEPS"
+
+// shellCacheDep is a fingerprint of a file read by a command.
+type shellCacheDep struct {
+	Path   string
+	Exists bool
+	Size   int64
+	Mtime  int64
+}
+
+type shellCacheEntry struct {
+	Deps   []shellCacheDep
+	Output []byte
+}
+
+type shellCacheFile struct {
+	Version int
+	Dir     string          // the current directory.
+	Env     [sha1.Size]byte // hash of the environment variables.
+	Entries map[string]shellCacheEntry
+}
+
+// shellCacheCmd is a $(shell) command to cache.
+type shellCacheCmd struct {
+	key  string
+	deps []string
+	// fps are fingerprints of deps before the command runs.
+	fps []shellCacheDep
+	// stderr is true if the command wrote to stderr.
+	stderr bool
+}
+
+// Write writes stderr of the command.
+func (sc *shellCacheCmd) Write(data []byte) (int, error) {
+	if len(data) > 0 {
+		sc.stderr = true
+	}
+	return os.Stderr.Write(data)
+}
+
+// newShellCacheCmd returns a command to cache, or nil if the command
+// is not cached. env is the environment of the command, or nil if no
+// variables are exported.
+func newShellCacheCmd(ev *Evaluator, shell, flags, arg string, env []string) (*shellCacheCmd, error) {
+	if ShellCacheFile == "" || !ev.LookupVar(shellCacheDepsVar).IsDefined() {
+		return nil, nil
+	}
+	s, err := ev.EvaluateVar(shellCacheDepsVar)
+	if err != nil {
+		return nil, err
+	}
+	deps := splitSpaces(s)
+	var envKey string
+	if env != nil {
+		envKey = fmt.Sprintf("%x", environHash(env))
+	}
+	return &shellCacheCmd{
+		key:  strings.Join(append([]string{shell, flags, arg, envKey}, deps...), "\x00"),
+		deps: deps,
+	}, nil
+}
+
+type shellCacheT struct {
+	mu       sync.Mutex
+	loaded   bool
+	env      [sha1.Size]byte
+	entries  map[string]shellCacheEntry
+	modified bool
+	// fps are fingerprints of files since the last command ran, which
+	// may modify files.
+	fps  map[string]shellCacheDep
+	hits int
+}
+
+var shellCache = &shellCacheT{}
+
+// environHash returns the hash of the environment variables env.
+func environHash(env []string) [sha1.Size]byte {
+	env = append([]string(nil), env...)
+	sort.Strings(env)
+	return sha1.Sum([]byte(strings.Join(env, "\x00")))
+}
+
+// init loads ShellCacheFile if not loaded yet. c.mu must be held.
+func (c *shellCacheT) init() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	c.env = environHash(os.Environ())
+	c.entries = make(map[string]shellCacheEntry)
+	c.fps = make(map[string]shellCacheDep)
+	sf, err := loadShellCacheFile(ShellCacheFile)
+	if err != nil {
+		glog.Infof("shell cache file %s: %v", ShellCacheFile, err)
+		return
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	if sf.Dir != wd || sf.Env != c.env {
+		glog.Infof("shell cache file %s: different directory or environment", ShellCacheFile)
+		return
+	}
+	c.entries = sf.Entries
+	logStats("%d commands in shell cache file %s", len(c.entries), ShellCacheFile)
+}
+
+// fingerprint returns the fingerprint of the file p. c.mu must be held.
+func (c *shellCacheT) fingerprint(p string) shellCacheDep {
+	if d, ok := c.fps[p]; ok {
+		return d
+	}
+	d := shellCacheDep{Path: p}
+	if fi, err := os.Stat(p); err == nil {
+		d.Exists = true
+		d.Size = fi.Size()
+		d.Mtime = fi.ModTime().UnixNano()
+	}
+	c.fps[p] = d
+	return d
+}
+
+// lookup returns the cached output of sc if its files are not
+// modified. Otherwise, it records fingerprints of the files in sc to
+// run the command.
+func (c *shellCacheT) lookup(sc *shellCacheCmd) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	e, ok := c.entries[sc.key]
+	if ok {
+		for _, d := range e.Deps {
+			if c.fingerprint(d.Path) != d {
+				ok = false
+				break
+			}
+		}
+	}
+	if ok {
+		c.hits++
+		return e.Output, true
+	}
+	sc.fps = make([]shellCacheDep, 0, len(sc.deps))
+	for _, p := range sc.deps {
+		sc.fps = append(sc.fps, c.fingerprint(p))
+	}
+	return nil, false
+}
+
+// update is called after a command ran. It stores the output of sc
+// if sc is not nil and can be cached.
+func (c *shellCacheT) update(sc *shellCacheCmd, out []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loaded {
+		return
+	}
+	c.fps = make(map[string]shellCacheDep)
+	if sc == nil || err != nil || sc.stderr {
+		return
+	}
+	for _, d := range sc.fps {
+		if c.fingerprint(d.Path) != d {
+			glog.V(1).Infof("shell cache: %s modified by the command", d.Path)
+			return
+		}
+	}
+	c.entries[sc.key] = shellCacheEntry{Deps: sc.fps, Output: out}
+	c.modified = true
+}
+
+func (c *shellCacheT) cacheHits() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+// save saves the cache into ShellCacheFile if it is modified.
+func (c *shellCacheT) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loaded {
+		return nil
+	}
+	// files may be modified until the next run.
+	c.fps = make(map[string]shellCacheDep)
+	if !c.modified {
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	err = saveShellCacheFile(ShellCacheFile, shellCacheFile{
+		Dir:     wd,
+		Env:     c.env,
+		Entries: c.entries,
+	})
+	if err != nil {
+		return err
+	}
+	c.modified = false
+	return nil
+}
+
+func saveShellCacheFile(filename string, sf shellCacheFile) error {
+	startTime := time.Now()
+	sf.Version = shellCacheFileVersion
+	tmpfile := filename + ".tmp"
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(sf)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	logStats("shell cache save time: %q", time.Since(startTime))
+	return nil
+}
+
+func loadShellCacheFile(filename string) (shellCacheFile, error) {
+	var sf shellCacheFile
+	f, err := os.Open(filename)
+	if err != nil {
+		return sf, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&sf)
+	if err != nil {
+		return sf, err
+	}
+	if sf.Version != shellCacheFileVersion {
+		return sf, fmt.Errorf("version mismatch: %d", sf.Version)
+	}
+	if sf.Entries == nil {
+		sf.Entries = make(map[string]shellCacheEntry)
+	}
+	return sf, nil
+}
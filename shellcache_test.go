@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShellCacheFile(t *testing.T) {
+	chdirTempDir(t)
+	savedFile, savedCache := ShellCacheFile, shellCache
+	defer func() { ShellCacheFile, shellCache = savedFile, savedCache }()
+	ShellCacheFile = "shell_cache"
+
+	// each command appends to log.txt when it runs.
+	mk, err := parseMakefileString(`
+A := $(shell echo a >> log.txt; echo a)
+.KATI_SHELL_DEPS := dep.txt
+B := $(shell echo b >> log.txt; cat dep.txt)
+C := $(shell echo c >> log.txt; echo c >&2)
+.KATI_SHELL_DEPS :=
+D := $(shell echo d >> log.txt; echo d)
+`, srcpos{filename: "test.mk", lineno: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		dep  string // content of dep.txt to write before the run.
+		want string // commands run.
+		b    string
+	}{
+		{dep: "1", want: "a b c d", b: "1"},
+		{want: "a c", b: "1"},
+		{dep: "22", want: "a b c", b: "22"},
+		{want: "a c", b: "22"},
+	} {
+		if tc.dep != "" {
+			err = ioutil.WriteFile("dep.txt", []byte(tc.dep), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = os.Remove("log.txt")
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		// a new process loads the cache file.
+		shellCache = &shellCacheT{}
+		er, err := eval(mk, make(Vars), false)
+		if err != nil {
+			t.Fatalf("eval #%d: %v", i, err)
+		}
+		err = shellCache.save()
+		if err != nil {
+			t.Fatalf("save #%d: %v", i, err)
+		}
+		log, err := ioutil.ReadFile("log.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(strings.Fields(string(log)), " "); got != tc.want {
+			t.Errorf("run #%d: commands %q; want %q", i, got, tc.want)
+		}
+		for name, want := range map[string]string{"A": "a", "B": tc.b, "D": "d"} {
+			if got := er.vars.Lookup(name).String(); got != want {
+				t.Errorf("run #%d: %s=%q; want %q", i, name, got, want)
+			}
+		}
+	}
+}
+
+func TestShellCacheExport(t *testing.T) {
+	chdirTempDir(t)
+	savedFile, savedCache := ShellCacheFile, shellCache
+	defer func() { ShellCacheFile, shellCache = savedFile, savedCache }()
+	ShellCacheFile = "shell_cache"
+
+	for i, tc := range []struct {
+		v   string // exported value of V.
+		ran bool
+	}{
+		{v: "x", ran: true},
+		{v: "x"},
+		{v: "y", ran: true},
+		{v: "x"},
+	} {
+		mk, err := parseMakefileString(`
+export V := `+tc.v+`
+.KATI_SHELL_DEPS :=
+E := $(shell echo e >> log.txt; echo $$V)
+`, srcpos{filename: "test.mk", lineno: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Remove("log.txt")
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		shellCache = &shellCacheT{}
+		er, err := eval(mk, make(Vars), false)
+		if err != nil {
+			t.Fatalf("eval #%d: %v", i, err)
+		}
+		err = shellCache.save()
+		if err != nil {
+			t.Fatalf("save #%d: %v", i, err)
+		}
+		_, err = os.Stat("log.txt")
+		if ran := err == nil; ran != tc.ran {
+			t.Errorf("run #%d: command ran=%t; want %t", i, ran, tc.ran)
+		}
+		if got := er.vars.Lookup("E").String(); got != tc.v {
+			t.Errorf("run #%d: E=%q; want %q", i, got, tc.v)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// Fast paths of $(shell) for trivial commands, e.g. $(shell cat VERSION),
+// which run in kati instead of forking a shell. Unlike builtins in
+// shellutil.go, which match commands in makefiles when they are parsed,
+// fast paths parse commands after they are expanded, and handle only
+// what they can answer exactly as the shell. Anything else, e.g.
+// options not implemented or a missing file, runs in the shell.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// shellFastCommands are commands with fast paths. in is the output of
+// the previous command in the pipeline, or empty for the first one,
+// whose stdin is /dev/null.
+var shellFastCommands = map[string]func(args []string, in []byte, env []string) ([]byte, bool){
+	"echo":     shellFastEcho,
+	"cat":      shellFastCat,
+	"pwd":      shellFastPwd,
+	"date":     shellFastDate,
+	"uname":    shellFastUname,
+	"dirname":  shellFastDirname,
+	"basename": shellFastBasename,
+	"sort":     shellFastSort,
+	"uniq":     shellFastUniq,
+}
+
+// shellFastPath returns the output of cmd run by shell with flags, or
+// false if it has no fast path. env is the environment of the command,
+// or nil for os.Environ().
+func shellFastPath(shell, flags, cmd string, env []string) ([]byte, bool) {
+	switch filepath.Base(shell) {
+	case "sh", "bash", "dash":
+	default:
+		return nil, false
+	}
+	switch flags {
+	case "-c", "-ec":
+	default:
+		return nil, false
+	}
+	pipeline, ok := parseSimpleShell(cmd)
+	if !ok {
+		return nil, false
+	}
+	var out []byte
+	for _, args := range pipeline {
+		f, ok := shellFastCommands[args[0]]
+		if !ok {
+			return nil, false
+		}
+		out, ok = f(args[1:], out, env)
+		if !ok {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// parseSimpleShell parses s as a pipeline of simple commands, whose
+// words are literal, i.e. have no expansions, redirections, globs or
+// control operators other than '|'. It returns words of each command.
+func parseSimpleShell(s string) ([][]string, bool) {
+	var pipeline [][]string
+	var words []string
+	var word []byte
+	inWord := false
+	endWord := func() {
+		if inWord {
+			words = append(words, string(word))
+			word = word[:0]
+			inWord = false
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case ' ', '\t':
+			endWord()
+		case '|':
+			endWord()
+			if len(words) == 0 || strings.HasPrefix(s[i+1:], "|") {
+				return nil, false
+			}
+			pipeline = append(pipeline, words)
+			words = nil
+		case '\'':
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return nil, false
+			}
+			word = append(word, s[i+1:i+1+j]...)
+			inWord = true
+			i += j + 1
+		case '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				return nil, false
+			}
+			q := s[i+1 : i+1+j]
+			if strings.ContainsAny(q, "$`\\") {
+				return nil, false
+			}
+			word = append(word, q...)
+			inWord = true
+			i += j + 1
+		case '\\':
+			if i+1 >= len(s) || s[i+1] == '\n' {
+				return nil, false
+			}
+			word = append(word, s[i+1])
+			inWord = true
+			i++
+		case '$', '`', ';', '&', '<', '>', '(', ')', '{', '}', '*', '?', '[', ']', '\n', '\r':
+			return nil, false
+		case '#', '~':
+			// a comment, or tilde expansion at the start of a word.
+			if !inWord {
+				return nil, false
+			}
+			word = append(word, c)
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+	endWord()
+	if len(words) == 0 {
+		return nil, false
+	}
+	return append(pipeline, words), true
+}
+
+// shellGetenv returns the environment variable name in env, or in
+// os.Environ() if env is nil.
+func shellGetenv(env []string, name string) string {
+	if env == nil {
+		return os.Getenv(name)
+	}
+	var v string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name) && strings.HasPrefix(kv[len(name):], "=") {
+			v = kv[len(name)+1:]
+		}
+	}
+	return v
+}
+
+// shellLocale returns the locale of category, e.g. LC_COLLATE, for the
+// command.
+func shellLocale(env []string, category string) string {
+	for _, name := range []string{"LC_ALL", category, "LANG"} {
+		if v := shellGetenv(env, name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func isCLocale(locale string) bool {
+	return locale == "" || locale == "C" || locale == "POSIX" || strings.HasPrefix(locale, "C.")
+}
+
+func isOption(arg string) bool {
+	return len(arg) > 1 && arg[0] == '-'
+}
+
+func shellFastEcho(args []string, in []byte, env []string) ([]byte, bool) {
+	newline := true
+	if len(args) > 0 && args[0] == "-n" {
+		newline = false
+		args = args[1:]
+	}
+	if len(args) > 0 && isOption(args[0]) && strings.Trim(args[0][1:], "neE") == "" {
+		// bash has -e and -E, but dash doesn't.
+		return nil, false
+	}
+	var out []byte
+	for i, arg := range args {
+		// dash interprets backslash escapes, but bash doesn't.
+		if strings.IndexByte(arg, '\\') >= 0 {
+			return nil, false
+		}
+		if i > 0 {
+			out = append(out, ' ')
+		}
+		out = append(out, arg...)
+	}
+	if newline {
+		out = append(out, '\n')
+	}
+	return out, true
+}
+
+// readShellFiles reads files as cat, or returns in if files are empty.
+func readShellFiles(files []string, in []byte) ([]byte, bool) {
+	if len(files) == 0 {
+		return in, true
+	}
+	var out []byte
+	for _, fn := range files {
+		if strings.HasPrefix(fn, "-") {
+			return nil, false
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			// let the shell report the error.
+			return nil, false
+		}
+		out = append(out, b...)
+	}
+	return out, true
+}
+
+func shellFastCat(args []string, in []byte, env []string) ([]byte, bool) {
+	return readShellFiles(args, in)
+}
+
+func shellFastPwd(args []string, in []byte, env []string) ([]byte, bool) {
+	if len(args) > 0 || shellGetenv(env, "PWD") != os.Getenv("PWD") {
+		return nil, false
+	}
+	// os.Getwd returns $PWD if it is the current directory, as the
+	// shell does.
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, false
+	}
+	return []byte(wd + "\n"), true
+}
+
+func shellFastDate(args []string, in []byte, env []string) ([]byte, bool) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "+") {
+		return nil, false
+	}
+	locale := shellLocale(env, "LC_TIME")
+	if !isCLocale(locale) && !strings.HasPrefix(locale, "en_") {
+		return nil, false
+	}
+	// time.Local is loaded with $TZ of kati.
+	if shellGetenv(env, "TZ") != os.Getenv("TZ") {
+		return nil, false
+	}
+	t := ShellDateTimestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	out, ok := strftime(t, args[0][1:])
+	if !ok {
+		return nil, false
+	}
+	return append(out, '\n'), true
+}
+
+// strftime formats t as date +format in the C locale. It returns false
+// for conversions not implemented.
+func strftime(t time.Time, format string) ([]byte, bool) {
+	var out []byte
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return nil, false
+		}
+		switch format[i] {
+		case '%':
+			out = append(out, '%')
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case 'Y':
+			out = append(out, fmt.Sprintf("%d", t.Year())...)
+		case 'y':
+			out = append(out, fmt.Sprintf("%02d", t.Year()%100)...)
+		case 'm':
+			out = append(out, fmt.Sprintf("%02d", int(t.Month()))...)
+		case 'd':
+			out = append(out, fmt.Sprintf("%02d", t.Day())...)
+		case 'e':
+			out = append(out, fmt.Sprintf("%2d", t.Day())...)
+		case 'j':
+			out = append(out, fmt.Sprintf("%03d", t.YearDay())...)
+		case 'H':
+			out = append(out, fmt.Sprintf("%02d", t.Hour())...)
+		case 'k':
+			out = append(out, fmt.Sprintf("%2d", t.Hour())...)
+		case 'I':
+			out = append(out, fmt.Sprintf("%02d", (t.Hour()+11)%12+1)...)
+		case 'l':
+			out = append(out, fmt.Sprintf("%2d", (t.Hour()+11)%12+1)...)
+		case 'M':
+			out = append(out, fmt.Sprintf("%02d", t.Minute())...)
+		case 'S':
+			out = append(out, fmt.Sprintf("%02d", t.Second())...)
+		case 's':
+			out = append(out, fmt.Sprintf("%d", t.Unix())...)
+		case 'N':
+			out = append(out, fmt.Sprintf("%09d", t.Nanosecond())...)
+		case 'p':
+			out = append(out, t.Format("PM")...)
+		case 'a':
+			out = append(out, t.Format("Mon")...)
+		case 'A':
+			out = append(out, t.Format("Monday")...)
+		case 'b', 'h':
+			out = append(out, t.Format("Jan")...)
+		case 'B':
+			out = append(out, t.Format("January")...)
+		case 'u':
+			wd := int(t.Weekday())
+			if wd == 0 {
+				wd = 7
+			}
+			out = append(out, fmt.Sprintf("%d", wd)...)
+		case 'w':
+			out = append(out, fmt.Sprintf("%d", int(t.Weekday()))...)
+		case 'z':
+			out = append(out, t.Format("-0700")...)
+		case 'Z':
+			out = append(out, t.Format("MST")...)
+		case 'F':
+			out = append(out, t.Format("2006-01-02")...)
+		case 'T':
+			out = append(out, t.Format("15:04:05")...)
+		case 'R':
+			out = append(out, t.Format("15:04")...)
+		case 'D':
+			out = append(out, t.Format("01/02/06")...)
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+func shellFastUname(args []string, in []byte, env []string) ([]byte, bool) {
+	fields := ""
+	for _, arg := range args {
+		if !isOption(arg) || strings.Trim(arg[1:], "snrvm") != "" {
+			return nil, false
+		}
+		fields += arg[1:]
+	}
+	if fields == "" {
+		fields = "s"
+	}
+	u, ok := uname()
+	if !ok {
+		return nil, false
+	}
+	var vals []string
+	// uname prints fields in this order, regardless of options.
+	for i, f := range "snrvm" {
+		if strings.ContainsRune(fields, f) {
+			vals = append(vals, u[i])
+		}
+	}
+	return []byte(strings.Join(vals, " ") + "\n"), true
+}
+
+// posixPathArg returns false for arguments of dirname and basename whose
+// results differ in implementations.
+func posixPathArg(arg string) bool {
+	return !isOption(arg) && !strings.HasPrefix(arg, "//")
+}
+
+func shellFastDirname(args []string, in []byte, env []string) ([]byte, bool) {
+	if len(args) != 1 || !posixPathArg(args[0]) {
+		return nil, false
+	}
+	s := strings.TrimRight(args[0], "/")
+	switch {
+	case args[0] == "":
+		s = "."
+	case s == "":
+		s = "/"
+	default:
+		i := strings.LastIndexByte(s, '/')
+		if i < 0 {
+			s = "."
+			break
+		}
+		s = strings.TrimRight(s[:i], "/")
+		if s == "" {
+			s = "/"
+		}
+	}
+	return []byte(s + "\n"), true
+}
+
+func shellFastBasename(args []string, in []byte, env []string) ([]byte, bool) {
+	if len(args) == 0 || len(args) > 2 || !posixPathArg(args[0]) {
+		return nil, false
+	}
+	s := strings.TrimRight(args[0], "/")
+	switch {
+	case args[0] == "":
+	case s == "":
+		s = "/"
+	default:
+		s = s[strings.LastIndexByte(s, '/')+1:]
+		if len(args) == 2 && s != args[1] {
+			s = strings.TrimSuffix(s, args[1])
+		}
+	}
+	return []byte(s + "\n"), true
+}
+
+// shellLines splits b into lines without newlines.
+func shellLines(b []byte) [][]byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return bytes.Split(bytes.TrimSuffix(b, []byte{'\n'}), []byte{'\n'})
+}
+
+func joinShellLines(lines [][]byte) []byte {
+	var out []byte
+	for _, line := range lines {
+		out = append(out, line...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+func shellFastSort(args []string, in []byte, env []string) ([]byte, bool) {
+	// other locales collate differently from bytes.
+	if !isCLocale(shellLocale(env, "LC_COLLATE")) {
+		return nil, false
+	}
+	unique := false
+	if len(args) > 0 && args[0] == "-u" {
+		unique = true
+		args = args[1:]
+	}
+	b, ok := readShellFiles(args, in)
+	if !ok {
+		return nil, false
+	}
+	lines := shellLines(b)
+	sort.Slice(lines, func(i, j int) bool {
+		return bytes.Compare(lines[i], lines[j]) < 0
+	})
+	if unique {
+		lines = uniqLines(lines)
+	}
+	return joinShellLines(lines), true
+}
+
+func uniqLines(lines [][]byte) [][]byte {
+	var out [][]byte
+	for i, line := range lines {
+		if i > 0 && bytes.Equal(line, lines[i-1]) {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func shellFastUniq(args []string, in []byte, env []string) ([]byte, bool) {
+	if len(args) > 0 || !isCLocale(shellLocale(env, "LC_COLLATE")) {
+		return nil, false
+	}
+	return joinShellLines(uniqLines(shellLines(in))), true
+}
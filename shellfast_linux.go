@@ -0,0 +1,50 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package kati
+
+import "syscall"
+
+// uname returns the kernel name, the node name, the release, the
+// version and the machine, as uname -snrvm.
+func uname() ([5]string, bool) {
+	var u syscall.Utsname
+	err := syscall.Uname(&u)
+	if err != nil {
+		return [5]string{}, false
+	}
+	return [5]string{
+		utsnameString(u.Sysname[:]),
+		utsnameString(u.Nodename[:]),
+		utsnameString(u.Release[:]),
+		utsnameString(u.Version[:]),
+		utsnameString(u.Machine[:]),
+	}, true
+}
+
+// utsnameString converts a NUL terminated field of Utsname, whose
+// element type is int8 or uint8 depending on the architecture.
+func utsnameString[T int8 | uint8](f []T) string {
+	b := make([]byte, 0, len(f))
+	for _, c := range f {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseSimpleShell(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want [][]string
+	}{
+		{
+			in:   "echo  a 'b  c' \"d\"e f\\ g",
+			want: [][]string{{"echo", "a", "b  c", "de", "f g"}},
+		},
+		{
+			in:   "cat a b|sort -u | uniq",
+			want: [][]string{{"cat", "a", "b"}, {"sort", "-u"}, {"uniq"}},
+		},
+		{
+			in:   "echo a#b a~ '$x' ''",
+			want: [][]string{{"echo", "a#b", "a~", "$x", ""}},
+		},
+		{in: ""},
+		{in: "echo $HOME"},
+		{in: "echo \"$HOME\""},
+		{in: "echo `pwd`"},
+		{in: "echo a > b"},
+		{in: "echo a; echo b"},
+		{in: "echo a && echo b"},
+		{in: "echo a || echo b"},
+		{in: "echo *.c"},
+		{in: "echo ~/a"},
+		{in: "echo a # comment"},
+		{in: "echo {a,b}"},
+		{in: "(echo a)"},
+		{in: "echo 'a"},
+		{in: "echo a |"},
+		{in: "| echo a"},
+		{in: "echo a\nb"},
+	} {
+		got, ok := parseSimpleShell(tc.in)
+		if ok != (tc.want != nil) || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSimpleShell(%q)=%q, %t; want %q", tc.in, got, ok, tc.want)
+		}
+	}
+}
+
+func TestShellFastPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	chdirTempDir(t)
+	err := ioutil.WriteFile("a.txt", []byte("b\na\nb\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("b.txt", []byte("c\na"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir("d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(), "LC_ALL=C")
+	for _, tc := range []struct {
+		cmd  string
+		fast bool
+	}{
+		{cmd: "echo", fast: true},
+		{cmd: "echo a  'b  c'", fast: true},
+		{cmd: "echo -n a b", fast: true},
+		{cmd: "echo -", fast: true},
+		{cmd: "echo -e a"},
+		{cmd: "echo -n -e a"},
+		{cmd: `echo 'a\nb'`},
+		{cmd: "cat a.txt b.txt", fast: true},
+		{cmd: "cat", fast: true},
+		{cmd: "cat missing.txt"},
+		{cmd: "cat d"},
+		{cmd: "cat -n a.txt"},
+		{cmd: "pwd", fast: true},
+		{cmd: "pwd -P"},
+		{cmd: "date +%Y-%m-%d", fast: true},
+		{cmd: "date"},
+		{cmd: "date -u +%Y"},
+		{cmd: "date +%c"},
+		{cmd: "uname", fast: runtime.GOOS == "linux"},
+		{cmd: "uname -m -s", fast: runtime.GOOS == "linux"},
+		{cmd: "uname -sr", fast: runtime.GOOS == "linux"},
+		{cmd: "uname -a"},
+		{cmd: "dirname a/b/c", fast: true},
+		{cmd: "dirname a//b//", fast: true},
+		{cmd: "dirname /a", fast: true},
+		{cmd: "dirname a", fast: true},
+		{cmd: "dirname /", fast: true},
+		{cmd: "dirname ''", fast: true},
+		{cmd: "dirname //a"},
+		{cmd: "dirname a b"},
+		{cmd: "basename a/b.c", fast: true},
+		{cmd: "basename a/b.c .c", fast: true},
+		{cmd: "basename a/.c .c", fast: true},
+		{cmd: "basename /a/b//", fast: true},
+		{cmd: "basename /", fast: true},
+		{cmd: "basename -s .c a.c"},
+		{cmd: "sort a.txt b.txt", fast: true},
+		{cmd: "sort -u a.txt", fast: true},
+		{cmd: "cat a.txt b.txt | sort | uniq", fast: true},
+		{cmd: "echo b a | sort", fast: true},
+		{cmd: "sort -r a.txt"},
+		{cmd: "uniq -c a.txt"},
+		{cmd: "true"},
+		{cmd: "A=b echo a"},
+	} {
+		got, ok := shellFastPath("/bin/sh", "-c", tc.cmd, env)
+		if ok != tc.fast {
+			t.Errorf("shellFastPath(%q)=_, %t; want %t", tc.cmd, ok, tc.fast)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		cmd := exec.Command("/bin/sh", "-c", tc.cmd)
+		cmd.Env = env
+		want, err := cmd.Output()
+		if err != nil {
+			t.Errorf("%q: %v", tc.cmd, err)
+			continue
+		}
+		if string(got) != string(want) {
+			t.Errorf("shellFastPath(%q)=%q; want %q", tc.cmd, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		shell, flags, env string
+	}{
+		{shell: "/bin/zsh", flags: "-c"},
+		{shell: "/bin/sh", flags: "-xc"},
+		{shell: "/bin/sh", flags: "-c", env: "LC_COLLATE=en_US.UTF-8"},
+	} {
+		env := append(os.Environ(), "LC_ALL=")
+		if tc.env != "" {
+			env = append(env, tc.env)
+		}
+		_, ok := shellFastPath(tc.shell, tc.flags, "sort a.txt", env)
+		if ok {
+			t.Errorf("shellFastPath(%q, %q, sort) with %q=_, true; want false", tc.shell, tc.flags, tc.env)
+		}
+	}
+}
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2015, time.March, 4, 5, 6, 7, 8, time.FixedZone("JST", 9*60*60))
+	for _, tc := range []struct {
+		format, want string
+	}{
+		{"%Y%m%d.%H%M%S", "20150304.050607"},
+		{"%F %T %R %D", "2015-03-04 05:06:07 05:06 03/04/15"},
+		{"%y %e %k %l %I %p %j", "15  4  5  5 05 AM 063"},
+		{"%a %A %b %h %B %u %w", "Wed Wednesday Mar Mar March 3 3"},
+		{"%z %Z %s %N %%%n%t", "+0900 JST 1425413167 000000008 %\n\t"},
+	} {
+		got, ok := strftime(ts, tc.format)
+		if !ok || string(got) != tc.want {
+			t.Errorf("strftime(%q)=%q, %t; want %q", tc.format, got, ok, tc.want)
+		}
+	}
+	for _, format := range []string{"%c", "%"} {
+		if got, ok := strftime(ts, format); ok {
+			t.Errorf("strftime(%q)=%q, true; want false", format, got)
+		}
+	}
+}
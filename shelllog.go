@@ -0,0 +1,137 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sources of outputs of $(shell) in ShellLogEntry.
+const (
+	// ShellRun is a command run in the shell.
+	ShellRun = "shell"
+	// ShellFromFindCache is a find command emulated by the find cache.
+	ShellFromFindCache = "find_cache"
+	// ShellFromCache is a command whose output was read from
+	// ShellCacheFile.
+	ShellFromCache = "shell_cache"
+	// ShellFastPath is a trivial command run in kati, e.g. echo. see
+	// shellfast.go
+	ShellFastPath = "fast_path"
+)
+
+// ShellLogEntry is a $(shell) command evaluated in makefiles. Commands
+// replaced by builtins when makefiles are parsed, see UseShellBuiltins,
+// are not logged.
+type ShellLogEntry struct {
+	Cmd string `json:"cmd"`
+	// Shell is $(SHELL), and Dir is the working directory of the
+	// command.
+	Shell string `json:"shell"`
+	Dir   string `json:"dir"`
+	// Location is the position of $(shell) in makefiles.
+	Location string `json:"location"`
+	// Source is how the output was made, e.g. ShellRun.
+	Source string `json:"source"`
+	// Start is when the command started, and Duration is the time to
+	// run it.
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	// OutputSize is the size of the output in bytes, before newlines
+	// are replaced with spaces.
+	OutputSize int `json:"output_size"`
+	// Error is the error of the command, e.g. its exit status.
+	Error string `json:"error,omitempty"`
+}
+
+type shellLogT struct {
+	mu      sync.Mutex
+	enabled bool
+	entries []ShellLogEntry
+	w       io.Writer
+	err     error
+}
+
+var shellLog shellLogT
+
+// StartShellLog starts to log $(shell) commands. Entries are kept for
+// ShellLog, and written to w as JSON lines if w is not nil.
+func StartShellLog(w io.Writer) {
+	shellLog.mu.Lock()
+	defer shellLog.mu.Unlock()
+	shellLog.enabled = true
+	shellLog.entries = nil
+	shellLog.w = w
+	shellLog.err = nil
+}
+
+// StopShellLog stops logging $(shell) commands, and returns the first
+// error to write the log.
+func StopShellLog() error {
+	shellLog.mu.Lock()
+	defer shellLog.mu.Unlock()
+	shellLog.enabled = false
+	shellLog.w = nil
+	return shellLog.err
+}
+
+// ShellLog returns $(shell) commands logged since StartShellLog.
+func ShellLog() []ShellLogEntry {
+	shellLog.mu.Lock()
+	defer shellLog.mu.Unlock()
+	return append([]ShellLogEntry(nil), shellLog.entries...)
+}
+
+func (l *shellLogT) isEnabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enabled
+}
+
+// add logs cmd of $(shell) at pos. It should be called only if l is
+// enabled, as it takes the working directory.
+func (l *shellLogT) add(pos srcpos, shell, cmd, source string, start time.Time, size int, err error) {
+	e := ShellLogEntry{
+		Cmd:        cmd,
+		Shell:      shell,
+		Location:   pos.String(),
+		Source:     source,
+		Start:      start,
+		Duration:   time.Since(start),
+		OutputSize: size,
+	}
+	e.Dir, _ = os.Getwd()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.enabled {
+		return
+	}
+	l.entries = append(l.entries, e)
+	if l.w == nil || l.err != nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		_, err = l.w.Write(append(b, '\n'))
+	}
+	l.err = err
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestShellLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("$(shell echo) needs a unix shell")
+	}
+	chdirTestMakefile(t, `
+A := $(shell echo hello)
+B := $(shell exit 3)
+C := $(shell find src -name '*.c')
+all:
+`)
+	err := os.Mkdir("src", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join("src", "a.c"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the working directory may be a symlink, e.g. on macOS.
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseFindCache = true
+	defer func() {
+		UseFindCache = false
+	}()
+
+	var buf bytes.Buffer
+	StartShellLog(&buf)
+	_, err = NewSession().Load(context.Background(), LoadReq{Makefile: "Makefile"})
+	if serr := StopShellLog(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// $(shell) isn't logged after StopShellLog.
+	_, err = NewSession().Load(context.Background(), LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		cmd, loc, source string
+		size             int
+		err              string
+	}
+	want := []entry{
+		{"echo hello", "Makefile:2", ShellRun, 6, ""},
+		{"exit 3", "Makefile:3", ShellRun, 0, "exit status 3"},
+		{"find src -name '*.c'", "Makefile:4", ShellFromFindCache, 8, ""},
+	}
+	logged := ShellLog()
+	var got []entry
+	for _, e := range logged {
+		got = append(got, entry{e.Cmd, e.Location, e.Source, e.OutputSize, e.Error})
+		if e.Shell != "/bin/sh" || e.Dir != dir || e.Start.IsZero() || e.Duration < 0 {
+			t.Errorf("shell=%q dir=%q start=%v duration=%v; want /bin/sh in %q", e.Shell, e.Dir, e.Start, e.Duration, dir)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ShellLog()=%+v; want %+v", got, want)
+	}
+
+	var written []ShellLogEntry
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var e ShellLogEntry
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		written = append(written, e)
+	}
+	if len(written) != len(logged) {
+		t.Fatalf("%d entries written; want %d", len(written), len(logged))
+	}
+	for i := range written {
+		// times in JSON have no monotonic clock.
+		if !written[i].Start.Equal(logged[i].Start) {
+			t.Errorf("written start=%v; want %v", written[i].Start, logged[i].Start)
+		}
+		written[i].Start = logged[i].Start
+	}
+	if !reflect.DeepEqual(written, logged) {
+		t.Errorf("written %+v; want %+v", written, logged)
+	}
+}
@@ -16,6 +16,8 @@ package kati
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -269,6 +271,33 @@ func (f *funcShellAndroidRot13) Eval(w evalWriter, ev *Evaluator) error {
 	return nil
 }
 
+// findCacheDir expands a leading "~" of dir, a directory to cd for
+// find, as a shell does, i.e. by $HOME of the shell. It returns dir
+// relative to the current directory to look up the find cache, or
+// false if dir is not in the current directory.
+func findCacheDir(dir string) (string, bool) {
+	if !strings.HasPrefix(dir, "~") {
+		return dir, true
+	}
+	dir = expandTilde(dir, func() string { return os.Getenv("HOME") })
+	if strings.HasPrefix(dir, "~") {
+		return "", false
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
 type funcShellAndroidFindFileInDir struct {
 	*funcShell
 	dir Value
@@ -283,15 +312,26 @@ func (f *funcShellAndroidFindFileInDir) Eval(w evalWriter, ev *Evaluator) error
 	dir := string(trimSpaceBytes(fargs[0]))
 	abuf.release()
 	glog.V(1).Infof("shellAndroidFindFileInDir %s => %s", f.dir.String(), dir)
+	dir, ok := findCacheDir(dir)
+	if !ok {
+		glog.Warningf("shellAndroidFindFileInDir out of tree: call original shell")
+		return f.funcShell.Eval(w, ev)
+	}
 	if strings.Contains(dir, "..") {
 		glog.Warningf("shellAndroidFindFileInDir contains ..: call original shell")
 		return f.funcShell.Eval(w, ev)
 	}
-	if !androidFindCache.ready() {
+	buf := newEbuf()
+	defer buf.release()
+	ok = ev.sess.findCache().query([]string{dir}, false, func(c *androidFindCacheT) bool {
+		c.findInDir(buf, dir)
+		return true
+	})
+	if !ok {
 		glog.Warningf("shellAndroidFindFileInDir androidFindCache is not ready: call original shell")
 		return f.funcShell.Eval(w, ev)
 	}
-	androidFindCache.findInDir(w, dir)
+	w.Write(buf.Bytes())
 	return nil
 }
 
@@ -319,31 +359,44 @@ func (f *funcShellAndroidFindExtFilesUnder) Eval(w evalWriter, ev *Evaluator) er
 	var roots []string
 	for _, word := range wb.words {
 		root := string(word)
-		if strings.Contains(root, "..") {
+		// roots are in the output, so let the shell expand "~".
+		if strings.Contains(root, "..") || strings.HasPrefix(root, "~") {
 			hasDotDot = true
 		}
 		roots = append(roots, root)
 	}
 	wb.release()
 	glog.V(1).Infof("shellAndroidFindExtFilesUnder %s,%s => %s,%s", f.chdir.String(), f.roots.String(), chdir, roots)
+	chdir, ok := findCacheDir(chdir)
+	if !ok {
+		glog.Warningf("shellAndroidFindExtFilesUnder out of tree: call original shell")
+		return f.funcShell.Eval(w, ev)
+	}
 	if strings.Contains(chdir, "..") || hasDotDot {
 		glog.Warningf("shellAndroidFindExtFilesUnder contains ..: call original shell")
 		return f.funcShell.Eval(w, ev)
 	}
-	if !androidFindCache.ready() {
-		glog.Warningf("shellAndroidFindExtFilesUnder androidFindCache is not ready: call original shell")
-		return f.funcShell.Eval(w, ev)
+	var paths []string
+	for _, root := range roots {
+		paths = append(paths, filepath.Join(chdir, root))
 	}
 	buf := newEbuf()
-	for _, root := range roots {
-		if !androidFindCache.findExtFilesUnder(buf, chdir, root, f.ext) {
-			buf.release()
-			glog.Warningf("shellAndroidFindExtFilesUnder androidFindCache couldn't handle: call original shell")
-			return f.funcShell.Eval(w, ev)
+	defer buf.release()
+	ok = ev.sess.findCache().query(paths, false, func(c *androidFindCacheT) bool {
+		buf.Reset()
+		buf.resetSep()
+		for _, root := range roots {
+			if !c.findExtFilesUnder(buf, chdir, root, f.ext) {
+				return false
+			}
 		}
+		return true
+	})
+	if !ok {
+		glog.Warningf("shellAndroidFindExtFilesUnder androidFindCache is not ready or couldn't handle: call original shell")
+		return f.funcShell.Eval(w, ev)
 	}
 	w.Write(buf.Bytes())
-	buf.release()
 	return nil
 }
 
@@ -361,15 +414,26 @@ func (f *funcShellAndroidFindJavaResourceFileGroup) Eval(w evalWriter, ev *Evalu
 	dir := string(trimSpaceBytes(fargs[0]))
 	abuf.release()
 	glog.V(1).Infof("shellAndroidFindJavaResourceFileGroup %s => %s", f.dir.String(), dir)
+	dir, ok := findCacheDir(dir)
+	if !ok {
+		glog.Warningf("shellAndroidFindJavaResourceFileGroup out of tree: call original shell")
+		return f.funcShell.Eval(w, ev)
+	}
 	if strings.Contains(dir, "..") {
 		glog.Warningf("shellAndroidFindJavaResourceFileGroup contains ..: call original shell")
 		return f.funcShell.Eval(w, ev)
 	}
-	if !androidFindCache.ready() {
+	buf := newEbuf()
+	defer buf.release()
+	ok = ev.sess.findCache().query([]string{dir}, false, func(c *androidFindCacheT) bool {
+		c.findJavaResourceFileGroup(buf, dir)
+		return true
+	})
+	if !ok {
 		glog.Warningf("shellAndroidFindJavaResourceFileGroup androidFindCache is not ready: call original shell")
 		return f.funcShell.Eval(w, ev)
 	}
-	androidFindCache.findJavaResourceFileGroup(w, dir)
+	w.Write(buf.Bytes())
 	return nil
 }
 
@@ -382,8 +446,7 @@ type funcShellAndroidFindleaves struct {
 }
 
 func (f *funcShellAndroidFindleaves) Eval(w evalWriter, ev *Evaluator) error {
-	if !androidFindCache.leavesReady() {
-		glog.Warningf("shellAndroidFindleaves androidFindCache is not ready: call original shell")
+	if !UseFindCache {
 		return f.funcShell.Eval(w, ev)
 	}
 	abuf := newEbuf()
@@ -409,17 +472,32 @@ func (f *funcShellAndroidFindleaves) Eval(w evalWriter, ev *Evaluator) error {
 	var dirs []string
 	for _, word := range wb.words {
 		dir := string(word)
-		if strings.Contains(dir, "..") {
-			glog.Warningf("shellAndroidFindleaves contains .. in %s: call original shell", dir)
+		// dirs are in the output, so let the shell expand "~".
+		if strings.Contains(dir, "..") || strings.HasPrefix(dir, "~") {
+			glog.Warningf("shellAndroidFindleaves contains .. or ~ in %s: call original shell", dir)
 			return f.funcShell.Eval(w, ev)
 		}
 		dirs = append(dirs, dir)
 	}
 	wb.release()
 
-	for _, dir := range dirs {
-		androidFindCache.findleaves(w, dir, name, prunes, f.mindepth)
+	buf := newEbuf()
+	defer buf.release()
+	ok := ev.sess.findCache().query(dirs, true, func(c *androidFindCacheT) bool {
+		buf.Reset()
+		buf.resetSep()
+		for _, dir := range dirs {
+			if !c.findleaves(buf, dir, name, prunes, f.mindepth) {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		glog.Warningf("shellAndroidFindleaves androidFindCache is not ready or couldn't handle: call original shell")
+		return f.funcShell.Eval(w, ev)
 	}
+	w.Write(buf.Bytes())
 	return nil
 }
 
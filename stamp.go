@@ -0,0 +1,517 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// The stamp file of ckati.
+//
+// ckati writes .kati_stamp<suffix> next to ninja files, and ckati
+// --regen reads it to check whether the ninja files need to be
+// generated again. It lists inputs of the generation: makefiles, which
+// are stale if they are modified after the generation started,
+// environment variables, results of $(wildcard) and outputs of
+// $(shell). KatiStamp reads and writes the format, so kati and ckati
+// can be used for the same output directory, and NewKatiStamp converts
+// inputs recorded in a DepGraph to it.
+//
+// The format is a sequence of little endian values: a float64 of the
+// time, then lists, each of which is an int32 of its length followed by
+// its elements. A string is an int32 of its length followed by its
+// bytes.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// KatiStampFilename returns the filename of the stamp file for ninja
+// files with suffix.
+func KatiStampFilename(suffix string) string {
+	return ".kati_stamp" + suffix
+}
+
+// KatiStampOp is the operation of a KatiStampCommand.
+type KatiStampOp int32
+
+// Operations of KatiStampCommand, as CommandOp of ckati.
+const (
+	// StampShell is $(shell), and StampFind is $(shell) of find
+	// emulated by ckati.
+	StampShell KatiStampOp = iota
+	StampFind
+	// StampRead and StampReadMissing are $(file <) of an existing file
+	// and a missing file. StampWrite and StampAppend are $(file >) and
+	// $(file >>).
+	StampRead
+	StampReadMissing
+	StampWrite
+	StampAppend
+)
+
+// KatiStamp is the content of the stamp file of ckati.
+type KatiStamp struct {
+	// Time is when the generation started, in seconds since the
+	// epoch.
+	Time float64
+	// Files are the kati binary and makefiles read.
+	Files []string
+	// UndefinedVars are variables which were undefined when they were
+	// used. They are stale if they are set in the environment.
+	UndefinedVars []string
+	Envs          []KatiStampEnv
+	Globs         []KatiStampGlob
+	Commands      []KatiStampCommand
+	// Args is the command line of the generation, which old versions
+	// of ckati don't write.
+	Args string
+}
+
+// KatiStampEnv is an environment variable used.
+type KatiStampEnv struct {
+	Name, Value string
+}
+
+// KatiStampGlob is a pattern of $(wildcard) and files it matched.
+type KatiStampGlob struct {
+	Pattern string
+	Files   []string
+}
+
+// KatiStampCommand is a command run while the generation.
+type KatiStampCommand struct {
+	Op        KatiStampOp
+	Shell     string
+	ShellFlag string
+	// Cmd is a command for StampShell and StampFind, or a filename
+	// for others.
+	Cmd    string
+	Result string
+	// MissingDirs, FoundFiles and ReadDirs are of StampFind.
+	MissingDirs []string
+	FoundFiles  []string
+	ReadDirs    []string
+}
+
+// stampTime returns t in seconds since the epoch, as ckati's timestamps.
+func stampTime(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+type stampWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+}
+
+func (w *stampWriter) Int(i int) {
+	binary.LittleEndian.PutUint32(w.buf[:4], uint32(int32(i)))
+	w.w.Write(w.buf[:4])
+}
+
+func (w *stampWriter) Str(s string) {
+	w.Int(len(s))
+	w.w.WriteString(s)
+}
+
+func (w *stampWriter) Strs(ss []string) {
+	w.Int(len(ss))
+	for _, s := range ss {
+		w.Str(s)
+	}
+}
+
+// Write writes s to w in the format of ckati.
+func (s *KatiStamp) Write(w io.Writer) error {
+	sw := &stampWriter{w: bufio.NewWriter(w)}
+	binary.LittleEndian.PutUint64(sw.buf[:], math.Float64bits(s.Time))
+	sw.w.Write(sw.buf[:])
+	sw.Strs(s.Files)
+	sw.Strs(s.UndefinedVars)
+	sw.Int(len(s.Envs))
+	for _, e := range s.Envs {
+		sw.Str(e.Name)
+		sw.Str(e.Value)
+	}
+	sw.Int(len(s.Globs))
+	for _, g := range s.Globs {
+		sw.Str(g.Pattern)
+		sw.Strs(g.Files)
+	}
+	sw.Int(len(s.Commands))
+	for _, c := range s.Commands {
+		sw.Int(int(c.Op))
+		sw.Str(c.Shell)
+		sw.Str(c.ShellFlag)
+		sw.Str(c.Cmd)
+		sw.Str(c.Result)
+		if c.Op == StampFind {
+			sw.Strs(c.MissingDirs)
+			sw.Strs(c.FoundFiles)
+			sw.Strs(c.ReadDirs)
+		}
+	}
+	sw.Str(s.Args)
+	return sw.w.Flush()
+}
+
+// Save writes s to filename.
+func (s *KatiStamp) Save(filename string) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	return s.Write(f)
+}
+
+type stampReader struct {
+	r   *bufio.Reader
+	buf [8]byte
+	err error
+}
+
+func (r *stampReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	_, r.err = io.ReadFull(r.r, r.buf[:n])
+	if r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+	return r.buf[:n]
+}
+
+func (r *stampReader) Int() int {
+	b := r.read(4)
+	if r.err != nil {
+		return 0
+	}
+	n := int(int32(binary.LittleEndian.Uint32(b)))
+	if n < 0 {
+		r.err = fmt.Errorf("broken stamp: negative length %d", n)
+		return 0
+	}
+	return n
+}
+
+func (r *stampReader) Str() string {
+	n := r.Int()
+	if r.err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	_, r.err = io.CopyN(&buf, r.r, int64(n))
+	if r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+	return buf.String()
+}
+
+func (r *stampReader) Strs() []string {
+	n := r.Int()
+	var ss []string
+	for i := 0; i < n && r.err == nil; i++ {
+		ss = append(ss, r.Str())
+	}
+	return ss
+}
+
+// ReadKatiStamp reads a stamp in the format of ckati from r.
+func ReadKatiStamp(r io.Reader) (*KatiStamp, error) {
+	sr := &stampReader{r: bufio.NewReader(r)}
+	s := &KatiStamp{}
+	s.Time = math.Float64frombits(binary.LittleEndian.Uint64(sr.read(8)))
+	s.Files = sr.Strs()
+	s.UndefinedVars = sr.Strs()
+	n := sr.Int()
+	for i := 0; i < n && sr.err == nil; i++ {
+		s.Envs = append(s.Envs, KatiStampEnv{Name: sr.Str(), Value: sr.Str()})
+	}
+	n = sr.Int()
+	for i := 0; i < n && sr.err == nil; i++ {
+		s.Globs = append(s.Globs, KatiStampGlob{Pattern: sr.Str(), Files: sr.Strs()})
+	}
+	n = sr.Int()
+	for i := 0; i < n && sr.err == nil; i++ {
+		c := KatiStampCommand{
+			Op:        KatiStampOp(sr.Int()),
+			Shell:     sr.Str(),
+			ShellFlag: sr.Str(),
+			Cmd:       sr.Str(),
+			Result:    sr.Str(),
+		}
+		if c.Op == StampFind {
+			c.MissingDirs = sr.Strs()
+			c.FoundFiles = sr.Strs()
+			c.ReadDirs = sr.Strs()
+		}
+		s.Commands = append(s.Commands, c)
+	}
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	if _, err := sr.r.Peek(1); err == io.EOF {
+		return s, nil
+	}
+	s.Args = sr.Str()
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	return s, nil
+}
+
+// LoadKatiStamp reads the stamp file filename.
+func LoadKatiStamp(filename string) (*KatiStamp, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ReadKatiStamp(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return s, nil
+}
+
+// NewKatiStamp converts inputs recorded in g to a KatiStamp. g should
+// be loaded with LoadReq.TrackMakefiles and CacheFingerprints to record
+// inputs other than makefiles. env is the environment to load g. If an
+// input was changed after g was loaded, the stamp is stale.
+func NewKatiStamp(g *DepGraph, env []string) (*KatiStamp, error) {
+	s := &KatiStamp{Time: stampTime(g.loadTime)}
+	kati, err := os.Executable()
+	if err != nil {
+		kati = os.Args[0]
+	}
+	s.Files = append(s.Files, kati)
+	stale := false
+	for _, mk := range g.accessedMks {
+		switch mk.State {
+		case fileExists, fileNotExists, fileInconsistent:
+			s.Files = append(s.Files, mk.Filename)
+		case fileGlob, fileWildcard:
+			var matched []string
+			if mk.State == fileGlob {
+				matched, err = filepath.Glob(mk.Filename)
+			} else {
+				w := &wildcardCacheT{dirent: make(map[string][]string)}
+				matched, err = w.Glob(mk.Filename)
+			}
+			if err != nil {
+				return nil, err
+			}
+			stale = stale || globHash(matched) != mk.Hash
+			s.Globs = append(s.Globs, KatiStampGlob{Pattern: mk.Filename, Files: matched})
+		case fileEnv:
+			value, ok := lookupEnviron(env, mk.Filename)
+			stale = stale || envHash(value, ok) != mk.Hash
+			if mk.Hash == envHash("", false) {
+				s.UndefinedVars = append(s.UndefinedVars, mk.Filename)
+				continue
+			}
+			s.Envs = append(s.Envs, KatiStampEnv{Name: mk.Filename, Value: value})
+		case fileShell:
+			if len(mk.Args) != 2 {
+				return nil, fmt.Errorf("internal error: broken shell fingerprint: %q", mk.Args)
+			}
+			out := mk.out
+			if out == nil && mk.Hash != sha1.Sum(nil) {
+				// g is loaded from a cache.
+				out, err = runStampCommand(mk.Args[0], mk.Args[1], mk.Filename, mk.Env)
+				if err != nil {
+					return nil, err
+				}
+				stale = stale || sha1.Sum(out) != mk.Hash
+			}
+			s.Commands = append(s.Commands, KatiStampCommand{
+				Op:        StampShell,
+				Shell:     mk.Args[0],
+				ShellFlag: mk.Args[1],
+				Cmd:       mk.Filename,
+				Result:    string(out),
+			})
+		default:
+			return nil, fmt.Errorf("internal error: broken state: %d", mk.State)
+		}
+	}
+	if stale {
+		glog.Warningf("inputs were changed after loaded; the stamp is stale")
+		s.Time = 0
+	}
+	return s, nil
+}
+
+func runStampCommand(shell, flag, command string, env []string) ([]byte, error) {
+	cmd, cleanup, err := shellCommand(context.Background(), shell, flag, command)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		glog.V(1).Infof("stamp $(shell %q): %v", command, err)
+	}
+	return out, nil
+}
+
+// sameFiles reports whether a and b have the same files, ignoring their
+// order.
+func sameFiles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns why ninja files generated with s need to be generated
+// again, or nil if they don't, as ckati --regen does. env is the
+// environment to generate them, e.g. os.Environ().
+func (s *KatiStamp) Check(env []string) (*RegenReason, error) {
+	for _, fn := range s.Files {
+		// ckati doesn't check removed files.
+		st, err := os.Stat(fn)
+		if err == nil && stampTime(st.ModTime()) > s.Time {
+			return &RegenReason{Kind: RegenMakefile, Name: fn, Change: "modified"}, nil
+		}
+	}
+	for _, name := range s.UndefinedVars {
+		if value, ok := lookupEnviron(env, name); ok {
+			return &RegenReason{Kind: RegenEnv, Name: name, Change: "set", Value: value}, nil
+		}
+	}
+	for _, e := range s.Envs {
+		value, ok := lookupEnviron(env, e.Name)
+		switch {
+		case !ok:
+			return &RegenReason{Kind: RegenEnv, Name: e.Name, Change: "unset"}, nil
+		case value != e.Value:
+			return &RegenReason{Kind: RegenEnv, Name: e.Name, Change: "changed", Value: value}, nil
+		}
+	}
+	for _, g := range s.Globs {
+		w := &wildcardCacheT{dirent: make(map[string][]string)}
+		matched, err := w.Glob(g.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !sameFiles(matched, g.Files) {
+			return &RegenReason{Kind: RegenWildcard, Name: g.Pattern, Change: "changed"}, nil
+		}
+	}
+	for _, c := range s.Commands {
+		r, err := s.checkCommand(c, env)
+		if r != nil || err != nil {
+			return r, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *KatiStamp) checkCommand(c KatiStampCommand, env []string) (*RegenReason, error) {
+	switch c.Op {
+	case StampShell, StampFind:
+		if c.Op == StampFind && !s.findChanged(c) {
+			return nil, nil
+		}
+		out, err := runStampCommand(c.Shell, c.ShellFlag, c.Cmd, env)
+		if err != nil {
+			return nil, err
+		}
+		if string(out) != c.Result {
+			return &RegenReason{Kind: RegenShell, Name: c.Cmd, Change: "changed"}, nil
+		}
+	case StampRead:
+		b, err := ioutil.ReadFile(c.Cmd)
+		if err != nil {
+			return &RegenReason{Kind: RegenMakefile, Name: c.Cmd, Change: "removed"}, nil
+		}
+		if string(b) != c.Result {
+			return &RegenReason{Kind: RegenMakefile, Name: c.Cmd, Change: "modified"}, nil
+		}
+	case StampReadMissing:
+		if exists(c.Cmd) {
+			return &RegenReason{Kind: RegenMakefile, Name: c.Cmd, Change: "created"}, nil
+		}
+	}
+	return nil, nil
+}
+
+// findChanged reports whether directories find of c read may be
+// changed, so c needs to run again.
+func (s *KatiStamp) findChanged(c KatiStampCommand) bool {
+	for _, dir := range c.MissingDirs {
+		if exists(dir) {
+			return true
+		}
+	}
+	for _, dir := range c.ReadDirs {
+		st, err := os.Stat(dir)
+		if err != nil || stampTime(st.ModTime()) > s.Time {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckKatiStamp returns why ninja files with suffix need to be
+// generated again, or nil if they don't, as ckati --regen does.
+func CheckKatiStamp(suffix string, env []string) (*RegenReason, error) {
+	for _, fn := range []string{fmt.Sprintf("build%s.ninja", suffix), KatiStampFilename(suffix)} {
+		if !exists(fn) {
+			return &RegenReason{Kind: RegenCache, Name: fn, Change: "not found"}, nil
+		}
+	}
+	s, err := LoadKatiStamp(KatiStampFilename(suffix))
+	if err != nil {
+		return nil, err
+	}
+	return s.Check(env)
+}
+
+// stampArgs returns the command line to write in the stamp, as ckati.
+func stampArgs() string {
+	return strings.Join(os.Args, " ")
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKatiStampFormat(t *testing.T) {
+	s := &KatiStamp{
+		Time:          1.5,
+		Files:         []string{"kati", "Makefile"},
+		UndefinedVars: []string{"U"},
+		Envs:          []KatiStampEnv{{Name: "E", Value: "v"}},
+		Globs:         []KatiStampGlob{{Pattern: "*.c", Files: []string{"a.c"}}},
+		Commands: []KatiStampCommand{
+			{Op: StampShell, Shell: "/bin/sh", ShellFlag: "-c", Cmd: "echo", Result: "\n"},
+			{Op: StampFind, Shell: "/bin/sh", ShellFlag: "-c", Cmd: "find d", Result: "d", MissingDirs: []string{"m"}, FoundFiles: []string{"d"}, ReadDirs: []string{"d"}},
+		},
+		Args: "kati -ninja",
+	}
+	var buf bytes.Buffer
+	err := s.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the time, files, undefined vars and envs.
+	prefix := "\x00\x00\x00\x00\x00\x00\xf8\x3f" +
+		"\x02\x00\x00\x00" + "\x04\x00\x00\x00kati" + "\x08\x00\x00\x00Makefile" +
+		"\x01\x00\x00\x00" + "\x01\x00\x00\x00U" +
+		"\x01\x00\x00\x00" + "\x01\x00\x00\x00E" + "\x01\x00\x00\x00v"
+	if !strings.HasPrefix(buf.String(), prefix) {
+		t.Errorf("Write()=%q; want prefix %q", buf.String(), prefix)
+	}
+	got, err := ReadKatiStamp(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("ReadKatiStamp(Write(%#v))=%#v", s, got)
+	}
+
+	// old versions of ckati don't write args.
+	b := buf.Bytes()[:buf.Len()-4-len(s.Args)]
+	got, err = ReadKatiStamp(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Args != "" || !reflect.DeepEqual(got.Commands, s.Commands) {
+		t.Errorf("ReadKatiStamp(without args)=%#v", got)
+	}
+
+	_, err = ReadKatiStamp(bytes.NewReader(b[:len(b)-1]))
+	if err == nil {
+		t.Errorf("ReadKatiStamp(truncated)=_, nil; want error")
+	}
+}
+
+func TestNewKatiStamp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("$(shell cat) needs a unix shell")
+	}
+	mk := writeTestMakefile(t, `
+D := $(dir $(lastword $(MAKEFILE_LIST)))
+A := $(wildcard $(D)*.c) $(shell cat $(D)v.txt) $(FOO) $(BAR)
+all:
+`)
+	dir := filepath.Dir(mk)
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("v.txt", "v1")
+	CacheFingerprints = true
+	defer func() {
+		CacheFingerprints = false
+	}()
+
+	env := []string{"FOO=a"}
+	for _, tc := range []struct {
+		name   string
+		change func()
+		env    string
+		// want is "kind change" of the RegenReason, or "" if the
+		// ninja files are up to date.
+		want string
+	}{
+		{
+			name: "no change",
+		},
+		{
+			name:   "create file matched by wildcard",
+			change: func() { writeFile("a.c", "") },
+			want:   "wildcard changed",
+		},
+		{
+			name:   "shell output",
+			change: func() { writeFile("v.txt", "v2") },
+			want:   "shell changed",
+		},
+		{
+			name: "environment variable",
+			env:  "FOO=b",
+			want: "env changed",
+		},
+		{
+			name: "undefined variable",
+			env:  "FOO=a BAR=b",
+			want: "env set",
+		},
+		{
+			// the makefile is modified for later loads.
+			name: "modify makefile",
+			change: func() {
+				future := time.Now().Add(time.Hour)
+				os.Chtimes(mk, future, future)
+			},
+			want: "makefile modified",
+		},
+	} {
+		InvalidateAllWildcardCache()
+		g, err := Load(LoadReq{Makefile: mk, EnvironmentVars: env, TrackMakefiles: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewKatiStamp(g, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.name == "no change" {
+			if len(s.Files) < 2 || s.Files[1] != mk {
+				t.Errorf("files=%q; want kati and %q", s.Files, mk)
+			}
+			if want := []KatiStampEnv{{Name: "FOO", Value: "a"}}; !reflect.DeepEqual(s.Envs, want) {
+				t.Errorf("envs=%q; want %q", s.Envs, want)
+			}
+			// variables in os.Environ() but not in env are also
+			// undefined.
+			if !contains(s.UndefinedVars, "BAR") || contains(s.UndefinedVars, "FOO") {
+				t.Errorf("undefined vars=%q; want BAR without FOO", s.UndefinedVars)
+			}
+			if len(s.Commands) != 1 || s.Commands[0].Result != "v1" {
+				t.Errorf("commands=%#v; want cat with v1", s.Commands)
+			}
+		}
+		if tc.change != nil {
+			tc.change()
+		}
+		cenv := env
+		if tc.env != "" {
+			cenv = strings.Fields(tc.env)
+		}
+		r, err := s.Check(cenv)
+		if err != nil {
+			t.Fatalf("%s: Check=%v", tc.name, err)
+		}
+		var got string
+		if r != nil {
+			got = r.Kind + " " + r.Change
+		}
+		if got != tc.want {
+			t.Errorf("%s: Check=%v; want %q", tc.name, r, tc.want)
+		}
+	}
+}
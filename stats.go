@@ -15,21 +15,31 @@
 package kati
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// traceEventT writes events in the trace event format of Chrome, which
+// about://tracing and Perfetto can open.
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
 type traceEventT struct {
 	mu  sync.Mutex
 	f   io.WriteCloser
 	t0  time.Time
 	pid int
+	// n is the number of events written.
+	n int
+	// lastTID is the last thread id allocated by newThread.
+	lastTID int32
 }
 
+// Thread ids of events which are not in an evaluation.
 const (
 	traceEventMain = iota + 1
 	traceEventFindCache
@@ -37,6 +47,27 @@ const (
 	traceEventFindCacheFiles
 )
 
+var traceEventThreadNames = map[int]string{
+	traceEventMain:            "main",
+	traceEventFindCache:       "find cache",
+	traceEventFindCacheLeaves: "find cache leaves",
+	traceEventFindCacheFiles:  "find cache files",
+}
+
+// traceEventPhases are the names of events written as trace events.
+// Others, e.g. var, are too many to trace, and only counted in stats.
+var traceEventPhases = map[string]bool{
+	"parse":       true,
+	"include":     true,
+	"eval":        true,
+	"depbuild":    true,
+	"shell":       true,
+	"findcache":   true,
+	"serialize":   true,
+	"deserialize": true,
+	"ninja":       true,
+}
+
 var traceEvent traceEventT
 
 // TraceEventStart starts trace event.
@@ -50,9 +81,18 @@ func TraceEventStop() {
 }
 
 func (t *traceEventT) start(f io.WriteCloser) {
+	t.mu.Lock()
 	t.f = f
 	t.t0 = time.Now()
+	t.pid = os.Getpid()
+	t.n = 0
+	t.lastTID = traceEventFindCacheFiles
 	fmt.Fprint(t.f, "[ ")
+	t.mu.Unlock()
+	t.metadata(0, "process_name", "kati")
+	for tid := traceEventMain; tid <= traceEventFindCacheFiles; tid++ {
+		t.metadata(tid, "thread_name", traceEventThreadNames[tid])
+	}
 }
 
 func (t *traceEventT) enabled() bool {
@@ -60,8 +100,23 @@ func (t *traceEventT) enabled() bool {
 }
 
 func (t *traceEventT) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	fmt.Fprint(t.f, "\n]\n")
 	t.f.Close()
+	t.f = nil
+}
+
+// newThread allocates a thread id for events of a goroutine, e.g. an
+// evaluation in LoadAll, so events of concurrent goroutines are not
+// nested in one thread. It returns traceEventMain if not enabled.
+func (t *traceEventT) newThread(name string) int {
+	if !t.enabled() {
+		return traceEventMain
+	}
+	tid := int(atomic.AddInt32(&t.lastTID, 1))
+	t.metadata(tid, "thread_name", name)
+	return tid
 }
 
 type event struct {
@@ -79,43 +134,55 @@ func (t *traceEventT) begin(name string, v Value, tid int) event {
 		e.name = name
 		e.v = v.String()
 	}
-	if t.f != nil {
-		e.emit = name == "include" || name == "shell" || name == "findcache"
-		if e.emit {
-			t.emit("B", e, e.t.Sub(t.t0))
-		}
-	}
+	e.emit = t.f != nil && traceEventPhases[name]
 	return e
 }
 
-func (t *traceEventT) emit(ph string, e event, ts time.Duration) {
+// write writes an event with fields in a JSON object, i.e. `"key":value`.
+func (t *traceEventT) write(fields string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-
-	if t.pid == 0 {
-		t.pid = os.Getpid()
-	} else {
+	if t.f == nil {
+		return
+	}
+	if t.n > 0 {
 		fmt.Fprintf(t.f, ",\n")
 	}
-	fmt.Fprintf(t.f, `{"pid":%d,"tid":%d,"ts":%d,"ph":%q,"cat":%q,"name":%q,"args":{}}`,
-		t.pid,
-		e.tid,
-		ts.Nanoseconds()/1e3,
-		ph,
-		e.name,
-		e.v,
-	)
+	t.n++
+	fmt.Fprintf(t.f, `{"pid":%d,%s}`, t.pid, fields)
+}
+
+func (t *traceEventT) metadata(tid int, name, v string) {
+	t.write(fmt.Sprintf(`"tid":%d,"ts":0,"ph":"M","name":%s,"args":{"name":%s}`, tid, jsonString(name), jsonString(v)))
 }
 
 func (t *traceEventT) end(e event) {
-	if t.f != nil {
-		if e.emit {
-			t.emit("E", e, time.Since(t.t0))
-		}
+	if e.emit {
+		// a complete event, rather than a pair of begin and end
+		// events, needn't be ordered with events of other goroutines.
+		ts := e.t.Sub(t.t0)
+		dur := time.Since(e.t)
+		t.write(fmt.Sprintf(`"tid":%d,"ts":%d,"dur":%d,"ph":"X","cat":%s,"name":%s,"args":{}`,
+			e.tid,
+			ts.Nanoseconds()/1e3,
+			dur.Nanoseconds()/1e3,
+			jsonString(e.name),
+			jsonString(e.v),
+		))
 	}
 	stats.add(e.name, e.v, e.t)
 }
 
+// jsonString returns s quoted as a JSON string. Invalid UTF-8, e.g. in
+// an output of $(shell), is replaced with U+FFFD.
+func jsonString(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return `""`
+	}
+	return string(b)
+}
+
 type statsData struct {
 	Name    string
 	Count   int
@@ -200,3 +267,112 @@ func (s *shellStatsT) Count() int {
 	defer s.mu.Unlock()
 	return s.count
 }
+
+// Statistics is statistics of caches and $(shell) collected in this
+// process, e.g. to export to monitoring systems.
+type Statistics struct {
+	FindCache FindCacheStats
+	Wildcard  WildcardCacheStats
+	Shell     ShellStats
+}
+
+// FindCacheStats is statistics of the find cache.
+type FindCacheStats struct {
+	// Dirs and Files are the numbers of directories and files in the
+	// cache.
+	Dirs, Files int
+	// ScanTime is the time to scan the tree, or to load FindCacheFile.
+	ScanTime time.Duration
+	// Loaded is true if the cache was loaded from FindCacheFile.
+	Loaded bool
+	// Emulated is the number of find commands served by the cache.
+	// Unhandled is the number of find commands which the cache
+	// couldn't serve, and ran in the shell.
+	Emulated, Unhandled int
+	// Lazy is the number of queries answered before the scan
+	// finished, by the top-level directories they need.
+	Lazy int
+}
+
+// WildcardCacheStats is statistics of the cache of $(wildcard).
+type WildcardCacheStats struct {
+	// Dirs and Files are the numbers of directories and files in the
+	// cache.
+	Dirs, Files int
+	// Hits and Misses are the numbers of lookups of directories
+	// served by the cache, and read otherwise. SnapshotReads is the
+	// number of misses read from the find cache.
+	Hits, Misses, SnapshotReads int
+}
+
+// ShellStats is statistics of $(shell).
+type ShellStats struct {
+	// Count is the number of commands run in the shell, and Time is
+	// the total time to run them.
+	Count int
+	Time  time.Duration
+	// CacheHits is the number of commands whose outputs were read from
+	// ShellCacheFile instead of running them.
+	CacheHits int
+}
+
+// Stats returns statistics collected so far.
+func Stats() Statistics {
+	return Statistics{
+		FindCache: androidFindCache.statistics(),
+		Wildcard:  wildcardCache.statistics(),
+		Shell: ShellStats{
+			Count:     shellStats.Count(),
+			Time:      shellStats.Duration(),
+			CacheHits: shellCache.cacheHits(),
+		},
+	}
+}
+
+func (c *androidFindCacheT) setScanStats(dirs, files int, loaded bool) {
+	c.statsMu.Lock()
+	c.stats.Dirs = dirs
+	c.stats.Files = files
+	c.stats.Loaded = loaded
+	c.statsMu.Unlock()
+}
+
+// countFind counts a find command served by the cache if emulated is
+// true, or ran in the shell otherwise.
+func (c *androidFindCacheT) countFind(emulated bool) {
+	c.statsMu.Lock()
+	if emulated {
+		c.stats.Emulated++
+	} else {
+		c.stats.Unhandled++
+	}
+	c.statsMu.Unlock()
+}
+
+// countLazy counts a query answered before the scan finished.
+func (c *androidFindCacheT) countLazy() {
+	c.statsMu.Lock()
+	c.stats.Lazy++
+	c.statsMu.Unlock()
+}
+
+func (c *androidFindCacheT) statistics() FindCacheStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.stats
+}
+
+func (w *wildcardCacheT) statistics() WildcardCacheStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := WildcardCacheStats{
+		Dirs:          len(w.dirent),
+		Hits:          w.hits,
+		Misses:        w.misses,
+		SnapshotReads: w.snapshotReads,
+	}
+	for _, names := range w.dirent {
+		s.Files += len(names)
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestTraceEvent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("$(shell echo) needs a unix shell")
+	}
+	mk := writeTestMakefile(t, `
+D := $(dir $(lastword $(MAKEFILE_LIST)))
+include $(D)sub.mk
+`+"A := $(shell echo \"\xff\x01\")\n"+`all: $(A)
+`)
+	dir := filepath.Dir(mk)
+	defer os.RemoveAll(dir)
+	err := ioutil.WriteFile(filepath.Join(dir, "sub.mk"), []byte("B := b\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	TraceEventStart(nopWriteCloser{&buf})
+	g, err := Load(LoadReq{Makefile: mk})
+	if err == nil {
+		fn := filepath.Join(dir, "graph")
+		err = PROTO.Save(g, fn, nil)
+		if err == nil {
+			_, err = PROTO.Load(fn)
+		}
+	}
+	TraceEventStop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []struct {
+		Pid  *int
+		Tid  *int
+		Ts   *int64
+		Dur  *int64
+		Ph   string
+		Cat  string
+		Name string
+		Args map[string]string
+	}
+	err = json.Unmarshal(buf.Bytes(), &events)
+	if err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.Bytes())
+	}
+	threads := make(map[int]string)
+	cats := make(map[string]int)
+	for _, e := range events {
+		if e.Pid == nil || *e.Pid != os.Getpid() || e.Tid == nil || e.Ts == nil {
+			t.Errorf("event without pid, tid or ts: %+v", e)
+			continue
+		}
+		switch e.Ph {
+		case "M":
+			if e.Name == "thread_name" {
+				threads[*e.Tid] = e.Args["name"]
+			}
+		case "X":
+			if e.Dur == nil || *e.Dur < 0 || *e.Ts < 0 {
+				t.Errorf("complete event without valid ts and dur: %+v", e)
+			}
+			if e.Cat != "serialize" && e.Cat != "deserialize" && threads[*e.Tid] != "load "+mk {
+				t.Errorf("%s event in thread %q", e.Cat, threads[*e.Tid])
+			}
+			cats[e.Cat]++
+			if e.Cat == "shell" && e.Name != "echo \"\ufffd\x01\"" {
+				t.Errorf("shell event %q", e.Name)
+			}
+		default:
+			t.Errorf("unexpected phase: %+v", e)
+		}
+	}
+	for _, cat := range []string{"parse", "include", "eval", "depbuild", "shell", "serialize", "deserialize"} {
+		if cats[cat] == 0 {
+			t.Errorf("no %s event in %q", cat, buf.Bytes())
+		}
+	}
+	if cats["parse"] != 2 {
+		t.Errorf("parse events=%d; want 2 for Makefile and sub.mk", cats["parse"])
+	}
+}
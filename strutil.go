@@ -32,46 +32,55 @@ func isWhitespace(ch rune) bool {
 	return wsbytes[ch]
 }
 
+// spaceOnly reports whether whitespaces in s are only ' ', so words
+// in s can be found by bytes.IndexByte.
+func spaceOnly(s []byte) bool {
+	return bytes.IndexByte(s, '\t') < 0 && bytes.IndexByte(s, '\n') < 0 && bytes.IndexByte(s, '\r') < 0
+}
+
+func spaceOnlyString(s string) bool {
+	return strings.IndexByte(s, '\t') < 0 && strings.IndexByte(s, '\n') < 0 && strings.IndexByte(s, '\r') < 0
+}
+
 func splitSpaces(s string) []string {
 	var r []string
-	tokStart := -1
-	for i, ch := range s {
-		if isWhitespace(ch) {
-			if tokStart >= 0 {
-				r = append(r, s[tokStart:i])
-				tokStart = -1
+	spaceOnly := spaceOnlyString(s)
+	i := 0
+	for {
+		for i < len(s) && wsbytes[s[i]] {
+			i++
+		}
+		if i == len(s) {
+			break
+		}
+		j := len(s)
+		if spaceOnly {
+			if k := strings.IndexByte(s[i:], ' '); k >= 0 {
+				j = i + k
 			}
 		} else {
-			if tokStart < 0 {
-				tokStart = i
+			j = i
+			for j < len(s) && !wsbytes[s[j]] {
+				j++
 			}
 		}
+		r = append(r, s[i:j])
+		i = j
 	}
-	if tokStart >= 0 {
-		r = append(r, s[tokStart:])
+	if glog.V(2) {
+		glog.Infof("splitSpace(%q)=%q", s, r)
 	}
-	glog.V(2).Infof("splitSpace(%q)=%q", s, r)
 	return r
 }
 
 func splitSpacesBytes(s []byte) (r [][]byte) {
-	tokStart := -1
-	for i, ch := range s {
-		if isWhitespace(rune(ch)) {
-			if tokStart >= 0 {
-				r = append(r, s[tokStart:i])
-				tokStart = -1
-			}
-		} else {
-			if tokStart < 0 {
-				tokStart = i
-			}
-		}
+	ws := newWordScanner(s)
+	for ws.Scan() {
+		r = append(r, ws.Bytes())
 	}
-	if tokStart >= 0 {
-		r = append(r, s[tokStart:])
+	if glog.V(2) {
+		glog.Infof("splitSpace(%q)=%q", s, r)
 	}
-	glog.V(2).Infof("splitSpace(%q)=%q", s, r)
 	return r
 }
 
@@ -81,11 +90,14 @@ type wordScanner struct {
 	s   int  // word starts
 	i   int  // current pos
 	esc bool // handle \-escape
+	// spaceOnly is true if whitespaces in in are only ' '.
+	spaceOnly bool
 }
 
 func newWordScanner(in []byte) *wordScanner {
 	return &wordScanner{
-		in: in,
+		in:        in,
+		spaceOnly: spaceOnly(in),
 	}
 }
 
@@ -95,16 +107,20 @@ func (ws *wordScanner) next() bool {
 			break
 		}
 	}
-	if ws.s == len(ws.in) {
-		return false
-	}
-	return true
+	return ws.s < len(ws.in)
 }
 
 func (ws *wordScanner) Scan() bool {
 	if !ws.next() {
 		return false
 	}
+	if ws.spaceOnly && !ws.esc {
+		ws.i = len(ws.in)
+		if k := bytes.IndexByte(ws.in[ws.s:], ' '); k >= 0 {
+			ws.i = ws.s + k
+		}
+		return true
+	}
 	for ws.i = ws.s; ws.i < len(ws.in); ws.i++ {
 		if ws.esc && ws.in[ws.i] == '\\' {
 			ws.i++
@@ -114,6 +130,10 @@ func (ws *wordScanner) Scan() bool {
 			break
 		}
 	}
+	if ws.i > len(ws.in) {
+		// trailing backslash.
+		ws.i = len(ws.in)
+	}
 	return true
 }
 
@@ -129,19 +149,11 @@ func (ws *wordScanner) Remain() []byte {
 }
 
 func matchPattern(pat, str string) bool {
-	i := strings.IndexByte(pat, '%')
-	if i < 0 {
-		return pat == str
-	}
-	return strings.HasPrefix(str, pat[:i]) && strings.HasSuffix(str, pat[i+1:])
+	return matcherCache.percentPatternString(pat).matchString(str)
 }
 
 func matchPatternBytes(pat, str []byte) bool {
-	i := bytes.IndexByte(pat, '%')
-	if i < 0 {
-		return bytes.Equal(pat, str)
-	}
-	return bytes.HasPrefix(str, pat[:i]) && bytes.HasSuffix(str, pat[i+1:])
+	return matcherCache.percentPattern(pat).match(str)
 }
 
 func substPattern(pat, repl, str string) string {
@@ -176,43 +188,7 @@ func substPattern(pat, repl, str string) string {
 }
 
 func substPatternBytes(pat, repl, str []byte) (pre, subst, post []byte) {
-	i := bytes.IndexByte(pat, '%')
-	if i < 0 {
-		if bytes.Equal(str, pat) {
-			return repl, nil, nil
-		}
-		return str, nil, nil
-	}
-	in := str
-	trimed := str
-	if i > 0 {
-		trimed = bytes.TrimPrefix(in, pat[:i])
-		if bytes.Equal(trimed, in) {
-			return str, nil, nil
-		}
-	}
-	in = trimed
-	if i < len(pat)-1 {
-		trimed = bytes.TrimSuffix(in, pat[i+1:])
-		if bytes.Equal(trimed, in) {
-			return str, nil, nil
-		}
-	}
-
-	i = bytes.IndexByte(repl, '%')
-	if i < 0 {
-		return repl, nil, nil
-	}
-
-	return repl[:i], trimed, repl[i+1:]
-}
-
-func substRef(pat, repl, str string) string {
-	if strings.IndexByte(pat, '%') >= 0 && strings.IndexByte(repl, '%') >= 0 {
-		return substPattern(pat, repl, str)
-	}
-	str = strings.TrimSuffix(str, pat)
-	return str + repl
+	return matcherCache.percentPattern(pat).subst(matcherCache.percentPattern(repl), str)
 }
 
 func stripExt(s string) string {
@@ -394,7 +370,7 @@ func concatline(line []byte) []byte {
 			continue
 		}
 		if i+1 == len(line) {
-			if line[i-1] != '\\' {
+			if i == 0 || line[i-1] != '\\' {
 				line = line[:i]
 			}
 			break
@@ -15,8 +15,10 @@
 package kati
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -45,6 +47,10 @@ func TestSplitSpaces(t *testing.T) {
 			in:   "foo bar  ",
 			want: []string{"foo", "bar"},
 		},
+		{
+			in:   "foo\nbar\r\n baz\tqux",
+			want: []string{"foo", "bar", "baz", "qux"},
+		},
 	} {
 		got := splitSpaces(tc.in)
 		if !reflect.DeepEqual(got, tc.want) {
@@ -78,6 +84,10 @@ func TestWordScanner(t *testing.T) {
 			in:   "foo bar  ",
 			want: []string{"foo", "bar"},
 		},
+		{
+			in:   "foo\nbar\r\n baz\tqux",
+			want: []string{"foo", "bar", "baz", "qux"},
+		},
 	} {
 		ws := newWordScanner([]byte(tc.in))
 		var got []string
@@ -251,3 +261,70 @@ func TestConcatline(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitSpacesBytes(t *testing.T) {
+	for _, in := range []string{"", " ", "foo", " foo  bar ", "foo\tbar\nbaz", "\r\n", "a b\tc"} {
+		var got []string
+		for _, w := range splitSpacesBytes([]byte(in)) {
+			got = append(got, string(w))
+		}
+		want := splitSpaces(in)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("splitSpacesBytes(%q)=%q; want %q", in, got, want)
+		}
+	}
+}
+
+// genWords generates a variable value of about n bytes, as a huge
+// list of files.
+func genWords(n int, sep string) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		fmt.Fprintf(&buf, "out/target/product/generic/obj/lib%d/foo%d.o", i%100, i)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkWordScanner(b *testing.B, sep string) {
+	in := genWords(4<<20, sep)
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ws := newWordScanner(in)
+		for ws.Scan() {
+		}
+	}
+}
+
+func BenchmarkWordScanner(b *testing.B)     { benchmarkWordScanner(b, " ") }
+func BenchmarkWordScannerTabs(b *testing.B) { benchmarkWordScanner(b, " \t") }
+
+func BenchmarkSplitSpaces(b *testing.B) {
+	in := string(genWords(4<<20, " "))
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		splitSpaces(in)
+	}
+}
+
+func BenchmarkVarsubst(b *testing.B) {
+	in := strings.Replace(string(genWords(4<<20, " ")), ".o", ".c", -1)
+	vars := make(Vars)
+	vars.Assign("SRCS", &simpleVar{value: []string{in}, origin: "file"})
+	v := varsubst{varname: literal("SRCS"), pat: literal(".c"), subst: literal(".o")}
+	ev := NewEvaluator(vars)
+	var buf evalBuffer
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		v.Eval(&buf, ev)
+	}
+}
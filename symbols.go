@@ -0,0 +1,250 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SymbolIndex is the cross reference of variables and targets in
+// makefiles loaded while SymbolIndexFlag is set.
+type SymbolIndex struct {
+	Variables []VarSymbol    `json:"variables"`
+	Targets   []TargetSymbol `json:"targets"`
+}
+
+// VarSymbol is where a variable is assigned and expanded. Locations
+// are "filename:lineno" of statements, e.g. of the rule whose
+// prerequisites expand the variable.
+type VarSymbol struct {
+	Name    string         `json:"name"`
+	Assigns []SymbolAssign `json:"assigns,omitempty"`
+	Refs    []string       `json:"refs,omitempty"`
+}
+
+// SymbolAssign is an assignment of a variable.
+type SymbolAssign struct {
+	Location string `json:"location"`
+	Op       string `json:"op"`
+	// Target is the target or the pattern of a target specific
+	// variable.
+	Target string `json:"target,omitempty"`
+}
+
+// TargetSymbol is rules of a target or a pattern.
+type TargetSymbol struct {
+	Name  string   `json:"name"`
+	Rules []string `json:"rules"`
+}
+
+// symbolIndex records symbols in an evaluator. Methods do nothing on
+// nil, i.e. if SymbolIndexFlag is not set.
+type symbolIndex struct {
+	vars    map[string]*varSymbols
+	targets map[string]map[srcpos]bool
+}
+
+type varSymbols struct {
+	assigns map[symbolAssign]bool
+	refs    map[srcpos]bool
+}
+
+type symbolAssign struct {
+	srcpos
+	op     string
+	target string
+}
+
+func newSymbolIndex() *symbolIndex {
+	return &symbolIndex{
+		vars:    make(map[string]*varSymbols),
+		targets: make(map[string]map[srcpos]bool),
+	}
+}
+
+func (s *symbolIndex) varSymbols(name string) *varSymbols {
+	v, ok := s.vars[name]
+	if !ok {
+		v = &varSymbols{
+			assigns: make(map[symbolAssign]bool),
+			refs:    make(map[srcpos]bool),
+		}
+		s.vars[name] = v
+	}
+	return v
+}
+
+// inMakefiles reports whether pos is in makefiles, not in the
+// bootstrap makefile nor unknown.
+func (pos srcpos) inMakefiles() bool {
+	return pos.filename != "" && pos.filename != bootstrapMakefileName
+}
+
+// assign records an assignment of the variable name at pos. target is
+// not empty for a target specific variable.
+func (s *symbolIndex) assign(name, op, target string, pos srcpos) {
+	if s == nil || !pos.inMakefiles() {
+		return
+	}
+	s.varSymbols(name).assigns[symbolAssign{srcpos: pos, op: op, target: target}] = true
+}
+
+// ref records an expansion of the variable name at pos.
+func (s *symbolIndex) ref(name string, pos srcpos) {
+	if s == nil || !pos.inMakefiles() {
+		return
+	}
+	s.varSymbols(name).refs[pos] = true
+}
+
+// addRules records rules by their outputs.
+func (s *symbolIndex) addRules(rules []*rule) {
+	if s == nil {
+		return
+	}
+	add := func(target string, pos srcpos) {
+		if !pos.inMakefiles() {
+			return
+		}
+		t, ok := s.targets[target]
+		if !ok {
+			t = make(map[srcpos]bool)
+			s.targets[target] = t
+		}
+		t[pos] = true
+	}
+	for _, r := range rules {
+		for _, o := range r.outputs {
+			add(o, r.srcpos)
+		}
+		for _, p := range r.outputPatterns {
+			add(p.String(), r.srcpos)
+		}
+	}
+}
+
+// merge merges symbols recorded in o into s.
+func (s *symbolIndex) merge(o *symbolIndex) {
+	if s == nil || o == nil {
+		return
+	}
+	for name, ov := range o.vars {
+		v := s.varSymbols(name)
+		for a := range ov.assigns {
+			v.assigns[a] = true
+		}
+		for pos := range ov.refs {
+			v.refs[pos] = true
+		}
+	}
+	for target, ot := range o.targets {
+		t, ok := s.targets[target]
+		if !ok {
+			t = make(map[srcpos]bool)
+			s.targets[target] = t
+		}
+		for pos := range ot {
+			t[pos] = true
+		}
+	}
+}
+
+func lessSrcpos(a, b srcpos) bool {
+	if a.filename != b.filename {
+		return a.filename < b.filename
+	}
+	return a.lineno < b.lineno
+}
+
+func sortedLocations(m map[srcpos]bool) []string {
+	var poss []srcpos
+	for pos := range m {
+		poss = append(poss, pos)
+	}
+	sort.Slice(poss, func(i, j int) bool { return lessSrcpos(poss[i], poss[j]) })
+	var r []string
+	for _, pos := range poss {
+		r = append(r, pos.String())
+	}
+	return r
+}
+
+// Symbols returns the cross reference of variables and targets, or nil
+// if SymbolIndexFlag was not set when g was loaded.
+func (g *DepGraph) Symbols() *SymbolIndex {
+	s := g.symbols
+	if s == nil {
+		return nil
+	}
+	si := &SymbolIndex{
+		Variables: []VarSymbol{},
+		Targets:   []TargetSymbol{},
+	}
+	for name, v := range s.vars {
+		vs := VarSymbol{
+			Name: name,
+			Refs: sortedLocations(v.refs),
+		}
+		var assigns []symbolAssign
+		for a := range v.assigns {
+			assigns = append(assigns, a)
+		}
+		sort.Slice(assigns, func(i, j int) bool {
+			if assigns[i].srcpos != assigns[j].srcpos {
+				return lessSrcpos(assigns[i].srcpos, assigns[j].srcpos)
+			}
+			if assigns[i].target != assigns[j].target {
+				return assigns[i].target < assigns[j].target
+			}
+			return assigns[i].op < assigns[j].op
+		})
+		for _, a := range assigns {
+			vs.Assigns = append(vs.Assigns, SymbolAssign{
+				Location: a.srcpos.String(),
+				Op:       a.op,
+				Target:   a.target,
+			})
+		}
+		si.Variables = append(si.Variables, vs)
+	}
+	sort.Slice(si.Variables, func(i, j int) bool { return si.Variables[i].Name < si.Variables[j].Name })
+	for target, t := range s.targets {
+		si.Targets = append(si.Targets, TargetSymbol{
+			Name:  target,
+			Rules: sortedLocations(t),
+		})
+	}
+	sort.Slice(si.Targets, func(i, j int) bool { return si.Targets[i].Name < si.Targets[j].Name })
+	return si
+}
+
+// WriteSymbolsJSON writes the cross reference of variables and targets
+// in JSON.
+func (g *DepGraph) WriteSymbolsJSON(w io.Writer) error {
+	si := g.Symbols()
+	if si == nil {
+		return errors.New("no symbol index: SymbolIndexFlag was not set")
+	}
+	b, err := json.MarshalIndent(si, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSymbols(t *testing.T) {
+	mk := writeTestMakefile(t, `A := a
+A += $(B)
+B = b
+$(eval C := c)
+all: $(A)
+all: X := $(value C)
+%.o: %.c
+	echo $(D)
+F = $(1)
+G := $(call F,g)
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	SymbolIndexFlag = true
+	g, err := Load(LoadReq{Makefile: mk, Targets: []string{"all"}})
+	SymbolIndexFlag = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := g.Symbols()
+	for i := range si.Variables {
+		v := &si.Variables[i]
+		for j := range v.Assigns {
+			v.Assigns[j].Location = strings.TrimPrefix(v.Assigns[j].Location, mk)
+		}
+		for j := range v.Refs {
+			v.Refs[j] = strings.TrimPrefix(v.Refs[j], mk)
+		}
+	}
+	for i := range si.Targets {
+		for j := range si.Targets[i].Rules {
+			si.Targets[i].Rules[j] = strings.TrimPrefix(si.Targets[i].Rules[j], mk)
+		}
+	}
+	want := &SymbolIndex{
+		Variables: []VarSymbol{
+			{
+				Name: "A",
+				Assigns: []SymbolAssign{
+					{Location: ":1", Op: ":="},
+					{Location: ":2", Op: "+="},
+				},
+				Refs: []string{":5"},
+			},
+			{
+				Name:    "B",
+				Assigns: []SymbolAssign{{Location: ":3", Op: "="}},
+				// A is a simple variable.
+				Refs: []string{":2"},
+			},
+			{
+				Name:    "C",
+				Assigns: []SymbolAssign{{Location: ":4", Op: ":="}},
+				Refs:    []string{":6"},
+			},
+			{
+				Name:    "F",
+				Assigns: []SymbolAssign{{Location: ":9", Op: "="}},
+				Refs:    []string{":10"},
+			},
+			{
+				Name:    "G",
+				Assigns: []SymbolAssign{{Location: ":10", Op: ":="}},
+			},
+			{
+				Name:    "X",
+				Assigns: []SymbolAssign{{Location: ":6", Op: ":=", Target: "all"}},
+			},
+		},
+		Targets: []TargetSymbol{
+			{Name: "%.o", Rules: []string{":7"}},
+			{Name: "all", Rules: []string{":5"}},
+		},
+	}
+	if !reflect.DeepEqual(si, want) {
+		t.Errorf("Symbols()=\n%+v\nwant\n%+v", si, want)
+	}
+}
@@ -14,29 +14,141 @@
 
 package kati
 
-import "sync"
+import (
+	"sync"
+	"unsafe"
+)
+
+// symtab interns strings, so target names, file paths, variable names,
+// commands and short literals repeated across hundreds of thousands of
+// rules share storage. It is sharded to reduce lock contention when
+// several evaluations run concurrently.
+const symtabShards = 64
+
+// symArenaChunk is the size of memory symArena allocates at once.
+// Strings longer than symArenaChunk/16 are allocated in the Go heap.
+const symArenaChunk = 1 << 20
+
+// internLiteralMax is the max length of literals in makefiles to be
+// interned. Longer literals are rarely repeated.
+const internLiteralMax = 64
+
+type symtabShard struct {
+	mu    sync.Mutex
+	m     map[string]string
+	arena symArena
+}
+
+// symArena allocates interned strings in chunks, which are mapped
+// outside of the Go heap where possible. Interned strings live as long
+// as the process, so the GC doesn't need to scan or free them one by
+// one, and a large graph costs far fewer heap objects.
+type symArena struct {
+	buf []byte
+}
+
+// str copies s into the arena.
+func (a *symArena) str(s []byte) string {
+	if len(s) == 0 {
+		return ""
+	}
+	var b []byte
+	if len(s) > symArenaChunk/16 {
+		b = make([]byte, len(s))
+	} else {
+		if len(a.buf) < len(s) {
+			a.buf = allocSymArenaChunk(symArenaChunk)
+		}
+		b = a.buf[:len(s):len(s)]
+		a.buf = a.buf[len(s):]
+	}
+	copy(b, s)
+	return unsafe.String(&b[0], len(b))
+}
 
 type symtabT struct {
-	mu sync.Mutex
-	m  map[string]string
+	// disabled is used to measure the effect of interning.
+	disabled bool
+	shards   [symtabShards]symtabShard
+}
+
+var symtab = newSymtab()
+
+func newSymtab() *symtabT {
+	st := &symtabT{}
+	for i := range st.shards {
+		st.shards[i].m = make(map[string]string)
+	}
+	return st
+}
+
+func (st *symtabT) shard(s []byte) *symtabShard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, c := range s {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return &st.shards[h%symtabShards]
+}
+
+func (st *symtabT) shardString(s string) *symtabShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return &st.shards[h%symtabShards]
 }
 
-var symtab = &symtabT{
-	m: make(map[string]string),
+func (st *symtabT) size() int {
+	n := 0
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.mu.Lock()
+		n += len(sh.m)
+		sh.mu.Unlock()
+	}
+	return n
 }
 
 func intern(s string) string {
-	symtab.mu.Lock()
-	v, ok := symtab.m[s]
-	if ok {
-		symtab.mu.Unlock()
-		return v
+	if symtab.disabled {
+		return s
+	}
+	sh := symtab.shardString(s)
+	sh.mu.Lock()
+	v, ok := sh.m[s]
+	if !ok {
+		v = sh.arena.str(unsafe.Slice(unsafe.StringData(s), len(s)))
+		sh.m[v] = v
 	}
-	symtab.m[s] = s
-	symtab.mu.Unlock()
-	return s
+	sh.mu.Unlock()
+	return v
 }
 
+// internBytes is like intern, but it doesn't allocate if s is already
+// interned.
 func internBytes(s []byte) string {
-	return intern(string(s))
+	if symtab.disabled {
+		return string(s)
+	}
+	sh := symtab.shard(s)
+	sh.mu.Lock()
+	v, ok := sh.m[string(s)]
+	if !ok {
+		v = sh.arena.str(s)
+		sh.m[v] = v
+	}
+	sh.mu.Unlock()
+	return v
+}
+
+// internStrs interns all strings in ss in place, e.g. the string table
+// of a loaded graph.
+func internStrs(ss []string) []string {
+	for i, s := range ss {
+		ss[i] = intern(s)
+	}
+	return ss
 }
@@ -0,0 +1,173 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestIntern(t *testing.T) {
+	a := intern(string([]byte("out/target/foo.o")))
+	b := internBytes([]byte("out/target/foo.o"))
+	if a != b {
+		t.Fatalf("intern=%q internBytes=%q", a, b)
+	}
+	if unsafe.StringData(a) != unsafe.StringData(b) {
+		t.Errorf("intern and internBytes returned different storage for %q", a)
+	}
+}
+
+func TestInternBytesNoAlloc(t *testing.T) {
+	s := []byte("out/target/bar.o")
+	internBytes(s)
+	allocs := testing.AllocsPerRun(100, func() {
+		internBytes(s)
+	})
+	if allocs != 0 {
+		t.Errorf("internBytes(interned) allocs=%v; want 0", allocs)
+	}
+}
+
+func TestInternArena(t *testing.T) {
+	saved := symtab
+	defer func() { symtab = saved }()
+	symtab = newSymtab()
+
+	long := strings.Repeat("x", symArenaChunk/16+1)
+	var want []string
+	// fill several chunks of some shards.
+	for i := 0; i < symArenaChunk/8; i++ {
+		want = append(want, fmt.Sprintf("out/target/product/generic/obj/%d.o", i))
+	}
+	want = append(want, "", long)
+	var got []string
+	for _, s := range want {
+		got = append(got, internBytes([]byte(s)))
+	}
+	runtime.GC()
+	for i, s := range want {
+		if got[i] != s {
+			t.Fatalf("internBytes(%q)=%q", s, got[i])
+		}
+		if s != "" && unsafe.StringData(intern(s)) != unsafe.StringData(got[i]) {
+			t.Errorf("intern(%q) returned different storage", s)
+		}
+	}
+}
+
+func TestInternLoadedGraph(t *testing.T) {
+	mk := writeTestMakefile(t, `
+all: a.o b.o
+a.o b.o:
+	cc -c -o $@
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+	g, err := Load(LoadReq{Makefile: mk, Targets: []string{"all"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ls := range []LoadSaver{GOB, JSON, PROTO} {
+		fn := filepath.Join(filepath.Dir(mk), "graph")
+		err = ls.Save(g, fn, []string{"all"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lg, err := ls.Load(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deps := lg.Nodes()[0].Deps
+		if len(deps) != 2 || len(deps[0].Cmds) != 1 || len(deps[1].Cmds) != 1 {
+			t.Fatalf("%T: deps=%v", ls, deps)
+		}
+		for _, s := range []string{deps[0].Output, deps[0].Cmds[0], deps[0].Filename} {
+			if unsafe.StringData(s) != unsafe.StringData(intern(s)) {
+				t.Errorf("%T: %q is not interned", ls, s)
+			}
+		}
+		if unsafe.StringData(deps[0].Cmds[0]) != unsafe.StringData(deps[1].Cmds[0]) {
+			t.Errorf("%T: commands of a.o and b.o don't share storage", ls)
+		}
+	}
+}
+
+// genInternTestMakefile generates a makefile which has many rules
+// sharing directory names, file names and flags, as seen in large
+// trees.
+func genInternTestMakefile(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("CFLAGS := -O2 -Wall -Werror\n")
+	buf.WriteString("HEADERS := $(foreach h,a b c d e f g h i j k l m n o p,frameworks/native/include/common/$(h).h)\n")
+	buf.WriteString("all:\n")
+	for i := 0; i < n; i++ {
+		dir := fmt.Sprintf("module%d", i/50)
+		fmt.Fprintf(&buf, "OBJS_%d := $(addprefix out/%s/,foo%d.o bar%d.o baz%d.o)\n", i, dir, i, i, i)
+		fmt.Fprintf(&buf, "all: $(OBJS_%d)\n", i)
+		fmt.Fprintf(&buf, "$(OBJS_%d): out/%s/%%.o: %s/%%.c $(HEADERS)\n", i, dir, dir)
+		buf.WriteString("\tcc $(CFLAGS) -c $< -o $@\n")
+	}
+	return buf.Bytes()
+}
+
+// heapInuse returns the bytes of live heap objects after GC.
+func heapInuse() uint64 {
+	runtime.GC()
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// benchmarkLoadHeap measures the heap retained by a loaded DepGraph,
+// with or without interning. Compare heap-MB of
+//
+//	go test -run=NONE -bench=LoadHeap
+func benchmarkLoadHeap(b *testing.B, disabled bool) {
+	dir := b.TempDir()
+	mk := filepath.Join(dir, "Makefile")
+	err := os.WriteFile(mk, genInternTestMakefile(2000), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	saved := symtab
+	defer func() { symtab = saved }()
+
+	var total uint64
+	for i := 0; i < b.N; i++ {
+		symtab = newSymtab()
+		symtab.disabled = disabled
+		before := heapInuse()
+		g, err := Load(LoadReq{Makefile: mk})
+		if err != nil {
+			b.Fatal(err)
+		}
+		after := heapInuse()
+		runtime.KeepAlive(g)
+		if after > before {
+			total += after - before
+		}
+	}
+	b.ReportMetric(float64(total)/float64(b.N)/(1<<20), "heap-MB")
+}
+
+func BenchmarkLoadHeapInterned(b *testing.B) { benchmarkLoadHeap(b, false) }
+func BenchmarkLoadHeapNoIntern(b *testing.B) { benchmarkLoadHeap(b, true) }
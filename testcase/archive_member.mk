@@ -0,0 +1,26 @@
+# Archive member targets. U keeps dates of members, which ar may not
+# record by default.
+ARFLAGS := crU
+
+test1:
+	echo a > a.o
+	echo b > b.o
+	echo c > c.o
+
+# a.o and b.o are added by the builtin rule "(%): %".
+test2: lib.a
+	ar t lib.a
+
+lib.a: lib.a(a.o b.o) lib.a( c.o )
+	@echo lib: $@ "[$%]" $^ $+ "$<"
+
+lib.a(c.o): c.o
+	@echo explicit $@ $% $< $* "[$(%D)]" "[$(%F)]" "[$(@D)]"
+	$(AR) $(ARFLAGS) $@ $<
+
+# Only b.o is newer than its member.
+test3:
+	sleep 1
+	touch b.o
+
+test4: lib.a
@@ -0,0 +1,12 @@
+# Preparation: create foo.c bar.c baz.x
+test1:
+	touch foo.c bar.c baz.x
+
+# foo.o and bar are made by the builtin rules.
+test2: foo.o bar baz.y
+
+CC := echo cc
+
+.SUFFIXES: .x .y
+.x.y:
+	echo PASS $@ $<
@@ -0,0 +1,11 @@
+define X
+foo
+
+define CMDS
+@echo cmds $$$$@ | sed 's/[0-9]//g'
+@echo $$(X)
+endef
+
+test2:
+	$(value CMDS)
+	$(CMDS)
@@ -0,0 +1,12 @@
+A := $(sort $(filter FOO BAR,$(.VARIABLES)))
+FOO := 1
+B := $(sort $(filter FOO BAR,$(.VARIABLES)))
+BAR = 2
+C := $(sort $(filter FOO BAR,$(.VARIABLES)))
+
+test:
+	echo $(A)
+	echo $(B)
+	echo $(C)
+	echo $(origin .VARIABLES) $(flavor .VARIABLES)
+	echo $(sort $(filter MAKE_VERSION .FEATURES,$(.VARIABLES)))
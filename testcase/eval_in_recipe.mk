@@ -0,0 +1,15 @@
+V := global
+W := global
+
+test: first second
+
+first: V := tsv
+first: W := tsv
+first:
+	$(eval V := recipe)echo V=$(V)
+	$(eval W += more)echo W=$(W)
+	$(eval override O := override)echo O=$(O)
+	$(eval X := x)echo X=$(X)
+
+second: first
+	echo second V=$(V) W=$(W) O=$(O) X=$(X)
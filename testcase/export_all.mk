@@ -0,0 +1,13 @@
+# .EXPORT_ALL_VARIABLES exports all variables except unexported ones.
+
+.EXPORT_ALL_VARIABLES:
+
+A := a
+B = $(A)_b
+C := c
+unexport C
+D.E := not_exportable
+
+test:
+	echo A=$$A B=$$B C=$$C
+	env | grep '^D.E=' || echo no D.E
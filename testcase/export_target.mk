@@ -0,0 +1,21 @@
+# Target-specific exported variables reach recipes, and are inherited
+# by prerequisites.
+
+A := global_a
+B := global_b
+
+test: export A := target_a
+test: B := not_exported
+test: export C = $(A)_c
+test: foo
+	echo A=$$A B=$$B C=$$C
+	echo HOME=$${HOME:-unexported}
+
+foo:
+	echo foo A=$$A C=$$C
+
+test2: export PATH := $(PATH)
+test2:
+	echo test2 $${PATH:+path}
+
+unexport HOME
@@ -0,0 +1,22 @@
+.EXTRA_PREREQS := gen.h
+
+test: a.o b.o c.o
+	echo $@: $^ / $+ / $<
+
+a.o: a.c
+	echo $@: $^ / $<
+
+b.o: .EXTRA_PREREQS += tool
+b.o: b.c
+	echo $@: $^
+
+c.o: .EXTRA_PREREQS := tool $(X)
+c.o: X := ignored
+c.o:
+	echo $@: $^
+
+gen.h tool:
+	echo make $@
+
+a.c b.c:
+	echo make $@
@@ -0,0 +1,18 @@
+define newline
+
+
+endef
+
+$(file >out.txt,hello)
+$(file >>out.txt,world$(newline))
+$(file >>out.txt,a,b)
+$(file >empty.txt,)
+$(file >truncated.txt)
+$(info [$(file <out.txt)])
+$(info [$(file <empty.txt)] [$(file < truncated.txt)] [$(file <nonexistent.txt)])
+
+test: foo
+	$(file >$@.rsp,$@ $^)cat $@.rsp
+
+foo:
+	echo foo
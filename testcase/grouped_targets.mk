@@ -0,0 +1,20 @@
+# The recipe of grouped targets runs once to make all of them.
+test1: b c
+	@echo all
+
+a b &: in
+	@echo run $@ "[$^]"
+	touch a b
+
+c d &:: in
+	@echo dc $@
+	touch c d
+
+in:
+	touch $@
+
+test2:
+	rm a
+
+# Only a is out of date.
+test3: a b d
@@ -0,0 +1,21 @@
+# Missing included makefiles are made by rules, and makefiles are read
+# again.
+
+include gen.mk
+-include opt.mk
+-include nope.mk
+
+test: foo
+	@echo FOO=$(FOO) OPT=$(OPT) RESTARTS=$(MAKE_RESTARTS)
+
+gen.mk: dep.txt
+	echo 'FOO := $$(shell cat dep.txt)' > $@
+
+opt.mk:
+	echo 'OPT := opt' > $@
+
+dep.txt:
+	echo foo > $@
+
+foo:
+	@echo built $@
@@ -0,0 +1,8 @@
+# MAKEFLAGS and MFLAGS are defined in makefiles, and passed to
+# commands.
+
+$(info MAKEFLAGS=[$(MAKEFLAGS)] $(origin MAKEFLAGS) $(flavor MAKEFLAGS))
+$(info MFLAGS=[$(MFLAGS)] MAKEOVERRIDES=[$(MAKEOVERRIDES)])
+
+test:
+	echo "MAKEFLAGS=[$$MAKEFLAGS] MFLAGS=[$$MFLAGS]"
@@ -0,0 +1,33 @@
+.ONESHELL:
+
+test: a b c d e
+
+a:
+	@echo a1
+	  -echo a2 \
+	  cont
+	@echo a3
+	cd /
+	pwd
+
+b:
+	x=1
+	echo b $$x
+	-false
+	echo after
+
+c:
+	-false
+	echo c
+
+d:
+	@if true; then
+	@  echo "in if"
+	fi
+	# comment
+	echo 'd' "$(MAKE_VERSION_X)"
+
+e: E := $$HOME
+e:
+	@test -n "$(E)"
+	echo $@
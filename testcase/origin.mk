@@ -14,6 +14,7 @@ test:
 	echo $(origin MAKEFILE_LIST)
 	echo $(origin CC)
 	echo $(origin $(FOOREF))
+	echo $(origin CURDIR) $(origin SHELL) $(origin MAKECMDGOALS) $(origin @)
 
 # TODO: support environment override, command line, and override.
 # TODO: Also add more tests especially for += and ?=
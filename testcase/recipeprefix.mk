@@ -0,0 +1,32 @@
+# .RECIPEPREFIX changes the first character of recipe lines for later
+# lines, and for included makefiles.
+
+$(shell printf 'sub1:\n>echo sub1\n.RECIPEPREFIX = +\nsub2:\n+echo sub2\n' > sub.mk)
+
+.RECIPEPREFIX = >
+test: a b c sub1 sub2 after
+>@echo test
+
+a:
+>echo a
+>  echo a2
+
+define d
+echo in define
+endef
+
+X := +
+.RECIPEPREFIX := $(X)
+b:
++echo b
++$(d)
+
+.RECIPEPREFIX =
+c:
+	echo c
+
+.RECIPEPREFIX := >
+include sub.mk
+
+after:
++echo after
@@ -0,0 +1,20 @@
+# SHELL and .SHELLFLAGS may be target specific, and are inherited by
+# prerequisites.
+
+test: echo flags parent
+	echo default shell
+
+echo: SHELL := /bin/echo
+echo:
+	hello from echo
+
+flags: .SHELLFLAGS := -ec
+flags:
+	echo $$-
+
+parent: SHELL := /bin/echo
+parent: child
+	parent
+
+child:
+	child
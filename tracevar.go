@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Tracing of variables in TraceVars, e.g.
+//
+//	Makefile:3: CFLAGS := -O2 => simple "-O2" (file)
+//	Makefile:4: CFLAGS += $(OPT) => simple "-O2 -g" (file)
+//	Makefile:5: CFLAGS = -O0 ignored: overridden by command line "-O3"
+//	Makefile:7: all: CFLAGS += -Wall => recursive "-Wall" (file)
+//	Makefile:9: CFLAGS expanded: "-O2 -g"
+//
+// An assignment shows its unexpanded right hand side, then the flavor,
+// the value and the origin of the variable after it. A target specific
+// variable is prefixed by its target. Expansions include $(value) and
+// $(call) of the variable.
+
+var (
+	traceVarMu sync.Mutex
+	// traceVarOutput is where traces are written.
+	traceVarOutput io.Writer = os.Stderr
+)
+
+// traceVar writes the trace of the variable name at ev.srcpos, if it
+// is in TraceVars. Traces are written in evaluation order, so an
+// isolated evaluator leaves the makefile to the parent.
+func (ev *Evaluator) traceVar(name string, format string, args ...interface{}) error {
+	if !TraceVars[name] {
+		return nil
+	}
+	if err := ev.checkIsolated("trace of %s", name); err != nil {
+		return err
+	}
+	traceVarMu.Lock()
+	defer traceVarMu.Unlock()
+	fmt.Fprintf(traceVarOutput, "%s: %s\n", ev.srcpos, fmt.Sprintf(format, args...))
+	return nil
+}
+
+// traceAssign traces the assignment "name op rhs" which results in v.
+// target is not empty for a target specific variable. directive is
+// "override" or "export", if any.
+func (ev *Evaluator) traceAssign(target, name, directive, op string, rhs Value, v Var) error {
+	if !TraceVars[name] {
+		return nil
+	}
+	var prefix string
+	if target != "" {
+		prefix = target + ": "
+	}
+	if directive != "" {
+		prefix += directive + " "
+	}
+	return ev.traceVar(name, "%s%s %s %s => %s %q (%s)", prefix, name, op, rhs, v.Flavor(), v.String(), v.Origin())
+}
+
+// traceExpand expands the variable v named name into w as evalVar,
+// and traces its value.
+func (ev *Evaluator) traceExpand(w evalWriter, name string, v Var) error {
+	var rec expandRecorder
+	err := ev.expandVar(&rec, name, v)
+	if err != nil {
+		return err
+	}
+	rec.replay(w)
+	var buf evalBuffer
+	buf.resetSep()
+	rec.replay(&buf)
+	return ev.traceVar(name, "%s expanded: %q", name, buf.String())
+}
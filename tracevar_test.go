@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTraceVars(t *testing.T) {
+	mk := writeTestMakefile(t, `A := a
+B = b
+A += $(B)
+override C = c
+$(eval A += x)
+all: A += t
+all: $(A)
+X := $(value A) $(C)
+D = d
+`)
+	defer os.RemoveAll(filepath.Dir(mk))
+
+	var buf bytes.Buffer
+	traceVarOutput = &buf
+	TraceVars = map[string]bool{"A": true, "D": true}
+	_, err := Load(LoadReq{
+		Makefile:        mk,
+		Targets:         []string{"all"},
+		CommandLineVars: []string{"D=cmd"},
+	})
+	traceVarOutput = os.Stderr
+	TraceVars = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(strings.ReplaceAll(buf.String(), mk, ""), "\n"), "\n")
+	want := []string{
+		`:1: A := a => simple "a" (file)`,
+		`:3: A += $(B) => simple "a b" (file)`,
+		`:5: A += x => simple "a b x" (file)`,
+		`:6: all: A += t => recursive "t" (file)`,
+		`:7: A expanded: "a b x"`,
+		`:8: $(value A): "a b x"`,
+		`:9: D = d ignored: overridden by command line "cmd"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("traces=\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
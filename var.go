@@ -18,7 +18,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // Var is an interface of make variable.
@@ -34,6 +36,9 @@ type Var interface {
 type targetSpecificVar struct {
 	v  Var
 	op string
+	// export is true if it is defined with "export", e.g.
+	// "foo: export V := v".
+	export bool
 }
 
 func (v *targetSpecificVar) Append(ev *Evaluator, s string) (Var, error) {
@@ -42,8 +47,9 @@ func (v *targetSpecificVar) Append(ev *Evaluator, s string) (Var, error) {
 		return nil, err
 	}
 	return &targetSpecificVar{
-		v:  nv,
-		op: v.op,
+		v:      nv,
+		op:     v.op,
+		export: v.export,
 	}, nil
 }
 func (v *targetSpecificVar) AppendVar(ev *Evaluator, v2 Value) (Var, error) {
@@ -52,8 +58,9 @@ func (v *targetSpecificVar) AppendVar(ev *Evaluator, v2 Value) (Var, error) {
 		return nil, err
 	}
 	return &targetSpecificVar{
-		v:  nv,
-		op: v.op,
+		v:      nv,
+		op:     v.op,
+		export: v.export,
 	}, nil
 }
 func (v *targetSpecificVar) Flavor() string {
@@ -76,10 +83,14 @@ func (v *targetSpecificVar) Eval(w evalWriter, ev *Evaluator) error {
 }
 
 func (v *targetSpecificVar) serialize() serializableVar {
-	return serializableVar{
+	sv := serializableVar{
 		Type:     v.op,
 		Children: []serializableVar{v.v.serialize()},
 	}
+	if v.export {
+		sv.V = "export"
+	}
+	return sv
 }
 
 func (v *targetSpecificVar) dump(d *dumpbuf) {
@@ -88,11 +99,44 @@ func (v *targetSpecificVar) dump(d *dumpbuf) {
 	v.v.dump(d)
 }
 
+// copyVar returns a copy of v, which can be appended without
+// modifying v.
+func copyVar(v Var) Var {
+	switch v := v.(type) {
+	case *simpleVar:
+		nv := *v
+		nv.value = append([]string(nil), v.value...)
+		return &nv
+	case *recursiveVar:
+		nv := *v
+		return &nv
+	case *targetSpecificVar:
+		return &targetSpecificVar{v: copyVar(v.v), op: v.op, export: v.export}
+	}
+	return v
+}
+
+// withOrigin returns a copy of v whose origin is origin. v must be a
+// simple or recursive variable.
+func withOrigin(v Var, origin string) Var {
+	switch v := copyVar(v).(type) {
+	case *simpleVar:
+		v.origin = origin
+		return v
+	case *recursiveVar:
+		v.origin = origin
+		return v
+	}
+	return v
+}
+
 type simpleVar struct {
 	// space separated. note that each string may contain spaces, so
 	// it is not word list.
 	value  []string
 	origin string
+	// version is incremented when value is modified in place.
+	version int
 }
 
 func (v *simpleVar) Flavor() string  { return "simple" }
@@ -138,6 +182,7 @@ func (v *simpleVar) Append(ev *Evaluator, s string) (Var, error) {
 		return nil, err
 	}
 	v.value = append(v.value, abuf.String())
+	v.version++
 	abuf.release()
 	return v, nil
 }
@@ -149,6 +194,7 @@ func (v *simpleVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
 		return nil, err
 	}
 	v.value = append(v.value, abuf.String())
+	v.version++
 	abuf.release()
 	return v, nil
 }
@@ -206,22 +252,32 @@ func (v *automaticVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
 }
 
 type recursiveVar struct {
-	expr   Value
+	expr Value
+	// src is the value as written, if expr.String() doesn't
+	// reproduce it, e.g. "$$". It is the result of $(value).
+	src    string
 	origin string
+	// version is incremented when expr is modified in place.
+	version int
 }
 
 func (v *recursiveVar) Flavor() string  { return "recursive" }
 func (v *recursiveVar) Origin() string  { return v.origin }
 func (v *recursiveVar) IsDefined() bool { return true }
 
-func (v *recursiveVar) String() string { return v.expr.String() }
+func (v *recursiveVar) String() string {
+	if v.src != "" {
+		return v.src
+	}
+	return v.expr.String()
+}
 func (v *recursiveVar) Eval(w evalWriter, ev *Evaluator) error {
-	v.expr.Eval(w, ev)
-	return nil
+	return v.expr.Eval(w, ev)
 }
 func (v *recursiveVar) serialize() serializableVar {
 	return serializableVar{
 		Type:     "recursive",
+		V:        v.src,
 		Children: []serializableVar{v.expr.serialize()},
 		Origin:   v.origin,
 	}
@@ -233,6 +289,9 @@ func (v *recursiveVar) dump(d *dumpbuf) {
 }
 
 func (v *recursiveVar) Append(_ *Evaluator, s string) (Var, error) {
+	if v.src != "" || strings.IndexByte(s, '$') >= 0 {
+		v.src = v.String() + " " + s
+	}
 	var exp expr
 	if e, ok := v.expr.(expr); ok {
 		exp = append(e, literal(" "))
@@ -249,12 +308,13 @@ func (v *recursiveVar) Append(_ *Evaluator, s string) (Var, error) {
 		exp = append(exp, sv)
 	}
 	v.expr = exp
+	v.version++
 	return v, nil
 }
 
 func (v *recursiveVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
 	var buf bytes.Buffer
-	buf.WriteString(v.expr.String())
+	buf.WriteString(v.String())
 	buf.WriteByte(' ')
 	buf.WriteString(val.String())
 	e, _, err := parseExpr(buf.Bytes(), nil, parseOp{alloc: true})
@@ -262,6 +322,10 @@ func (v *recursiveVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
 		return nil, err
 	}
 	v.expr = e
+	if v.src != "" {
+		v.src = buf.String()
+	}
+	v.version++
 	return v, nil
 }
 
@@ -292,14 +356,77 @@ func (undefinedVar) AppendVar(_ *Evaluator, val Value) (Var, error) {
 // Vars is a map for make variables.
 type Vars map[string]Var
 
-// usedEnvs tracks what environment variables are used.
-var usedEnvs = map[string]bool{}
+// usedEnvsT tracks what environment variables are used.
+// It may be updated by several evaluations running concurrently, so
+// variables are tracked by identity, not by name, to know which
+// evaluation used them.
+type usedEnvsT struct {
+	mu sync.Mutex
+	// m is true for tracked variables which are used.
+	m map[Var]bool
+}
+
+var usedEnvs = &usedEnvsT{m: make(map[Var]bool)}
+
+// track starts tracking environment variables in vars.
+func (u *usedEnvsT) track(vars Vars) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, v := range vars {
+		if strings.HasPrefix(v.Origin(), "environment") {
+			u.m[v] = false
+		}
+	}
+}
+
+func (u *usedEnvsT) add(v Var) {
+	u.mu.Lock()
+	if _, ok := u.m[v]; ok {
+		u.m[v] = true
+	}
+	u.mu.Unlock()
+}
+
+// used returns sorted names of used variables in vars tracked by
+// track.
+func (u *usedEnvsT) used(vars Vars) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var names []string
+	for name, v := range vars {
+		if u.m[v] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// take returns sorted names of used variables in vars tracked by
+// track, and stops tracking them.
+func (u *usedEnvsT) take(vars Vars) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var names []string
+	for name, v := range vars {
+		used, ok := u.m[v]
+		if !ok {
+			continue
+		}
+		if used {
+			names = append(names, name)
+		}
+		delete(u.m, v)
+	}
+	sort.Strings(names)
+	return names
+}
 
 // Lookup looks up named make variable.
 func (vt Vars) Lookup(name string) Var {
 	if v, ok := vt[name]; ok {
 		if strings.HasPrefix(v.Origin(), "environment") {
-			usedEnvs[name] = true
+			usedEnvs.add(v)
 		}
 		return v
 	}
@@ -307,17 +434,19 @@ func (vt Vars) Lookup(name string) Var {
 }
 
 // origin precedence
-//  override / environment override
+//  override
 //  command line
+//  environment override
 //  file
 //  environment
 //  default
-// TODO(ukai): is this correct order?
+// A variable is not modified by an assignment with lower precedence,
+// e.g. a command line variable is modified only by override.
 var originPrecedence = map[string]int{
-	"override":             4,
+	"override":             6,
+	"command line":         5,
 	"environment override": 4,
-	"command line":         3,
-	"file":                 2,
+	"file":                 3,
 	"environment":          2,
 	"default":              1,
 	"undefined":            0,
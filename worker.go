@@ -18,8 +18,11 @@ import (
 	"container/heap"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -28,8 +31,24 @@ import (
 
 var (
 	errNothingDone = errors.New("nothing done")
+
+	// ErrOutOfDate is returned by Executor.Exec with QuestionFlag if
+	// a target is not up to date.
+	ErrOutOfDate = errors.New("target is not up to date")
 )
 
+// BuildErrors is returned by Executor.Exec with KeepGoingFlag, with
+// errors of all failed targets.
+type BuildErrors []error
+
+func (e BuildErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
 type job struct {
 	n        *DepNode
 	ex       *Executor
@@ -38,10 +57,60 @@ type job struct {
 	numDeps  int
 	depsTs   int64
 	id       int
+	// failed is true if the job or its dependency failed with
+	// KeepGoingFlag.
+	failed bool
+	// orderOnlyOf is parents which need the job as an order-only
+	// prerequisite. Its timestamp doesn't make them out of date.
+	orderOnlyOf map[*job]bool
+	// finished is true if the job and its parents are updated.
+	finished bool
+	// doubleColon is the 1-based index of the double-colon rule of
+	// the output which the job runs, or 0. Jobs of the rules are
+	// prerequisites of the job of the output. see
+	// Executor.makeDoubleColonJobs
+	doubleColon int
+	// group is the group of jobs of the grouped rule of the output, or
+	// nil.
+	group *jobGroup
+	// skip is set if the job didn't make the missing intermediate
+	// file, which is made only when a parent is remade. skippedDeps
+	// are such jobs of prerequisites, and intermediates are files
+	// made by them for the job. see makeSkipped.
+	skip          *skippedJob
+	skippedDeps   []*job
+	intermediates []string
+	// forced is true if the job makes the skipped file for a parent.
+	forced bool
+
+	// neededBy is the job which made the job, at depth from a goal.
+	// doneDeps are jobs of prerequisites, for debug messages. see
+	// debug.go
+	neededBy   *job
+	depth      int
+	considered bool
+	doneDeps   map[*DepNode]*job
 
 	runners []runner
 }
 
+// skippedJob is the state of a skipped job, which is made at most once
+// for parents.
+type skippedJob struct {
+	once sync.Once
+	err  error
+}
+
+// jobGroup is jobs of outputs of a grouped rule, e.g. "a b &: c". The
+// jobs run one by one, and the commands run at most once for all of
+// them, as GNU make does.
+type jobGroup struct {
+	// last is the job added last.
+	last *job
+	// ran is true if a job of the group ran the commands.
+	ran bool
+}
+
 type jobResult struct {
 	j   *job
 	w   *worker
@@ -49,8 +118,9 @@ type jobResult struct {
 }
 
 type newDep struct {
-	j        *job
-	neededBy *job
+	j         *job
+	neededBy  *job
+	orderOnly bool
 }
 
 type worker struct {
@@ -115,13 +185,43 @@ func (w *worker) Wait() {
 	<-w.doneChan
 }
 
-func (j *job) createRunners() ([]runner, error) {
-	runners, _, err := createRunners(j.ex.ctx, j.n)
-	return runners, err
+func (j *job) addParent(p *job, orderOnly bool) {
+	j.parents = append(j.parents, p)
+	if orderOnly {
+		if j.orderOnlyOf == nil {
+			j.orderOnlyOf = make(map[*job]bool)
+		}
+		j.orderOnlyOf[p] = true
+	}
+}
+
+func (j *job) createRunners(nodes []*DepNode) ([]runner, error) {
+	var runners []runner
+	for _, n := range nodes {
+		rr, _, err := createRunners(j.ex.ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		runners = append(runners, rr...)
+	}
+	return runners, nil
+}
+
+// outOfDateNodes returns nodes whose commands run for the job, i.e.
+// the node of the job if it is out of date. A double-colon rule without
+// prerequisites is always out of date.
+func (j *job) outOfDateNodes() []*DepNode {
+	if j.outputTs >= j.depsTs && !(j.doubleColon > 0 && len(j.n.Deps) == 0) {
+		return nil
+	}
+	return []*DepNode{j.n}
 }
 
 // TODO(ukai): use time.Time?
 func getTimestamp(filename string) int64 {
+	if archive, member, ok := splitArchiveMember(filename); ok {
+		return archiveMemberTimestamp(archive, member)
+	}
 	st, err := os.Stat(filename)
 	if err != nil {
 		return -2
@@ -138,6 +238,10 @@ func (j *job) build() error {
 
 	if !j.n.HasRule {
 		if j.outputTs >= 0 || j.n.IsPhony {
+			if j.debugging() {
+				j.debugPrereqs()
+				j.debugf(DebugVerbose, 0, "No need to remake target '%s'.", j.n.Output)
+			}
 			return errNothingDone
 		}
 		if len(j.parents) == 0 {
@@ -146,32 +250,189 @@ func (j *job) build() error {
 		return fmt.Errorf("*** No rule to make target %q, needed by %q.", j.n.Output, j.parents[0].n.Output)
 	}
 
-	if j.outputTs >= j.depsTs {
+	if len(j.n.DoubleColons) > 0 {
+		// jobs of the double-colon rules ran the commands.
+		if j.outputTs < j.depsTs {
+			j.outputTs = j.depsTs
+		}
+		return errNothingDone
+	}
+	if j.group != nil && j.group.ran {
+		// the commands run for another output made the output.
+		j.outputTs = getTimestamp(j.n.Output)
+		if j.outputTs < 0 {
+			j.outputTs = time.Now().Unix()
+		}
+		return errNothingDone
+	}
+	if j.n.IsIntermediate && j.outputTs < 0 && j.neededBy != nil && !j.forced {
+		// GNU make doesn't make a missing intermediate file unless
+		// a parent is remade, for which it is as new as its newest
+		// prerequisite.
+		j.debugf(DebugVerbose, 0, "Intermediate target '%s' is not remade unless needed.", j.n.Output)
+		j.skip = &skippedJob{}
+		j.outputTs = j.depsTs
+		return errNothingDone
+	}
+	if j.debugging() {
+		j.debugPrereqs()
+	}
+	nodes := j.outOfDateNodes()
+	if len(nodes) == 0 {
 		// TODO: stats.
+		j.debugf(DebugVerbose, 0, "No need to remake target '%s'.", j.n.Output)
+		j.outputTs = j.ex.restat.timestamp(j.n.Output, j.outputTs)
+		return errNothingDone
+	}
+	if QuestionFlag {
+		for _, n := range nodes {
+			if len(n.Cmds) > 0 {
+				return ErrOutOfDate
+			}
+		}
 		return errNothingDone
 	}
 
-	rr, err := j.createRunners()
+	j.debugf(DebugBasic, 0, "Must remake target '%s'.", j.n.Output)
+	for _, n := range nodes {
+		j.trace(n)
+	}
+	rr, err := j.createRunners(nodes)
+	if err != nil {
+		return err
+	}
+	if TouchFlag {
+		return j.touch(rr)
+	}
+	err = j.makeSkipped()
 	if err != nil {
 		return err
 	}
+	tok, err := j.ex.jobserver.acquire()
+	if err != nil {
+		return err
+	}
+	defer j.ex.jobserver.release(tok)
+	var rs restatState
+	if !DryRunFlag && !j.n.IsPhony {
+		rs = j.ex.restat.before(j.n.Output, j.outputTs)
+	}
+	out := j.ex.ctx.outputSync.newJobOutput()
+	defer out.flush()
 	for _, r := range rr {
-		err := r.run(j.n.Output)
+		start := time.Now()
+		err := r.run(j.n.Output, out)
+		j.ex.buildLog.record(j.n.Output, start, exitStatus(err))
 		glog.Warningf("cmd error for %q: %v", j.n.Output, err)
 		if err != nil {
 			exit := exitStatus(err)
+			if j.n.DeleteOnError && !DryRunFlag {
+				j.deleteOutput(out)
+			}
+			if KeepGoingFlag {
+				j.debugf(DebugBasic, 0, "Failed to remake target file '%s'.", j.n.Output)
+			}
 			return fmt.Errorf("*** [%s] Error %d", j.n.Output, exit)
 		}
 	}
+	if j.group != nil {
+		j.group.ran = true
+	}
 
 	if j.n.IsPhony {
 		j.outputTs = time.Now().Unix()
+	} else if _, _, ok := splitArchiveMember(j.n.Output); ok {
+		// The archive modified by the commands may be newer than
+		// the member, but it is out of date as GNU make does.
+		j.outputTs = math.MaxInt64
 	} else {
 		j.outputTs = getTimestamp(j.n.Output)
 		if j.outputTs < 0 {
 			j.outputTs = time.Now().Unix()
+		} else if !DryRunFlag {
+			j.outputTs = j.ex.restat.after(j.n.Output, rs, j.outputTs)
 		}
 	}
+	j.debugf(DebugBasic, 0, "Successfully remade target file '%s'.", j.n.Output)
+	return nil
+}
+
+// makeSkipped makes missing intermediate files of prerequisites,
+// which were skipped, before the commands of j run. A skipped job is
+// made on a copy, as the worker manager may read the job meanwhile.
+func (j *job) makeSkipped() error {
+	for _, d := range j.skippedDeps {
+		d := d
+		d.skip.once.Do(func() {
+			fj := *d
+			fj.forced = true
+			d.skip.err = fj.build()
+			if d.skip.err == nil {
+				j.intermediates = append(j.intermediates, fj.intermediates...)
+				j.intermediates = append(j.intermediates, d.n.Output)
+			}
+		})
+		if d.skip.err != nil && d.skip.err != errNothingDone {
+			return d.skip.err
+		}
+	}
+	return nil
+}
+
+// deleteOutput deletes the output which the failed commands modified,
+// for .DELETE_ON_ERROR.
+func (j *job) deleteOutput(out *jobOutput) {
+	if getTimestamp(j.n.Output) == j.outputTs {
+		return
+	}
+	if archive, member, ok := splitArchiveMember(j.n.Output); ok {
+		fmt.Fprintf(out, "kati: *** [%s] Archive member `%s' may be bogus; not deleted\n", archive, member)
+		return
+	}
+	fmt.Fprintf(out, "kati: *** Deleting file `%s'\n", j.n.Output)
+	err := os.Remove(j.n.Output)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(out, "kati: %v\n", err)
+	}
+}
+
+// touch runs only forced commands in rr, and touches the output
+// instead of running the other commands.
+func (j *job) touch(rr []runner) error {
+	out := j.ex.ctx.outputSync.newJobOutput()
+	defer out.flush()
+	for _, r := range rr {
+		if !r.force {
+			continue
+		}
+		err := r.run(j.n.Output, out)
+		if err != nil {
+			return fmt.Errorf("*** [%s] Error %d", j.n.Output, exitStatus(err))
+		}
+	}
+	if j.n.IsPhony || len(j.n.Cmds) == 0 {
+		j.outputTs = time.Now().Unix()
+		return nil
+	}
+	fmt.Fprintf(out, "touch %s\n", j.n.Output)
+	now := time.Now()
+	var err error
+	if archive, member, ok := splitArchiveMember(j.n.Output); ok {
+		err = touchArchiveMember(archive, member, now)
+	} else {
+		err = os.Chtimes(j.n.Output, now, now)
+		if os.IsNotExist(err) {
+			var f *os.File
+			f, err = os.Create(j.n.Output)
+			if err == nil {
+				err = f.Close()
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("*** [%s] %v", j.n.Output, err)
+	}
+	j.outputTs = now.Unix()
 	return nil
 }
 
@@ -184,9 +445,18 @@ func (wm *workerManager) handleJobs() error {
 			return nil
 		}
 		j := heap.Pop(&wm.readyQueue).(*job)
+		j.numDeps = -1 // Do not let other workers pick this.
+		if j.failed {
+			glog.V(1).Infof("skip: %s", j.n.Output)
+			wm.finishCnt++
+			if len(j.parents) == 0 {
+				wm.errs = append(wm.errs, fmt.Errorf("*** Target %q not remade because of errors.", j.n.Output))
+			}
+			wm.updateParents(j)
+			continue
+		}
 		glog.V(1).Infof("run: %s", j.n.Output)
 
-		j.numDeps = -1 // Do not let other workers pick this.
 		w := wm.freeWorkers[0]
 		wm.freeWorkers = wm.freeWorkers[1:]
 		wm.busyWorkers[w] = true
@@ -195,14 +465,33 @@ func (wm *workerManager) handleJobs() error {
 }
 
 func (wm *workerManager) updateParents(j *job) {
+	j.finished = true
 	for _, p := range j.parents {
-		p.numDeps--
-		glog.V(1).Infof("child: %s (%d)", p.n.Output, p.numDeps)
+		wm.updateParent(j, p)
+	}
+}
+
+func (wm *workerManager) updateParent(j, p *job) {
+	p.numDeps--
+	if j.failed {
+		p.failed = true
+	}
+	glog.V(1).Infof("child: %s (%d)", p.n.Output, p.numDeps)
+	if j.skip != nil {
+		p.skippedDeps = append(p.skippedDeps, j)
+	}
+	if !j.orderOnlyOf[p] {
 		if p.depsTs < j.outputTs {
 			p.depsTs = j.outputTs
 		}
-		wm.maybePushToReadyQueue(p)
+		if p.debugging() {
+			if p.doneDeps == nil {
+				p.doneDeps = make(map[*DepNode]*job)
+			}
+			p.doneDeps[j.n] = j
+		}
 	}
+	wm.maybePushToReadyQueue(p)
 }
 
 type workerManager struct {
@@ -222,6 +511,11 @@ type workerManager struct {
 
 	finishCnt int
 	skipCnt   int
+	// errs are errors of failed jobs with KeepGoingFlag.
+	errs BuildErrors
+	// intermediates are intermediate files made by jobs, which are
+	// deleted after the build.
+	intermediates []string
 }
 
 func newWorkerManager(numJobs int) (*workerManager, error) {
@@ -257,6 +551,9 @@ func exitStatus(err error) int {
 			return w.ExitStatus()
 		}
 	}
+	if err, ok := err.(interface{ ExitStatus() int }); ok {
+		return err.ExitStatus()
+	}
 	return exit
 }
 
@@ -265,22 +562,23 @@ func (wm *workerManager) hasTodo() bool {
 }
 
 func (wm *workerManager) maybePushToReadyQueue(j *job) {
-	if j.numDeps != 0 {
+	// j is pushed when posted if it is not posted yet.
+	if j.numDeps != 0 || j.id == 0 {
 		return
 	}
 	heap.Push(&wm.readyQueue, j)
 	glog.V(1).Infof("ready: %s", j.n.Output)
 }
 
-func (wm *workerManager) handleNewDep(j *job, neededBy *job) {
-	if j.numDeps < 0 {
-		neededBy.numDeps--
-		if neededBy.id > 0 {
-			panic("FIXME: already in WM... can this happen?")
-		}
-	} else {
-		j.parents = append(j.parents, neededBy)
+func (wm *workerManager) handleNewDep(j *job, neededBy *job, orderOnly bool) {
+	j.addParent(neededBy, orderOnly)
+	if !j.finished {
+		return
+	}
+	if neededBy.id > 0 {
+		panic("FIXME: already in WM... can this happen?")
 	}
+	wm.updateParent(j, neededBy)
 }
 
 func (wm *workerManager) Run() {
@@ -298,20 +596,28 @@ Loop:
 			glog.V(1).Infof("done: %s", jr.j.n.Output)
 			delete(wm.busyWorkers, jr.w)
 			wm.freeWorkers = append(wm.freeWorkers, jr.w)
-			wm.updateParents(jr.j)
-			wm.finishCnt++
+			wm.intermediates = append(wm.intermediates, jr.j.intermediates...)
 			if jr.err == errNothingDone {
 				wm.skipCnt++
 				jr.err = nil
+			} else if jr.err == nil && jr.j.n.IsIntermediate {
+				wm.intermediates = append(wm.intermediates, jr.j.n.Output)
+			}
+			if jr.err != nil && KeepGoingFlag && jr.err != ErrOutOfDate {
+				wm.errs = append(wm.errs, jr.err)
+				jr.j.failed = true
+				jr.err = nil
 			}
+			wm.updateParents(jr.j)
+			wm.finishCnt++
 			if jr.err != nil {
 				err = jr.err
 				close(wm.stopChan)
 				break Loop
 			}
 		case af := <-wm.newDepChan:
-			wm.handleNewDep(af.j, af.neededBy)
-			glog.V(1).Infof("dep: %s (%d) %s", af.neededBy.n.Output, af.neededBy.numDeps, af.j.n.Output)
+			wm.handleNewDep(af.j, af.neededBy, af.orderOnly)
+			glog.V(1).Infof("dep: %s %s", af.neededBy.n.Output, af.j.n.Output)
 		case done = <-wm.waitChan:
 		}
 		err = wm.handleJobs()
@@ -331,6 +637,9 @@ Loop:
 	for w := range wm.busyWorkers {
 		w.Wait()
 	}
+	if err == nil && len(wm.errs) > 0 {
+		err = wm.errs
+	}
 	wm.doneChan <- err
 }
 
@@ -350,9 +659,9 @@ func (wm *workerManager) ReportResult(w *worker, j *job, err error) {
 	}
 }
 
-func (wm *workerManager) ReportNewDep(j *job, neededBy *job) {
+func (wm *workerManager) ReportNewDep(j *job, neededBy *job, orderOnly bool) {
 	select {
-	case wm.newDepChan <- newDep{j: j, neededBy: neededBy}:
+	case wm.newDepChan <- newDep{j: j, neededBy: neededBy, orderOnly: orderOnly}:
 	case <-wm.stopChan:
 	}
 }